@@ -5,11 +5,13 @@ trap 'trap_handler $@' INT TERM
 
 trap_handler () {
     code=$?
-    if [ $code -ne 0 ]; then
-        echo "Exit code:$code received in run.sh, waiting for $SD_TERMINATION_GRACE_PERIOD_SECONDS seconds"
-        # this trap does not wait for launcher SIGTERM processing completion 
-        # so add sleep until timeoutgraceperiodseconds is elapsed
-        sleep $SD_TERMINATION_GRACE_PERIOD_SECONDS
+    if [ $code -ne 0 ] && [ -n "$launch_pid" ]; then
+        echo "Exit code:$code received in run.sh, waiting for the launcher to stop the build"
+        # the launcher stops the steps itself, within the termination grace period of the build,
+        # and runs the teardowns; the container lives until it is done
+        while kill -0 "$launch_pid" 2>/dev/null; do
+            wait "$launch_pid"
+        done
     fi
 }
 
@@ -37,7 +39,15 @@ echo "run launch"
 # wrapper script for run build in multiple executors.
 if [ "$SD_AWS_INTEGRATION" = "true" ]; then
   # use environment variables from aws codebuild executor
-  SD_TOKEN=`/opt/sd/launch --only-fetch-token --token "$TOKEN" --api-uri "$API" --store-uri "$STORE" --ui-uri "$UI" --emitter /sd/emitter --build-timeout "$TIMEOUT" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$SDBUILDID"` && (/opt/sd/launch --token "$SD_TOKEN" --api-uri "$API" --store-uri "$STORE" --ui-uri "$UI" --emitter /sd/emitter --build-timeout "$TIMEOUT" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$SDBUILDID" & /opt/sd/logservice --token "$SD_TOKEN" --emitter /sd/emitter --api-uri "$API" --store-uri "$STORE" --build "$SDBUILDID" & wait $(jobs -p))
+  SD_TOKEN=`/opt/sd/launch --only-fetch-token --token "$TOKEN" --api-uri "$API" --store-uri "$STORE" --ui-uri "$UI" --emitter /sd/emitter --build-timeout "$TIMEOUT" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$SDBUILDID"`
+  /opt/sd/launch --token "$SD_TOKEN" --api-uri "$API" --store-uri "$STORE" --ui-uri "$UI" --emitter /sd/emitter --build-timeout "$TIMEOUT" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$SDBUILDID" &
+  launch_pid=$!
+  /opt/sd/logservice --token "$SD_TOKEN" --emitter /sd/emitter --api-uri "$API" --store-uri "$STORE" --build "$SDBUILDID" &
+  wait $(jobs -p)
 else
-  SD_TOKEN=`/opt/sd/launch --only-fetch-token --token "$1" --api-uri "$2" --store-uri "$3" --ui-uri "$6" --emitter /sd/emitter --build-timeout "$4" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$5"` && (/opt/sd/launch --token "$SD_TOKEN" --api-uri "$2" --store-uri "$3" --ui-uri "$6" --emitter /sd/emitter --build-timeout "$4" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$5" & /opt/sd/logservice --token "$SD_TOKEN" --emitter /sd/emitter --api-uri "$2" --store-uri "$3" --build "$5" & wait $(jobs -p))
+  SD_TOKEN=`/opt/sd/launch --only-fetch-token --token "$1" --api-uri "$2" --store-uri "$3" --ui-uri "$6" --emitter /sd/emitter --build-timeout "$4" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$5"`
+  /opt/sd/launch --token "$SD_TOKEN" --api-uri "$2" --store-uri "$3" --ui-uri "$6" --emitter /sd/emitter --build-timeout "$4" --cache-strategy "$7" --pipeline-cache-dir "$8" --job-cache-dir "$9" --event-cache-dir "${10}" --cache-compress "${11}" --cache-md5check "${12}" --cache-max-size-mb "${13}" --cache-max-go-threads "${14}" "$5" &
+  launch_pid=$!
+  /opt/sd/logservice --token "$SD_TOKEN" --emitter /sd/emitter --api-uri "$2" --store-uri "$3" --build "$5" &
+  wait $(jobs -p)
 fi
@@ -0,0 +1,352 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package controlpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	// Steps returns the steps so far and whether the build is paused, then, with follow, their
+	// starts and stops until the build is complete
+	Steps(ctx context.Context, in *StepsRequest, opts ...grpc.CallOption) (Control_StepsClient, error)
+	// Tail returns the last lines of output of the build, then, with follow, its new lines until the
+	// build is complete
+	Tail(ctx context.Context, in *TailRequest, opts ...grpc.CallOption) (Control_TailClient, error)
+	// Env returns the environment of the build with its secrets masked
+	Env(ctx context.Context, in *EnvRequest, opts ...grpc.CallOption) (*EnvResponse, error)
+	// Pause makes the build wait before its next user step until it is resumed
+	Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseResponse, error)
+	// Resume lets a paused build go on
+	Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*ResumeResponse, error)
+	// Abort aborts the build like SIGTERM
+	Abort(ctx context.Context, in *AbortRequest, opts ...grpc.CallOption) (*AbortResponse, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) Steps(ctx context.Context, in *StepsRequest, opts ...grpc.CallOption) (Control_StepsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[0], "/screwdriver.launcher.control.v1.Control/Steps", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlStepsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Control_StepsClient interface {
+	Recv() (*StepsResponse, error)
+	grpc.ClientStream
+}
+
+type controlStepsClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlStepsClient) Recv() (*StepsResponse, error) {
+	m := new(StepsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *controlClient) Tail(ctx context.Context, in *TailRequest, opts ...grpc.CallOption) (Control_TailClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[1], "/screwdriver.launcher.control.v1.Control/Tail", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlTailClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Control_TailClient interface {
+	Recv() (*TailResponse, error)
+	grpc.ClientStream
+}
+
+type controlTailClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlTailClient) Recv() (*TailResponse, error) {
+	m := new(TailResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *controlClient) Env(ctx context.Context, in *EnvRequest, opts ...grpc.CallOption) (*EnvResponse, error) {
+	out := new(EnvResponse)
+	err := c.cc.Invoke(ctx, "/screwdriver.launcher.control.v1.Control/Env", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseResponse, error) {
+	out := new(PauseResponse)
+	err := c.cc.Invoke(ctx, "/screwdriver.launcher.control.v1.Control/Pause", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*ResumeResponse, error) {
+	out := new(ResumeResponse)
+	err := c.cc.Invoke(ctx, "/screwdriver.launcher.control.v1.Control/Resume", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Abort(ctx context.Context, in *AbortRequest, opts ...grpc.CallOption) (*AbortResponse, error) {
+	out := new(AbortResponse)
+	err := c.cc.Invoke(ctx, "/screwdriver.launcher.control.v1.Control/Abort", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility
+type ControlServer interface {
+	// Steps returns the steps so far and whether the build is paused, then, with follow, their
+	// starts and stops until the build is complete
+	Steps(*StepsRequest, Control_StepsServer) error
+	// Tail returns the last lines of output of the build, then, with follow, its new lines until the
+	// build is complete
+	Tail(*TailRequest, Control_TailServer) error
+	// Env returns the environment of the build with its secrets masked
+	Env(context.Context, *EnvRequest) (*EnvResponse, error)
+	// Pause makes the build wait before its next user step until it is resumed
+	Pause(context.Context, *PauseRequest) (*PauseResponse, error)
+	// Resume lets a paused build go on
+	Resume(context.Context, *ResumeRequest) (*ResumeResponse, error)
+	// Abort aborts the build like SIGTERM
+	Abort(context.Context, *AbortRequest) (*AbortResponse, error)
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (UnimplementedControlServer) Steps(*StepsRequest, Control_StepsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Steps not implemented")
+}
+func (UnimplementedControlServer) Tail(*TailRequest, Control_TailServer) error {
+	return status.Errorf(codes.Unimplemented, "method Tail not implemented")
+}
+func (UnimplementedControlServer) Env(context.Context, *EnvRequest) (*EnvResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Env not implemented")
+}
+func (UnimplementedControlServer) Pause(context.Context, *PauseRequest) (*PauseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Pause not implemented")
+}
+func (UnimplementedControlServer) Resume(context.Context, *ResumeRequest) (*ResumeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resume not implemented")
+}
+func (UnimplementedControlServer) Abort(context.Context, *AbortRequest) (*AbortResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Abort not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_Steps_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StepsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).Steps(m, &controlStepsServer{stream})
+}
+
+type Control_StepsServer interface {
+	Send(*StepsResponse) error
+	grpc.ServerStream
+}
+
+type controlStepsServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlStepsServer) Send(m *StepsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Control_Tail_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TailRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).Tail(m, &controlTailServer{stream})
+}
+
+type Control_TailServer interface {
+	Send(*TailResponse) error
+	grpc.ServerStream
+}
+
+type controlTailServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlTailServer) Send(m *TailResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Control_Env_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnvRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Env(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/screwdriver.launcher.control.v1.Control/Env",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Env(ctx, req.(*EnvRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Pause_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PauseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Pause(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/screwdriver.launcher.control.v1.Control/Pause",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Pause(ctx, req.(*PauseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Resume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResumeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Resume(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/screwdriver.launcher.control.v1.Control/Resume",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Resume(ctx, req.(*ResumeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Abort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AbortRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Abort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/screwdriver.launcher.control.v1.Control/Abort",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Abort(ctx, req.(*AbortRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "screwdriver.launcher.control.v1.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Env",
+			Handler:    _Control_Env_Handler,
+		},
+		{
+			MethodName: "Pause",
+			Handler:    _Control_Pause_Handler,
+		},
+		{
+			MethodName: "Resume",
+			Handler:    _Control_Resume_Handler,
+		},
+		{
+			MethodName: "Abort",
+			Handler:    _Control_Abort_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Steps",
+			Handler:       _Control_Steps_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Tail",
+			Handler:       _Control_Tail_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
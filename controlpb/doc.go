@@ -0,0 +1,5 @@
+// Package controlpb is the gRPC control service of the launcher, which sidecars and wrapper agents
+// observe and control the running build with over the Unix socket SD_CONTROL_SOCKET
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
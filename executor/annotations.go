@@ -0,0 +1,120 @@
+package executor
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// How many step timings and annotations may wait to be sent before new ones are dropped
+	annotationQueueSize = 64
+	// How long the end of the build waits for the pending step timings and annotations to be sent
+	annotationFlushTimeout = 10 * time.Second
+)
+
+// stepAnnotation is the timings of one step waiting to be sent, or the annotations of the source it
+// reported if problems is not nil
+type stepAnnotation struct {
+	step     string
+	timings  screwdriver.StepTimings
+	problems []screwdriver.Annotation
+}
+
+// stepAnnotator sends the fine-grained timings of the steps and the annotations of the source they
+// reported to the API in the background, so a slow API never delays the build
+type stepAnnotator struct {
+	api     screwdriver.API
+	buildID int
+	queue   chan stepAnnotation
+	done    chan struct{}
+}
+
+func newStepAnnotator(api screwdriver.API, buildID int) *stepAnnotator {
+	a := &stepAnnotator{
+		api:     api,
+		buildID: buildID,
+		queue:   make(chan stepAnnotation, annotationQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(a.done)
+		for annotation := range a.queue {
+			if annotation.problems != nil {
+				if err := a.api.UpdateStepAnnotations(a.buildID, annotation.step, annotation.problems); err != nil {
+					logger.Warnf("Failed to update the annotations of step %q: %v", annotation.step, err)
+				}
+				continue
+			}
+			if err := a.api.UpdateStepTimings(a.buildID, annotation.step, annotation.timings); err != nil {
+				logger.Warnf("Failed to update the timings of step %q: %v", annotation.step, err)
+			}
+		}
+	}()
+
+	return a
+}
+
+// Queues the timings of step to be sent, dropping them if too many are pending
+func (a *stepAnnotator) add(step string, timings screwdriver.StepTimings) {
+	select {
+	case a.queue <- stepAnnotation{step: step, timings: timings}:
+	default:
+		logger.Warnf("Dropping the timings of step %q, too many are waiting to be sent", step)
+	}
+}
+
+// Queues the annotations of the source step reported to be sent, dropping them if too many are
+// pending. Nothing is sent without annotations.
+func (a *stepAnnotator) addProblems(step string, problems []screwdriver.Annotation) {
+	if len(problems) == 0 {
+		return
+	}
+	select {
+	case a.queue <- stepAnnotation{step: step, problems: problems}:
+	default:
+		logger.Warnf("Dropping the annotations of step %q, too many are waiting to be sent", step)
+	}
+}
+
+// Close waits up to timeout for the pending timings and annotations to be sent
+func (a *stepAnnotator) Close(timeout time.Duration) {
+	close(a.queue)
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		logger.Warnf("Gave up sending the pending step timings and annotations after %v", timeout)
+	}
+}
+
+// firstReadReader records when the first read from r returned data
+type firstReadReader struct {
+	r     io.Reader
+	first int64 // unix nanoseconds, 0 until the first read
+}
+
+func (f *firstReadReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 {
+		atomic.CompareAndSwapInt64(&f.first, 0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Returns how long after start the first data was read, or 0 if nothing was read yet
+func (f *firstReadReader) since(start time.Time) time.Duration {
+	first := atomic.LoadInt64(&f.first)
+	if first == 0 {
+		return 0
+	}
+	return time.Unix(0, first).Sub(start)
+}
+
+// Returns d in milliseconds, with a microsecond precision
+func millis(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
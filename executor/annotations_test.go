@@ -0,0 +1,94 @@
+package executor
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestStepAnnotatorSendsTimings(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]screwdriver.StepTimings{}
+	api := MockAPI{
+		stepTimings: func(buildID int, stepName string, timings screwdriver.StepTimings) {
+			mu.Lock()
+			defer mu.Unlock()
+			got[stepName] = timings
+		},
+	}
+
+	a := newStepAnnotator(api, 1)
+	a.add("install", screwdriver.StepTimings{ScriptWriteMs: 1})
+	a.add("test", screwdriver.StepTimings{StepStopUpdateMs: 2})
+	a.Close(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got["install"].ScriptWriteMs != 1 || got["test"].StepStopUpdateMs != 2 {
+		t.Errorf("Unexpected timings sent: %+v", got)
+	}
+}
+
+func TestStepAnnotatorDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	api := MockAPI{
+		stepTimings: func(buildID int, stepName string, timings screwdriver.StepTimings) {
+			<-release
+		},
+	}
+
+	a := newStepAnnotator(api, 1)
+	start := time.Now()
+	for i := 0; i < annotationQueueSize+10; i++ {
+		a.add("step", screwdriver.StepTimings{})
+	}
+	a.Close(100 * time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Errorf("a stuck API should not block the build, took %v", time.Since(start))
+	}
+}
+
+func TestFirstReadReader(t *testing.T) {
+	start := time.Now()
+	r := &firstReadReader{r: strings.NewReader("output")}
+	if r.since(start) != 0 {
+		t.Errorf("nothing was read yet")
+	}
+
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	first := r.since(start)
+	if first <= 0 {
+		t.Errorf("expected the time of the first read, got %v", first)
+	}
+
+	r.Read(make([]byte, 1))
+	if r.since(start) != first {
+		t.Errorf("later reads should not change the first read time")
+	}
+
+	empty := &firstReadReader{r: iotestErrReader{}}
+	empty.Read(make([]byte, 1))
+	if empty.since(start) != 0 {
+		t.Errorf("a failed read is not a first read")
+	}
+}
+
+type iotestErrReader struct{}
+
+func (iotestErrReader) Read(p []byte) (int, error) {
+	return 0, errors.New("closed")
+}
+
+func TestMillis(t *testing.T) {
+	if got := millis(1500 * time.Microsecond); got != 1.5 {
+		t.Errorf("millis() = %v, want 1.5", got)
+	}
+}
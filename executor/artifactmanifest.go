@@ -0,0 +1,200 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// artifactsManifestFile is the name of the artifact listing every artifact of the build
+	artifactsManifestFile = "artifacts-manifest.json"
+	// maxMetaArtifacts bounds the artifacts listed in the build meta, the manifest has them all
+	maxMetaArtifacts = 100
+)
+
+// artifactEntry is an artifact of the build in the manifest. Step is the step that wrote it, empty
+// for the ones of the launcher, and Retention its retention class, if any.
+type artifactEntry struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"contentType"`
+	Step        string `json:"step,omitempty"`
+	Retention   string `json:"retention,omitempty"`
+}
+
+// artifactStamp tells whether a file changed since it was last seen
+type artifactStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// artifactTracker attributes the files of the artifacts dir to the steps that wrote them, by
+// looking for the new and changed files after each step
+type artifactTracker struct {
+	dir       string
+	seen      map[string]artifactStamp
+	steps     map[string]string
+	retention *artifactRetention
+}
+
+// Returns the tracker of the artifacts dir dir, giving the artifacts their class of retention, or
+// nil if there is none. The files already there are the launcher's.
+func newArtifactTracker(dir string, retention *artifactRetention) *artifactTracker {
+	if dir == "" {
+		return nil
+	}
+	t := &artifactTracker{dir: dir, seen: map[string]artifactStamp{}, steps: map[string]string{}, retention: retention}
+	t.scan("")
+	return t
+}
+
+// Calls fn with the path relative to the artifacts dir of each of its regular files, but the
+// manifest
+func (t *artifactTracker) walk(fn func(name string, info fs.FileInfo)) {
+	filepath.WalkDir(t.dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(t.dir, file)
+		if err != nil || name == artifactsManifestFile {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			fn(filepath.ToSlash(name), info)
+		}
+		return nil
+	})
+}
+
+// Attributes the files written since the last scan to step
+func (t *artifactTracker) scan(step string) {
+	if t == nil {
+		return
+	}
+	t.walk(func(name string, info fs.FileInfo) {
+		stamp := artifactStamp{info.Size(), info.ModTime()}
+		if seen, ok := t.seen[name]; !ok || seen != stamp {
+			t.seen[name] = stamp
+			t.steps[name] = step
+		}
+	})
+}
+
+// Returns the entries of the artifacts in the order of their names, with their checksum and
+// content type
+func (t *artifactTracker) entries() []artifactEntry {
+	entries := []artifactEntry{}
+	t.walk(func(name string, info fs.FileInfo) {
+		sum, contentType, err := artifactDigest(filepath.Join(t.dir, filepath.FromSlash(name)))
+		if err != nil {
+			return
+		}
+		entries = append(entries, artifactEntry{
+			Name:        name,
+			Size:        info.Size(),
+			SHA256:      sum,
+			ContentType: contentType,
+			Step:        t.steps[name],
+			Retention:   t.retention.class(name, t.steps[name]),
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Returns the hex SHA256 and the content type of the file at path, from its extension or else
+// from its first bytes
+func artifactDigest(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	h := sha256.New()
+	h.Write(head[:n])
+	if _, err := io.Copy(h, f); err != nil {
+		return "", "", err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(head[:n])
+	}
+	return hex.EncodeToString(h.Sum(nil)), contentType, nil
+}
+
+// Writes the manifest of the artifacts to the artifacts dir, so it is uploaded with them, and its
+// summary to the build meta at metaPath if not empty, returning the entries of the manifest
+func (t *artifactTracker) writeManifest(metaPath string) ([]artifactEntry, error) {
+	entries := t.entries()
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(t.dir, artifactsManifestFile), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	if metaPath == "" {
+		return entries, nil
+	}
+	return entries, writeArtifactsMeta(metaPath, entries)
+}
+
+// Sets "artifacts" in the build meta at metaPath to the summary of entries: the name of the
+// manifest, the number and total size of the artifacts and the first of them with their checksum,
+// which the API shows and the downstream jobs read
+func writeArtifactsMeta(metaPath string, entries []artifactEntry) error {
+	var totalBytes int64
+	files := []map[string]interface{}{}
+	for i, entry := range entries {
+		totalBytes += entry.Size
+		if i < maxMetaArtifacts {
+			files = append(files, map[string]interface{}{"name": entry.Name, "size": entry.Size, "sha256": entry.SHA256})
+		}
+	}
+	return updateBuildMeta(metaPath, func(meta map[string]interface{}) {
+		meta["artifacts"] = map[string]interface{}{
+			"manifest":   artifactsManifestFile,
+			"count":      len(entries),
+			"totalBytes": totalBytes,
+			"files":      files,
+		}
+	})
+}
+
+// Reads the build meta at metaPath, missing or empty if the steps set none, has update change it
+// and writes it back
+func updateBuildMeta(metaPath string, update func(meta map[string]interface{})) error {
+	meta := map[string]interface{}{}
+	if data, err := ioutil.ReadFile(metaPath); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	update(meta)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, data, 0666)
+}
@@ -0,0 +1,125 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestArtifactDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, test := range map[string]struct{ content, sum, contentType string }{
+		"report.json": {`{"ok": true}`, "6bc0da1f42f96fc37b8bd7ed20ba57606d2a0da5cda2b135c7854fbdc985b8a3", "application/json"},
+		"empty":       {"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "text/plain; charset=utf-8"},
+		"index":       {"<html><body>", "3f7af3768d0a5463f3cfd93c47864c3f654c8cdb65e4ca6b24d5772365e6dee4", "text/html; charset=utf-8"},
+	} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(test.content), 0644)
+		if sum, contentType, err := artifactDigest(path); err != nil || sum != test.sum || contentType != test.contentType {
+			t.Errorf("artifactDigest(%s) = %s, %s, %v, want %s, %s", name, sum, contentType, err, test.sum, test.contentType)
+		}
+	}
+}
+
+func TestWriteArtifactsMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metaPath := filepath.Join(dir, "meta.json")
+	ioutil.WriteFile(metaPath, []byte(`{"foo": "bar"}`), 0666)
+
+	var entries []artifactEntry
+	for i := 0; i < maxMetaArtifacts+1; i++ {
+		entries = append(entries, artifactEntry{Name: "file", Size: 2, SHA256: "abc"})
+	}
+	if err := writeArtifactsMeta(metaPath, entries); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var meta struct {
+		Foo       string `json:"foo"`
+		Artifacts struct {
+			Manifest   string                   `json:"manifest"`
+			Count      int                      `json:"count"`
+			TotalBytes int64                    `json:"totalBytes"`
+			Files      []map[string]interface{} `json:"files"`
+		} `json:"artifacts"`
+	}
+	data, _ := ioutil.ReadFile(metaPath)
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if meta.Foo != "bar" || meta.Artifacts.Manifest != artifactsManifestFile || meta.Artifacts.Count != maxMetaArtifacts+1 ||
+		meta.Artifacts.TotalBytes != 2*(maxMetaArtifacts+1) || len(meta.Artifacts.Files) != maxMetaArtifacts {
+		t.Errorf("Unexpected meta %s", data)
+	}
+}
+
+func TestRunWritesArtifactsManifest(t *testing.T) {
+	envFilepath := "/tmp/testArtifactsManifest"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	artifactsDir := filepath.Join(dir, "artifacts")
+	os.MkdirAll(artifactsDir, 0755)
+	ioutil.WriteFile(filepath.Join(artifactsDir, "steps.json"), []byte("[]"), 0644)
+	metaPath := filepath.Join(dir, "meta.json")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "build", Cmd: "mkdir -p $SD_ARTIFACTS_DIR/dist && echo launcher > $SD_ARTIFACTS_DIR/dist/launcher.txt"},
+			{Name: "teardown-report", Cmd: "echo '<testsuite/>' > $SD_ARTIFACTS_DIR/junit.xml"},
+			// The artifacts are uploaded with their manifest
+			{Name: "sd-teardown-upload", Cmd: "test -f $SD_ARTIFACTS_DIR/" + artifactsManifestFile},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	env := []string{"SD_ARTIFACTS_DIR=" + artifactsDir, "SD_META_PATH=" + metaPath}
+	if err := Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if codes["sd-teardown-upload"] != 0 {
+		t.Errorf("The manifest should be written before the Screwdriver teardowns: %v", codes)
+	}
+
+	var entries []artifactEntry
+	data, _ := ioutil.ReadFile(filepath.Join(artifactsDir, artifactsManifestFile))
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, data)
+	}
+	steps := map[string]string{}
+	for _, entry := range entries {
+		steps[entry.Name] = entry.Step
+		if entry.SHA256 == "" || entry.ContentType == "" {
+			t.Errorf("The entry should have a checksum and a content type: %+v", entry)
+		}
+	}
+	if want := map[string]string{"dist/launcher.txt": "build", "junit.xml": "teardown-report", "steps.json": ""}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("The artifacts were written by %v, want %v", steps, want)
+	}
+	if data, _ := ioutil.ReadFile(metaPath); !json.Valid(data) || len(data) == 0 {
+		t.Errorf("The build meta should have the artifacts: %s", data)
+	}
+}
@@ -0,0 +1,95 @@
+package executor
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// retentionTag is the tag of the objects of the artifacts with their retention class
+	retentionTag = "retention"
+	// retentionHeader is the header of the uploads to the Store with the retention class
+	retentionHeader = "X-Retention-Class"
+)
+
+// retentionClassPattern is what a retention class looks like, so it fits in the tags and headers
+// of every store
+var retentionClassPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// artifactRetention gives the artifacts of a build their retention class: the one of the first
+// rule matching the artifact, or else the one of the step that wrote it, or else the default
+type artifactRetention struct {
+	def   string
+	rules []screwdriver.ArtifactRetentionRule
+	// steps are the classes of the artifacts of the steps, by name
+	steps map[string]string
+}
+
+// Returns the retention classes of spec and of the steps of commands, or nil if none is set
+func newArtifactRetention(spec *screwdriver.ArtifactRetention, commands []screwdriver.CommandDef) (*artifactRetention, error) {
+	r := &artifactRetention{steps: map[string]string{}}
+	if spec != nil {
+		if spec.Default != "" {
+			if err := checkRetentionClass(spec.Default); err != nil {
+				return nil, err
+			}
+		}
+		for _, rule := range spec.Rules {
+			if err := checkArtifactPattern(rule.Pattern); err != nil {
+				return nil, err
+			}
+			if err := checkRetentionClass(rule.Class); err != nil {
+				return nil, err
+			}
+		}
+		r.def, r.rules = spec.Default, spec.Rules
+	}
+	for _, cmd := range commands {
+		if cmd.ArtifactRetention == "" {
+			continue
+		}
+		if err := checkRetentionClass(cmd.ArtifactRetention); err != nil {
+			return nil, fmt.Errorf("Step %q: %v", cmd.Name, err)
+		}
+		r.steps[cmd.Name] = cmd.ArtifactRetention
+	}
+	if r.def == "" && len(r.rules) == 0 && len(r.steps) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Checks class is a valid retention class
+func checkRetentionClass(class string) error {
+	if !retentionClassPattern.MatchString(class) {
+		return fmt.Errorf("Invalid retention class %q, want up to 63 letters, digits, '.', '_' and '-'", class)
+	}
+	return nil
+}
+
+// Returns the retention class of the artifact name, with slashes, written by step, or empty if it
+// has none
+func (r *artifactRetention) class(name, step string) string {
+	if r == nil {
+		return ""
+	}
+	for _, rule := range r.rules {
+		if matchArtifactPattern(rule.Pattern, name) {
+			return rule.Class
+		}
+	}
+	if class, ok := r.steps[step]; ok {
+		return class
+	}
+	return r.def
+}
+
+// Returns the tags of the object of an artifact of class, nil if it has none
+func retentionTags(class string) map[string]string {
+	if class == "" {
+		return nil
+	}
+	return map[string]string{retentionTag: class}
+}
@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestNewArtifactRetention(t *testing.T) {
+	commands := []screwdriver.CommandDef{{Name: "build"}, {Name: "package", ArtifactRetention: "release"}}
+	if r, err := newArtifactRetention(nil, commands[:1]); r != nil || err != nil {
+		t.Errorf("newArtifactRetention() without classes = %v, %v, want none", r, err)
+	}
+	for _, spec := range []screwdriver.ArtifactRetention{
+		{Default: "30 days"},
+		{Rules: []screwdriver.ArtifactRetentionRule{{Pattern: "dist/*", Class: ""}}},
+		{Rules: []screwdriver.ArtifactRetentionRule{{Pattern: "../dist/*", Class: "release"}}},
+	} {
+		if _, err := newArtifactRetention(&spec, commands); err == nil {
+			t.Errorf("newArtifactRetention(%+v) should fail", spec)
+		}
+	}
+	if _, err := newArtifactRetention(nil, []screwdriver.CommandDef{{Name: "build", ArtifactRetention: "-1d"}}); err == nil {
+		t.Errorf("newArtifactRetention() with an invalid step class should fail")
+	}
+	r, err := newArtifactRetention(nil, commands)
+	if err != nil || r == nil || !reflect.DeepEqual(r.steps, map[string]string{"package": "release"}) {
+		t.Errorf("newArtifactRetention() = %+v, %v", r, err)
+	}
+}
+
+func TestArtifactRetentionClass(t *testing.T) {
+	spec := &screwdriver.ArtifactRetention{
+		Default: "30d",
+		Rules:   []screwdriver.ArtifactRetentionRule{{Pattern: "**/*.log", Class: "ephemeral"}},
+	}
+	r, err := newArtifactRetention(spec, []screwdriver.CommandDef{{Name: "package", ArtifactRetention: "release"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, test := range []struct{ name, step, class string }{
+		{"dist/app.tar.gz", "package", "release"},
+		{"logs/package.log", "package", "ephemeral"},
+		{"coverage.json", "test", "30d"},
+		{"steps.json", "", "30d"},
+	} {
+		if class := r.class(test.name, test.step); class != test.class {
+			t.Errorf("class(%s, %s) = %q, want %q", test.name, test.step, class, test.class)
+		}
+	}
+	if class := (*artifactRetention)(nil).class("dist/app.tar.gz", "package"); class != "" {
+		t.Errorf("class() without retention = %q, want none", class)
+	}
+}
+
+func TestRunTagsArtifactRetention(t *testing.T) {
+	envFilepath := "/tmp/testArtifactRetention"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, server := newFakeArtifactStore()
+	defer server.Close()
+	defer os.Setenv("SD_ARTIFACT_UPLOAD", os.Getenv("SD_ARTIFACT_UPLOAD"))
+	os.Setenv("SD_ARTIFACT_UPLOAD", "true")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "package", Cmd: `echo app > "$SD_ARTIFACTS_DIR/app.tar.gz"; echo done > "$SD_ARTIFACTS_DIR/package.log"`, ArtifactRetention: "release"},
+			{Name: "test", Cmd: `echo '{}' > "$SD_ARTIFACTS_DIR/coverage.json"`},
+		},
+		Environment: []map[string]string{},
+		ArtifactRetention: &screwdriver.ArtifactRetention{
+			Default: "30d",
+			Rules:   []screwdriver.ArtifactRetentionRule{{Pattern: "*.log", Class: "ephemeral"}},
+		},
+	}
+	env := []string{"SD_ARTIFACTS_DIR=" + dir, "SD_STORE_URL=" + server.URL + "/v1/", "SD_TOKEN=build-token"}
+	if err := Run(dir, env, &MockEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := map[string]string{"app.tar.gz": "release", "package.log": "ephemeral", "coverage.json": "30d"}
+	for name, class := range want {
+		if got := store.classes["/v1/builds/12345/ARTIFACTS/"+name]; got != class {
+			t.Errorf("%s should be uploaded with the class %q, got %q", name, class, got)
+		}
+	}
+	var entries []artifactEntry
+	data, _ := ioutil.ReadFile(filepath.Join(dir, artifactsManifestFile))
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, data)
+	}
+	for _, entry := range entries {
+		if class, ok := want[entry.Name]; ok && entry.Retention != class {
+			t.Errorf("The manifest entry of %s should have the class %q, got %q", entry.Name, class, entry.Retention)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// artifactPatternsFile is the name of the artifact listing the files the artifact patterns
+	// matched
+	artifactPatternsFile = "artifact-patterns.json"
+	// The default size limits of the collected files
+	defaultArtifactMaxFileBytes  = 100 << 20
+	defaultArtifactMaxTotalBytes = 1 << 30
+)
+
+// collectedArtifact is a file matching an artifact pattern, Skipped saying why it was not
+// collected if it was not
+type collectedArtifact struct {
+	Path    string `json:"path"`
+	Pattern string `json:"pattern"`
+	Size    int64  `json:"size"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// artifactManifest is what the artifact patterns of a build matched
+type artifactManifest struct {
+	Patterns []string            `json:"patterns"`
+	Files    []collectedArtifact `json:"files"`
+	// TotalBytes is the size of the collected files
+	TotalBytes int64 `json:"totalBytes"`
+}
+
+// artifactCollector copies the files of the source directory matching the artifact patterns of a
+// build to its artifacts dir, which the Screwdriver teardowns upload
+type artifactCollector struct {
+	patterns      []string
+	maxFileBytes  int64
+	maxTotalBytes int64
+}
+
+// Returns the collector of the files matching patterns, with the size limits per file and in total
+// of SD_ARTIFACT_MAX_FILE_BYTES and SD_ARTIFACT_MAX_TOTAL_BYTES in the launcher environment, or
+// nil if there are no patterns
+func newArtifactCollector(patterns []string) (*artifactCollector, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range patterns {
+		if err := checkArtifactPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	maxFileBytes, err := artifactLimit("SD_ARTIFACT_MAX_FILE_BYTES", defaultArtifactMaxFileBytes)
+	if err != nil {
+		return nil, err
+	}
+	maxTotalBytes, err := artifactLimit("SD_ARTIFACT_MAX_TOTAL_BYTES", defaultArtifactMaxTotalBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactCollector{patterns: patterns, maxFileBytes: maxFileBytes, maxTotalBytes: maxTotalBytes}, nil
+}
+
+// Returns the size limit of the variable name in the launcher environment, or def if it is not set
+func artifactLimit(name string, def int64) (int64, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid %s %q, want a positive number of bytes", name, value)
+	}
+	return n, nil
+}
+
+// Checks pattern is a valid pattern of path.Match, where ** matches any number of directories,
+// relative to the source directory and staying in it
+func checkArtifactPattern(pattern string) error {
+	if pattern == "" || path.IsAbs(pattern) {
+		return fmt.Errorf("Invalid artifact pattern %q, want a path relative to the source directory", pattern)
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == ".." {
+			return fmt.Errorf("Invalid artifact pattern %q, it leaves the source directory", pattern)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("Invalid artifact pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Returns whether the slash separated path name matches pattern
+func matchArtifactPattern(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Returns the first pattern matching the slash separated path name, if any
+func (a *artifactCollector) match(name string) (string, bool) {
+	for _, pattern := range a.patterns {
+		if matchArtifactPattern(pattern, name) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// Copies the regular files of sourceDir matching the patterns to the same relative paths in
+// artifactsDir, in the order of their paths, until the size limits are reached, and writes the
+// manifest of what they matched. Symlinks are never followed, nor are the files already in
+// artifactsDir collected again.
+func (a *artifactCollector) collect(sourceDir, artifactsDir string) (artifactManifest, error) {
+	manifest := artifactManifest{Patterns: a.patterns, Files: []collectedArtifact{}}
+	if sourceDir == "" || artifactsDir == "" {
+		return manifest, fmt.Errorf("No source directory or artifacts dir to collect the artifacts of")
+	}
+
+	err := filepath.WalkDir(sourceDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are left out
+			return nil
+		}
+		if d.IsDir() && file == artifactsDir {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(sourceDir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		pattern, ok := a.match(rel)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		artifact := collectedArtifact{Path: rel, Pattern: pattern, Size: info.Size()}
+		switch {
+		case artifact.Size > a.maxFileBytes:
+			artifact.Skipped = fmt.Sprintf("Larger than the limit of %d bytes per file", a.maxFileBytes)
+		case manifest.TotalBytes+artifact.Size > a.maxTotalBytes:
+			artifact.Skipped = fmt.Sprintf("Over the limit of %d bytes in total", a.maxTotalBytes)
+		default:
+			if err := copyArtifact(file, filepath.Join(artifactsDir, filepath.FromSlash(rel)), artifact.Size); err != nil {
+				artifact.Skipped = err.Error()
+			} else {
+				manifest.TotalBytes += artifact.Size
+			}
+		}
+		manifest.Files = append(manifest.Files, artifact)
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, writeFileAtomic(filepath.Join(artifactsDir, artifactPatternsFile), append(data, '\n'), 0644)
+}
+
+// Copies size bytes of the file at src to a new file at dst, which a step may not have written
+// already
+func copyArtifact(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("Already in the artifacts dir")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(out, in, size); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// Returns the number of the files of the manifest that were collected and skipped
+func (m artifactManifest) counts() (int, int) {
+	var skipped int
+	for _, file := range m.Files {
+		if file.Skipped != "" {
+			skipped++
+		}
+	}
+	return len(m.Files) - skipped, skipped
+}
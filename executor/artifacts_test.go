@@ -0,0 +1,159 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestMatchArtifactPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"reports/*.xml", "reports/junit.xml", true},
+		{"reports/*.xml", "reports/unit/junit.xml", false},
+		{"reports/**/*.xml", "reports/junit.xml", true},
+		{"reports/**/*.xml", "reports/unit/go/junit.xml", true},
+		{"**/coverage.out", "coverage.out", true},
+		{"**/coverage.out", "pkg/coverage.out", true},
+		{"**", "any/file", true},
+		{"dist/launcher-?", "dist/launcher-1", true},
+		{"dist/*", "dist", false},
+	}
+	for _, test := range tests {
+		if got := matchArtifactPattern(test.pattern, test.name); got != test.want {
+			t.Errorf("matchArtifactPattern(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewArtifactCollector(t *testing.T) {
+	if a, err := newArtifactCollector(nil); a != nil || err != nil {
+		t.Errorf("newArtifactCollector() = %+v, %v, want none", a, err)
+	}
+	for _, pattern := range []string{"", "/etc/passwd", "../secrets/*", "dist/../../x", "reports/[.xml"} {
+		if _, err := newArtifactCollector([]string{pattern}); err == nil {
+			t.Errorf("Expected an error for pattern %q", pattern)
+		}
+	}
+
+	defer os.Unsetenv("SD_ARTIFACT_MAX_FILE_BYTES")
+	os.Setenv("SD_ARTIFACT_MAX_FILE_BYTES", "1024")
+	a, err := newArtifactCollector([]string{"dist/*"})
+	if err != nil || a.maxFileBytes != 1024 || a.maxTotalBytes != defaultArtifactMaxTotalBytes {
+		t.Errorf("newArtifactCollector() = %+v, %v, want 1024 bytes per file", a, err)
+	}
+	os.Setenv("SD_ARTIFACT_MAX_FILE_BYTES", "0")
+	if _, err := newArtifactCollector([]string{"dist/*"}); err == nil {
+		t.Errorf("Expected an error for a limit of 0 bytes")
+	}
+}
+
+func TestCollectArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sourceDir := filepath.Join(dir, "src")
+	artifactsDir := filepath.Join(sourceDir, "artifacts")
+	for name, size := range map[string]int{
+		"reports/a.xml":     10,
+		"reports/b.xml":     20,
+		"reports/big.xml":   100,
+		"reports/c.xml":     30,
+		"reports/go/d.xml":  5,
+		"reports/notes.txt": 5,
+		"artifacts/x.xml":   5,
+	} {
+		path := filepath.Join(sourceDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, make([]byte, size), 0644)
+	}
+	os.Symlink("/etc/passwd", filepath.Join(sourceDir, "reports", "passwd.xml"))
+	// A step wrote it already
+	os.MkdirAll(filepath.Join(artifactsDir, "reports", "go"), 0755)
+	ioutil.WriteFile(filepath.Join(artifactsDir, "reports", "go", "d.xml"), []byte("mine"), 0644)
+
+	a := &artifactCollector{patterns: []string{"reports/**/*.xml", "artifacts/*"}, maxFileBytes: 50, maxTotalBytes: 45}
+	manifest, err := a.collect(sourceDir, artifactsDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := artifactManifest{
+		Patterns: a.patterns,
+		Files: []collectedArtifact{
+			{Path: "reports/a.xml", Pattern: "reports/**/*.xml", Size: 10},
+			{Path: "reports/b.xml", Pattern: "reports/**/*.xml", Size: 20},
+			{Path: "reports/big.xml", Pattern: "reports/**/*.xml", Size: 100, Skipped: "Larger than the limit of 50 bytes per file"},
+			{Path: "reports/c.xml", Pattern: "reports/**/*.xml", Size: 30, Skipped: "Over the limit of 45 bytes in total"},
+			{Path: "reports/go/d.xml", Pattern: "reports/**/*.xml", Size: 5, Skipped: "Already in the artifacts dir"},
+		},
+		TotalBytes: 30,
+	}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Errorf("collect() = %+v, want %+v", manifest, want)
+	}
+	for name, size := range map[string]int{"reports/a.xml": 10, "reports/b.xml": 20, "reports/go/d.xml": 4} {
+		if info, err := os.Stat(filepath.Join(artifactsDir, name)); err != nil || info.Size() != int64(size) {
+			t.Errorf("The artifact %s should have %d bytes: %v", name, size, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(artifactsDir, "reports", "passwd.xml")); !os.IsNotExist(err) {
+		t.Errorf("The symlink should not be collected: %v", err)
+	}
+
+	var written artifactManifest
+	data, _ := ioutil.ReadFile(filepath.Join(artifactsDir, artifactPatternsFile))
+	if err := json.Unmarshal(data, &written); err != nil || !reflect.DeepEqual(written, want) {
+		t.Errorf("The manifest artifact = %s, %v", data, err)
+	}
+}
+
+func TestRunCollectsArtifacts(t *testing.T) {
+	envFilepath := "/tmp/testArtifacts"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sourceDir := filepath.Join(dir, "src")
+	artifactsDir := filepath.Join(dir, "artifacts")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(artifactsDir, 0755)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: "mkdir -p reports && echo '<testsuite/>' > reports/junit.xml && exit 1"},
+			{Name: "teardown-check", Cmd: "test -f " + artifactsDir + "/reports/junit.xml"},
+		},
+		Environment:      []map[string]string{},
+		ArtifactPatterns: []string{"reports/*.xml"},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	env := []string{"SD_ARTIFACTS_DIR=" + artifactsDir}
+	if err := Run(sourceDir, env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, sourceDir); err == nil {
+		t.Errorf("Expected the failed step to fail the build")
+	}
+	// The teardowns see the artifacts of the failed build
+	if want := map[string]int{"test": 1, "teardown-check": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	if _, err := os.Stat(filepath.Join(artifactsDir, artifactPatternsFile)); err != nil {
+		t.Errorf("The manifest should be written: %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+const (
+	// defaultArtifactUploadInterval is how often the artifacts dir is watched during a step
+	defaultArtifactUploadInterval = time.Minute
+	// artifactUploadFlushTimeout bounds the wait for the pending uploads once the steps are done
+	artifactUploadFlushTimeout = 30 * time.Second
+)
+
+// artifactUploader uploads the artifacts of the build to the Store, or to an object store, as the
+// steps write them: the new and changed files after each step, and during a step the ones that
+// did not change since the previous look at the artifacts dir
+type artifactUploader struct {
+	dir string
+	// url is the URL of the artifacts of the build in the Store
+	url    string
+	token  string
+	client *http.Client
+	// store is the object store of SD_ARTIFACT_STORE the artifacts are uploaded to under object
+	// instead, if set
+	store  cacheStore
+	object string
+	// retention gives the artifacts the retention class passed to the store
+	retention *artifactRetention
+
+	mu sync.Mutex
+	// step is the running step, which writes the new files
+	step string
+	// uploaded are the files uploaded or queued, as they were then, and classes the retention
+	// classes of the queued ones
+	uploaded map[string]artifactStamp
+	classes  map[string]string
+	// watched are the files as they were at the previous look of the watcher
+	watched map[string]artifactStamp
+	queue   []string
+	// busy tells whether a file is being uploaded
+	busy  bool
+	wake  chan struct{}
+	count int
+	bytes int64
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopWatch chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Returns the uploader of the artifacts dir of env to the Store of build buildID, or to the object
+// store of SD_ARTIFACT_STORE, if SD_ARTIFACT_UPLOAD is true in the launcher environment, watching
+// the dir every SD_ARTIFACT_UPLOAD_INTERVAL seconds during the steps (60 by default, 0 to only
+// upload after each step). The artifacts are tagged with their class of retention. Without the
+// artifacts dir, or the Store URL and the token with no object store, it is nil with a warning.
+func newArtifactUploader(env []string, buildID int, retention *artifactRetention) (*artifactUploader, error) {
+	value := strings.TrimSpace(os.Getenv("SD_ARTIFACT_UPLOAD"))
+	if value == "" {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SD_ARTIFACT_UPLOAD %q, want true or false", value)
+	}
+	interval := defaultArtifactUploadInterval
+	if value := strings.TrimSpace(os.Getenv("SD_ARTIFACT_UPLOAD_INTERVAL")); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("Invalid SD_ARTIFACT_UPLOAD_INTERVAL %q, want a number of seconds", value)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	store, err := newObjectStore("SD_ARTIFACT_STORE")
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	dir, storeURL, token := lookupEnv(env, "SD_ARTIFACTS_DIR"), lookupEnv(env, "SD_STORE_URL"), lookupEnv(env, "SD_TOKEN")
+	if dir == "" || (store == nil && (storeURL == "" || token == "")) {
+		logger.Warnf("The artifacts are not uploaded during the build without SD_ARTIFACTS_DIR, and SD_STORE_URL and SD_TOKEN or SD_ARTIFACT_STORE")
+		return nil, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &artifactUploader{
+		dir:       dir,
+		url:       strings.TrimSuffix(storeURL, "/") + "/builds/" + strconv.Itoa(buildID) + "/ARTIFACTS/",
+		token:     token,
+		client:    &http.Client{},
+		store:     store,
+		object:    "builds/" + strconv.Itoa(buildID) + "/ARTIFACTS/",
+		retention: retention,
+		uploaded:  map[string]artifactStamp{},
+		classes:   map[string]string{},
+		watched:   map[string]artifactStamp{},
+		wake:      make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		stopWatch: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go u.upload()
+	if interval > 0 {
+		go u.watch(interval)
+	}
+	return u, nil
+}
+
+// Queues the files of the artifacts dir changed since they were uploaded, only the ones that did
+// not change since the previous call with stable if stable
+func (u *artifactUploader) sync(stable bool) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	filepath.WalkDir(u.dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(u.dir, file)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		name, stamp := filepath.ToSlash(rel), artifactStamp{info.Size(), info.ModTime()}
+		if seen, ok := u.uploaded[name]; ok && seen == stamp {
+			return nil
+		}
+		if stable {
+			if watched, ok := u.watched[name]; !ok || watched != stamp {
+				u.watched[name] = stamp
+				return nil
+			}
+		}
+		u.uploaded[name] = stamp
+		u.classes[name] = u.retention.class(name, u.step)
+		u.queue = append(u.queue, name)
+		return nil
+	})
+	if len(u.queue) > 0 {
+		select {
+		case u.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Attributes the files written from now on to the step name
+func (u *artifactUploader) stepStart(name string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.step = name
+}
+
+// Queues the files of the artifacts dir written by the step that just ended
+func (u *artifactUploader) stepDone() {
+	u.sync(false)
+	u.stepStart("")
+}
+
+// Queues the stable files of the artifacts dir every interval, until the uploader is closed
+func (u *artifactUploader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.sync(true)
+		case <-u.stopWatch:
+			return
+		}
+	}
+}
+
+// Uploads the queued files one at a time, until the uploader is closed
+func (u *artifactUploader) upload() {
+	defer close(u.done)
+	for {
+		u.mu.Lock()
+		var name string
+		if len(u.queue) > 0 {
+			name, u.queue = u.queue[0], u.queue[1:]
+		}
+		u.busy = name != ""
+		u.mu.Unlock()
+		if name == "" {
+			select {
+			case <-u.wake:
+				continue
+			case <-u.ctx.Done():
+				return
+			}
+		}
+
+		size, err := u.put(name)
+		u.mu.Lock()
+		u.busy = false
+		if err != nil {
+			// Uploaded again by a later sync
+			delete(u.uploaded, name)
+		} else {
+			u.count++
+			u.bytes += size
+		}
+		u.mu.Unlock()
+		if u.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warnf("Failed to upload the artifact %s: %v", name, err)
+		}
+	}
+}
+
+// Uploads the artifact name to the Store, or to the object store, and returns its size
+func (u *artifactUploader) put(name string) (int64, error) {
+	u.mu.Lock()
+	class := u.classes[name]
+	u.mu.Unlock()
+	if u.store != nil {
+		file := filepath.Join(u.dir, filepath.FromSlash(name))
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), u.store.Put(u.ctx, u.object+name, file, info.Size(), retentionTags(class))
+	}
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	target := u.url + strings.Join(segments, "/")
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	var f *os.File
+	var size int64
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	res, err := doStoreRequest(u.ctx, u.client, func() (*http.Request, error) {
+		if f != nil {
+			f.Close()
+		}
+		var err error
+		if f, err = os.Open(filepath.Join(u.dir, filepath.FromSlash(name))); err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+		req, err := http.NewRequest("PUT", target, io.LimitReader(f, size))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Authorization", "Bearer "+u.token)
+		req.Header.Set("Content-Type", contentType)
+		if class != "" {
+			req.Header.Set(retentionHeader, class)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return 0, storeError(res)
+	}
+	return size, nil
+}
+
+// Close waits up to timeout for the queued files to be uploaded, and stops the uploads. The
+// Screwdriver teardowns upload the artifacts not uploaded by then.
+func (u *artifactUploader) Close(timeout time.Duration) {
+	if u == nil {
+		return
+	}
+	u.closeOnce.Do(func() {
+		close(u.stopWatch)
+		deadline := time.After(timeout)
+	wait:
+		for {
+			u.mu.Lock()
+			pending := len(u.queue)
+			if u.busy {
+				pending++
+			}
+			u.mu.Unlock()
+			if pending == 0 {
+				break
+			}
+			select {
+			case <-deadline:
+				logger.Warnf("Gave up uploading %d artifacts during the build after %v", pending, timeout)
+				break wait
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		u.cancel()
+		<-u.done
+		logger.Infof("Uploaded %d artifacts of %d bytes during the build", u.count, u.bytes)
+	})
+}
@@ -0,0 +1,211 @@
+package executor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// fakeArtifactStore records the artifacts uploaded to it
+type fakeArtifactStore struct {
+	mu      sync.Mutex
+	uploads []string
+	bodies  map[string]string
+	types   map[string]string
+	classes map[string]string
+}
+
+func newFakeArtifactStore() (*fakeArtifactStore, *httptest.Server) {
+	store := &fakeArtifactStore{bodies: map[string]string{}, types: map[string]string{}, classes: map[string]string{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.Header.Get("Authorization") != "Bearer build-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		store.uploads = append(store.uploads, r.URL.EscapedPath())
+		store.bodies[r.URL.EscapedPath()] = string(body)
+		store.types[r.URL.EscapedPath()] = r.Header.Get("Content-Type")
+		store.classes[r.URL.EscapedPath()] = r.Header.Get(retentionHeader)
+	}))
+	return store, server
+}
+
+// Waits up to 5 seconds for the store to have n uploads, and returns them
+func (s *fakeArtifactStore) wait(n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		uploads := append([]string{}, s.uploads...)
+		s.mu.Unlock()
+		if len(uploads) >= n || time.Now().After(deadline) {
+			return uploads
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewArtifactUploader(t *testing.T) {
+	defer os.Setenv("SD_ARTIFACT_UPLOAD", os.Getenv("SD_ARTIFACT_UPLOAD"))
+	defer os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", os.Getenv("SD_ARTIFACT_UPLOAD_INTERVAL"))
+	defer os.Setenv("SD_ARTIFACT_STORE", os.Getenv("SD_ARTIFACT_STORE"))
+	env := []string{"SD_ARTIFACTS_DIR=/sd/workspace/artifacts", "SD_STORE_URL=https://store/v1/", "SD_TOKEN=build-token"}
+
+	for _, values := range [][3]string{{"maybe", "", ""}, {"true", "-1", ""}, {"true", "1m", ""}, {"true", "", "ftp://host/dir"}} {
+		os.Setenv("SD_ARTIFACT_UPLOAD", values[0])
+		os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", values[1])
+		os.Setenv("SD_ARTIFACT_STORE", values[2])
+		if _, err := newArtifactUploader(env, 12345, nil); err == nil {
+			t.Errorf("newArtifactUploader() with %q should fail", values)
+		}
+	}
+	os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", "")
+	os.Setenv("SD_ARTIFACT_STORE", "")
+	for _, value := range []string{"", "false"} {
+		os.Setenv("SD_ARTIFACT_UPLOAD", value)
+		if u, err := newArtifactUploader(env, 12345, nil); u != nil || err != nil {
+			t.Errorf("newArtifactUploader() with %q = %v, %v, want no uploader", value, u, err)
+		}
+	}
+	os.Setenv("SD_ARTIFACT_UPLOAD", "true")
+	if u, err := newArtifactUploader(env[1:], 12345, nil); u != nil || err != nil {
+		t.Errorf("newArtifactUploader() without artifacts dir = %v, %v, want no uploader", u, err)
+	}
+	u, err := newArtifactUploader(env, 12345, nil)
+	if err != nil || u == nil || u.url != "https://store/v1/builds/12345/ARTIFACTS/" {
+		t.Fatalf("newArtifactUploader() = %+v, %v", u, err)
+	}
+	u.Close(0)
+	// The object store needs neither the Store URL nor the token
+	os.Setenv("SD_ARTIFACT_STORE", "file:///mnt/artifacts")
+	u, err = newArtifactUploader(env[:1], 12345, nil)
+	if err != nil || u == nil || u.store != (localCacheStore{dir: "/mnt/artifacts"}) || u.object != "builds/12345/ARTIFACTS/" {
+		t.Fatalf("newArtifactUploader() = %+v, %v", u, err)
+	}
+	u.Close(0)
+}
+
+func TestArtifactUploader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifactupload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, server := newFakeArtifactStore()
+	defer server.Close()
+	defer os.Setenv("SD_ARTIFACT_UPLOAD", os.Getenv("SD_ARTIFACT_UPLOAD"))
+	defer os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", os.Getenv("SD_ARTIFACT_UPLOAD_INTERVAL"))
+	os.Setenv("SD_ARTIFACT_UPLOAD", "true")
+	os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", "0")
+
+	u, err := newArtifactUploader([]string{"SD_ARTIFACTS_DIR=" + dir, "SD_STORE_URL=" + server.URL + "/v1/", "SD_TOKEN=build-token"}, 12345, nil)
+	if err != nil || u == nil {
+		t.Fatalf("newArtifactUploader() = %v, %v", u, err)
+	}
+	defer u.Close(0)
+	os.MkdirAll(filepath.Join(dir, "test reports"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "build-output"), []byte("step 1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "test reports", "junit.xml"), []byte("<testsuite/>"), 0644)
+	u.stepDone()
+	uploads := store.wait(2)
+	if len(uploads) != 2 {
+		t.Fatalf("The files of the step should be uploaded, got %v", uploads)
+	}
+	if body := store.bodies["/v1/builds/12345/ARTIFACTS/test%20reports/junit.xml"]; body != "<testsuite/>" {
+		t.Errorf("The report should be uploaded under its escaped path, got %v", uploads)
+	}
+	if contentType := store.types["/v1/builds/12345/ARTIFACTS/build-output"]; contentType != "application/octet-stream" {
+		t.Errorf("Content-Type = %q, want application/octet-stream", contentType)
+	}
+
+	// Only the changed files are uploaded again, and the stable ones while watching
+	ioutil.WriteFile(filepath.Join(dir, "build-output"), []byte("step 1\nstep 2"), 0644)
+	u.stepDone()
+	ioutil.WriteFile(filepath.Join(dir, "coverage.json"), []byte("{}"), 0644)
+	u.sync(true)
+	if uploads := store.wait(3); len(uploads) != 3 || store.bodies["/v1/builds/12345/ARTIFACTS/build-output"] != "step 1\nstep 2" {
+		t.Errorf("The changed file should be uploaded again, got %v", uploads)
+	}
+	u.sync(true)
+	u.Close(5 * time.Second)
+	if uploads := store.wait(4); len(uploads) != 4 || uploads[3] != "/v1/builds/12345/ARTIFACTS/coverage.json" {
+		t.Errorf("The file stable since the previous look should be uploaded, got %v", uploads)
+	}
+}
+
+func TestArtifactUploaderObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifactupload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("SD_ARTIFACT_UPLOAD", os.Getenv("SD_ARTIFACT_UPLOAD"))
+	defer os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", os.Getenv("SD_ARTIFACT_UPLOAD_INTERVAL"))
+	defer os.Setenv("SD_ARTIFACT_STORE", os.Getenv("SD_ARTIFACT_STORE"))
+	os.Setenv("SD_ARTIFACT_UPLOAD", "true")
+	os.Setenv("SD_ARTIFACT_UPLOAD_INTERVAL", "0")
+	os.Setenv("SD_ARTIFACT_STORE", "file://"+filepath.Join(dir, "store"))
+
+	artifacts := filepath.Join(dir, "artifacts")
+	u, err := newArtifactUploader([]string{"SD_ARTIFACTS_DIR=" + artifacts}, 12345, nil)
+	if err != nil || u == nil {
+		t.Fatalf("newArtifactUploader() = %v, %v", u, err)
+	}
+	os.MkdirAll(filepath.Join(artifacts, "reports"), 0755)
+	ioutil.WriteFile(filepath.Join(artifacts, "reports", "junit.xml"), []byte("<testsuite/>"), 0644)
+	u.stepDone()
+	u.Close(5 * time.Second)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "store", "builds", "12345", "ARTIFACTS", "reports", "junit.xml"))
+	if err != nil || string(data) != "<testsuite/>" {
+		t.Errorf("The artifact should be in the object store, got %q, %v", data, err)
+	}
+}
+
+func TestRunUploadsArtifacts(t *testing.T) {
+	envFilepath := "/tmp/testArtifactUpload"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "artifactupload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, server := newFakeArtifactStore()
+	defer server.Close()
+	defer os.Setenv("SD_ARTIFACT_UPLOAD", os.Getenv("SD_ARTIFACT_UPLOAD"))
+	os.Setenv("SD_ARTIFACT_UPLOAD", "true")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "build", Cmd: `echo built > "$SD_ARTIFACTS_DIR/build.txt"`},
+			{Name: "check", Cmd: "true"},
+		},
+		Environment: []map[string]string{},
+	}
+	// The first step's artifact is uploaded before the second step runs
+	checked := false
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStart: func(buildID int, stepName string) error {
+			if stepName == "check" {
+				checked = len(store.wait(1)) == 1
+			}
+			return nil
+		},
+	})
+	env := []string{"SD_ARTIFACTS_DIR=" + dir, "SD_STORE_URL=" + server.URL + "/v1/", "SD_TOKEN=build-token"}
+	if err := Run(dir, env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !checked || store.bodies["/v1/builds/12345/ARTIFACTS/build.txt"] != "built\n" {
+		t.Errorf("The artifact should be uploaded after its step, got %v", store.uploads)
+	}
+}
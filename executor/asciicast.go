@@ -0,0 +1,165 @@
+package executor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// terminalRecordingFile is the artifact with the recording of the terminal of the build
+	terminalRecordingFile = "terminal.cast"
+	// defaultTerminalWidth and defaultTerminalHeight are the size of a pty that has none
+	defaultTerminalWidth  = 80
+	defaultTerminalHeight = 24
+)
+
+// Returns whether the terminal of the build is recorded, SD_TERMINAL_RECORDING in the launcher
+// environment
+func terminalRecording() (bool, error) {
+	value := strings.TrimSpace(os.Getenv("SD_TERMINAL_RECORDING"))
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid SD_TERMINAL_RECORDING %q, want true or false", value)
+	}
+	return enabled, nil
+}
+
+// asciicastHeader is the first line of an asciicast v2 recording
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// terminalRecorder records what the build shell writes to its pty, with when it did, to an
+// asciicast v2 file that asciinema replays as it unfolded, control sequences included. Each step
+// starts with a marker.
+type terminalRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	partial []byte
+	err     error
+}
+
+// Starts the recording of a terminal of width and height to the file at path, titled title
+func newTerminalRecorder(path string, width, height int, title string, env map[string]string) (*terminalRecorder, error) {
+	if width <= 0 || height <= 0 {
+		width, height = defaultTerminalWidth, defaultTerminalHeight
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &terminalRecorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	header, _ := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       env,
+	})
+	r.w.Write(append(header, '\n'))
+	return r, nil
+}
+
+// Returns src recording what is read from it, or src itself without a recording
+func (r *terminalRecorder) reader(src io.Reader) io.Reader {
+	if r == nil {
+		return src
+	}
+	return io.TeeReader(src, recorderOutput{r})
+}
+
+// recorderOutput writes the output of the terminal to its recorder
+type recorderOutput struct {
+	r *terminalRecorder
+}
+
+func (o recorderOutput) Write(p []byte) (int, error) {
+	o.r.output(p)
+	return len(p), nil
+}
+
+// Records the output p. A character cut off at its end is recorded with the next output.
+func (r *terminalRecorder) output(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.partial = append(r.partial, p...)
+	n := screwdriver.RuneBoundary(r.partial)
+	if n == 0 {
+		return
+	}
+	r.event("o", string(r.partial[:n]))
+	r.partial = append(r.partial[:0], r.partial[n:]...)
+}
+
+// Records the marker label, e.g. the name of a step starting
+func (r *terminalRecorder) marker(label string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("m", label)
+}
+
+// Writes the event of type kind with data at the current time of the recording
+func (r *terminalRecorder) event(kind, data string) {
+	if r.err != nil || r.f == nil {
+		return
+	}
+	elapsed := math.Round(time.Since(r.start).Seconds()*1e6) / 1e6
+	line, _ := json.Marshal([]interface{}{elapsed, kind, data})
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		r.err = err
+		logger.Warnf("Failed to record the terminal: %v", err)
+	}
+}
+
+// Ends the recording, writing what is left of it to its file
+func (r *terminalRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return r.err
+	}
+	if len(r.partial) > 0 {
+		r.event("o", string(r.partial))
+		r.partial = nil
+	}
+	if err := r.w.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if err := r.f.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	r.f = nil
+	return r.err
+}
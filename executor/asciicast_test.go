@@ -0,0 +1,170 @@
+package executor
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestTerminalRecording(t *testing.T) {
+	defer os.Setenv("SD_TERMINAL_RECORDING", os.Getenv("SD_TERMINAL_RECORDING"))
+	tests := []struct {
+		value   string
+		enabled bool
+		err     bool
+	}{
+		{"", false, false},
+		{"true", true, false},
+		{" false ", false, false},
+		{"always", false, true},
+	}
+	for _, test := range tests {
+		os.Setenv("SD_TERMINAL_RECORDING", test.value)
+		if enabled, err := terminalRecording(); enabled != test.enabled || (err != nil) != test.err {
+			t.Errorf("terminalRecording() with %q = %v, %v, want %v and error %v", test.value, enabled, err, test.enabled, test.err)
+		}
+	}
+}
+
+// Reads the header and the events of the asciicast recording at path
+func readAsciicast(t *testing.T, path string) (asciicastHeader, [][]interface{}) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	var header asciicastHeader
+	var events [][]interface{}
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan(); i++ {
+		if i == 0 {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				t.Fatalf("Invalid header %s: %v", scanner.Bytes(), err)
+			}
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			t.Fatalf("Invalid event %s: %v", scanner.Bytes(), err)
+		}
+		events = append(events, event)
+	}
+	return header, events
+}
+
+func TestTerminalRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asciicast")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "artifacts", terminalRecordingFile)
+
+	r, err := newTerminalRecorder(path, 0, 0, "Build 1", map[string]string{"SHELL": "/bin/sh"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r.marker("install")
+	src := r.reader(strings.NewReader("\x1b[32mok\x1b[0m \xe2\x9c"))
+	if data, _ := ioutil.ReadAll(src); string(data) != "\x1b[32mok\x1b[0m \xe2\x9c" {
+		t.Errorf("The output should be read as is: %q", data)
+	}
+	r.output([]byte("\x93 done\r\n"))
+	if err := r.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Closing again should do nothing: %v", err)
+	}
+	r.output([]byte("after close"))
+
+	header, events := readAsciicast(t, path)
+	if header.Version != 2 || header.Width != defaultTerminalWidth || header.Height != defaultTerminalHeight || header.Title != "Build 1" || header.Env["SHELL"] != "/bin/sh" {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	var kinds, data []string
+	for _, event := range events {
+		if _, ok := event[0].(float64); !ok {
+			t.Errorf("The time of the event should be a number: %v", event)
+		}
+		kinds, data = append(kinds, event[1].(string)), append(data, event[2].(string))
+	}
+	if want := []string{"m", "o", "o"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("Event types %v, want %v", kinds, want)
+	}
+	// The character split between reads is recorded whole
+	if want := []string{"install", "\x1b[32mok\x1b[0m ", "✓ done\r\n"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("Event data %q, want %q", data, want)
+	}
+
+	var none *terminalRecorder
+	none.marker("test")
+	if src := strings.NewReader("x"); none.reader(src) != src || none.Close() != nil {
+		t.Errorf("No recording should leave the output alone")
+	}
+}
+
+func TestRunRecordsTerminal(t *testing.T) {
+	envFilepath := "/tmp/testRecordTerminal"
+	setupTestCase(t, envFilepath)
+	defer os.Setenv("SD_TERMINAL_RECORDING", os.Getenv("SD_TERMINAL_RECORDING"))
+	os.Setenv("SD_TERMINAL_RECORDING", "true")
+	dir, err := ioutil.TempDir("", "asciicast")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "colors", Cmd: `printf '\033[1;32mgreen\033[0m\n'`},
+			{Name: "test", Cmd: "echo done"},
+			{Name: "teardown-cleanup", Cmd: "test -s $SD_ARTIFACTS_DIR/" + terminalRecordingFile},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	env := []string{"SD_ARTIFACTS_DIR=" + dir}
+	if err := Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if codes["teardown-cleanup"] != 0 {
+		t.Errorf("The recording should be complete before the teardowns: %v", codes)
+	}
+
+	header, events := readAsciicast(t, filepath.Join(dir, terminalRecordingFile))
+	if header.Version != 2 || header.Title != "Build 12345" {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	var markers []string
+	var output strings.Builder
+	for _, event := range events {
+		switch event[1] {
+		case "m":
+			markers = append(markers, event[2].(string))
+		case "o":
+			output.WriteString(event[2].(string))
+		}
+	}
+	if want := []string{"colors", "test"}; !reflect.DeepEqual(markers, want) {
+		t.Errorf("Markers %v, want %v", markers, want)
+	}
+	if !strings.Contains(output.String(), "\x1b[1;32mgreen\x1b[0m") || !strings.Contains(output.String(), "done") {
+		t.Errorf("The recording should have the output with its control sequences: %q", output.String())
+	}
+}
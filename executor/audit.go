@@ -0,0 +1,135 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// defaultAuditLog is where the audit log goes unless SD_AUDIT_LOG says otherwise. Only the
+// launcher's user can write to its directory, unlike the artifacts dir the build rewrites.
+var defaultAuditLog = "/var/log/sd/launcher-audit.log"
+
+const (
+	// Kinds of audited commands
+	auditSetup    = "setup"
+	auditStep     = "step"
+	auditTeardown = "teardown"
+)
+
+// auditRecord is one command the launcher ran on behalf of the build
+type auditRecord struct {
+	Kind      string    `json:"kind"`
+	Step      string    `json:"step,omitempty"`
+	Command   string    `json:"command"`
+	Redacted  bool      `json:"redacted,omitempty"`
+	Dir       string    `json:"cwd"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	ExitCode  int       `json:"exitCode"`
+}
+
+// auditLog appends a JSON line for every command the launcher runs to a file opened in
+// append-only mode. A nil auditLog records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Opens the audit log at SD_AUDIT_LOG from the launcher environment, or at defaultAuditLog.
+// Failing to open the one at SD_AUDIT_LOG is an error, as auditing was asked for; failing to
+// open the default one is written to the build log and disables auditing.
+func openAuditLog(emitter io.Writer) (*auditLog, error) {
+	path := os.Getenv("SD_AUDIT_LOG")
+	requested := path != ""
+	if !requested {
+		path = defaultAuditLog
+	}
+
+	file, err := createAuditLog(path)
+	if err != nil {
+		if requested {
+			return nil, err
+		}
+		logger.Warnf("Failed to open the audit log: %v", err)
+		launcherf(emitter, "Warning: the commands of this build are not audited, %v\n", err)
+		return nil, nil
+	}
+
+	return &auditLog{file: file}, nil
+}
+
+// Opens the audit log at path for appending, creating it and its directory for the launcher's
+// user only
+func createAuditLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("Creating the directory of the audit log %q: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Opening the audit log %q: %v", path, err)
+	}
+	return file, nil
+}
+
+// Records a command that ran from start until now
+func (a *auditLog) record(kind, step, command, dir string, start time.Time, exitCode int) {
+	a.write(auditRecord{Kind: kind, Step: step, Command: command, Dir: dir, StartTime: start, ExitCode: exitCode})
+}
+
+// Records the step of cmd that ran from start until now. The command of a step with an echo is
+// recorded as it is echoed, and the record is marked as redacted, to keep its secrets out of the log.
+func (a *auditLog) recordStep(kind string, cmd screwdriver.CommandDef, dir string, start time.Time, exitCode int) {
+	a.write(auditRecord{Kind: kind, Step: cmd.Name, Command: shownCommand(cmd), Redacted: cmd.Echo != nil, Dir: dir, StartTime: start, ExitCode: exitCode})
+}
+
+// Appends r, ending now, to the audit log
+func (a *auditLog) write(r auditRecord) {
+	if a == nil {
+		return
+	}
+
+	r.EndTime = time.Now()
+	line, err := json.Marshal(r)
+	if err != nil {
+		logger.Warnf("Failed to encode the audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// A single write per record, so records are never interleaved in the file
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logger.Warnf("Failed to write the audit record: %v", err)
+	}
+}
+
+// Close flushes the audit log to disk and closes it
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// Returns the directory a command with Dir set to dir runs in
+func commandDir(dir string) string {
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	return dir
+}
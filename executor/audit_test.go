@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Couldn't open the audit log: %v", err)
+	}
+	defer file.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Couldn't parse audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLogAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sd", "launcher-audit.log")
+	os.Setenv("SD_AUDIT_LOG", path)
+	defer os.Unsetenv("SD_AUDIT_LOG")
+
+	for i, step := range []string{"first", "second"} {
+		audit, err := openAuditLog(ioutil.Discard)
+		if err != nil || audit == nil {
+			t.Fatalf("openAuditLog() = %v, %v, want an audit log", audit, err)
+		}
+		audit.record(auditStep, step, "echo "+step, "/sd/workspace", time.Now(), i)
+		if err := audit.Close(); err != nil {
+			t.Fatalf("Unexpected error closing the audit log: %v", err)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Only the launcher should be able to write to the audit log directory: %v, %v", info, err)
+	}
+	records := readAuditRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("audit log has %d records, want 2", len(records))
+	}
+	for i, step := range []string{"first", "second"} {
+		r := records[i]
+		if r.Kind != auditStep || r.Step != step || r.Command != "echo "+step || r.Dir != "/sd/workspace" || r.ExitCode != i {
+			t.Errorf("Unexpected audit record: %+v", r)
+		}
+		if r.EndTime.Before(r.StartTime) {
+			t.Errorf("audit record ends before it starts: %+v", r)
+		}
+	}
+}
+
+func TestAuditLogPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A file where the directory of the audit log should be
+	blocker := filepath.Join(dir, "file")
+	ioutil.WriteFile(blocker, nil, 0600)
+
+	defer func(path string) { defaultAuditLog = path }(defaultAuditLog)
+	defaultAuditLog = filepath.Join(blocker, "launcher-audit.log")
+	var buildLog bytes.Buffer
+	audit, err := openAuditLog(&buildLog)
+	if audit != nil || err != nil {
+		t.Errorf("openAuditLog() = %v, %v, want no audit log without an error", audit, err)
+	}
+	if !strings.Contains(buildLog.String(), "not audited") {
+		t.Errorf("The build log should say the build is not audited: %q", buildLog.String())
+	}
+	// A nil audit log records nothing
+	audit.record(auditStep, "test", "true", "/", time.Now(), 0)
+	if err := audit.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	os.Setenv("SD_AUDIT_LOG", filepath.Join(blocker, "custom.log"))
+	defer os.Unsetenv("SD_AUDIT_LOG")
+	if _, err := openAuditLog(ioutil.Discard); err == nil {
+		t.Errorf("Expected an error when the audit log asked for cannot be opened")
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    []screwdriver.CommandDef{{Name: "test", Cmd: "true"}},
+		Environment: []map[string]string{},
+	}
+	err = Run("", nil, &MockEmitter{}, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", TestBuildTimeout, "/tmp/testAuditLogPath", "")
+	if !errors.Is(err, ErrInfra) {
+		t.Errorf("The build should fail without its audit log, got %v", err)
+	}
+}
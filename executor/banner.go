@@ -0,0 +1,146 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// timeoutArt is the art the default timeout banner starts with
+var timeoutArt = []string{
+	"#####################################################################",
+	"#####################################################################",
+	"#####################################################################",
+	" _     _                                      _ ",
+	"| |   (_)                                    | |",
+	"| |_   _   _ __ ___     ___    ___    _   _  | |_ ",
+	"| __| | | | '_ ` _ \\   / _ \\  / _ \\  | | | | | __|",
+	"| |_  | | | | | | | | |  __/ | (_) | | |_| | | |_ ",
+	" \\__| |_| |_| |_| |_|  \\___|  \\___/   \\__,_|  \\__|",
+}
+
+// defaultTimeoutBanner is the template of the timeout banner, with the teardowns that run next and
+// the documentation of the timeouts if the cluster has one
+var defaultTimeoutBanner = strings.Join(timeoutArt, "\n") + `
+
+{{.Message}}
+
+{{if .Teardowns}}{{.Teardowns}} teardowns run next{{if .TeardownBudget}}, for at most {{.TeardownBudget}}{{end}}
+{{end}}{{if .DocsURL}}See {{.DocsURL}}
+{{end}}
+` + strings.Join(timeoutArt[:3], "\n") + "\n"
+
+// timeoutBanner is the banner the build shell prints when the build or a step times out
+type timeoutBanner struct {
+	tmpl    *template.Template
+	docsURL string
+}
+
+// timeoutBannerData is what the template of the timeout banner gets
+type timeoutBannerData struct {
+	// Message is the error of the timeout
+	Message string
+	Step    string
+	// Build tells whether the build timed out, rather than the step
+	Build   bool
+	Timeout time.Duration
+	// Teardowns is how many teardowns run next, for at most TeardownBudget, 0 without a limit
+	Teardowns      int
+	TeardownBudget time.Duration
+	DocsURL        string
+}
+
+// Reads the timeout banner from the launcher environment: the text/template in the file
+// SD_TIMEOUT_BANNER_FILE, the default one if unset, and the link to the documentation of the
+// timeouts SD_TIMEOUT_DOCS_URL, none by default
+func loadTimeoutBanner() (*timeoutBanner, error) {
+	text := defaultTimeoutBanner
+	if path := strings.TrimSpace(os.Getenv("SD_TIMEOUT_BANNER_FILE")); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SD_TIMEOUT_BANNER_FILE %q: %v", path, err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("timeout").Parse(text)
+	if err == nil {
+		// A template using what it does not get fails now rather than when the build times out
+		err = tmpl.Execute(ioutil.Discard, timeoutBannerData{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SD_TIMEOUT_BANNER_FILE template: %v", err)
+	}
+	return &timeoutBanner{tmpl: tmpl, docsURL: strings.TrimSpace(os.Getenv("SD_TIMEOUT_DOCS_URL"))}, nil
+}
+
+// Returns the data of the banner of the timeout timeoutErr of the step name, with the teardowns
+// that run next
+func (b *timeoutBanner) data(name string, timeoutErr error, teardowns []screwdriver.CommandDef) timeoutBannerData {
+	data := timeoutBannerData{Message: timeoutErr.Error(), Step: name, Teardowns: len(teardowns), DocsURL: b.docsURL}
+	var buildTimeout Timeout
+	var stepTimeout StepTimeout
+	switch {
+	case errors.As(timeoutErr, &buildTimeout):
+		data.Build, data.Timeout = true, buildTimeout.Timeout
+	case errors.As(timeoutErr, &stepTimeout):
+		data.Timeout = stepTimeout.Timeout
+	}
+	for _, cmd := range teardowns {
+		if cmd.Timeout <= 0 {
+			data.TeardownBudget = 0
+			break
+		}
+		data.TeardownBudget += time.Duration(cmd.Timeout) * time.Second
+	}
+	return data
+}
+
+// Returns the text of the banner of data, or its message if the template fails
+func (b *timeoutBanner) render(data timeoutBannerData) string {
+	var text strings.Builder
+	if err := b.tmpl.Execute(&text, data); err != nil {
+		logger.Warnf("Failed to render the timeout banner: %v", err)
+		return data.Message + "\n"
+	}
+	return text.String()
+}
+
+// Returns the event of the timeout of data
+func (d timeoutBannerData) event() screwdriver.TimeoutEvent {
+	event := screwdriver.TimeoutEvent{
+		Kind:             screwdriver.TimeoutStep,
+		Step:             d.Step,
+		Message:          d.Message,
+		TimeoutMs:        d.Timeout.Milliseconds(),
+		Teardowns:        d.Teardowns,
+		TeardownBudgetMs: d.TeardownBudget.Milliseconds(),
+		DocsURL:          d.DocsURL,
+	}
+	if d.Build {
+		event.Kind = screwdriver.TimeoutBuild
+	}
+	return event
+}
+
+// Logs event with the emitter under the wrappers in emitter, if it logs the timeouts as events
+func logTimeoutEvent(emitter io.Writer, event screwdriver.TimeoutEvent) {
+	for emitter != nil {
+		if e, ok := emitter.(screwdriver.TimeoutEmitter); ok {
+			e.Timeout(event)
+			return
+		}
+		wrapper, ok := emitter.(wrappingEmitter)
+		if !ok {
+			return
+		}
+		emitter = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,119 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+// timeoutEmitter is a MockEmitter logging the timeouts as events
+type timeoutEmitter struct {
+	MockEmitter
+	events []screwdriver.TimeoutEvent
+}
+
+func (e *timeoutEmitter) Timeout(event screwdriver.TimeoutEvent) {
+	e.events = append(e.events, event)
+}
+
+func TestLoadTimeoutBanner(t *testing.T) {
+	defer os.Setenv("SD_TIMEOUT_BANNER_FILE", os.Getenv("SD_TIMEOUT_BANNER_FILE"))
+	defer os.Setenv("SD_TIMEOUT_DOCS_URL", os.Getenv("SD_TIMEOUT_DOCS_URL"))
+	dir, err := ioutil.TempDir("", "banner")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("SD_TIMEOUT_BANNER_FILE", "")
+	os.Setenv("SD_TIMEOUT_DOCS_URL", "https://docs.example.com/timeouts")
+	banner, err := loadTimeoutBanner()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	teardowns := []screwdriver.CommandDef{{Name: "teardown-a", Timeout: 60}, {Name: "teardown-b", Timeout: 30}}
+	text := banner.render(banner.data("test", Timeout{Timeout: time.Hour}, teardowns))
+	for _, want := range []string{"| |_   _   _ __ ___", "\n\nTimeout of 1h0m0s seconds exceeded\n\n", "\n2 teardowns run next, for at most 1m30s\n", "\nSee https://docs.example.com/timeouts\n"} {
+		assert.Contains(t, text, want)
+	}
+	data := banner.data("test", withStep(StepTimeout{"test", time.Minute}, "test"), append(teardowns, screwdriver.CommandDef{Name: "teardown-c"}))
+	assert.Equal(t, screwdriver.TimeoutEvent{
+		Kind:      screwdriver.TimeoutStep,
+		Step:      "test",
+		Message:   "Step timeout of 1m0s exceeded",
+		TimeoutMs: 60000,
+		Teardowns: 3,
+		DocsURL:   "https://docs.example.com/timeouts",
+	}, data.event())
+
+	file := filepath.Join(dir, "banner.tmpl")
+	for content, valid := range map[string]bool{
+		"{{if .Build}}BUILD{{else}}STEP {{.Step}}{{end}} TIMED OUT\n": true,
+		"{{.Unknown}}\n": false,
+		"{{if .Build}\n": false,
+	} {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		os.Setenv("SD_TIMEOUT_BANNER_FILE", file)
+		banner, err := loadTimeoutBanner()
+		if (err == nil) != valid {
+			t.Errorf("loadTimeoutBanner() with %q: unexpected error %v", content, err)
+			continue
+		}
+		if valid {
+			assert.Equal(t, "STEP test TIMED OUT\n", banner.render(banner.data("test", StepTimeout{"test", time.Minute}, nil)))
+		}
+	}
+	os.Setenv("SD_TIMEOUT_BANNER_FILE", filepath.Join(dir, "missing"))
+	if _, err := loadTimeoutBanner(); err == nil {
+		t.Errorf("A missing SD_TIMEOUT_BANNER_FILE should be an error")
+	}
+}
+
+func TestRunShowsTimeoutBanner(t *testing.T) {
+	defer os.Setenv("SD_TIMEOUT_BANNER_FILE", os.Getenv("SD_TIMEOUT_BANNER_FILE"))
+	dir, err := ioutil.TempDir("", "banner")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "banner.tmpl")
+	if err := ioutil.WriteFile(file, []byte("*** {{.Step}} timed out after {{.Timeout}}, {{.Teardowns}} teardowns run next ***\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.Setenv("SD_TIMEOUT_BANNER_FILE", file)
+
+	envFilepath := "/tmp/testTimeoutBanner"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "sleep 30", Name: "slow", Timeout: 1},
+			{Cmd: "echo cleaning", Name: "teardown-clean", Timeout: 20},
+		},
+		Environment: []map[string]string{},
+	}
+	emitter := &timeoutEmitter{}
+	err = Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if want := (StepTimeout{"slow", time.Second}); err != want {
+		t.Errorf("Unexpected error: %v, want %v", err, want)
+	}
+	if !strings.Contains(string(emitter.found), "*** slow timed out after 1s, 1 teardowns run next ***") {
+		t.Errorf("The build shell should print the banner of the cluster, got %q", emitter.found)
+	}
+	assert.Equal(t, []screwdriver.TimeoutEvent{{
+		Kind:             screwdriver.TimeoutStep,
+		Step:             "slow",
+		Message:          "Step timeout of 1s exceeded",
+		TimeoutMs:        1000,
+		Teardowns:        1,
+		TeardownBudgetMs: 20000,
+	}}, emitter.events)
+}
@@ -0,0 +1,224 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// cacheTimeout bounds the restore and the save of a cache
+	cacheTimeout = 30 * time.Minute
+	// cacheHitEnvPrefix starts the name of the variable telling whether a cache was restored with
+	// its exact key, followed by its name in upper case
+	cacheHitEnvPrefix = "SD_CACHE_HIT_"
+)
+
+// buildCaches restores the paths of the caches of a build from the cache store and saves them to
+// it, under the namespace of the pipeline
+type buildCaches struct {
+	store       cacheStore
+	compression cacheCompression
+	namespace   string
+	keys        cacheKeys
+	// hits are the caches restored with their exact key, which are not saved again
+	hits map[string]bool
+}
+
+// Returns the caches of keys with paths in store, archived with compression, for the pipeline of
+// env, or nil if there are none or they cannot be kept, with a warning
+func newBuildCaches(store cacheStore, compression cacheCompression, keys cacheKeys, env []string) *buildCaches {
+	var names []string
+	for _, def := range keys {
+		if len(def.Paths) > 0 {
+			names = append(names, def.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if store == nil {
+		logger.Warnf("The caches %v are not restored or saved without SD_CACHE_STORE", names)
+		return nil
+	}
+	pipelineID := lookupEnv(env, "SD_PIPELINE_ID")
+	if pipelineID == "" {
+		logger.Warnf("The caches %v are not restored or saved without SD_PIPELINE_ID", names)
+		return nil
+	}
+	return &buildCaches{store: store, compression: compression, namespace: "pipelines/" + pipelineID, keys: keys, hits: map[string]bool{}}
+}
+
+// Returns the name of the archives of key without their extension, which is also the prefix of
+// the names of the archives whose keys start with key. The key is escaped, so it stays in the
+// namespace.
+func (c *buildCaches) object(key string) string {
+	return c.namespace + "/" + url.PathEscape(key)
+}
+
+// Restores the cache paths from the archive of key, of the compression of the launcher or else of
+// another one
+func (c *buildCaches) restoreKey(key, sourceDir string, paths []string) error {
+	exts := []string{c.compression.ext()}
+	for _, ext := range cacheArchiveExts {
+		if ext != exts[0] {
+			exts = append(exts, ext)
+		}
+	}
+	for _, ext := range exts {
+		if err := c.restoreObject(c.object(key)+ext, sourceDir, paths); err != errCacheMiss {
+			return err
+		}
+	}
+	return errCacheMiss
+}
+
+// Restores the caches with a key in vars, the variables of cacheKeys.render, from the archive of
+// their key or else the newest one of their first restore key with one, and sets their
+// SD_CACHE_HIT_ variable in vars. A cache that cannot be restored is left as it is, with a warning.
+func (c *buildCaches) restore(sourceDir string, vars map[string]string) {
+	for _, def := range c.keys {
+		name := strings.ToUpper(def.Name)
+		key, ok := vars[cacheKeyEnvPrefix+name]
+		if len(def.Paths) == 0 || !ok {
+			continue
+		}
+		vars[cacheHitEnvPrefix+name] = "false"
+
+		err := c.restoreKey(key, sourceDir, def.Paths)
+		if err == nil {
+			logger.Infof("Restored cache %s with key %s", def.Name, key)
+			c.hits[name] = true
+			vars[cacheHitEnvPrefix+name] = "true"
+			continue
+		}
+		if err != errCacheMiss {
+			logger.Warnf("Failed to restore cache %s with key %s: %v", def.Name, key, err)
+			continue
+		}
+		restored := false
+		for _, restoreKey := range strings.Split(vars[cacheRestoreKeysEnvPrefix+name], ",") {
+			if restoreKey == "" {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+			object, err := c.store.Latest(ctx, c.object(restoreKey))
+			cancel()
+			if err == errCacheMiss {
+				continue
+			}
+			if err == nil {
+				err = c.restoreObject(object, sourceDir, def.Paths)
+			}
+			if err != nil {
+				logger.Warnf("Failed to restore cache %s with restore key %s: %v", def.Name, restoreKey, err)
+			} else {
+				logger.Infof("Restored cache %s from %s", def.Name, object)
+			}
+			restored = true
+			break
+		}
+		if !restored {
+			logger.Infof("No archive of cache %s", def.Name)
+		}
+	}
+}
+
+// Extracts the archive object to paths as it is downloaded
+func (c *buildCaches) restoreObject(object, sourceDir string, paths []string) error {
+	return getArchive(c.store, object, sourceDir, paths)
+}
+
+// Extracts the archive object of store to paths as it is downloaded
+func getArchive(store cacheStore, object, sourceDir string, paths []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	pr, pw := io.Pipe()
+	got := make(chan error, 1)
+	go func() {
+		err := store.Get(ctx, object, pw)
+		pw.CloseWithError(err)
+		got <- err
+	}()
+
+	err := unpackCache(pr, sourceDir, paths)
+	if err == nil {
+		// The end of the archive after the tar, if any, is still downloaded
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	// Stops the download if the extraction failed
+	pr.CloseWithError(err)
+	if getErr := <-got; getErr != nil {
+		return getErr
+	}
+	return err
+}
+
+// Saves the caches with a key in vars to the archives of their keys, unless they were restored
+// with it. A cache that cannot be saved is left out, with a warning.
+func (c *buildCaches) save(sourceDir string, vars map[string]string) {
+	for _, def := range c.keys {
+		name := strings.ToUpper(def.Name)
+		key, ok := vars[cacheKeyEnvPrefix+name]
+		if len(def.Paths) == 0 || !ok {
+			continue
+		}
+		if c.hits[name] {
+			logger.Infof("Cache %s is up to date with key %s", def.Name, key)
+			continue
+		}
+		if err := c.saveObject(c.object(key)+c.compression.ext(), sourceDir, def); err != nil {
+			logger.Warnf("Failed to save cache %s with key %s: %v", def.Name, key, err)
+		}
+	}
+}
+
+// Archives the paths of the cache def and uploads the archive as object
+func (c *buildCaches) saveObject(object, sourceDir string, def screwdriver.CacheKey) error {
+	size, err := putArchive(c.store, c.compression, object, sourceDir, def.Paths)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		logger.Infof("Cache %s has no files to save", def.Name)
+		return nil
+	}
+	logger.Infof("Saved cache %s as %s (%d bytes)", def.Name, object, size)
+	return nil
+}
+
+// Archives paths with compression and uploads the archive as object of store, returning its size,
+// or -1 without uploading it if paths have no files
+func putArchive(store cacheStore, compression cacheCompression, object, sourceDir string, paths []string) (int64, error) {
+	tmp, err := ioutil.TempFile("", "sd-cache-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	entries, err := packCache(tmp, compression, sourceDir, paths)
+	if err != nil {
+		return 0, err
+	}
+	if entries == 0 {
+		return -1, nil
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	if err := store.Put(ctx, object, tmp.Name(), info.Size(), nil); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
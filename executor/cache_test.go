@@ -0,0 +1,70 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestRunRestoresAndSavesCaches(t *testing.T) {
+	envFilepath := "/tmp/testCaches"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "caches")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src, storeDir := filepath.Join(dir, "src"), filepath.Join(dir, "store")
+	os.Mkdir(src, 0755)
+	defer os.Setenv("SD_CACHE_STORE", os.Getenv("SD_CACHE_STORE"))
+	defer os.Setenv("SD_CACHE_COMPRESSION", os.Getenv("SD_CACHE_COMPRESSION"))
+	os.Setenv("SD_CACHE_STORE", "file://"+storeDir)
+	os.Setenv("SD_CACHE_COMPRESSION", "gzip")
+
+	run := func(lockfile, install string) string {
+		ioutil.WriteFile(filepath.Join(src, "deps.lock"), []byte(lockfile), 0644)
+		os.RemoveAll(filepath.Join(src, "deps"))
+		testBuild := screwdriver.Build{
+			ID: 12345,
+			Commands: []screwdriver.CommandDef{
+				{Name: "sd-setup-scm", Cmd: "true"},
+				{Name: "install", Cmd: `echo "hit: $SD_CACHE_HIT_DEPS"; cat deps/version 2>/dev/null || true; mkdir -p deps && echo ` + install + ` > deps/version`},
+			},
+			Environment: []map[string]string{},
+			CacheKeys: []screwdriver.CacheKey{
+				{Name: "deps", Key: `deps-{{ hashFiles "deps.lock" }}`, RestoreKeys: []string{"deps-"}, Paths: []string{"deps"}},
+			},
+		}
+		emitter := &MockEmitter{}
+		if err := Run(src, []string{"SD_PIPELINE_ID=1"}, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, src); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return string(emitter.found)
+	}
+
+	if output := run("v1", "v1"); !strings.Contains(output, "hit: false\n") {
+		t.Errorf("The first build should miss the cache, got %q", output)
+	}
+	sum, _ := hashFiles(src, []string{"deps.lock"})
+	if _, err := os.Stat(filepath.Join(storeDir, "pipelines", "1", "deps-"+sum+".tar.gz")); err != nil {
+		t.Fatalf("The cache should be saved under its key: %v", err)
+	}
+	// The archives of the other compressions are restored too
+	os.Setenv("SD_CACHE_COMPRESSION", "")
+	if output := run("v1", "v1"); !strings.Contains(output, "hit: true\nv1\n") {
+		t.Errorf("The second build should restore the cache with its key, got %q", output)
+	}
+	// A changed lockfile restores the cache of the restore key, and saves it under the new key
+	if output := run("v2", "v2"); !strings.Contains(output, "hit: false\nv1\n") {
+		t.Errorf("The third build should restore the cache of the restore key, got %q", output)
+	}
+	sum, _ = hashFiles(src, []string{"deps.lock"})
+	compression, _ := newCacheCompression()
+	if _, err := os.Stat(filepath.Join(storeDir, "pipelines", "1", "deps-"+sum+compression.ext())); err != nil {
+		t.Errorf("The cache should be saved under its new key: %v", err)
+	}
+}
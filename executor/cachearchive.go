@@ -0,0 +1,224 @@
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Returns an error unless p is a path of a cache: relative to the source directory without
+// leaving it, or absolute, and neither the source directory nor the root
+func checkCachePath(p string) error {
+	clean := path.Clean(p)
+	if p == "" || clean == "." || clean == "/" {
+		return fmt.Errorf("Invalid cache path %q", p)
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return fmt.Errorf("Invalid cache path %q, it has ..", p)
+		}
+	}
+	return nil
+}
+
+// Returns the file path of the cache path p, relative to sourceDir unless absolute
+func cachePathFile(sourceDir, p string) string {
+	if path.IsAbs(p) {
+		return filepath.FromSlash(path.Clean(p))
+	}
+	return filepath.Join(sourceDir, filepath.FromSlash(p))
+}
+
+// Writes the tar of the directories, regular files and symlinks of the cache paths to w with
+// compression, each entry named after its cache path, and returns the number of entries. The
+// missing paths are left out, and symlinks are not followed. The tar is compressed as it is
+// written.
+func packCache(w io.Writer, compression cacheCompression, sourceDir string, paths []string) (int, error) {
+	cw, err := compression.writer(w)
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(cw)
+	entries := 0
+	for _, p := range paths {
+		root := cachePathFile(sourceDir, p)
+		name := path.Clean(p)
+		err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if file == root && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			var link string
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				if link, err = os.Readlink(file); err != nil {
+					return err
+				}
+			case !d.IsDir() && !d.Type().IsRegular():
+				// Sockets, pipes and devices are left out
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			hdr.Name = name
+			if rel != "." {
+				hdr.Name += "/" + filepath.ToSlash(rel)
+			}
+			hdr.Uname, hdr.Gname = "", ""
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			entries++
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+				return fmt.Errorf("Archiving %s: %v", file, err)
+			}
+			return nil
+		})
+		if err != nil {
+			cw.Close()
+			return entries, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		cw.Close()
+		return entries, err
+	}
+	return entries, cw.Close()
+}
+
+// Extracts the compressed tar of r written by packCache to the cache paths as it is read,
+// leaving out the entries of other paths. An entry may not be written through a symlink below its
+// cache path.
+func unpackCache(r io.Reader, sourceDir string, paths []string) error {
+	dr, err := decompressCache(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// The rest is read, so the checksum of the archive is checked
+			if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+				return err
+			}
+			return dr.Close()
+		}
+		if err != nil {
+			return err
+		}
+		root, target, ok := cacheEntryFile(sourceDir, paths, hdr.Name)
+		if !ok {
+			continue
+		}
+		if err := checkNoSymlinks(root, filepath.Dir(target)); err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			// The directory stays writable, for the next entries
+			if err := os.Chmod(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// A symlink in the way is replaced, not followed
+			os.Remove(target)
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Returns the file path of the cache path of the entry name of an archive, and of the entry, or
+// false if the entry is not below one of paths
+func cacheEntryFile(sourceDir string, paths []string, name string) (string, string, bool) {
+	for _, p := range paths {
+		prefix := path.Clean(p)
+		if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/")
+		if rel != "" && path.Clean("/"+rel) != "/"+rel {
+			return "", "", false
+		}
+		root := cachePathFile(sourceDir, p)
+		return root, filepath.Join(root, filepath.FromSlash(rel)), true
+	}
+	return "", "", false
+}
+
+// Returns an error if a directory from below root to dir is a symlink
+func checkNoSymlinks(root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		// The entry of the cache path itself
+		return err
+	}
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("Not extracting through the symlink %s", current)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackUnpackCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachearchive")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst, home := filepath.Join(dir, "src"), filepath.Join(dir, "dst"), filepath.Join(dir, "home", ".npm")
+	os.MkdirAll(filepath.Join(src, "node_modules", "left-pad"), 0755)
+	os.MkdirAll(filepath.Join(src, "node_modules", ".bin"), 0755)
+	os.MkdirAll(home, 0755)
+	os.Mkdir(dst, 0755)
+	ioutil.WriteFile(filepath.Join(src, "node_modules", "left-pad", "index.js"), []byte("module.exports = leftPad"), 0644)
+	os.Symlink("../left-pad/index.js", filepath.Join(src, "node_modules", ".bin", "left-pad"))
+	ioutil.WriteFile(filepath.Join(src, "package.json"), []byte("{}"), 0644)
+	ioutil.WriteFile(filepath.Join(home, "index.json"), []byte("[]"), 0644)
+
+	var buf bytes.Buffer
+	paths := []string{"node_modules", home, "missing"}
+	entries, err := packCache(&buf, gzipCompression{}, src, paths)
+	// node_modules, .bin, its link, left-pad, index.js, .npm and index.json
+	if err != nil || entries != 7 {
+		t.Fatalf("packCache() = %d, %v, want 7 entries", entries, err)
+	}
+
+	os.RemoveAll(home)
+	if err := unpackCache(bytes.NewReader(buf.Bytes()), dst, paths); err != nil {
+		t.Fatalf("unpackCache() = %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "node_modules", ".bin", "left-pad")); err != nil || string(data) != "module.exports = leftPad" {
+		t.Errorf("The link should be restored, got %q, %v", data, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(home, "index.json")); err != nil || string(data) != "[]" {
+		t.Errorf("The absolute path should be restored, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "package.json")); !os.IsNotExist(err) {
+		t.Errorf("Only the cache paths should be archived")
+	}
+
+	// The entries of the paths no longer cached are left out
+	os.RemoveAll(home)
+	if err := unpackCache(bytes.NewReader(buf.Bytes()), filepath.Join(dir, "other"), []string{"node_modules"}); err != nil {
+		t.Fatalf("unpackCache() = %v", err)
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Errorf("The entries of the other paths should be left out")
+	}
+}
+
+func TestUnpackCacheStaysInPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachearchive")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	os.Mkdir(outside, 0755)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range []*tar.Header{
+		{Name: "deps/../escaped", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "deps/link", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "deps/link/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		tw.WriteHeader(hdr)
+	}
+	tw.Close()
+	gz.Close()
+
+	if err := unpackCache(&buf, filepath.Join(dir, "src"), []string{"deps"}); err == nil {
+		t.Errorf("unpackCache() should refuse to write through a symlink")
+	}
+	for _, file := range []string{filepath.Join(dir, "src", "escaped"), filepath.Join(outside, "escaped")} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s should not be written", file)
+		}
+	}
+}
+
+func TestCheckCachePath(t *testing.T) {
+	for _, p := range []string{"node_modules", "/root/.m2", ".cache/pip"} {
+		if err := checkCachePath(p); err != nil {
+			t.Errorf("checkCachePath(%s) = %v", p, err)
+		}
+	}
+	for _, p := range []string{"", ".", "/", "../deps", "deps/../.."} {
+		if err := checkCachePath(p); err == nil {
+			t.Errorf("checkCachePath(%q) should fail", p)
+		}
+	}
+}
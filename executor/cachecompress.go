@@ -0,0 +1,285 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// gzipBlockSize is the size of the blocks of a cache archive compressed concurrently, each a
+	// gzip member of its own
+	gzipBlockSize = 1 << 20
+	// zstdCLI compresses and decompresses the zstd archives
+	zstdCLI = "zstd"
+)
+
+// zstdMagic and gzipMagic start the zstd and gzip streams
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// cacheCompression compresses the cache archives
+type cacheCompression interface {
+	// ext ends the names of the archives
+	ext() string
+	// writer returns the writer compressing to w, whose Close flushes it
+	writer(w io.Writer) (io.WriteCloser, error)
+}
+
+// cacheCompressions are the compressions of the cache archives by name
+var cacheCompressions = map[string]func() cacheCompression{
+	"zstd": func() cacheCompression { return zstdCompression{} },
+	"gzip": func() cacheCompression { return gzipCompression{} },
+}
+
+// cacheArchiveExts are the extensions of the archives of every compression, tried in order when
+// restoring a cache after the one of the compression of the launcher
+var cacheArchiveExts = []string{zstdCompression{}.ext(), gzipCompression{}.ext()}
+
+// Returns the compression picked by SD_CACHE_COMPRESSION in the launcher environment: zstd by
+// default if the zstd CLI is installed, else gzip
+func newCacheCompression() (cacheCompression, error) {
+	name := strings.TrimSpace(os.Getenv("SD_CACHE_COMPRESSION"))
+	if name == "" {
+		if _, err := exec.LookPath(zstdCLI); err != nil {
+			return gzipCompression{}, nil
+		}
+		return zstdCompression{}, nil
+	}
+	compression, ok := cacheCompressions[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown SD_CACHE_COMPRESSION %q, want zstd or gzip", name)
+	}
+	if name == "zstd" {
+		if _, err := exec.LookPath(zstdCLI); err != nil {
+			return nil, fmt.Errorf("SD_CACHE_COMPRESSION is zstd but there is no %s CLI: %v", zstdCLI, err)
+		}
+	}
+	return compression(), nil
+}
+
+// Returns the reader decompressing r, zstd or gzip according to its first bytes
+func decompressCache(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return newZstdReader(br)
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case err != nil:
+		return nil, err
+	}
+	return nil, fmt.Errorf("Unknown compression of the cache archive")
+}
+
+// gzipCompression compresses the blocks of the archives with gzip concurrently, on all the CPUs
+type gzipCompression struct{}
+
+func (gzipCompression) ext() string {
+	return ".tar.gz"
+}
+
+func (gzipCompression) writer(w io.Writer) (io.WriteCloser, error) {
+	return newParallelGzipWriter(w, runtime.GOMAXPROCS(0)), nil
+}
+
+// gzipBlock is a block being compressed, done once compressed
+type gzipBlock struct {
+	data []byte
+	done chan struct{}
+	err  error
+}
+
+// parallelGzipWriter compresses the blocks of what is written to it concurrently and writes
+// them in order to w, as a multi-member gzip stream
+type parallelGzipWriter struct {
+	w       io.Writer
+	buf     []byte
+	blocks  chan *gzipBlock
+	written chan error
+	// wrote tells whether a block was compressed, as an empty stream still has one
+	wrote bool
+	// err is the first error writing to w, which stops the writes
+	errMu sync.Mutex
+	err   error
+}
+
+// Returns the writer compressing at most concurrency blocks at a time to w
+func newParallelGzipWriter(w io.Writer, concurrency int) *parallelGzipWriter {
+	z := &parallelGzipWriter{w: w, blocks: make(chan *gzipBlock, concurrency), written: make(chan error, 1)}
+	go func() {
+		var err error
+		for block := range z.blocks {
+			<-block.done
+			if err == nil {
+				if err = block.err; err == nil {
+					_, err = w.Write(block.data)
+				}
+				if err != nil {
+					z.errMu.Lock()
+					z.err = err
+					z.errMu.Unlock()
+				}
+			}
+		}
+		z.written <- err
+	}()
+	return z
+}
+
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	z.errMu.Lock()
+	err := z.err
+	z.errMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		size := gzipBlockSize - len(z.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		z.buf = append(z.buf, p[:size]...)
+		p = p[size:]
+		if len(z.buf) == gzipBlockSize {
+			z.compress()
+		}
+	}
+	return n, nil
+}
+
+// Compresses the buffered bytes in the background, waiting for a block to be written if there
+// are too many
+func (z *parallelGzipWriter) compress() {
+	block := &gzipBlock{done: make(chan struct{})}
+	data := z.buf
+	z.buf = make([]byte, 0, gzipBlockSize)
+	z.wrote = true
+	z.blocks <- block
+	go func() {
+		defer close(block.done)
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, block.err = gz.Write(data); block.err == nil {
+			block.err = gz.Close()
+		}
+		block.data = buf.Bytes()
+	}()
+}
+
+// Close compresses the last block and returns once every block is written
+func (z *parallelGzipWriter) Close() error {
+	if len(z.buf) > 0 || !z.wrote {
+		z.compress()
+	}
+	close(z.blocks)
+	return <-z.written
+}
+
+// zstdCompression compresses the archives with the zstd CLI, on all the CPUs
+type zstdCompression struct{}
+
+func (zstdCompression) ext() string {
+	return ".tar.zst"
+}
+
+func (zstdCompression) writer(w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command(zstdCLI, "-q", "-c", "-T0")
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &zstdWriter{WriteCloser: stdin, cmd: cmd, stderr: &stderr}, nil
+}
+
+// zstdWriter writes to the zstd CLI
+type zstdWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// Close waits for the zstd CLI to write the end of the archive
+func (z *zstdWriter) Close() error {
+	z.WriteCloser.Close()
+	if err := z.cmd.Wait(); err != nil {
+		return fmt.Errorf("Compressing the cache archive: %v: %s", err, strings.TrimSpace(z.stderr.String()))
+	}
+	return nil
+}
+
+// zstdReader reads what the zstd CLI decompresses
+type zstdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	eof    bool
+	closed bool
+}
+
+// Returns the reader of r decompressed by the zstd CLI. The input is copied in the background,
+// so closing the reader does not wait for r.
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command(zstdCLI, "-d", "-q", "-c")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		io.Copy(stdin, r)
+		stdin.Close()
+	}()
+	return &zstdReader{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.ReadCloser.Read(p)
+	if err == io.EOF {
+		z.eof = true
+	}
+	return n, err
+}
+
+// Close stops the zstd CLI unless all was read, and else returns its error, e.g. of a corrupt
+// archive
+func (z *zstdReader) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	if !z.eof {
+		z.cmd.Process.Kill()
+		z.cmd.Wait()
+		return nil
+	}
+	if err := z.cmd.Wait(); err != nil {
+		return fmt.Errorf("Decompressing the cache archive: %v: %s", err, strings.TrimSpace(z.stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package executor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// gzipSerialCompression is the single goroutine gzip compression, the baseline of the benchmarks
+type gzipSerialCompression struct{}
+
+func (gzipSerialCompression) ext() string {
+	return ".tar.gz"
+}
+
+func (gzipSerialCompression) writer(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// Returns compressible text of size bytes
+func cacheTestData(r *rand.Rand, size int) []byte {
+	words := []string{"require", "module", "exports", "function", "return", "const", "node_modules", "{", "}", "\n"}
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[r.Intn(len(words))])
+		buf.WriteByte(' ')
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestParallelGzipWriter(t *testing.T) {
+	data := cacheTestData(rand.New(rand.NewSource(1)), 3*gzipBlockSize+12345)
+	for _, size := range []int{0, 100, len(data)} {
+		var buf bytes.Buffer
+		w := newParallelGzipWriter(&buf, 2)
+		// Written in chunks not aligned with the blocks
+		for rest := data[:size]; len(rest) > 0; {
+			n := 70000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			w.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		r, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("The stream of %d bytes should be gzip: %v", size, err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data[:size]) {
+			t.Errorf("The stream of %d bytes decompresses to %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestDecompressCache(t *testing.T) {
+	compressions := []cacheCompression{gzipCompression{}}
+	if _, err := exec.LookPath(zstdCLI); err == nil {
+		compressions = append(compressions, zstdCompression{})
+	}
+	data := cacheTestData(rand.New(rand.NewSource(1)), 100000)
+	for _, compression := range compressions {
+		var buf bytes.Buffer
+		w, err := compression.writer(&buf)
+		if err != nil {
+			t.Fatalf("writer() = %v", err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		r, err := decompressCache(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("decompressCache() of %s = %v", compression.ext(), err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err == nil {
+			err = r.Close()
+		}
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("The %s archive decompresses to %d bytes, %v", compression.ext(), len(got), err)
+		}
+
+		// A truncated archive is an error
+		r, err = decompressCache(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err == nil {
+			t.Errorf("The truncated %s archive should fail", compression.ext())
+		}
+	}
+	if _, err := decompressCache(bytes.NewReader([]byte("plain tar"))); err == nil {
+		t.Errorf("decompressCache() of an uncompressed archive should fail")
+	}
+}
+
+func TestNewCacheCompression(t *testing.T) {
+	defer os.Setenv("SD_CACHE_COMPRESSION", os.Getenv("SD_CACHE_COMPRESSION"))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+
+	os.Setenv("SD_CACHE_COMPRESSION", "gzip")
+	if compression, err := newCacheCompression(); err != nil || compression != (gzipCompression{}) {
+		t.Errorf("newCacheCompression() = %v, %v, want gzip", compression, err)
+	}
+	os.Setenv("SD_CACHE_COMPRESSION", "lz4")
+	if _, err := newCacheCompression(); err == nil {
+		t.Errorf("newCacheCompression() should fail with an unknown compression")
+	}
+	// Without the zstd CLI, gzip is the default and zstd is an error
+	os.Setenv("PATH", "")
+	os.Setenv("SD_CACHE_COMPRESSION", "")
+	if compression, err := newCacheCompression(); err != nil || compression != (gzipCompression{}) {
+		t.Errorf("newCacheCompression() = %v, %v, want gzip", compression, err)
+	}
+	os.Setenv("SD_CACHE_COMPRESSION", "zstd")
+	if _, err := newCacheCompression(); err == nil {
+		t.Errorf("newCacheCompression() should fail without the zstd CLI")
+	}
+}
+
+// Returns the source directory of a node_modules of files packages of 8 files of 16KiB
+func benchmarkCacheTree(b *testing.B, packages int) string {
+	dir, err := ioutil.TempDir("", "cachebench")
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < packages; i++ {
+		pkg := filepath.Join(dir, "node_modules", fmt.Sprintf("package-%d", i), "lib")
+		os.MkdirAll(pkg, 0755)
+		for j := 0; j < 8; j++ {
+			ioutil.WriteFile(filepath.Join(pkg, fmt.Sprintf("file-%d.js", j)), cacheTestData(r, 16<<10), 0644)
+		}
+	}
+	return dir
+}
+
+func benchmarkPackCache(b *testing.B, compression cacheCompression) {
+	if _, ok := compression.(zstdCompression); ok {
+		if _, err := exec.LookPath(zstdCLI); err != nil {
+			b.Skip("No zstd CLI")
+		}
+	}
+	dir := benchmarkCacheTree(b, 256)
+	defer os.RemoveAll(dir)
+	b.SetBytes(256 * 8 * 16 << 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := packCache(ioutil.Discard, compression, dir, []string{"node_modules"}); err != nil {
+			b.Fatalf("packCache() = %v", err)
+		}
+	}
+}
+
+func BenchmarkPackCacheSerialGzip(b *testing.B) { benchmarkPackCache(b, gzipSerialCompression{}) }
+
+func BenchmarkPackCacheGzip(b *testing.B) { benchmarkPackCache(b, gzipCompression{}) }
+
+func BenchmarkPackCacheZstd(b *testing.B) { benchmarkPackCache(b, zstdCompression{}) }
+
+func benchmarkUnpackCache(b *testing.B, compression cacheCompression) {
+	if _, ok := compression.(zstdCompression); ok {
+		if _, err := exec.LookPath(zstdCLI); err != nil {
+			b.Skip("No zstd CLI")
+		}
+	}
+	dir := benchmarkCacheTree(b, 256)
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	if _, err := packCache(&buf, compression, dir, []string{"node_modules"}); err != nil {
+		b.Fatalf("packCache() = %v", err)
+	}
+	b.SetBytes(256 * 8 * 16 << 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst := filepath.Join(dir, fmt.Sprintf("restore-%d", i))
+		if err := unpackCache(bytes.NewReader(buf.Bytes()), dst, []string{"node_modules"}); err != nil {
+			b.Fatalf("unpackCache() = %v", err)
+		}
+		b.StopTimer()
+		os.RemoveAll(dst)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkUnpackCacheGzip(b *testing.B) { benchmarkUnpackCache(b, gzipCompression{}) }
+
+func BenchmarkUnpackCacheZstd(b *testing.B) { benchmarkUnpackCache(b, zstdCompression{}) }
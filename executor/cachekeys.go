@@ -0,0 +1,207 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// cacheKeyEnvPrefix and cacheRestoreKeysEnvPrefix start the names of the variables with the
+	// key and the restore keys of a cache, followed by its name in upper case
+	cacheKeyEnvPrefix         = "SD_CACHE_KEY_"
+	cacheRestoreKeysEnvPrefix = "SD_CACHE_RESTORE_KEYS_"
+	// maxCacheKeyLength bounds the length of a rendered key
+	maxCacheKeyLength = 512
+	// scmSetupStep checks out the source, so the keys are rendered after it
+	scmSetupStep = "sd-setup-scm"
+)
+
+// cacheKeys are the key templates of the caches of a build
+type cacheKeys []screwdriver.CacheKey
+
+// Returns the cache keys of defs once their names and templates are checked
+func newCacheKeys(defs []screwdriver.CacheKey) (cacheKeys, error) {
+	names := map[string]bool{}
+	for _, def := range defs {
+		if !envName.MatchString(def.Name) {
+			return nil, fmt.Errorf("Invalid cache name %q", def.Name)
+		}
+		name := strings.ToUpper(def.Name)
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate cache %q", def.Name)
+		}
+		names[name] = true
+		if def.Key == "" {
+			return nil, fmt.Errorf("Cache %q has no key", def.Name)
+		}
+		for _, text := range append([]string{def.Key}, def.RestoreKeys...) {
+			if _, err := parseCacheKey(text, "", nil); err != nil {
+				return nil, fmt.Errorf("Invalid key of cache %q: %v", def.Name, err)
+			}
+		}
+		for _, p := range def.Paths {
+			if err := checkCachePath(p); err != nil {
+				return nil, fmt.Errorf("Invalid path of cache %q: %v", def.Name, err)
+			}
+		}
+	}
+	return cacheKeys(defs), nil
+}
+
+// Parses the key template text with the functions reading the files of sourceDir and the
+// variables of env: hashFiles, env, os and arch
+func parseCacheKey(text, sourceDir string, env []string) (*template.Template, error) {
+	return template.New("key").Funcs(template.FuncMap{
+		"hashFiles": func(patterns ...string) (string, error) { return hashFiles(sourceDir, patterns) },
+		"env":       func(name string) string { return lookupEnv(env, name) },
+		"os":        func() string { return runtime.GOOS },
+		"arch":      func() string { return runtime.GOARCH },
+	}).Parse(text)
+}
+
+// Returns the key template text rendered with the files of sourceDir and the variables of env
+func renderCacheKey(text, sourceDir string, env []string) (string, error) {
+	tmpl, err := parseCacheKey(text, sourceDir, env)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	key := buf.String()
+	if key == "" || len(key) > maxCacheKeyLength || strings.IndexFunc(key, func(r rune) bool { return r == ',' || unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return "", fmt.Errorf("Invalid key %q, want at most %d printable characters without spaces or commas", key, maxCacheKeyLength)
+	}
+	return key, nil
+}
+
+// Returns the variables with the rendered keys and restore keys of the caches, the restore keys
+// joined with commas. A cache whose key cannot be rendered gets no variables, with a warning.
+func (k cacheKeys) render(sourceDir string, env []string) map[string]string {
+	vars := map[string]string{}
+	for _, def := range k {
+		name := strings.ToUpper(def.Name)
+		key, err := renderCacheKey(def.Key, sourceDir, env)
+		if err != nil {
+			logger.Warnf("Failed to render the key of cache %s: %v", def.Name, err)
+			continue
+		}
+		var restoreKeys []string
+		for _, text := range def.RestoreKeys {
+			restoreKey, err := renderCacheKey(text, sourceDir, env)
+			if err != nil {
+				logger.Warnf("Failed to render a restore key of cache %s: %v", def.Name, err)
+				continue
+			}
+			restoreKeys = append(restoreKeys, restoreKey)
+		}
+		vars[cacheKeyEnvPrefix+name] = key
+		vars[cacheRestoreKeysEnvPrefix+name] = strings.Join(restoreKeys, ",")
+		logger.Infof("Cache %s has key %s, restore keys %v", def.Name, key, restoreKeys)
+	}
+	return vars
+}
+
+// Returns the hex SHA256 of the paths and contents of the regular files of sourceDir matching
+// patterns, in the order of their paths, or an error if none match
+func hashFiles(sourceDir string, patterns []string) (string, error) {
+	for _, pattern := range patterns {
+		if err := checkArtifactPattern(pattern); err != nil {
+			return "", err
+		}
+	}
+	if sourceDir == "" {
+		return "", fmt.Errorf("No source directory to hash the files of")
+	}
+
+	var files []string
+	err := filepath.WalkDir(sourceDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are left out
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(sourceDir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			if matchArtifactPattern(pattern, rel) {
+				files = append(files, rel)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("No files match %v", patterns)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(sourceDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", rel)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the index of the step before which the cache keys are rendered: the one after the
+// checkout of the source, or the first step if there is none
+func cacheKeysStep(commands []screwdriver.CommandDef) int {
+	for i, cmd := range commands {
+		if cmd.Name == scmSetupStep {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Returns cmd with the variables vars set, the variables of the step winning
+func withCacheEnv(cmd screwdriver.CommandDef, vars map[string]string) screwdriver.CommandDef {
+	if len(vars) == 0 {
+		return cmd
+	}
+	env := make(map[string]string, len(vars)+len(cmd.Env))
+	for key, value := range vars {
+		env[key] = value
+	}
+	for key, value := range cmd.Env {
+		env[key] = value
+	}
+	cmd.Env = env
+	return cmd
+}
@@ -0,0 +1,113 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestHashFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachekeys")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "web"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte("golang.org/x/sys v0.1.0 h1:abc\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "web", "package-lock.json"), []byte(`{"lockfileVersion": 2}`), 0644)
+
+	sum, err := hashFiles(dir, []string{"go.sum", "**/package-lock.json"})
+	if err != nil || len(sum) != 64 {
+		t.Fatalf("hashFiles() = %q, %v, want a SHA256", sum, err)
+	}
+	if again, _ := hashFiles(dir, []string{"**/package-lock.json", "go.sum"}); again != sum {
+		t.Errorf("The hash should not depend on the order of the patterns: %s, %s", again, sum)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "web", "package-lock.json"), []byte(`{"lockfileVersion": 3}`), 0644)
+	if changed, _ := hashFiles(dir, []string{"go.sum", "**/package-lock.json"}); changed == sum {
+		t.Errorf("The hash should change with the lockfiles")
+	}
+	if _, err := hashFiles(dir, []string{"yarn.lock"}); err == nil {
+		t.Errorf("hashFiles() should fail without matching files")
+	}
+	if _, err := hashFiles(dir, []string{"../go.sum"}); err == nil {
+		t.Errorf("hashFiles() should fail with a pattern leaving the source directory")
+	}
+}
+
+func TestRenderCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachekeys")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte("golang.org/x/sys v0.1.0 h1:abc\n"), 0644)
+	sum, _ := hashFiles(dir, []string{"go.sum"})
+
+	env := []string{"GO_VERSION=1.16"}
+	key, err := renderCacheKey(`go-{{ os }}-{{ arch }}-{{ env "GO_VERSION" }}-{{ hashFiles "go.sum" }}`, dir, env)
+	if want := "go-" + runtime.GOOS + "-" + runtime.GOARCH + "-1.16-" + sum; err != nil || key != want {
+		t.Errorf("renderCacheKey() = %q, %v, want %q", key, err, want)
+	}
+	for _, text := range []string{`{{ env "MISSING" }}`, `go {{ env "GO_VERSION" }}`, `go,{{ env "GO_VERSION" }}`, `go-{{ hashFiles "yarn.lock" }}`} {
+		if key, err := renderCacheKey(text, dir, env); err == nil {
+			t.Errorf("renderCacheKey(%s) = %q, want an error", text, key)
+		}
+	}
+}
+
+func TestNewCacheKeys(t *testing.T) {
+	for _, defs := range [][]screwdriver.CacheKey{
+		{{Name: "node-modules", Key: "npm"}},
+		{{Name: "npm", Key: "npm"}, {Name: "NPM", Key: "npm"}},
+		{{Name: "npm"}},
+		{{Name: "npm", Key: "npm-{{ hashFiles }"}},
+		{{Name: "npm", Key: "npm", RestoreKeys: []string{"{{ unknown }}"}}},
+	} {
+		if _, err := newCacheKeys(defs); err == nil {
+			t.Errorf("newCacheKeys(%+v) should fail", defs)
+		}
+	}
+}
+
+func TestRunSetsCacheKeys(t *testing.T) {
+	envFilepath := "/tmp/testCacheKeys"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "cachekeys")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte("golang.org/x/sys v0.1.0 h1:abc\n"), 0644)
+	sum, _ := hashFiles(dir, []string{"go.sum"})
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "sd-setup-launcher", Cmd: `echo "setup key: $SD_CACHE_KEY_GO"`},
+			{Name: "sd-setup-scm", Cmd: "true"},
+			{Name: "test", Cmd: `echo "test key: $SD_CACHE_KEY_GO restore: $SD_CACHE_RESTORE_KEYS_GO"`},
+			{Name: "sd-teardown-cache", Cmd: `echo "teardown key: $SD_CACHE_KEY_GO"`},
+		},
+		Environment: []map[string]string{},
+		CacheKeys: []screwdriver.CacheKey{
+			{Name: "go", Key: `go-{{ hashFiles "go.sum" }}`, RestoreKeys: []string{"go-"}},
+		},
+	}
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output := string(emitter.found)
+	// The steps before the checkout do not get the keys
+	for _, want := range []string{"setup key: \n", "test key: go-" + sum + " restore: go-\n", "teardown key: go-" + sum + "\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("The output should contain %q, got %q", want, output)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheStoreAttempts bounds the attempts of a request to a cache store
+	cacheStoreAttempts = 3
+	// cacheStoreRetryDelay is the delay before the second attempt, doubled for each next one
+	cacheStoreRetryDelay = time.Second
+)
+
+// errCacheMiss is the error of a cache store without the object asked for
+var errCacheMiss = errors.New("Cache miss")
+
+// cacheStore keeps the cache archives of the builds, and their artifacts with SD_ARTIFACT_STORE,
+// by name, the names being paths with /. The files larger than multipartPartSize are uploaded in
+// parts, resumed by the next Put of the same file after a failure.
+type cacheStore interface {
+	// Get writes the object name to w, or returns errCacheMiss if there is none
+	Get(ctx context.Context, name string, w io.Writer) error
+	// Put stores the size bytes of the file at file as the object name, with tags if the store
+	// keeps them
+	Put(ctx context.Context, name, file string, size int64, tags map[string]string) error
+	// Latest returns the name of the newest object whose name starts with prefix, or
+	// errCacheMiss if there is none
+	Latest(ctx context.Context, prefix string) (string, error)
+}
+
+// Returns the cache store of SD_CACHE_STORE in the launcher environment, or nil if it is not set
+func newCacheStore() (cacheStore, error) {
+	return newObjectStore("SD_CACHE_STORE")
+}
+
+// Returns the store of the variable of the launcher environment, or nil if it is not set:
+// s3://bucket/prefix, gs://bucket/prefix, azblob://account/container/prefix or file:///path
+func newObjectStore(variable string) (cacheStore, error) {
+	value := strings.TrimSpace(os.Getenv(variable))
+	if value == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %q: %v", variable, value, err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	var store cacheStore
+	switch u.Scheme {
+	case "s3":
+		store, err = newS3CacheStore(u.Host, prefix, u.Query())
+	case "gs":
+		store, err = newGCSCacheStore(u.Host, prefix, u.Query())
+	case "azblob":
+		container, prefix := prefix, ""
+		if i := strings.IndexByte(container, '/'); i >= 0 {
+			container, prefix = container[:i], container[i+1:]
+		}
+		store, err = newAzureCacheStore(u.Host, container, prefix, u.Query())
+	case "file":
+		if u.Host != "" || !filepath.IsAbs(u.Path) {
+			return nil, fmt.Errorf("Invalid %s %q, want file:///path", variable, value)
+		}
+		return localCacheStore{dir: filepath.Clean(u.Path)}, nil
+	default:
+		return nil, fmt.Errorf("Invalid %s %q, want s3, gs, azblob or file", variable, value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %q: %v", variable, value, err)
+	}
+	return store, nil
+}
+
+// Returns tags in the form of a URL query, the one of the object tags of S3 and Azure
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// Returns name under prefix, if not empty
+func storeObjectName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// localCacheStore keeps the cache archives in a directory, e.g. an NFS mount shared by the nodes
+type localCacheStore struct {
+	dir string
+}
+
+// Returns the path of the object name, which may not leave the directory of the store
+func (s localCacheStore) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" || clean != "/"+name {
+		return "", fmt.Errorf("Invalid cache object name %q", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s localCacheStore) Get(ctx context.Context, name string, w io.Writer) error {
+	file, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return errCacheMiss
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Put writes the object to a temporary file renamed once complete, so the builds reading the
+// store concurrently never see a partial archive. A directory keeps no tags.
+func (s localCacheStore) Put(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	dst, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dst), ".put-")
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(out, in, size); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+func (s localCacheStore) Latest(ctx context.Context, prefix string) (string, error) {
+	var latest string
+	var latestTime time.Time
+	// Only the directory of the prefix can have matching objects
+	dir := s.dir
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		var err error
+		if dir, err = s.path(prefix[:i]); err != nil {
+			return "", err
+		}
+	}
+	filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && (latest == "" || info.ModTime().After(latestTime)) {
+			latest, latestTime = name, info.ModTime()
+		}
+		return nil
+	})
+	if latest == "" {
+		return "", errCacheMiss
+	}
+	return latest, nil
+}
+
+// storeRequest builds a request to a cache store, once per attempt
+type storeRequest func() (*http.Request, error)
+
+// Sends the request of newRequest with client, retrying after network errors and server errors,
+// and returns the response of the first attempt that got a status below 500. The caller closes
+// its body.
+func doStoreRequest(ctx context.Context, client *http.Client, newRequest storeRequest) (*http.Response, error) {
+	delay := cacheStoreRetryDelay
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req.WithContext(ctx))
+		if err == nil && res.StatusCode < 500 {
+			return res, nil
+		}
+		if err == nil {
+			lastErr = storeError(res)
+			res.Body.Close()
+		} else {
+			lastErr = redactStoreError(err)
+		}
+		if attempt == cacheStoreAttempts || ctx.Err() != nil {
+			return nil, lastErr
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, lastErr
+		}
+		delay *= 2
+	}
+}
+
+// Returns the error of a response of a cache store with a failed status and the start of its
+// body. The query of the URL is left out, it may have a token.
+func storeError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	u := *res.Request.URL
+	u.RawQuery = ""
+	return fmt.Errorf("%s %s: %s: %s", res.Request.Method, u.String(), res.Status, strings.TrimSpace(string(body)))
+}
+
+// Returns err without the query of its URL if it is a url.Error, the query may have a token
+func redactStoreError(err error) error {
+	if uerr, ok := err.(*url.Error); ok {
+		if u, perr := url.Parse(uerr.URL); perr == nil {
+			u.RawQuery = ""
+			return &url.Error{Op: uerr.Op, URL: u.String(), Err: uerr.Err}
+		}
+	}
+	return err
+}
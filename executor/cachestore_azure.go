@@ -0,0 +1,272 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the version of the Blob service REST API of the requests
+const azureAPIVersion = "2020-10-02"
+
+// azureCacheStore keeps the cache archives in a container of an Azure Blob Storage account
+type azureCacheStore struct {
+	// endpoint is the URL of the container
+	endpoint *url.URL
+	prefix   string
+	// sas is the shared access signature of the container authorizing the requests
+	sas    url.Values
+	client *http.Client
+	// partSize is the size of the blocks of the uploads of the files larger than it
+	partSize int64
+	uploads  multipartUploads
+}
+
+// Returns the store of the blobs under prefix in container of account, at the endpoint of query
+// if set, with the shared access signature AZURE_STORAGE_SAS_TOKEN of the launcher environment
+func newAzureCacheStore(account, container, prefix string, query url.Values) (cacheStore, error) {
+	if account == "" || container == "" {
+		return nil, fmt.Errorf("No Azure account and container")
+	}
+	endpoint := "https://" + account + ".blob.core.windows.net"
+	if value := query.Get("endpoint"); value != "" {
+		endpoint = strings.TrimSuffix(value, "/")
+	}
+	u, err := url.Parse(endpoint + "/" + url.PathEscape(container))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid Azure endpoint %q", endpoint)
+	}
+	sas, err := url.ParseQuery(strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"))
+	if err != nil || sas.Get("sig") == "" {
+		return nil, fmt.Errorf("No valid AZURE_STORAGE_SAS_TOKEN for the Azure store")
+	}
+	return &azureCacheStore{endpoint: u, prefix: prefix, sas: sas, client: &http.Client{}, partSize: multipartPartSize}, nil
+}
+
+// Returns the URL of the blob name of the container, or of the container itself if name is
+// empty, with query and the shared access signature
+func (s *azureCacheStore) url(name string, query url.Values) string {
+	u := *s.endpoint
+	if name != "" {
+		u.Path += "/" + name
+		u.RawPath = s.endpoint.EscapedPath() + "/" + awsEscape(name, false)
+	}
+	values := url.Values{}
+	for key, value := range s.sas {
+		values[key] = value
+	}
+	for key, value := range query {
+		values[key] = value
+	}
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+// Returns a request to the URL u of the container
+func (s *azureCacheStore) request(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	return req, nil
+}
+
+func (s *azureCacheStore) Get(ctx context.Context, name string, w io.Writer) error {
+	u := s.url(storeObjectName(s.prefix, name), nil)
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		return s.request("GET", u, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errCacheMiss
+	}
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Put tags the blob with the blob index tags, which the lifecycle management can filter on
+func (s *azureCacheStore) Put(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	if size > s.partSize {
+		return s.putBlocks(ctx, name, file, size, tags)
+	}
+	u := s.url(storeObjectName(s.prefix, name), nil)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		if f != nil {
+			f.Close()
+		}
+		var err error
+		if f, err = os.Open(file); err != nil {
+			return nil, err
+		}
+		req, err := s.request("PUT", u, io.LimitReader(f, size))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		if len(tags) > 0 {
+			req.Header.Set("x-ms-tags", encodeTags(tags))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	return nil
+}
+
+// putBlocks uploads the file in blocks, each retried on its own, resuming the unfinished upload of
+// the same file, then commits the list of the blocks. Azure checks each block and the list
+// against their MD5.
+func (s *azureCacheStore) putBlocks(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	blob := storeObjectName(s.prefix, name)
+	upload := s.uploads.get(name, size, info.ModTime())
+	count := partCount(size, s.partSize)
+	var blockList strings.Builder
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for i := 0; i < count; i++ {
+		if id, ok := upload.parts[i]; ok {
+			blockList.WriteString("<Latest>" + id + "</Latest>")
+			continue
+		}
+		data, sum, err := readPart(f, i, s.partSize, size)
+		if err != nil {
+			return err
+		}
+		// The IDs of the blocks of a blob have the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+		u := s.url(blob, url.Values{"comp": {"block"}, "blockid": {id}})
+		if err := s.put(ctx, u, data, sum, nil); err != nil {
+			return fmt.Errorf("Uploading the block %d of %d of %s: %v", i+1, count, blob, err)
+		}
+		upload.parts[i] = id
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	body := []byte(blockList.String())
+	sum := md5.Sum(body)
+	headers := map[string]string{"x-ms-blob-content-type": "application/octet-stream"}
+	if len(tags) > 0 {
+		headers["x-ms-tags"] = encodeTags(tags)
+	}
+	if err := s.put(ctx, s.url(blob, url.Values{"comp": {"blocklist"}}), body, base64.StdEncoding.EncodeToString(sum[:]), headers); err != nil {
+		// Committing another upload of the blob discards the uncommitted blocks, so the next
+		// attempt starts again
+		s.uploads.done(name)
+		return fmt.Errorf("Committing the blocks of %s: %v", blob, err)
+	}
+	s.uploads.done(name)
+	return nil
+}
+
+// Puts data with the base64 MD5 sum and headers to the URL u
+func (s *azureCacheStore) put(ctx context.Context, u string, data []byte, sum string, headers map[string]string) error {
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		req, err := s.request("PUT", u, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(data))
+		req.Header.Set("Content-MD5", sum)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	return nil
+}
+
+// azureListResult is a page of the blobs of a container
+type azureListResult struct {
+	Blobs []struct {
+		Name         string `xml:"Name"`
+		LastModified string `xml:"Properties>Last-Modified"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *azureCacheStore) Latest(ctx context.Context, prefix string) (string, error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {storeObjectName(s.prefix, prefix)}}
+	var latest string
+	var latestTime time.Time
+	for {
+		u := s.url("", query)
+		res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+			return s.request("GET", u, nil)
+		})
+		if err != nil {
+			return "", err
+		}
+		var page azureListResult
+		if res.StatusCode/100 != 2 {
+			err = storeError(res)
+		} else {
+			err = xml.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		for _, blob := range page.Blobs {
+			modified, err := http.ParseTime(blob.LastModified)
+			if err != nil {
+				continue
+			}
+			if latest == "" || modified.After(latestTime) {
+				latest, latestTime = blob.Name, modified
+			}
+		}
+		if page.NextMarker == "" {
+			break
+		}
+		query.Set("marker", page.NextMarker)
+	}
+	if latest == "" {
+		return "", errCacheMiss
+	}
+	return strings.TrimPrefix(latest, storeObjectName(s.prefix, "")), nil
+}
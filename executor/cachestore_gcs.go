@@ -0,0 +1,394 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gcsEndpoint is the URL of the JSON API of Google Cloud Storage
+	gcsEndpoint = "https://storage.googleapis.com"
+	// gcsMetadataHost serves the access tokens of the service account of a GCE instance or GKE
+	// workload, GCE_METADATA_HOST overriding it
+	gcsMetadataHost = "metadata.google.internal"
+)
+
+// errGCSSessionExpired is the error of a resumable upload session GCS no longer has
+var errGCSSessionExpired = errors.New("The resumable upload session expired")
+
+// gcsCacheStore keeps the cache archives in a Google Cloud Storage bucket
+type gcsCacheStore struct {
+	bucket, prefix string
+	endpoint       string
+	client         *http.Client
+	// partSize is the size of the chunks of the resumable uploads of the files larger than it
+	partSize int64
+	uploads  multipartUploads
+
+	// The access token, GOOGLE_OAUTH_ACCESS_TOKEN or else the one of the metadata server,
+	// refreshed when it expires
+	tokenMu      sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
+
+// Returns the store of the objects under prefix in bucket, at the endpoint of query if set
+func newGCSCacheStore(bucket, prefix string, query url.Values) (cacheStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("No GCS bucket")
+	}
+	s := &gcsCacheStore{bucket: bucket, prefix: prefix, endpoint: gcsEndpoint, client: &http.Client{}, partSize: multipartPartSize}
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid GCS endpoint %q", endpoint)
+		}
+		s.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		s.token, s.tokenExpires = token, time.Now().AddDate(100, 0, 0)
+	}
+	return s, nil
+}
+
+// Returns the access token, from the metadata server unless it is set
+func (s *gcsCacheStore) accessToken(ctx context.Context) (string, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if s.token != "" && time.Now().Before(s.tokenExpires) {
+		return s.token, nil
+	}
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = gcsMetadataHost
+	}
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Getting a GCS access token from the metadata server: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("Getting a GCS access token from the metadata server: %v", storeError(res))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("Getting a GCS access token from the metadata server: invalid response")
+	}
+	// Refreshed a minute early, so it does not expire during a request
+	s.token, s.tokenExpires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+	return s.token, nil
+}
+
+// Returns a request to the URL u of the API with the access token
+func (s *gcsCacheStore) request(ctx context.Context, method, u string, body io.Reader) (*http.Request, error) {
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+func (s *gcsCacheStore) Get(ctx context.Context, name string, w io.Writer) error {
+	u := s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(storeObjectName(s.prefix, name)) + "?alt=media"
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		return s.request(ctx, "GET", u, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errCacheMiss
+	}
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Put sets tags as the custom metadata of the object, which only a resumable upload can
+func (s *gcsCacheStore) Put(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	if size > s.partSize || len(tags) > 0 {
+		return s.putResumable(ctx, name, file, size, tags)
+	}
+	u := s.endpoint + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(storeObjectName(s.prefix, name))
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		if f != nil {
+			f.Close()
+		}
+		var err error
+		if f, err = os.Open(file); err != nil {
+			return nil, err
+		}
+		req, err := s.request(ctx, "POST", u, io.LimitReader(f, size))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	return nil
+}
+
+// putResumable uploads the file in chunks of a resumable upload session, sending a failed chunk
+// again from the bytes GCS has of it and resuming the session of a failed upload of the same
+// file. GCS checks the object against the MD5 of the file.
+func (s *gcsCacheStore) putResumable(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	object := storeObjectName(s.prefix, name)
+	upload := s.uploads.get(name, size, info.ModTime())
+	if upload.md5 == "" {
+		if upload.md5, err = fileMD5(f, size); err != nil {
+			return err
+		}
+	}
+	resume, restarted := upload.id != "", false
+	for {
+		if upload.id == "" {
+			if err := s.startSession(ctx, object, upload, tags); err != nil {
+				return err
+			}
+			resume = false
+		}
+		attempt := 0
+		res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+			if attempt++; attempt > 1 || resume {
+				resume = false
+				if err := s.sessionOffset(ctx, upload); err != nil {
+					return nil, err
+				}
+			}
+			return s.chunkRequest(ctx, upload, f)
+		})
+		if err == nil && (res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone) {
+			res.Body.Close()
+			err = errGCSSessionExpired
+		}
+		if err == errGCSSessionExpired && !restarted {
+			restarted = true
+			upload.id, upload.offset = "", 0
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Uploading %s from the byte %d: %v", object, upload.offset, err)
+		}
+
+		switch {
+		case res.StatusCode == http.StatusPermanentRedirect:
+			upload.offset = gcsPersistedSize(res)
+			res.Body.Close()
+		case res.StatusCode/100 == 2:
+			var uploaded struct {
+				MD5Hash string `json:"md5Hash"`
+			}
+			err := json.NewDecoder(res.Body).Decode(&uploaded)
+			res.Body.Close()
+			s.uploads.done(name)
+			if err != nil {
+				return fmt.Errorf("Uploading %s: invalid response: %v", object, err)
+			}
+			if uploaded.MD5Hash != upload.md5 {
+				return fmt.Errorf("The MD5 of the uploaded %s is %q, want %q", object, uploaded.MD5Hash, upload.md5)
+			}
+			return nil
+		default:
+			// GCS refused the chunk, e.g. for a wrong MD5, so the next attempt starts again
+			err := storeError(res)
+			res.Body.Close()
+			s.uploads.done(name)
+			return fmt.Errorf("Uploading %s: %v", object, err)
+		}
+	}
+}
+
+// Starts the resumable upload session of upload as object with the custom metadata tags, checked
+// against the MD5 of upload
+func (s *gcsCacheStore) startSession(ctx context.Context, object string, upload *multipartUpload, tags map[string]string) error {
+	u := s.endpoint + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?uploadType=resumable"
+	metadata := map[string]interface{}{"name": object, "md5Hash": upload.md5, "contentType": "application/octet-stream"}
+	if len(tags) > 0 {
+		metadata["metadata"] = tags
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		req, err := s.request(ctx, "POST", u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(upload.size, 10))
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	if upload.id = res.Header.Get("Location"); upload.id == "" {
+		return fmt.Errorf("No resumable upload session for %s", object)
+	}
+	upload.offset = 0
+	return nil
+}
+
+// Sets the offset of upload to the number of bytes GCS has, all of them if the upload is complete
+func (s *gcsCacheStore) sessionOffset(ctx context.Context, upload *multipartUpload) error {
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		req, err := s.request(ctx, "PUT", upload.id, nil)
+		if err == nil {
+			req.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(upload.size, 10))
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusPermanentRedirect:
+		upload.offset = gcsPersistedSize(res)
+	case res.StatusCode/100 == 2:
+		upload.offset = upload.size
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return errGCSSessionExpired
+	default:
+		return storeError(res)
+	}
+	return nil
+}
+
+// Returns the request of the chunk of upload from its offset, which asks for the object once GCS
+// has all of it
+func (s *gcsCacheStore) chunkRequest(ctx context.Context, upload *multipartUpload, f *os.File) (*http.Request, error) {
+	n := upload.size - upload.offset
+	if n > s.partSize {
+		n = s.partSize
+	}
+	var body io.Reader = http.NoBody
+	if n > 0 {
+		body = io.NewSectionReader(f, upload.offset, n)
+	}
+	req, err := s.request(ctx, "PUT", upload.id, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = n
+	size := strconv.FormatInt(upload.size, 10)
+	if n == 0 {
+		req.Header.Set("Content-Range", "bytes */"+size)
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", upload.offset, upload.offset+n-1, size))
+	}
+	return req, nil
+}
+
+// Returns the number of bytes GCS has of a resumable upload from the Range of its 308 response
+func gcsPersistedSize(res *http.Response) int64 {
+	var last int64
+	if _, err := fmt.Sscanf(res.Header.Get("Range"), "bytes=0-%d", &last); err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+// gcsListResult is a page of the objects of a bucket
+type gcsListResult struct {
+	Items []struct {
+		Name    string    `json:"name"`
+		Updated time.Time `json:"updated"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (s *gcsCacheStore) Latest(ctx context.Context, prefix string) (string, error) {
+	query := url.Values{"prefix": {storeObjectName(s.prefix, prefix)}, "fields": {"items(name,updated),nextPageToken"}}
+	var latest string
+	var latestTime time.Time
+	for {
+		u := s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + query.Encode()
+		res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+			return s.request(ctx, "GET", u, nil)
+		})
+		if err != nil {
+			return "", err
+		}
+		var page gcsListResult
+		if res.StatusCode/100 != 2 {
+			err = storeError(res)
+		} else {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		for _, object := range page.Items {
+			if latest == "" || object.Updated.After(latestTime) {
+				latest, latestTime = object.Name, object.Updated
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+	if latest == "" {
+		return "", errCacheMiss
+	}
+	return strings.TrimPrefix(latest, storeObjectName(s.prefix, "")), nil
+}
@@ -0,0 +1,456 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3UnsignedPayload is the payload hash of the uploads, which are not hashed before being sent
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3EmptyPayload is the payload hash of the requests without a body, the SHA256 of nothing
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3CacheStore keeps the cache archives in an S3 bucket, or in the bucket of an S3 compatible
+// storage at endpoint
+type s3CacheStore struct {
+	bucket, prefix, region string
+	// endpoint is the URL of the S3 compatible storage, addressed with path-style URLs, or nil
+	// for AWS
+	endpoint                           *url.URL
+	accessKey, secretKey, sessionToken string
+	client                             *http.Client
+	// partSize is the size of the parts of the multipart uploads of the files larger than it
+	partSize int64
+	uploads  multipartUploads
+}
+
+// Returns the store of the objects under prefix in bucket, in the region and at the endpoint of
+// query, with the credentials of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN in
+// the launcher environment
+func newS3CacheStore(bucket, prefix string, query url.Values) (cacheStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("No S3 bucket")
+	}
+	s := &s3CacheStore{
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       query.Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+		partSize:     multipartPartSize,
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+		}
+		s.endpoint = u
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("No AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for the S3 store")
+	}
+	return s, nil
+}
+
+// Returns the URL of the object key of the bucket, or of the bucket itself if key is empty
+func (s *s3CacheStore) url(key string, query url.Values) *url.URL {
+	var u url.URL
+	if s.endpoint != nil {
+		u = *s.endpoint
+		u.Path = "/" + s.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u = url.URL{Scheme: "https", Host: s.bucket + ".s3." + s.region + ".amazonaws.com", Path: "/" + key}
+	}
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = awsCanonicalQuery(query)
+	return &u
+}
+
+// Returns a signed request to the URL u of the store
+func (s *s3CacheStore) request(method string, u *url.URL, body io.Reader, payloadHash string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash)
+	return req, nil
+}
+
+// Signs req, whose payload has the hex SHA256 payloadHash, along with its X-Amz-* headers
+func (s *s3CacheStore) sign(req *http.Request, payloadHash string) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	signAWSv4(req, "s3", s.region, s.accessKey, s.secretKey, payloadHash, time.Now())
+}
+
+func (s *s3CacheStore) Get(ctx context.Context, name string, w io.Writer) error {
+	u := s.url(storeObjectName(s.prefix, name), nil)
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		return s.request("GET", u, nil, s3EmptyPayload)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errCacheMiss
+	}
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Put tags the object with the S3 object tags, which the lifecycle rules can filter on
+func (s *s3CacheStore) Put(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	if size > s.partSize {
+		return s.putMultipart(ctx, name, file, size, tags)
+	}
+	u := s.url(storeObjectName(s.prefix, name), nil)
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		if f != nil {
+			f.Close()
+		}
+		var err error
+		if f, err = os.Open(file); err != nil {
+			return nil, err
+		}
+		req, err := s.request("PUT", u, io.LimitReader(f, size), s3UnsignedPayload)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if len(tags) > 0 {
+			req.Header.Set("X-Amz-Tagging", encodeTags(tags))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	return nil
+}
+
+// s3CompleteMultipartUpload lists the parts of a multipart upload to complete it
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads the file in parts, each retried on its own, resuming the unfinished upload
+// of the same file. S3 checks each part against its MD5 and SHA256.
+func (s *s3CacheStore) putMultipart(ctx context.Context, name, file string, size int64, tags map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	key := storeObjectName(s.prefix, name)
+	upload := s.uploads.get(name, size, info.ModTime())
+	if upload.id == "" {
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		headers := map[string]string{}
+		if len(tags) > 0 {
+			headers["X-Amz-Tagging"] = encodeTags(tags)
+		}
+		if err := s.post(ctx, s.url(key, url.Values{"uploads": {""}}), nil, headers, &result); err != nil {
+			return err
+		}
+		if result.UploadID == "" {
+			return fmt.Errorf("No upload ID for the multipart upload of %s", key)
+		}
+		upload.id = result.UploadID
+	}
+
+	count := partCount(size, s.partSize)
+	complete := s3CompleteMultipartUpload{}
+	for i := 0; i < count; i++ {
+		if etag, ok := upload.parts[i]; ok {
+			complete.Parts = append(complete.Parts, s3Part{i + 1, etag})
+			continue
+		}
+		data, sum, err := readPart(f, i, s.partSize, size)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		u := s.url(key, url.Values{"partNumber": {strconv.Itoa(i + 1)}, "uploadId": {upload.id}})
+		res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+			req, err := s.request("PUT", u, bytes.NewReader(data), hex.EncodeToString(hash[:]))
+			if err != nil {
+				return nil, err
+			}
+			req.ContentLength = int64(len(data))
+			req.Header.Set("Content-MD5", sum)
+			return req, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Uploading the part %d of %d of %s: %v", i+1, count, key, err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			// The upload was aborted or expired, the next attempt starts a new one
+			s.uploads.done(name)
+		}
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("Uploading the part %d of %d of %s: %v", i+1, count, key, storeError(res))
+		}
+		upload.parts[i] = res.Header.Get("ETag")
+		complete.Parts = append(complete.Parts, s3Part{i + 1, upload.parts[i]})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	if err := s.post(ctx, s.url(key, url.Values{"uploadId": {upload.id}}), body, nil, nil); err != nil {
+		return fmt.Errorf("Completing the multipart upload of %s: %v", key, err)
+	}
+	s.uploads.done(name)
+	return nil
+}
+
+// Posts body with headers to the URL u and decodes the XML response into result, if not nil. S3
+// may report an error with a 200 status once it started responding, so an Error document fails
+// too.
+func (s *s3CacheStore) post(ctx context.Context, u *url.URL, body []byte, headers map[string]string, result interface{}) error {
+	hash := sha256.Sum256(body)
+	res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		s.sign(req, hex.EncodeToString(hash[:]))
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return storeError(res)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var s3Err struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &s3Err) == nil {
+		return fmt.Errorf("%s %s: %s: %s", res.Request.Method, u.Path, s3Err.Code, s3Err.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// s3ListResult is a page of the objects of a bucket
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3CacheStore) Latest(ctx context.Context, prefix string) (string, error) {
+	fullPrefix := storeObjectName(s.prefix, prefix)
+	var latest string
+	var latestTime time.Time
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {fullPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.url("", query)
+		res, err := doStoreRequest(ctx, s.client, func() (*http.Request, error) {
+			return s.request("GET", u, nil, s3EmptyPayload)
+		})
+		if err != nil {
+			return "", err
+		}
+		var page s3ListResult
+		if res.StatusCode/100 != 2 {
+			err = storeError(res)
+		} else {
+			err = xml.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		for _, object := range page.Contents {
+			if latest == "" || object.LastModified.After(latestTime) {
+				latest, latestTime = object.Key, object.LastModified
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if latest == "" {
+		return "", errCacheMiss
+	}
+	return strings.TrimPrefix(latest, storeObjectName(s.prefix, "")), nil
+}
+
+// Signs req with the AWS Signature Version 4 of service in region at t, the payload of the
+// request having the hex SHA256 payloadHash. The host and X-Amz-* headers are signed.
+func signAWSv4(req *http.Request, service, region, accessKey, secretKey, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Returns query with its keys sorted and its keys and values escaped the AWS way
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Returns s with every byte but the unreserved characters of RFC 3986 percent-encoded, and the
+// slashes too if escapeSlash
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
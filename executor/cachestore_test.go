@@ -0,0 +1,517 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObjects are the objects of a fake bucket, their times a second apart in the order they were
+// put
+type fakeObjects struct {
+	mu      sync.Mutex
+	data    map[string][]byte
+	times   map[string]time.Time
+	next    time.Time
+	pageLen int
+	// tags are the tags of the objects as a URL query
+	tags map[string]string
+}
+
+func newFakeObjects() *fakeObjects {
+	return &fakeObjects{data: map[string][]byte{}, times: map[string]time.Time{}, next: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), pageLen: 1, tags: map[string]string{}}
+}
+
+func (o *fakeObjects) put(name string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next = o.next.Add(time.Second)
+	o.data[name], o.times[name] = data, o.next
+}
+
+func (o *fakeObjects) get(name string) ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, ok := o.data[name]
+	return data, ok
+}
+
+// Returns the names with prefix from the one after marker, at most pageLen of them, and the
+// marker of the next page
+func (o *fakeObjects) list(prefix, marker string) ([]string, []time.Time, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var names []string
+	for name := range o.data {
+		if strings.HasPrefix(name, prefix) && name > marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	next := ""
+	if len(names) > o.pageLen {
+		names = names[:o.pageLen]
+		next = names[len(names)-1]
+	}
+	var times []time.Time
+	for _, name := range names {
+		times = append(times, o.times[name])
+	}
+	return names, times, next
+}
+
+// Checks that store gets, puts and lists the objects of the fake bucket, whose names start with
+// storePrefix
+func testCacheStore(t *testing.T, store cacheStore, objects *fakeObjects, storePrefix string) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if err := store.Get(ctx, "pipelines/1/npm-a.tar.gz", &buf); err != errCacheMiss {
+		t.Fatalf("Get() of a missing object = %v, want a cache miss", err)
+	}
+	if _, err := store.Latest(ctx, "pipelines/1/npm-"); err != errCacheMiss {
+		t.Fatalf("Latest() without objects = %v, want a cache miss", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "cachestore")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "archive")
+	for _, name := range []string{"pipelines/1/npm-b.tar.gz", "pipelines/1/npm-a.tar.gz", "pipelines/1/go-a.tar.gz"} {
+		ioutil.WriteFile(file, []byte("archive "+name), 0644)
+		if err := store.Put(ctx, name, file, int64(len("archive "+name)), nil); err != nil {
+			t.Fatalf("Put(%s) = %v", name, err)
+		}
+	}
+	if data, ok := objects.get(storePrefix + "pipelines/1/npm-a.tar.gz"); !ok || string(data) != "archive pipelines/1/npm-a.tar.gz" {
+		t.Errorf("The object should be stored with its prefix, got %q", data)
+	}
+	if err := store.Get(ctx, "pipelines/1/npm-b.tar.gz", &buf); err != nil || buf.String() != "archive pipelines/1/npm-b.tar.gz" {
+		t.Errorf("Get() = %q, %v", buf.String(), err)
+	}
+	// The newest of the objects with the prefix, over several pages
+	if name, err := store.Latest(ctx, "pipelines/1/npm-"); err != nil || name != "pipelines/1/npm-a.tar.gz" {
+		t.Errorf("Latest() = %q, %v, want pipelines/1/npm-a.tar.gz", name, err)
+	}
+	if name, err := store.Latest(ctx, "pipelines/2/"); err != errCacheMiss {
+		t.Errorf("Latest() of another prefix = %q, %v, want a cache miss", name, err)
+	}
+}
+
+// Puts a tagged file of 3 parts with store, whose fake bucket refuses the second part once: the
+// upload either resumes by itself or with the next Put, without sending the accepted parts again.
+// parts counts the parts the fake bucket accepted, want of them.
+func testMultipartPut(t *testing.T, store cacheStore, objects *fakeObjects, storePrefix string, parts *int, want int) {
+	tmp, err := ioutil.TempDir("", "cachestore")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	file, data := filepath.Join(tmp, "archive"), "0123456789abcdefghij"
+	ioutil.WriteFile(file, []byte(data), 0644)
+
+	ctx := context.Background()
+	name := "pipelines/1/large.tar.gz"
+	tags := map[string]string{"retention": "30d"}
+	if err := store.Put(ctx, name, file, int64(len(data)), tags); err != nil {
+		if err := store.Put(ctx, name, file, int64(len(data)), tags); err != nil {
+			t.Fatalf("Put() should resume the upload, got %v", err)
+		}
+	}
+	if got, ok := objects.get(storePrefix + name); !ok || string(got) != data {
+		t.Errorf("The parts should be put together, got %q", got)
+	}
+	if got := objects.tags[storePrefix+name]; got != "retention=30d" {
+		t.Errorf("The object should be tagged with retention=30d, got %q", got)
+	}
+	if *parts != want {
+		t.Errorf("The bucket should accept %d parts, got %d", want, *parts)
+	}
+}
+
+func TestNewCacheStore(t *testing.T) {
+	defer os.Setenv("SD_CACHE_STORE", os.Getenv("SD_CACHE_STORE"))
+	defer os.Setenv("AWS_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID"))
+	defer os.Setenv("AWS_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	defer os.Setenv("AZURE_STORAGE_SAS_TOKEN", os.Getenv("AZURE_STORAGE_SAS_TOKEN"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	os.Setenv("AZURE_STORAGE_SAS_TOKEN", "")
+
+	os.Setenv("SD_CACHE_STORE", "")
+	if store, err := newCacheStore(); store != nil || err != nil {
+		t.Errorf("newCacheStore() = %v, %v, want no store", store, err)
+	}
+	for _, value := range []string{"ftp://host/dir", "file://dir", "s3://bucket/ci", "azblob://account/container", "gs:///ci", "s3://bucket?endpoint=minio:9000"} {
+		os.Setenv("SD_CACHE_STORE", value)
+		if store, err := newCacheStore(); err == nil {
+			t.Errorf("newCacheStore(%s) = %v, want an error", value, store)
+		}
+	}
+
+	os.Setenv("SD_CACHE_STORE", "file:///mnt/cache/")
+	if store, err := newCacheStore(); err != nil || store != (localCacheStore{dir: "/mnt/cache"}) {
+		t.Errorf("newCacheStore() = %v, %v, want the local store of /mnt/cache", store, err)
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("SD_CACHE_STORE", "s3://bucket/ci/caches?region=eu-west-1")
+	store, err := newCacheStore()
+	if s, ok := store.(*s3CacheStore); err != nil || !ok || s.bucket != "bucket" || s.prefix != "ci/caches" || s.region != "eu-west-1" {
+		t.Errorf("newCacheStore() = %+v, %v", store, err)
+	}
+	os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2020-10-02&sig=abc")
+	os.Setenv("SD_CACHE_STORE", "azblob://account/container/ci")
+	store, err = newCacheStore()
+	if s, ok := store.(*azureCacheStore); err != nil || !ok || s.endpoint.String() != "https://account.blob.core.windows.net/container" || s.prefix != "ci" {
+		t.Errorf("newCacheStore() = %+v, %v", store, err)
+	}
+}
+
+func TestLocalCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachestore")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := localCacheStore{dir: filepath.Join(dir, "store")}
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if err := store.Get(ctx, "pipelines/1/npm-a.tar.gz", &buf); err != errCacheMiss {
+		t.Fatalf("Get() of a missing object = %v, want a cache miss", err)
+	}
+	file := filepath.Join(dir, "archive")
+	ioutil.WriteFile(file, []byte("archive"), 0644)
+	for _, name := range []string{"pipelines/1/npm-a.tar.gz", "pipelines/1/npm-b.tar.gz"} {
+		if err := store.Put(ctx, name, file, 7, nil); err != nil {
+			t.Fatalf("Put(%s) = %v", name, err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "store", "pipelines", "1", "npm-a.tar.gz"), old, old)
+	if err := store.Get(ctx, "pipelines/1/npm-b.tar.gz", &buf); err != nil || buf.String() != "archive" {
+		t.Errorf("Get() = %q, %v", buf.String(), err)
+	}
+	if name, err := store.Latest(ctx, "pipelines/1/npm-"); err != nil || name != "pipelines/1/npm-b.tar.gz" {
+		t.Errorf("Latest() = %q, %v, want pipelines/1/npm-b.tar.gz", name, err)
+	}
+	if name, err := store.Latest(ctx, "pipelines/2/npm-"); err != errCacheMiss {
+		t.Errorf("Latest() of another prefix = %q, %v, want a cache miss", name, err)
+	}
+	for _, name := range []string{"../npm.tar.gz", "pipelines//npm.tar.gz", ""} {
+		if err := store.Put(ctx, name, file, 7, nil); err == nil {
+			t.Errorf("Put(%q) should fail", name)
+		}
+	}
+}
+
+func TestS3CacheStore(t *testing.T) {
+	objects := newFakeObjects()
+	failedOnce, failedPart := false, false
+	parts, partData, partTags := 0, map[string][]byte{}, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		query := r.URL.Query()
+		switch {
+		case r.Method == "PUT" && !failedOnce:
+			// The upload is retried
+			failedOnce = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.Method == "POST" && query.Get("uploads") == "" && len(query["uploads"]) == 1:
+			partTags = r.Header.Get("X-Amz-Tagging")
+			w.Write([]byte("<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>"))
+		case r.Method == "PUT" && query.Get("uploadId") == "upload-1":
+			body, _ := ioutil.ReadAll(r.Body)
+			sum := md5.Sum(body)
+			if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) || (query.Get("partNumber") == "2" && !failedPart) {
+				failedPart = true
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			parts++
+			partData[query.Get("partNumber")] = body
+			w.Header().Set("ETag", fmt.Sprintf("%q", hex.EncodeToString(sum[:])))
+		case r.Method == "POST" && query.Get("uploadId") == "upload-1":
+			var complete s3CompleteMultipartUpload
+			xml.NewDecoder(r.Body).Decode(&complete)
+			var data []byte
+			for _, part := range complete.Parts {
+				sum := md5.Sum(partData[strconv.Itoa(part.PartNumber)])
+				if part.ETag != fmt.Sprintf("%q", hex.EncodeToString(sum[:])) {
+					w.Write([]byte("<Error><Code>InvalidPart</Code><Message>Wrong ETag</Message></Error>"))
+					return
+				}
+				data = append(data, partData[strconv.Itoa(part.PartNumber)]...)
+			}
+			objects.put(key, data)
+			objects.tags[key] = partTags
+			w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+		case r.Method == "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			objects.put(key, body)
+		case r.URL.Path == "/bucket" && r.URL.Query().Get("list-type") == "2":
+			names, times, next := objects.list(r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+			var page s3ListResult
+			for i, name := range names {
+				page.Contents = append(page.Contents, struct {
+					Key          string    `xml:"Key"`
+					LastModified time.Time `xml:"LastModified"`
+				}{name, times[i]})
+			}
+			page.IsTruncated, page.NextContinuationToken = next != "", next
+			xml.NewEncoder(w).Encode(page)
+		default:
+			data, ok := objects.get(key)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+	defer os.Setenv("AWS_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID"))
+	defer os.Setenv("AWS_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	store, err := newS3CacheStore("bucket", "ci", url.Values{"endpoint": {server.URL}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testCacheStore(t, store, objects, "ci/")
+	store.(*s3CacheStore).partSize = 8
+	testMultipartPut(t, store, objects, "ci/", &parts, 3)
+}
+
+func TestGCSCacheStore(t *testing.T) {
+	objects := newFakeObjects()
+	// The resumable upload session
+	var session struct {
+		name, md5 string
+		data      []byte
+	}
+	failedChunk, parts := false, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Query().Get("uploadType") == "resumable":
+			var metadata struct {
+				Name     string            `json:"name"`
+				MD5Hash  string            `json:"md5Hash"`
+				Metadata map[string]string `json:"metadata"`
+			}
+			json.NewDecoder(r.Body).Decode(&metadata)
+			session.name, session.md5, session.data = metadata.Name, metadata.MD5Hash, nil
+			objects.tags[session.name] = encodeTags(metadata.Metadata)
+			w.Header().Set("Location", "http://"+r.Host+"/upload/storage/v1/b/bucket/o?uploadType=resumable&upload_id=session-1")
+		case r.Method == "PUT" && r.URL.Query().Get("upload_id") == "session-1":
+			body, _ := ioutil.ReadAll(r.Body)
+			var start, end, size int
+			if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err == nil {
+				if start != len(session.data) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if start > 0 && !failedChunk {
+					// Only the start of the chunk is persisted
+					failedChunk = true
+					session.data = append(session.data, body[:4]...)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				parts++
+				session.data = append(session.data, body...)
+			} else if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%d", &size); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if len(session.data) < size {
+				if len(session.data) > 0 {
+					w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+				}
+				w.WriteHeader(http.StatusPermanentRedirect)
+				return
+			}
+			sum := md5.Sum(session.data)
+			if base64.StdEncoding.EncodeToString(sum[:]) != session.md5 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects.put(session.name, session.data)
+			json.NewEncoder(w).Encode(map[string]string{"name": session.name, "md5Hash": session.md5})
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+			body, _ := ioutil.ReadAll(r.Body)
+			objects.put(r.URL.Query().Get("name"), body)
+		case r.URL.Path == "/storage/v1/b/bucket/o":
+			names, times, next := objects.list(r.URL.Query().Get("prefix"), r.URL.Query().Get("pageToken"))
+			var page gcsListResult
+			for i, name := range names {
+				page.Items = append(page.Items, struct {
+					Name    string    `json:"name"`
+					Updated time.Time `json:"updated"`
+				}{name, times[i]})
+			}
+			page.NextPageToken = next
+			json.NewEncoder(w).Encode(page)
+		default:
+			// The name is a single escaped segment
+			name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1/b/bucket/o/"))
+			data, ok := objects.get(name)
+			if err != nil || strings.Contains(r.URL.EscapedPath(), "o/ci/") || r.URL.Query().Get("alt") != "media" || !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+	defer os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"))
+	os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+
+	store, err := newGCSCacheStore("bucket", "ci", url.Values{"endpoint": {server.URL}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testCacheStore(t, store, objects, "ci/")
+	// The second chunk is sent again from the bytes GCS has of it, with the rest of the file
+	store.(*gcsCacheStore).partSize = 8
+	testMultipartPut(t, store, objects, "ci/", &parts, 2)
+}
+
+func TestGCSMetadataToken(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" || r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests++
+		w.Write([]byte(`{"access_token": "metadata-token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer server.Close()
+	defer os.Setenv("GCE_METADATA_HOST", os.Getenv("GCE_METADATA_HOST"))
+	defer os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"))
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+
+	store, _ := newGCSCacheStore("bucket", "", nil)
+	for i := 0; i < 2; i++ {
+		if token, err := store.(*gcsCacheStore).accessToken(context.Background()); err != nil || token != "metadata-token" {
+			t.Errorf("accessToken() = %q, %v, want metadata-token", token, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("The token should be cached, got %d requests", requests)
+	}
+}
+
+func TestAzureCacheStore(t *testing.T) {
+	objects := newFakeObjects()
+	failedBlock, parts, blocks := false, 0, map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "abc" || r.Header.Get("x-ms-version") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/container/")
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := md5.Sum(body)
+		switch {
+		case r.Method == "PUT" && r.URL.Query().Get("comp") != "" && r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]):
+			w.WriteHeader(http.StatusBadRequest)
+		case r.Method == "PUT" && r.URL.Query().Get("comp") == "block":
+			if len(blocks) == 1 && !failedBlock {
+				failedBlock = true
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			parts++
+			blocks[r.URL.Query().Get("blockid")] = body
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "PUT" && r.URL.Query().Get("comp") == "blocklist":
+			var list struct {
+				Latest []string `xml:"Latest"`
+			}
+			xml.Unmarshal(body, &list)
+			var data []byte
+			for _, id := range list.Latest {
+				data = append(data, blocks[id]...)
+			}
+			objects.put(name, data)
+			objects.tags[name] = r.Header.Get("x-ms-tags")
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "PUT" && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+			objects.put(name, body)
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/container" && r.URL.Query().Get("comp") == "list":
+			names, times, next := objects.list(r.URL.Query().Get("prefix"), r.URL.Query().Get("marker"))
+			var page strings.Builder
+			page.WriteString("<EnumerationResults><Blobs>")
+			for i, name := range names {
+				page.WriteString("<Blob><Name>" + name + "</Name><Properties><Last-Modified>" + times[i].Format(http.TimeFormat) + "</Last-Modified></Properties></Blob>")
+			}
+			page.WriteString("</Blobs><NextMarker>" + next + "</NextMarker></EnumerationResults>")
+			w.Write([]byte(page.String()))
+		default:
+			data, ok := objects.get(name)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+	defer os.Setenv("AZURE_STORAGE_SAS_TOKEN", os.Getenv("AZURE_STORAGE_SAS_TOKEN"))
+	os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2020-10-02&sig=abc")
+
+	store, err := newAzureCacheStore("account", "container", "ci", url.Values{"endpoint": {server.URL}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testCacheStore(t, store, objects, "ci/")
+	store.(*azureCacheStore).partSize = 8
+	testMultipartPut(t, store, objects, "ci/", &parts, 3)
+
+	// The signature of the URL is not in the errors
+	server.Close()
+	err = store.Get(context.Background(), "pipelines/1/npm-a.tar.gz", &bytes.Buffer{})
+	if err == nil || strings.Contains(err.Error(), "sig=") {
+		t.Errorf("Get() = %v, want an error without the signature", err)
+	}
+}
+
+func TestSignAWSv4(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signAWSv4(req, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", s3EmptyPayload, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+}
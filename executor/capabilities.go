@@ -0,0 +1,25 @@
+package executor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Parses a comma separated list of capabilities to keep (e.g. "chown,CAP_SETUID"), or "none", to
+// the sorted list of their names
+func parseCapabilities(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "cap_")
+		if name == "" || name == "none" {
+			continue
+		}
+		if _, ok := capabilityNumbers[name]; !ok {
+			return nil, fmt.Errorf("Unknown capability %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,105 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Linux capabilities by their name without the CAP_ prefix, as in SD_STEP_CAPABILITIES
+var capabilityNumbers = map[string]uint{
+	"chown":            unix.CAP_CHOWN,
+	"dac_override":     unix.CAP_DAC_OVERRIDE,
+	"dac_read_search":  unix.CAP_DAC_READ_SEARCH,
+	"fowner":           unix.CAP_FOWNER,
+	"fsetid":           unix.CAP_FSETID,
+	"kill":             unix.CAP_KILL,
+	"setgid":           unix.CAP_SETGID,
+	"setuid":           unix.CAP_SETUID,
+	"setpcap":          unix.CAP_SETPCAP,
+	"linux_immutable":  unix.CAP_LINUX_IMMUTABLE,
+	"net_bind_service": unix.CAP_NET_BIND_SERVICE,
+	"net_broadcast":    unix.CAP_NET_BROADCAST,
+	"net_admin":        unix.CAP_NET_ADMIN,
+	"net_raw":          unix.CAP_NET_RAW,
+	"ipc_lock":         unix.CAP_IPC_LOCK,
+	"ipc_owner":        unix.CAP_IPC_OWNER,
+	"sys_module":       unix.CAP_SYS_MODULE,
+	"sys_rawio":        unix.CAP_SYS_RAWIO,
+	"sys_chroot":       unix.CAP_SYS_CHROOT,
+	"sys_ptrace":       unix.CAP_SYS_PTRACE,
+	"sys_pacct":        unix.CAP_SYS_PACCT,
+	"sys_admin":        unix.CAP_SYS_ADMIN,
+	"sys_boot":         unix.CAP_SYS_BOOT,
+	"sys_nice":         unix.CAP_SYS_NICE,
+	"sys_resource":     unix.CAP_SYS_RESOURCE,
+	"sys_time":         unix.CAP_SYS_TIME,
+	"sys_tty_config":   unix.CAP_SYS_TTY_CONFIG,
+	"mknod":            unix.CAP_MKNOD,
+	"lease":            unix.CAP_LEASE,
+	"audit_write":      unix.CAP_AUDIT_WRITE,
+	"audit_control":    unix.CAP_AUDIT_CONTROL,
+	"setfcap":          unix.CAP_SETFCAP,
+	"mac_override":     unix.CAP_MAC_OVERRIDE,
+	"mac_admin":        unix.CAP_MAC_ADMIN,
+	"syslog":           unix.CAP_SYSLOG,
+	"wake_alarm":       unix.CAP_WAKE_ALARM,
+	"block_suspend":    unix.CAP_BLOCK_SUSPEND,
+	"audit_read":       unix.CAP_AUDIT_READ,
+	"perfmon":          unix.CAP_PERFMON,
+	"bpf":              unix.CAP_BPF,
+}
+
+// Drops all the capabilities but keep from the bounding and inheritable sets of the calling
+// thread, and clears its ambient set, so the program it executes next only gets those even as
+// root. The thread needs CAP_SETPCAP.
+func dropCapabilities(keep []string) error {
+	kept := map[uint]bool{}
+	for _, name := range keep {
+		kept[capabilityNumbers[name]] = true
+	}
+
+	for c := uint(0); c <= lastCapability(); c++ {
+		if kept[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("Dropping capability %d from the bounding set: %v", c, err)
+		}
+	}
+
+	// Root keeps the inheritable capabilities across exec whatever the bounding set
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("Reading the capabilities: %v", err)
+	}
+	data[0].Inheritable, data[1].Inheritable = 0, 0
+	for c := range kept {
+		data[c/32].Inheritable |= data[c/32].Permitted & (1 << (c % 32))
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("Setting the inheritable capabilities: %v", err)
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("Clearing the ambient capabilities: %v", err)
+	}
+	return nil
+}
+
+// Returns the highest capability of the running kernel, which may know more than this package
+func lastCapability() uint {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return uint(last)
+}
@@ -0,0 +1,63 @@
+package executor
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		err  bool
+	}{
+		{"none", nil, false},
+		{"setuid, CAP_CHOWN,", []string{"chown", "setuid"}, false},
+		{"NET_BIND_SERVICE", []string{"net_bind_service"}, false},
+		{"chown,superpowers", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseCapabilities(test.list)
+		if !reflect.DeepEqual(got, test.want) || (err != nil) != test.err {
+			t.Errorf("parseCapabilities(%q) = %v, %v, want %v, error %v", test.list, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestRunDropsCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Dropping capabilities needs root")
+	}
+
+	envFilepath := "/tmp/testCapabilities"
+	setupTestCase(t, envFilepath)
+	os.Setenv("SD_STEP_CAPABILITIES", "chown")
+	defer os.Unsetenv("SD_STEP_CAPABILITIES")
+
+	// Only CAP_CHOWN (bit 0) is left for the user steps, even for root
+	onlyChown := "grep -q '^CapBnd:\t0000000000000001$' /proc/self/status && grep -q '^CapEff:\t0000000000000001$' /proc/self/status"
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: onlyChown, Name: "step"},
+			{Cmd: onlyChown, Name: "teardown-user"},
+			{Cmd: "! grep -q '^CapBnd:\t0000000000000001$' /proc/self/status", Name: "sd-teardown-launcher"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	if err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v, exit codes %v", err, codes)
+	}
+}
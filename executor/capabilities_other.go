@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// capabilityNumbers is empty where there are no Linux capabilities, none can be kept
+var capabilityNumbers = map[string]uint{}
+
+// Fails, the capabilities of the steps can only be dropped on Linux
+func dropCapabilities(keep []string) error {
+	return fmt.Errorf("Dropping capabilities is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,212 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// checkpointTimeout bounds a request for the checkpoint of a build
+const checkpointTimeout = time.Minute
+
+// buildCheckpoint is the progress of a build after its last user step that did not fail it, for
+// the build to resume from if it is preempted and runs again
+type buildCheckpoint struct {
+	BuildID int `json:"buildId"`
+	// Steps are the user steps that did not fail the build, in the order they ran
+	Steps []string `json:"steps"`
+	// Env is the environment the build shell exported after the last of them, without the secrets
+	Env string `json:"env,omitempty"`
+	// Workspace is the object of the snapshot of the source directory after the last of them
+	Workspace string    `json:"workspace,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// checkpointer saves the progress of a build to the object store of SD_CHECKPOINT_STORE after each
+// user step, and restores it when the build runs again: the steps that passed before are not run
+// again, the source directory is restored from its snapshot and the environment the build shell
+// exported is sourced. A nil checkpointer saves and restores nothing.
+type checkpointer struct {
+	store       cacheStore
+	compression cacheCompression
+	buildID     int
+	sourceDir   string
+	// steps are the user steps that did not fail the build so far
+	steps []string
+	// resume is the checkpoint the build resumes from until a step does not match it, and next the
+	// index of its next step
+	resume *buildCheckpoint
+	next   int
+}
+
+// Returns the checkpointer of build buildID with the source directory sourceDir, snapshots
+// archived with compression, or nil if SD_CHECKPOINT_STORE is not set in the launcher environment
+func newCheckpointer(buildID int, sourceDir string, compression cacheCompression) (*checkpointer, error) {
+	store, err := newObjectStore("SD_CHECKPOINT_STORE")
+	if err != nil || store == nil {
+		return nil, err
+	}
+	return &checkpointer{store: store, compression: compression, buildID: buildID, sourceDir: sourceDir}, nil
+}
+
+// Returns the name of the object of the checkpoint, or of a file of it
+func (c *checkpointer) object(name string) string {
+	return "checkpoints/" + strconv.Itoa(c.buildID) + "/" + name
+}
+
+// Loads the checkpoint of the build, if it ran before. A checkpoint that cannot be loaded is left
+// out, with a warning, and the build starts over.
+func (c *checkpointer) load() {
+	if c == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancel()
+	var buf bytes.Buffer
+	err := c.store.Get(ctx, c.object("checkpoint.json"), &buf)
+	if err == errCacheMiss {
+		return
+	}
+	var checkpoint buildCheckpoint
+	if err == nil {
+		err = json.Unmarshal(buf.Bytes(), &checkpoint)
+	}
+	if err != nil {
+		logger.Warnf("Failed to load the checkpoint of the build, starting over: %v", err)
+		return
+	}
+	if checkpoint.BuildID != c.buildID || len(checkpoint.Steps) == 0 {
+		return
+	}
+	logger.Infof("Resuming the build from its checkpoint of %s after step %q", checkpoint.Time.Format(time.RFC3339), checkpoint.Steps[len(checkpoint.Steps)-1])
+	c.resume = &checkpoint
+}
+
+// Returns whether the user step name passed before the build ran again, so it is not run again.
+// The first one restores the source directory and the environment with restoreEnv, which sources
+// a file in the build shell; if they cannot be, the build starts over.
+func (c *checkpointer) restores(name string, envFile string, restoreEnv func(file string) error) bool {
+	if c == nil || c.resume == nil {
+		return false
+	}
+	if c.next >= len(c.resume.Steps) || c.resume.Steps[c.next] != name {
+		if c.next < len(c.resume.Steps) {
+			logger.Warnf("Step %q is not step %q of the checkpoint, running the steps left", name, c.resume.Steps[c.next])
+		}
+		c.resume = nil
+		return false
+	}
+	if c.next == 0 {
+		if err := c.restore(envFile, restoreEnv); err != nil {
+			logger.Warnf("Failed to restore the checkpoint of the build, starting over: %v", err)
+			c.resume = nil
+			return false
+		}
+	}
+	c.next++
+	c.steps = append(c.steps, name)
+	return true
+}
+
+// Restores the snapshot of the source directory and the environment of the checkpoint
+func (c *checkpointer) restore(envFile string, restoreEnv func(file string) error) error {
+	if c.resume.Workspace != "" {
+		if err := getArchive(c.store, c.resume.Workspace, c.sourceDir, []string{c.sourceDir}); err != nil {
+			return fmt.Errorf("Restoring the source directory from %s: %v", c.resume.Workspace, err)
+		}
+	}
+	if c.resume.Env == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(envFile, []byte(c.resume.Env), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(envFile)
+	if err := restoreEnv(envFile); err != nil {
+		return fmt.Errorf("Restoring the environment: %v", err)
+	}
+	return nil
+}
+
+// Saves the checkpoint of the build after the user step name, which did not fail it, with the
+// environment exportEnv writes to envFile from the build shell. A checkpoint that cannot be saved
+// is left out, with a warning, and the build resumes from the one before if it runs again.
+func (c *checkpointer) save(name string, envFile string, exportEnv func(file string) error) {
+	if c == nil {
+		return
+	}
+	c.steps = append(c.steps, name)
+	checkpoint := buildCheckpoint{BuildID: c.buildID, Steps: c.steps, Time: time.Now()}
+
+	defer os.Remove(envFile)
+	if err := exportEnv(envFile); err != nil {
+		logger.Warnf("Failed to save the checkpoint of step %q, exporting the environment: %v", name, err)
+		return
+	}
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		logger.Warnf("Failed to save the checkpoint of step %q: %v", name, err)
+		return
+	}
+	checkpoint.Env = string(env)
+
+	// Each snapshot has its own object, so the checkpoint before stays whole until this one is
+	if c.sourceDir != "" {
+		object := c.object(fmt.Sprintf("workspace-%d", len(c.steps))) + c.compression.ext()
+		size, err := putArchive(c.store, c.compression, object, c.sourceDir, []string{c.sourceDir})
+		if err != nil {
+			logger.Warnf("Failed to save the checkpoint of step %q, archiving the source directory: %v", name, err)
+			return
+		}
+		if size >= 0 {
+			checkpoint.Workspace = object
+		}
+	}
+
+	if err := c.put(checkpoint); err != nil {
+		logger.Warnf("Failed to save the checkpoint of step %q: %v", name, err)
+		return
+	}
+	logger.Debugf("Saved the checkpoint of the build after step %q", name)
+}
+
+// Uploads checkpoint as the checkpoint of the build
+func (c *checkpointer) put(checkpoint buildCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile("", "sd-checkpoint-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancel()
+	return c.store.Put(ctx, c.object("checkpoint.json"), tmp.Name(), int64(len(data)), nil)
+}
+
+// quietEmitter drops the output of the commands the launcher runs in the build shell between the
+// steps, which is not of any step
+type quietEmitter struct {
+	screwdriver.Emitter
+}
+
+func (quietEmitter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
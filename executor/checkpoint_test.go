@@ -0,0 +1,80 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunResumesFromCheckpoint(t *testing.T) {
+	envFilepath := "/tmp/testCheckpoint"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src, storeDir := filepath.Join(dir, "src"), filepath.Join(dir, "store")
+	os.Mkdir(src, 0755)
+	defer os.Setenv("SD_CHECKPOINT_STORE", os.Getenv("SD_CHECKPOINT_STORE"))
+	defer os.Setenv("SD_CACHE_COMPRESSION", os.Getenv("SD_CACHE_COMPRESSION"))
+	os.Setenv("SD_CHECKPOINT_STORE", "file://"+storeDir)
+	os.Setenv("SD_CACHE_COMPRESSION", "gzip")
+
+	run := func(build, test string) (string, map[string]screwdriver.StepStopDetails, error) {
+		testBuild := screwdriver.Build{
+			ID: 12345,
+			Commands: []screwdriver.CommandDef{
+				{Name: "sd-setup-scm", Cmd: "echo checked out > checkout"},
+				{Name: "build", Cmd: build},
+				{Name: "test", Cmd: test},
+			},
+			Environment: []map[string]string{},
+		}
+		stops := map[string]screwdriver.StepStopDetails{}
+		testAPI := screwdriver.API(MockAPI{
+			stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+				stops[stepName] = details
+			},
+		})
+		emitter := &MockEmitter{}
+		err := Run(src, nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, src)
+		return string(emitter.found), stops, err
+	}
+
+	// The build fails after its first user step passed
+	_, _, err = run("echo built > artifact; export VERSION=1.2.3", "exit 3")
+	if err == nil {
+		t.Fatalf("The first run should fail")
+	}
+	if _, err := os.Stat(filepath.Join(storeDir, "checkpoints", "12345", "checkpoint.json")); err != nil {
+		t.Fatalf("The checkpoint should be saved: %v", err)
+	}
+
+	// The build runs again on a fresh node from its checkpoint
+	os.RemoveAll(src)
+	os.Mkdir(src, 0755)
+	output, stops, err := run("exit 7", `echo "$(cat artifact) $VERSION"`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(output, "built 1.2.3\n") {
+		t.Errorf("The source directory and the environment should be restored, got %q", output)
+	}
+	assert.True(t, stops["build"].Restored)
+	assert.Equal(t, screwdriver.StepCached, stops["build"].Reason)
+	assert.False(t, stops["sd-setup-scm"].Restored)
+	assert.False(t, stops["test"].Restored)
+
+	// Without the checkpoint store the build starts over
+	os.Setenv("SD_CHECKPOINT_STORE", "")
+	output, stops, err = run("echo rebuilt", "true")
+	assert.Nil(t, err)
+	assert.False(t, stops["build"].Restored)
+	assert.Contains(t, output, "rebuilt\n")
+}
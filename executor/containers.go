@@ -0,0 +1,199 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// defaultContainerRuntime runs the step containers unless SD_CONTAINER_RUNTIME picks another
+const defaultContainerRuntime = "docker"
+
+// containerRemoveTimeout bounds the removal of the containers left by the steps
+const containerRemoveTimeout = 30 * time.Second
+
+// imageName matches the container images a step can run in, e.g. node:18 or
+// registry.example.com/ci/python@sha256:...
+var imageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/:@-]*$`)
+
+// containerEnvSkipped are the variables of the build shell a step container or a remote host keeps
+// its own of
+var containerEnvSkipped = []string{"PATH", "HOME", "HOSTNAME", "PWD", "OLDPWD", "SHLVL", "TERM", "_"}
+
+// containerRuntime runs the containers of the steps with an image
+type containerRuntime interface {
+	// command returns the command the build shell runs for the step script at path of cmd in a
+	// container named name of its image. The container gets the exported variables of the build
+	// shell, the workspace at the same path and the current directory, and runs the step script.
+	command(name, path string, cmd screwdriver.CommandDef) string
+	// remove removes the containers named names that are left
+	remove(ctx context.Context, names []string) error
+}
+
+// containerRuntimes are the container runtimes by name, with the CLI they run
+var containerRuntimes = map[string]func() containerRuntime{
+	"docker":     func() containerRuntime { return dockerRuntime{cli: "docker"} },
+	"podman":     func() containerRuntime { return dockerRuntime{cli: "podman"} },
+	"containerd": func() containerRuntime { return containerdRuntime{cli: "ctr"} },
+}
+
+// Returns the container runtime picked by SD_CONTAINER_RUNTIME in the launcher environment, docker
+// by default
+func newContainerRuntime() (containerRuntime, error) {
+	name := strings.TrimSpace(os.Getenv("SD_CONTAINER_RUNTIME"))
+	if name == "" {
+		name = defaultContainerRuntime
+	}
+	runtime, ok := containerRuntimes[name]
+	if !ok {
+		var names []string
+		for name := range containerRuntimes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown SD_CONTAINER_RUNTIME %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	return runtime(), nil
+}
+
+// Checks the image of the step of cmd, if any, is an image name, and that the step is no teardown
+func checkImage(cmd screwdriver.CommandDef, stepType string) error {
+	if cmd.Image == "" {
+		return nil
+	}
+	if !imageName.MatchString(cmd.Image) {
+		return fmt.Errorf("Invalid image %q of step %q", cmd.Image, cmd.Name)
+	}
+	if stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown {
+		return fmt.Errorf("Teardown %q cannot have an image", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the name of the container of the step with guid
+func containerName(guid string) string {
+	return "sd-step-" + guid
+}
+
+// workspaceDir is the workspace as the build shell expands it
+const workspaceDir = `"${SD_ROOT_DIR:-$PWD}"`
+
+// Returns the pipeline of the build shell listing the variables a step container gets
+func containerEnvCommand() string {
+	return "env | grep -E '^[A-Za-z_][A-Za-z0-9_]*=' | grep -vE '^(" + strings.Join(containerEnvSkipped, "|") + ")='"
+}
+
+// dockerRuntime runs the step containers with the CLI of Docker or of a runtime taking its
+// options, like Podman
+type dockerRuntime struct {
+	cli string
+}
+
+// The variables are passed by name, so their values stay off the command line
+func (r dockerRuntime) command(name, path string, cmd screwdriver.CommandDef) string {
+	dir := filepath.Dir(path)
+	args := []string{
+		r.cli, "run", "--rm", "--init", "--network", "host",
+		"--name", name,
+		"-v", workspaceDir + ":" + workspaceDir,
+		"-v", shellQuote(dir + ":" + dir + ":ro"),
+		"-w", `"$PWD"`,
+		"$(" + containerEnvCommand() + " | sed 's/=.*//; s/^/-e /')",
+	}
+	if cmd.User != "" {
+		args = append(args, "--user", shellQuote(cmd.User))
+	}
+	args = append(args, "--entrypoint", shellQuote(path), shellQuote(cmd.Image))
+	return strings.Join(args, " ")
+}
+
+// The containers of the steps that finished are already gone
+func (r dockerRuntime) remove(ctx context.Context, names []string) error {
+	output, err := exec.CommandContext(ctx, r.cli, append([]string{"rm", "-f"}, names...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return nil
+}
+
+// containerdRuntime runs the step containers with ctr, the CLI of containerd, which pulls the image
+// first and takes the variables from a file next to the step script
+type containerdRuntime struct {
+	cli string
+}
+
+// The variables with a value of several lines only get its first line
+func (r containerdRuntime) command(name, path string, cmd screwdriver.CommandDef) string {
+	dir := filepath.Dir(path)
+	envFile := shellQuote(strings.TrimSuffix(path, ".sh") + ".env")
+	args := []string{
+		r.cli, "run", "--rm", "--net-host",
+		"--mount", "type=bind,src=" + workspaceDir + ",dst=" + workspaceDir + ",options=rbind:rw",
+		"--mount", shellQuote("type=bind,src=" + dir + ",dst=" + dir + ",options=rbind:ro"),
+		"--cwd", `"$PWD"`,
+		"--env-file", envFile,
+	}
+	if cmd.User != "" {
+		args = append(args, "--user", shellQuote(cmd.User))
+	}
+	args = append(args, shellQuote(cmd.Image), name, shellQuote(path))
+	return "(umask 077; " + containerEnvCommand() + " > " + envFile + ") && " +
+		r.cli + " image pull " + shellQuote(cmd.Image) + " > /dev/null && " + strings.Join(args, " ")
+}
+
+// A container of ctr only goes once its task is killed and deleted
+func (r containerdRuntime) remove(ctx context.Context, names []string) error {
+	var failed []string
+	for _, name := range names {
+		exec.CommandContext(ctx, r.cli, "task", "kill", "-s", "SIGKILL", name).Run()
+		exec.CommandContext(ctx, r.cli, "task", "delete", "-f", name).Run()
+		if output, err := exec.CommandContext(ctx, r.cli, "container", "delete", name).CombinedOutput(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v: %s", name, err, output))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// stepContainers are the containers of the steps of a build: the ones of their images, removed at
+// its end in case a step was killed before its container was, and the peer containers of pod
+type stepContainers struct {
+	runtime containerRuntime
+	pod     *kubernetesPod
+	names   []string
+}
+
+// Returns the command the build shell runs for the step script at path of cmd in its peer
+// container, or in a container of its image, adding the container of the step with guid
+func (c *stepContainers) command(guid, path string, cmd screwdriver.CommandDef) string {
+	if cmd.Container != "" {
+		return c.pod.command(path, cmd)
+	}
+	name := containerName(guid)
+	c.names = append(c.names, name)
+	return c.runtime.command(name, path, cmd)
+}
+
+// Removes the containers left by the steps
+func (c *stepContainers) remove() {
+	if len(c.names) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), containerRemoveTimeout)
+	defer cancel()
+
+	if err := c.runtime.remove(ctx, c.names); err != nil {
+		logger.Debugf("Removing the step containers: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCheckImage(t *testing.T) {
+	valid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "make test"},
+		{Name: "test", Cmd: "npm test", Image: "node:18"},
+		{Name: "test", Cmd: "pytest", Image: "registry.example.com/ci/python@sha256:0123abcd"},
+	}
+	for _, cmd := range valid {
+		if err := checkImage(cmd, screwdriver.StepTypeUser); err != nil {
+			t.Errorf("checkImage(%+v) = %v", cmd, err)
+		}
+	}
+
+	invalid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "npm test", Image: "--privileged"},
+		{Name: "test", Cmd: "npm test", Image: "node 18"},
+	}
+	for _, cmd := range invalid {
+		if err := checkImage(cmd, screwdriver.StepTypeUser); err == nil {
+			t.Errorf("Expected an error for %+v", cmd)
+		}
+	}
+	if err := checkImage(screwdriver.CommandDef{Name: "teardown-report", Image: "node:18"}, screwdriver.StepTypeTeardown); err == nil {
+		t.Errorf("Expected an error for a teardown with an image")
+	}
+}
+
+func TestNewContainerRuntime(t *testing.T) {
+	defer os.Unsetenv("SD_CONTAINER_RUNTIME")
+
+	for value, want := range map[string]containerRuntime{
+		"":           dockerRuntime{cli: "docker"},
+		"podman":     dockerRuntime{cli: "podman"},
+		"containerd": containerdRuntime{cli: "ctr"},
+	} {
+		os.Setenv("SD_CONTAINER_RUNTIME", value)
+		if got, err := newContainerRuntime(); err != nil || got != want {
+			t.Errorf("newContainerRuntime() with %q = %v, %v, want %v", value, got, err, want)
+		}
+	}
+
+	os.Setenv("SD_CONTAINER_RUNTIME", "lxc")
+	if _, err := newContainerRuntime(); err == nil {
+		t.Errorf("Expected an error for an unknown runtime")
+	}
+}
+
+func TestContainerCommand(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Cmd: "npm test", Image: "node:18", User: "node"}
+	for runtime, wants := range map[containerRuntime][]string{
+		dockerRuntime{cli: "podman"}: {
+			"podman run --rm ",
+			" --name sd-step-abcd ",
+			` -v "${SD_ROOT_DIR:-$PWD}":"${SD_ROOT_DIR:-$PWD}" `,
+			" -v '/tmp/env_steps:/tmp/env_steps:ro' ",
+			" --user 'node' ",
+			" --entrypoint '/tmp/env_steps/1-test.sh' 'node:18'",
+		},
+		containerdRuntime{cli: "ctr"}: {
+			" > '/tmp/env_steps/1-test.env') && ctr image pull 'node:18' > /dev/null && ctr run --rm ",
+			` --mount type=bind,src="${SD_ROOT_DIR:-$PWD}",dst="${SD_ROOT_DIR:-$PWD}",options=rbind:rw `,
+			" --env-file '/tmp/env_steps/1-test.env' ",
+			" --user 'node' 'node:18' sd-step-abcd '/tmp/env_steps/1-test.sh'",
+		},
+	} {
+		got := runtime.command("sd-step-abcd", "/tmp/env_steps/1-test.sh", cmd)
+		for _, want := range wants {
+			if !strings.Contains(got, want) {
+				t.Errorf("command() of %T = %s, want it to contain %q", runtime, got, want)
+			}
+		}
+	}
+	if stepShell(cmd, "/bin/bash") != posixShell {
+		t.Errorf("The step container should run its script with %s", posixShell)
+	}
+}
+
+func TestContainerdEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containers")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Writes the variables a step container gets and stops before the image is pulled
+	path := filepath.Join(dir, "1-test.sh")
+	command := containerdRuntime{cli: "false"}.command("sd-step-abcd", path, screwdriver.CommandDef{Image: "node:18"})
+	c := exec.Command("/bin/sh", "-c", command)
+	c.Env = []string{"PATH=/usr/bin:/bin", "FOO=a b", "MULTI=first\nsecond"}
+	c.Run()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "1-test.env"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got, want := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), []string{"FOO=a b", "MULTI=first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected variables %q, want %q", data, want)
+	}
+}
+
+func TestRunInContainer(t *testing.T) {
+	envFilepath := "/tmp/testContainers"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "containers")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Records its arguments and runs the entrypoint in place of the container
+	argsFile := filepath.Join(dir, "args")
+	cli := filepath.Join(dir, "docker")
+	ioutil.WriteFile(cli, []byte("#!/bin/sh\necho \"$@\" >> "+argsFile+"\n"+
+		"while [ $# -gt 0 ]; do if [ \"$1\" = --entrypoint ]; then exec \"$2\"; fi; shift; done\n"), 0755)
+	oldDocker := containerRuntimes["docker"]
+	defer func() { containerRuntimes["docker"] = oldDocker }()
+	containerRuntimes["docker"] = func() containerRuntime { return dockerRuntime{cli: cli} }
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "export", Cmd: "export FOO=bar"},
+			{Name: "test", Cmd: `echo "test in container with $FOO and $ANSWER"`, Image: "node:18", Env: map[string]string{"ANSWER": "42"}},
+			{Name: "fail", Cmd: "exit 3", Image: "node:18", AllowFailure: true},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if want := map[string]int{"export": 0, "test": 0, "fail": 3}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	if want := "\ntest in container with bar and 42\n"; !strings.Contains(string(emitter.found), want) {
+		t.Errorf("The output should contain %q, got %q", want, emitter.found)
+	}
+
+	data, _ := ioutil.ReadFile(argsFile)
+	calls := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(calls) != 3 {
+		t.Fatalf("Expected 2 containers and their removal, got %q", calls)
+	}
+	if !strings.Contains(calls[0], " -e FOO ") || strings.Contains(calls[0], " -e PATH ") || !strings.HasSuffix(calls[0], " node:18") {
+		t.Errorf("The container should get the variables of the build shell but its PATH: %s", calls[0])
+	}
+	if !strings.HasPrefix(calls[2], "rm -f sd-step-") || strings.Count(calls[2], "sd-step-") != 2 {
+		t.Errorf("The step containers should be removed at the end of the build: %s", calls[2])
+	}
+}
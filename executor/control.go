@@ -0,0 +1,423 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/controlpb"
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// How many of the last lines of output the control interface keeps for a tail
+	controlTailLines = 1000
+	// How many events may wait to be sent to a client before it stops following them
+	controlQueueSize = 256
+	// How long the clients have to get the end of the build before the server is stopped
+	controlStopTimeout = 10 * time.Second
+)
+
+// controlStep is the state of a step in the control interface
+type controlStep struct {
+	name   string
+	status string
+	code   int
+	start  time.Time
+	stop   *time.Time
+}
+
+// Returns the step as the control service sends it
+func (step controlStep) proto() *controlpb.Step {
+	p := &controlpb.Step{Name: step.name, Status: step.status, Code: int32(step.code), Start: timestamppb.New(step.start)}
+	if step.stop != nil {
+		p.Stop = timestamppb.New(*step.stop)
+	}
+	return p
+}
+
+// controlSubscriber is a client following the events of a kind
+type controlSubscriber struct {
+	output bool
+	events chan *controlpb.Event
+}
+
+// controlServer serves the gRPC control service of controlpb on a Unix socket, for sidecars and
+// wrapper agents to observe and control the build: stream the state of the steps, abort the build,
+// pause it between steps, tail its output and read its environment. A nil controlServer serves
+// nothing.
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+	server  *grpc.Server
+	env     []string
+	secrets []string
+	abort   chan<- error
+
+	mu          sync.Mutex
+	steps       []controlStep
+	tail        []string
+	line        []byte
+	paused      bool
+	resumed     chan struct{}
+	subscribers map[*controlSubscriber]bool
+	done        chan struct{}
+	closed      bool
+}
+
+// Returns a control server listening on the Unix socket SD_CONTROL_SOCKET of the launcher
+// environment, nil if it is not set. An abort request stops the build with an Aborted error on
+// abort.
+func newControlServer(env []string, abort chan<- error) (*controlServer, error) {
+	path := strings.TrimSpace(os.Getenv("SD_CONTROL_SOCKET"))
+	if path == "" {
+		return nil, nil
+	}
+	// A socket left behind by a build that did not clean up would keep this one from listening
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the user of the launcher controls the build
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &controlServer{
+		server:      grpc.NewServer(),
+		env:         env,
+		secrets:     buildSecrets(env),
+		abort:       abort,
+		resumed:     make(chan struct{}),
+		subscribers: map[*controlSubscriber]bool{},
+		done:        make(chan struct{}),
+	}
+	controlpb.RegisterControlServer(s.server, s)
+	go s.server.Serve(listener)
+	logger.Infof("Serving the control interface on %s", path)
+	return s, nil
+}
+
+// Steps sends the steps so far, then their events while the client follows them
+func (s *controlServer) Steps(req *controlpb.StepsRequest, stream controlpb.Control_StepsServer) error {
+	s.mu.Lock()
+	res := &controlpb.StepsResponse{Paused: s.paused}
+	for _, step := range s.steps {
+		res.Steps = append(res.Steps, step.proto())
+	}
+	var sub *controlSubscriber
+	if req.Follow {
+		sub = s.subscribe(false)
+	}
+	s.mu.Unlock()
+
+	if err := stream.Send(res); err != nil {
+		s.unsubscribe(sub)
+		return err
+	}
+	return s.follow(stream.Context(), sub, func(event *controlpb.Event) error {
+		return stream.Send(&controlpb.StepsResponse{Event: event})
+	})
+}
+
+// Tail sends the last lines of output, then the new ones while the client follows them
+func (s *controlServer) Tail(req *controlpb.TailRequest, stream controlpb.Control_TailServer) error {
+	s.mu.Lock()
+	lines := s.tail
+	if req.Lines > 0 && int(req.Lines) < len(lines) {
+		lines = lines[len(lines)-int(req.Lines):]
+	}
+	res := &controlpb.TailResponse{Lines: append([]string{}, lines...)}
+	var sub *controlSubscriber
+	if req.Follow {
+		sub = s.subscribe(true)
+	}
+	s.mu.Unlock()
+
+	if err := stream.Send(res); err != nil {
+		s.unsubscribe(sub)
+		return err
+	}
+	return s.follow(stream.Context(), sub, func(event *controlpb.Event) error {
+		return stream.Send(&controlpb.TailResponse{Event: event})
+	})
+}
+
+// Env returns the environment of the build with its secrets masked
+func (s *controlServer) Env(ctx context.Context, req *controlpb.EnvRequest) (*controlpb.EnvResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &controlpb.EnvResponse{Env: s.envSnapshot()}, nil
+}
+
+// Pause makes the build wait before its next step until it is resumed
+func (s *controlServer) Pause(ctx context.Context, req *controlpb.PauseRequest) (*controlpb.PauseResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		logger.Infof("Pausing the build before its next step")
+		s.paused = true
+	}
+	return &controlpb.PauseResponse{Paused: true}, nil
+}
+
+// Resume lets a paused build go on
+func (s *controlServer) Resume(ctx context.Context, req *controlpb.ResumeRequest) (*controlpb.ResumeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		logger.Infof("Resuming the build")
+		s.paused = false
+		close(s.resumed)
+		s.resumed = make(chan struct{})
+	}
+	return &controlpb.ResumeResponse{}, nil
+}
+
+// Abort aborts the build
+func (s *controlServer) Abort(ctx context.Context, req *controlpb.AbortRequest) (*controlpb.AbortResponse, error) {
+	logger.Infof("Aborting the build on request of the control interface")
+	select {
+	case s.abort <- Aborted{}:
+	default:
+		// The build is stopping already
+	}
+	return &controlpb.AbortResponse{}, nil
+}
+
+// Sends the events of sub until the build is complete or the client goes away. A client that fell
+// behind the events gets an error.
+func (s *controlServer) follow(ctx context.Context, sub *controlSubscriber, send func(*controlpb.Event) error) error {
+	if sub == nil {
+		return nil
+	}
+	defer s.unsubscribe(sub)
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				select {
+				case <-s.done:
+					return nil
+				default:
+					return status.Error(codes.ResourceExhausted, "the client fell behind the events")
+				}
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Returns a subscriber to the output if output, else to the state changes, with no events once
+// the build is complete. The caller holds s.mu.
+func (s *controlServer) subscribe(output bool) *controlSubscriber {
+	sub := &controlSubscriber{output: output, events: make(chan *controlpb.Event, controlQueueSize)}
+	if s.closed {
+		close(sub.events)
+		return sub
+	}
+	s.subscribers[sub] = true
+	return sub
+}
+
+func (s *controlServer) unsubscribe(sub *controlSubscriber) {
+	if sub == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Sends event to the subscribers of its kind, dropping those that fell behind. The caller holds
+// s.mu.
+func (s *controlServer) publish(event *controlpb.Event) {
+	for sub := range s.subscribers {
+		if sub.output != (event.Kind == controlpb.Event_OUTPUT) && event.Kind != controlpb.Event_BUILD_COMPLETE {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(s.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Returns the environment of the build with its secrets masked. The caller holds s.mu.
+func (s *controlServer) envSnapshot() map[string]string {
+	env := map[string]string{}
+	for _, kv := range s.env {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = maskSecrets(kv[i+1:], s.secrets)
+		}
+	}
+	return env
+}
+
+// Records the start of step name
+func (s *controlServer) stepStart(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, controlStep{name: name, status: string(screwdriver.Running), start: time.Now()})
+	s.publish(&controlpb.Event{Kind: controlpb.Event_STEP_START, Step: s.steps[len(s.steps)-1].proto()})
+}
+
+// Records the stop of step name with its exit code and error
+func (s *controlServer) stepStop(name string, code int, stepErr error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if s.steps[i].name != name || s.steps[i].stop != nil {
+			continue
+		}
+		s.steps[i].status, s.steps[i].code, s.steps[i].stop = resultStatus(code, stepErr), code, &now
+		s.publish(&controlpb.Event{Kind: controlpb.Event_STEP_STOP, Step: s.steps[i].proto(), Error: errorString(stepErr)})
+		return
+	}
+}
+
+// Waits while the build is paused, before the next step. It returns the exit code and error of a
+// build timeout or abort meanwhile.
+func (s *controlServer) waitResumed(invokeTimeout, sig <-chan error) (int, error) {
+	if s == nil {
+		return ExitOk, nil
+	}
+	s.mu.Lock()
+	paused, resumed := s.paused, s.resumed
+	s.mu.Unlock()
+	if !paused {
+		return ExitOk, nil
+	}
+
+	logger.Infof("The build is paused, waiting to be resumed")
+	select {
+	case <-resumed:
+		return ExitOk, nil
+	case buildTimeout := <-invokeTimeout:
+		return ExitTimeout, buildTimeout
+	case abort := <-sig:
+		return ExitAborted, abort
+	}
+}
+
+// Keeps the lines of p, output of the build, for the tail and its followers
+func (s *controlServer) scanOutput(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		s.addLine(s.line[:i])
+		s.line = s.line[i+1:]
+	}
+	if len(s.line) > maxScannedLine {
+		s.addLine(s.line)
+		s.line = nil
+	}
+}
+
+// Adds a line to the tail and sends it to the followers. The caller holds s.mu.
+func (s *controlServer) addLine(line []byte) {
+	text := maskSecrets(strings.TrimSuffix(string(line), "\r"), s.secrets)
+	if len(s.tail) == controlTailLines {
+		s.tail = append(s.tail[:0], s.tail[1:]...)
+	}
+	s.tail = append(s.tail, text)
+	s.publish(&controlpb.Event{Kind: controlpb.Event_OUTPUT, Line: text})
+}
+
+// Returns emitter with its output kept by the control server, emitter itself without a server
+func (s *controlServer) emitter(emitter screwdriver.Emitter) screwdriver.Emitter {
+	if s == nil {
+		return emitter
+	}
+	return &controlEmitter{Emitter: emitter, s: s}
+}
+
+// buildComplete sends the end of the build to the followers and closes the server
+func (s *controlServer) buildComplete(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if len(s.line) > 0 {
+		s.addLine(s.line)
+		s.line = nil
+	}
+	s.publish(&controlpb.Event{Kind: controlpb.Event_BUILD_COMPLETE, Status: resultStatus(ExitOk, err), Error: errorString(err)})
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	// The followers end with the build, so no client outlives it
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(controlStopTimeout):
+		s.server.Stop()
+	}
+}
+
+// controlEmitter keeps the output of the build for the control server
+type controlEmitter struct {
+	screwdriver.Emitter
+	s *controlServer
+}
+
+func (e *controlEmitter) Write(p []byte) (int, error) {
+	e.s.scanOutput(p)
+	return e.Emitter.Write(p)
+}
+
+// Keeps the output written apart from the emitter, like the standard error of a step
+func (e *controlEmitter) scanOutput(p []byte) {
+	e.s.scanOutput(p)
+}
+
+// Unwrap returns the emitter the control server writes to
+func (e *controlEmitter) Unwrap() screwdriver.Emitter {
+	return e.Emitter
+}
@@ -0,0 +1,231 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/controlpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a control server on a socket of dir, with abort as its abort channel
+func testControlServer(t *testing.T, dir string, env []string, abort chan error) *controlServer {
+	defer os.Setenv("SD_CONTROL_SOCKET", os.Getenv("SD_CONTROL_SOCKET"))
+	os.Setenv("SD_CONTROL_SOCKET", filepath.Join(dir, "control.sock"))
+	s, err := newControlServer(env, abort)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return s
+}
+
+// Returns a client of the control service on the socket of dir
+func dialControl(t *testing.T, dir string) (controlpb.ControlClient, *grpc.ClientConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+filepath.Join(dir, "control.sock"), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return controlpb.NewControlClient(conn), conn
+}
+
+// Returns the next event of a followed stream
+func recvEvent(t *testing.T, recv func() (*controlpb.Event, error)) *controlpb.Event {
+	event, err := recv()
+	if err != nil {
+		t.Fatalf("No event: %v", err)
+	}
+	return event
+}
+
+func TestControlServerDisabled(t *testing.T) {
+	defer os.Setenv("SD_CONTROL_SOCKET", os.Getenv("SD_CONTROL_SOCKET"))
+	os.Setenv("SD_CONTROL_SOCKET", "")
+	s, err := newControlServer(nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+
+	// A nil server does nothing
+	emitter := &MockEmitter{}
+	assert.Equal(t, emitter, s.emitter(emitter))
+	s.stepStart("install")
+	s.stepStop("install", ExitOk, nil)
+	code, err := s.waitResumed(nil, nil)
+	assert.Equal(t, ExitOk, code)
+	assert.Nil(t, err)
+	s.buildComplete(nil)
+}
+
+func TestControlServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	abort := make(chan error, 1)
+	s := testControlServer(t, dir, []string{"SD_TOKEN=build-token", "SD_SECRET_NAMES=PASSWORD", "PASSWORD=hunter22", "GREETING=hi"}, abort)
+	emitter := s.emitter(&MockEmitter{})
+	client, conn := dialControl(t, dir)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	steps, err := client.Steps(ctx, &controlpb.StepsRequest{Follow: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res, err := steps.Recv()
+	if err != nil || len(res.Steps) != 0 || res.Paused {
+		t.Fatalf("Steps() = %v, %v, want no steps", res, err)
+	}
+	stepEvent := func() (*controlpb.Event, error) {
+		res, err := steps.Recv()
+		return res.GetEvent(), err
+	}
+
+	s.stepStart("install")
+	event := recvEvent(t, stepEvent)
+	if event.Kind != controlpb.Event_STEP_START || event.Step.Name != "install" || event.Step.Status != "RUNNING" || event.Step.Stop != nil {
+		t.Errorf("Unexpected event %v", event)
+	}
+	fmt.Fprintf(emitter, "one\ntwo with hunter22\r\nthr")
+	tail, err := client.Tail(ctx, &controlpb.TailRequest{Lines: 1, Follow: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines, err := tail.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"two with ********"}, lines.GetLines())
+	tailEvent := func() (*controlpb.Event, error) {
+		res, err := tail.Recv()
+		return res.GetEvent(), err
+	}
+	fmt.Fprintf(emitter, "ee\n")
+	event = recvEvent(t, tailEvent)
+	if event.Kind != controlpb.Event_OUTPUT || event.Line != "three" {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	s.stepStop("install", 2, StepFailure{Step: "install", Code: 2})
+	event = recvEvent(t, stepEvent)
+	if event.Kind != controlpb.Event_STEP_STOP || event.Step.Status != "FAILURE" || event.Step.Code != 2 || event.Step.Stop == nil || event.Error == "" {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	snapshot, err := client.Steps(ctx, &controlpb.StepsRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res, err = snapshot.Recv()
+	if err != nil || len(res.Steps) != 1 || res.Steps[0].Name != "install" || res.Steps[0].Status != "FAILURE" {
+		t.Errorf("Unexpected steps %v, %v", res, err)
+	}
+	if _, err := snapshot.Recv(); err != io.EOF {
+		t.Errorf("Steps() without follow should end after the steps, got %v", err)
+	}
+	env, err := client.Env(ctx, &controlpb.EnvRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"SD_TOKEN": "********", "SD_SECRET_NAMES": "PASSWORD", "PASSWORD": "********", "GREETING": "hi"}, env.GetEnv())
+
+	// A paused build waits until it is resumed
+	paused, err := client.Pause(ctx, &controlpb.PauseRequest{})
+	assert.Nil(t, err)
+	assert.True(t, paused.GetPaused())
+	snapshot, _ = client.Steps(ctx, &controlpb.StepsRequest{})
+	if res, err := snapshot.Recv(); err != nil || !res.Paused {
+		t.Errorf("Steps() = %v, %v, want a paused build", res, err)
+	}
+	resumed := make(chan error)
+	go func() {
+		_, err := s.waitResumed(nil, nil)
+		resumed <- err
+	}()
+	select {
+	case <-resumed:
+		t.Fatalf("The build should wait while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = client.Resume(ctx, &controlpb.ResumeRequest{})
+	assert.Nil(t, err)
+	select {
+	case err := <-resumed:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The build should be resumed")
+	}
+
+	// An abort stops a paused build
+	client.Pause(ctx, &controlpb.PauseRequest{})
+	_, err = client.Abort(ctx, &controlpb.AbortRequest{})
+	assert.Nil(t, err)
+	code, err := s.waitResumed(nil, abort)
+	assert.Equal(t, ExitAborted, code)
+	assert.True(t, errors.Is(err, ErrAborted))
+
+	// The followers get the end of the build, then the server closes
+	s.buildComplete(StepFailure{Step: "install", Code: 2})
+	event = recvEvent(t, stepEvent)
+	if event.Kind != controlpb.Event_BUILD_COMPLETE || event.Status != "FAILURE" {
+		t.Errorf("Unexpected event %v", event)
+	}
+	if _, err := steps.Recv(); err != io.EOF {
+		t.Errorf("The followers should end with the build, got %v", err)
+	}
+	event = recvEvent(t, tailEvent)
+	if event.Kind != controlpb.Event_BUILD_COMPLETE {
+		t.Errorf("Unexpected event %v", event)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "control.sock")); !os.IsNotExist(err) {
+		t.Errorf("The socket should be removed, got %v", err)
+	}
+}
+
+func TestControlServerSlowFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := testControlServer(t, dir, nil, nil)
+	defer s.buildComplete(nil)
+	client, conn := dialControl(t, dir)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tail, err := client.Tail(ctx, &controlpb.TailRequest{Follow: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := tail.Recv(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The events queued for the client are dropped with it once the queue is full
+	s.mu.Lock()
+	for i := 0; i <= controlQueueSize*2; i++ {
+		s.addLine([]byte("line"))
+	}
+	s.mu.Unlock()
+	for {
+		if _, err = tail.Recv(); err != nil {
+			break
+		}
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("A client falling behind should get an error, got %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// maxCoverageReportBytes bounds the size of a coverage report the launcher reads
+const maxCoverageReportBytes = 64 << 20
+
+// The decisions of the coverage check
+const (
+	coveragePassed = "passed"
+	coverageWarned = "warned"
+	coverageFailed = "failed"
+)
+
+// coverageCounts are the covered and coverable lines and branches of coverage reports. The
+// statements of a Go profile count as lines.
+type coverageCounts struct {
+	linesCovered, lines       int64
+	branchesCovered, branches int64
+}
+
+// coverageResult is the coverage of a build checked against its thresholds, with the coverage in
+// percent and Delta the difference in percentage points with Baseline, the line coverage of the
+// target branch
+type coverageResult struct {
+	Reports    []string `json:"reports"`
+	Line       *float64 `json:"line,omitempty"`
+	Branch     *float64 `json:"branch,omitempty"`
+	Baseline   *float64 `json:"baseline,omitempty"`
+	Delta      *float64 `json:"delta,omitempty"`
+	Violations []string `json:"violations"`
+	// Decision is passed, warned for violations that do not fail the build, or failed
+	Decision string `json:"decision"`
+}
+
+// xmlCoverageReport is the root of a Cobertura or JaCoCo XML report, coverage and report
+// respectively
+type xmlCoverageReport struct {
+	XMLName         xml.Name
+	LinesCovered    *int64          `xml:"lines-covered,attr"`
+	LinesValid      *int64          `xml:"lines-valid,attr"`
+	BranchesCovered *int64          `xml:"branches-covered,attr"`
+	BranchesValid   *int64          `xml:"branches-valid,attr"`
+	Counters        []jacocoCounter `xml:"counter"`
+}
+
+// jacocoCounter is a counter of a JaCoCo report, the ones of its root being the totals
+type jacocoCounter struct {
+	Type    string `xml:"type,attr"`
+	Missed  int64  `xml:"missed,attr"`
+	Covered int64  `xml:"covered,attr"`
+}
+
+// Checks the patterns and thresholds of the coverage checks of a build, which may have none
+func checkCoverageChecks(checks *screwdriver.CoverageChecks) error {
+	if checks == nil {
+		return nil
+	}
+	for _, pattern := range checks.Patterns {
+		if err := checkArtifactPattern(pattern); err != nil {
+			return err
+		}
+	}
+	if checks.MinLine < 0 || checks.MinLine > 100 || checks.MinBranch < 0 || checks.MinBranch > 100 {
+		return fmt.Errorf("Invalid coverage thresholds %v and %v, want percents", checks.MinLine, checks.MinBranch)
+	}
+	if checks.MaxDrop != nil && *checks.MaxDrop < 0 {
+		return fmt.Errorf("Invalid coverage drop %v, want a positive number of percentage points", *checks.MaxDrop)
+	}
+	return nil
+}
+
+// Returns the coverage counts of the reports of sourceDir matching patterns and the reports they
+// are from. The reports that cannot be read are left out with a warning, symlinks are never
+// followed.
+func readCoverageReports(sourceDir string, patterns []string) (coverageCounts, []string, error) {
+	var total coverageCounts
+	reports := []string{}
+	if sourceDir == "" {
+		return total, reports, fmt.Errorf("No source directory to read the coverage reports of")
+	}
+
+	err := filepath.WalkDir(sourceDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(sourceDir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			if !matchArtifactPattern(pattern, rel) {
+				continue
+			}
+			counts, err := parseCoverageReport(file)
+			if err != nil {
+				logger.Warnf("Skipping coverage report %s: %v", rel, err)
+				return nil
+			}
+			reports = append(reports, rel)
+			total.linesCovered += counts.linesCovered
+			total.lines += counts.lines
+			total.branchesCovered += counts.branchesCovered
+			total.branches += counts.branches
+			return nil
+		}
+		return nil
+	})
+	return total, reports, err
+}
+
+// Parses the coverage report at path, a Cobertura or JaCoCo XML report, a Go coverage profile or
+// an LCOV tracefile
+func parseCoverageReport(path string) (coverageCounts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return coverageCounts{}, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxCoverageReportBytes+1))
+	if err != nil {
+		return coverageCounts{}, err
+	}
+	if len(data) > maxCoverageReportBytes {
+		return coverageCounts{}, fmt.Errorf("Larger than the limit of %d bytes", maxCoverageReportBytes)
+	}
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("<")):
+		return parseXMLCoverage(data)
+	case bytes.HasPrefix(data, []byte("mode:")):
+		return parseGoCoverProfile(data)
+	default:
+		return parseLCOV(data)
+	}
+}
+
+// Returns the counts of a Cobertura report, from the attributes of its root, or of a JaCoCo one,
+// from the counters of its root
+func parseXMLCoverage(data []byte) (coverageCounts, error) {
+	var root xmlCoverageReport
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return coverageCounts{}, fmt.Errorf("Invalid XML: %v", err)
+	}
+
+	var counts coverageCounts
+	switch root.XMLName.Local {
+	case "coverage":
+		if root.LinesCovered == nil || root.LinesValid == nil {
+			return counts, fmt.Errorf("No lines-covered and lines-valid in the Cobertura report")
+		}
+		counts.linesCovered, counts.lines = *root.LinesCovered, *root.LinesValid
+		if root.BranchesCovered != nil && root.BranchesValid != nil {
+			counts.branchesCovered, counts.branches = *root.BranchesCovered, *root.BranchesValid
+		}
+	case "report":
+		for _, counter := range root.Counters {
+			switch counter.Type {
+			case "LINE":
+				counts.linesCovered, counts.lines = counter.Covered, counter.Covered+counter.Missed
+			case "BRANCH":
+				counts.branchesCovered, counts.branches = counter.Covered, counter.Covered+counter.Missed
+			}
+		}
+	default:
+		return counts, fmt.Errorf("Not a Cobertura or JaCoCo report, the root element is %s", root.XMLName.Local)
+	}
+	return counts, nil
+}
+
+// Returns the counts of the statements of a Go coverage profile. A block in the profile more than
+// once, as with -coverpkg, is covered if any of its entries has a count.
+func parseGoCoverProfile(data []byte) (coverageCounts, error) {
+	statements := map[string]int64{}
+	covered := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	scanner.Scan() // the mode line
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// name.go:line.column,line.column statements count
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return coverageCounts{}, fmt.Errorf("Invalid Go coverage profile line %q", line)
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return coverageCounts{}, fmt.Errorf("Invalid Go coverage profile line %q", line)
+		}
+		count, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return coverageCounts{}, fmt.Errorf("Invalid Go coverage profile line %q", line)
+		}
+		statements[fields[0]] = n
+		covered[fields[0]] = covered[fields[0]] || count > 0
+	}
+	if err := scanner.Err(); err != nil {
+		return coverageCounts{}, err
+	}
+
+	var counts coverageCounts
+	for block, n := range statements {
+		counts.lines += n
+		if covered[block] {
+			counts.linesCovered += n
+		}
+	}
+	return counts, nil
+}
+
+// Returns the counts of the LF, LH, BRF and BRH lines of the records of an LCOV tracefile
+func parseLCOV(data []byte) (coverageCounts, error) {
+	var counts coverageCounts
+	var found bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := fields[0], fields[1]
+		var total *int64
+		switch key {
+		case "LF":
+			total = &counts.lines
+		case "LH":
+			total = &counts.linesCovered
+		case "BRF":
+			total = &counts.branches
+		case "BRH":
+			total = &counts.branchesCovered
+		default:
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return coverageCounts{}, fmt.Errorf("Invalid LCOV line %s:%s", key, value)
+		}
+		*total += n
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return coverageCounts{}, err
+	}
+	if !found {
+		return coverageCounts{}, fmt.Errorf("Not a coverage report")
+	}
+	return counts, nil
+}
+
+// Returns covered out of total in percent, rounded to hundredths, or nil if there is nothing
+// to cover
+func coveragePercent(covered, total int64) *float64 {
+	if total <= 0 {
+		return nil
+	}
+	percent := roundPercent(float64(covered) * 100 / float64(total))
+	return &percent
+}
+
+// Returns percent rounded to hundredths
+func roundPercent(percent float64) float64 {
+	return math.Round(percent*100) / 100
+}
+
+// Checks the coverage of counts, from reports, against the thresholds of checks, and the line
+// coverage against baseline, the one of the target branch if known
+func checkCoverage(checks *screwdriver.CoverageChecks, counts coverageCounts, reports []string, baseline *float64) coverageResult {
+	result := coverageResult{
+		Reports:    reports,
+		Line:       coveragePercent(counts.linesCovered, counts.lines),
+		Branch:     coveragePercent(counts.branchesCovered, counts.branches),
+		Violations: []string{},
+	}
+
+	if checks.MinLine > 0 {
+		if result.Line == nil {
+			result.Violations = append(result.Violations, fmt.Sprintf("No line coverage in the reports to check against %v%%", checks.MinLine))
+		} else if *result.Line < checks.MinLine {
+			result.Violations = append(result.Violations, fmt.Sprintf("Line coverage %v%% is below %v%%", *result.Line, checks.MinLine))
+		}
+	}
+	if checks.MinBranch > 0 {
+		if result.Branch == nil {
+			result.Violations = append(result.Violations, fmt.Sprintf("No branch coverage in the reports to check against %v%%", checks.MinBranch))
+		} else if *result.Branch < checks.MinBranch {
+			result.Violations = append(result.Violations, fmt.Sprintf("Branch coverage %v%% is below %v%%", *result.Branch, checks.MinBranch))
+		}
+	}
+	if checks.MaxDrop != nil && baseline != nil && result.Line != nil {
+		delta := roundPercent(*result.Line - *baseline)
+		result.Baseline, result.Delta = baseline, &delta
+		if -delta > *checks.MaxDrop {
+			result.Violations = append(result.Violations, fmt.Sprintf("Line coverage %v%% dropped %v points from %v%% on the target branch, more than %v", *result.Line, -delta, *baseline, *checks.MaxDrop))
+		}
+	}
+
+	switch {
+	case len(result.Violations) == 0:
+		result.Decision = coveragePassed
+	case checks.FailBuild:
+		result.Decision = coverageFailed
+	default:
+		result.Decision = coverageWarned
+	}
+	return result
+}
+
+// Returns the line coverage of the last successful build of the target branch of the job jobID:
+// of its PR parent job for a PR job, or else of the job itself. It is nil if that build has none.
+func targetCoverage(api screwdriver.API, jobID int) (*float64, error) {
+	job, err := api.JobFromID(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.PrParentJobID != 0 {
+		jobID = job.PrParentJobID
+	}
+	meta, err := api.LastSuccessfulMeta(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return metaCoverage(meta), nil
+}
+
+// Returns the line coverage of the build meta meta: the one the launcher checked, or else the one
+// the steps or the coverage plugin set as tests.coverage, or nil if it has none
+func metaCoverage(meta map[string]interface{}) *float64 {
+	if coverage, ok := meta["coverage"].(map[string]interface{}); ok {
+		if line, ok := coverage["line"].(float64); ok {
+			return &line
+		}
+	}
+	tests, _ := meta["tests"].(map[string]interface{})
+	switch coverage := tests["coverage"].(type) {
+	case float64:
+		return &coverage
+	case string:
+		if line, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(coverage), "%"), 64); err == nil {
+			return &line
+		}
+	}
+	return nil
+}
+
+// Sets the result of the coverage check as "coverage" in the build meta at metaPath, and the line
+// coverage as tests.coverage, which the UI shows, unless the steps set it
+func writeCoverageMeta(metaPath string, result coverageResult) error {
+	return updateBuildMeta(metaPath, func(meta map[string]interface{}) {
+		meta["coverage"] = result
+		if result.Line == nil {
+			return
+		}
+		tests, ok := meta["tests"].(map[string]interface{})
+		if !ok {
+			tests = map[string]interface{}{}
+		}
+		if _, ok := tests["coverage"]; !ok {
+			tests["coverage"] = strconv.FormatFloat(*result.Line, 'f', -1, 64)
+		}
+		meta["tests"] = tests
+	})
+}
+
+// Checks the coverage reports of build in sourceDir against its thresholds, recording the result
+// in the build meta at metaPath if not empty. It returns a CoverageFailure if the build fails
+// because of them.
+func checkCoverageReports(api screwdriver.API, build screwdriver.Build, sourceDir, metaPath string) error {
+	checks := build.Coverage
+	counts, reports, err := readCoverageReports(sourceDir, checks.Patterns)
+	if err != nil {
+		logger.Warnf("Failed to read the coverage reports: %v", err)
+		return nil
+	}
+	if len(reports) == 0 {
+		logger.Warnf("No coverage reports matched %v", checks.Patterns)
+		return nil
+	}
+
+	var baseline *float64
+	if checks.MaxDrop != nil {
+		if baseline, err = targetCoverage(api, build.JobID); err != nil {
+			logger.Warnf("Failed to fetch the coverage of the target branch: %v", err)
+		} else if baseline == nil {
+			logger.Infof("No coverage of the target branch to compare with")
+		}
+	}
+
+	result := checkCoverage(checks, counts, reports, baseline)
+	logger.Infof("Coverage of %d reports %s the checks", len(reports), result.Decision)
+	for _, violation := range result.Violations {
+		logger.Warnf("%s", violation)
+	}
+	if metaPath != "" {
+		if err := writeCoverageMeta(metaPath, result); err != nil {
+			logger.Warnf("Failed to write the coverage to the build meta: %v", err)
+		}
+	}
+	if result.Decision == coverageFailed {
+		return CoverageFailure{Violations: result.Violations}
+	}
+	return nil
+}
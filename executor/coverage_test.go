@@ -0,0 +1,173 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const testCoberturaReport = `<?xml version="1.0" ?>
+<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">
+<coverage line-rate="0.75" branch-rate="0.5" lines-covered="75" lines-valid="100" branches-covered="10" branches-valid="20" version="1.9">
+  <packages/>
+</coverage>
+`
+
+func TestParseCoverageReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name, report string
+		want         coverageCounts
+	}{
+		{"cobertura.xml", testCoberturaReport, coverageCounts{75, 100, 10, 20}},
+		{"jacoco.xml", `<report name="app"><package name="a"><counter type="LINE" missed="9" covered="1"/></package>` +
+			`<counter type="INSTRUCTION" missed="5" covered="15"/><counter type="BRANCH" missed="1" covered="3"/>` +
+			`<counter type="LINE" missed="20" covered="60"/></report>`, coverageCounts{60, 80, 3, 4}},
+		{"lcov.info", "TN:\nSF:a.js\nLF:10\nLH:5\nBRF:4\nBRH:1\nend_of_record\nSF:b.js\nLF:10\nLH:10\nend_of_record\n", coverageCounts{15, 20, 1, 4}},
+		// The block of a.go is in the profile twice, covered by the second test binary
+		{"cover.out", "mode: set\na.go:1.1,3.2 2 0\na.go:5.1,6.2 3 1\na.go:1.1,3.2 2 1\nb.go:1.1,2.2 5 0\n", coverageCounts{5, 10, 0, 0}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		ioutil.WriteFile(path, []byte(test.report), 0644)
+		if got, err := parseCoverageReport(path); err != nil || got != test.want {
+			t.Errorf("parseCoverageReport(%s) = %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+
+	for name, report := range map[string]string{
+		"old.xml":   `<coverage line-rate="0.5"/>`,
+		"junit.xml": `<testsuite/>`,
+		"notes.txt": "nothing to see",
+		"bad.out":   "mode: set\na.go:1.1,3.2 two 0\n",
+	} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(report), 0644)
+		if _, err := parseCoverageReport(path); err == nil {
+			t.Errorf("parseCoverageReport(%s) should fail", name)
+		}
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	drop := 1.0
+	baseline := 78.5
+	counts := coverageCounts{75, 100, 10, 20}
+	tests := []struct {
+		checks     screwdriver.CoverageChecks
+		baseline   *float64
+		violations int
+		decision   string
+	}{
+		{screwdriver.CoverageChecks{MinLine: 70, MinBranch: 50}, nil, 0, coveragePassed},
+		{screwdriver.CoverageChecks{MinLine: 80}, nil, 1, coverageWarned},
+		{screwdriver.CoverageChecks{MinLine: 80, MinBranch: 60, FailBuild: true}, nil, 2, coverageFailed},
+		{screwdriver.CoverageChecks{MaxDrop: &drop, FailBuild: true}, &baseline, 1, coverageFailed},
+		// Without the coverage of the target branch there is nothing to compare with
+		{screwdriver.CoverageChecks{MaxDrop: &drop, FailBuild: true}, nil, 0, coveragePassed},
+	}
+	for _, test := range tests {
+		result := checkCoverage(&test.checks, counts, []string{"cobertura.xml"}, test.baseline)
+		if len(result.Violations) != test.violations || result.Decision != test.decision || *result.Line != 75 || *result.Branch != 50 {
+			t.Errorf("checkCoverage(%+v) = %+v, want %d violations and %s", test.checks, result, test.violations, test.decision)
+		}
+	}
+
+	result := checkCoverage(&screwdriver.CoverageChecks{MaxDrop: &drop}, counts, nil, &baseline)
+	if *result.Baseline != baseline || *result.Delta != -3.5 {
+		t.Errorf("The result should have the baseline and the delta: %+v", result)
+	}
+	result = checkCoverage(&screwdriver.CoverageChecks{MinBranch: 10}, coverageCounts{linesCovered: 1, lines: 2}, nil, nil)
+	if result.Branch != nil || len(result.Violations) != 1 {
+		t.Errorf("A branch threshold without branches in the reports should be a violation: %+v", result)
+	}
+}
+
+func TestMetaCoverage(t *testing.T) {
+	tests := []struct {
+		meta string
+		want float64
+	}{
+		{`{"coverage":{"line":81.5},"tests":{"coverage":"70"}}`, 81.5},
+		{`{"tests":{"coverage":"70.25"}}`, 70.25},
+		{`{"tests":{"coverage":"66%"}}`, 66},
+		{`{"tests":{"coverage":55}}`, 55},
+	}
+	for _, test := range tests {
+		meta := map[string]interface{}{}
+		json.Unmarshal([]byte(test.meta), &meta)
+		if got := metaCoverage(meta); got == nil || *got != test.want {
+			t.Errorf("metaCoverage(%s) = %v, want %v", test.meta, got, test.want)
+		}
+	}
+	if got := metaCoverage(map[string]interface{}{"tests": map[string]interface{}{"results": "1/2"}}); got != nil {
+		t.Errorf("metaCoverage() = %v, want nil", *got)
+	}
+}
+
+func TestRunChecksCoverage(t *testing.T) {
+	envFilepath := "/tmp/testCoverage"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sourceDir := filepath.Join(dir, "src")
+	os.MkdirAll(sourceDir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cobertura.xml"), []byte(testCoberturaReport), 0644)
+	metaPath := filepath.Join(dir, "meta.json")
+
+	drop := 2.0
+	testBuild := screwdriver.Build{
+		ID:    12345,
+		JobID: 5,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: "cp " + filepath.Join(dir, "cobertura.xml") + " " + sourceDir + "/cobertura.xml"},
+		},
+		Environment: []map[string]string{},
+		Coverage:    &screwdriver.CoverageChecks{Patterns: []string{"*.xml"}, MinLine: 70, MaxDrop: &drop, FailBuild: true},
+	}
+	var targetJob int
+	testAPI := screwdriver.API(MockAPI{
+		jobFromID: func(jobID int) (screwdriver.Job, error) {
+			return screwdriver.Job{ID: jobID, PrParentJobID: 3}, nil
+		},
+		lastMeta: func(jobID int) (map[string]interface{}, error) {
+			targetJob = jobID
+			return map[string]interface{}{"tests": map[string]interface{}{"coverage": "80"}}, nil
+		},
+	})
+	env := []string{"SD_META_PATH=" + metaPath}
+	err = Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, sourceDir)
+	var failure CoverageFailure
+	if !errors.As(err, &failure) || len(failure.Violations) != 1 || !IsUserFailure(err) {
+		t.Errorf("The coverage drop should fail the build: %v", err)
+	}
+	if targetJob != 3 {
+		t.Errorf("The coverage should be compared with the one of the PR parent job, got job %d", targetJob)
+	}
+
+	var meta struct {
+		Coverage coverageResult    `json:"coverage"`
+		Tests    map[string]string `json:"tests"`
+	}
+	data, _ := ioutil.ReadFile(metaPath)
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, data)
+	}
+	if meta.Coverage.Decision != coverageFailed || !reflect.DeepEqual(meta.Coverage.Reports, []string{"cobertura.xml"}) || meta.Tests["coverage"] != "75" {
+		t.Errorf("The build meta should have the decision: %s", data)
+	}
+}
@@ -0,0 +1,23 @@
+package executor
+
+import (
+	"fmt"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Returns the command of the step of cmd as the launcher shows it, in the log and the failure
+// summary: its echo if it has one, which is "" to hide it
+func shownCommand(cmd screwdriver.CommandDef) string {
+	if cmd.Echo != nil {
+		return *cmd.Echo
+	}
+	return cmd.Cmd
+}
+
+// Echoes the command of the step of cmd to emitter before it runs, unless the step hides it
+func echoCommand(emitter screwdriver.Emitter, cmd screwdriver.CommandDef) {
+	if command := shownCommand(cmd); command != "" {
+		fmt.Fprintf(emitter, "$ %s\n", command)
+	}
+}
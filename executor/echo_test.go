@@ -0,0 +1,86 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestRunEchoesCommand(t *testing.T) {
+	envFilepath := "/tmp/testEcho"
+	setupTestCase(t, envFilepath)
+	hidden, replaced := "", "deploy --token ***"
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "shown", Cmd: "echo shown"},
+			{Name: "hidden", Cmd: "echo hidden-secret-1 >/dev/null", Echo: &hidden},
+			{Name: "replaced", Cmd: "echo replaced-secret-2 >/dev/null", Echo: &replaced},
+			{Name: "teardown-hidden", Cmd: "echo teardown-secret-3 >/dev/null", Echo: &hidden},
+		},
+		Environment: []map[string]string{},
+	}
+	dir, err := ioutil.TempDir("", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditPath := filepath.Join(dir, "launcher-audit.log")
+	os.Setenv("SD_AUDIT_LOG", auditPath)
+	defer os.Unsetenv("SD_AUDIT_LOG")
+
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output := string(emitter.found)
+	if !strings.Contains(output, "$ echo shown\n") || !strings.Contains(output, "$ deploy --token ***\n") {
+		t.Errorf("The log should echo the commands and their replacement, got %q", output)
+	}
+	for _, secret := range []string{"secret-1", "secret-2", "secret-3"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("The log should not echo the command with %s, got %q", secret, output)
+		}
+	}
+
+	audited := map[string]auditRecord{}
+	for _, r := range readAuditRecords(t, auditPath) {
+		audited[r.Step] = r
+	}
+	want := map[string]auditRecord{
+		"shown":           {Command: "echo shown"},
+		"hidden":          {Command: "", Redacted: true},
+		"replaced":        {Command: "deploy --token ***", Redacted: true},
+		"teardown-hidden": {Command: "", Redacted: true},
+	}
+	for step, w := range want {
+		if r, ok := audited[step]; !ok || r.Command != w.Command || r.Redacted != w.Redacted {
+			t.Errorf("Audit record of %s = %+v, want the command %q redacted %v", step, r, w.Command, w.Redacted)
+		}
+	}
+	data, _ := ioutil.ReadFile(auditPath)
+	if strings.Contains(string(data), "secret-") {
+		t.Errorf("The audit log should not have the commands with secrets, got %s", data)
+	}
+}
+
+func TestShownCommand(t *testing.T) {
+	hidden, replaced := "", "make deploy"
+	tests := []struct {
+		cmd  screwdriver.CommandDef
+		want string
+	}{
+		{screwdriver.CommandDef{Cmd: "make deploy TOKEN=abc"}, "make deploy TOKEN=abc"},
+		{screwdriver.CommandDef{Cmd: "make deploy TOKEN=abc", Echo: &replaced}, "make deploy"},
+		{screwdriver.CommandDef{Cmd: "make deploy TOKEN=abc", Echo: &hidden}, ""},
+	}
+	for _, test := range tests {
+		if got := shownCommand(test.cmd); got != test.want {
+			t.Errorf("shownCommand(%+v) = %q, want %q", test.cmd, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// envName matches the names of variables the shell can unset
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Returns the variables never written to the export file: the build token and the secrets listed
+// in SD_SECRET_NAMES (comma separated) by the launcher. The teardowns get them from the
+// environment of the launcher instead.
+func scrubbedEnvNames(env []string) []string {
+	names := []string{"SD_TOKEN"}
+	for _, name := range strings.Split(lookupEnv(env, "SD_SECRET_NAMES"), ",") {
+		if name = strings.TrimSpace(name); envName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// protectedEnvPrefix is prepended to the names of the variables the system would strip from the
+// environment of the build shell, which the shell sets back under their own names
+const protectedEnvPrefix = "SD_PROTECTED_"
+
+// Returns whether the system strips the variable name from the environment of the build shell
+func isStrippedEnv(name string) bool {
+	for _, prefix := range strippedEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns env with the variables the system would strip from the environment of the build shell
+// renamed, and the setup command setting them back, empty if there are none
+func protectEnv(env []string) ([]string, string) {
+	protected := make([]string, 0, len(env))
+	var restore []string
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if isStrippedEnv(name) && envName.MatchString(name) {
+			kv = protectedEnvPrefix + kv
+			restore = append(restore, "export "+name+"=\"$"+protectedEnvPrefix+name+"\"", "unset "+protectedEnvPrefix+name)
+		}
+		protected = append(protected, kv)
+	}
+	return protected, strings.Join(restore, " && ")
+}
+
+// Returns the shell commands writing the exported variables but PS1 and scrubbed to exportFile.
+// They are unset in a subshell rather than filtered out of the output, so no line of a multi-line
+// value is left behind. Use a per-shell tmpfile only its owner can read just in case export -p
+// takes some time, flush it to disk and rename it so teardowns never source a half-written file.
+func exportEnvCommand(tmpFile, exportFile string, scrubbed []string) string {
+	return "tmpfile=" + tmpFile + ".$$; exportfile=" + exportFile + "; " +
+		"(umask 077; unset " + strings.Join(scrubbed, " ") + "; export -p | grep -vi \"PS1=\" > $tmpfile) && " +
+		"(sync $tmpfile 2>/dev/null || true) && mv -f $tmpfile $exportfile; "
+}
+
+// Removes the export file and the tmpfiles left over by the shells writing it
+func removeEnvFiles(tmpFile, exportFile string) {
+	tmpFiles, _ := filepath.Glob(tmpFile + ".*")
+	for _, f := range append(tmpFiles, exportFile) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Failed to remove the environment file %s: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package executor
+
+// strippedEnvPrefixes are the prefixes of the variables System Integrity Protection strips from
+// the environment of the system's binaries, e.g. /bin/bash, so DYLD_LIBRARY_PATH would never reach
+// the steps
+var strippedEnvPrefixes = []string{"DYLD_"}
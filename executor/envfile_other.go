@@ -0,0 +1,8 @@
+//go:build !darwin
+// +build !darwin
+
+package executor
+
+// strippedEnvPrefixes are the prefixes of the variables the system strips from the environment of
+// the build shell, none
+var strippedEnvPrefixes []string
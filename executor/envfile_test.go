@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestScrubbedEnvNames(t *testing.T) {
+	env := []string{"SD_SECRET_NAMES=AWS_KEY, NPM_TOKEN,bad name,", "FOO=bar"}
+	want := []string{"SD_TOKEN", "AWS_KEY", "NPM_TOKEN"}
+	if got := scrubbedEnvNames(env); !reflect.DeepEqual(got, want) {
+		t.Errorf("scrubbedEnvNames() = %v, want %v", got, want)
+	}
+}
+
+func TestRunProtectsStrippedEnv(t *testing.T) {
+	envFilepath := "/tmp/testProtectEnv"
+	setupTestCase(t, envFilepath)
+	oldPrefixes := strippedEnvPrefixes
+	defer func() { strippedEnvPrefixes = oldPrefixes }()
+	// Like DYLD_ on macOS
+	strippedEnvPrefixes = []string{"SD_TEST_STRIPPED_"}
+
+	env := []string{"SD_TEST_STRIPPED_PATH=/opt/lib:/usr/local/lib", "FOO=bar"}
+	if got, restore := protectEnv(env); !reflect.DeepEqual(got, []string{"SD_PROTECTED_SD_TEST_STRIPPED_PATH=/opt/lib:/usr/local/lib", "FOO=bar"}) ||
+		restore != `export SD_TEST_STRIPPED_PATH="$SD_PROTECTED_SD_TEST_STRIPPED_PATH" && unset SD_PROTECTED_SD_TEST_STRIPPED_PATH` {
+		t.Errorf("protectEnv() = %q, %q", got, restore)
+	}
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: `echo "path is $SD_TEST_STRIPPED_PATH, ${SD_PROTECTED_SD_TEST_STRIPPED_PATH-gone}"`},
+		},
+		Environment: []map[string]string{},
+	}
+	emitter := &MockEmitter{}
+	if err := Run("", env, emitter, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if want := "\npath is /opt/lib:/usr/local/lib, gone\n"; !strings.Contains(string(emitter.found), want) {
+		t.Errorf("The output should contain %q, got %q", want, emitter.found)
+	}
+}
+
+func TestRunScrubsExportFile(t *testing.T) {
+	envFilepath := "/tmp/testScrub"
+	setupTestCase(t, envFilepath)
+	exportFile := envFilepath + "_export"
+
+	// The launcher has the secrets in its environment, which the teardowns inherit
+	os.Setenv("MY_SECRET", "hunter2")
+	defer os.Unsetenv("MY_SECRET")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "export OTHER_SECRET=\"$(printf 'line1\\nswordfish')\"; export VISIBLE=yes", Name: "step"},
+			{Cmd: "test $(stat -c %a " + exportFile + ") = 600 && ! grep -q -e hunter2 -e swordfish -e buildtoken " + exportFile +
+				` && test "$VISIBLE" = yes && test "$MY_SECRET" = hunter2`, Name: "teardown-check"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	env := []string{"MY_SECRET=hunter2", "SD_TOKEN=buildtoken", "SD_SECRET_NAMES=MY_SECRET,OTHER_SECRET"}
+	if err := Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v, exit codes %v", err, codes)
+	}
+
+	if _, err := os.Stat(exportFile); !os.IsNotExist(err) {
+		t.Errorf("The export file should be removed at the end of the build: %v", err)
+	}
+}
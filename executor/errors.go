@@ -0,0 +1,456 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Classes of build failures, to be matched with errors.Is
+var (
+	// ErrStepFailed matches errors caused by a step exiting with a non-zero code
+	ErrStepFailed = errors.New("step failed")
+	// ErrTimeout matches errors caused by the build exceeding its timeout
+	ErrTimeout = errors.New("build timed out")
+	// ErrAborted matches errors caused by the build being aborted
+	ErrAborted = errors.New("build aborted")
+	// ErrBlocked matches errors caused by a step blocked by the command policy
+	ErrBlocked = errors.New("step blocked by policy")
+	// ErrFrozen matches errors caused by a deployment step that falls in a freeze window
+	ErrFrozen = errors.New("step frozen")
+	// ErrPreempted matches errors caused by the node of the build going away
+	ErrPreempted = errors.New("build preempted")
+	// ErrInfra matches errors caused by the launcher or its dependencies rather than by the user
+	ErrInfra = errors.New("infrastructure error")
+)
+
+// StepFailure is an error for a step that exited with a non-zero code, or was killed by Signal
+type StepFailure struct {
+	Step   string
+	Code   int
+	Signal syscall.Signal
+}
+
+func (e StepFailure) Error() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("Launching command killed by %s, exit with code: %v", signalName(e.Signal), e.Code)
+	}
+	return fmt.Sprintf("Launching command exit with code: %v", e.Code)
+}
+
+// Is reports whether target is ErrStepFailed
+func (e StepFailure) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// Timeout is an error for a build that exceeded its timeout while running Step
+type Timeout struct {
+	Step    string
+	Timeout time.Duration
+}
+
+func (e Timeout) Error() string {
+	return fmt.Sprintf("Timeout of %v seconds exceeded", e.Timeout)
+}
+
+// Is reports whether target is ErrTimeout
+func (e Timeout) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// StepTimeout is an error for a step or teardown Step that exceeded its own timeout. The step
+// failed, the build did not time out.
+type StepTimeout struct {
+	Step    string
+	Timeout time.Duration
+}
+
+func (e StepTimeout) Error() string {
+	return fmt.Sprintf("Step timeout of %v exceeded", e.Timeout)
+}
+
+// Is reports whether target is ErrStepFailed
+func (e StepTimeout) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// TeardownFailures is the error of a build whose steps succeeded but whose teardowns failed, one
+// error per failed teardown
+type TeardownFailures []error
+
+func (e TeardownFailures) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+		if step := stepOf(err); step != "" {
+			msgs[i] = fmt.Sprintf("%s: %s", step, msgs[i])
+		}
+	}
+	return fmt.Sprintf("%d teardowns failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the failures matches target, so a single infrastructure error makes
+// the build an infrastructure failure
+func (e TeardownFailures) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failure matching target
+func (e TeardownFailures) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestFailures is the error of a build whose steps succeeded but whose test reports and TAP steps,
+// Reports of them, have Failed failed tests
+type TestFailures struct {
+	Failed  int
+	Reports int
+}
+
+func (e TestFailures) Error() string {
+	return fmt.Sprintf("%d tests failed in %d test reports", e.Failed, e.Reports)
+}
+
+// Is reports whether target is ErrStepFailed
+func (e TestFailures) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// CoverageFailure is the error of a build whose steps succeeded but whose coverage is below the
+// thresholds it has, one violation per threshold
+type CoverageFailure struct {
+	Violations []string
+}
+
+func (e CoverageFailure) Error() string {
+	return "Coverage below the thresholds: " + strings.Join(e.Violations, "; ")
+}
+
+// Is reports whether target is ErrStepFailed
+func (e CoverageFailure) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// FindingsFailure is the error of a build whose steps succeeded but whose SARIF files have more
+// findings than its thresholds, one violation per threshold
+type FindingsFailure struct {
+	Violations []string
+}
+
+func (e FindingsFailure) Error() string {
+	return "Findings above the thresholds: " + strings.Join(e.Violations, "; ")
+}
+
+// Is reports whether target is ErrStepFailed
+func (e FindingsFailure) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// Aborted is an error for a build that was aborted by a signal while running Step
+type Aborted struct {
+	Step string
+}
+
+func (e Aborted) Error() string {
+	return "SIGTERM received, step aborted"
+}
+
+// Is reports whether target is ErrAborted
+func (e Aborted) Is(target error) bool {
+	return target == ErrAborted
+}
+
+// Preempted is an error for a build stopped while running Step because its node was going away,
+// for Reason (e.g. "SIGTERM" or "aws spot interruption")
+type Preempted struct {
+	Step   string
+	Reason string
+}
+
+func (e Preempted) Error() string {
+	return fmt.Sprintf("The node of the build is shutting down (%s), build preempted", e.Reason)
+}
+
+// Is reports whether target is ErrPreempted
+func (e Preempted) Is(target error) bool {
+	return target == ErrPreempted
+}
+
+// BuildStopped is an error for a step stopped because the API has the build set to Status, aborted
+// or failed, outside of the launcher
+type BuildStopped struct {
+	Step   string
+	Status string
+}
+
+func (e BuildStopped) Error() string {
+	return fmt.Sprintf("Build set to %s outside of the launcher, step stopped", e.Status)
+}
+
+// Is reports whether target is ErrAborted
+func (e BuildStopped) Is(target error) bool {
+	return target == ErrAborted
+}
+
+// WaitingForInput is an error for a step stopped because it waited for interactive input on the
+// pty after Prompt, with no output for Quiet
+type WaitingForInput struct {
+	Step   string
+	Prompt string
+	Quiet  time.Duration
+}
+
+func (e WaitingForInput) Error() string {
+	return fmt.Sprintf("Step is waiting for interactive input after %q, with no output for %v", e.Prompt, e.Quiet)
+}
+
+// Is reports whether target is ErrStepFailed
+func (e WaitingForInput) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// WroteStderr is an error for a step that failed for writing Bytes to its standard error
+type WroteStderr struct {
+	Step  string
+	Bytes int64
+}
+
+func (e WroteStderr) Error() string {
+	return fmt.Sprintf("Step wrote %d bytes to its standard error", e.Bytes)
+}
+
+// Is reports whether target is ErrStepFailed
+func (e WroteStderr) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// Blocked is an error for a step that was not run because it violates the command policy Rule
+type Blocked struct {
+	Step    string
+	Rule    string
+	Message string
+}
+
+func (e Blocked) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("Step blocked by policy rule %q: %s", e.Rule, e.Message)
+	}
+	return fmt.Sprintf("Step blocked by policy rule %q", e.Rule)
+}
+
+// Is reports whether target is ErrBlocked
+func (e Blocked) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// Frozen is an error for a deployment step that was not run because it falls in the freeze window
+// Window of the job
+type Frozen struct {
+	Step   string
+	Window string
+}
+
+func (e Frozen) Error() string {
+	return fmt.Sprintf("Deployment step %q frozen by the freeze window %q", e.Step, e.Window)
+}
+
+// Is reports whether target is ErrFrozen
+func (e Frozen) Is(target error) bool {
+	return target == ErrFrozen
+}
+
+// ApprovalRejected is an error for a gate step whose approval was rejected By someone, with Message
+type ApprovalRejected struct {
+	Step    string
+	By      string
+	Message string
+}
+
+func (e ApprovalRejected) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("Approval rejected by %s: %s", e.By, e.Message)
+	}
+	return fmt.Sprintf("Approval rejected by %s", e.By)
+}
+
+// Is reports whether target is ErrStepFailed
+func (e ApprovalRejected) Is(target error) bool {
+	return target == ErrStepFailed
+}
+
+// LaunchError is an error for a step command that could not be started at all
+type LaunchError struct {
+	Step string
+	Err  error
+}
+
+func (e LaunchError) Error() string {
+	return fmt.Sprintf("Launching step %q: %v", e.Step, e.Err)
+}
+
+// Is reports whether target is ErrInfra
+func (e LaunchError) Is(target error) bool {
+	return target == ErrInfra
+}
+
+// Unwrap returns the underlying error
+func (e LaunchError) Unwrap() error {
+	return e.Err
+}
+
+// InfraError is an error of the launcher itself or its dependencies (API, pty, filesystem)
+type InfraError struct {
+	Op  string
+	Err error
+}
+
+func (e InfraError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Is reports whether target is ErrInfra
+func (e InfraError) Is(target error) bool {
+	return target == ErrInfra
+}
+
+// Unwrap returns the underlying error
+func (e InfraError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifiedFailure is the failure Err of Step that the failure rule Rule puts in Class
+type ClassifiedFailure struct {
+	Step  string
+	Class string
+	Rule  string
+	Err   error
+}
+
+func (e ClassifiedFailure) Error() string {
+	return fmt.Sprintf("Step %q failed as %s by rule %q: %v", e.Step, e.Class, e.Rule, e.Err)
+}
+
+// Is reports whether target is the class of the failure: ErrInfra, ErrTimeout or ErrAborted
+func (e ClassifiedFailure) Is(target error) bool {
+	switch e.Class {
+	case ClassInfraError:
+		return target == ErrInfra
+	case ClassTimeout:
+		return target == ErrTimeout
+	case ClassAborted:
+		return target == ErrAborted
+	}
+	return false
+}
+
+// Unwrap returns the underlying error
+func (e ClassifiedFailure) Unwrap() error {
+	return e.Err
+}
+
+// withStep sets the step name on the step aware error types
+func withStep(err error, step string) error {
+	switch e := err.(type) {
+	case StepFailure:
+		e.Step = step
+		return e
+	case Timeout:
+		e.Step = step
+		return e
+	case StepTimeout:
+		e.Step = step
+		return e
+	case Aborted:
+		e.Step = step
+		return e
+	case Blocked:
+		e.Step = step
+		return e
+	case ApprovalRejected:
+		e.Step = step
+		return e
+	case Frozen:
+		e.Step = step
+		return e
+	case BuildStopped:
+		e.Step = step
+		return e
+	case Preempted:
+		e.Step = step
+		return e
+	case WaitingForInput:
+		e.Step = step
+		return e
+	case WroteStderr:
+		e.Step = step
+		return e
+	case LaunchError:
+		e.Step = step
+		return e
+	}
+	return err
+}
+
+// stepOf returns the step name of the step aware error types whose message does not have it, or ""
+func stepOf(err error) string {
+	switch e := err.(type) {
+	case StepFailure:
+		return e.Step
+	case Timeout:
+		return e.Step
+	case StepTimeout:
+		return e.Step
+	case Aborted:
+		return e.Step
+	case Blocked:
+		return e.Step
+	case ApprovalRejected:
+		return e.Step
+	case BuildStopped:
+		return e.Step
+	case Preempted:
+		return e.Step
+	case WaitingForInput:
+		return e.Step
+	case WroteStderr:
+		return e.Step
+	}
+	return ""
+}
+
+// IsUserFailure reports whether err was caused by the build itself (failed step, timeout, abort,
+// blocked or frozen step) rather than by the infrastructure
+func IsUserFailure(err error) bool {
+	return err != nil && !errors.Is(err, ErrInfra) &&
+		(errors.Is(err, ErrStepFailed) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrAborted) || errors.Is(err, ErrBlocked) || errors.Is(err, ErrFrozen))
+}
+
+// FailureClass returns the class of the build failure err: ClassUserError, ClassInfraError,
+// ClassTimeout, ClassAborted or ClassPreempted, or "" if err is nil
+func FailureClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrPreempted):
+		return ClassPreempted
+	case !IsUserFailure(err):
+		return ClassInfraError
+	case errors.Is(err, ErrAborted):
+		return ClassAborted
+	case errors.Is(err, ErrTimeout):
+		return ClassTimeout
+	}
+	return ClassUserError
+}
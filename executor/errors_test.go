@@ -0,0 +1,106 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestErrorClasses(t *testing.T) {
+	cause := errors.New("connection refused")
+	tests := []struct {
+		err   error
+		class error
+		user  bool
+	}{
+		{StepFailure{Step: "test", Code: 2}, ErrStepFailed, true},
+		{Timeout{"test", time.Minute}, ErrTimeout, true},
+		{StepTimeout{"teardown-test", time.Minute}, ErrStepFailed, true},
+		{TeardownFailures{StepFailure{Step: "a", Code: 1}, StepTimeout{"b", time.Minute}}, ErrStepFailed, true},
+		{TestFailures{Failed: 3, Reports: 1}, ErrStepFailed, true},
+		{CoverageFailure{[]string{"Line coverage 75% is below 80%"}}, ErrStepFailed, true},
+		{FindingsFailure{[]string{"3 errors, more than 0"}}, ErrStepFailed, true},
+		{Aborted{"test"}, ErrAborted, true},
+		{Blocked{Step: "test", Rule: "no-curl-sh"}, ErrBlocked, true},
+		{Frozen{Step: "deploy", Window: "* * ? * SAT,SUN"}, ErrFrozen, true},
+		{ApprovalRejected{Step: "approve", By: "jdoe"}, ErrStepFailed, true},
+		{WaitingForInput{Step: "test", Prompt: "Password:", Quiet: time.Minute}, ErrStepFailed, true},
+		{WroteStderr{Step: "test", Bytes: 12}, ErrStepFailed, true},
+		{LaunchError{"test", cause}, ErrInfra, false},
+		{InfraError{"Updating step start", cause}, ErrInfra, false},
+		{fmt.Errorf("wrapped: %w", StepFailure{Step: "test", Code: 1}), ErrStepFailed, true},
+		{errors.New("unknown"), nil, false},
+	}
+
+	classes := []error{ErrStepFailed, ErrTimeout, ErrAborted, ErrBlocked, ErrFrozen, ErrInfra}
+	for _, test := range tests {
+		for _, class := range classes {
+			if got := errors.Is(test.err, class); got != (class == test.class) {
+				t.Errorf("errors.Is(%v, %v) = %v", test.err, class, got)
+			}
+		}
+		if got := IsUserFailure(test.err); got != test.user {
+			t.Errorf("IsUserFailure(%v) = %v, want %v", test.err, got, test.user)
+		}
+	}
+
+	if !errors.Is(LaunchError{"test", cause}, cause) {
+		t.Errorf("LaunchError should unwrap to its cause")
+	}
+	if !errors.Is(InfraError{"op", cause}, cause) {
+		t.Errorf("InfraError should unwrap to its cause")
+	}
+}
+
+func TestStepFailureMessage(t *testing.T) {
+	tests := []struct {
+		err  StepFailure
+		want string
+	}{
+		{StepFailure{Step: "test", Code: 2}, "Launching command exit with code: 2"},
+		{StepFailure{"test", 137, syscall.SIGKILL}, "Launching command killed by SIGKILL, exit with code: 137"},
+	}
+
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("Error() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestWithStep(t *testing.T) {
+	var failure StepFailure
+	if !errors.As(fmt.Errorf("wrapped: %w", withStep(StepFailure{Code: 3}, "build")), &failure) {
+		t.Fatalf("errors.As should find the StepFailure")
+	}
+	if !reflect.DeepEqual(failure, StepFailure{Step: "build", Code: 3}) {
+		t.Errorf("Unexpected step failure: %+v", failure)
+	}
+
+	err := InfraError{"op", errors.New("boom")}
+	if got := withStep(err, "build"); !reflect.DeepEqual(got, err) {
+		t.Errorf("withStep(%v) = %v, want it unchanged", err, got)
+	}
+}
+
+func TestTeardownFailures(t *testing.T) {
+	err := TeardownFailures{
+		StepFailure{Step: "teardown-report", Code: 2},
+		InfraError{"Running command \"upload\"", errors.New("boom")},
+	}
+	want := `2 teardowns failed: teardown-report: Launching command exit with code: 2; Running command "upload": boom`
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	if IsUserFailure(err) {
+		t.Errorf("A teardown infrastructure error should make the build an infrastructure failure")
+	}
+	var failure StepFailure
+	if !errors.As(err, &failure) || failure.Step != "teardown-report" {
+		t.Errorf("errors.As should find the StepFailure: %+v", failure)
+	}
+}
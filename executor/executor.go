@@ -3,22 +3,28 @@ package executor
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/creack/pty"
 	"github.com/google/uuid"
+	"github.com/screwdriver-cd/launcher/logger"
 	"github.com/screwdriver-cd/launcher/screwdriver"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -28,87 +34,221 @@ const (
 	ExitUnknown = 254
 	// ExitOk is the exit code when a step runs successfully
 	ExitOk = 0
+	// ExitSignal is added to the signal number for a step killed by a signal, as the shell does
+	ExitSignal = 128
+	// ExitTimeout is the exit code of a step killed by SIGTERM because the build timed out
+	ExitTimeout = ExitSignal + int(syscall.SIGTERM)
+	// ExitAborted is the exit code of a step killed by SIGTERM because the build was aborted
+	ExitAborted = ExitSignal + int(syscall.SIGTERM)
+	// ExitBlocked is the exit code of a step blocked by the command policy, as the shell does for
+	// a command it cannot execute
+	ExitBlocked = 126
+	// ExitStderr is the exit code of a step that succeeded but failed for writing to its standard
+	// error
+	ExitStderr = 1
 	// How long should wait for the env file
 	WaitTimeout = 5
+	// Longest chunk of a single output line held in memory before it is forwarded
+	maxLineChunk = 64 * 1024
 )
 
-// ErrStatus is an error that holds an exit status code
-type ErrStatus struct {
-	Status int
+// Write a file atomically: the data goes to a temp file in the same directory, is synced to disk
+// and then renamed over path, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Creating temp file for %q: %v", path, err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Writing %q: %v", path, err)
+	}
+
+	return nil
 }
 
-func (e ErrStatus) Error() string {
-	return fmt.Sprintf("exit %d", e.Status)
+// Returns the lines of the step script of cmd before its command: the shebang, the token export
+// if any and the variables of the step
+func stepScriptHeader(cmd screwdriver.CommandDef, shellBin, token string) string {
+	header := "#!" + shellBin + " -e\n"
+	if isFish(shellBin) {
+		// fish has no -e, a script fails with its last command
+		header = "#!" + shellBin + "\n"
+	}
+	if token != "" {
+		header += exportToken(token)
+	}
+	return header + exportStepEnv(cmd.Env) + traceStart(cmd, shellBin)
 }
 
-// Create a sh file
-func createShFile(path string, cmd screwdriver.CommandDef, shellBin string) error {
-	return ioutil.WriteFile(path, []byte("#!"+shellBin+" -e\n"+cmd.Cmd), 0755)
+// Create a sh file and verify its content before it gets sourced. With a token the file exports it
+// first and only its owner can read it. The command of a step with an interpreter goes to a script
+// of its own, with the shebang of the interpreter, which the sh file runs in its place.
+func createShFile(path string, cmd screwdriver.CommandDef, shellBin, token string) error {
+	perm := os.FileMode(0755)
+	if token != "" {
+		perm = 0700
+	}
+	command := cmd.Cmd
+	if cmd.Interpreter != "" {
+		scriptPath := interpreterScriptPath(path)
+		if err := writeVerifiedFile(scriptPath, []byte(interpreterShebang(cmd.Interpreter)+cmd.Cmd), perm); err != nil {
+			return err
+		}
+		command = "exec " + shellQuote(scriptPath) + "\n"
+	}
+	return writeVerifiedFile(path, []byte(stepScriptHeader(cmd, shellBin, token)+command+traceStop(cmd, shellBin)), perm)
 }
 
-// Returns a single line (without the ending \n) from the input buffered reader
-// Pulled from https://stackoverflow.com/a/12206365
-func readln(r *bufio.Reader) (string, error) {
-	var (
-		isPrefix = true
-		err      error
-		line, ln []byte
-	)
+// Writes content to the file at path with perm and reads it back to check it was written
+func writeVerifiedFile(path string, content []byte, perm os.FileMode) error {
+	if err := writeFileAtomic(path, content, perm); err != nil {
+		return err
+	}
 
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.ReadLine()
-		ln = append(ln, line...)
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Verifying %q: %v", path, err)
+	}
+	if !bytes.Equal(written, content) {
+		return fmt.Errorf("Verifying %q: content does not match what was written", path)
 	}
 
-	return string(ln), err
+	return nil
+}
+
+// Normalizes the line ending of a chunk returned by ReadSlice to a single \n, in place.
+// Reports whether the chunk completes a line (false for partial chunks of long lines).
+func trimEOL(chunk []byte) ([]byte, bool) {
+	n := len(chunk)
+	if n == 0 || chunk[n-1] != '\n' {
+		return chunk, false
+	}
+	if n > 1 && chunk[n-2] == '\r' {
+		chunk[n-2] = '\n'
+		chunk = chunk[:n-1]
+	}
+	return chunk, true
 }
 
 // Copy lines until match string
-func copyLinesUntil(r io.Reader, w io.Writer, match string) (int, error) {
+func copyLinesUntil(r io.Reader, dst io.Writer, match string) (int, error) {
+	code, _, err := copyStepOutput(r, dst, match)
+	return code, err
+}
+
+// Copies the output of a step until the exit sentinel with match, returning the exit code and how
+// many times the step ran again after failing, which the steps running apart echo after the code.
+// Lines longer than the reader buffer are forwarded in chunks split between UTF-8 characters,
+// so memory stays bounded. Output is batched and flushed to w whenever the next read may block
+func copyStepOutput(r io.Reader, dst io.Writer, match string) (int, int, error) {
 	var (
-		err    error
-		t      string
-		reader = bufio.NewReader(r)
-		// Match the guid and exitCode
-		reExit = regexp.MustCompile(fmt.Sprintf("(%s) ([0-9]+)", match))
+		reader = bufio.NewReaderSize(r, maxLineChunk)
+		w      = bufio.NewWriterSize(dst, maxLineChunk)
+		// Match the guid, exitCode and retries
+		reExit = regexp.MustCompile(fmt.Sprintf("(%s) ([0-9]+)(?: ([0-9]+))?", match))
 		// Match the export SD_STEP_ID command
 		reExport = regexp.MustCompile("export SD_STEP_ID=(" + match + ")")
+		// Whether the current chunk continues a line that did not fit in the buffer
+		continued bool
+		// The start of a character cut off at the end of the previous chunk
+		partial = make([]byte, 0, 2*utf8.UTFMax)
+		// Cheap pre-check so the regexes only run on lines that can match
+		guid = []byte(match)
 	)
-	t, err = readln(reader)
-	for err == nil {
-		parts := reExit.FindStringSubmatch(t)
-		if len(parts) != 0 {
-			exitCode, rerr := strconv.Atoi(parts[2])
-			if rerr != nil {
-				return ExitUnknown, fmt.Errorf("Error converting the exit code to int: %v", rerr)
+
+	defer w.Flush()
+
+	// Writes p in one piece, so the output is only ever split between writes
+	emit := func(p []byte) error {
+		if len(p) > w.Available() && w.Buffered() > 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(p)
+		return err
+	}
+	// Writes p after the character cut off at the end of the previous chunk
+	emitContinued := func(p []byte) error {
+		if len(partial) > 0 {
+			k := 0
+			for k < len(p) && k < utf8.UTFMax && !utf8.RuneStart(p[k]) {
+				k++
 			}
-			if exitCode != 0 {
-				return exitCode, fmt.Errorf("Launching command exit with code: %v", exitCode)
+			if err := emit(append(partial, p[:k]...)); err != nil {
+				return err
 			}
-			return ExitOk, nil
+			partial, p = partial[:0], p[k:]
 		}
-		// Filter out the export command from the output
-		exportCmd := reExport.FindStringSubmatch(t)
-		if len(exportCmd) == 0 {
-			_, werr := fmt.Fprintln(w, t)
-			if werr != nil {
-				return ExitUnknown, fmt.Errorf("Error piping logs to emitter: %v", werr)
+		return emit(p)
+	}
+
+	for {
+		if pending, _ := reader.Peek(reader.Buffered()); bytes.IndexByte(pending, '\n') < 0 {
+			if err := w.Flush(); err != nil {
+				return ExitUnknown, 0, InfraError{"Error piping logs to emitter", err}
 			}
 		}
 
-		t, err = readln(reader)
-	}
-	if err != nil {
-		return ExitUnknown, fmt.Errorf("Error with reader: %v", err)
+		chunk, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			n := screwdriver.RuneBoundary(chunk)
+			if werr := emitContinued(chunk[:n]); werr != nil {
+				return ExitUnknown, 0, InfraError{"Error piping logs to emitter", werr}
+			}
+			partial = append(partial[:0], chunk[n:]...)
+			continued = true
+			continue
+		}
+		if err != nil {
+			return ExitUnknown, 0, InfraError{"Error with reader", err}
+		}
+
+		line, _ := trimEOL(chunk)
+		hasGUID := bytes.Contains(line, guid)
+		if !continued && hasGUID {
+			parts := reExit.FindSubmatch(line)
+			if len(parts) != 0 {
+				exitCode, rerr := strconv.Atoi(string(parts[2]))
+				if rerr != nil {
+					return ExitUnknown, 0, InfraError{"Error converting the exit code to int", rerr}
+				}
+				retries, _ := strconv.Atoi(string(parts[3]))
+				logger.Debugf("pty: read exit sentinel %q", line)
+				if exitCode != 0 {
+					return exitCode, retries, StepFailure{Code: exitCode}
+				}
+				return ExitOk, retries, nil
+			}
+		}
+		// Filter out the export command from the output
+		if continued || !hasGUID || !reExport.Match(line) {
+			if werr := emitContinued(line); werr != nil {
+				return ExitUnknown, 0, InfraError{"Error piping logs to emitter", werr}
+			}
+		}
+		continued = false
 	}
-	return ExitOk, nil
 }
 
-func doRunSetupCommand(emitter screwdriver.Emitter, f *os.File, r io.Reader, setupCommands []string) error {
+func doRunSetupCommand(emitter screwdriver.Emitter, f io.Writer, r io.Reader, setupCommands []string) error {
 	var (
-		t      string
-		err    error
-		reader = bufio.NewReader(r)
+		reader = bufio.NewReaderSize(r, maxLineChunk)
 		reEcho = regexp.MustCompile("echo ;")
 	)
 
@@ -116,309 +256,1789 @@ func doRunSetupCommand(emitter screwdriver.Emitter, f *os.File, r io.Reader, set
 
 	f.Write([]byte(shargs))
 
-	t, err = readln(reader)
-	for err == nil {
-		echoCmd := reEcho.FindStringSubmatch(t)
-		if len(echoCmd) != 0 {
-			_, werr := fmt.Fprintln(emitter, t)
-			if werr != nil {
-				return fmt.Errorf("Error piping logs to emitter: %v", werr)
-			}
-			return nil
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return InfraError{"Error with reader", err}
 		}
-		_, werr := fmt.Fprintln(emitter, t)
-		if werr != nil {
-			return fmt.Errorf("Error piping logs to emitter: %v", werr)
+		line, complete := trimEOL(chunk)
+		if _, werr := emitter.Write(line); werr != nil {
+			return InfraError{"Error piping logs to emitter", werr}
+		}
+		if complete && reEcho.Match(line) {
+			logger.Debugf("pty: setup commands done")
+			return nil
 		}
-		t, err = readln(reader)
-	}
-	if err != nil {
-		return fmt.Errorf("Error with reader: %v", err)
 	}
-	return nil
 }
 
-func doRunCommand(guid, path string, emitter screwdriver.Emitter, f *os.File, fReader io.Reader) (int, error) {
-	executionCommand := []string{
-		"export SD_STEP_ID=" + guid,
-		";. " + path,
-		";echo",
-		";echo " + guid + " $?\n",
+// Runs command in the build shell, returning its exit code and how many times it was retried
+func doRunCommand(guid, command string, emitter screwdriver.Emitter, f io.Writer, fReader io.Reader) (int, int, error) {
+	f.Write([]byte(command))
+
+	return copyStepOutput(fReader, emitter, guid)
+}
+
+// Checks condition in the build shell, returning whether it succeeded
+func doRunCondition(guid, condition string, emitter screwdriver.Emitter, f io.Writer, fReader io.Reader) (bool, error) {
+	f.Write([]byte(conditionCommand(guid, condition)))
+
+	code, err := copyLinesUntil(fReader, emitter, guid)
+	if errors.Is(err, ErrStepFailed) {
+		return false, nil
 	}
-	shargs := strings.Join(executionCommand, " ")
+	return code == ExitOk, err
+}
 
-	f.Write([]byte(shargs))
+// Returns the name of sig, e.g. "SIGTERM"
+func signalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
 
-	return copyLinesUntil(fReader, emitter, guid)
+// Signals every process in the process group led by c
+func killProcessGroup(c *exec.Cmd, sig syscall.Signal) {
+	if c.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-c.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		logger.Warnf("Failed to send %v to process group %d: %v", sig, c.Process.Pid, err)
+	}
 }
 
-// Executes teardown commands
-func doRunTeardownCommand(cmd screwdriver.CommandDef, emitter screwdriver.Emitter, shellBin, exportFile, sourceDir string, stepExitCode int) (int, error) {
+// Executes teardown commands isolated like isolation, or on the remote host if not nil, with
+// SD_TOKEN set to token, SD_STEP_RESULTS to resultsFile and TMPDIR to tmpDir if not empty, and
+// the directories of toolPath added to PATH, returning the exit code and the resources the command
+// used
+func doRunTeardownCommand(ctx context.Context, cmd screwdriver.CommandDef, emitter screwdriver.Emitter, remote *remoteHost, shellBin, exportFile, resultsFile, sourceDir string, stepExitCode int, isolation stepIsolation, token, tmpDir string, toolPath stepPath, priority processPriority) (int, *screwdriver.ResourceUsage, error) {
+	shell, run := teardownShell(cmd, shellBin)
 	shargs := []string{"-e", "-c"}
-	cmdStr := "export PATH=${PATH}:/opt/sd:/usr/sd/bin SD_STEP_EXIT_CODE=" + strconv.Itoa(stepExitCode) + " && " +
+	exports := "export PATH=" + toolPath.value() + " SD_STEP_EXIT_CODE=" + strconv.Itoa(stepExitCode)
+	if resultsFile != "" {
+		exports += " SD_STEP_RESULTS=" + resultsFile
+	}
+	cmdStr := exports + " && " +
 		"START=$(date +'%s'); while ! [ -f " + exportFile + " ] && [ $(($(date +'%s')-$START)) -lt " + strconv.Itoa(WaitTimeout) + " ]; do sleep 1; done; " +
 		"if [ -f " + exportFile + " ]; then set +e; . " + exportFile + "; set -e; fi; " +
-		cmd.Cmd
+		exportStepEnv(cmd.Env) + exportTmpDir(tmpDir) + run
 
 	shargs = append(shargs, cmdStr)
 
-	c := exec.Command(shellBin, shargs...)
+	teardownCtx := ctx
+	timeout := time.Duration(cmd.Timeout) * time.Second
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		teardownCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var c *exec.Cmd
+	var err error
+	if remote != nil {
+		c, err = remote.teardownCommand(teardownCtx, cmd, shell, cmdStr, sourceDir, token)
+		if err == nil {
+			c.SysProcAttr = &syscall.SysProcAttr{}
+		}
+	} else {
+		c, err = isolation.command(teardownCtx, shell, shargs...)
+	}
+	if err != nil {
+		return ExitLaunch, nil, LaunchError{cmd.Name, err}
+	}
+	// Run in its own process group so everything the teardown spawns can be killed with it
+	c.SysProcAttr.Setpgid = true
+	if cmd.User != "" && remote == nil {
+		uid, gid, err := lookupUser(cmd.User)
+		if err != nil {
+			return ExitLaunch, nil, LaunchError{cmd.Name, err}
+		}
+		c.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
 	emitter.StartCmd(cmd)
-	fmt.Fprintf(emitter, "$ %s\n", cmd.Cmd)
+	echoCommand(emitter, cmd)
 	c.Stdout = emitter
 	c.Stderr = emitter
-	c.Dir = sourceDir
+	if remote == nil {
+		stdin, closer, err := teardownStdin(cmd, sourceDir)
+		if err != nil {
+			launcherf(emitter, "%v\n", err)
+			return exitStdinNotFound, nil, StepFailure{Step: cmd.Name, Code: exitStdinNotFound}
+		}
+		if closer != nil {
+			defer closer.Close()
+		}
+		c.Stdin = stdin
+	}
+	if remote != nil {
+		// The output comes from the pty of the remote host
+		output := &crlfWriter{w: emitter}
+		c.Stdout = output
+		c.Stderr = output
+	} else {
+		c.Dir = sourceDir
+		if token != "" {
+			c.Env = setEnv(os.Environ(), "SD_TOKEN", token)
+		}
+	}
 
 	if err := c.Start(); err != nil {
-		return ExitLaunch, fmt.Errorf("Launching command %q: %v", cmd.Cmd, err)
+		return ExitLaunch, nil, LaunchError{cmd.Name, err}
+	}
+	if remote == nil {
+		if err := priority.apply(c.Process.Pid); err != nil {
+			logger.Warnf("Failed to set the priority of teardown %q: %v", cmd.Name, err)
+		}
 	}
 
-	if err := c.Wait(); err != nil {
+	err = c.Wait()
+	if teardownCtx.Err() != nil {
+		// The context only kills the group leader, make sure nothing it spawned outlives it
+		killProcessGroup(c, syscall.SIGKILL)
+	}
+	usage := rusageOf(c.ProcessState)
+	if ctx.Err() == nil && teardownCtx.Err() == context.DeadlineExceeded {
+		launcherf(emitter, "Step timeout of %v exceeded\n", timeout)
+		return ExitTimeout, usage, StepTimeout{cmd.Name, timeout}
+	}
+	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			waitStatus := exitError.Sys().(syscall.WaitStatus)
+			if waitStatus.Signaled() {
+				code := ExitSignal + int(waitStatus.Signal())
+				return code, usage, StepFailure{cmd.Name, code, waitStatus.Signal()}
+			}
 
-			return waitStatus.ExitStatus(), ErrStatus{waitStatus.ExitStatus()}
+			return waitStatus.ExitStatus(), usage, StepFailure{Step: cmd.Name, Code: waitStatus.ExitStatus()}
 		}
 
-		return ExitUnknown, fmt.Errorf("Running command %q: %v", cmd.Cmd, err)
+		return ExitUnknown, usage, InfraError{fmt.Sprintf("Running command %q", shownCommand(cmd)), err}
 	}
 
-	return ExitOk, nil
+	return ExitOk, usage, nil
+}
+
+// buildTimer signals the build timeout on a channel. It is stopped when the run context is done
+// and can be extended while it has not fired yet
+type buildTimer struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	timeout  time.Duration
+	deadline time.Time
+	fired    bool
+	ch       chan<- error
+}
+
+// ptyWriter serializes writes to the pty through a single goroutine, so the step, timeout
+// and abort paths can't interleave their control bytes
+type ptyWriter struct {
+	reqs chan ptyWrite
+	done chan struct{}
+	once sync.Once
+}
+
+type ptyWrite struct {
+	data   []byte
+	result chan ptyResult
+}
+
+type ptyResult struct {
+	n   int
+	err error
+}
+
+func newPtyWriter(w io.Writer) *ptyWriter {
+	p := &ptyWriter{
+		reqs: make(chan ptyWrite),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case req := <-p.reqs:
+				logger.Debugf("pty: write %q", req.data)
+				n, err := w.Write(req.data)
+				req.result <- ptyResult{n, err}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// Write queues b for the writer goroutine and waits until it has been written
+func (p *ptyWriter) Write(b []byte) (int, error) {
+	req := ptyWrite{data: b, result: make(chan ptyResult, 1)}
+
+	select {
+	case p.reqs <- req:
+	case <-p.done:
+		return 0, fmt.Errorf("Writing to closed pty writer")
+	}
+
+	res := <-req.result
+	return res.n, res.err
+}
+
+// Close stops the writer goroutine. Writes after Close fail
+func (p *ptyWriter) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
 }
 
 // Initiate the build timeout timer
-func initBuildTimeout(timeout time.Duration, ch chan<- error) {
-	log.Printf("Starting timer for timeout of %v seconds", timeout)
-	time.Sleep(timeout)
-	log.Printf("Timeout of %v seconds exceeded. Signal kill-build process", timeout)
-	ch <- fmt.Errorf("Timeout of %v seconds exceeded", timeout)
+func newBuildTimer(ctx context.Context, timeout time.Duration, ch chan<- error) *buildTimer {
+	logger.Infof("Starting timer for timeout of %v seconds", timeout)
+	b := &buildTimer{
+		timeout:  timeout,
+		deadline: time.Now().Add(timeout),
+		ch:       ch,
+	}
+	b.timer = time.AfterFunc(timeout, b.fire)
+
+	go func() {
+		<-ctx.Done()
+		b.Stop()
+	}()
+
+	return b
+}
+
+func (b *buildTimer) fire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fired = true
+	logger.Infof("Timeout of %v seconds exceeded. Signal kill-build process", b.timeout)
+	select {
+	case b.ch <- Timeout{Timeout: b.timeout}:
+	default:
+	}
+}
+
+// Extend pushes the timeout back by d. It returns false if the timer already fired or was stopped
+func (b *buildTimer) Extend(d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fired || !b.timer.Stop() {
+		return false
+	}
+	b.timeout += d
+	b.deadline = b.deadline.Add(d)
+	b.timer.Reset(time.Until(b.deadline))
+	logger.Infof("Extended build timeout to %v seconds", b.timeout)
+
+	return true
+}
+
+// Stop cancels the timer. It returns false if the timer already fired or was stopped
+func (b *buildTimer) Stop() bool {
+	return b.timer.Stop()
+}
+
+// Returns how much SIGUSR1 extends the build timeout, from SD_TIMEOUT_EXTENSION in minutes in the
+// launcher environment. 0, the default, leaves the timeout as it is.
+func timeoutExtension() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("SD_TIMEOUT_EXTENSION"))
+	if value == "" {
+		return 0, nil
+	}
+	minutes, err := strconv.Atoi(value)
+	if err != nil || minutes < 0 {
+		return 0, fmt.Errorf("Invalid SD_TIMEOUT_EXTENSION %q, want a number of minutes", value)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// Extends the build timeout by d every time the launcher gets SIGUSR1, until ctx is done
+func extendOnSignal(ctx context.Context, b *buildTimer, d time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+				if !b.Extend(d) {
+					logger.Warnf("Cannot extend the build timeout, it is over")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Waits for the reader of a step stopped by a timeout or an abort to be done with the pty and the
+// emitter. The shell was told to stop, so the reader soon gets the exit sentinel or the end of the
+// pty. If it does not, closing the pty ends it.
+func joinStepReader(pty io.Closer, runErr <-chan error) {
+	select {
+	case <-runErr:
+		return
+	case <-time.After(WaitTimeout * time.Second):
+	}
+	logger.Warnf("The step output is still being read %d seconds after stopping the shell, closing the pty", WaitTimeout)
+	pty.Close()
+	<-runErr
 }
 
 // trap sigterm signal and handle it
 func notifySignal(sigs chan os.Signal, ch chan<- error) {
 	sig := <-sigs
-	fmt.Printf("Received %s signal in launcher, processing signal \n", sig)
-	ch <- fmt.Errorf("SIGTERM received, step aborted")
+	logger.Infof("Received %s signal in launcher, processing signal", sig)
+	ch <- Aborted{}
 }
 
 // print timeout message to build & kill shell
-func handleBuildTimeout(f *os.File, timeoutErr error) {
-	l := []string{
-		"#####################################################################",
-		"#####################################################################",
-		"#####################################################################",
-		" _     _                                      _ ",
-		"| |   (_)                                    | |",
-		"| |_   _   _ __ ___     ___    ___    _   _  | |_ ",
-		"| __| | | | '_ ` _ \\   / _ \\  / _ \\  | | | | | __|",
-		"| |_  | | | | | | | | |  __/ | (_) | | |_| | | |_ ",
-		" \\__| |_| |_| |_| |_|  \\___|  \\___/   \\__,_|  \\__|",
-		"",
-		fmt.Sprintf("%v\n", timeoutErr.Error()),
-		"",
-		"#####################################################################",
-		"#####################################################################",
-		"#####################################################################",
-	}
-
-	for _, msg := range l {
-		// print lines
-		f.Write([]byte(fmt.Sprintf("%v\n", msg)))
-	}
-
-	// kill shell
-	f.Write([]byte{4})
-}
-
-func filterTeardowns(build screwdriver.Build) ([]screwdriver.CommandDef, []screwdriver.CommandDef, []screwdriver.CommandDef) {
+func handleBuildTimeout(f io.Writer, text string, caps shellCapabilities) {
+	l := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+
+	// print lines & kill shell in a single write so nothing gets interleaved
+	var banner bytes.Buffer
+	if caps.busybox {
+		// BusyBox ash reads the banner as commands, so keep its quotes out of them
+		for _, msg := range l {
+			fmt.Fprintf(&banner, "# %v\n", msg)
+		}
+		banner.WriteString("exit\n")
+	} else {
+		for _, msg := range l {
+			fmt.Fprintf(&banner, "%v\n", msg)
+		}
+		banner.WriteByte(4)
+	}
+
+	f.Write(banner.Bytes())
+}
+
+// Default patterns of the names of the Screwdriver and user teardowns, and of the setup steps
+const (
+	defaultSDTeardownPattern   = "^sd-teardown-.+"
+	defaultUserTeardownPattern = "^(pre|post)?teardown-.+"
+	defaultSetupPattern        = "^(pre)?setup-.+"
+	// sdSetupPrefix starts the names of the setup steps of Screwdriver
+	sdSetupPrefix = "sd-setup-"
+)
+
+// Splits the steps of build into the user steps, the Screwdriver teardowns and the user teardowns
+// by their type. The setup steps come first in the user steps, right after the Screwdriver ones,
+// so they prepare the build shell before any other step runs. The steps without a type are classified by name, with the teardown
+// patterns of the build or the defaults.
+func filterTeardowns(build screwdriver.Build) ([]screwdriver.CommandDef, []screwdriver.CommandDef, []screwdriver.CommandDef, error) {
+	setupCommands := []screwdriver.CommandDef{}
 	userCommands := []screwdriver.CommandDef{}
 	sdTeardownCommands := []screwdriver.CommandDef{}
 	userTeardownCommands := []screwdriver.CommandDef{}
 
-	for _, cmd := range build.Commands {
-		isSdTeardown, _ := regexp.MatchString("^sd-teardown-.+", cmd.Name)
-		isUserTeardown, _ := regexp.MatchString("^(pre|post)?teardown-.+", cmd.Name)
+	sdPattern, userPattern, setupPattern := defaultSDTeardownPattern, defaultUserTeardownPattern, defaultSetupPattern
+	if p := build.TeardownPatterns; p != nil {
+		if p.SD != "" {
+			sdPattern = p.SD
+		}
+		if p.User != "" {
+			userPattern = p.User
+		}
+		if p.Setup != "" {
+			setupPattern = p.Setup
+		}
+	}
+	sdTeardown, err := regexp.Compile(sdPattern)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Invalid Screwdriver teardown pattern %q: %v", sdPattern, err)
+	}
+	userTeardown, err := regexp.Compile(userPattern)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Invalid user teardown pattern %q: %v", userPattern, err)
+	}
+	setup, err := regexp.Compile(setupPattern)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Invalid setup pattern %q: %v", setupPattern, err)
+	}
+
+	commands, err := expandTemplates(build.Commands, build.StepTemplates)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	commands, err = expandMatrix(commands)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, cmd := range commands {
+		stepType := cmd.Type
+		if stepType == "" {
+			switch {
+			case sdTeardown.MatchString(cmd.Name):
+				stepType = screwdriver.StepTypeSDTeardown
+			case userTeardown.MatchString(cmd.Name):
+				stepType = screwdriver.StepTypeTeardown
+			case setup.MatchString(cmd.Name):
+				stepType = screwdriver.StepTypeSetup
+			default:
+				stepType = screwdriver.StepTypeUser
+			}
+		}
+
+		if cmd.Timeout < 0 {
+			return nil, nil, nil, fmt.Errorf("Invalid timeout %d of step %q", cmd.Timeout, cmd.Name)
+		}
+		if cmd.Retries < 0 {
+			return nil, nil, nil, fmt.Errorf("Invalid retries %d of step %q", cmd.Retries, cmd.Name)
+		}
+		if cmd.Shell != "" && !filepath.IsAbs(cmd.Shell) {
+			return nil, nil, nil, fmt.Errorf("Invalid shell %q of step %q, want an absolute path", cmd.Shell, cmd.Name)
+		}
+		if cmd.Condition != "" && (stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown) {
+			return nil, nil, nil, fmt.Errorf("Teardown %q cannot have a condition", cmd.Name)
+		}
+		if err := checkScriptPath(cmd); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkInterpreter(cmd); err != nil {
+			return nil, nil, nil, err
+		}
+		if cmd.Interpreter != "" && (stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown) {
+			return nil, nil, nil, fmt.Errorf("Teardown %q cannot have an interpreter", cmd.Name)
+		}
+		if err := checkImage(cmd, stepType); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkPeerContainer(cmd, stepType); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkGate(cmd, stepType); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkPriority(cmd); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkRawOutput(cmd, stepType); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkStderr(cmd, stepType); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkTrace(cmd, stepType); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := checkStdin(cmd); err != nil {
+			return nil, nil, nil, err
+		}
+		for key := range cmd.Env {
+			if !envName.MatchString(key) {
+				return nil, nil, nil, fmt.Errorf("Invalid variable %q of step %q", key, cmd.Name)
+			}
+		}
+		switch cmd.OnFailure {
+		case "", screwdriver.OnFailureContinue, screwdriver.OnFailureStop:
+		default:
+			return nil, nil, nil, fmt.Errorf("Unknown failure policy %q of step %q", cmd.OnFailure, cmd.Name)
+		}
 
-		if isSdTeardown {
+		switch stepType {
+		case screwdriver.StepTypeSDTeardown:
 			sdTeardownCommands = append(sdTeardownCommands, cmd)
-		} else if isUserTeardown {
+		case screwdriver.StepTypeTeardown:
 			userTeardownCommands = append(userTeardownCommands, cmd)
-		} else {
+		case screwdriver.StepTypeSetup:
+			setupCommands = append(setupCommands, cmd)
+		case screwdriver.StepTypeUser:
 			userCommands = append(userCommands, cmd)
+		default:
+			return nil, nil, nil, fmt.Errorf("Unknown type %q of step %q", cmd.Type, cmd.Name)
 		}
 	}
 
-	return userCommands, sdTeardownCommands, userTeardownCommands
+	// The setup steps run after the ones of Screwdriver, which check out the source, and before
+	// the other user steps
+	n := 0
+	for n < len(userCommands) && strings.HasPrefix(userCommands[n].Name, sdSetupPrefix) {
+		n++
+	}
+	steps := append(append(userCommands[:n:n], setupCommands...), userCommands[n:]...)
+
+	return steps, sdTeardownCommands, userTeardownCommands, nil
 }
 
 // Run executes a slice of CommandDefs
-func Run(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeoutSec int, envFilepath, sourceDir string) error {
+func Run(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeoutSec int, envFilepath, sourceDir string) (err error) {
+	runStart := time.Now()
 	tmpFile := envFilepath + "_tmp"
 	exportFile := envFilepath + "_export"
+	resultsFile := envFilepath + "_results.json"
+	stepScriptDir := envFilepath + "_steps"
+	// The export file has the environment of the build, never leave it behind
+	removeEnvFiles(tmpFile, exportFile)
+	defer removeEnvFiles(tmpFile, exportFile)
+	if err := makeStepScriptDir(stepScriptDir); err != nil {
+		return InfraError{"Creating the step script directory", err}
+	}
+	// The line number of the failed command is the build's own, like its step scripts
+	lineFile := failedLinePath(stepScriptDir)
+	defer removeFailedLine(lineFile)
 
-	// Set up a single pseudo-terminal
-	c := exec.Command(shellBin)
+	// Nothing runs with tools that were tampered with
+	if err := verifyTools(); err != nil {
+		return InfraError{"Verifying the tools", err}
+	}
+	policy, err := loadCommandPolicy()
+	if err != nil {
+		return InfraError{"Loading the command policy", err}
+	}
+	failureRules, err := loadFailureRules()
+	if err != nil {
+		return InfraError{"Loading the failure rules", err}
+	}
+	summaryLines, err := failureSummaryLines()
+	if err != nil {
+		return InfraError{"Loading the failure summary settings", err}
+	}
+	matchers, err := loadProblemMatchers()
+	if err != nil {
+		return InfraError{"Loading the problem matchers", err}
+	}
+	notifications, err := loadNotifier()
+	if err != nil {
+		return InfraError{"Loading the notification targets", err}
+	}
+	toolPath, err := loadStepPath()
+	if err != nil {
+		return InfraError{"Loading the PATH of the steps", err}
+	}
+	timeoutBanner, err := loadTimeoutBanner()
+	if err != nil {
+		return InfraError{"Loading the timeout banner", err}
+	}
+	isolation, err := loadStepIsolation()
+	if err != nil {
+		return InfraError{"Loading the step isolation settings", err}
+	}
+	readOnly, err := newReadOnlySource(env, sourceDir, isolation)
+	if err != nil {
+		return InfraError{"Loading the read-only steps", err}
+	}
+	if err := readOnly.mount(); err != nil {
+		return InfraError{"Setting up the read-only source directory", err}
+	}
+	defer readOnly.Close()
+	tokens, err := newStepTokens(api, buildID)
+	if err != nil {
+		return InfraError{"Loading the step token settings", err}
+	}
+	concurrency, err := teardownConcurrency()
+	if err != nil {
+		return InfraError{"Loading the teardown settings", err}
+	}
+	extension, err := timeoutExtension()
+	if err != nil {
+		return InfraError{"Loading the timeout settings", err}
+	}
+	stepRuntime, err := newContainerRuntime()
+	if err != nil {
+		return InfraError{"Loading the container runtime", err}
+	}
+	remote, err := newRemoteHost(stepScriptDir)
+	if err != nil {
+		return InfraError{"Loading the remote host", err}
+	}
+	artifacts, err := newArtifactCollector(build.ArtifactPatterns)
+	if err != nil {
+		return InfraError{"Loading the artifact patterns", err}
+	}
+	if err := checkTestReports(build.TestReports); err != nil {
+		return InfraError{"Loading the test report patterns", err}
+	}
+	if err := checkCoverageChecks(build.Coverage); err != nil {
+		return InfraError{"Loading the coverage checks", err}
+	}
+	if err := checkSarifChecks(build.Sarif); err != nil {
+		return InfraError{"Loading the SARIF checks", err}
+	}
+	if err := checkSBOMOptions(build.SBOM); err != nil {
+		return InfraError{"Loading the SBOM options", err}
+	}
+	keys, err := newCacheKeys(build.CacheKeys)
+	if err != nil {
+		return InfraError{"Loading the cache keys", err}
+	}
+	store, err := newCacheStore()
+	if err != nil {
+		return InfraError{"Loading the cache store", err}
+	}
+	compression, err := newCacheCompression()
+	if err != nil {
+		return InfraError{"Loading the cache compression", err}
+	}
+	caches := newBuildCaches(store, compression, keys, env)
+	checkpoints, err := newCheckpointer(buildID, sourceDir, compression)
+	if err != nil {
+		return InfraError{"Loading the checkpoint store", err}
+	}
+	if checkpoints != nil && remote != nil {
+		logger.Warnf("The build is not checkpointed on the remote host")
+		checkpoints = nil
+	}
+	checkpoints.load()
+	userCommands, sdTeardownCommands, userTeardownCommands, err := filterTeardowns(build)
+	if err != nil {
+		return InfraError{"Classifying the steps", err}
+	}
+	if err := checkProblemMatchers(matchers, userCommands, userTeardownCommands, sdTeardownCommands); err != nil {
+		return InfraError{"Loading the problem matchers", err}
+	}
+	retries, err := flakyRetries()
+	if err != nil {
+		return InfraError{"Loading the flaky step settings", err}
+	}
+	userCommands = withFlakyRetries(userCommands, retries)
+	userTeardownCommands = withFlakyRetries(userTeardownCommands, retries)
+	approvalInterval, err := approvalPollInterval()
+	if err != nil {
+		return InfraError{"Loading the approval settings", err}
+	}
+	gate := approvalGate{api: api, buildID: buildID, interval: approvalInterval}
+	freeze, err := loadFreezeWindows(api, build, userCommands)
+	if err != nil {
+		return InfraError{"Loading the freeze windows", err}
+	}
+	priority, err := buildPriority()
+	if err != nil {
+		return InfraError{"Loading the process priority", err}
+	}
+	statusInterval, err := statusPollInterval()
+	if err != nil {
+		return InfraError{"Loading the build status settings", err}
+	}
+	promptLimit, err := promptTimeout()
+	if err != nil {
+		return InfraError{"Loading the prompt detection settings", err}
+	}
+	keepAlive, err := keepAliveInterval()
+	if err != nil {
+		return InfraError{"Loading the keep-alive settings", err}
+	}
+	drain, err := newDrainer(env, api, buildID)
+	if err != nil {
+		return InfraError{"Loading the drain settings", err}
+	}
+	grace, err := terminationGrace(env)
+	if err != nil {
+		return InfraError{"Loading the termination grace period", err}
+	}
+	recordTerminal, err := terminalRecording()
+	if err != nil {
+		return InfraError{"Loading the terminal recording settings", err}
+	}
+	replayCast, err := replayTerminal()
+	if err != nil {
+		return InfraError{"Loading the replay settings", err}
+	}
+	if replayCast != "" {
+		if remote != nil {
+			return InfraError{"Replaying the build", fmt.Errorf("The build cannot be replayed on the remote host %s", remote.destination)}
+		}
+		logger.Infof("Replaying the terminal recording %s, the steps do not run", replayCast)
+		userCommands = replayCommands(userCommands)
+		userTeardownCommands = replayCommands(userTeardownCommands)
+		sdTeardownCommands = replayCommands(sdTeardownCommands)
+	}
+	if remote != nil && priority != (processPriority{}) {
+		logger.Warnf("The priority of the processes is not set on the remote host")
+	}
+	retention, err := newArtifactRetention(build.ArtifactRetention, append(append([]screwdriver.CommandDef{}, userCommands...), userTeardownCommands...))
+	if err != nil {
+		return InfraError{"Loading the artifact retention classes", err}
+	}
+	uploads, err := newArtifactUploader(env, buildID, retention)
+	if err != nil {
+		return InfraError{"Loading the artifact upload settings", err}
+	}
+	if uploads != nil && remote != nil {
+		logger.Warnf("The artifacts are not uploaded during the build from the remote host")
+		uploads.Close(0)
+		uploads = nil
+	}
+	defer uploads.Close(0)
+	if remote != nil {
+		if err := remote.check(isolation, readOnly, userCommands, userTeardownCommands, sdTeardownCommands); err != nil {
+			return InfraError{"Checking the remote host", err}
+		}
+		if err := remote.makeScriptDir(); err != nil {
+			return InfraError{"Creating the step script directory on the remote host", err}
+		}
+		defer func() {
+			if err := remote.removeFiles(tmpFile, exportFile); err != nil {
+				logger.Warnf("Failed to remove the environment files on the remote host: %v", err)
+			}
+		}()
+	}
+	// The steps on a remote host keep its temporary directory
+	var tmpDirs *stepTmpDirs
+	if remote == nil {
+		if tmpDirs, err = newStepTmpDirs(stepTmpRoot(envFilepath)); err != nil {
+			return InfraError{"Creating the temporary directories of the steps", err}
+		}
+		defer tmpDirs.removeAll()
+	}
+	if isFish(shellBin) {
+		// fish runs every step and teardown, but the build shell has to be a POSIX one
+		if err := checkShellBin(shellBin, remote); err != nil {
+			return InfraError{"Checking the shell", err}
+		}
+		userCommands = withStepShell(userCommands, shellBin)
+		sdTeardownCommands = withStepShell(sdTeardownCommands, shellBin)
+		userTeardownCommands = withStepShell(userTeardownCommands, shellBin)
+		shellBin = posixShell
+	}
+	shellCaps, err := probeShell(shellBin, remote)
+	if err != nil {
+		return InfraError{"Checking the shell", err}
+	}
+	audit, err := openAuditLog(emitter)
+	if err != nil {
+		return InfraError{"Opening the audit log", err}
+	}
+	defer audit.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Sidecars observe the build and abort or pause it over the control socket until it is complete
+	sig := make(chan error, 1)
+	control, err := newControlServer(env, sig)
+	if err != nil {
+		return InfraError{"Serving the control interface", err}
+	}
+
+	// Call the webhook on step and build state changes, notify the end of the build and send the
+	// metrics, once everything else is done
+	hooks := newWebhookNotifier(buildID)
+	stats := openStatsd()
+	defer func() {
+		hooks.buildComplete(err)
+		hooks.Close(webhookFlushTimeout)
+		notifications.buildComplete(build, env, time.Since(runStart), err)
+		control.buildComplete(err)
+		health.setPhase(healthComplete)
+		reportBuildMetrics(stats, time.Since(runStart), err)
+		stats.Close()
+	}()
+	// The failure rules matching the failed step put the build failure in their class
+	classifier := newFailureClassifier(emitter, failureRules)
+	emitter = classifier
+	defer func() {
+		err = classifier.classify(err)
+	}()
+	// The summary of the failure in the build meta has the last lines of output of the failed step
+	summarizer := newFailureSummarizer(emitter, summaryLines)
+	emitter = summarizer
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := summarizer.write(err, buildSecrets(env), lookupEnv(env, "SD_META_PATH")); err != nil {
+			logger.Warnf("Failed to write the failure summary: %v", err)
+		}
+	}()
+	// The problem matchers of the steps turn their output into annotations of the source
+	problems := newProblemScanner(emitter, matchers, sourceDir)
+	emitter = problems
+	// The tests of the steps writing TAP are counted from their output
+	tap := newTAPScanner(emitter)
+	emitter = tap
+	emitter = control.emitter(emitter)
+
+	// Set up a single pseudo-terminal. The shell leads its own session & process group,
+	// and is killed when Run returns
+	c, err := isolation.command(ctx, shellBin, shellCaps.startArgs()...)
+	if replayCast != "" {
+		c, err = replayShellCmd(ctx, replayCast)
+	}
+	if err != nil {
+		return InfraError{"Cannot start shell", err}
+	}
 	c.Dir = path
-	c.Env = append(env, c.Env...)
+	shellEnv, restoreEnv := protectEnv(tokens.shellEnv(env))
+	c.Env = append(shellEnv, c.Env...)
+	if remote != nil {
+		// The shell runs on the remote host with the environment of the build, ssh with the one
+		// of the launcher
+		envFile, err := remote.writeEnvFile(tokens.shellEnv(env))
+		if err != nil {
+			return InfraError{"Sending the environment to the remote host", err}
+		}
+		c = remote.shellCommand(ctx, envFile, path, shellBin, shellCaps.startArgs()...)
+		restoreEnv = ""
+	}
 
 	f, err := pty.Start(c)
 	if err != nil {
-		return fmt.Errorf("Cannot start shell: %v", err)
+		return InfraError{"Cannot start shell", err}
+	}
+	if remote == nil {
+		if err := priority.apply(c.Process.Pid); err != nil {
+			return InfraError{"Setting the priority of the shell", err}
+		}
+	}
+	// The steps run in the terminal of the launcher in local mode, so their output fits it. The pty
+	// is not resized anymore once the build is over.
+	resized := propagateTerminalSize(ctx, launcherTerminal(), f)
+	defer func() {
+		cancel()
+		<-resized
+	}()
+
+	// The recording of the terminal is an artifact, complete once the user steps are done
+	var recorder *terminalRecorder
+	if recordTerminal {
+		if artifactsDir := lookupEnv(env, "SD_ARTIFACTS_DIR"); artifactsDir == "" {
+			logger.Warnf("The terminal is not recorded without SD_ARTIFACTS_DIR")
+		} else {
+			rows, cols, _ := pty.Getsize(f)
+			recordEnv := map[string]string{"SHELL": shellBin}
+			if term := lookupEnv(env, "TERM"); term != "" {
+				recordEnv["TERM"] = term
+			}
+			path := filepath.Join(artifactsDir, terminalRecordingFile)
+			if recorder, err = newTerminalRecorder(path, cols, rows, fmt.Sprintf("Build %d", buildID), recordEnv); err != nil {
+				logger.Warnf("Failed to record the terminal: %v", err)
+				recorder = nil
+			}
+		}
+	}
+	defer recorder.Close()
+
+	// All writes to the pty go through a single writer
+	w := newPtyWriter(f)
+	defer w.Close()
+
+	// Prints the banner of the timeout timeoutErr of the step name in the build shell, stopping it,
+	// and logs its event for the UI to show a banner of its own
+	showTimeout := func(name string, timeoutErr error) {
+		data := timeoutBanner.data(name, timeoutErr, append(append([]screwdriver.CommandDef{}, userTeardownCommands...), sdTeardownCommands...))
+		logTimeoutEvent(emitter, data.event())
+		handleBuildTimeout(w, timeoutBanner.render(data), shellCaps)
 	}
 
-	// Command to Export Env. Use tmpfile just in case export -p takes some time
-	exportEnvCmd :=
-		"tmpfile=" + tmpFile + "; exportfile=" + exportFile + "; " +
-			"export -p | grep -vi \"PS1=\" > $tmpfile && mv -f $tmpfile $exportfile; "
+	// Command to Export Env, without the secrets
+	exportEnvCmd := shellCaps.exportEnvCommand(tmpFile, exportFile, scrubbedEnvNames(env))
 
 	// Run setup commands
 	setupCommands := []string{
 		"set -e",
-		"export PATH=${PATH}:/opt/sd:/usr/sd/bin",
-		// trap ABRT(6) and EXIT, echo the last step ID and write ENV to /tmp/buildEnv
+		// no job control, so everything the steps spawn stays in the shell's process group
+		"set +m",
+		"export PATH=" + toolPath.value(),
+		trapFailedLine(lineFile),
+		// trap ABRT(6) if the shell can and EXIT, echo the last step ID and write ENV to /tmp/buildEnv
 		"finish() { " +
 			"EXITCODE=$?; " +
 			exportEnvCmd +
 			"echo $SD_STEP_ID $EXITCODE; }", //mv newfile to file
-		"trap finish ABRT EXIT;\necho ;\n",
+		"trap finish " + shellCaps.finishSignals() + ";\necho ;\n",
+	}
+	if restoreEnv != "" {
+		setupCommands = append([]string{restoreEnv}, setupCommands...)
+	}
+	if setup := shellCaps.setupCommand(); setup != "" {
+		setupCommands = append([]string{setup}, setupCommands...)
 	}
 
-	setupReader := bufio.NewReader(f)
-	if err := doRunSetupCommand(emitter, f, setupReader, setupCommands); err != nil {
+	// The setup phase of the log folds the setup of the build shell and the setup steps
+	setupPhase := beginPhase(emitter, screwdriver.FoldPhaseSetup)
+	defer setupPhase.end()
+	setupStart := time.Now()
+	setupReader := bufio.NewReader(recorder.reader(f))
+	if err := doRunSetupCommand(emitter, w, setupReader, setupCommands); err != nil {
 		return err
 	}
+	// The directory of the shell, which the audit log records, is only known on this host
+	shellDir := func() string {
+		if remote != nil {
+			return commandDir(path)
+		}
+		return processDir(c.Process.Pid, commandDir(path))
+	}
+	for _, setupCmd := range setupCommands {
+		audit.record(auditSetup, "", setupCmd, shellDir(), setupStart, ExitOk)
+	}
 
 	var firstError error
 	var code int
 	var stepExitCode int
 	var cmdErr error
+	// stopped is the step the launcher stopped, if any, whose processes are killed at the end of the
+	// termination grace period
+	var stopped *stoppedStep
 
 	timeout := time.Duration(timeoutSec) * time.Second
 	invokeTimeout := make(chan error, 1)
-	sig := make(chan error, 1)
 
 	// add a SIGTERM signal handler
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	// start build timeout timer
-	go initBuildTimeout(timeout, invokeTimeout)
-	go notifySignal(sigs, sig)
+	// start build timeout timer, which SIGUSR1 extends if enabled
+	timer := newBuildTimer(ctx, timeout, invokeTimeout)
+	if extension > 0 {
+		extendOnSignal(ctx, timer, extension)
+	}
+	// a SIGTERM or notice of the node going away drains the build if enabled
+	go drain.handleSignals(ctx, sigs, sig)
+	drain.watch(ctx, sig)
+	// stop the user steps like an abort once the API has the build aborted or failed
+	reconcileCtx, stopReconcile := context.WithCancel(ctx)
+	defer stopReconcile()
+	reconcileStatus(reconcileCtx, api, buildID, statusInterval, sig)
+
+	// Record how each step went for the build summary artifact and the build timing stats
+	summary := newBuildSummary(runStart, build.Stats.QueueEntertime)
+	defer func() {
+		summary.finish(time.Now())
+		if artifactsDir := lookupEnv(env, "SD_ARTIFACTS_DIR"); artifactsDir != "" {
+			if err := summary.write(artifactsDir); err != nil {
+				logger.Warnf("Failed to write the build summary: %v", err)
+			}
+		}
+		if err := api.UpdateBuildTimings(buildID, summary.timings()); err != nil {
+			logger.Warnf("Failed to update the build timings: %v", err)
+		}
+	}()
+	// Record how each user step went for the teardowns
+	results := &stepResults{}
+	// Record whether the steps that can be retried passed on retry
+	flakiness := newFlakinessTracker()
+	// Record which step wrote each artifact for the artifacts manifest
+	artifactFiles := newArtifactTracker(lookupEnv(env, "SD_ARTIFACTS_DIR"), retention)
+	// Send where the time of each step went without waiting for the API
+	annotator := newStepAnnotator(api, buildID)
+	defer annotator.Close(annotationFlushTimeout)
+
+	stopStep := func(name string, teardown bool, start time.Time, code int, stepErr error, details screwdriver.StepStopDetails, timings screwdriver.StepTimings) error {
+		details.Reason, details.Message = stopReason(code, classifier.classify(stepErr), details)
+		foldStepEnd(emitter, name, start)
+		summary.add(name, teardown, start, code, details)
+		summarizer.stop(name, code)
+		hooks.stepStop(name, code, stepErr)
+		control.stepStop(name, code, stepErr)
+		health.stepStop(name)
+		reportStepMetrics(stats, name, teardown, time.Since(start), code, stepErr, details.PassedOnRetry)
+		if !details.Skipped && !details.Restored {
+			details.Tests = tap.stop(name)
+		}
+		updateStart := time.Now()
+		if err := api.UpdateStepStop(buildID, name, code, details); err != nil {
+			return err
+		}
+		timings.StepStopUpdateMs = millis(time.Since(updateStart))
+		annotator.add(name, timings)
+		annotations, dropped := problems.take(name)
+		if dropped > 0 {
+			logger.Warnf("Step %q has %d more annotations than the limit of %d, dropping them", name, dropped, maxStepAnnotations)
+		}
+		annotator.addProblems(name, annotations)
+		return nil
+	}
 
-	userCommands, sdTeardownCommands, userTeardownCommands := filterTeardowns(build)
+	// The containers of the steps with an image, in case one outlives its step, and the build pod
+	// if steps run in its peer containers
+	containers := &stepContainers{runtime: stepRuntime}
+	defer containers.remove()
+	if usesPeerContainers(userCommands) {
+		if containers.pod, err = newKubernetesPod(); err != nil {
+			return InfraError{"Finding the build pod", err}
+		}
+	}
 
-	for _, cmd := range userCommands {
+	// The steps and teardowns from the checkout of the source on get the cache keys, which hash its
+	// files, and the caches with paths are restored then if restore
+	var cacheEnv map[string]string
+	renderCacheKeys := func(restore bool) {
+		if cacheEnv != nil || len(keys) == 0 {
+			return
+		}
+		cacheEnv = map[string]string{}
+		if remote != nil {
+			logger.Warnf("The cache keys are not rendered with the files of the remote host")
+			return
+		}
+		cacheEnv = keys.render(sourceDir, env)
+		if restore && caches != nil {
+			caches.restore(sourceDir, cacheEnv)
+		}
+	}
+	cacheKeysAt := cacheKeysStep(userCommands)
+
+	// Runs commands, ending with ;, in the build shell between the steps
+	runInShell := func(commands string) error {
+		guid := uuid.Must(uuid.NewRandom()).String()
+		_, _, err := doRunCommand(guid, "export SD_STEP_ID="+guid+" ;set +e; "+commands+" sd_code=$?; set -e ;echo ;echo "+guid+" $sd_code\n", quietEmitter{emitter}, w, bufio.NewReader(recorder.reader(f)))
+		return err
+	}
+	// The checkpoint of the build is saved after each user step that did not fail it, and the
+	// build resumes from it if it runs again
+	checkpointFile := envFilepath + "_checkpoint"
+	saveCheckpoint := func(name string) {
+		if firstError != nil || strings.HasPrefix(name, sdSetupPrefix) {
+			return
+		}
+		checkpoints.save(name, checkpointFile, func(file string) error {
+			return runInShell(shellCaps.exportEnvCommand(tmpFile, file, scrubbedEnvNames(env)))
+		})
+	}
+	sourceEnv := func(file string) error {
+		return runInShell(". " + file + ";")
+	}
+	// Whether the user steps stopped at a gate step, which leaves the shell idle
+	stoppedAtGate := false
+
+	health.setPhase(healthSteps)
+	for i, cmd := range userCommands {
 		// Start set up & user steps if previous steps succeed
 		if firstError != nil {
 			break
 		}
+		// A build whose node goes away starts no other step
+		if reason := drain.preempted(); reason != "" {
+			logger.Infof("Not running the steps left, the node of the build is going away")
+			firstError, code = Preempted{Reason: reason}, ExitAborted
+			break
+		}
+		// A paused build waits before its next step
+		if pauseCode, pauseErr := control.waitResumed(invokeTimeout, sig); pauseErr != nil {
+			logger.Infof("%v while the build was paused", pauseErr)
+			firstError, code = pauseErr, pauseCode
+			break
+		}
+		if i == cacheKeysAt {
+			renderCacheKeys(true)
+		}
+		cmd = withCacheEnv(cmd, cacheEnv)
+		if !strings.HasPrefix(cmd.Name, sdSetupPrefix) {
+			setupPhase.end()
+		}
 
+		var timings screwdriver.StepTimings
+		stepStart := time.Now()
 		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
-			return fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+			return InfraError{fmt.Sprintf("Updating step start %q", cmd.Name), err}
+		}
+		timings.StepStartUpdateMs = millis(time.Since(stepStart))
+		hooks.stepStart(cmd.Name)
+		control.stepStart(cmd.Name)
+		health.stepStart(cmd.Name)
+		uploads.stepStart(cmd.Name)
+		foldStepBegin(emitter, cmd.Name)
+
+		// A user step that passed before the build was re-queued is not run again
+		if !strings.HasPrefix(cmd.Name, sdSetupPrefix) && checkpoints.restores(cmd.Name, checkpointFile, sourceEnv) {
+			emitter.StartCmd(cmd)
+			launcherf(emitter, "Not running the step again, it passed before the build was re-queued\n")
+			code = ExitOk
+			if err := stopStep(cmd.Name, false, stepStart, code, nil, screwdriver.StepStopDetails{Restored: true}, timings); err != nil {
+				return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
+			}
+			results.add(cmd.Name, stepStart, code, 0, cmd.Cmd)
+			continue
+		}
+
+		// A step whose script cannot be run fails without running
+		cmd, scriptCode, scriptErr := resolveScript(cmd, sourceDir)
+		var stdinPath string
+		if scriptErr == nil {
+			stdinPath, scriptCode, scriptErr = resolveStdinFile(cmd, sourceDir)
+		}
+		if scriptErr != nil {
+			emitter.StartCmd(cmd)
+			launcherf(emitter, "%v\n", scriptErr)
+			code = scriptCode
+			stepErr := StepFailure{Step: cmd.Name, Code: code}
+			details := screwdriver.StepStopDetails{AllowedFailure: cmd.AllowFailure}
+			if !cmd.AllowFailure {
+				firstError = stepErr
+			}
+			if err := stopStep(cmd.Name, false, stepStart, code, stepErr, details, timings); err != nil {
+				return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
+			}
+			results.add(cmd.Name, stepStart, code, 0, "")
+			if cmd.AllowFailure {
+				code = ExitOk
+			}
+			saveCheckpoint(cmd.Name)
+			continue
+		}
+
+		// A step blocked by the command policy fails without running
+		violations, blocked := policy.evaluate(cmd, env)
+		if blocked != nil {
+			emitter.StartCmd(cmd)
+			reportViolations(emitter, cmd.Name, violations)
+			firstError = *blocked
+			code = ExitBlocked
+			if err := stopStep(cmd.Name, false, stepStart, code, firstError, screwdriver.StepStopDetails{Policy: violations}, timings); err != nil {
+				return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
+			}
+			results.add(cmd.Name, stepStart, code, 0, cmd.Cmd)
+			continue
+		}
+
+		// A deployment step in a freeze window fails without running
+		if frozen := freeze.check(cmd, stepStart); frozen != nil {
+			emitter.StartCmd(cmd)
+			launcherf(emitter, "%v\n", *frozen)
+			firstError = *frozen
+			code = ExitBlocked
+			if err := stopStep(cmd.Name, false, stepStart, code, firstError, screwdriver.StepStopDetails{}, timings); err != nil {
+				return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
+			}
+			results.add(cmd.Name, stepStart, code, 0, cmd.Cmd)
+			continue
+		}
+
+		// A gate step waits for its approval without running
+		if cmd.Gate != nil {
+			emitter.StartCmd(cmd)
+			reportViolations(emitter, cmd.Name, violations)
+			var stepErr error
+			code, stepErr = gate.wait(cmd, emitter, invokeTimeout, sig)
+			if errors.Is(stepErr, ErrInfra) {
+				return stepErr
+			}
+			if stepErr != nil {
+				firstError = stepErr
+				stoppedAtGate = true
+			}
+			if err := stopStep(cmd.Name, false, stepStart, code, stepErr, screwdriver.StepStopDetails{Policy: violations}, timings); err != nil {
+				return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
+			}
+			results.add(cmd.Name, stepStart, code, 0, "")
+			saveCheckpoint(cmd.Name)
+			continue
+		}
+
+		// The source directory stays read-only until the step is over
+		readOnlyStep, err := readOnly.protect(cmd.Name)
+		if err != nil {
+			return InfraError{"Protecting the source directory", err}
 		}
 
 		// Create step script file
-		stepFilePath := "/tmp/step.sh"
-		if err := createShFile(stepFilePath, cmd, shellBin); err != nil {
-			return fmt.Errorf("Writing to step script file: %v", err)
+		stepFilePath := stepScriptPath(stepScriptDir, i, cmd.Name)
+		writeStart := time.Now()
+		// The user steps get their own token and the setup steps of Screwdriver the build token
+		var token string
+		if tokens != nil {
+			token = lookupEnv(env, "SD_TOKEN")
+			if !strings.HasPrefix(cmd.Name, sdSetupPrefix) {
+				if token, err = tokens.mint(cmd.Name); err != nil {
+					return InfraError{"Getting the step token", err}
+				}
+			}
+		}
+		stepTmpDir, err := tmpDirs.create(cmd)
+		if err != nil {
+			return InfraError{"Creating the temporary directory of the step", err}
 		}
+		if err := createShFile(stepFilePath, cmd, stepShell(cmd, shellBin), token); err != nil {
+			return InfraError{"Writing to step script file", err}
+		}
+		if remote != nil {
+			if err := remote.copyStepScript(stepFilePath, cmd); err != nil {
+				return InfraError{"Copying the step script to the remote host", err}
+			}
+		} else {
+			if err := chownStepFile(stepFilePath, cmd); err != nil {
+				return InfraError{fmt.Sprintf("Giving the step script to user %q", cmd.User), err}
+			}
+			if cmd.Interpreter != "" {
+				if err := chownStepFile(interpreterScriptPath(stepFilePath), cmd); err != nil {
+					return InfraError{fmt.Sprintf("Giving the step script to user %q", cmd.User), err}
+				}
+			}
+		}
+		// The standard input of the step is a file instead of the pty
+		var streams stepStreams
+		if streams.in, err = writeStdin(cmd, stdinPath, stdinTextPath(stepScriptDir, i, cmd.Name)); err != nil {
+			return InfraError{fmt.Sprintf("Writing the standard input of step %q", cmd.Name), err}
+		}
+		// The raw output of the step goes to a file of the artifacts instead of the pty
+		if cmd.RawOutput {
+			streams.out = rawOutputPath(lookupEnv(env, "SD_ARTIFACTS_DIR"), stepScriptDir, i, cmd.Name)
+			if err := createRawOutput(streams.out); err != nil {
+				return InfraError{fmt.Sprintf("Creating the raw output file of step %q", cmd.Name), err}
+			}
+		}
+		// The standard error of the step goes to a pipe the launcher logs it from
+		if cmd.Stderr != "" {
+			streams.err = stderrPipePath(stepScriptDir, i, cmd.Name)
+		}
+		removeFailedLine(lineFile)
+		timings.ScriptWriteMs = millis(time.Since(writeStart))
 
 		// Generate guid v4 for the step
 		guid := uuid.Must(uuid.NewRandom()).String()
+		logger.Debugf("pty: running step %q with id %s", cmd.Name, guid)
 
 		runErr := make(chan error, 1)
 		eCode := make(chan int, 1)
 
 		// Set current running step in emitter
 		emitter.StartCmd(cmd)
-		fmt.Fprintf(emitter, "$ %s\n", cmd.Cmd)
+		recorder.marker(cmd.Name)
+		echoCommand(emitter, cmd)
+		reportViolations(emitter, cmd.Name, violations)
+		if readOnlyStep {
+			launcherf(emitter, "The source directory %s is read-only for this step\n", sourceDir)
+		}
+		var stderr *stepStderr
+		if streams.err != "" {
+			if stderr, err = captureStderr(streams.err, emitter); err != nil {
+				return InfraError{fmt.Sprintf("Capturing the standard error of step %q", cmd.Name), err}
+			}
+		}
 
-		fReader := bufio.NewReader(f)
+		// Measures the round trip from handing the step to the shell until its first output
+		prompts := newPromptWatcher(recorder.reader(f))
+		ptyReader := &firstReadReader{r: prompts}
+		fReader := bufio.NewReader(ptyReader)
 
+		// The processes of the step are only seen reading the pty on this host, outside a container
+		waiting := make(chan error, 1)
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		if remote == nil && cmd.Image == "" && cmd.Container == "" {
+			prompts.watch(watchCtx, c.Process.Pid, promptLimit, waiting)
+		}
+		// The output of the step and what the launcher tells about it until it is done
+		stepOut := newKeepAliveEmitter(emitter)
+		stepOut.run(watchCtx, stepStart, keepAlive)
+		// The output of the step shows the build makes progress, unlike the keep-alive lines
+		stepEmitter := traceOutput(cmd, health.emitter(stepOut), emitter)
+
+		// The steps run in the shell's process group
+		tracker := startUsageTracker(c.Process.Pid)
+		stepDir := shellDir()
+
+		// A step with a condition only runs if the condition succeeds in the build shell
+		var skipped bool
+		var retries int
+		ptyStart := time.Now()
 		go func() {
-			runCode, rcErr := doRunCommand(guid, stepFilePath, emitter, f, fReader)
+			if cmd.Condition != "" {
+				met, err := doRunCondition(guid, cmd.Condition, stepEmitter, w, fReader)
+				if err != nil {
+					eCode <- ExitUnknown
+					runErr <- err
+					return
+				}
+				if !met {
+					skipped = true
+					eCode <- ExitOk
+					runErr <- nil
+					return
+				}
+			}
+			runCode, runRetries, rcErr := doRunCommand(guid, stepCommand(guid, stepFilePath, streams, cmd, shellBin, stepTmpDir, containers), stepEmitter, w, fReader)
+			retries = runRetries
 			// exit code & errors from doRunCommand
 			eCode <- runCode
 			runErr <- rcErr
 		}()
 
+		var stepTimer *time.Timer
+		var stepTimeout <-chan time.Time
+		if cmd.Timeout > 0 {
+			stepTimer = time.NewTimer(time.Duration(cmd.Timeout) * time.Second)
+			stepTimeout = stepTimer.C
+		}
+
+		details := screwdriver.StepStopDetails{Policy: violations}
+		var stepErr error
+		stepDone := false
 		select {
 		case cmdErr = <-runErr:
+			stepDone = true
+			stepErr = withStep(cmdErr, cmd.Name)
+			code = <-eCode
+			if retries > 0 {
+				details.Attempts, details.PassedOnRetry = retries+1, code == ExitOk
+			}
+			switch {
+			case details.PassedOnRetry:
+				launcherf(stepOut, "The step passed on attempt %d of %d, it is flaky\n", details.Attempts, cmd.Retries+1)
+			case skipped:
+				details.Skipped = true
+				launcherf(stepOut, "Skipping the step, its condition failed\n")
+			case cmd.AllowFailure && errors.Is(stepErr, ErrStepFailed) && !errors.Is(stepErr, ErrInfra):
+				details.AllowedFailure = true
+				launcherf(stepOut, "The step failed with exit code %d, which does not fail the build\n", code)
+			case firstError == nil:
+				firstError = stepErr
+			}
+		case <-stepTimeout:
+			stepErr = StepTimeout{cmd.Name, time.Duration(cmd.Timeout) * time.Second}
+			showTimeout(cmd.Name, stepErr)
 			if firstError == nil {
-				firstError = cmdErr
+				firstError = stepErr
+				code = ExitTimeout
+				details.Signal = signalName(syscall.SIGTERM)
 			}
-			code = <-eCode
+			stopped = stopStepProcesses(c, grace)
+		case waitErr := <-waiting:
+			stepErr = withStep(waitErr, cmd.Name)
+			if firstError == nil {
+				firstError = stepErr
+				code = ExitTimeout
+				details.Signal = signalName(syscall.SIGTERM)
+			}
+			stopped = stopStepProcesses(c, grace)
 		case buildTimeout := <-invokeTimeout:
-			handleBuildTimeout(f, buildTimeout)
+			stepErr = withStep(buildTimeout, cmd.Name)
+			showTimeout(cmd.Name, buildTimeout)
 			if firstError == nil {
-				firstError = buildTimeout
-				code = 3
+				firstError = stepErr
+				code = ExitTimeout
+				details.Signal = signalName(syscall.SIGTERM)
 			}
-			_ = c.Process.Signal(syscall.SIGABRT)
-			terminateSleep(shellBin, sourceDir, true) // kill all running sleep
+			stopped = stopStepProcesses(c, grace)
 
 		case stepAbort := <-sig:
-			f.Write([]byte{4})
+			stepErr = withStep(stepAbort, cmd.Name)
+			w.Write([]byte{4})
 			if firstError == nil {
-				firstError = stepAbort
-				code = 1
+				firstError = stepErr
+				code = ExitAborted
+				details.Signal = signalName(syscall.SIGTERM)
+			}
+			stopped = stopStepProcesses(c, drain.stepGrace(grace))
+		}
+		if !stepDone {
+			// Nothing else writes to the emitter until the step is done with it
+			stopped.wait(f, runErr)
+		}
+		stopWatching()
+		stepEmitter.close()
+		stepOut.stop()
+		if n := stderr.stop(); n > 0 && cmd.Stderr == stderrFail && stepErr == nil && !skipped {
+			stepErr, code = WroteStderr{cmd.Name, n}, ExitStderr
+			if cmd.AllowFailure {
+				details.AllowedFailure = true
+				launcherf(emitter, "%v, which does not fail the build\n", stepErr)
+			} else {
+				launcherf(emitter, "%v\n", stepErr)
+				if firstError == nil {
+					firstError = stepErr
+				}
 			}
-			_ = c.Process.Signal(syscall.SIGABRT)
-			terminateSleep(shellBin, sourceDir, false) // kill all running sleep other than sleep $SD_TERMINATION_GRACE_PERIOD_SECS
 		}
+		// Told in the log rather than on the pty, where the program waiting for input would read it
+		if errors.As(stepErr, new(WaitingForInput)) {
+			launcherf(emitter, "\n%v, the step was stopped\n", stepErr)
+		}
+
+		if stepTimer != nil {
+			stepTimer.Stop()
+		}
+		if streams.out != "" && !skipped {
+			reportRawOutput(emitter, streams.out)
+		}
+		details.Usage = tracker.Stop()
+		details.TmpDirBytes = tmpDirs.remove(stepTmpDir)
+		if readOnlyStep {
+			if err := readOnly.release(); err != nil {
+				return InfraError{"Unprotecting the source directory", err}
+			}
+		}
+		audit.recordStep(auditStep, cmd, stepDir, stepStart, code)
+		var lineNumber int
+		// The failed line of a step with an echo is not told, which could show its command
+		if code != ExitOk && cmd.Interpreter == "" && cmd.Image == "" && cmd.Container == "" && cmd.Echo == nil {
+			header := strings.Count(stepScriptHeader(cmd, stepShell(cmd, shellBin), token), "\n")
+			lineNumber = failedLineNumber(lineFile, header)
+		}
+		timings.PtyRoundTripMs = millis(ptyReader.since(ptyStart))
 
-		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil {
-			return fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+		if err := stopStep(cmd.Name, false, stepStart, code, stepErr, details, timings); err != nil {
+			return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
 		}
+		results.add(cmd.Name, stepStart, code, lineNumber, cmd.Cmd)
+		flakiness.add(cmd, details)
+		artifactFiles.scan(cmd.Name)
+		uploads.stepDone()
+		if details.AllowedFailure {
+			// The teardowns only see the exit code of a step that failed the build
+			code = ExitOk
+		}
+		saveCheckpoint(cmd.Name)
+	}
+	// The teardowns run whatever the status of the build
+	stopReconcile()
+	if err := recorder.Close(); err != nil {
+		logger.Warnf("Failed to record the terminal: %v", err)
 	}
 
 	stepExitCode = code
+	if err := results.write(resultsFile); err != nil {
+		logger.Warnf("Failed to write the step results: %v", err)
+		resultsFile = ""
+	} else if remote != nil {
+		if err := remote.copyFile(resultsFile, ""); err != nil {
+			logger.Warnf("Failed to copy the step results to the remote host: %v", err)
+			resultsFile = ""
+		}
+	}
+
+	// Collect the artifacts whether the steps succeeded or not, the Screwdriver teardowns upload them
+	if artifacts != nil && remote != nil {
+		logger.Warnf("The artifacts are not collected from the remote host")
+	} else if artifacts != nil {
+		manifest, err := artifacts.collect(sourceDir, lookupEnv(env, "SD_ARTIFACTS_DIR"))
+		if err != nil {
+			logger.Warnf("Failed to collect the artifacts: %v", err)
+		}
+		collected, skipped := manifest.counts()
+		logger.Infof("Collected %d artifacts of %d bytes, skipped %d", collected, manifest.TotalBytes, skipped)
+		artifactFiles.scan("")
+	}
+
+	// Read the test and coverage reports whether the steps succeeded or not, a step may have
+	// masked failed tests
+	var reportsErr error
+	tests := testResults{Reports: []string{}, Failures: []testFailure{}}
+	if build.TestReports != nil && len(build.TestReports.Patterns) > 0 {
+		if remote != nil {
+			logger.Warnf("The test reports are not read from the remote host")
+		} else if reports, err := readTestReports(sourceDir, build.TestReports.Patterns); err != nil {
+			logger.Warnf("Failed to read the test reports: %v", err)
+		} else if len(reports.Reports) == 0 {
+			logger.Warnf("No test reports matched %v", build.TestReports.Patterns)
+		} else {
+			logger.Infof("Read %d test reports: %d tests passed, %d failed, %d skipped", len(reports.Reports), reports.Passed, reports.Failed, reports.Skipped)
+			tests = reports
+		}
+	}
+	for _, step := range tap.steps() {
+		logger.Infof("Step %q wrote TAP: %d tests passed, %d failed, %d skipped, %d to do", step.step, step.tests.Passed, step.tests.Failed, step.tests.Skipped, step.tests.Todo)
+		tests.addTAP(step.step, step.tests)
+	}
+	if len(tests.Reports) > 0 || len(tests.Steps) > 0 {
+		if err := tests.write(lookupEnv(env, "SD_ARTIFACTS_DIR"), lookupEnv(env, "SD_META_PATH")); err != nil {
+			logger.Warnf("Failed to write the test results: %v", err)
+		}
+		artifactFiles.scan("")
+		if build.TestReports != nil && build.TestReports.FailBuild && tests.Failed > 0 {
+			reportsErr = TestFailures{Failed: tests.Failed, Reports: len(tests.Reports) + len(tests.Steps)}
+		}
+	}
+	if build.Coverage != nil && len(build.Coverage.Patterns) > 0 {
+		if remote != nil {
+			logger.Warnf("The coverage reports are not read from the remote host")
+		} else if err := checkCoverageReports(api, build, sourceDir, lookupEnv(env, "SD_META_PATH")); err != nil && reportsErr == nil {
+			reportsErr = err
+		}
+	}
+	// The scanners of the steps write SARIF files to the artifacts directory
+	if remote != nil {
+		if build.Sarif != nil {
+			logger.Warnf("The SARIF files are not read from the remote host")
+		}
+	} else if err := checkSarifFiles(api, buildID, build.Sarif, lookupEnv(env, "SD_ARTIFACTS_DIR"), sourceDir); err != nil && reportsErr == nil {
+		reportsErr = err
+	}
 
-	teardownCommands := append(userTeardownCommands, sdTeardownCommands...)
+	// The artifacts the steps and the launcher wrote are uploaded before the teardowns, which
+	// upload the rest
+	uploads.stepDone()
+	uploads.Close(artifactUploadFlushTimeout)
 
-	for index, cmd := range teardownCommands {
-		if index == 0 && firstError == nil {
-			// Exit shell only if previous user steps ran successfully
-			f.Write([]byte{4})
+	if firstError == nil {
+		renderCacheKeys(false)
+		if caches != nil && remote == nil {
+			caches.save(sourceDir, cacheEnv)
+		}
+	}
+	var teardownCommands []screwdriver.CommandDef
+	for _, cmd := range append(userTeardownCommands, sdTeardownCommands...) {
+		teardownCommands = append(teardownCommands, withCacheEnv(cmd, cacheEnv))
+	}
+	// A user teardown only stops the other user teardowns, the Screwdriver ones always run
+	kindEnd := func(index int) int {
+		if index < len(userTeardownCommands) {
+			return len(userTeardownCommands)
 		}
+		return len(teardownCommands)
+	}
 
-		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
-			return fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+	// The teardowns of a parallel group run their commands at the same time, but report to the
+	// API, emit their output and update the shared state one at a time
+	var mu sync.Mutex
+	locked := func(f func() error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return f()
+	}
+
+	// Runs the teardown at index with SD_STEP_EXIT_CODE set to exitCode, next being the index of
+	// the teardown after its group, returning its exit code and error
+	runTeardown := func(index, next int, cmd screwdriver.CommandDef, out *teardownOutput, exitCode int) (int, error, error) {
+		cmd, scriptCode, scriptErr := resolveScript(cmd, sourceDir)
+		var (
+			timings           screwdriver.StepTimings
+			stepStart         time.Time
+			violations        []screwdriver.PolicyViolation
+			blocked           *Blocked
+			teardownIsolation stepIsolation
+			readOnlyStep      bool
+			token             string
+		)
+		err := locked(func() error {
+			stepStart = time.Now()
+			if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
+				return InfraError{fmt.Sprintf("Updating step start %q", cmd.Name), err}
+			}
+			timings.StepStartUpdateMs = millis(time.Since(stepStart))
+			hooks.stepStart(cmd.Name)
+			control.stepStart(cmd.Name)
+			health.stepStart(cmd.Name)
+			// The output of a teardown run in parallel is logged once it is over, and its fold then
+			if !out.buffered {
+				foldStepBegin(emitter, cmd.Name)
+			}
+			if scriptErr != nil {
+				out.StartCmd(cmd)
+				launcherf(out, "%v\n", scriptErr)
+				return nil
+			}
+
+			// The policy applies to the user teardowns, not to the ones of Screwdriver
+			if index < len(userTeardownCommands) {
+				violations, blocked = policy.evaluate(cmd, env)
+				out.StartCmd(cmd)
+				reportViolations(out, cmd.Name, violations)
+			}
+			if blocked != nil {
+				return nil
+			}
+
+			if index < len(userTeardownCommands) {
+				teardownIsolation = isolation
+				var err error
+				if readOnlyStep, err = readOnly.protect(cmd.Name); err != nil {
+					return InfraError{"Protecting the source directory", err}
+				}
+				if readOnlyStep {
+					launcherf(out, "The source directory %s is read-only for this step\n", sourceDir)
+				}
+			}
+			// The user teardowns get their own token and the Screwdriver ones the build token
+			if tokens != nil {
+				token = lookupEnv(env, "SD_TOKEN")
+				if index < len(userTeardownCommands) {
+					var err error
+					if token, err = tokens.mint(cmd.Name); err != nil {
+						return InfraError{"Getting the step token", err}
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return ExitUnknown, nil, err
 		}
 
-		code, cmdErr = doRunTeardownCommand(cmd, emitter, shellBin, exportFile, sourceDir, stepExitCode)
+		var code int
+		var cmdErr error
+		var usage *screwdriver.ResourceUsage
+		var attempts int
+		var tmpDirBytes int64
+		switch {
+		case scriptErr != nil:
+			code, cmdErr = scriptCode, StepFailure{Step: cmd.Name, Code: scriptCode}
+		case blocked != nil:
+			code, cmdErr = ExitBlocked, *blocked
+		default:
+			tmpDir, err := tmpDirs.create(cmd)
+			if err != nil {
+				return ExitUnknown, nil, InfraError{"Creating the temporary directory of the step", err}
+			}
+			for attempts = 1; ; attempts++ {
+				code, usage, cmdErr = doRunTeardownCommand(ctx, cmd, out, remote, shellBin, exportFile, resultsFile, sourceDir, exitCode, teardownIsolation, token, tmpDir, toolPath, priority.forStep(cmd))
+				if !errors.Is(cmdErr, ErrStepFailed) || attempts > cmd.Retries || ctx.Err() != nil {
+					break
+				}
+				launcherf(out, "Exit code %d, retrying (%d of %d)\n", code, attempts, cmd.Retries)
+			}
+			tmpDirBytes = tmpDirs.remove(tmpDir)
+		}
+		allowedFailure := cmd.AllowFailure && errors.Is(cmdErr, ErrStepFailed) && !errors.Is(cmdErr, ErrInfra)
+
+		err = locked(func() error {
+			if readOnlyStep {
+				if err := readOnly.release(); err != nil {
+					return InfraError{"Unprotecting the source directory", err}
+				}
+			}
+			if blocked == nil && scriptErr == nil {
+				audit.recordStep(auditTeardown, cmd, commandDir(sourceDir), stepStart, code)
+			}
+			if index < len(userTeardownCommands) {
+				artifactFiles.scan(cmd.Name)
+			}
 
-		if code != ExitOk {
-			stepExitCode = code
+			details := screwdriver.StepStopDetails{Usage: usage, Policy: violations, AllowedFailure: allowedFailure, TmpDirBytes: tmpDirBytes}
+			var failure StepFailure
+			if errors.As(cmdErr, &failure) && failure.Signal != 0 {
+				details.Signal = signalName(failure.Signal)
+			}
+			if attempts > 1 {
+				details.Attempts, details.PassedOnRetry = attempts, cmdErr == nil
+			}
+			if details.PassedOnRetry {
+				launcherf(out, "The step passed on attempt %d of %d, it is flaky\n", attempts, cmd.Retries+1)
+			} else if allowedFailure {
+				launcherf(out, "The step failed with exit code %d, which does not fail the build\n", code)
+			} else if cmdErr != nil && cmd.OnFailure == screwdriver.OnFailureStop && next < kindEnd(index) {
+				launcherf(out, "Skipping %d remaining teardowns\n", kindEnd(index)-next)
+			}
+			if out.buffered {
+				foldStepBegin(emitter, cmd.Name)
+			}
+			out.flush()
+
+			if err := stopStep(cmd.Name, true, stepStart, code, cmdErr, details, timings); err != nil {
+				return InfraError{fmt.Sprintf("Updating step stop %q", cmd.Name), err}
+			}
+			flakiness.add(cmd, details)
+			return nil
+		})
+		if allowedFailure {
+			// Reported as it is, but neither the build nor the next teardowns see it
+			return ExitOk, nil, err
+		}
+		return code, cmdErr, err
+	}
+
+	// The SBOM, the manifest of the artifacts and the flakiness of the steps are written once the
+	// user teardowns are done, before the Screwdriver teardowns upload the artifacts
+	var manifestOnce sync.Once
+	writeArtifactsManifest := func() {
+		manifestOnce.Do(func() {
+			if err := flakiness.write(api, build, lookupEnv(env, "SD_META_PATH")); err != nil {
+				logger.Warnf("Failed to write the flakiness of the steps: %v", err)
+			}
+			if build.SBOM != nil && remote != nil {
+				logger.Warnf("The SBOM of the remote host is not written")
+			} else if build.SBOM != nil {
+				summary, err := writeSBOM(build.SBOM, build, env, sourceDir, lookupEnv(env, "SD_ARTIFACTS_DIR"), lookupEnv(env, "SD_META_PATH"))
+				if err != nil {
+					logger.Warnf("Failed to write the SBOM: %v", err)
+				} else {
+					logger.Infof("Wrote the SBOM of %d packages, %d toolchains and %d Git repositories", summary.Packages, len(summary.Toolchains), len(summary.Repositories))
+				}
+				artifactFiles.scan("")
+			}
+			if artifactFiles == nil {
+				return
+			}
+			entries, err := artifactFiles.writeManifest(lookupEnv(env, "SD_META_PATH"))
+			if err != nil {
+				logger.Warnf("Failed to write the artifacts manifest: %v", err)
+				return
+			}
+			logger.Infof("Wrote the manifest of %d artifacts", len(entries))
+		})
+	}
+
+	setupPhase.end()
+	health.setPhase(healthTeardowns)
+	teardownPhase := beginPhase(emitter, screwdriver.FoldPhaseTeardown)
+	defer teardownPhase.end()
+	var teardownErrors []error
+	skipUntil := 0 // the teardowns before skipUntil are skipped after a teardown stopped them
+	for index := 0; index < len(teardownCommands); {
+		if index < skipUntil {
+			index++
+			continue
+		}
+		if index >= len(userTeardownCommands) {
+			writeArtifactsManifest()
+		}
+		if index == 0 && (firstError == nil || errors.Is(firstError, ErrBlocked) || errors.Is(firstError, ErrFrozen) || stoppedAtGate) {
+			// Exit shell only if previous user steps ran successfully, or were blocked, frozen or
+			// stopped at a gate without running
+			w.Write([]byte{4})
 		}
 
-		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil {
-			return fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+		next := parallelGroupEnd(teardownCommands, index, len(userTeardownCommands), concurrency, readOnly)
+		codes := make([]int, next-index)
+		cmdErrs := make([]error, next-index)
+		errs := make([]error, next-index)
+		if next-index == 1 {
+			out := &teardownOutput{emitter: health.emitter(emitter)}
+			codes[0], cmdErrs[0], errs[0] = runTeardown(index, next, teardownCommands[index], out, stepExitCode)
+		} else {
+			logger.Debugf("Running teardowns %d to %d in parallel", index, next-1)
+			var wg sync.WaitGroup
+			slots := make(chan struct{}, concurrency)
+			for i := index; i < next; i++ {
+				wg.Add(1)
+				slots <- struct{}{}
+				go func(i int) {
+					defer wg.Done()
+					defer func() { <-slots }()
+					out := &teardownOutput{emitter: health.emitter(emitter), buffered: true}
+					codes[i-index], cmdErrs[i-index], errs[i-index] = runTeardown(i, next, teardownCommands[i], out, stepExitCode)
+				}(i)
+			}
+			wg.Wait()
 		}
 
-		if firstError == nil {
-			firstError = cmdErr
+		for i := range codes {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			if codes[i] != ExitOk {
+				stepExitCode = codes[i]
+			}
+			if cmdErrs[i] != nil {
+				teardownErrors = append(teardownErrors, cmdErrs[i])
+				if teardownCommands[index+i].OnFailure == screwdriver.OnFailureStop {
+					skipUntil = kindEnd(index)
+				}
+			}
 		}
+		index = next
+	}
+	writeArtifactsManifest()
+	teardownPhase.end()
+	stopped.finish()
+
+	// The steps caused the build failure if they failed, then their failed tests or coverage,
+	// otherwise every failed teardown did
+	if firstError == nil && reportsErr != nil {
+		return reportsErr
+	}
+	if firstError == nil && len(teardownErrors) == 1 {
+		return teardownErrors[0]
+	}
+	if firstError == nil && len(teardownErrors) > 1 {
+		return TeardownFailures(teardownErrors)
 	}
-	terminateSleep(shellBin, sourceDir, true) // kill running sleep $SD_TERMINATION_GRACE_PERIOD_SECS
 	return firstError
 }
 
-// terminate long running sleep process for abort, timeout, n after teardown steps
-func terminateSleep(shellBin, sourceDir string, killAll bool) {
-	var stdout, stderr bytes.Buffer
-	shargs := []string{"-e", "-c"}
-	cmdStr := "pids=$(ps -ef | grep '[s]leep' | awk '{print $2}'); pidcnt=$(echo $pids | wc -w); if [ $pidcnt -gt 1 ]; then kill $(echo $pids | awk '{$NF=\"\"}1'); else echo $pids; fi;"
-	if killAll {
-		cmdStr = "pids=$(ps -ef | grep '[s]leep' | awk '{print $2}'); if [ ! -z $pids ]; then kill $pids; else echo $pids; fi;"
+// Returns the exit code of a command that ran, as reported for steps
+func exitCodeOf(state *os.ProcessState) int {
+	if state == nil {
+		return ExitLaunch
 	}
-	shargs = append(shargs, cmdStr)
-	c := exec.Command(shellBin, shargs...)
-	c.Stdout = &stdout
-	c.Stderr = &stderr
-	c.Dir = sourceDir
-	err := c.Run()
-	if err != nil || strings.TrimSpace(stderr.String()) != "" {
-		fmt.Printf("error %v, %v, in terminating sleep", err, strings.TrimSpace(stderr.String()))
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ExitSignal + int(ws.Signal())
 	}
+	return state.ExitCode()
 }
@@ -3,30 +3,49 @@ package executor
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/screwdriver-cd/launcher/logger"
 	"github.com/screwdriver-cd/launcher/screwdriver"
 )
 
 const TestBuildTimeout = 60
 const DoesNotExistExitCode = 127
 
-var stepFilePath = "/tmp/step.sh"
-
 type MockAPI struct {
 	updateStepStart func(buildID int, stepName string) error
 	updateStepStop  func(buildID int, stepName string, exitCode int) error
+	stepStopDetails func(stepName string, details screwdriver.StepStopDetails)
+	buildTimings    func(buildID int, timings screwdriver.BuildTimings)
+	stepTimings     func(buildID int, stepName string, timings screwdriver.StepTimings)
+	annotations     func(buildID int, stepName string, annotations []screwdriver.Annotation)
+	findings        func(buildID int, findings screwdriver.Findings)
+	getStepToken    func(buildID int, stepName string, scope []string, ttlSeconds int) (string, error)
+	jobFromID       func(jobID int) (screwdriver.Job, error)
+	lastMeta        func(jobID int) (map[string]interface{}, error)
+	stepApproval    func(buildID int, stepName string) (screwdriver.StepApproval, error)
+	buildFromID     func(buildID int) (screwdriver.Build, error)
 }
 
 func (f MockAPI) BuildFromID(buildID int) (screwdriver.Build, error) {
+	if f.buildFromID != nil {
+		return f.buildFromID(buildID)
+	}
 	return screwdriver.Build{}, nil
 }
 
@@ -35,9 +54,19 @@ func (f MockAPI) EventFromID(eventID int) (screwdriver.Event, error) {
 }
 
 func (f MockAPI) JobFromID(jobID int) (screwdriver.Job, error) {
+	if f.jobFromID != nil {
+		return f.jobFromID(jobID)
+	}
 	return screwdriver.Job{}, nil
 }
 
+func (f MockAPI) LastSuccessfulMeta(jobID int) (map[string]interface{}, error) {
+	if f.lastMeta != nil {
+		return f.lastMeta(jobID)
+	}
+	return map[string]interface{}{}, nil
+}
+
 func (f MockAPI) PipelineFromID(pipelineID int) (screwdriver.Pipeline, error) {
 	return screwdriver.Pipeline{}, nil
 }
@@ -65,22 +94,85 @@ func (f MockAPI) UpdateStepStart(buildID int, stepName string) error {
 	return nil
 }
 
-func (f MockAPI) UpdateStepStop(buildID int, stepName string, exitCode int) error {
+func (f MockAPI) UpdateStepStop(buildID int, stepName string, exitCode int, details screwdriver.StepStopDetails) error {
+	if f.stepStopDetails != nil {
+		f.stepStopDetails(stepName, details)
+	}
 	if f.updateStepStop != nil {
 		return f.updateStepStop(buildID, stepName, exitCode)
 	}
 	return nil
 }
 
+func (f MockAPI) UpdateBuildTimings(buildID int, timings screwdriver.BuildTimings) error {
+	if f.buildTimings != nil {
+		f.buildTimings(buildID, timings)
+	}
+	return nil
+}
+
+func (f MockAPI) UpdateStepTimings(buildID int, stepName string, timings screwdriver.StepTimings) error {
+	if f.stepTimings != nil {
+		f.stepTimings(buildID, stepName, timings)
+	}
+	return nil
+}
+
+func (f MockAPI) UpdateBuildFindings(buildID int, findings screwdriver.Findings) error {
+	if f.findings != nil {
+		f.findings(buildID, findings)
+	}
+	return nil
+}
+
+func (f MockAPI) UpdateStepAnnotations(buildID int, stepName string, annotations []screwdriver.Annotation) error {
+	if f.annotations != nil {
+		f.annotations(buildID, stepName, annotations)
+	}
+	return nil
+}
+
+func (f MockAPI) RequestStepApproval(buildID int, stepName, message string) error {
+	return nil
+}
+
+func (f MockAPI) GetStepApproval(buildID int, stepName string) (screwdriver.StepApproval, error) {
+	if f.stepApproval != nil {
+		return f.stepApproval(buildID, stepName)
+	}
+	return screwdriver.StepApproval{Status: screwdriver.ApprovalApproved}, nil
+}
+
 func (f MockAPI) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error) {
 	return "foobar", nil
 }
 
+func (f MockAPI) GetStepToken(buildID int, stepName string, scope []string, ttlSeconds int) (string, error) {
+	if f.getStepToken != nil {
+		return f.getStepToken(buildID, stepName, scope, ttlSeconds)
+	}
+	return "steptoken", nil
+}
+
+func (f MockAPI) GetIDToken(buildID int, audience string) (string, error) {
+	return "idtoken", nil
+}
+
+func (f MockAPI) NegotiateCapabilities(buildID int, launcher screwdriver.Capabilities) (screwdriver.Capabilities, error) {
+	return launcher, nil
+}
+
+func (f MockAPI) ClaimBuild(queue string) (int, error) {
+	return 0, nil
+}
+
 type MockEmitter struct {
 	startCmd func(screwdriver.CommandDef)
 	write    func([]byte) (int, error)
 	close    func() error
-	found    []byte
+	// mu guards found between the output of a step and its standard error, written concurrently
+	mu    sync.Mutex
+	found []byte
 }
 
 func (e *MockEmitter) Error() error {
@@ -98,6 +190,8 @@ func (e *MockEmitter) Write(b []byte) (int, error) {
 	if e.write != nil {
 		return e.write(b)
 	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.found = append(e.found, b...)
 	return len(b), nil
 }
@@ -147,7 +241,20 @@ func setupTestCase(t *testing.T, filename string) {
 }
 
 func TestMain(m *testing.M) {
-	os.Exit(m.Run())
+	// Run re-executes the test binary to start the steps under a seccomp or AppArmor profile
+	Confine()
+	// Run re-executes it as the build shell to replay a recorded build
+	ReplayShell()
+	// Keep the audit records of the test builds out of /var/log
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't create the audit log directory: %v\n", err)
+		os.Exit(1)
+	}
+	defaultAuditLog = filepath.Join(dir, "launcher-audit.log")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func ReadCommand(file string) []string {
@@ -171,8 +278,8 @@ func TestUnmocked(t *testing.T) {
 		{"ls && ls ", nil, "/bin/sh"},
 		// Large single-line
 		{"openssl rand -hex 1000000", nil, "/bin/sh"},
-		{"doesntexist", fmt.Errorf("Launching command exit with code: %v", DoesNotExistExitCode), "/bin/sh"},
-		{"ls && sh -c 'exit 5' && sh -c 'exit 2'", fmt.Errorf("Launching command exit with code: %v", 5), "/bin/sh"},
+		{"doesntexist", StepFailure{Step: "test", Code: DoesNotExistExitCode}, "/bin/sh"},
+		{"ls && sh -c 'exit 5' && sh -c 'exit 2'", StepFailure{Step: "test", Code: 5}, "/bin/sh"},
 		// Custom shell
 		{"ls", nil, "/bin/bash"},
 	}
@@ -204,7 +311,7 @@ func TestUnmocked(t *testing.T) {
 		})
 
 		err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, test.shell, TestBuildTimeout, envFilepath, "")
-		commands := ReadCommand(stepFilePath)
+		commands := ReadCommand(stepScriptPath(envFilepath+"_steps", 0, cmd.Name))
 
 		if !reflect.DeepEqual(err, test.err) {
 			t.Fatalf("Unexpected error: (%v) - should be (%v)", err, test.err)
@@ -276,7 +383,7 @@ func TestMulti(t *testing.T) {
 		},
 	})
 	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
-	expectedErr := fmt.Errorf("Launching command exit with code: %v", DoesNotExistExitCode)
+	expectedErr := StepFailure{Step: "test doesnotexist err", Code: DoesNotExistExitCode}
 	if !runUserTeardown {
 		t.Errorf("step user teardown should run")
 	}
@@ -288,6 +395,87 @@ func TestMulti(t *testing.T) {
 	}
 }
 
+func TestFilterTeardowns(t *testing.T) {
+	names := func(cmds []screwdriver.CommandDef) []string {
+		var out []string
+		for _, c := range cmds {
+			out = append(out, c.Name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name                string
+		commands            []screwdriver.CommandDef
+		patterns            *screwdriver.TeardownPatterns
+		user, sd, userTdown []string
+	}{
+		{
+			name: "default patterns",
+			commands: []screwdriver.CommandDef{
+				{Name: "install"}, {Name: "sd-teardown-artifacts"}, {Name: "preteardown-report"}, {Name: "teardown-clean"}, {Name: "test"},
+			},
+			user: []string{"install", "test"}, sd: []string{"sd-teardown-artifacts"}, userTdown: []string{"preteardown-report", "teardown-clean"},
+		},
+		{
+			name: "explicit types",
+			commands: []screwdriver.CommandDef{
+				{Name: "install"},
+				{Name: "upload-coverage", Type: screwdriver.StepTypeSDTeardown},
+				{Name: "cleanup", Type: screwdriver.StepTypeTeardown},
+				{Name: "teardown-looking-step", Type: screwdriver.StepTypeUser},
+			},
+			user: []string{"install", "teardown-looking-step"}, sd: []string{"upload-coverage"}, userTdown: []string{"cleanup"},
+		},
+		{
+			name:     "build patterns",
+			commands: []screwdriver.CommandDef{{Name: "sd-finally-upload"}, {Name: "always-notify"}, {Name: "teardown-clean"}},
+			patterns: &screwdriver.TeardownPatterns{SD: "^sd-finally-", User: "^always-"},
+			user:     []string{"teardown-clean"}, sd: []string{"sd-finally-upload"}, userTdown: []string{"always-notify"},
+		},
+		{
+			name: "setup steps",
+			commands: []screwdriver.CommandDef{
+				{Name: "sd-setup-init"}, {Name: "sd-setup-scm"}, {Name: "install"}, {Name: "setup-node"},
+				{Name: "test"}, {Name: "presetup-cache"}, {Name: "prepare", Type: screwdriver.StepTypeSetup}, {Name: "teardown-clean"},
+			},
+			user:      []string{"sd-setup-init", "sd-setup-scm", "setup-node", "presetup-cache", "prepare", "install", "test"},
+			userTdown: []string{"teardown-clean"},
+		},
+		{
+			name:     "setup pattern",
+			commands: []screwdriver.CommandDef{{Name: "install"}, {Name: "before-node"}, {Name: "setup-node"}},
+			patterns: &screwdriver.TeardownPatterns{Setup: "^before-"},
+			user:     []string{"before-node", "install", "setup-node"},
+		},
+	}
+
+	for _, test := range tests {
+		build := screwdriver.Build{Commands: test.commands, TeardownPatterns: test.patterns}
+		user, sd, userTdown, err := filterTeardowns(build)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(names(user), test.user) || !reflect.DeepEqual(names(sd), test.sd) || !reflect.DeepEqual(names(userTdown), test.userTdown) {
+			t.Errorf("%s: filterTeardowns() = %v, %v, %v, want %v, %v, %v", test.name, names(user), names(sd), names(userTdown), test.user, test.sd, test.userTdown)
+		}
+	}
+
+	invalid := []screwdriver.Build{
+		{Commands: []screwdriver.CommandDef{{Name: "a"}}, TeardownPatterns: &screwdriver.TeardownPatterns{User: "("}},
+		{Commands: []screwdriver.CommandDef{{Name: "a"}}, TeardownPatterns: &screwdriver.TeardownPatterns{Setup: "["}},
+		{Commands: []screwdriver.CommandDef{{Name: "a", Type: "cleanup"}}},
+		{Commands: []screwdriver.CommandDef{{Name: "teardown-a", OnFailure: "retry"}}},
+		{Commands: []screwdriver.CommandDef{{Name: "teardown-a", Timeout: -1}}},
+	}
+	for _, build := range invalid {
+		if _, _, _, err := filterTeardowns(build); err == nil {
+			t.Errorf("Expected an error for %+v", build)
+		}
+	}
+}
+
 func TestTeardownEnv(t *testing.T) {
 	envFilepath := "/tmp/testTeardownEnv"
 	setupTestCase(t, envFilepath)
@@ -359,7 +547,7 @@ func TestTeardownEnv(t *testing.T) {
 		},
 	})
 	err := Run("", baseEnv, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
-	expectedErr := fmt.Errorf("Launching command exit with code: %v", DoesNotExistExitCode)
+	expectedErr := StepFailure{Step: "doesnotexist", Code: DoesNotExistExitCode}
 	if !runWrapUserTeardown {
 		t.Errorf("step pre user teardown should run")
 	}
@@ -395,10 +583,56 @@ func TestTeardownfail(t *testing.T) {
 		},
 	})
 	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
-	expectedErr := ErrStatus{DoesNotExistExitCode}
+	expectedErr := StepFailure{Step: "sd-teardown-artifacts", Code: DoesNotExistExitCode}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Fatalf("Unexpected error: %v - should be %v", err, expectedErr)
+	}
+}
+
+func TestTeardownTimeoutAndFailurePolicy(t *testing.T) {
+	envFilepath := "/tmp/testTeardownPolicy"
+	setupTestCase(t, envFilepath)
+	commands := []screwdriver.CommandDef{
+		{Cmd: "ls", Name: "test ls"},
+		{Cmd: "sleep 30", Name: "teardown-slow", Timeout: 1, OnFailure: screwdriver.OnFailureStop},
+		{Cmd: "echo skipped", Name: "teardown-skipped"},
+		{Cmd: "exit 3", Name: "sd-teardown-fail"},
+		{Cmd: "exit $SD_STEP_EXIT_CODE", Name: "sd-teardown-last"},
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    commands,
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+
+	start := time.Now()
+	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("The slow teardown should be killed at its timeout, the build took %v", elapsed)
+	}
+
+	wantCodes := map[string]int{"test ls": 0, "teardown-slow": ExitTimeout, "sd-teardown-fail": 3, "sd-teardown-last": 3}
+	if !reflect.DeepEqual(codes, wantCodes) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, wantCodes)
+	}
+	expectedErr := TeardownFailures{
+		StepTimeout{"teardown-slow", time.Second},
+		StepFailure{Step: "sd-teardown-fail", Code: 3},
+		StepFailure{Step: "sd-teardown-last", Code: 3},
+	}
 	if !reflect.DeepEqual(err, expectedErr) {
 		t.Fatalf("Unexpected error: %v - should be %v", err, expectedErr)
 	}
+	if !IsUserFailure(err) {
+		t.Errorf("Failed teardowns should be a user failure")
+	}
 }
 
 func TestAllStepsPassed(t *testing.T) {
@@ -449,6 +683,8 @@ func TestTimeout(t *testing.T) {
 		Commands:    commands,
 		Environment: []map[string]string{},
 	}
+	codes := map[string]int{}
+	signals := map[string]string{}
 	testAPI := screwdriver.API(MockAPI{
 		updateStepStart: func(buildID int, stepName string) error {
 			return nil
@@ -457,8 +693,12 @@ func TestTimeout(t *testing.T) {
 			if stepName == "completed" {
 				t.Errorf("Should not update step that never run: %v", stepName)
 			}
+			codes[stepName] = code
 			return nil
 		},
+		stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+			signals[stepName] = details.Signal
+		},
 	})
 	emitter := MockEmitter{
 		startCmd: func(cmd screwdriver.CommandDef) {
@@ -470,9 +710,20 @@ func TestTimeout(t *testing.T) {
 	}
 	testTimeout := 3
 	err := Run("", nil, &emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", testTimeout, envFilepath, "")
-	expectedErr := fmt.Errorf("Timeout of %vs seconds exceeded", testTimeout)
-	if !reflect.DeepEqual(err, expectedErr) {
-		t.Fatalf("Unexpected error: %v - should be %v", err, expectedErr)
+	var timeoutErr Timeout
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Unexpected error: %v - should be a timeout", err)
+	}
+	if timeoutErr.Timeout != time.Duration(testTimeout)*time.Second {
+		t.Errorf("Unexpected timeout: %v - should be %vs", timeoutErr.Timeout, testTimeout)
+	}
+	expectedMsg := fmt.Sprintf("Timeout of %vs seconds exceeded", testTimeout)
+	if err.Error() != expectedMsg {
+		t.Errorf("Unexpected error message: %v - should be %v", err, expectedMsg)
+	}
+	if codes[timeoutErr.Step] != ExitTimeout || signals[timeoutErr.Step] != "SIGTERM" {
+		t.Errorf("step %v stopped with code %v and signal %q, want %v and %q",
+			timeoutErr.Step, codes[timeoutErr.Step], signals[timeoutErr.Step], ExitTimeout, "SIGTERM")
 	}
 }
 
@@ -524,10 +775,10 @@ func TestTeardownAbort(t *testing.T) {
 				executedTeardownSteps = append(executedTeardownSteps, "sd-teardown-foo")
 			}
 			if stepName == "sd-teardown-last-tear-down" {
-				// check if last teardown step is executed and returns code 1
+				// check if last teardown step is executed and returns the abort exit code
 				executedTeardownSteps = append(executedTeardownSteps, "sd-teardown-last-tear-down")
-				if code != 1 {
-					t.Errorf("step %v should return exit code 1 ", stepName)
+				if code != ExitAborted {
+					t.Errorf("step %v should return exit code %v", stepName, ExitAborted)
 				}
 				return nil
 			}
@@ -539,14 +790,16 @@ func TestTeardownAbort(t *testing.T) {
 		startCmd: func(cmd screwdriver.CommandDef) {
 			if cmd.Cmd == "export FOO=bar" {
 				syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+				// give the signal time to be delivered before the step runs
+				time.Sleep(100 * time.Millisecond)
 			}
 		},
 	}
 
 	err := Run("", baseEnv, &emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
 
-	if err == nil {
-		t.Errorf("Aborted in step %v, should return error", "bazfoo")
+	if !errors.Is(err, ErrAborted) {
+		t.Errorf("Aborted in step %v, should return abort error, got %v", "bazfoo", err)
 	}
 
 	if !runUserTeardown {
@@ -743,3 +996,566 @@ func TestNotifySignal(t *testing.T) {
 		t.Fatal("Signal not received")
 	}
 }
+
+func TestCopyLinesUntil(t *testing.T) {
+	guid := "a5f8e3d2-guid"
+	longLine := strings.Repeat("x", 3*maxLineChunk+17)
+	input := "first line\r\n" +
+		"export SD_STEP_ID=" + guid + " ;. /tmp/step.sh\r\n" +
+		longLine + "\n" +
+		guid + " 7\r\n" +
+		"never copied\n"
+
+	var out bytes.Buffer
+	code, err := copyLinesUntil(strings.NewReader(input), &out, guid)
+	if code != 7 {
+		t.Errorf("code = %v, want %v", code, 7)
+	}
+	if !reflect.DeepEqual(err, StepFailure{Code: 7}) {
+		t.Errorf("expected step failure for non-zero exit code, got %v", err)
+	}
+
+	want := "first line\n" + longLine + "\n"
+	if out.String() != want {
+		t.Errorf("copied %d bytes, want %d", out.Len(), len(want))
+	}
+}
+
+// utf8Writer fails the test on any write that is not valid UTF-8
+type utf8Writer struct {
+	t   *testing.T
+	out bytes.Buffer
+}
+
+func (w *utf8Writer) Write(p []byte) (int, error) {
+	if !utf8.Valid(p) {
+		w.t.Errorf("write of %d bytes ending in %q is not valid UTF-8", len(p), p[len(p)-3:])
+	}
+	return w.out.Write(p)
+}
+
+func TestCopyLinesUntilUTF8(t *testing.T) {
+	guid := "a5f8e3d2-guid"
+	// The 4-byte characters straddle the end of the reader buffer
+	longLine := strings.Repeat("x", maxLineChunk-2) + strings.Repeat("😀", maxLineChunk/2)
+	pr, pw := io.Pipe()
+	go func() {
+		// Write in odd sizes so every read ends in the middle of a character
+		input := []byte(longLine + "\n" + guid + " 0\n")
+		for len(input) > 0 {
+			n := 4093
+			if n > len(input) {
+				n = len(input)
+			}
+			pw.Write(input[:n])
+			input = input[n:]
+		}
+		pw.Close()
+	}()
+
+	dst := &utf8Writer{t: t}
+	if _, err := copyLinesUntil(pr, dst, guid); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := longLine + "\n"; dst.out.String() != want {
+		t.Errorf("copied %d bytes, want %d", dst.out.Len(), len(want))
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/step.sh"
+	if err := ioutil.WriteFile(path, []byte("old content"), 0644); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new content"), 0755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != "new content" {
+		t.Errorf("content = %q, want %q", content, "new content")
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("mode = %v, want %v", info.Mode().Perm(), os.FileMode(0755))
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temp files left behind: %v", len(files)-1)
+	}
+
+	if err := writeFileAtomic(dir+"/missing/step.sh", []byte("x"), 0755); err == nil {
+		t.Errorf("expected error writing into a missing directory")
+	}
+}
+
+func TestBuildTimer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan error, 1)
+	timer := newBuildTimer(ctx, 50*time.Millisecond, ch)
+	if !timer.Extend(100 * time.Millisecond) {
+		t.Fatalf("Extend should succeed before the timer fires")
+	}
+
+	select {
+	case err := <-ch:
+		t.Fatalf("timer fired before the extended deadline: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case err := <-ch:
+		want := Timeout{Timeout: 150 * time.Millisecond}
+		if !reflect.DeepEqual(err, want) {
+			t.Errorf("Unexpected error: %v - should be %v", err, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timer did not fire")
+	}
+
+	if timer.Extend(time.Second) {
+		t.Errorf("Extend should fail after the timer fired")
+	}
+}
+
+func TestBuildTimerCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan error, 1)
+	timer := newBuildTimer(ctx, 50*time.Millisecond, ch)
+	cancel()
+
+	select {
+	case err := <-ch:
+		t.Fatalf("timer fired after the context was cancelled: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if timer.Extend(time.Second) {
+		t.Errorf("Extend should fail after the timer was stopped")
+	}
+}
+
+func TestTimeoutExtension(t *testing.T) {
+	defer os.Unsetenv("SD_TIMEOUT_EXTENSION")
+	for value, want := range map[string]time.Duration{"": 0, "0": 0, " 15 ": 15 * time.Minute} {
+		os.Setenv("SD_TIMEOUT_EXTENSION", value)
+		if got, err := timeoutExtension(); err != nil || got != want {
+			t.Errorf("timeoutExtension() with %q = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"-1", "1h", "abc"} {
+		os.Setenv("SD_TIMEOUT_EXTENSION", value)
+		if _, err := timeoutExtension(); err == nil {
+			t.Errorf("Expected an error for SD_TIMEOUT_EXTENSION %q", value)
+		}
+	}
+}
+
+func TestExtendTimeoutOnSignal(t *testing.T) {
+	envFilepath := "/tmp/testExtendTimeout"
+	setupTestCase(t, envFilepath)
+	os.Setenv("SD_TIMEOUT_EXTENSION", "1")
+	defer os.Unsetenv("SD_TIMEOUT_EXTENSION")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "slow", Cmd: "sleep 2"},
+		},
+		Environment: []map[string]string{},
+	}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStart: func(buildID int, stepName string) error {
+			syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			return nil
+		},
+	})
+	if err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", 1, envFilepath, ""); err != nil {
+		t.Errorf("The build should not time out once extended: %v", err)
+	}
+}
+
+// chunkRecorder records each Write as a separate chunk and fails if writes overlap
+type chunkRecorder struct {
+	mu      sync.Mutex
+	writing bool
+	overlap bool
+	chunks  []string
+}
+
+func (c *chunkRecorder) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.writing {
+		c.overlap = true
+	}
+	c.writing = true
+	c.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	c.mu.Lock()
+	c.chunks = append(c.chunks, string(b))
+	c.writing = false
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+func TestPtyWriterSerializesWrites(t *testing.T) {
+	rec := &chunkRecorder{}
+	w := newPtyWriter(rec)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				handleBuildTimeout(w, fmt.Sprintf("timeout %d\n", i), shellCapabilities{})
+			} else {
+				w.Write([]byte{4})
+			}
+		}(i)
+	}
+	wg.Wait()
+	w.Close()
+
+	if rec.overlap {
+		t.Errorf("writes to the pty overlapped")
+	}
+	if len(rec.chunks) != 20 {
+		t.Errorf("got %d writes, want %d", len(rec.chunks), 20)
+	}
+	for _, chunk := range rec.chunks {
+		if len(chunk) > 1 && !strings.HasSuffix(chunk, "\x04") {
+			t.Errorf("timeout banner was not followed by EOT: %q", chunk)
+		}
+	}
+
+	if _, err := w.Write([]byte("after close")); err == nil {
+		t.Errorf("expected error writing after close")
+	}
+}
+
+func TestAbortDuringRunningStep(t *testing.T) {
+	envFilepath := "/tmp/testAbortRunning"
+	setupTestCase(t, envFilepath)
+	commands := []screwdriver.CommandDef{
+		// blocks reading the pty until the launcher sends EOT
+		{Cmd: "cat", Name: "long"},
+		{Cmd: "echo never", Name: "never"},
+		{Cmd: "exit $SD_STEP_EXIT_CODE", Name: "sd-teardown-exit"},
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    commands,
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	signals := map[string]string{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+		stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+			signals[stepName] = details.Signal
+		},
+	})
+
+	emitter := MockEmitter{
+		startCmd: func(cmd screwdriver.CommandDef) {
+			if cmd.Name == "long" {
+				go func() {
+					time.Sleep(500 * time.Millisecond)
+					// Abort from several goroutines at once while the step writes to the pty
+					for i := 0; i < 3; i++ {
+						go syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+					}
+				}()
+			}
+		},
+	}
+
+	start := time.Now()
+	err := Run("", nil, &emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if !reflect.DeepEqual(err, Aborted{"long"}) {
+		t.Errorf("Aborted in step %v, should return abort error, got %v", "long", err)
+	}
+	if time.Since(start) > 20*time.Second {
+		t.Errorf("abort did not stop the running step")
+	}
+	if _, ok := codes["never"]; ok {
+		t.Errorf("step %v should not run after abort", "never")
+	}
+	if codes["long"] != ExitAborted || codes["sd-teardown-exit"] != ExitAborted {
+		t.Errorf("unexpected exit codes after abort: %v", codes)
+	}
+	if signals["long"] != "SIGTERM" || signals["sd-teardown-exit"] != "" {
+		t.Errorf("unexpected signals after abort: %v", signals)
+	}
+}
+
+func TestRunWritesBuildArtifacts(t *testing.T) {
+	envFilepath := "/tmp/testSummary"
+	setupTestCase(t, envFilepath)
+	artifactsDir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(artifactsDir)
+
+	commands := []screwdriver.CommandDef{
+		{Cmd: "echo ok", Name: "ok"},
+		{Cmd: "echo done", Name: "sd-teardown-done"},
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    commands,
+		Environment: []map[string]string{},
+	}
+
+	usages := map[string]*screwdriver.ResourceUsage{}
+	var timings *screwdriver.BuildTimings
+	stepTimings := map[string]screwdriver.StepTimings{}
+	testAPI := screwdriver.API(MockAPI{
+		stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+			usages[stepName] = details.Usage
+		},
+		buildTimings: func(buildID int, t screwdriver.BuildTimings) {
+			timings = &t
+		},
+		stepTimings: func(buildID int, stepName string, t screwdriver.StepTimings) {
+			stepTimings[stepName] = t
+		},
+	})
+
+	os.Setenv("SD_AUDIT_LOG", filepath.Join(artifactsDir, "launcher-audit.log"))
+	defer os.Unsetenv("SD_AUDIT_LOG")
+	env := []string{"SD_ARTIFACTS_DIR=" + artifactsDir}
+	if err := Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"ok", "sd-teardown-done"} {
+		if usages[name] == nil {
+			t.Errorf("step %v should report its resource usage", name)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(artifactsDir, summaryFile))
+	if err != nil {
+		t.Fatalf("Couldn't read the build summary: %v", err)
+	}
+	var summary buildSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Couldn't parse the build summary: %v", err)
+	}
+	if len(summary.Steps) != 2 || summary.Steps[0].Name != "ok" || summary.Steps[1].Name != "sd-teardown-done" {
+		t.Errorf("Unexpected build summary: %s", data)
+	}
+	if _, err := os.Stat(filepath.Join(artifactsDir, summaryTableFile)); err != nil {
+		t.Errorf("Couldn't find the build summary table: %v", err)
+	}
+	if timings == nil || len(timings.Steps) != 2 || timings.TotalTimeMs < timings.StepsTimeMs+timings.TeardownTimeMs {
+		t.Errorf("Unexpected build timings sent to the API: %+v", timings)
+	}
+
+	if len(stepTimings) != 2 || stepTimings["ok"].ScriptWriteMs <= 0 || stepTimings["ok"].PtyRoundTripMs <= 0 {
+		t.Errorf("Unexpected step timings sent to the API: %+v", stepTimings)
+	}
+
+	kinds := map[string]int{}
+	for _, r := range readAuditRecords(t, filepath.Join(artifactsDir, "launcher-audit.log")) {
+		kinds[r.Kind]++
+		if r.Kind == auditStep && (r.Step != "ok" || r.Command != "echo ok" || r.Dir == "") {
+			t.Errorf("Unexpected step audit record: %+v", r)
+		}
+		if r.Kind == auditTeardown && (r.Step != "sd-teardown-done" || r.Command != "echo done") {
+			t.Errorf("Unexpected teardown audit record: %+v", r)
+		}
+	}
+	if kinds[auditSetup] == 0 || kinds[auditStep] != 1 || kinds[auditTeardown] != 1 || len(kinds) != 3 {
+		t.Errorf("Unexpected audited commands: %v", kinds)
+	}
+}
+
+func TestRunTracesPtyProtocol(t *testing.T) {
+	old := logger.Default()
+	defer logger.SetDefault(old)
+	var trace bytes.Buffer
+	logger.SetDefault(logger.New(&syncWriter{w: &trace}, logger.LevelDebug, false))
+
+	envFilepath := "/tmp/testTrace"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    []screwdriver.CommandDef{{Cmd: "echo traced", Name: "traced"}},
+		Environment: []map[string]string{},
+	}
+
+	if err := Run("", nil, &MockEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	logger.SetDefault(old)
+	for _, want := range []string{"pty: setup commands done", `pty: running step "traced"`, "pty: write", "pty: read exit sentinel"} {
+		if !strings.Contains(trace.String(), want) {
+			t.Errorf("debug log should contain %q:\n%s", want, trace.String())
+		}
+	}
+}
+
+// syncWriter serializes writes to w
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func TestTeardownKilledBySignal(t *testing.T) {
+	envFilepath := "/tmp/testTeardownSignal"
+	setupTestCase(t, envFilepath)
+	commands := []screwdriver.CommandDef{
+		{Cmd: "echo ok", Name: "ok"},
+		{Cmd: "kill -KILL $$", Name: "sd-teardown-killed"},
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    commands,
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	signals := map[string]string{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+		stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+			signals[stepName] = details.Signal
+		},
+	})
+
+	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	wantCode := ExitSignal + int(syscall.SIGKILL)
+	want := StepFailure{"sd-teardown-killed", wantCode, syscall.SIGKILL}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("Unexpected error: %v - should be %v", err, want)
+	}
+	if codes["sd-teardown-killed"] != wantCode || signals["sd-teardown-killed"] != "SIGKILL" {
+		t.Errorf("step %v stopped with code %v and signal %q, want %v and %q",
+			"sd-teardown-killed", codes["sd-teardown-killed"], signals["sd-teardown-killed"], wantCode, "SIGKILL")
+	}
+}
+
+// benchmarkOutput returns size bytes of step output in lines of lineLen, followed by the exit sentinel
+func benchmarkOutput(guid string, size, lineLen int) []byte {
+	line := strings.Repeat("a", lineLen-1) + "\r\n"
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(line)
+	}
+	buf.WriteString(guid + " 0\r\n")
+	return buf.Bytes()
+}
+
+func benchmarkCopyLinesUntil(b *testing.B, lineLen int) {
+	guid := "4a0e0a7d-bench"
+	input := benchmarkOutput(guid, 16*1024*1024, lineLen)
+	lines := len(input) / lineLen
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := copyLinesUntil(bytes.NewReader(input), ioutil.Discard, guid); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*lines), "ns/line")
+}
+
+func BenchmarkCopyLinesUntilShortLines(b *testing.B) { benchmarkCopyLinesUntil(b, 80) }
+
+func BenchmarkCopyLinesUntilLongLines(b *testing.B) { benchmarkCopyLinesUntil(b, 4096) }
+
+func BenchmarkCopyLinesUntilHugeLines(b *testing.B) { benchmarkCopyLinesUntil(b, 4*maxLineChunk) }
+
+// BenchmarkRunThroughput measures end to end throughput of a step writing to the pty
+func BenchmarkRunThroughput(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	envFilepath := "/tmp/benchRunThroughput"
+	cmd := screwdriver.CommandDef{
+		Name: "output",
+		Cmd:  fmt.Sprintf("head -c %d /dev/zero | tr '\\0' 'a' | fold -w 100", size),
+	}
+	testBuild := screwdriver.Build{
+		ID:       12345,
+		Commands: []screwdriver.CommandDef{cmd},
+	}
+	emitter := MockEmitter{
+		write: func(p []byte) (int, error) {
+			return len(p), nil
+		},
+	}
+
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		if err := Run("", nil, &emitter, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func TestTimeoutKillsStepProcesses(t *testing.T) {
+	envFilepath := "/tmp/testTimeoutKills"
+	pidFile := envFilepath + "_pid"
+	setupTestCase(t, envFilepath)
+	cleanup(pidFile)
+	defer cleanup(pidFile)
+
+	commands := []screwdriver.CommandDef{
+		{Cmd: "sh -c 'echo $$ > " + pidFile + "; exec tail -f /dev/null'", Name: "hang"},
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    commands,
+		Environment: []map[string]string{},
+	}
+
+	err := Run("", nil, &MockEmitter{}, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", 2, envFilepath, "")
+	if err == nil {
+		t.Fatalf("expected timeout error")
+	}
+
+	content, rerr := ioutil.ReadFile(pidFile)
+	if rerr != nil {
+		t.Fatalf("step did not start: %v", rerr)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("process %d spawned by the step survived the timeout", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,218 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Classes of the failed builds, in the build status message and the metrics
+const (
+	ClassUserError  = "user-error"
+	ClassInfraError = "infra-error"
+	ClassTimeout    = "timeout"
+	ClassAborted    = "aborted"
+	ClassPreempted  = "preempted"
+)
+
+// maxScannedLine bounds the unfinished line kept by the failure classifier
+const maxScannedLine = 4096
+
+// failureRule puts a failed step in Class when its name matches Step, its exit code is one of
+// ExitCodes and a line of its output matches Output. An empty pattern or list matches
+// everything, but a rule needs an exit code or an output pattern.
+type failureRule struct {
+	Name      string `json:"name"`
+	Step      string `json:"step,omitempty"`
+	ExitCodes []int  `json:"exitCodes,omitempty"`
+	Output    string `json:"output,omitempty"`
+	Class     string `json:"class"`
+
+	step, output *regexp.Regexp
+}
+
+// failureRules are the rules cluster admins add to the built-in ones
+type failureRules struct {
+	Rules []failureRule `json:"rules"`
+}
+
+// builtinFailureRules put the steps failing because of the network, the disk or the image
+// registries in the infrastructure errors
+var builtinFailureRules = []failureRule{
+	{Name: "disk-full", Class: ClassInfraError, output: regexp.MustCompile(`(?i)no space left on device`)},
+	{Name: "dns", Class: ClassInfraError, output: regexp.MustCompile(`(?i)could not resolve host|temporary failure in name resolution`)},
+	{Name: "network", Class: ClassInfraError, output: regexp.MustCompile(`(?i)tls handshake timeout|connection timed out|connection reset by peer|the remote end hung up unexpectedly`)},
+	{Name: "image-pull", Class: ClassInfraError, output: regexp.MustCompile(`(?i)pull access denied|error pulling image|toomanyrequests`)},
+}
+
+// Loads the failure rules from the JSON file at SD_FAILURE_RULES in the launcher environment,
+// followed by the built-in ones
+func loadFailureRules() ([]failureRule, error) {
+	path := strings.TrimSpace(os.Getenv("SD_FAILURE_RULES"))
+	if path == "" {
+		return builtinFailureRules, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseFailureRules(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, builtinFailureRules...), nil
+}
+
+// Parses and validates failure rules
+func parseFailureRules(data []byte) ([]failureRule, error) {
+	var r failureRules
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("Parsing the failure rules: %v", err)
+	}
+
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("Failure rule %d has no name", i)
+		}
+		switch rule.Class {
+		case ClassUserError, ClassInfraError, ClassTimeout, ClassAborted:
+		default:
+			return nil, fmt.Errorf("Failure rule %q has class %q, want %q, %q, %q or %q", rule.Name, rule.Class, ClassUserError, ClassInfraError, ClassTimeout, ClassAborted)
+		}
+		if len(rule.ExitCodes) == 0 && rule.Output == "" {
+			return nil, fmt.Errorf("Failure rule %q matches every failure, it needs exit codes or an output pattern", rule.Name)
+		}
+
+		var err error
+		if rule.Step != "" {
+			if rule.step, err = regexp.Compile(rule.Step); err != nil {
+				return nil, fmt.Errorf("Failure rule %q: %v", rule.Name, err)
+			}
+		}
+		if rule.Output != "" {
+			if rule.output, err = regexp.Compile(rule.Output); err != nil {
+				return nil, fmt.Errorf("Failure rule %q: %v", rule.Name, err)
+			}
+		}
+	}
+	return r.Rules, nil
+}
+
+// failureClassifier is the emitter of the build, recording the rules matching the output of each
+// step, which classify the failure of the build
+type failureClassifier struct {
+	screwdriver.Emitter
+	rules []failureRule
+
+	mu   sync.Mutex
+	step string
+	line []byte
+	// matched are the indexes of the rules whose output pattern matched the output of the steps,
+	// by name
+	matched map[string]map[int]bool
+}
+
+func newFailureClassifier(emitter screwdriver.Emitter, rules []failureRule) *failureClassifier {
+	return &failureClassifier{Emitter: emitter, rules: rules, matched: map[string]map[int]bool{}}
+}
+
+// StartCmd attributes the output from now on to cmd
+func (c *failureClassifier) StartCmd(cmd screwdriver.CommandDef) {
+	c.mu.Lock()
+	c.step, c.line = cmd.Name, nil
+	c.mu.Unlock()
+	c.Emitter.StartCmd(cmd)
+}
+
+func (c *failureClassifier) Write(p []byte) (int, error) {
+	c.scanOutput(p)
+	return c.Emitter.Write(p)
+}
+
+// Scans p, output of the current step, for the output patterns of the rules
+func (c *failureClassifier) scanOutput(p []byte) {
+	c.mu.Lock()
+	c.line = append(c.line, p...)
+	for {
+		i := bytes.IndexByte(c.line, '\n')
+		if i < 0 {
+			break
+		}
+		c.scan(c.line[:i])
+		c.line = c.line[i+1:]
+	}
+	if len(c.line) > maxScannedLine {
+		c.scan(c.line)
+		c.line = nil
+	}
+	c.mu.Unlock()
+}
+
+// Unwrap returns the emitter the classifier writes to
+func (c *failureClassifier) Unwrap() screwdriver.Emitter {
+	return c.Emitter
+}
+
+// Records the rules whose output pattern matches line
+func (c *failureClassifier) scan(line []byte) {
+	if c.step == "" {
+		return
+	}
+	for i, rule := range c.rules {
+		if rule.output == nil || c.matched[c.step][i] || !rule.output.Match(line) {
+			continue
+		}
+		if c.matched[c.step] == nil {
+			c.matched[c.step] = map[int]bool{}
+		}
+		c.matched[c.step][i] = true
+	}
+}
+
+// Returns err in the class of the first rule matching the step failure it is, or err if none does
+func (c *failureClassifier) classify(err error) error {
+	step, code, codeKnown := "", 0, false
+	switch e := err.(type) {
+	case StepFailure:
+		step, code, codeKnown = e.Step, e.Code, true
+	case StepTimeout:
+		step = e.Step
+	default:
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, rule := range c.rules {
+		if rule.step != nil && !rule.step.MatchString(step) {
+			continue
+		}
+		if len(rule.ExitCodes) > 0 && (!codeKnown || !hasCode(rule.ExitCodes, code)) {
+			continue
+		}
+		if rule.output != nil && !c.matched[step][i] {
+			continue
+		}
+		return ClassifiedFailure{Step: step, Class: rule.Class, Rule: rule.Name, Err: err}
+	}
+	return err
+}
+
+// Returns whether codes has code
+func hasCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const testFailureRules = `{"rules": [
+	{"name": "oom-killed", "exitCodes": [137], "class": "infra-error"},
+	{"name": "flaky-test", "step": "^test$", "output": "ECONNRESET", "class": "user-error"},
+	{"name": "deploy-lock", "output": "(?i)lock wait timeout", "class": "timeout"}
+]}`
+
+func TestParseFailureRules(t *testing.T) {
+	rules, err := parseFailureRules([]byte(testFailureRules))
+	if err != nil || len(rules) != 3 || rules[1].step == nil || rules[1].output == nil {
+		t.Fatalf("parseFailureRules() = %+v, %v", rules, err)
+	}
+
+	for _, bad := range []string{
+		`{"rules": [`,
+		`{"rules": [{"exitCodes": [1], "class": "infra-error"}]}`,
+		`{"rules": [{"name": "a", "exitCodes": [1], "class": "bug"}]}`,
+		`{"rules": [{"name": "a", "step": "test", "class": "infra-error"}]}`,
+		`{"rules": [{"name": "a", "output": "(", "class": "infra-error"}]}`,
+		`{"rules": [{"name": "a", "step": "(", "exitCodes": [1], "class": "infra-error"}]}`,
+	} {
+		if _, err := parseFailureRules([]byte(bad)); err == nil {
+			t.Errorf("parseFailureRules(%s) should fail", bad)
+		}
+	}
+}
+
+func TestLoadFailureRules(t *testing.T) {
+	defer os.Setenv("SD_FAILURE_RULES", os.Getenv("SD_FAILURE_RULES"))
+	os.Setenv("SD_FAILURE_RULES", "")
+	if rules, err := loadFailureRules(); err != nil || len(rules) != len(builtinFailureRules) {
+		t.Errorf("loadFailureRules() = %v, %v, want the built-in rules", rules, err)
+	}
+
+	rulesFile, err := ioutil.TempFile("", "failurerules")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.Remove(rulesFile.Name())
+	rulesFile.WriteString(testFailureRules)
+	rulesFile.Close()
+	os.Setenv("SD_FAILURE_RULES", rulesFile.Name())
+	rules, err := loadFailureRules()
+	if err != nil || len(rules) != 3+len(builtinFailureRules) || rules[0].Name != "oom-killed" {
+		t.Errorf("loadFailureRules() = %v, %v, want the rules of the file first", rules, err)
+	}
+	os.Setenv("SD_FAILURE_RULES", rulesFile.Name()+".missing")
+	if _, err := loadFailureRules(); err == nil {
+		t.Errorf("loadFailureRules() with a missing file should fail")
+	}
+}
+
+func TestFailureClassifier(t *testing.T) {
+	rules, err := parseFailureRules([]byte(testFailureRules))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	emitter := &MockEmitter{}
+	c := newFailureClassifier(emitter, append(rules, builtinFailureRules...))
+	c.StartCmd(screwdriver.CommandDef{Name: "install"})
+	c.Write([]byte("npm ERR! ENOSPC: no space "))
+	c.Write([]byte("left on device, write\n"))
+	c.StartCmd(screwdriver.CommandDef{Name: "test"})
+	c.Write([]byte("Error: read ECONNRESET\nconnection reset by peer\n"))
+	c.StartCmd(screwdriver.CommandDef{Name: "deploy"})
+	c.Write([]byte("ERROR 1205: Lock wait timeout exceeded\n"))
+	c.StartCmd(screwdriver.CommandDef{Name: "lint"})
+	c.Write([]byte("FAIL: expected 1, got 2\n"))
+	if string(emitter.found) != "npm ERR! ENOSPC: no space left on device, write\nError: read ECONNRESET\nconnection reset by peer\nERROR 1205: Lock wait timeout exceeded\nFAIL: expected 1, got 2\n" {
+		t.Errorf("The output should be passed on, got %q", emitter.found)
+	}
+
+	tests := []struct {
+		err   error
+		class string
+		rule  string
+	}{
+		{StepFailure{Step: "install", Code: 1}, ClassInfraError, "disk-full"},
+		{StepFailure{Step: "lint", Code: 137}, ClassInfraError, "oom-killed"},
+		// The rules of the file come first
+		{StepFailure{Step: "test", Code: 1}, ClassUserError, "flaky-test"},
+		{StepTimeout{Step: "deploy", Timeout: time.Minute}, ClassTimeout, "deploy-lock"},
+		{StepTimeout{Step: "lint", Timeout: time.Minute}, ClassUserError, ""},
+		{StepFailure{Step: "lint", Code: 1}, ClassUserError, ""},
+		{Aborted{Step: "install"}, ClassAborted, ""},
+		{InfraError{"Updating step start", errors.New("503")}, ClassInfraError, ""},
+	}
+	for _, test := range tests {
+		err := c.classify(test.err)
+		var classified ClassifiedFailure
+		rule := ""
+		if errors.As(err, &classified) {
+			rule = classified.Rule
+		}
+		if got := FailureClass(err); got != test.class || rule != test.rule {
+			t.Errorf("classify(%v) = %v of class %q, want class %q by rule %q", test.err, err, got, test.class, test.rule)
+		}
+	}
+
+	err = c.classify(StepFailure{Step: "install", Code: 1})
+	if err.Error() != `Step "install" failed as infra-error by rule "disk-full": Launching command exit with code: 1` {
+		t.Errorf("Unexpected message: %v", err)
+	}
+	if IsUserFailure(err) || !errors.Is(err, ErrStepFailed) {
+		t.Errorf("classify() = %v, want an infrastructure error that is still the step failure", err)
+	}
+}
+
+func TestRunClassifiesFailures(t *testing.T) {
+	envFilepath := "/tmp/testFailureClass"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "failureclass")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		cmd   string
+		class string
+	}{
+		{`echo "fatal: unable to access 'https://github.com/org/repo/': Could not resolve host: github.com"; exit 128`, ClassInfraError},
+		{`echo "FAIL: expected 1, got 2"; exit 1`, ClassUserError},
+	}
+	for _, test := range tests {
+		testBuild := screwdriver.Build{
+			ID:          12345,
+			Commands:    []screwdriver.CommandDef{{Name: "checkout", Cmd: test.cmd}},
+			Environment: []map[string]string{},
+		}
+		err := Run(dir, nil, &MockEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir)
+		if class := FailureClass(err); class != test.class {
+			t.Errorf("Run() with %q = %v of class %q, want %q", test.cmd, err, class, test.class)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package executor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// defaultFailureSummaryLines is how many of the last lines of output of the failed step the
+	// failure summary keeps, unless SD_FAILURE_SUMMARY_LINES is set
+	defaultFailureSummaryLines = 20
+	// failureMetaKey is the key of the build meta with the failure summary
+	failureMetaKey = "failure"
+	// secretMask replaces the secrets of the build in the failure summary
+	secretMask = "********"
+)
+
+// Returns how many of the last lines of output of the failed step the failure summary keeps,
+// SD_FAILURE_SUMMARY_LINES in the launcher environment or 20, 0 for no summary
+func failureSummaryLines() (int, error) {
+	value := strings.TrimSpace(os.Getenv("SD_FAILURE_SUMMARY_LINES"))
+	if value == "" {
+		return defaultFailureSummaryLines, nil
+	}
+	lines, err := strconv.Atoi(value)
+	if err != nil || lines < 0 {
+		return 0, fmt.Errorf("Invalid SD_FAILURE_SUMMARY_LINES %q, want a number of lines", value)
+	}
+	return lines, nil
+}
+
+// FailureSummary is why the build failed, in the build meta: the step that failed it, the command
+// of the step, its exit code and its last lines of output
+type FailureSummary struct {
+	Step     string   `json:"step"`
+	Command  string   `json:"command,omitempty"`
+	ExitCode int      `json:"exitCode"`
+	Output   []string `json:"output"`
+}
+
+// stepTail is the command, exit code and last lines of output of a step
+type stepTail struct {
+	command string
+	code    int
+	lines   []string
+}
+
+// failureSummarizer keeps the last lines of output of each step to summarize the failure of the
+// build
+type failureSummarizer struct {
+	screwdriver.Emitter
+	max int
+
+	mu    sync.Mutex
+	step  string
+	line  []byte
+	steps map[string]*stepTail
+}
+
+func newFailureSummarizer(emitter screwdriver.Emitter, max int) *failureSummarizer {
+	return &failureSummarizer{Emitter: emitter, max: max, steps: map[string]*stepTail{}}
+}
+
+// StartCmd attributes the output from now on to cmd
+func (s *failureSummarizer) StartCmd(cmd screwdriver.CommandDef) {
+	s.mu.Lock()
+	s.flush()
+	s.step = cmd.Name
+	command := shownCommand(cmd)
+	if cmd.Script != "" && cmd.Echo == nil {
+		command = strings.Join(append([]string{cmd.Script}, cmd.Args...), " ")
+	}
+	s.steps[cmd.Name] = &stepTail{command: command}
+	s.mu.Unlock()
+	s.Emitter.StartCmd(cmd)
+}
+
+func (s *failureSummarizer) Write(p []byte) (int, error) {
+	s.scanOutput(p)
+	return s.Emitter.Write(p)
+}
+
+// Keeps the last lines of p, output of the current step
+func (s *failureSummarizer) scanOutput(p []byte) {
+	s.mu.Lock()
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		s.add(s.line[:i])
+		s.line = s.line[i+1:]
+	}
+	if len(s.line) > maxScannedLine {
+		s.flush()
+	}
+	s.mu.Unlock()
+}
+
+// Unwrap returns the emitter the summarizer writes to
+func (s *failureSummarizer) Unwrap() screwdriver.Emitter {
+	return s.Emitter
+}
+
+// Adds the partial line to the output of the current step
+func (s *failureSummarizer) flush() {
+	if len(s.line) > 0 {
+		s.add(s.line)
+		s.line = nil
+	}
+}
+
+// Adds line to the last lines of output of the current step
+func (s *failureSummarizer) add(line []byte) {
+	tail := s.steps[s.step]
+	if tail == nil || s.max == 0 {
+		return
+	}
+	tail.lines = append(tail.lines, string(bytes.TrimRight(line, "\r")))
+	if len(tail.lines) > s.max {
+		tail.lines = tail.lines[len(tail.lines)-s.max:]
+	}
+}
+
+// Records the exit code of the step with name
+func (s *failureSummarizer) stop(name string, code int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tail := s.steps[name]; tail != nil {
+		tail.code = code
+	}
+}
+
+// Returns the summary of the failure err of the build, with the secrets masked, or nil if no step
+// failed it
+func (s *failureSummarizer) summary(err error, secrets []string) *FailureSummary {
+	if s == nil || s.max == 0 {
+		return nil
+	}
+	step := failedStep(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	tail := s.steps[step]
+	if tail == nil {
+		return nil
+	}
+	summary := &FailureSummary{Step: step, Command: maskSecrets(tail.command, secrets), ExitCode: tail.code, Output: []string{}}
+	for _, line := range tail.lines {
+		summary.Output = append(summary.Output, maskSecrets(line, secrets))
+	}
+	return summary
+}
+
+// Sets the summary of the failure err of the build in the build meta at metaPath
+func (s *failureSummarizer) write(err error, secrets []string, metaPath string) error {
+	summary := s.summary(err, secrets)
+	if summary == nil || metaPath == "" {
+		return nil
+	}
+	return updateBuildMeta(metaPath, func(meta map[string]interface{}) {
+		meta[failureMetaKey] = summary
+	})
+}
+
+// Returns the step that failed the build with err, the first of its failed teardowns, or ""
+func failedStep(err error) string {
+	var teardowns TeardownFailures
+	if errors.As(err, &teardowns) && len(teardowns) > 0 {
+		err = teardowns[0]
+	}
+	var frozen Frozen
+	if errors.As(err, &frozen) {
+		return frozen.Step
+	}
+	var launch LaunchError
+	if errors.As(err, &launch) {
+		return launch.Step
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if step := stepOf(err); step != "" {
+			return step
+		}
+	}
+	return ""
+}
+
+// Returns the secrets of the build, the values of the variables never written to the export file
+func buildSecrets(env []string) []string {
+	var secrets []string
+	for _, name := range scrubbedEnvNames(env) {
+		// Short values would mask too much that is not a secret
+		if value := lookupEnv(env, name); len(value) >= 4 {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+// Returns s with the secrets masked
+func maskSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, secretMask)
+	}
+	return s
+}
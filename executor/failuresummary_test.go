@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestFailureSummarizer(t *testing.T) {
+	s := newFailureSummarizer(&MockEmitter{}, 3)
+	s.StartCmd(screwdriver.CommandDef{Name: "install", Cmd: "npm install"})
+	fmt.Fprintf(s, "added 1 package\n")
+	s.stop("install", 0)
+	s.StartCmd(screwdriver.CommandDef{Name: "test", Cmd: "npm test"})
+	fmt.Fprintf(s, "one\ntwo\r\nthree\nfour\nusing token s3cr3t-t0ken\nFAIL")
+	s.stop("test", 1)
+
+	got := s.summary(StepFailure{Step: "test", Code: 1}, []string{"s3cr3t-t0ken"})
+	want := &FailureSummary{Step: "test", Command: "npm test", ExitCode: 1, Output: []string{"four", "using token ********", "FAIL"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary() = %+v, want %+v", got, want)
+	}
+	if got := s.summary(InfraError{"Updating step start", errors.New("503")}, nil); got != nil {
+		t.Errorf("summary() of a failure without a step = %+v, want nil", got)
+	}
+	if got := newFailureSummarizer(&MockEmitter{}, 0).summary(StepFailure{Step: "test"}, nil); got != nil {
+		t.Errorf("summary() without lines = %+v, want nil", got)
+	}
+}
+
+func TestFailedStep(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{StepFailure{Step: "test", Code: 1}, "test"},
+		{ClassifiedFailure{Step: "test", Class: ClassInfraError, Rule: "dns", Err: StepFailure{Step: "test", Code: 6}}, "test"},
+		{StepTimeout{"e2e", time.Minute}, "e2e"},
+		{Frozen{Step: "deploy", Window: "* * * * *"}, "deploy"},
+		{LaunchError{"lint", errors.New("no shell")}, "lint"},
+		{TeardownFailures{StepFailure{Step: "teardown-a", Code: 1}, StepFailure{Step: "teardown-b", Code: 2}}, "teardown-a"},
+		{TestFailures{Failed: 2, Reports: 1}, ""},
+	}
+	for _, test := range tests {
+		if got := failedStep(test.err); got != test.want {
+			t.Errorf("failedStep(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRunWritesFailureSummary(t *testing.T) {
+	envFilepath := "/tmp/testFailureSummary"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "failuresummary")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metaPath := filepath.Join(dir, "meta.json")
+	defer os.Setenv("SD_FAILURE_SUMMARY_LINES", os.Getenv("SD_FAILURE_SUMMARY_LINES"))
+	os.Setenv("SD_FAILURE_SUMMARY_LINES", "2")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: "echo running; echo 3 tests failed; exit 3"},
+			{Name: "teardown-report", Cmd: "echo reported"},
+		},
+		Environment: []map[string]string{},
+	}
+	if err := Run(dir, []string{"SD_META_PATH=" + metaPath}, &MockEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir); err == nil {
+		t.Fatalf("Run() should fail")
+	}
+
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var meta struct {
+		Failure FailureSummary `json:"failure"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := FailureSummary{Step: "test", Command: "echo running; echo 3 tests failed; exit 3", ExitCode: 3, Output: []string{"running", "3 tests failed"}}
+	if !reflect.DeepEqual(meta.Failure, want) {
+		t.Errorf("Failure summary in the meta = %+v, want %+v", meta.Failure, want)
+	}
+}
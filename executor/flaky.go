@@ -0,0 +1,124 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// defaultFlakyRetries is how many times a flaky step runs again after failing, unless
+	// SD_FLAKY_RETRIES is set or the step has more retries
+	defaultFlakyRetries = 2
+	// flakinessMetaKey is the key of the build meta with the flakiness of the steps
+	flakinessMetaKey = "flakiness"
+)
+
+// Returns how many times the flaky steps run again after failing, SD_FLAKY_RETRIES in the
+// launcher environment or 2
+func flakyRetries() (int, error) {
+	value := strings.TrimSpace(os.Getenv("SD_FLAKY_RETRIES"))
+	if value == "" {
+		return defaultFlakyRetries, nil
+	}
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		return 0, fmt.Errorf("Invalid SD_FLAKY_RETRIES %q, want a number of retries", value)
+	}
+	return retries, nil
+}
+
+// Returns commands with the flaky ones retried at least retries times
+func withFlakyRetries(commands []screwdriver.CommandDef, retries int) []screwdriver.CommandDef {
+	withRetries := make([]screwdriver.CommandDef, len(commands))
+	for i, cmd := range commands {
+		if cmd.Flaky && cmd.Retries < retries {
+			cmd.Retries = retries
+		}
+		withRetries[i] = cmd
+	}
+	return withRetries
+}
+
+// stepFlakiness is the history of a step run again after failing, over the builds of the job
+type stepFlakiness struct {
+	// Runs is the number of builds that ran the step, PassedOnRetry the ones where it failed
+	// before passing
+	Runs          int `json:"runs"`
+	PassedOnRetry int `json:"passedOnRetry"`
+	// LastPassedOnRetry is the ID of the last build where the step passed on retry
+	LastPassedOnRetry int `json:"lastPassedOnRetry,omitempty"`
+}
+
+// flakinessMeta is the flakiness of the steps in the build meta: the history of every step that
+// can be retried, and the steps that passed on retry in the build, quarantined from the steps
+// that passed
+type flakinessMeta struct {
+	Steps         map[string]stepFlakiness `json:"steps"`
+	PassedOnRetry []string                 `json:"passedOnRetry"`
+}
+
+// flakinessTracker records whether the steps that can be retried passed on retry
+type flakinessTracker struct {
+	// steps tell whether each step passed on retry, by name
+	steps map[string]bool
+}
+
+func newFlakinessTracker() *flakinessTracker {
+	return &flakinessTracker{steps: map[string]bool{}}
+}
+
+// Records how the step of cmd stopped, if it can be retried
+func (t *flakinessTracker) add(cmd screwdriver.CommandDef, details screwdriver.StepStopDetails) {
+	if cmd.Retries > 0 && !details.Skipped {
+		t.steps[cmd.Name] = details.PassedOnRetry
+	}
+}
+
+// Returns the flakiness of the steps of the build buildID, adding the steps it ran to the history
+// of the meta of the previous build, nil if no step can be retried
+func (t *flakinessTracker) meta(previous map[string]interface{}, buildID int) *flakinessMeta {
+	if len(t.steps) == 0 {
+		return nil
+	}
+	m := &flakinessMeta{Steps: map[string]stepFlakiness{}, PassedOnRetry: []string{}}
+	var old flakinessMeta
+	if data, err := json.Marshal(previous[flakinessMetaKey]); err == nil && json.Unmarshal(data, &old) == nil {
+		for name, history := range old.Steps {
+			m.Steps[name] = history
+		}
+	}
+	for name, passedOnRetry := range t.steps {
+		history := m.Steps[name]
+		history.Runs++
+		if passedOnRetry {
+			history.PassedOnRetry++
+			history.LastPassedOnRetry = buildID
+			m.PassedOnRetry = append(m.PassedOnRetry, name)
+		}
+		m.Steps[name] = history
+	}
+	sort.Strings(m.PassedOnRetry)
+	return m
+}
+
+// Sets the flakiness of the steps of build in the build meta at metaPath, from the history in the
+// meta of the last successful build of the job
+func (t *flakinessTracker) write(api screwdriver.API, build screwdriver.Build, metaPath string) error {
+	if len(t.steps) == 0 || metaPath == "" {
+		return nil
+	}
+	previous, err := api.LastSuccessfulMeta(build.JobID)
+	if err != nil {
+		return fmt.Errorf("Fetching the meta of the last successful build: %v", err)
+	}
+	m := t.meta(previous, build.ID)
+	return updateBuildMeta(metaPath, func(meta map[string]interface{}) {
+		meta[flakinessMetaKey] = m
+	})
+}
@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestFlakyRetries(t *testing.T) {
+	defer os.Setenv("SD_FLAKY_RETRIES", os.Getenv("SD_FLAKY_RETRIES"))
+	tests := []struct {
+		value   string
+		retries int
+		err     bool
+	}{
+		{"", defaultFlakyRetries, false},
+		{"0", 0, false},
+		{" 5 ", 5, false},
+		{"-1", 0, true},
+		{"many", 0, true},
+	}
+	for _, test := range tests {
+		os.Setenv("SD_FLAKY_RETRIES", test.value)
+		if retries, err := flakyRetries(); retries != test.retries || (err != nil) != test.err {
+			t.Errorf("flakyRetries() with %q = %v, %v, want %v and error %v", test.value, retries, err, test.retries, test.err)
+		}
+	}
+}
+
+func TestWithFlakyRetries(t *testing.T) {
+	commands := []screwdriver.CommandDef{
+		{Name: "test", Flaky: true},
+		{Name: "e2e", Flaky: true, Retries: 5},
+		{Name: "lint"},
+	}
+	got := withFlakyRetries(commands, 2)
+	if got[0].Retries != 2 || got[1].Retries != 5 || got[2].Retries != 0 {
+		t.Errorf("withFlakyRetries() = %+v", got)
+	}
+	if commands[0].Retries != 0 {
+		t.Errorf("withFlakyRetries() should not change its commands")
+	}
+}
+
+func TestFlakinessMeta(t *testing.T) {
+	tracker := newFlakinessTracker()
+	tracker.add(screwdriver.CommandDef{Name: "test", Retries: 2}, screwdriver.StepStopDetails{Attempts: 2, PassedOnRetry: true})
+	tracker.add(screwdriver.CommandDef{Name: "e2e", Retries: 2}, screwdriver.StepStopDetails{})
+	tracker.add(screwdriver.CommandDef{Name: "deploy", Retries: 2}, screwdriver.StepStopDetails{Skipped: true})
+	tracker.add(screwdriver.CommandDef{Name: "lint"}, screwdriver.StepStopDetails{})
+
+	var previous map[string]interface{}
+	json.Unmarshal([]byte(`{"flakiness": {"steps": {
+		"test": {"runs": 9, "passedOnRetry": 1, "lastPassedOnRetry": 12000},
+		"old": {"runs": 3, "passedOnRetry": 0}
+	}, "passedOnRetry": ["test"]}}`), &previous)
+	got := tracker.meta(previous, 12345)
+	want := &flakinessMeta{
+		Steps: map[string]stepFlakiness{
+			"test": {Runs: 10, PassedOnRetry: 2, LastPassedOnRetry: 12345},
+			"e2e":  {Runs: 1},
+			"old":  {Runs: 3},
+		},
+		PassedOnRetry: []string{"test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("meta() = %+v, want %+v", got, want)
+	}
+	if got := newFlakinessTracker().meta(previous, 12345); got != nil {
+		t.Errorf("meta() without steps that can be retried = %+v, want nil", got)
+	}
+}
+
+func TestRunRetriesFlakySteps(t *testing.T) {
+	envFilepath := "/tmp/testFlakySteps"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "flaky")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metaPath := filepath.Join(dir, "meta.json")
+	defer os.Setenv("SD_FLAKY_RETRIES", os.Getenv("SD_FLAKY_RETRIES"))
+	os.Setenv("SD_FLAKY_RETRIES", "")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			// Fails the first time only
+			{Name: "test", Cmd: `if [ -f "$SD_META_PATH.ran" ]; then echo passed; else touch "$SD_META_PATH.ran"; exit 1; fi`, Flaky: true},
+			{Name: "lint", Cmd: "true"},
+		},
+		Environment: []map[string]string{},
+	}
+	details := map[string]screwdriver.StepStopDetails{}
+	testAPI := screwdriver.API(MockAPI{
+		stepStopDetails: func(stepName string, d screwdriver.StepStopDetails) {
+			details[stepName] = d
+		},
+		lastMeta: func(jobID int) (map[string]interface{}, error) {
+			return map[string]interface{}{"flakiness": map[string]interface{}{"steps": map[string]interface{}{"test": map[string]interface{}{"runs": 4}}}}, nil
+		},
+	})
+	emitter := &MockEmitter{}
+	if err := Run(dir, []string{"SD_META_PATH=" + metaPath}, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := details["test"]; got.Attempts != 2 || !got.PassedOnRetry {
+		t.Errorf("The flaky step should pass on retry, got %+v", got)
+	}
+	if got := details["lint"]; got.Attempts != 0 || got.PassedOnRetry {
+		t.Errorf("The step should pass at once, got %+v", got)
+	}
+	if !strings.Contains(string(emitter.found), "The step passed on attempt 2 of 3, it is flaky") {
+		t.Errorf("The step log should say the step passed on retry, got %q", emitter.found)
+	}
+
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var meta struct {
+		Flakiness flakinessMeta `json:"flakiness"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := flakinessMeta{Steps: map[string]stepFlakiness{"test": {Runs: 5, PassedOnRetry: 1, LastPassedOnRetry: 12345}}, PassedOnRetry: []string{"test"}}
+	if !reflect.DeepEqual(meta.Flakiness, want) {
+		t.Errorf("Flakiness in the meta = %+v, want %+v", meta.Flakiness, want)
+	}
+}
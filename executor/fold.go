@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Logs marker with the emitter under the output scanners wrapping it in emitter, if it folds the
+// log. The output scanners pass the output on as it is written, so the marker keeps its place.
+func foldLog(emitter screwdriver.Emitter, marker screwdriver.FoldMarker) {
+	for {
+		if e, ok := emitter.(screwdriver.FoldEmitter); ok {
+			e.Fold(marker)
+			return
+		}
+		scanner, ok := emitter.(outputScanner)
+		if !ok {
+			return
+		}
+		emitter = scanner.Unwrap()
+	}
+}
+
+// Marks the begin of the step name in the log of emitter
+func foldStepBegin(emitter screwdriver.Emitter, name string) {
+	foldLog(emitter, screwdriver.FoldMarker{Fold: screwdriver.FoldBegin, Phase: screwdriver.FoldPhaseStep, Step: name})
+}
+
+// Marks the end of the step name, which started at start, in the log of emitter
+func foldStepEnd(emitter screwdriver.Emitter, name string, start time.Time) {
+	foldLog(emitter, screwdriver.FoldMarker{Fold: screwdriver.FoldEnd, Phase: screwdriver.FoldPhaseStep, Step: name, DurationMs: time.Since(start).Milliseconds()})
+}
+
+// phaseFold is the fold of a phase of the build in the log, from its begin to its end
+type phaseFold struct {
+	emitter screwdriver.Emitter
+	phase   string
+	start   time.Time
+	ended   bool
+}
+
+// Marks the begin of phase in the log of emitter
+func beginPhase(emitter screwdriver.Emitter, phase string) *phaseFold {
+	foldLog(emitter, screwdriver.FoldMarker{Fold: screwdriver.FoldBegin, Phase: phase})
+	return &phaseFold{emitter: emitter, phase: phase, start: time.Now()}
+}
+
+// Marks the end of the phase in the log, once
+func (p *phaseFold) end() {
+	if p.ended {
+		return
+	}
+	p.ended = true
+	foldLog(p.emitter, screwdriver.FoldMarker{Fold: screwdriver.FoldEnd, Phase: p.phase, DurationMs: time.Since(p.start).Milliseconds()})
+}
@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+// foldingEmitter is a MockEmitter folding the log
+type foldingEmitter struct {
+	MockEmitter
+	markers []screwdriver.FoldMarker
+}
+
+func (e *foldingEmitter) Fold(marker screwdriver.FoldMarker) {
+	e.markers = append(e.markers, marker)
+}
+
+func TestRunFoldsLog(t *testing.T) {
+	envFilepath := "/tmp/testFold"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "sd-setup-init", Cmd: "echo init"},
+			{Name: "test", Cmd: "echo test"},
+			{Name: "teardown-clean", Cmd: "echo clean"},
+		},
+		Environment: []map[string]string{},
+	}
+	emitter := &foldingEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, marker := range emitter.markers {
+		got = append(got, marker.Fold+" "+marker.Phase+" "+marker.Step)
+		if marker.Fold == screwdriver.FoldBegin && marker.DurationMs != 0 {
+			t.Errorf("The begin of a fold should have no duration: %+v", marker)
+		}
+	}
+	assert.Equal(t, []string{
+		"begin setup ",
+		"begin step sd-setup-init",
+		"end step sd-setup-init",
+		"end setup ",
+		"begin step test",
+		"end step test",
+		"begin teardown ",
+		"begin step teardown-clean",
+		"end step teardown-clean",
+		"end teardown ",
+	}, got)
+}
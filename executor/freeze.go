@@ -0,0 +1,169 @@
+package executor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// cronField is a field of a freeze window: its bounds and the names its values can have
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{"day of week", 0, 7, []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// freezeWindow is a freeze window of the job, a cron expression of the minutes in UTC during which
+// its deployment steps do not run, e.g. "* 10-21 ? * MON-FRI"
+type freezeWindow struct {
+	expr string
+	// fields are the values matched by each field, by value
+	fields [5]map[int]bool
+	// anyDay tells whether the day of month or the day of week field is * or ?
+	anyDay bool
+}
+
+// Parses the freeze window cron expression expr: minute, hour, day of month, month and day of week,
+// each a *, a ? or a comma separated list of values, ranges and steps
+func parseFreezeWindow(expr string) (freezeWindow, error) {
+	w := freezeWindow{expr: expr}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return w, fmt.Errorf("Invalid freeze window %q, want 5 fields", expr)
+	}
+	for i, part := range parts {
+		values, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return w, fmt.Errorf("Invalid freeze window %q: %v", expr, err)
+		}
+		w.fields[i] = values
+	}
+	// Sunday is 0 or 7
+	if w.fields[4][7] {
+		w.fields[4][0] = true
+	}
+	w.anyDay = isAnyCron(parts[2]) || isAnyCron(parts[4])
+	return w, nil
+}
+
+func isAnyCron(part string) bool {
+	return part == "*" || part == "?"
+}
+
+// Returns the values matched by the part of a cron expression for field
+func parseCronField(part string, field cronField) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, item := range strings.Split(part, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("Invalid step %q of the %s", item[i+1:], field.name)
+			}
+			rng, step = item[:i], n
+		}
+		first, last := field.min, field.max
+		if !isAnyCron(rng) {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if first, err = cronValue(bounds[0], field); err != nil {
+				return nil, err
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = cronValue(bounds[1], field); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				last = field.max
+			}
+			if last < first {
+				return nil, fmt.Errorf("Invalid range %q of the %s", rng, field.name)
+			}
+		}
+		for v := first; v <= last; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Returns the value of a number or name in field
+func cronValue(s string, field cronField) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(s, name) {
+			return field.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < field.min || v > field.max {
+		return 0, fmt.Errorf("Invalid %s %q", field.name, s)
+	}
+	return v, nil
+}
+
+// Reports whether the minute of t in UTC is in the freeze window. As with cron, a day matches if
+// it matches the day of month or the day of week when both are restricted.
+func (w freezeWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	if !w.fields[0][t.Minute()] || !w.fields[1][t.Hour()] || !w.fields[3][int(t.Month())] {
+		return false
+	}
+	dayOfMonth, dayOfWeek := w.fields[2][t.Day()], w.fields[4][int(t.Weekday())]
+	if w.anyDay {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// freezeWindows are the freeze windows of the job of a build
+type freezeWindows []freezeWindow
+
+// Returns the freeze windows of the job of build if it has deployment steps among commands, from
+// the API
+func loadFreezeWindows(api screwdriver.API, build screwdriver.Build, commands []screwdriver.CommandDef) (freezeWindows, error) {
+	deploys := false
+	for _, cmd := range commands {
+		deploys = deploys || cmd.Deployment
+	}
+	if !deploys {
+		return nil, nil
+	}
+	job, err := api.JobFromID(build.JobID)
+	if err != nil {
+		return nil, fmt.Errorf("Fetching the job: %v", err)
+	}
+	var windows freezeWindows
+	for _, expr := range job.FreezeWindows() {
+		w, err := parseFreezeWindow(expr)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// Returns the Frozen error of the deployment step cmd if t is in a freeze window, or nil
+func (ws freezeWindows) check(cmd screwdriver.CommandDef, t time.Time) *Frozen {
+	if !cmd.Deployment {
+		return nil
+	}
+	for _, w := range ws {
+		if w.contains(t) {
+			return &Frozen{Step: cmd.Name, Window: w.expr}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package executor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestFreezeWindowContains(t *testing.T) {
+	// A Friday
+	friday := time.Date(2021, time.March, 12, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", friday, true},
+		{"* 10-21 ? * MON-FRI", friday, true},
+		{"* 10-21 ? * MON-FRI", friday.Add(7 * time.Hour), false},
+		{"* * ? * SAT,SUN", friday, false},
+		{"* * ? * SAT,SUN", friday.AddDate(0, 0, 2), true},
+		{"* * ? * 7", friday.AddDate(0, 0, 2), true},
+		{"*/15 * * * *", friday, true},
+		{"*/15 * * * *", friday.Add(time.Minute), false},
+		{"0-29 * * * *", friday, false},
+		{"* * 24-31 DEC ?", time.Date(2021, time.December, 25, 0, 0, 0, 0, time.UTC), true},
+		{"* * 24-31 DEC ?", time.Date(2021, time.November, 25, 0, 0, 0, 0, time.UTC), false},
+		// Either day matches when both are restricted, as with cron
+		{"* * 1 * FRI", friday, true},
+		{"* * 1 * MON", friday, false},
+		// The windows are in UTC
+		{"* 15 * * *", friday.In(time.FixedZone("PST", -8*3600)), true},
+	}
+	for _, test := range tests {
+		w, err := parseFreezeWindow(test.expr)
+		if err != nil {
+			t.Fatalf("parseFreezeWindow(%q) = %v", test.expr, err)
+		}
+		if got := w.contains(test.t); got != test.want {
+			t.Errorf("%q contains %v = %v, want %v", test.expr, test.t, got, test.want)
+		}
+	}
+}
+
+func TestParseFreezeWindowErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 5-1 * * *", "* * * FOO *", "*/0 * * * *", "* * * * * *"} {
+		if _, err := parseFreezeWindow(expr); err == nil {
+			t.Errorf("parseFreezeWindow(%q) should fail", expr)
+		}
+	}
+}
+
+func TestLoadFreezeWindows(t *testing.T) {
+	fetched := 0
+	testAPI := MockAPI{
+		jobFromID: func(jobID int) (screwdriver.Job, error) {
+			fetched++
+			return screwdriver.Job{ID: jobID, Permutations: []screwdriver.JobPermutation{{FreezeWindows: []string{"* * ? * SAT,SUN"}}}}, nil
+		},
+	}
+	build := screwdriver.Build{ID: 12345, JobID: 1555}
+
+	windows, err := loadFreezeWindows(testAPI, build, []screwdriver.CommandDef{{Name: "test"}})
+	if err != nil || windows != nil || fetched != 0 {
+		t.Errorf("loadFreezeWindows() without deployment steps = %v, %v, fetched the job %d times", windows, err, fetched)
+	}
+	windows, err = loadFreezeWindows(testAPI, build, []screwdriver.CommandDef{{Name: "deploy", Deployment: true}})
+	if err != nil || len(windows) != 1 {
+		t.Fatalf("loadFreezeWindows() = %v, %v, want a window", windows, err)
+	}
+	saturday := time.Date(2021, time.March, 13, 15, 30, 0, 0, time.UTC)
+	if frozen := windows.check(screwdriver.CommandDef{Name: "test"}, saturday); frozen != nil {
+		t.Errorf("check() should not freeze a step that is not a deployment, got %v", frozen)
+	}
+	if frozen := windows.check(screwdriver.CommandDef{Name: "deploy", Deployment: true}, saturday.AddDate(0, 0, -1)); frozen != nil {
+		t.Errorf("check() should not freeze a deployment step out of the windows, got %v", frozen)
+	}
+	if frozen := windows.check(screwdriver.CommandDef{Name: "deploy", Deployment: true}, saturday); frozen == nil || frozen.Window != "* * ? * SAT,SUN" {
+		t.Errorf("check() should freeze a deployment step in a window, got %v", frozen)
+	}
+}
+
+func TestRunFreezesDeploymentSteps(t *testing.T) {
+	envFilepath := "/tmp/testFreezeWindows"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID:    12345,
+		JobID: 1555,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: "echo tested"},
+			{Name: "deploy", Cmd: "echo deployed", Deployment: true},
+			{Name: "teardown-notify", Cmd: "echo notified"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		jobFromID: func(jobID int) (screwdriver.Job, error) {
+			return screwdriver.Job{ID: jobID, Permutations: []screwdriver.JobPermutation{{FreezeWindows: []string{"* * * * *"}}}}, nil
+		},
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			codes[stepName] = exitCode
+			return nil
+		},
+	})
+	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if !errors.Is(err, ErrFrozen) {
+		t.Errorf("Run() = %v, want a frozen step", err)
+	}
+	want := map[string]int{"test": ExitOk, "deploy": ExitBlocked, "teardown-notify": ExitOk}
+	for step, code := range want {
+		if got, ok := codes[step]; !ok || got != code {
+			t.Errorf("Exit code of %q = %d (ran %v), want %d", step, got, ok, code)
+		}
+	}
+}
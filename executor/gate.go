@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// defaultApprovalPollInterval is how often the approval of a gate step is fetched, unless
+// SD_APPROVAL_POLL_INTERVAL is set
+const defaultApprovalPollInterval = 10 * time.Second
+
+// Returns how often the approval of the gate steps is fetched, SD_APPROVAL_POLL_INTERVAL seconds in
+// the launcher environment or 10 seconds
+func approvalPollInterval() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("SD_APPROVAL_POLL_INTERVAL"))
+	if value == "" {
+		return defaultApprovalPollInterval, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("Invalid SD_APPROVAL_POLL_INTERVAL %q, want a number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Returns an error if cmd is a gate step that also runs something, or a teardown
+func checkGate(cmd screwdriver.CommandDef, stepType string) error {
+	if cmd.Gate == nil {
+		return nil
+	}
+	if stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown {
+		return fmt.Errorf("Teardown %q cannot be a gate", cmd.Name)
+	}
+	if cmd.Cmd != "" || cmd.Script != "" || cmd.Image != "" || cmd.Container != "" || cmd.Condition != "" {
+		return fmt.Errorf("Gate step %q cannot have a command, script, image, container or condition", cmd.Name)
+	}
+	return nil
+}
+
+// approvalGate waits for the approval of the gate steps of a build
+type approvalGate struct {
+	api      screwdriver.API
+	buildID  int
+	interval time.Duration
+}
+
+// Reports the gate step cmd as waiting for approval, then fetches its approval every interval until
+// it is approved or rejected, the step times out, or the build times out or is aborted on
+// invokeTimeout or sig. Returns the exit code and error of the step, an InfraError if the approval
+// cannot be requested.
+func (g approvalGate) wait(cmd screwdriver.CommandDef, out io.Writer, invokeTimeout, sig <-chan error) (int, error) {
+	if err := g.api.RequestStepApproval(g.buildID, cmd.Name, cmd.Gate.Message); err != nil {
+		return ExitUnknown, InfraError{fmt.Sprintf("Requesting the approval of step %q", cmd.Name), err}
+	}
+	if cmd.Gate.Message != "" {
+		launcherf(out, "Waiting for approval: %s\n", cmd.Gate.Message)
+	} else {
+		launcherf(out, "Waiting for approval\n")
+	}
+
+	var stepTimeout <-chan time.Time
+	if cmd.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(cmd.Timeout) * time.Second)
+		defer timer.Stop()
+		stepTimeout = timer.C
+	}
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		approval, err := g.api.GetStepApproval(g.buildID, cmd.Name)
+		if err != nil {
+			logger.Warnf("Failed to fetch the approval of step %q: %v", cmd.Name, err)
+		}
+		switch approval.Status {
+		case screwdriver.ApprovalApproved:
+			launcherf(out, "Approved by %s\n", approvalBy(approval))
+			return ExitOk, nil
+		case screwdriver.ApprovalRejected:
+			launcherf(out, "Rejected by %s\n", approvalBy(approval))
+			return 1, ApprovalRejected{Step: cmd.Name, By: approval.By, Message: approval.Message}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stepTimeout:
+			err := StepTimeout{cmd.Name, time.Duration(cmd.Timeout) * time.Second}
+			launcherf(out, "%v\n", err)
+			return ExitTimeout, err
+		case buildTimeout := <-invokeTimeout:
+			launcherf(out, "%v\n", buildTimeout)
+			return ExitTimeout, withStep(buildTimeout, cmd.Name)
+		case stepAbort := <-sig:
+			launcherf(out, "%v\n", stepAbort)
+			return ExitAborted, withStep(stepAbort, cmd.Name)
+		}
+	}
+}
+
+// Returns who approved or rejected approval, with their message
+func approvalBy(approval screwdriver.StepApproval) string {
+	by := approval.By
+	if by == "" {
+		by = "unknown"
+	}
+	if approval.Message != "" {
+		return fmt.Sprintf("%s: %s", by, approval.Message)
+	}
+	return by
+}
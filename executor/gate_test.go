@@ -0,0 +1,111 @@
+package executor
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestApprovalPollInterval(t *testing.T) {
+	defer os.Setenv("SD_APPROVAL_POLL_INTERVAL", os.Getenv("SD_APPROVAL_POLL_INTERVAL"))
+	os.Setenv("SD_APPROVAL_POLL_INTERVAL", "")
+	if interval, err := approvalPollInterval(); interval != defaultApprovalPollInterval || err != nil {
+		t.Errorf("approvalPollInterval() = %v, %v, want %v", interval, err, defaultApprovalPollInterval)
+	}
+	for _, value := range []string{"0", "-5", "soon"} {
+		os.Setenv("SD_APPROVAL_POLL_INTERVAL", value)
+		if _, err := approvalPollInterval(); err == nil {
+			t.Errorf("approvalPollInterval() with %q should fail", value)
+		}
+	}
+}
+
+func TestCheckGate(t *testing.T) {
+	gate := &screwdriver.StepGate{Message: "Deploy?"}
+	tests := []struct {
+		cmd      screwdriver.CommandDef
+		stepType string
+		err      bool
+	}{
+		{screwdriver.CommandDef{Name: "approve", Gate: gate}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "deploy", Cmd: "make deploy"}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "approve", Gate: gate, Cmd: "make deploy"}, screwdriver.StepTypeUser, true},
+		{screwdriver.CommandDef{Name: "approve", Gate: gate, Condition: "true"}, screwdriver.StepTypeUser, true},
+		{screwdriver.CommandDef{Name: "teardown-approve", Gate: gate}, screwdriver.StepTypeTeardown, true},
+	}
+	for _, test := range tests {
+		if err := checkGate(test.cmd, test.stepType); (err != nil) != test.err {
+			t.Errorf("checkGate(%+v) = %v, want error %v", test.cmd, err, test.err)
+		}
+	}
+}
+
+func TestRunGateStep(t *testing.T) {
+	envFilepath := "/tmp/testGateStep"
+	defer os.Setenv("SD_APPROVAL_POLL_INTERVAL", os.Getenv("SD_APPROVAL_POLL_INTERVAL"))
+	os.Setenv("SD_APPROVAL_POLL_INTERVAL", "1")
+
+	tests := []struct {
+		name     string
+		status   string
+		timeout  int
+		code     int
+		err      error
+		deployed bool
+	}{
+		{"approved", screwdriver.ApprovalApproved, 0, ExitOk, nil, true},
+		{"rejected", screwdriver.ApprovalRejected, 0, 1, ApprovalRejected{Step: "approve", By: "jdoe", Message: "Not today"}, false},
+		{"timeout", screwdriver.ApprovalWaiting, 1, ExitTimeout, StepTimeout{"approve", 1e9}, false},
+	}
+	for _, test := range tests {
+		setupTestCase(t, envFilepath)
+		testBuild := screwdriver.Build{
+			ID: 12345,
+			Commands: []screwdriver.CommandDef{
+				{Name: "approve", Gate: &screwdriver.StepGate{Message: "Deploy to production?"}, Timeout: test.timeout},
+				{Name: "deploy", Cmd: "echo deployed"},
+				{Name: "teardown-cleanup", Cmd: "echo cleaned up"},
+			},
+			Environment: []map[string]string{},
+		}
+		polls := 0
+		codes := map[string]int{}
+		testAPI := screwdriver.API(MockAPI{
+			stepApproval: func(buildID int, stepName string) (screwdriver.StepApproval, error) {
+				// Waits for the first poll
+				polls++
+				if polls == 1 {
+					return screwdriver.StepApproval{Status: screwdriver.ApprovalWaiting}, nil
+				}
+				return screwdriver.StepApproval{Status: test.status, By: "jdoe", Message: "Not today"}, nil
+			},
+			updateStepStop: func(buildID int, stepName string, exitCode int) error {
+				codes[stepName] = exitCode
+				return nil
+			},
+		})
+		emitter := &MockEmitter{}
+		err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+		if test.err == nil && err != nil || test.err != nil && !errors.Is(err, ErrStepFailed) {
+			t.Errorf("%s: Run() = %v, want %v", test.name, err, test.err)
+		}
+		if test.err != nil && err.Error() != test.err.Error() {
+			t.Errorf("%s: Run() = %q, want %q", test.name, err, test.err)
+		}
+		if codes["approve"] != test.code {
+			t.Errorf("%s: exit code of the gate step = %d, want %d", test.name, codes["approve"], test.code)
+		}
+		if _, deployed := codes["deploy"]; deployed != test.deployed {
+			t.Errorf("%s: step after the gate ran = %v, want %v", test.name, deployed, test.deployed)
+		}
+		if _, ok := codes["teardown-cleanup"]; !ok {
+			t.Errorf("%s: the teardown should run after the gate step", test.name)
+		}
+		if !strings.Contains(string(emitter.found), "Waiting for approval: Deploy to production?") {
+			t.Errorf("%s: the step log should say the step waits for approval, got %q", test.name, emitter.found)
+		}
+	}
+}
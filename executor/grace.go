@@ -0,0 +1,78 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// defaultTerminationGrace is how long the processes of a stopped step have to exit before they are
+// killed without SD_TERMINATION_GRACE_PERIOD_SECS, the default of Kubernetes
+const defaultTerminationGrace = 30 * time.Second
+
+// Returns the termination grace period of the build with the environment env, from its
+// SD_TERMINATION_GRACE_PERIOD_SECS
+func terminationGrace(env []string) (time.Duration, error) {
+	value := strings.TrimSpace(lookupEnv(env, "SD_TERMINATION_GRACE_PERIOD_SECS"))
+	if value == "" {
+		return defaultTerminationGrace, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("Invalid SD_TERMINATION_GRACE_PERIOD_SECS %q, want a number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// stoppedStep is a step the launcher stopped, e.g. at a timeout: the processes in the process group
+// of the build shell got SIGTERM, and are killed once the grace period is over
+type stoppedStep struct {
+	c     *exec.Cmd
+	grace time.Duration
+	// kill kills the processes of the step left at the end of the grace period
+	kill *time.Timer
+}
+
+// Stops the step the build shell c runs: the shell gets SIGABRT and the other processes of its
+// process group SIGTERM, and what is left of them is killed after grace
+func stopStepProcesses(c *exec.Cmd, grace time.Duration) *stoppedStep {
+	logger.Debugf("pty: sending SIGABRT to the shell and SIGTERM to its process group")
+	_ = c.Process.Signal(syscall.SIGABRT)
+	killProcessGroup(c, syscall.SIGTERM) // the interactive shell ignores SIGTERM, its children don't
+	return &stoppedStep{
+		c:     c,
+		grace: grace,
+		kill: time.AfterFunc(grace, func() {
+			killProcessGroup(c, syscall.SIGKILL)
+		}),
+	}
+}
+
+// Waits for the step to be done with runErr, up to the grace period, its processes being killed
+// then. The pty f is closed if the output of the step is still being read after that.
+func (s *stoppedStep) wait(f io.Closer, runErr <-chan error) {
+	timer := time.NewTimer(s.grace)
+	defer timer.Stop()
+	select {
+	case <-runErr:
+		return
+	case <-timer.C:
+	}
+	logger.Warnf("The step is still running %v after it was stopped, killing it", s.grace)
+	killProcessGroup(s.c, syscall.SIGKILL)
+	joinStepReader(f, runErr)
+}
+
+// Kills the processes of the step left once the build is over, if the grace period is not over
+// yet. It does nothing on a nil step.
+func (s *stoppedStep) finish() {
+	if s != nil && s.kill.Stop() {
+		killProcessGroup(s.c, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,78 @@
+package executor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminationGrace(t *testing.T) {
+	tests := []struct {
+		env   []string
+		grace time.Duration
+		err   bool
+	}{
+		{grace: defaultTerminationGrace},
+		{env: []string{"SD_TERMINATION_GRACE_PERIOD_SECS= 90 "}, grace: 90 * time.Second},
+		{env: []string{"SD_TERMINATION_GRACE_PERIOD_SECS=0"}, err: true},
+		{env: []string{"SD_TERMINATION_GRACE_PERIOD_SECS=soon"}, err: true},
+	}
+	for _, test := range tests {
+		grace, err := terminationGrace(test.env)
+		if grace != test.grace || (err != nil) != test.err {
+			t.Errorf("terminationGrace(%q) = %v, %v, want %v and error %v", test.env, grace, err, test.grace, test.err)
+		}
+	}
+}
+
+func TestDrainerStepGrace(t *testing.T) {
+	var d *drainer
+	assert.Equal(t, time.Minute, d.stepGrace(time.Minute))
+
+	d = &drainer{}
+	assert.Equal(t, time.Minute, d.stepGrace(time.Minute))
+
+	// The teardowns have the other half of the time left
+	d.notice = &preemptionNotice{reason: "SIGTERM", deadline: time.Now().Add(20 * time.Second)}
+	if grace := d.stepGrace(time.Minute); grace > 10*time.Second || grace < 9*time.Second {
+		t.Errorf("stepGrace() = %v, want half of the time left", grace)
+	}
+	assert.Equal(t, time.Second, d.stepGrace(time.Second))
+}
+
+func TestRunKillsStoppedStepAfterGrace(t *testing.T) {
+	envFilepath := "/tmp/testTerminationGrace"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			// The step and what it runs ignore SIGTERM
+			{Name: "stubborn", Cmd: "trap '' TERM; sleep 60", Timeout: 1},
+			{Name: "teardown-done", Cmd: "echo done"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	api := MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	}
+	emitter := &MockEmitter{}
+	start := time.Now()
+	err := Run("", []string{"SD_TERMINATION_GRACE_PERIOD_SECS=2"}, emitter, testBuild, screwdriver.API(api), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	elapsed := time.Since(start)
+	if want := (StepTimeout{"stubborn", time.Second}); err != want {
+		t.Errorf("Unexpected error: %v, want %v", err, want)
+	}
+	if elapsed < 3*time.Second {
+		t.Errorf("The step should have the grace period to exit, the build took %v", elapsed)
+	}
+	if elapsed > 20*time.Second {
+		t.Errorf("The step should be killed at the end of the grace period, the build took %v", elapsed)
+	}
+	assert.Equal(t, map[string]int{"stubborn": ExitTimeout, "teardown-done": ExitOk}, codes)
+}
@@ -0,0 +1,178 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Phases of the build the health endpoint reports
+const (
+	healthStarting  = "starting"
+	healthSteps     = "steps"
+	healthTeardowns = "teardowns"
+	healthComplete  = "complete"
+)
+
+// HealthStatus is what the status endpoint reports of the build the launcher runs
+type HealthStatus struct {
+	BuildID int    `json:"buildId"`
+	Phase   string `json:"phase"`
+	// Step is the step running, the last one to start when teardowns run in parallel
+	Step               string     `json:"step,omitempty"`
+	Start              time.Time  `json:"start"`
+	ElapsedSeconds     int64      `json:"elapsedSeconds"`
+	StepStart          *time.Time `json:"stepStart,omitempty"`
+	StepElapsedSeconds int64      `json:"stepElapsedSeconds,omitempty"`
+	// LastActivity is when a step last had output, or a step or phase last started or stopped
+	LastActivity time.Time `json:"lastActivity"`
+	Stalled      bool      `json:"stalled"`
+	// Errors are the last warnings and errors of the launcher
+	Errors []logger.Entry `json:"errors"`
+}
+
+// buildHealth follows the progress of the build for the health endpoint
+type buildHealth struct {
+	mu       sync.Mutex
+	buildID  int
+	start    time.Time
+	phase    string
+	step     string
+	stepTime time.Time
+	activity time.Time
+	// stall is how long without activity the build is wedged, 0 if it never is
+	stall time.Duration
+	now   func() time.Time
+}
+
+// health is the progress of the build the launcher runs
+var health = newBuildHealth(time.Now)
+
+func newBuildHealth(now func() time.Time) *buildHealth {
+	start := now()
+	return &buildHealth{start: start, phase: healthStarting, activity: start, now: now}
+}
+
+// ServeHealth serves the health endpoint of build buildID on addr in the background: /healthz
+// answers 200 while the launcher makes progress and 503 once the build had no activity for stall (0
+// for never), and /status the HealthStatus as JSON
+func ServeHealth(addr string, buildID int, stall time.Duration) error {
+	health.mu.Lock()
+	health.buildID, health.stall = buildID, stall
+	health.mu.Unlock()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, health.handler()); err != nil {
+			logger.Warnf("Stopped serving the health endpoint: %v", err)
+		}
+	}()
+	logger.Infof("Serving the health endpoint on %s", listener.Addr())
+	return nil
+}
+
+// Returns the handler of the health and status endpoints
+func (h *buildHealth) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := h.status()
+		if status.Stalled {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "stalled: no activity since %s\n", status.LastActivity.Format(time.RFC3339))
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.status())
+	})
+	return mux
+}
+
+// Returns the status of the build now
+func (h *buildHealth) status() HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	status := HealthStatus{
+		BuildID:        h.buildID,
+		Phase:          h.phase,
+		Step:           h.step,
+		Start:          h.start,
+		ElapsedSeconds: int64(now.Sub(h.start) / time.Second),
+		LastActivity:   h.activity,
+		Stalled:        h.stall > 0 && h.phase != healthComplete && now.Sub(h.activity) >= h.stall,
+		Errors:         logger.Recent(),
+	}
+	if h.step != "" {
+		stepStart := h.stepTime
+		status.StepStart = &stepStart
+		status.StepElapsedSeconds = int64(now.Sub(stepStart) / time.Second)
+	}
+	return status
+}
+
+// Records that the build entered phase
+func (h *buildHealth) setPhase(phase string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.phase, h.activity = phase, h.now()
+}
+
+// Records the start of step name
+func (h *buildHealth) stepStart(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.step, h.stepTime = name, h.now()
+	h.activity = h.stepTime
+}
+
+// Records the stop of step name
+func (h *buildHealth) stepStop(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.step == name {
+		h.step = ""
+	}
+	h.activity = h.now()
+}
+
+// Records output of a step
+func (h *buildHealth) active() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.activity = h.now()
+}
+
+// Returns emitter with its output counting as activity of the build
+func (h *buildHealth) emitter(emitter screwdriver.Emitter) screwdriver.Emitter {
+	return &healthEmitter{Emitter: emitter, h: h}
+}
+
+// healthEmitter records the output of the steps as activity of the build
+type healthEmitter struct {
+	screwdriver.Emitter
+	h *buildHealth
+}
+
+func (e *healthEmitter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		e.h.active()
+	}
+	return e.Emitter.Write(p)
+}
+
+// Unwrap returns the emitter e wraps, the messages of the launcher are no activity of the build
+func (e *healthEmitter) Unwrap() screwdriver.Emitter {
+	return e.Emitter
+}
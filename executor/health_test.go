@@ -0,0 +1,82 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildHealth(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	h := newBuildHealth(func() time.Time { return now })
+	h.buildID, h.stall = 42, 10*time.Minute
+	server := httptest.NewServer(h.handler())
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	status := func() HealthStatus {
+		code, body := get("/status")
+		assert.Equal(t, http.StatusOK, code)
+		var status HealthStatus
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatalf("Invalid status %q: %v", body, err)
+		}
+		return status
+	}
+
+	h.setPhase(healthSteps)
+	now = now.Add(time.Minute)
+	h.stepStart("test")
+	now = now.Add(9 * time.Minute)
+	fmt.Fprintf(h.emitter(&MockEmitter{}), "ok\n")
+	now = now.Add(5 * time.Minute)
+	code, body := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+	s := status()
+	assert.Equal(t, 42, s.BuildID)
+	assert.Equal(t, healthSteps, s.Phase)
+	assert.Equal(t, "test", s.Step)
+	assert.Equal(t, int64(15*60), s.ElapsedSeconds)
+	assert.Equal(t, int64(14*60), s.StepElapsedSeconds)
+	assert.False(t, s.Stalled)
+
+	// A build without activity for the stall timeout is wedged
+	now = now.Add(5 * time.Minute)
+	code, body = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "stalled: no activity since 2021-03-01T10:10:00Z\n", body)
+	logger.Warnf("Failed to update the step start: 401 Unauthorized")
+	s = status()
+	assert.True(t, s.Stalled)
+	if len(s.Errors) == 0 || s.Errors[len(s.Errors)-1].Message != "Failed to update the step start: 401 Unauthorized" {
+		t.Errorf("Unexpected recent errors %+v", s.Errors)
+	}
+
+	h.stepStop("test")
+	s = status()
+	assert.Equal(t, "", s.Step)
+	assert.Nil(t, s.StepStart)
+	assert.False(t, s.Stalled)
+
+	// A complete build is not wedged
+	h.setPhase(healthComplete)
+	now = now.Add(time.Hour)
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,45 @@
+package executor
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// interpreterName matches the interpreters looked up in the PATH of the step, e.g. python3
+var interpreterName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// Checks the interpreter of the step of cmd, if any, is an absolute path or a command name, and
+// that the step runs an inline command in no shell of its own
+func checkInterpreter(cmd screwdriver.CommandDef) error {
+	if cmd.Interpreter == "" {
+		return nil
+	}
+	if !filepath.IsAbs(cmd.Interpreter) && !interpreterName.MatchString(cmd.Interpreter) {
+		return fmt.Errorf("Invalid interpreter %q of step %q, want an absolute path or a command name", cmd.Interpreter, cmd.Name)
+	}
+	if cmd.Shell != "" {
+		return fmt.Errorf("Step %q has both a shell and an interpreter", cmd.Name)
+	}
+	if cmd.Script != "" {
+		return fmt.Errorf("Step %q has both a script and an interpreter", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the path of the file with the command of the step script at path run by its interpreter
+func interpreterScriptPath(path string) string {
+	return strings.TrimSuffix(path, ".sh") + ".script"
+}
+
+// Returns the shebang line running a script with interpreter, found in the PATH unless it is an
+// absolute path
+func interpreterShebang(interpreter string) string {
+	if filepath.IsAbs(interpreter) {
+		return "#!" + interpreter + "\n"
+	}
+	return "#!/usr/bin/env " + interpreter + "\n"
+}
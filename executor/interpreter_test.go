@@ -0,0 +1,91 @@
+package executor
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCheckInterpreter(t *testing.T) {
+	valid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "make test"},
+		{Name: "test", Cmd: "print('hi')", Interpreter: "python3"},
+		{Name: "test", Cmd: "puts 'hi'", Interpreter: "/usr/local/bin/ruby"},
+		{Name: "test", Cmd: "console.log('hi')", Interpreter: "node", User: "nobody"},
+	}
+	for _, cmd := range valid {
+		if err := checkInterpreter(cmd); err != nil {
+			t.Errorf("checkInterpreter(%+v) = %v", cmd, err)
+		}
+	}
+
+	invalid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "print('hi')", Interpreter: "python3 -u"},
+		{Name: "test", Cmd: "print('hi')", Interpreter: "../bin/python3"},
+		{Name: "test", Cmd: "print('hi')", Interpreter: "python3", Shell: "/bin/bash"},
+		{Name: "test", Script: "test.py", Interpreter: "python3"},
+	}
+	for _, cmd := range invalid {
+		if err := checkInterpreter(cmd); err == nil {
+			t.Errorf("Expected an error for %+v", cmd)
+		}
+	}
+}
+
+func TestInterpreterShebang(t *testing.T) {
+	if got, want := interpreterShebang("python3"), "#!/usr/bin/env python3\n"; got != want {
+		t.Errorf("interpreterShebang() = %q, want %q", got, want)
+	}
+	if got, want := interpreterShebang("/usr/bin/perl"), "#!/usr/bin/perl\n"; got != want {
+		t.Errorf("interpreterShebang() = %q, want %q", got, want)
+	}
+}
+
+func TestRunWithInterpreter(t *testing.T) {
+	envFilepath := "/tmp/testInterpreter"
+	setupTestCase(t, envFilepath)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "greet", Cmd: "my $who = \"perl\";\nprint \"hello from $who, answer $ENV{ANSWER}\\n\";", Interpreter: "perl", Env: map[string]string{"ANSWER": "42"}},
+			{Name: "fail", Cmd: "exit 3;", Interpreter: "/usr/bin/perl", AllowFailure: true},
+			{Name: "after", Cmd: "echo still running"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if want := map[string]int{"greet": 0, "fail": 3, "after": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	for _, want := range []string{"\nhello from perl, answer 42\n", "\nstill running\n"} {
+		if !strings.Contains(string(emitter.found), want) {
+			t.Errorf("The output should contain %q, got %q", want, emitter.found)
+		}
+	}
+
+	script, err := ioutil.ReadFile(interpreterScriptPath(stepScriptPath(envFilepath+"_steps", 0, "greet")))
+	if err != nil || !strings.HasPrefix(string(script), "#!/usr/bin/env perl\nmy $who") {
+		t.Errorf("The command should be a perl script: %q, %v", script, err)
+	}
+}
+
+func TestInterpreterTeardown(t *testing.T) {
+	commands := []screwdriver.CommandDef{{Name: "teardown-report", Cmd: "print 1", Interpreter: "python3"}}
+	if _, _, _, err := filterTeardowns(screwdriver.Build{Commands: commands}); err == nil {
+		t.Errorf("Expected an error for a teardown with an interpreter")
+	}
+}
@@ -0,0 +1,184 @@
+package executor
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Returns the clone flags for the namespaces listed in SD_STEP_NAMESPACES from the launcher
+// environment (comma separated, e.g. "mount,pid"), which the user steps run in instead of the
+// ones of the launcher
+func stepNamespaces() (uintptr, error) {
+	var flags uintptr
+	for _, name := range strings.Split(os.Getenv("SD_STEP_NAMESPACES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		flag, ok := stepNamespaceFlags[name]
+		if !ok && len(stepNamespaceFlags) == 0 {
+			return 0, fmt.Errorf("Namespaces are not supported on %s", runtime.GOOS)
+		}
+		if !ok {
+			return 0, fmt.Errorf("Unknown namespace %q, want mount, pid, net, ipc or uts", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// confineCommand is the first argument of the launcher when it is re-executed to start a step
+// under a seccomp or AppArmor profile or with fewer capabilities, see Confine
+const confineCommand = "sd-confine-step"
+
+// stepIsolation is how the user steps are isolated from the launcher. The zero value runs them
+// like the launcher.
+type stepIsolation struct {
+	namespaces      uintptr
+	seccompProfile  string
+	apparmorProfile string
+	// capabilities are the comma separated capabilities the steps keep, or "none". Empty keeps
+	// them all.
+	capabilities string
+}
+
+// Reads how to isolate the user steps from the launcher environment: the namespaces of
+// SD_STEP_NAMESPACES, the seccomp profile at SD_STEP_SECCOMP_PROFILE, the AppArmor profile
+// SD_STEP_APPARMOR_PROFILE and the capabilities of SD_STEP_CAPABILITIES
+func loadStepIsolation() (stepIsolation, error) {
+	namespaces, err := stepNamespaces()
+	if err != nil {
+		return stepIsolation{}, fmt.Errorf("Reading SD_STEP_NAMESPACES: %v", err)
+	}
+
+	isolation := stepIsolation{
+		namespaces:      namespaces,
+		seccompProfile:  strings.TrimSpace(os.Getenv("SD_STEP_SECCOMP_PROFILE")),
+		apparmorProfile: strings.TrimSpace(os.Getenv("SD_STEP_APPARMOR_PROFILE")),
+	}
+	// Catch a broken profile before the build starts rather than in every step
+	if isolation.seccompProfile != "" {
+		if _, err := loadSeccompProfile(isolation.seccompProfile); err != nil {
+			return stepIsolation{}, err
+		}
+	}
+
+	if list := strings.TrimSpace(os.Getenv("SD_STEP_CAPABILITIES")); list != "" {
+		capabilities, err := parseCapabilities(list)
+		if err != nil {
+			return stepIsolation{}, fmt.Errorf("Reading SD_STEP_CAPABILITIES: %v", err)
+		}
+		// Steps started by another user than root have no capabilities to drop
+		if os.Geteuid() == 0 {
+			isolation.capabilities = "none"
+			if len(capabilities) > 0 {
+				isolation.capabilities = strings.Join(capabilities, ",")
+			}
+		}
+	}
+	return isolation, nil
+}
+
+// Returns the command running name with args isolated from the launcher. Under a seccomp or
+// AppArmor profile or with fewer capabilities the launcher itself is run, to apply them right
+// before executing name.
+func (s stepIsolation) command(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	var c *exec.Cmd
+	if s.seccompProfile == "" && s.apparmorProfile == "" && s.capabilities == "" {
+		c = exec.CommandContext(ctx, name, args...)
+	} else {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("Finding the launcher executable: %v", err)
+		}
+		confineArgs := []string{confineCommand, "-seccomp", s.seccompProfile, "-apparmor", s.apparmorProfile, "-capabilities", s.capabilities, "--", name}
+		c = exec.CommandContext(ctx, self, append(confineArgs, args...)...)
+	}
+
+	c.SysProcAttr = isolatedProcAttr(s.namespaces)
+	return c, nil
+}
+
+// Confine runs a step when the launcher was re-executed to start it under a seccomp or AppArmor
+// profile or with fewer capabilities: it applies them and executes the step, never returning.
+// Otherwise it returns right away. The launcher calls it first thing in main.
+func Confine() {
+	if len(os.Args) < 2 || os.Args[1] != confineCommand {
+		return
+	}
+
+	err := confine(os.Args[2:])
+	fmt.Fprintf(os.Stderr, "Error starting the step under its security profile: %v\n", err)
+	os.Exit(ExitLaunch)
+}
+
+// Applies the profiles and capabilities given in args and executes the command following them
+func confine(args []string) error {
+	flags := flag.NewFlagSet(confineCommand, flag.ContinueOnError)
+	seccompProfile := flags.String("seccomp", "", "Seccomp profile to load")
+	apparmorProfile := flags.String("apparmor", "", "AppArmor profile to change to")
+	capabilities := flags.String("capabilities", "", "Capabilities to keep, or none")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("No command to run")
+	}
+
+	path, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var filter seccompFilter
+	if *seccompProfile != "" {
+		if filter, err = loadSeccompProfile(*seccompProfile); err != nil {
+			return err
+		}
+	}
+	keep, err := parseCapabilities(*capabilities)
+	if err != nil {
+		return err
+	}
+
+	// The profiles and capabilities apply to the calling thread, which must be the one executing
+	// the step
+	runtime.LockOSThread()
+	if *apparmorProfile != "" {
+		if err := changeAppArmorProfile(*apparmorProfile); err != nil {
+			return err
+		}
+	}
+	// Dropped before the seccomp filter, which may deny prctl and capset
+	if *capabilities != "" {
+		if err := dropCapabilities(keep); err != nil {
+			return err
+		}
+	}
+	if filter != nil {
+		if err := installSeccompFilter(filter); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(path, flags.Args(), os.Environ())
+}
+
+// Makes the next exec of the calling thread switch to the AppArmor profile
+func changeAppArmorProfile(profile string) error {
+	for _, attr := range []string{"/proc/thread-self/attr/apparmor/exec", "/proc/thread-self/attr/exec"} {
+		err := ioutil.WriteFile(attr, []byte("exec "+profile), 0)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("Changing to the AppArmor profile %q: %v", profile, err)
+		}
+	}
+	return fmt.Errorf("Changing to the AppArmor profile %q: AppArmor is not available", profile)
+}
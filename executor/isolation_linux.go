@@ -0,0 +1,21 @@
+package executor
+
+import "syscall"
+
+// Namespaces the user steps can be isolated in, by their name in SD_STEP_NAMESPACES
+var stepNamespaceFlags = map[string]uintptr{
+	"mount": syscall.CLONE_NEWNS,
+	"pid":   syscall.CLONE_NEWPID,
+	"net":   syscall.CLONE_NEWNET,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+}
+
+// Returns the process attributes isolating a user step in the namespaces of cloneflags
+func isolatedProcAttr(cloneflags uintptr) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Cloneflags: cloneflags &^ syscall.CLONE_NEWNS}
+	// Unsharing the mount namespace rather than cloning it makes all the mounts private, so the
+	// mounts of the steps never propagate back to the launcher
+	attr.Unshareflags = cloneflags & syscall.CLONE_NEWNS
+	return attr
+}
@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestStepNamespaces(t *testing.T) {
+	defer os.Unsetenv("SD_STEP_NAMESPACES")
+
+	tests := []struct {
+		value string
+		want  uintptr
+		err   bool
+	}{
+		{"", 0, false},
+		{"pid", syscall.CLONE_NEWPID, false},
+		{" Mount, pid,net ,", syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET, false},
+		{"ipc,uts", syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS, false},
+		{"pid,user", 0, true},
+	}
+
+	for _, test := range tests {
+		os.Setenv("SD_STEP_NAMESPACES", test.value)
+		got, err := stepNamespaces()
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("stepNamespaces(%q) = %x, %v, want %x, error %v", test.value, got, err, test.want, test.err)
+		}
+	}
+
+	attr := isolatedProcAttr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	if attr.Cloneflags != syscall.CLONE_NEWPID || attr.Unshareflags != syscall.CLONE_NEWNS {
+		t.Errorf("isolatedProcAttr() = %+v, want the mount namespace unshared and the others cloned", attr)
+	}
+}
+
+func TestRunIsolatesSteps(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating namespaces needs root")
+	}
+
+	envFilepath := "/tmp/testIsolation"
+	setupTestCase(t, envFilepath)
+	os.Setenv("SD_STEP_NAMESPACES", "mount,pid,net")
+	defer os.Unsetenv("SD_STEP_NAMESPACES")
+
+	// In its own pid namespace the shell is pid 1, and a new network namespace only has loopback
+	isolated := "test $$ -eq 1 && test $(grep -c : /proc/self/net/dev) -eq 1"
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: isolated, Name: "step"},
+			{Cmd: isolated, Name: "teardown-user"},
+			{Cmd: "test $$ -ne 1", Name: "sd-teardown-launcher"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	if err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v, exit codes %v", err, codes)
+	}
+}
+
+func TestConfineErrors(t *testing.T) {
+	if err := confine([]string{"-seccomp", ""}); err == nil || err.Error() != "No command to run" {
+		t.Errorf("confine() without a command = %v", err)
+	}
+	if err := confine([]string{"-seccomp", "/does/not/exist", "--", "sh"}); err == nil {
+		t.Errorf("Expected an error for a missing seccomp profile")
+	}
+	if err := confine([]string{"--", "no-such-shell"}); err == nil {
+		t.Errorf("Expected an error for a missing command")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import "syscall"
+
+// stepNamespaceFlags is empty where there are no namespaces, the steps can't be isolated in any
+var stepNamespaceFlags = map[string]uintptr{}
+
+// Returns the process attributes of a user step, which runs like the launcher without namespaces
+func isolatedProcAttr(cloneflags uintptr) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
@@ -0,0 +1,239 @@
+package executor
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// testResultsFile is the name of the artifact with the results of the test reports
+	testResultsFile = "test-results.json"
+	// maxTestReportBytes bounds the size of a test report the launcher reads
+	maxTestReportBytes = 32 << 20
+	// maxMetaTestFailures bounds the failed tests listed in the build meta, the results have them all
+	maxMetaTestFailures = 20
+	// maxTestFailureMessage bounds the length of the message of a failed test
+	maxTestFailureMessage = 1000
+)
+
+// junitSuite is a testsuite element of a JUnit report, or its testsuites root element
+type junitSuite struct {
+	XMLName xml.Name
+	Name    string       `xml:"name,attr"`
+	Suites  []junitSuite `xml:"testsuite"`
+	Cases   []junitCase  `xml:"testcase"`
+}
+
+// junitCase is a testcase element of a JUnit report
+type junitCase struct {
+	Name      string         `xml:"name,attr"`
+	Classname string         `xml:"classname,attr"`
+	Failures  []junitProblem `xml:"failure"`
+	Errors    []junitProblem `xml:"error"`
+	Skipped   *struct{}      `xml:"skipped"`
+}
+
+// junitProblem is the failure or error element of a failed test
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// testFailure is a failed test of a report, or of a step writing TAP
+type testFailure struct {
+	Report  string `json:"report,omitempty"`
+	Step    string `json:"step,omitempty"`
+	Test    string `json:"test"`
+	Message string `json:"message"`
+}
+
+// testResults are the counts of the tests of the reports and the TAP steps of a build and its
+// failed tests
+type testResults struct {
+	Reports  []string      `json:"reports"`
+	Steps    []string      `json:"steps,omitempty"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Failures []testFailure `json:"failures"`
+}
+
+// Checks the patterns of the test reports of a build, which may have none
+func checkTestReports(reports *screwdriver.TestReports) error {
+	if reports == nil {
+		return nil
+	}
+	for _, pattern := range reports.Patterns {
+		if err := checkArtifactPattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the results of the JUnit reports of sourceDir matching patterns. The reports that cannot
+// be read are left out with a warning, symlinks are never followed.
+func readTestReports(sourceDir string, patterns []string) (testResults, error) {
+	results := testResults{Reports: []string{}, Failures: []testFailure{}}
+	if sourceDir == "" {
+		return results, fmt.Errorf("No source directory to read the test reports of")
+	}
+
+	err := filepath.WalkDir(sourceDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(sourceDir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			if !matchArtifactPattern(pattern, rel) {
+				continue
+			}
+			root, err := parseJUnitReport(file)
+			if err != nil {
+				logger.Warnf("Skipping test report %s: %v", rel, err)
+				return nil
+			}
+			results.Reports = append(results.Reports, rel)
+			results.add(rel, root)
+			return nil
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Parses the JUnit report at path, whose root is a testsuites or a testsuite element
+func parseJUnitReport(path string) (junitSuite, error) {
+	var root junitSuite
+	f, err := os.Open(path)
+	if err != nil {
+		return root, err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil {
+		return root, err
+	} else if info.Size() > maxTestReportBytes {
+		return root, fmt.Errorf("Larger than the limit of %d bytes", maxTestReportBytes)
+	}
+	if err := xml.NewDecoder(io.LimitReader(f, maxTestReportBytes)).Decode(&root); err != nil {
+		return root, fmt.Errorf("Invalid XML: %v", err)
+	}
+	if root.XMLName.Local != "testsuites" && root.XMLName.Local != "testsuite" {
+		return root, fmt.Errorf("Not a JUnit report, the root element is %s", root.XMLName.Local)
+	}
+	return root, nil
+}
+
+// Counts the tests of suite and its nested suites, from the report named report
+func (r *testResults) add(report string, suite junitSuite) {
+	for _, nested := range suite.Suites {
+		r.add(report, nested)
+	}
+	for _, test := range suite.Cases {
+		switch {
+		case len(test.Failures) > 0:
+			r.Failed++
+			r.Failures = append(r.Failures, testFailure{Report: report, Test: test.fullName(), Message: test.Failures[0].message()})
+		case len(test.Errors) > 0:
+			r.Failed++
+			r.Failures = append(r.Failures, testFailure{Report: report, Test: test.fullName(), Message: test.Errors[0].message()})
+		case test.Skipped != nil:
+			r.Skipped++
+		default:
+			r.Passed++
+		}
+	}
+}
+
+// Counts the tests of the TAP step named step, the ones it marked as to do as skipped
+func (r *testResults) addTAP(step string, tests *screwdriver.StepTests) {
+	r.Steps = append(r.Steps, step)
+	r.Passed += tests.Passed
+	r.Failed += tests.Failed
+	r.Skipped += tests.Skipped + tests.Todo
+	for _, failure := range tests.Failures {
+		r.Failures = append(r.Failures, testFailure{Step: step, Test: failure.Test, Message: failure.Message})
+	}
+}
+
+// Returns the name of the test with its class, if it has one
+func (c junitCase) fullName() string {
+	if c.Classname == "" {
+		return c.Name
+	}
+	return c.Classname + "." + c.Name
+}
+
+// Returns the message of the failure, or the first line of its text if it has none
+func (p junitProblem) message() string {
+	message := strings.TrimSpace(p.Message)
+	if message == "" {
+		message = strings.TrimSpace(p.Text)
+		if i := strings.IndexByte(message, '\n'); i >= 0 {
+			message = strings.TrimSpace(message[:i])
+		}
+	}
+	if len(message) > maxTestFailureMessage {
+		message = message[:maxTestFailureMessage] + "..."
+	}
+	return message
+}
+
+// Returns the number of tests of the reports
+func (r testResults) total() int {
+	return r.Passed + r.Failed + r.Skipped
+}
+
+// Writes the results to the artifacts dir if not empty, so they are uploaded, and their summary to
+// the build meta at metaPath if not empty
+func (r testResults) write(artifactsDir, metaPath string) error {
+	if artifactsDir != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(artifactsDir, testResultsFile), append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if metaPath == "" {
+		return nil
+	}
+	return writeTestsMeta(metaPath, r)
+}
+
+// Sets the results of the tests in "tests" of the build meta at metaPath, keeping what the steps
+// set there: "results" as the number of passed tests out of all of them, which the UI shows, the
+// counts of the tests and the first failed ones
+func writeTestsMeta(metaPath string, r testResults) error {
+	failures := r.Failures
+	if len(failures) > maxMetaTestFailures {
+		failures = failures[:maxMetaTestFailures]
+	}
+	return updateBuildMeta(metaPath, func(meta map[string]interface{}) {
+		tests, ok := meta["tests"].(map[string]interface{})
+		if !ok {
+			tests = map[string]interface{}{}
+		}
+		tests["results"] = fmt.Sprintf("%d/%d", r.Passed, r.total())
+		tests["passed"] = r.Passed
+		tests["failed"] = r.Failed
+		tests["skipped"] = r.Skipped
+		tests["failures"] = failures
+		meta["tests"] = tests
+	})
+}
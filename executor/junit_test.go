@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const testJUnitReport = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="executor">
+    <testcase classname="executor" name="TestRun"/>
+    <testcase classname="executor" name="TestTimeout">
+      <failure message="timed out after 10s">executor_test.go:42</failure>
+    </testcase>
+    <testcase classname="executor" name="TestShell"><skipped/></testcase>
+  </testsuite>
+  <testsuite name="screwdriver">
+    <testsuite name="api">
+      <testcase name="TestBuildFromID">
+        <error>panic: nil map
+goroutine 1 [running]</error>
+      </testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>
+`
+
+func TestReadTestReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "junit")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "reports", "unit"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "reports", "unit", "junit.xml"), []byte(testJUnitReport), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "reports", "lint.xml"), []byte(`<testsuite name="lint"><testcase name="vet"/></testsuite>`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "reports", "broken.xml"), []byte("<testsuite>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "reports", "pom.xml"), []byte("<project/>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "junit.xml"), []byte(testJUnitReport), 0644)
+
+	results, err := readTestReports(dir, []string{"reports/**/*.xml"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := testResults{
+		Reports: []string{"reports/lint.xml", "reports/unit/junit.xml"},
+		Passed:  2,
+		Failed:  2,
+		Skipped: 1,
+		Failures: []testFailure{
+			{Report: "reports/unit/junit.xml", Test: "executor.TestTimeout", Message: "timed out after 10s"},
+			{Report: "reports/unit/junit.xml", Test: "TestBuildFromID", Message: "panic: nil map"},
+		},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("readTestReports() = %+v, want %+v", results, want)
+	}
+}
+
+func TestWriteTestsMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "junit")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metaPath := filepath.Join(dir, "meta.json")
+	ioutil.WriteFile(metaPath, []byte(`{"foo":"bar","tests":{"coverage":"80"}}`), 0644)
+
+	results := testResults{Reports: []string{"junit.xml"}, Passed: 7}
+	for i := 0; i <= maxMetaTestFailures; i++ {
+		results.Failed++
+		results.Failures = append(results.Failures, testFailure{Report: "junit.xml", Test: "TestFail", Message: "failed"})
+	}
+	if err := writeTestsMeta(metaPath, results); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var meta struct {
+		Foo   string `json:"foo"`
+		Tests struct {
+			Coverage string        `json:"coverage"`
+			Results  string        `json:"results"`
+			Failed   int           `json:"failed"`
+			Failures []testFailure `json:"failures"`
+		} `json:"tests"`
+	}
+	data, _ := ioutil.ReadFile(metaPath)
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if meta.Foo != "bar" || meta.Tests.Coverage != "80" || meta.Tests.Results != "7/28" ||
+		meta.Tests.Failed != maxMetaTestFailures+1 || len(meta.Tests.Failures) != maxMetaTestFailures {
+		t.Errorf("Unexpected meta %s", data)
+	}
+}
+
+func TestRunFailsOnTestFailures(t *testing.T) {
+	envFilepath := "/tmp/testTestReports"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "junit")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sourceDir := filepath.Join(dir, "src")
+	artifactsDir := filepath.Join(dir, "artifacts")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(artifactsDir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "junit.xml"), []byte(testJUnitReport), 0644)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			// The step masks the exit code of the failed tests
+			{Name: "test", Cmd: "cp " + filepath.Join(dir, "junit.xml") + " " + sourceDir + "/junit.xml || true"},
+			{Name: "teardown-echo", Cmd: "echo teardown"},
+		},
+		Environment: []map[string]string{},
+		TestReports: &screwdriver.TestReports{Patterns: []string{"*.xml"}, FailBuild: true},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	env := []string{"SD_ARTIFACTS_DIR=" + artifactsDir}
+	err = Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, sourceDir)
+	var failures TestFailures
+	if !errors.As(err, &failures) || failures.Failed != 2 || !IsUserFailure(err) {
+		t.Errorf("The failed tests should fail the build: %v", err)
+	}
+	if want := map[string]int{"test": 0, "teardown-echo": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	if _, err := os.Stat(filepath.Join(artifactsDir, testResultsFile)); err != nil {
+		t.Errorf("The test results should be an artifact: %v", err)
+	}
+}
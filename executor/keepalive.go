@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Returns after how long without output a step gets a keep-alive line in its log,
+// SD_KEEPALIVE_INTERVAL seconds in the launcher environment, 0 if it never does
+func keepAliveInterval() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("SD_KEEPALIVE_INTERVAL"))
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("Invalid SD_KEEPALIVE_INTERVAL %q, want a number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// keepAliveEmitter writes a line to the log of a quiet step now and then, so the log consumers and
+// proxies downstream do not time out the idle stream
+type keepAliveEmitter struct {
+	screwdriver.Emitter
+
+	mu   sync.Mutex
+	last time.Time
+	// midLine tells whether the output so far ends in the middle of a line
+	midLine bool
+	stopped bool
+}
+
+func newKeepAliveEmitter(emitter screwdriver.Emitter) *keepAliveEmitter {
+	return &keepAliveEmitter{Emitter: emitter, last: time.Now()}
+}
+
+func (k *keepAliveEmitter) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(p) > 0 {
+		k.last = time.Now()
+		k.midLine = p[len(p)-1] != '\n'
+	}
+	return k.Emitter.Write(p)
+}
+
+// Unwrap returns the emitter k wraps, the messages of the launcher are logged as lines of their
+// own
+func (k *keepAliveEmitter) Unwrap() screwdriver.Emitter {
+	return k.Emitter
+}
+
+// Writes how long the step started at start has been running every time it had no output for
+// interval, until ctx is done
+func (k *keepAliveEmitter) run(ctx context.Context, start time.Time, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			k.mu.Lock()
+			timer := time.NewTimer(time.Until(k.last.Add(interval)))
+			k.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			k.mu.Lock()
+			if now := time.Now(); !k.stopped && now.Sub(k.last) >= interval {
+				newline := ""
+				if k.midLine {
+					newline = "\n"
+				}
+				// Not output of the step, the next line is due after another interval
+				launcherf(k.Emitter, "%sStill running (%s elapsed)\n", newline, formatElapsed(now.Sub(start)))
+				k.last, k.midLine = now, false
+			}
+			k.mu.Unlock()
+		}
+	}()
+}
+
+// Stops the keep-alive lines, none is written once it returns
+func (k *keepAliveEmitter) stop() {
+	k.mu.Lock()
+	k.stopped = true
+	k.mu.Unlock()
+}
+
+// Returns d in whole minutes, e.g. 12m, or in seconds under a minute
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	}
+	return fmt.Sprintf("%dm", int(d/time.Minute))
+}
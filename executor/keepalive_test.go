@@ -0,0 +1,82 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveInterval(t *testing.T) {
+	defer os.Setenv("SD_KEEPALIVE_INTERVAL", os.Getenv("SD_KEEPALIVE_INTERVAL"))
+	tests := []struct {
+		value    string
+		interval time.Duration
+		err      bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{" 300 ", 5 * time.Minute, false},
+		{"-1", 0, true},
+		{"5m", 0, true},
+	}
+	for _, test := range tests {
+		os.Setenv("SD_KEEPALIVE_INTERVAL", test.value)
+		if interval, err := keepAliveInterval(); interval != test.interval || (err != nil) != test.err {
+			t.Errorf("keepAliveInterval() with %q = %v, %v, want %v and error %v", test.value, interval, err, test.interval, test.err)
+		}
+	}
+}
+
+func TestKeepAliveEmitter(t *testing.T) {
+	emitter := &MockEmitter{}
+	k := newKeepAliveEmitter(emitter)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k.run(ctx, time.Now().Add(-12*time.Minute), 50*time.Millisecond)
+
+	fmt.Fprint(k, "Downloading")
+	time.Sleep(130 * time.Millisecond)
+	k.stop()
+	got := string(emitter.found)
+	time.Sleep(100 * time.Millisecond)
+
+	if !regexp.MustCompile(`^Downloading\n((\x1b\[36m)?\[launcher\] Still running \(12m elapsed\)(\x1b\[0m)?\n)+$`).MatchString(got) {
+		t.Errorf("Unexpected output %q", got)
+	}
+	if string(emitter.found) != got {
+		t.Errorf("No line should be written once stopped, got %q", emitter.found)
+	}
+}
+
+func TestKeepAliveEmitterBusyStep(t *testing.T) {
+	emitter := &MockEmitter{}
+	k := newKeepAliveEmitter(emitter)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k.run(ctx, time.Now(), 200*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(k, "line %d\n", i)
+		time.Sleep(50 * time.Millisecond)
+	}
+	k.stop()
+	if want := "line 0\nline 1\nline 2\nline 3\nline 4\n"; string(emitter.found) != want {
+		t.Errorf("A step with output should get no keep-alive line, got %q", emitter.found)
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	tests := map[time.Duration]string{
+		45 * time.Second:                "45s",
+		12*time.Minute + 30*time.Second: "12m",
+		2 * time.Hour:                   "120m",
+	}
+	for d, want := range tests {
+		if got := formatElapsed(d); got != want {
+			t.Errorf("formatElapsed(%v) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// serviceAccountNamespace holds the namespace of the pod, mounted by Kubernetes with the token of
+// its service account
+var serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// kubectlCLI runs the commands in the peer containers through the Kubernetes API
+var kubectlCLI = "kubectl"
+
+// containerNamePattern matches the names of the containers of a pod, DNS labels
+var containerNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// kubernetesPod is the build pod whose peer containers run the steps with a container
+type kubernetesPod struct {
+	name      string
+	namespace string
+}
+
+// Returns the build pod, SD_POD_NAME and SD_POD_NAMESPACE in the launcher environment (e.g. from
+// the downward API), by default the host name and the namespace of the service account
+func newKubernetesPod() (*kubernetesPod, error) {
+	pod := &kubernetesPod{
+		name:      strings.TrimSpace(os.Getenv("SD_POD_NAME")),
+		namespace: strings.TrimSpace(os.Getenv("SD_POD_NAMESPACE")),
+	}
+	if pod.name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Getting the name of the pod: %v", err)
+		}
+		pod.name = hostname
+	}
+	if pod.namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("Reading the namespace of the pod, set SD_POD_NAMESPACE: %v", err)
+		}
+		pod.namespace = strings.TrimSpace(string(data))
+	}
+	return pod, nil
+}
+
+// Checks the container of the step of cmd, if any, is a container name, and that the step runs
+// an inline command in no image or interpreter, as the user of the container, and is no teardown
+func checkPeerContainer(cmd screwdriver.CommandDef, stepType string) error {
+	if cmd.Container == "" {
+		return nil
+	}
+	if !containerNamePattern.MatchString(cmd.Container) {
+		return fmt.Errorf("Invalid container %q of step %q", cmd.Container, cmd.Name)
+	}
+	if cmd.Image != "" || cmd.Interpreter != "" || cmd.User != "" {
+		return fmt.Errorf("Step %q has a container and an image, interpreter or user", cmd.Name)
+	}
+	if stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown {
+		return fmt.Errorf("Teardown %q cannot have a container", cmd.Name)
+	}
+	return nil
+}
+
+// Returns whether a step of commands runs in a peer container
+func usesPeerContainers(commands []screwdriver.CommandDef) bool {
+	for _, cmd := range commands {
+		if cmd.Container != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the pipeline of the build shell printing the shell lines exporting the variables a peer
+// container gets, quoted for any POSIX shell
+func peerEnvCommand() string {
+	return containerEnvCommand() + ` | sed 's/=.*//' | while read -r sd_name; do eval "sd_value=\${$sd_name}"; ` +
+		`printf "export %s='%s'\n" "$sd_name" "$(printf '%s' "$sd_value" | sed "s/'/'\\\\''/g")"; done`
+}
+
+// Returns the command the build shell runs for the step script at path of cmd in its peer
+// container of the pod. The container has no access to the files of the build container, so the
+// exported variables of the build shell and the step script are sent to its shell on stdin, which
+// runs them in the current directory of the build shell, the workspace being a volume they share.
+func (p *kubernetesPod) command(path string, cmd screwdriver.CommandDef) string {
+	args := []string{
+		kubectlCLI, "exec", "-i", "-n", shellQuote(p.namespace), shellQuote(p.name), "-c", shellQuote(cmd.Container),
+		"--", "/bin/sh", "-c", shellQuote(`cd "$0" && exec /bin/sh -e`), `"$PWD"`,
+	}
+	return "{ " + peerEnvCommand() + "; cat " + shellQuote(path) + "; } | " + strings.Join(args, " ")
+}
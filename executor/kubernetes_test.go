@@ -0,0 +1,139 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestNewKubernetesPod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldNamespace := serviceAccountNamespace
+	defer func() { serviceAccountNamespace = oldNamespace }()
+	serviceAccountNamespace = filepath.Join(dir, "namespace")
+	defer os.Unsetenv("SD_POD_NAME")
+	defer os.Unsetenv("SD_POD_NAMESPACE")
+
+	if _, err := newKubernetesPod(); err == nil {
+		t.Errorf("Expected an error without a namespace")
+	}
+
+	ioutil.WriteFile(serviceAccountNamespace, []byte("sd-builds\n"), 0644)
+	hostname, _ := os.Hostname()
+	if pod, err := newKubernetesPod(); err != nil || *pod != (kubernetesPod{hostname, "sd-builds"}) {
+		t.Errorf("newKubernetesPod() = %+v, %v, want %s in sd-builds", pod, err, hostname)
+	}
+
+	os.Setenv("SD_POD_NAME", "build-1234")
+	os.Setenv("SD_POD_NAMESPACE", "ci")
+	if pod, err := newKubernetesPod(); err != nil || *pod != (kubernetesPod{"build-1234", "ci"}) {
+		t.Errorf("newKubernetesPod() = %+v, %v, want build-1234 in ci", pod, err)
+	}
+}
+
+func TestCheckPeerContainer(t *testing.T) {
+	valid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "make test"},
+		{Name: "test", Cmd: "npm test", Container: "node"},
+		{Name: "test", Cmd: "npm test", Container: "node-18", Env: map[string]string{"CI": "true"}},
+	}
+	for _, cmd := range valid {
+		if err := checkPeerContainer(cmd, screwdriver.StepTypeUser); err != nil {
+			t.Errorf("checkPeerContainer(%+v) = %v", cmd, err)
+		}
+	}
+
+	invalid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "npm test", Container: "Node"},
+		{Name: "test", Cmd: "npm test", Container: "-c"},
+		{Name: "test", Cmd: "npm test", Container: "node", Image: "node:18"},
+		{Name: "test", Cmd: "print(1)", Container: "python", Interpreter: "python3"},
+		{Name: "test", Cmd: "npm test", Container: "node", User: "node"},
+	}
+	for _, cmd := range invalid {
+		if err := checkPeerContainer(cmd, screwdriver.StepTypeUser); err == nil {
+			t.Errorf("Expected an error for %+v", cmd)
+		}
+	}
+	if err := checkPeerContainer(screwdriver.CommandDef{Name: "teardown-report", Container: "node"}, screwdriver.StepTypeTeardown); err == nil {
+		t.Errorf("Expected an error for a teardown with a container")
+	}
+}
+
+func TestPeerEnvCommand(t *testing.T) {
+	c := exec.Command("/bin/sh", "-c", "{ "+peerEnvCommand()+`; echo 'printf "%s|%s|%s" "$QUOTE" "$MULTI" "$PATH"'; } | env -i PATH=/bin /bin/sh`)
+	c.Env = []string{"PATH=/usr/bin:/bin", "QUOTE=it's \"$HOME\"", "MULTI=first\nsecond"}
+	output, err := c.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, output)
+	}
+	if got, want := string(output), "it's \"$HOME\"|first\nsecond|/bin"; got != want {
+		t.Errorf("The exported variables = %q, want %q", got, want)
+	}
+}
+
+func TestRunInPeerContainer(t *testing.T) {
+	envFilepath := "/tmp/testPeerContainers"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("SD_POD_NAME", "build-1234")
+	defer os.Unsetenv("SD_POD_NAME")
+	os.Setenv("SD_POD_NAMESPACE", "ci")
+	defer os.Unsetenv("SD_POD_NAMESPACE")
+
+	// Records its arguments and runs the command in place of the container, without the variables
+	// of the build shell
+	argsFile := filepath.Join(dir, "args")
+	cli := filepath.Join(dir, "kubectl")
+	ioutil.WriteFile(cli, []byte("#!/bin/sh\necho \"$@\" >> "+argsFile+"\n"+
+		"while [ \"$1\" != -- ]; do shift; done; shift; exec env -i PATH=\"$PATH\" \"$@\"\n"), 0755)
+	oldCLI := kubectlCLI
+	defer func() { kubectlCLI = oldCLI }()
+	kubectlCLI = cli
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "export", Cmd: "export FOO='bar baz' && cd /tmp"},
+			{Name: "test", Cmd: `echo "test in $(pwd) with $FOO and $ANSWER"`, Container: "node", Env: map[string]string{"ANSWER": "42"}},
+			{Name: "fail", Cmd: "exit 3", Container: "node", AllowFailure: true},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if want := map[string]int{"export": 0, "test": 0, "fail": 3}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	if want := "\ntest in /tmp with bar baz and 42\n"; !strings.Contains(string(emitter.found), want) {
+		t.Errorf("The output should contain %q, got %q", want, emitter.found)
+	}
+
+	data, _ := ioutil.ReadFile(argsFile)
+	if !strings.HasPrefix(string(data), "exec -i -n ci build-1234 -c node -- /bin/sh -c ") {
+		t.Errorf("The step should run in the container node of the pod: %s", data)
+	}
+}
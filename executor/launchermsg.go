@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// launcherPrefix starts the lines of the messages of the launcher itself, e.g. about the timeout
+// of a step, to tell them from the output of the steps
+const launcherPrefix = "[launcher] "
+
+// The color of the messages of the launcher logged as output, cyan
+const (
+	launcherColor = "\x1b[36m"
+	resetColor    = "\x1b[0m"
+)
+
+// wrappingEmitter is an emitter wrapping another one which the messages of the launcher may skip,
+// e.g. to count the output of the steps. Unwrap returns nil if they may not.
+type wrappingEmitter interface {
+	Unwrap() screwdriver.Emitter
+}
+
+// Logs the message of the launcher of format and args to w, an emitter or the output of a step,
+// after the output written so far. The emitter under the wrappers in w logs it as lines of the launcher if it can, after the
+// output scanners wrapping it scan it, or it is written as output, prefixed and colored. A message
+// starting with a newline ends the line of output written so far, if any.
+func launcherf(w io.Writer, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	newline := ""
+	if strings.HasPrefix(message, "\n") {
+		newline, message = "\n", message[1:]
+	}
+	var scanners []outputScanner
+	for e := w; e != nil; {
+		if l, ok := e.(screwdriver.LauncherEmitter); ok {
+			// The emitter ends the line of output before the message itself
+			message = launcherText(message, false)
+			for _, scanner := range scanners {
+				scanner.scanOutput([]byte(newline + message))
+			}
+			l.Launcher(message)
+			return
+		}
+		if scanner, ok := e.(outputScanner); ok {
+			scanners = append(scanners, scanner)
+		}
+		wrapper, ok := e.(wrappingEmitter)
+		if !ok {
+			break
+		}
+		e = wrapper.Unwrap()
+	}
+	fmt.Fprint(w, newline+launcherText(message, colorLauncherText()))
+}
+
+// Tells whether the messages of the launcher logged as output are colored, unless NO_COLOR is set
+// in the launcher environment
+func colorLauncherText() bool {
+	return os.Getenv("NO_COLOR") == ""
+}
+
+// Returns the lines of message, which ends with a newline, with the prefix of the launcher, and
+// colored if color is set
+func launcherText(message string, color bool) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(message, "\n"), "\n") {
+		if color {
+			b.WriteString(launcherColor + launcherPrefix + line + resetColor + "\n")
+		} else {
+			b.WriteString(launcherPrefix + line + "\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+// launcherEmitter is a MockEmitter logging the messages of the launcher apart
+type launcherEmitter struct {
+	MockEmitter
+	messages []string
+}
+
+func (e *launcherEmitter) Launcher(message string) {
+	e.messages = append(e.messages, message)
+}
+
+func TestLauncherf(t *testing.T) {
+	defer os.Setenv("NO_COLOR", os.Getenv("NO_COLOR"))
+
+	os.Setenv("NO_COLOR", "")
+	emitter := &MockEmitter{}
+	fmt.Fprint(emitter, "partial")
+	launcherf(emitter, "\nStep timeout of %v exceeded\nStopping it\n", "1m0s")
+	assert.Equal(t, "partial\n\x1b[36m[launcher] Step timeout of 1m0s exceeded\x1b[0m\n\x1b[36m[launcher] Stopping it\x1b[0m\n", string(emitter.found))
+
+	os.Setenv("NO_COLOR", "1")
+	emitter = &MockEmitter{}
+	launcherf(emitter, "Waiting for approval\n")
+	assert.Equal(t, "[launcher] Waiting for approval\n", string(emitter.found))
+
+	// The output scanners and the wrappers pass the message on to the emitter logging it apart
+	launcher := &launcherEmitter{}
+	summarizer := newFailureSummarizer(launcher, 10)
+	summarizer.StartCmd(screwdriver.CommandDef{Name: "test"})
+	launcherf(newKeepAliveEmitter(summarizer), "\nStep timeout of %v exceeded\n", "1m0s")
+	assert.Equal(t, []string{"[launcher] Step timeout of 1m0s exceeded\n"}, launcher.messages)
+	assert.Empty(t, launcher.found)
+	assert.Equal(t, []string{"", "[launcher] Step timeout of 1m0s exceeded"}, summarizer.steps["test"].lines)
+
+	// A teardown keeping its output for later keeps the messages in it
+	out := &teardownOutput{emitter: launcher, buffered: true}
+	launcherf(out, "Exit code 1, retrying (1 of 2)\n")
+	assert.Len(t, launcher.messages, 1)
+	assert.Equal(t, "[launcher] Exit code 1, retrying (1 of 2)\n", out.buf.String())
+}
+
+func TestRunTagsLauncherMessages(t *testing.T) {
+	envFilepath := "/tmp/testLauncherMessages"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "flaky", Cmd: "echo output; false", AllowFailure: true},
+		},
+		Environment: []map[string]string{},
+	}
+	emitter := &launcherEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assert.Contains(t, emitter.messages, "[launcher] The step failed with exit code 1, which does not fail the build\n")
+	assert.NotContains(t, string(emitter.found), "which does not fail the build")
+	assert.Contains(t, string(emitter.found), "output\n")
+}
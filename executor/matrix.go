@@ -0,0 +1,104 @@
+package executor
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// unsafeNameChars matches what the derived names of the matrix steps replace with _, so they
+// can be used in the API URLs
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Returns commands with every step declaring a matrix replaced by one step per combination of
+// its variables, named after the step and the values and running with the variables set. The
+// variables are sorted by name and the last one changes first.
+func expandMatrix(commands []screwdriver.CommandDef) ([]screwdriver.CommandDef, error) {
+	expanded := []screwdriver.CommandDef{}
+	names := map[string]bool{}
+	for _, cmd := range commands {
+		steps, err := matrixSteps(cmd)
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range steps {
+			if names[step.Name] {
+				return nil, fmt.Errorf("Duplicate step %q", step.Name)
+			}
+			names[step.Name] = true
+		}
+		expanded = append(expanded, steps...)
+	}
+	return expanded, nil
+}
+
+// Returns the steps of the matrix of cmd, or cmd itself if it has none
+func matrixSteps(cmd screwdriver.CommandDef) ([]screwdriver.CommandDef, error) {
+	if len(cmd.Matrix) == 0 {
+		return []screwdriver.CommandDef{cmd}, nil
+	}
+
+	keys := make([]string, 0, len(cmd.Matrix))
+	for key, values := range cmd.Matrix {
+		if !envName.MatchString(key) {
+			return nil, fmt.Errorf("Invalid matrix variable %q of step %q", key, cmd.Name)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("Matrix variable %q of step %q has no values", key, cmd.Name)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Each combination is the index of its value for every variable
+	combination := make([]int, len(keys))
+	var steps []screwdriver.CommandDef
+	for {
+		step := cmd
+		step.Matrix = nil
+		step.Env = map[string]string{}
+		for key, value := range cmd.Env {
+			step.Env[key] = value
+		}
+		parts := []string{cmd.Name}
+		for i, key := range keys {
+			value := cmd.Matrix[key][combination[i]]
+			step.Env[key] = value
+			parts = append(parts, unsafeNameChars.ReplaceAllString(value, "_"))
+		}
+		step.Name = strings.Join(parts, "-")
+		steps = append(steps, step)
+
+		i := len(keys) - 1
+		for ; i >= 0; i-- {
+			if combination[i]++; combination[i] < len(cmd.Matrix[keys[i]]) {
+				break
+			}
+			combination[i] = 0
+		}
+		if i < 0 {
+			return steps, nil
+		}
+	}
+}
+
+// Returns the shell line exporting the variables of a step, or "" if it has none
+func exportStepEnv(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	line := "export"
+	for _, key := range keys {
+		line += " " + key + "=" + shellQuote(env[key])
+	}
+	return line + "\n"
+}
@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	commands := []screwdriver.CommandDef{
+		{Name: "install", Cmd: "npm install"},
+		{
+			Name:   "test",
+			Cmd:    "make test",
+			Env:    map[string]string{"CI": "true"},
+			Matrix: map[string][]string{"OS": {"linux", "mac os"}, "GO": {"1.11", "1.12"}},
+		},
+	}
+	expanded, err := expandMatrix(commands)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []screwdriver.CommandDef{
+		commands[0],
+		{Name: "test-1.11-linux", Cmd: "make test", Env: map[string]string{"CI": "true", "GO": "1.11", "OS": "linux"}},
+		{Name: "test-1.11-mac_os", Cmd: "make test", Env: map[string]string{"CI": "true", "GO": "1.11", "OS": "mac os"}},
+		{Name: "test-1.12-linux", Cmd: "make test", Env: map[string]string{"CI": "true", "GO": "1.12", "OS": "linux"}},
+		{Name: "test-1.12-mac_os", Cmd: "make test", Env: map[string]string{"CI": "true", "GO": "1.12", "OS": "mac os"}},
+	}
+	if !reflect.DeepEqual(expanded, want) {
+		t.Errorf("expandMatrix() = %+v, want %+v", expanded, want)
+	}
+	if commands[1].Env["OS"] != "" {
+		t.Errorf("The variables of the step should not change: %v", commands[1].Env)
+	}
+
+	invalid := [][]screwdriver.CommandDef{
+		{{Name: "test", Matrix: map[string][]string{"1OS": {"linux"}}}},
+		{{Name: "test", Matrix: map[string][]string{"OS": {}}}},
+		{{Name: "test-linux"}, {Name: "test", Matrix: map[string][]string{"OS": {"linux"}}}},
+		{{Name: "test", Matrix: map[string][]string{"OS": {"mac os", "mac/os"}}}},
+	}
+	for _, commands := range invalid {
+		if _, err := expandMatrix(commands); err == nil {
+			t.Errorf("Expected an error for %+v", commands)
+		}
+	}
+}
+
+func TestExportStepEnv(t *testing.T) {
+	if got := exportStepEnv(nil); got != "" {
+		t.Errorf("exportStepEnv(nil) = %q", got)
+	}
+	if got, want := exportStepEnv(map[string]string{"B": "it's", "A": "$HOME"}), "export A='$HOME' B='it'\\''s'\n"; got != want {
+		t.Errorf("exportStepEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestRunMatrixSteps(t *testing.T) {
+	envFilepath := "/tmp/testMatrixSteps"
+	setupTestCase(t, envFilepath)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: `echo "testing $OS"; [ "$OS" != fail ]`, Matrix: map[string][]string{"OS": {"linux", "fail", "mac"}}},
+			{Name: "after", Cmd: `echo "after ${OS:-none}"`},
+			{Name: "teardown-report", Cmd: `echo "report $KIND"; exit 3`, Parallel: true, Matrix: map[string][]string{"KIND": {"junit", "lcov"}}},
+		},
+		Environment: []map[string]string{},
+	}
+	testBuild.Commands[0].AllowFailure = true
+
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+
+	err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if err == nil {
+		t.Errorf("The failed teardowns should fail the build")
+	}
+	want := map[string]int{"test-linux": 0, "test-fail": 1, "test-mac": 0, "after": 0, "teardown-report-junit": 3, "teardown-report-lcov": 3}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	for _, line := range []string{"\ntesting linux", "\ntesting mac", "\nafter none", "\nreport junit", "\nreport lcov"} {
+		if !strings.Contains(string(emitter.found), line) {
+			t.Errorf("Missing %q in the output %q", line, emitter.found)
+		}
+	}
+}
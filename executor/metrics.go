@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/statsd"
+)
+
+// defaultStatsdPrefix is the prefix of the metric names unless SD_STATSD_PREFIX is set
+const defaultStatsdPrefix = "sd.launcher."
+
+// Returns a statsd client for the server at SD_STATSD_ADDR from the launcher environment, or nil
+// if it is not set. SD_STATSD_DOGSTATSD=true adds the pipeline and job as DogStatsD tags, along
+// with the comma separated key:value tags of SD_STATSD_TAGS.
+func openStatsd() *statsd.Client {
+	addr := strings.TrimSpace(os.Getenv("SD_STATSD_ADDR"))
+	if addr == "" {
+		return nil
+	}
+
+	prefix, ok := os.LookupEnv("SD_STATSD_PREFIX")
+	if !ok {
+		prefix = defaultStatsdPrefix
+	}
+	dogstatsd, _ := strconv.ParseBool(os.Getenv("SD_STATSD_DOGSTATSD"))
+
+	var tags []string
+	for _, tag := range []struct{ key, env string }{{"pipeline_id", "SD_PIPELINE_ID"}, {"job_name", "SD_JOB_NAME"}} {
+		if value := os.Getenv(tag.env); value != "" {
+			tags = append(tags, tag.key+":"+value)
+		}
+	}
+	for _, tag := range strings.Split(os.Getenv("SD_STATSD_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	client, err := statsd.New(addr, prefix, dogstatsd, tags...)
+	if err != nil {
+		logger.Warnf("Not sending metrics: %v", err)
+		return nil
+	}
+	return client
+}
+
+// Sends the duration of a step that stopped with code and err, and counts it if it failed, timed
+// out or passed on retry
+func reportStepMetrics(client *statsd.Client, step string, teardown bool, duration time.Duration, code int, err error, passedOnRetry bool) {
+	tags := []string{"step:" + step, "teardown:" + strconv.FormatBool(teardown)}
+	client.Timing("step.duration", duration, tags...)
+	switch {
+	case passedOnRetry:
+		client.Count("step.passed_on_retry", 1, tags...)
+	case errors.Is(err, ErrTimeout):
+		client.Count("step.timeout", 1, tags...)
+	case errors.Is(err, ErrAborted):
+		client.Count("step.aborted", 1, tags...)
+	case err != nil || code != ExitOk:
+		client.Count("step.failure", 1, tags...)
+	}
+}
+
+// Sends the duration and result of the build, the failures tagged with their class
+func reportBuildMetrics(client *statsd.Client, duration time.Duration, err error) {
+	client.Timing("build.duration", duration)
+	class := "class:" + FailureClass(err)
+	switch {
+	case errors.Is(err, ErrTimeout):
+		client.Count("build.timeout", 1, class)
+	case errors.Is(err, ErrAborted):
+		client.Count("build.aborted", 1, class)
+	case errors.Is(err, ErrPreempted):
+		client.Count("build.preempted", 1, class)
+	case err != nil:
+		client.Count("build.failure", 1, class)
+	default:
+		client.Count("build.success", 1)
+	}
+}
@@ -0,0 +1,64 @@
+package executor
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStepMetrics(t *testing.T) {
+	if client := openStatsd(); client != nil {
+		t.Errorf("Expected no statsd client without SD_STATSD_ADDR")
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	env := map[string]string{
+		"SD_STATSD_ADDR":      conn.LocalAddr().String(),
+		"SD_STATSD_DOGSTATSD": "true",
+		"SD_STATSD_TAGS":      "cluster:a, ",
+		"SD_PIPELINE_ID":      "1",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	client := openStatsd()
+	if client == nil {
+		t.Fatalf("Expected a statsd client")
+	}
+	defer client.Close()
+
+	reportStepMetrics(client, "test", false, 2*time.Second, ExitTimeout, Timeout{Step: "test"}, false)
+	reportStepMetrics(client, "sd-teardown-a", true, time.Second, 1, nil, false)
+	reportStepMetrics(client, "lint", false, time.Second, ExitOk, nil, true)
+	reportBuildMetrics(client, 3*time.Second, StepFailure{Step: "test", Code: 1})
+
+	wants := []string{
+		"sd.launcher.step.duration:2000|ms|#pipeline_id:1,cluster:a,step:test,teardown:false",
+		"sd.launcher.step.timeout:1|c|#pipeline_id:1,cluster:a,step:test,teardown:false",
+		"sd.launcher.step.duration:1000|ms|#pipeline_id:1,cluster:a,step:sd-teardown-a,teardown:true",
+		"sd.launcher.step.failure:1|c|#pipeline_id:1,cluster:a,step:sd-teardown-a,teardown:true",
+		"sd.launcher.step.duration:1000|ms|#pipeline_id:1,cluster:a,step:lint,teardown:false",
+		"sd.launcher.step.passed_on_retry:1|c|#pipeline_id:1,cluster:a,step:lint,teardown:false",
+		"sd.launcher.build.duration:3000|ms|#pipeline_id:1,cluster:a",
+		"sd.launcher.build.failure:1|c|#pipeline_id:1,cluster:a,class:user-error",
+	}
+	buf := make([]byte, 1024)
+	for _, want := range wants {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Didn't receive %q: %v", want, err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("Got metric %q, want %q", got, want)
+		}
+	}
+}
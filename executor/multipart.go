@@ -0,0 +1,89 @@
+package executor
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// multipartPartSize is the size of the parts of the multipart uploads to the object stores, the
+// files up to it being uploaded with a single request. GCS wants a multiple of 256KiB.
+var multipartPartSize int64 = 64 << 20
+
+// multipartUpload is an upload of a file in parts, kept by the store until it completes so a
+// failed upload resumes from the parts already uploaded
+type multipartUpload struct {
+	// size and modTime are the ones of the file, which is uploaded again from the start if they
+	// change
+	size    int64
+	modTime time.Time
+	// id is the upload ID of S3 or the session URI of GCS
+	id string
+	// parts are the ETags of S3 or the block IDs of Azure of the uploaded parts by index
+	parts map[int]string
+	// offset is the number of bytes GCS has of the file
+	offset int64
+	// md5 is the base64 MD5 of the file GCS checks the object against
+	md5 string
+}
+
+// multipartUploads are the unfinished multipart uploads of a store by object name
+type multipartUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*multipartUpload
+}
+
+// Returns the unfinished upload as the object name of the file of size last modified at modTime,
+// or a new one
+func (u *multipartUploads) get(name string, size int64, modTime time.Time) *multipartUpload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if upload, ok := u.uploads[name]; ok && upload.size == size && upload.modTime.Equal(modTime) {
+		return upload
+	}
+	upload := &multipartUpload{size: size, modTime: modTime, parts: map[int]string{}}
+	if u.uploads == nil {
+		u.uploads = map[string]*multipartUpload{}
+	}
+	u.uploads[name] = upload
+	return upload
+}
+
+// Forgets the upload of the object name, once complete or no longer resumable
+func (u *multipartUploads) done(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.uploads, name)
+}
+
+// Returns the number of parts of partSize of a file of size
+func partCount(size, partSize int64) int {
+	return int((size + partSize - 1) / partSize)
+}
+
+// Returns the part i of partSize of the file f of size, and its base64 MD5 for Content-MD5
+func readPart(f *os.File, i int, partSize, size int64) ([]byte, string, error) {
+	offset := int64(i) * partSize
+	n := partSize
+	if offset+n > size {
+		n = size - offset
+	}
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, "", err
+	}
+	sum := md5.Sum(data)
+	return data, base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// Returns the base64 MD5 of the first size bytes of f
+func fileMD5(f *os.File, size int64) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,55 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// netUsage is the bytes received and sent on the network
+type netUsage struct {
+	RxBytes int64 `json:"rxBytes"`
+	TxBytes int64 `json:"txBytes"`
+}
+
+func (n netUsage) sub(o netUsage) netUsage {
+	return netUsage{n.RxBytes - o.RxBytes, n.TxBytes - o.TxBytes}
+}
+
+// Reads the bytes received and sent so far on all the network interfaces of the launcher's network
+// namespace except loopback. The build runs in the same namespace, so this counts its traffic too.
+func readNetUsage() (netUsage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, "net", "dev"))
+	if err != nil {
+		return netUsage{}, err
+	}
+
+	var n netUsage
+	lines := strings.Split(string(data), "\n")
+	// The first two lines are headers
+	for i := 2; i < len(lines); i++ {
+		parts := strings.SplitN(lines[i], ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		// bytes is the first receive field and the first of the 8 transmit fields
+		if len(fields) < 16 {
+			return netUsage{}, fmt.Errorf("Unexpected line in %s/net/dev: %q", procDir, lines[i])
+		}
+		rx, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return netUsage{}, err
+		}
+		tx, err := strconv.ParseInt(fields[8], 10, 64)
+		if err != nil {
+			return netUsage{}, err
+		}
+		n.RxBytes += rx
+		n.TxBytes += tx
+	}
+
+	return n, nil
+}
@@ -0,0 +1,91 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func writeNetDev(t *testing.T, dir string, eth0Rx, eth0Tx int64) {
+	data := "Inter-|   Receive                                                |  Transmit\n" +
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+		"    lo:    9999      10    0    0    0     0          0         0     9999      10    0    0    0     0       0          0\n" +
+		fmt.Sprintf("  eth0: %7d      20    0    0    0     0          0         0  %7d      15    0    0    0     0       0          0\n", eth0Rx, eth0Tx) +
+		"  eth1:     100       1    0    0    0     0          0         0       50       1    0    0    0     0       0          0\n"
+	if err := os.MkdirAll(filepath.Join(dir, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "net", "dev"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadNetUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldProcDir := procDir
+	defer func() { procDir = oldProcDir }()
+	procDir = dir
+
+	if _, err := readNetUsage(); err == nil {
+		t.Errorf("Expected an error without a %s/net/dev", dir)
+	}
+
+	writeNetDev(t, dir, 2000, 1000)
+	got, err := readNetUsage()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// loopback is not counted
+	if want := (netUsage{RxBytes: 2100, TxBytes: 1050}); got != want {
+		t.Errorf("readNetUsage() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBuildSummaryNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldProcDir := procDir
+	defer func() { procDir = oldProcDir }()
+	procDir = dir
+
+	writeNetDev(t, dir, 1000, 500)
+	summary := newBuildSummary(time.Now(), "")
+	writeNetDev(t, dir, 5000, 700)
+	summary.add("install", false, time.Now(), 0, screwdriver.StepStopDetails{})
+	writeNetDev(t, dir, 6000, 900)
+	summary.add("test", false, time.Now(), 0, screwdriver.StepStopDetails{})
+	writeNetDev(t, dir, 6500, 1000)
+	summary.finish(time.Now())
+
+	wants := []netUsage{{RxBytes: 4000, TxBytes: 200}, {RxBytes: 1000, TxBytes: 200}}
+	for i, want := range wants {
+		if got := summary.Steps[i].Network; got == nil || *got != want {
+			t.Errorf("Network of step %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if got, want := summary.Network, (netUsage{RxBytes: 5500, TxBytes: 500}); got == nil || *got != want {
+		t.Errorf("Network of the build = %+v, want %+v", got, want)
+	}
+
+	procDir = filepath.Join(dir, "missing")
+	summary = newBuildSummary(time.Now(), "")
+	summary.add("install", false, time.Now(), 0, screwdriver.StepStopDetails{})
+	summary.finish(time.Now())
+	if summary.Network != nil || summary.Steps[0].Network != nil {
+		t.Errorf("Expected no network usage without a %s/net/dev", procDir)
+	}
+}
@@ -0,0 +1,329 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Notification events, what a build ended with
+const (
+	notifySuccess = "success"
+	notifyFailure = "failure"
+	notifyTimeout = "timeout"
+	notifyAborted = "aborted"
+)
+
+// Types of the notification targets
+const (
+	notifySlack = "slack"
+	notifyTeams = "teams"
+	notifyEmail = "email"
+)
+
+const (
+	// How long a single notification may take
+	notificationTimeout = 10 * time.Second
+	// How long the end of the build waits for the notifications to be sent
+	notificationFlushTimeout = 15 * time.Second
+)
+
+// defaultNotifyEvents are the events of the targets without any
+var defaultNotifyEvents = []string{notifyFailure, notifyTimeout}
+
+// notifyText renders the text of the notifications, their Text
+var notifyText = template.Must(template.New("text").Parse(
+	`{{if .Pipeline}}{{.Pipeline}} {{end}}{{if .Job}}{{.Job}} {{end}}build {{.BuildID}}: {{.Status}}` +
+		`{{if .Step}} at step {{.Step}}{{end}}{{if .Error}} ({{.Error}}){{end}}{{if .URL}} {{.URL}}{{end}}`))
+
+// defaultNotifyTemplates are the templates of the payloads of the targets without one, by type
+var defaultNotifyTemplates = map[string]string{
+	notifySlack: `{"text": {{json .Text}}}`,
+	notifyTeams: `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "themeColor": "{{if eq .Event "success"}}2EB886{{else}}D00000{{end}}", ` +
+		`"summary": {{json (printf "Build %d: %s" .BuildID .Status)}}, "text": {{json .Text}}}`,
+	notifyEmail: "{{.Text}}\n",
+}
+
+// defaultNotifySubject is the subject of the emails of the targets without one
+const defaultNotifySubject = `[Screwdriver] {{if .Pipeline}}{{.Pipeline}} {{end}}{{if .Job}}{{.Job}} {{end}}build {{.BuildID}}: {{.Status}}`
+
+// notifyFuncs are the functions of the templates: json quotes a value as JSON
+var notifyFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// notificationTarget is where the launcher notifies the end of the builds ending with one of On.
+// Slack and Teams targets are incoming webhooks at URL, email targets send to To from From through
+// the SMTP server at SMTP (host:port). Template renders the payload, the body of the emails, and
+// Subject the subject of the emails.
+type notificationTarget struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	On       []string `json:"on,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	SMTP     string   `json:"smtp,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Subject  string   `json:"subject,omitempty"`
+	Template string   `json:"template,omitempty"`
+
+	tmpl, subject *template.Template
+}
+
+// notificationTargets are the notification targets of the cluster
+type notificationTargets struct {
+	Targets []notificationTarget `json:"targets"`
+}
+
+// notification is the data of the templates of the notifications
+type notification struct {
+	// Event is success, failure, timeout or aborted, and Status the status of the build
+	Event    string
+	Status   string
+	BuildID  int
+	JobID    int
+	EventID  int
+	SHA      string
+	Pipeline string
+	Job      string
+	URL      string
+	// Step is the step that failed the build, if one did, and Error why the build failed
+	Step     string
+	Error    string
+	Duration time.Duration
+	// Text says all that in a line
+	Text string
+}
+
+// notifier notifies the targets of the cluster of the end of the build. A nil notifier sends
+// nothing.
+type notifier struct {
+	targets []notificationTarget
+	client  *http.Client
+	// sendMail sends the emails, smtp.SendMail but in the tests
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Loads the notification targets from the JSON file at SD_NOTIFICATIONS in the launcher
+// environment, returning nil if it is unset. The emails authenticate with SD_SMTP_USERNAME and
+// SD_SMTP_PASSWORD if set.
+func loadNotifier() (*notifier, error) {
+	path := strings.TrimSpace(os.Getenv("SD_NOTIFICATIONS"))
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := parseNotificationTargets(data)
+	if err != nil {
+		return nil, err
+	}
+	return &notifier{targets: targets, client: &http.Client{Timeout: notificationTimeout}, sendMail: smtp.SendMail}, nil
+}
+
+// Parses and validates notification targets
+func parseNotificationTargets(data []byte) ([]notificationTarget, error) {
+	var t notificationTargets
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("Parsing the notification targets: %v", err)
+	}
+
+	for i := range t.Targets {
+		target := &t.Targets[i]
+		if target.Name == "" {
+			return nil, fmt.Errorf("Notification target %d has no name", i)
+		}
+		switch target.Type {
+		case notifySlack, notifyTeams:
+			if !strings.HasPrefix(target.URL, "https://") && !strings.HasPrefix(target.URL, "http://") {
+				return nil, fmt.Errorf("Notification target %q has URL %q, want the URL of an incoming webhook", target.Name, target.URL)
+			}
+		case notifyEmail:
+			if target.SMTP == "" || target.From == "" || len(target.To) == 0 {
+				return nil, fmt.Errorf("Notification target %q needs an SMTP server, a sender and recipients", target.Name)
+			}
+		default:
+			return nil, fmt.Errorf("Notification target %q has type %q, want %q, %q or %q", target.Name, target.Type, notifySlack, notifyTeams, notifyEmail)
+		}
+		if len(target.On) == 0 {
+			target.On = defaultNotifyEvents
+		}
+		for _, event := range target.On {
+			switch event {
+			case notifySuccess, notifyFailure, notifyTimeout, notifyAborted:
+			default:
+				return nil, fmt.Errorf("Notification target %q has event %q, want %q, %q, %q or %q", target.Name, event, notifySuccess, notifyFailure, notifyTimeout, notifyAborted)
+			}
+		}
+
+		var err error
+		text := target.Template
+		if text == "" {
+			text = defaultNotifyTemplates[target.Type]
+		}
+		if target.tmpl, err = parseNotifyTemplate(text); err != nil {
+			return nil, fmt.Errorf("Notification target %q: %v", target.Name, err)
+		}
+		if target.Type == notifyEmail {
+			subject := target.Subject
+			if subject == "" {
+				subject = defaultNotifySubject
+			}
+			if target.subject, err = parseNotifyTemplate(subject); err != nil {
+				return nil, fmt.Errorf("Notification target %q subject: %v", target.Name, err)
+			}
+		}
+	}
+	return t.Targets, nil
+}
+
+// Parses the template text of a notification, which fails now rather than at the end of the
+// build if it uses what the notifications do not have
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("notification").Funcs(notifyFuncs).Parse(text)
+	if err == nil {
+		err = tmpl.Execute(ioutil.Discard, notification{})
+	}
+	return tmpl, err
+}
+
+// Returns the notification event of a build that ended with err, a step timing out being a timeout
+func notifyEvent(err error) string {
+	var stepTimeout StepTimeout
+	switch {
+	case err == nil:
+		return notifySuccess
+	case errors.Is(err, ErrTimeout), errors.As(err, &stepTimeout):
+		return notifyTimeout
+	case errors.Is(err, ErrAborted):
+		return notifyAborted
+	}
+	return notifyFailure
+}
+
+// Notifies the targets of the events of the build with env, which ended with err after duration,
+// waiting up to notificationFlushTimeout for them. Failures are only logged.
+func (n *notifier) buildComplete(build screwdriver.Build, env []string, duration time.Duration, err error) {
+	if n == nil {
+		return
+	}
+
+	data := notification{
+		Event:    notifyEvent(err),
+		Status:   resultStatus(ExitOk, err),
+		BuildID:  build.ID,
+		JobID:    build.JobID,
+		EventID:  build.EventID,
+		SHA:      build.SHA,
+		Pipeline: lookupEnv(env, "SD_PIPELINE_NAME"),
+		Job:      lookupEnv(env, "SD_JOB_NAME"),
+		URL:      lookupEnv(env, "SD_UI_BUILD_URL"),
+		Step:     failedStep(err),
+		Error:    maskSecrets(errorString(err), buildSecrets(env)),
+		Duration: duration.Round(time.Second),
+	}
+	var text strings.Builder
+	if err := notifyText.Execute(&text, data); err == nil {
+		data.Text = text.String()
+	}
+
+	var wg sync.WaitGroup
+	for i := range n.targets {
+		target := &n.targets[i]
+		if !hasEvent(target.On, data.Event) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.send(target, data); err != nil {
+				logger.Warnf("Failed to notify %s: %v", target.Name, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(notificationFlushTimeout):
+		logger.Warnf("Gave up sending the pending notifications after %v", notificationFlushTimeout)
+	}
+}
+
+// Sends the notification of data to target
+func (n *notifier) send(target *notificationTarget, data notification) error {
+	var body bytes.Buffer
+	if err := target.tmpl.Execute(&body, data); err != nil {
+		return fmt.Errorf("Rendering the template: %v", err)
+	}
+
+	if target.Type == notifyEmail {
+		var subject strings.Builder
+		if err := target.subject.Execute(&subject, data); err != nil {
+			return fmt.Errorf("Rendering the subject: %v", err)
+		}
+		return n.email(target, subject.String(), body.Bytes())
+	}
+
+	res, err := n.client.Post(target.URL, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Emails body with subject to the recipients of target
+func (n *notifier) email(target *notificationTarget, subject string, body []byte) error {
+	var auth smtp.Auth
+	if username := os.Getenv("SD_SMTP_USERNAME"); username != "" {
+		host := target.SMTP
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", username, os.Getenv("SD_SMTP_PASSWORD"), host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", target.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(target.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n")))
+	return n.sendMail(target.SMTP, auth, target.From, target.To, msg.Bytes())
+}
+
+// Returns whether events has event
+func hasEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
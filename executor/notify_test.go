@@ -0,0 +1,155 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNotificationTargets(t *testing.T) {
+	tests := []struct {
+		json string
+		err  bool
+	}{
+		{json: `{"targets": [{"name": "team", "type": "slack", "url": "https://hooks.slack.com/services/T/B/X"}]}`},
+		{json: `{"targets": [{"name": "team", "type": "teams", "url": "https://outlook.office.com/webhook/x", "on": ["success", "aborted"], "template": "{\"text\": {{json .Error}}}"}]}`},
+		{json: `{"targets": [{"name": "oncall", "type": "email", "smtp": "smtp.example.com:587", "from": "sd@example.com", "to": ["oncall@example.com"], "subject": "{{.Status}}"}]}`},
+		{json: `{"targets": [{"type": "slack", "url": "https://hooks.slack.com/services/T/B/X"}]}`, err: true},
+		{json: `{"targets": [{"name": "team", "type": "irc", "url": "https://irc.example.com"}]}`, err: true},
+		{json: `{"targets": [{"name": "team", "type": "slack", "url": "hooks.slack.com"}]}`, err: true},
+		{json: `{"targets": [{"name": "oncall", "type": "email", "smtp": "smtp.example.com:587", "from": "sd@example.com"}]}`, err: true},
+		{json: `{"targets": [{"name": "team", "type": "slack", "url": "https://hooks.slack.com", "on": ["started"]}]}`, err: true},
+		{json: `{"targets": [{"name": "team", "type": "slack", "url": "https://hooks.slack.com", "template": "{{.Unknown}}"}]}`, err: true},
+		{json: `{"targets": [{"name": "oncall", "type": "email", "smtp": "smtp:25", "from": "a@b", "to": ["c@d"], "subject": "{{if .Status}"}]}`, err: true},
+		{json: `{"targets": `, err: true},
+	}
+	for _, test := range tests {
+		if _, err := parseNotificationTargets([]byte(test.json)); (err != nil) != test.err {
+			t.Errorf("parseNotificationTargets(%s) error = %v, want error %v", test.json, err, test.err)
+		}
+	}
+}
+
+func TestNotifyEvent(t *testing.T) {
+	assert.Equal(t, notifySuccess, notifyEvent(nil))
+	assert.Equal(t, notifyTimeout, notifyEvent(Timeout{Timeout: time.Hour}))
+	assert.Equal(t, notifyTimeout, notifyEvent(withStep(StepTimeout{"test", time.Minute}, "test")))
+	assert.Equal(t, notifyAborted, notifyEvent(Aborted{Step: "test"}))
+	assert.Equal(t, notifyFailure, notifyEvent(StepFailure{Step: "test", Code: 1}))
+	assert.Equal(t, notifyFailure, notifyEvent(errors.New("Cannot start shell")))
+}
+
+func TestNotifierBuildComplete(t *testing.T) {
+	var mu sync.Mutex
+	bodies := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid JSON payload: %v", err)
+		}
+		mu.Lock()
+		bodies[r.URL.Path] = body
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	targets, err := parseNotificationTargets([]byte(`{"targets": [
+		{"name": "slack", "type": "slack", "url": "` + server.URL + `/slack"},
+		{"name": "teams", "type": "teams", "url": "` + server.URL + `/teams", "on": ["failure"]},
+		{"name": "releases", "type": "slack", "url": "` + server.URL + `/releases", "on": ["success"]},
+		{"name": "oncall", "type": "email", "smtp": "smtp.example.com:25", "from": "sd@example.com", "to": ["a@example.com", "b@example.com"]}
+	]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var mails []string
+	n := &notifier{targets: targets, client: http.DefaultClient, sendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "smtp.example.com:25", addr)
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, to)
+		mails = append(mails, string(msg))
+		return nil
+	}}
+
+	build := screwdriver.Build{ID: 42, JobID: 7, SHA: "abc123"}
+	env := []string{"SD_PIPELINE_NAME=org/repo", "SD_JOB_NAME=main", "SD_UI_BUILD_URL=https://cd.example.com/pipelines/1/builds/42"}
+	n.buildComplete(build, env, time.Minute, withStep(StepTimeout{"test", time.Minute}, "test"))
+
+	mu.Lock()
+	text := "org/repo main build 42: FAILURE at step test (Step timeout of 1m0s exceeded) https://cd.example.com/pipelines/1/builds/42"
+	assert.Equal(t, map[string]map[string]interface{}{
+		"/slack": {"text": text},
+	}, bodies, "Only the targets of timeouts are notified")
+	if assert.Len(t, mails, 1) {
+		assert.Contains(t, mails[0], "To: a@example.com, b@example.com\r\n")
+		assert.Contains(t, mails[0], "Subject: [Screwdriver] org/repo main build 42: FAILURE\r\n")
+		assert.Contains(t, mails[0], "\r\n\r\n"+text+"\r\n")
+	}
+
+	bodies = map[string]map[string]interface{}{}
+	mu.Unlock()
+
+	n.buildComplete(build, env, time.Minute, StepFailure{Step: "test", Code: 1})
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "MessageCard", bodies["/teams"]["@type"])
+	assert.Equal(t, "Build 42: FAILURE", bodies["/teams"]["summary"])
+	assert.Nil(t, bodies["/releases"])
+}
+
+func TestRunNotifies(t *testing.T) {
+	defer os.Setenv("SD_NOTIFICATIONS", os.Getenv("SD_NOTIFICATIONS"))
+	var mu sync.Mutex
+	var payloads []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		payloads = append(payloads, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "notifications.json")
+	targets := `{"targets": [{"name": "team", "type": "slack", "url": "` + server.URL + `", "on": ["success", "failure"], "template": "{{.Event}} {{.BuildID}} {{.Step}}"}]}`
+	if err := ioutil.WriteFile(file, []byte(targets), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.Setenv("SD_NOTIFICATIONS", file)
+
+	envFilepath := "/tmp/testNotifications"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    []screwdriver.CommandDef{{Name: "test", Cmd: "exit 3"}},
+		Environment: []map[string]string{},
+	}
+	err = Run("", nil, &MockEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if err == nil {
+		t.Fatalf("The step should fail the build")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"failure 12345 test"}, payloads)
+
+	ioutil.WriteFile(file, []byte(`{"targets": [{"name": "team", "type": "slack"}]}`), 0644)
+	err = Run("", nil, &MockEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if _, ok := err.(InfraError); !ok {
+		t.Errorf("Invalid notification targets should fail the build as an infrastructure error, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// defaultTeardownConcurrency is how many parallel teardowns run at once by default
+const defaultTeardownConcurrency = 4
+
+// Returns how many parallel teardowns run at once, from SD_TEARDOWN_CONCURRENCY in the launcher
+// environment. 1 runs them all one after the other.
+func teardownConcurrency() (int, error) {
+	value := strings.TrimSpace(os.Getenv("SD_TEARDOWN_CONCURRENCY"))
+	if value == "" {
+		return defaultTeardownConcurrency, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid SD_TEARDOWN_CONCURRENCY %q, want a positive number", value)
+	}
+	return n, nil
+}
+
+// Returns the end of the group of teardowns starting at start that run in parallel: the teardown
+// at start and the ones after it, as long as they are all marked parallel and of the same kind,
+// the first userTeardowns being the user teardowns. A teardown with a read-only source directory
+// runs alone, the source directory is read-only for every process or for none.
+func parallelGroupEnd(teardowns []screwdriver.CommandDef, start, userTeardowns, concurrency int, readOnly *readOnlySource) int {
+	inGroup := func(i int) bool {
+		return teardowns[i].Parallel && !readOnly.applies(teardowns[i].Name) &&
+			(i < userTeardowns) == (start < userTeardowns)
+	}
+	if concurrency < 2 || !inGroup(start) {
+		return start + 1
+	}
+	end := start + 1
+	for end < len(teardowns) && inGroup(end) {
+		end++
+	}
+	return end
+}
+
+// teardownOutput is the emitter of a teardown. When it runs in parallel with others, it keeps
+// the output until the teardown is over, then writes it to the build emitter in one piece so
+// the logs of the teardowns do not get mixed up.
+type teardownOutput struct {
+	emitter  screwdriver.Emitter
+	buffered bool
+	cmd      screwdriver.CommandDef
+	buf      bytes.Buffer
+}
+
+// StartCmd sets the teardown the output belongs to
+func (o *teardownOutput) StartCmd(cmd screwdriver.CommandDef) {
+	o.cmd = cmd
+	if !o.buffered {
+		o.emitter.StartCmd(cmd)
+	}
+}
+
+func (o *teardownOutput) Write(p []byte) (int, error) {
+	if !o.buffered {
+		return o.emitter.Write(p)
+	}
+	return o.buf.Write(p)
+}
+
+// Unwrap returns the build emitter, or nil while the output is kept for later, which the messages
+// of the launcher are part of
+func (o *teardownOutput) Unwrap() screwdriver.Emitter {
+	if o.buffered {
+		return nil
+	}
+	return o.emitter
+}
+
+// Close does nothing, the build emitter is closed at the end of the build
+func (o *teardownOutput) Close() error {
+	return nil
+}
+
+// Error gets the latest error from the build emitter
+func (o *teardownOutput) Error() error {
+	return o.emitter.Error()
+}
+
+// Writes the output kept so far to the build emitter
+func (o *teardownOutput) flush() {
+	if !o.buffered || o.buf.Len() == 0 {
+		return
+	}
+	o.emitter.StartCmd(o.cmd)
+	o.emitter.Write(o.buf.Bytes())
+	o.buf.Reset()
+}
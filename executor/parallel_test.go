@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestTeardownConcurrency(t *testing.T) {
+	defer os.Unsetenv("SD_TEARDOWN_CONCURRENCY")
+
+	if n, err := teardownConcurrency(); n != defaultTeardownConcurrency || err != nil {
+		t.Errorf("teardownConcurrency() = %d, %v, want the default", n, err)
+	}
+	os.Setenv("SD_TEARDOWN_CONCURRENCY", "2")
+	if n, err := teardownConcurrency(); n != 2 || err != nil {
+		t.Errorf("teardownConcurrency() = %d, %v, want 2", n, err)
+	}
+	for _, value := range []string{"0", "many"} {
+		os.Setenv("SD_TEARDOWN_CONCURRENCY", value)
+		if _, err := teardownConcurrency(); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParallelGroupEnd(t *testing.T) {
+	teardowns := []screwdriver.CommandDef{
+		{Name: "teardown-a", Parallel: true},
+		{Name: "teardown-b", Parallel: true},
+		{Name: "teardown-c"},
+		{Name: "teardown-d", Parallel: true},
+		{Name: "teardown-readonly", Parallel: true},
+		{Name: "sd-teardown-artifacts", Parallel: true},
+		{Name: "sd-teardown-coverage", Parallel: true},
+	}
+	readOnly := &readOnlySource{steps: map[string]bool{"teardown-readonly": true}}
+
+	tests := []struct {
+		start, concurrency, want int
+	}{
+		{0, 4, 2},
+		{0, 1, 1},
+		{2, 4, 3},
+		{3, 4, 4},
+		{4, 4, 5},
+		// the user teardowns and the Screwdriver ones are never in the same group
+		{5, 4, 7},
+	}
+	for _, test := range tests {
+		if got := parallelGroupEnd(teardowns, test.start, 5, test.concurrency, readOnly); got != test.want {
+			t.Errorf("parallelGroupEnd(%d, %d) = %d, want %d", test.start, test.concurrency, got, test.want)
+		}
+	}
+}
+
+func TestRunParallelTeardowns(t *testing.T) {
+	envFilepath := "/tmp/testParallelTeardowns"
+	setupTestCase(t, envFilepath)
+	dir := "/tmp/testParallelTeardowns.d"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	// Each teardown waits for the other one to start, which only works if they run at once
+	waitFor := func(self, other string) string {
+		return "touch " + dir + "/" + self + "; i=0; while [ ! -f " + dir + "/" + other + " ] && [ $i -lt 100 ]; do sleep 0.1; i=$((i+1)); done; " +
+			"echo " + self + " done; test -f " + dir + "/" + other
+	}
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "ls", Name: "test ls"},
+			{Cmd: waitFor("artifacts", "coverage"), Name: "sd-teardown-artifacts", Parallel: true},
+			{Cmd: waitFor("coverage", "artifacts"), Name: "sd-teardown-coverage", Parallel: true},
+			{Cmd: "echo last", Name: "sd-teardown-last"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	var started []string
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStart: func(buildID int, stepName string) error {
+			started = append(started, stepName)
+			return nil
+		},
+	})
+	var current string
+	logs := map[string]string{}
+	emitter := &MockEmitter{
+		startCmd: func(cmd screwdriver.CommandDef) { current = cmd.Name },
+		write: func(b []byte) (int, error) {
+			logs[current] += string(b)
+			return len(b), nil
+		},
+	}
+
+	if err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v, logs %v", err, logs)
+	}
+	if got := started[len(started)-1]; got != "sd-teardown-last" {
+		t.Errorf("The last teardown should start after the parallel ones, started %v", started)
+	}
+	for step, other := range map[string]string{"artifacts": "coverage", "coverage": "artifacts"} {
+		log := logs["sd-teardown-"+step]
+		if !strings.Contains(log, "\n"+step+" done") || strings.Contains(log, "\n"+other+" done") {
+			t.Errorf("Unexpected log of sd-teardown-%s: %q", step, log)
+		}
+	}
+}
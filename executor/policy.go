@@ -0,0 +1,136 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Actions of a command policy rule
+const (
+	policyWarn  = "warn"
+	policyBlock = "block"
+)
+
+// policyRule matches the steps whose command matches Command and whose environment has an entry
+// (KEY=value) matching Env. An empty pattern matches everything, but a rule needs at least one.
+type policyRule struct {
+	Name    string `json:"name"`
+	Command string `json:"command,omitempty"`
+	Env     string `json:"env,omitempty"`
+	Action  string `json:"action"`
+	Message string `json:"message,omitempty"`
+
+	command, env *regexp.Regexp
+}
+
+// commandPolicy is the set of rules cluster admins apply to the steps of every build
+type commandPolicy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// Loads the command policy from the JSON file at SD_POLICY_FILE in the launcher environment, or
+// returns nil if it is not set
+func loadCommandPolicy() (*commandPolicy, error) {
+	path := strings.TrimSpace(os.Getenv("SD_POLICY_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCommandPolicy(data)
+}
+
+// Parses and validates a command policy
+func parseCommandPolicy(data []byte) (*commandPolicy, error) {
+	var p commandPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("Parsing the command policy: %v", err)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("Rule %d of the command policy has no name", i)
+		}
+		if rule.Action != policyWarn && rule.Action != policyBlock {
+			return nil, fmt.Errorf("Rule %q of the command policy has action %q, want %q or %q", rule.Name, rule.Action, policyWarn, policyBlock)
+		}
+		if rule.Command == "" && rule.Env == "" {
+			return nil, fmt.Errorf("Rule %q of the command policy matches nothing, it needs a command or env pattern", rule.Name)
+		}
+
+		var err error
+		if rule.Command != "" {
+			if rule.command, err = regexp.Compile(rule.Command); err != nil {
+				return nil, fmt.Errorf("Rule %q of the command policy: %v", rule.Name, err)
+			}
+		}
+		if rule.Env != "" {
+			if rule.env, err = regexp.Compile(rule.Env); err != nil {
+				return nil, fmt.Errorf("Rule %q of the command policy: %v", rule.Name, err)
+			}
+		}
+	}
+
+	return &p, nil
+}
+
+// Returns whether the rule matches the command cmd running with env
+func (r policyRule) matches(cmd string, env []string) bool {
+	if r.command != nil && !r.command.MatchString(cmd) {
+		return false
+	}
+	if r.env == nil {
+		return true
+	}
+	for _, kv := range env {
+		if r.env.MatchString(kv) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the rules violated by the step cmd running with env, and the first blocking one if the
+// step must not run
+func (p *commandPolicy) evaluate(cmd screwdriver.CommandDef, env []string) ([]screwdriver.PolicyViolation, *Blocked) {
+	if p == nil {
+		return nil, nil
+	}
+
+	var violations []screwdriver.PolicyViolation
+	var blocked *Blocked
+	for _, rule := range p.Rules {
+		// The condition of a step runs in the build shell too
+		if !rule.matches(cmd.Cmd, env) && (cmd.Condition == "" || !rule.matches(cmd.Condition, env)) {
+			continue
+		}
+		violations = append(violations, screwdriver.PolicyViolation{Rule: rule.Name, Action: rule.Action, Message: rule.Message})
+		if rule.Action == policyBlock && blocked == nil {
+			blocked = &Blocked{Step: cmd.Name, Rule: rule.Name, Message: rule.Message}
+		}
+	}
+	return violations, blocked
+}
+
+// Logs the rules violated by step and writes them to its log
+func reportViolations(emitter screwdriver.Emitter, step string, violations []screwdriver.PolicyViolation) {
+	for _, v := range violations {
+		logger.With("step", step, "rule", v.Rule, "action", v.Action).Warnf("Step violates the command policy: %s", v.Message)
+		if v.Action == policyBlock {
+			launcherf(emitter, "Step blocked by policy rule %q: %s\n", v.Rule, v.Message)
+		} else {
+			launcherf(emitter, "Warning: step violates policy rule %q: %s\n", v.Rule, v.Message)
+		}
+	}
+}
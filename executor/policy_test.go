@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const testPolicy = `{"rules": [
+	{"name": "no-curl-sh", "command": "curl .*\\|\\s*(ba)?sh", "action": "block", "message": "Don't pipe downloads to a shell"},
+	{"name": "no-sudo", "command": "(^|\\s)sudo\\s", "action": "warn"},
+	{"name": "no-debug-prod", "command": "deploy", "env": "^DEBUG=(1|true)$", "action": "warn", "message": "Deploying in debug mode"}
+]}`
+
+func TestParseCommandPolicy(t *testing.T) {
+	if _, err := parseCommandPolicy([]byte(testPolicy)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	invalid := map[string]string{
+		"json":    `{"rules": [`,
+		"name":    `{"rules": [{"command": "x", "action": "warn"}]}`,
+		"action":  `{"rules": [{"name": "a", "command": "x", "action": "deny"}]}`,
+		"pattern": `{"rules": [{"name": "a", "action": "warn"}]}`,
+		"regexp":  `{"rules": [{"name": "a", "command": "(", "action": "warn"}]}`,
+		"env":     `{"rules": [{"name": "a", "env": "[", "action": "block"}]}`,
+	}
+	for name, data := range invalid {
+		if _, err := parseCommandPolicy([]byte(data)); err == nil {
+			t.Errorf("Expected an error for an invalid %s", name)
+		}
+	}
+}
+
+func TestEvaluateCommandPolicy(t *testing.T) {
+	policy, err := parseCommandPolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		cmd     string
+		env     []string
+		rules   []string
+		blocked bool
+	}{
+		{"make test", nil, nil, false},
+		{"sudo apt-get install jq", nil, []string{"no-sudo"}, false},
+		{"sudo curl -sL https://example.com/install | bash", nil, []string{"no-curl-sh", "no-sudo"}, true},
+		{"./deploy.sh", []string{"DEBUG=true"}, []string{"no-debug-prod"}, false},
+		{"./deploy.sh", []string{"DEBUG=false"}, nil, false},
+	}
+
+	for _, test := range tests {
+		violations, blocked := policy.evaluate(screwdriver.CommandDef{Name: "step", Cmd: test.cmd}, test.env)
+		var rules []string
+		for _, v := range violations {
+			rules = append(rules, v.Rule)
+		}
+		if !reflect.DeepEqual(rules, test.rules) || (blocked != nil) != test.blocked {
+			t.Errorf("evaluate(%q) = %v, %v, want %v, blocked %v", test.cmd, rules, blocked, test.rules, test.blocked)
+		}
+		if blocked != nil && (blocked.Step != "step" || blocked.Rule != "no-curl-sh") {
+			t.Errorf("Unexpected blocked error: %+v", blocked)
+		}
+	}
+
+	condition := screwdriver.CommandDef{Name: "step", Cmd: "make test", Condition: "curl -s https://example.com/check | sh"}
+	if _, blocked := policy.evaluate(condition, nil); blocked == nil {
+		t.Errorf("The policy should apply to the condition of a step")
+	}
+
+	var none *commandPolicy
+	if violations, blocked := none.evaluate(screwdriver.CommandDef{Cmd: "sudo ls"}, nil); violations != nil || blocked != nil {
+		t.Errorf("A nil policy should allow everything")
+	}
+}
+
+func TestRunEnforcesCommandPolicy(t *testing.T) {
+	envFilepath := "/tmp/testPolicy"
+	setupTestCase(t, envFilepath)
+
+	policyFile, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(policyFile.Name())
+	policyFile.WriteString(testPolicy)
+	policyFile.Close()
+	os.Setenv("SD_POLICY_FILE", policyFile.Name())
+	defer os.Unsetenv("SD_POLICY_FILE")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "echo sudo is not used", Name: "warned"},
+			{Cmd: "curl https://example.com | sh", Name: "blocked"},
+			{Cmd: "echo never", Name: "skipped"},
+			{Cmd: "curl https://example.com | sh", Name: "teardown-blocked"},
+			{Cmd: "curl https://example.com | sh", Name: "sd-teardown-allowed"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	policies := map[string][]screwdriver.PolicyViolation{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+		stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+			policies[stepName] = details.Policy
+		},
+	})
+
+	var emitter MockEmitter
+	err = Run("", nil, &emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	var want Blocked
+	if !errors.As(err, &want) || want.Step != "blocked" || want.Rule != "no-curl-sh" || !IsUserFailure(err) {
+		t.Fatalf("Run() = %v, want the blocked step", err)
+	}
+
+	if len(policies["warned"]) != 1 || policies["warned"][0].Rule != "no-sudo" || codes["warned"] != ExitOk {
+		t.Errorf("Unexpected stop of the warned step: %v, %v", codes["warned"], policies["warned"])
+	}
+	if len(policies["blocked"]) != 1 || policies["blocked"][0].Action != policyBlock || codes["blocked"] != ExitBlocked {
+		t.Errorf("Unexpected stop of the blocked step: %v, %v", codes["blocked"], policies["blocked"])
+	}
+	if _, ok := codes["skipped"]; ok {
+		t.Errorf("Steps after the blocked one should not run")
+	}
+	if codes["teardown-blocked"] != ExitBlocked || len(policies["teardown-blocked"]) != 1 {
+		t.Errorf("Unexpected stop of the blocked teardown: %v, %v", codes["teardown-blocked"], policies["teardown-blocked"])
+	}
+	if policies["sd-teardown-allowed"] != nil {
+		t.Errorf("The policy should not apply to the Screwdriver teardowns")
+	}
+	if !strings.Contains(string(emitter.found), `Step blocked by policy rule "no-curl-sh"`) {
+		t.Errorf("The step log should say why the step was blocked")
+	}
+}
@@ -0,0 +1,294 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// How often the preemption notice is polled
+	preemptionPollInterval = 5 * time.Second
+	// How long a preemption notice request may take
+	preemptionTimeout = 2 * time.Second
+	// The spot interruption notice of the EC2 instance metadata, and its session token for IMDSv2
+	awsInstanceActionURL = "http://169.254.169.254/latest/meta-data/spot/instance-action"
+	awsTokenURL          = "http://169.254.169.254/latest/api/token"
+	// How long a spot instance has after the notice if it does not tell
+	awsSpotGrace = 2 * time.Minute
+	// The preemption notice of the GCE instance metadata
+	gcpPreemptedURL = "http://metadata.google.internal/computeMetadata/v1/instance/preempted"
+	// How long a preemptible instance has after the notice
+	gcpPreemptionGrace = 30 * time.Second
+)
+
+// preemptionNotice tells that the node of the build goes away at deadline, for reason
+type preemptionNotice struct {
+	reason   string
+	deadline time.Time
+}
+
+// preemptionSource is where the notice of the node going away is polled from: the metadata of an
+// AWS spot instance (aws), of a GCE preemptible instance (gcp), or any URL answering 200 with a
+// notice and 404 without
+type preemptionSource struct {
+	kind     string
+	url      string
+	tokenURL string
+}
+
+// Returns the source of the notices of SD_PREEMPTION_NOTICE, nil if it is not set
+func preemptionSourceOf(value string) (*preemptionSource, error) {
+	switch value = strings.TrimSpace(value); value {
+	case "":
+		return nil, nil
+	case "aws":
+		return &preemptionSource{kind: "aws", url: awsInstanceActionURL, tokenURL: awsTokenURL}, nil
+	case "gcp":
+		return &preemptionSource{kind: "gcp", url: gcpPreemptedURL}, nil
+	}
+	if u, err := url.Parse(value); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid SD_PREEMPTION_NOTICE %q, want aws, gcp or a URL", value)
+	}
+	return &preemptionSource{kind: "url", url: value}, nil
+}
+
+// Returns the notice of the source at now, nil without one. A notice of a URL gives grace.
+func (s *preemptionSource) poll(client *http.Client, now time.Time, grace time.Duration) (*preemptionNotice, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch s.kind {
+	case "aws":
+		// IMDSv2 wants a session token, IMDSv1 does without
+		if token, err := s.awsToken(client); err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+	case "gcp":
+		req.Header.Set("Metadata-Flavor", "Google")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %d", s.url, res.StatusCode)
+	}
+
+	switch s.kind {
+	case "aws":
+		var action struct {
+			Action string    `json:"action"`
+			Time   time.Time `json:"time"`
+		}
+		notice := &preemptionNotice{reason: "aws spot interruption", deadline: now.Add(awsSpotGrace)}
+		if err := json.Unmarshal(body, &action); err == nil && !action.Time.IsZero() {
+			notice.deadline = action.Time
+		}
+		return notice, nil
+	case "gcp":
+		if strings.TrimSpace(string(body)) != "TRUE" {
+			return nil, nil
+		}
+		return &preemptionNotice{reason: "gcp preemption", deadline: now.Add(gcpPreemptionGrace)}, nil
+	}
+	return &preemptionNotice{reason: "preemption notice", deadline: now.Add(grace)}, nil
+}
+
+// Returns a session token of the EC2 instance metadata
+func (s *preemptionSource) awsToken(client *http.Client) (string, error) {
+	req, err := http.NewRequest("PUT", s.tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %d", s.tokenURL, res.StatusCode)
+	}
+	token, err := ioutil.ReadAll(res.Body)
+	return strings.TrimSpace(string(token)), err
+}
+
+// drainer winds the build down when its node goes away, on a notice of the node or a SIGTERM that
+// is not an abort: the running step has half of the time left to finish before it is stopped, no
+// other step starts, and the teardowns run in the rest of the time. The build is then Preempted.
+// A nil drainer aborts the build on any signal, like without draining.
+type drainer struct {
+	api       screwdriver.API
+	buildID   int
+	source    *preemptionSource
+	onSIGTERM bool
+	grace     time.Duration
+	client    *http.Client
+
+	mu     sync.Mutex
+	notice *preemptionNotice
+}
+
+// Returns the drainer of the build buildID, polling the notices of SD_PREEMPTION_NOTICE and draining
+// on SIGTERM if SD_DRAIN_ON_SIGTERM is true in the launcher environment, nil if neither is set.
+// The build has SD_TERMINATION_GRACE_PERIOD_SECS of env after a SIGTERM or a notice of a URL.
+func newDrainer(env []string, api screwdriver.API, buildID int) (*drainer, error) {
+	source, err := preemptionSourceOf(os.Getenv("SD_PREEMPTION_NOTICE"))
+	if err != nil {
+		return nil, err
+	}
+	onSIGTERM := false
+	if value := strings.TrimSpace(os.Getenv("SD_DRAIN_ON_SIGTERM")); value != "" {
+		if onSIGTERM, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("Invalid SD_DRAIN_ON_SIGTERM %q, want true or false", value)
+		}
+	}
+	if source == nil && !onSIGTERM {
+		return nil, nil
+	}
+
+	grace, err := terminationGrace(env)
+	if err != nil {
+		return nil, err
+	}
+	return &drainer{
+		api:       api,
+		buildID:   buildID,
+		source:    source,
+		onSIGTERM: onSIGTERM,
+		grace:     grace,
+		client:    &http.Client{Timeout: preemptionTimeout},
+	}, nil
+}
+
+// Polls the preemption notices until ctx is done, draining the build with ch on the first one
+func (d *drainer) watch(ctx context.Context, ch chan<- error) {
+	if d == nil || d.source == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(preemptionPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			notice, err := d.source.poll(d.client, time.Now(), d.grace)
+			if err != nil {
+				logger.Debugf("Failed to poll the preemption notice: %v", err)
+				continue
+			}
+			if notice != nil {
+				d.drain(ctx, *notice, ch)
+				return
+			}
+		}
+	}()
+}
+
+// Stops the build on ch on the signals of sigs: a SIGTERM drains the build unless the API has it
+// aborted, any other signal aborts it
+func (d *drainer) handleSignals(ctx context.Context, sigs chan os.Signal, ch chan<- error) {
+	if d == nil || !d.onSIGTERM {
+		notifySignal(sigs, ch)
+		return
+	}
+	for sig := range sigs {
+		if sig == syscall.SIGTERM && d.preempted() == "" {
+			build, err := d.api.BuildFromID(d.buildID)
+			if err == nil && build.Status != screwdriver.Aborted {
+				d.drain(ctx, preemptionNotice{reason: "SIGTERM", deadline: time.Now().Add(d.grace)}, ch)
+				continue
+			}
+		}
+		logger.Infof("Received %s signal in launcher, processing signal", sig)
+		ch <- Aborted{}
+		return
+	}
+}
+
+// Drains the build for notice: the running step is stopped with a Preempted error on ch once half
+// of the time left is over, unless ctx is done first
+func (d *drainer) drain(ctx context.Context, notice preemptionNotice, ch chan<- error) {
+	d.mu.Lock()
+	if d.notice != nil {
+		d.mu.Unlock()
+		return
+	}
+	d.notice = &notice
+	d.mu.Unlock()
+
+	left := time.Until(notice.deadline)
+	logger.Warnf("The node of the build is going away (%s) in %v, the running step has %v to finish before the teardowns run", notice.reason, left.Round(time.Second), (left / 2).Round(time.Second))
+	go func() {
+		timer := time.NewTimer(left / 2)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		select {
+		case ch <- Preempted{Reason: notice.reason}:
+		default:
+			// The build is stopping already
+		}
+	}()
+}
+
+// Returns how long the processes of a step stopped as the node of the build goes away have to exit,
+// at most grace and half of the time left, the teardowns having the rest, or grace if it does not
+func (d *drainer) stepGrace(grace time.Duration) time.Duration {
+	if d == nil {
+		return grace
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.notice == nil {
+		return grace
+	}
+	if left := time.Until(d.notice.deadline) / 2; left < grace {
+		if left < 0 {
+			return 0
+		}
+		return left
+	}
+	return grace
+}
+
+// Returns the reason the node of the build goes away for, "" if it does not
+func (d *drainer) preempted() string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.notice == nil {
+		return ""
+	}
+	return d.notice.reason
+}
@@ -0,0 +1,217 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreemptionSourceOf(t *testing.T) {
+	tests := []struct {
+		value string
+		kind  string
+		err   bool
+	}{
+		{"", "", false},
+		{"aws", "aws", false},
+		{" gcp ", "gcp", false},
+		{"http://localhost:8080/notice", "url", false},
+		{"azure", "", true},
+		{"ftp://localhost/notice", "", true},
+	}
+	for _, test := range tests {
+		source, err := preemptionSourceOf(test.value)
+		if (err != nil) != test.err || (source == nil) != (test.kind == "") || (source != nil && source.kind != test.kind) {
+			t.Errorf("preemptionSourceOf(%q) = %+v, %v, want kind %q and error %v", test.value, source, err, test.kind, test.err)
+		}
+	}
+}
+
+func TestPreemptionSourcePoll(t *testing.T) {
+	noticed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("imds-token"))
+		case "/latest/meta-data/spot/instance-action":
+			if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !noticed {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"action": "terminate", "time": "2021-03-01T10:02:00Z"}`))
+		case "/computeMetadata/v1/instance/preempted":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if !noticed {
+				w.Write([]byte("FALSE"))
+				return
+			}
+			w.Write([]byte("TRUE"))
+		case "/notice":
+			if !noticed {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	sources := []struct {
+		source preemptionSource
+		notice preemptionNotice
+	}{
+		{preemptionSource{kind: "aws", url: server.URL + "/latest/meta-data/spot/instance-action", tokenURL: server.URL + "/latest/api/token"}, preemptionNotice{"aws spot interruption", now.Add(2 * time.Minute)}},
+		{preemptionSource{kind: "gcp", url: server.URL + "/computeMetadata/v1/instance/preempted"}, preemptionNotice{"gcp preemption", now.Add(30 * time.Second)}},
+		{preemptionSource{kind: "url", url: server.URL + "/notice"}, preemptionNotice{"preemption notice", now.Add(time.Minute)}},
+	}
+	for _, test := range sources {
+		noticed = false
+		notice, err := test.source.poll(http.DefaultClient, now, time.Minute)
+		if notice != nil || err != nil {
+			t.Errorf("%s: poll() = %+v, %v, want no notice", test.source.kind, notice, err)
+		}
+		noticed = true
+		notice, err = test.source.poll(http.DefaultClient, now, time.Minute)
+		if notice == nil || err != nil || notice.reason != test.notice.reason || !notice.deadline.Equal(test.notice.deadline) {
+			t.Errorf("%s: poll() = %+v, %v, want %+v", test.source.kind, notice, err, test.notice)
+		}
+	}
+
+	source := preemptionSource{kind: "url", url: server.URL + "/error"}
+	if _, err := source.poll(http.DefaultClient, now, time.Minute); err == nil {
+		t.Errorf("poll() of a failing URL should fail")
+	}
+}
+
+func TestNewDrainer(t *testing.T) {
+	defer os.Setenv("SD_PREEMPTION_NOTICE", os.Getenv("SD_PREEMPTION_NOTICE"))
+	defer os.Setenv("SD_DRAIN_ON_SIGTERM", os.Getenv("SD_DRAIN_ON_SIGTERM"))
+	os.Setenv("SD_PREEMPTION_NOTICE", "")
+	os.Setenv("SD_DRAIN_ON_SIGTERM", "")
+
+	d, err := newDrainer(nil, MockAPI{}, 1)
+	assert.Nil(t, d)
+	assert.Nil(t, err)
+	assert.Equal(t, "", d.preempted())
+
+	os.Setenv("SD_DRAIN_ON_SIGTERM", "true")
+	d, err = newDrainer([]string{"SD_TERMINATION_GRACE_PERIOD_SECS=90"}, MockAPI{}, 1)
+	assert.Nil(t, err)
+	if assert.NotNil(t, d) {
+		assert.Equal(t, 90*time.Second, d.grace)
+		assert.True(t, d.onSIGTERM)
+		assert.Nil(t, d.source)
+	}
+	d, err = newDrainer(nil, MockAPI{}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultTerminationGrace, d.grace)
+	_, err = newDrainer([]string{"SD_TERMINATION_GRACE_PERIOD_SECS=soon"}, MockAPI{}, 1)
+	assert.NotNil(t, err)
+
+	os.Setenv("SD_DRAIN_ON_SIGTERM", "maybe")
+	_, err = newDrainer(nil, MockAPI{}, 1)
+	assert.NotNil(t, err)
+}
+
+func TestRunDrainsOnSIGTERM(t *testing.T) {
+	envFilepath := "/tmp/testDrain"
+	setupTestCase(t, envFilepath)
+	defer os.Setenv("SD_DRAIN_ON_SIGTERM", os.Getenv("SD_DRAIN_ON_SIGTERM"))
+	os.Setenv("SD_DRAIN_ON_SIGTERM", "true")
+
+	tests := []struct {
+		name string
+		cmd  string
+		code int
+	}{
+		// The running step finishes within half of the grace period
+		{"finish", "sleep 0.2", ExitOk},
+		// The running step is stopped after half of the grace period
+		{"stop", "sleep 30", ExitAborted},
+	}
+	for _, test := range tests {
+		testBuild := screwdriver.Build{
+			ID: 12345,
+			Commands: []screwdriver.CommandDef{
+				{Name: "work", Cmd: test.cmd},
+				{Name: "deploy", Cmd: "echo deployed"},
+				{Name: "teardown-cleanup", Cmd: "echo cleaned up"},
+			},
+			Environment: []map[string]string{},
+		}
+		codes := map[string]int{}
+		testAPI := screwdriver.API(MockAPI{
+			buildFromID: func(buildID int) (screwdriver.Build, error) {
+				return screwdriver.Build{ID: buildID, Status: screwdriver.Running}, nil
+			},
+			updateStepStop: func(buildID int, stepName string, exitCode int) error {
+				codes[stepName] = exitCode
+				return nil
+			},
+		})
+		emitter := MockEmitter{
+			startCmd: func(cmd screwdriver.CommandDef) {
+				if cmd.Name == "work" {
+					syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+				}
+			},
+		}
+
+		start := time.Now()
+		err := Run("", []string{"SD_TERMINATION_GRACE_PERIOD_SECS=2"}, &emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+		if !errors.Is(err, ErrPreempted) || errors.Is(err, ErrAborted) {
+			t.Errorf("%s: Run() = %v, want the build preempted", test.name, err)
+		}
+		if FailureClass(err) != ClassPreempted {
+			t.Errorf("%s: the class of %v = %q, want %q", test.name, err, FailureClass(err), ClassPreempted)
+		}
+		if elapsed := time.Since(start); elapsed > 20*time.Second {
+			t.Errorf("%s: the step should stop within the grace period, took %v", test.name, elapsed)
+		}
+		if codes["work"] != test.code {
+			t.Errorf("%s: exit code of the running step = %d, want %d", test.name, codes["work"], test.code)
+		}
+		if _, ok := codes["deploy"]; ok {
+			t.Errorf("%s: no step should start once the build drains", test.name)
+		}
+		if _, ok := codes["teardown-cleanup"]; !ok {
+			t.Errorf("%s: the teardowns should run when the build drains", test.name)
+		}
+	}
+}
+
+func TestDrainerAbortsAbortedBuild(t *testing.T) {
+	d := &drainer{
+		api: MockAPI{buildFromID: func(buildID int) (screwdriver.Build, error) {
+			return screwdriver.Build{Status: screwdriver.Aborted}, nil
+		}},
+		onSIGTERM: true,
+		grace:     time.Minute,
+	}
+	sigs := make(chan os.Signal, 1)
+	ch := make(chan error, 1)
+	sigs <- syscall.SIGTERM
+	d.handleSignals(context.Background(), sigs, ch)
+	assert.Equal(t, Aborted{}, <-ch)
+	assert.Equal(t, "", d.preempted())
+}
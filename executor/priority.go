@@ -0,0 +1,160 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// IO scheduling classes, as the kernel numbers them
+const (
+	ioClassRealtime   = 1
+	ioClassBestEffort = 2
+	ioClassIdle       = 3
+	// defaultIOLevel is the level of the realtime and best-effort classes without one
+	defaultIOLevel = 4
+	// maxNice is the lowest CPU priority
+	maxNice = 19
+)
+
+// ioClassNames are the IO scheduling classes by their name in SD_IONICE and ioNice
+var ioClassNames = map[string]int{
+	"realtime":    ioClassRealtime,
+	"best-effort": ioClassBestEffort,
+	"idle":        ioClassIdle,
+}
+
+// ioPriority is an IO scheduling class and its level from 0, the highest priority, to 7. The zero
+// value keeps the IO priority as it is.
+type ioPriority struct {
+	class int
+	level int
+}
+
+// Parses the IO priority s: idle, or realtime or best-effort optionally followed by :level
+func parseIOPriority(s string) (ioPriority, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ioPriority{}, nil
+	}
+	name, level := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, level = s[:i], s[i+1:]
+	}
+	class, ok := ioClassNames[name]
+	if !ok {
+		return ioPriority{}, fmt.Errorf("Unknown IO scheduling class %q, want realtime, best-effort or idle", name)
+	}
+	p := ioPriority{class: class}
+	if class == ioClassIdle {
+		if level != "" {
+			return ioPriority{}, fmt.Errorf("The idle IO scheduling class has no level")
+		}
+		return p, nil
+	}
+	p.level = defaultIOLevel
+	if level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return ioPriority{}, fmt.Errorf("Invalid IO priority level %q, want 0 to 7", level)
+		}
+		p.level = n
+	}
+	return p, nil
+}
+
+// Returns the options of ionice for the IO priority
+func (p ioPriority) ioniceArgs() string {
+	if p.class == ioClassIdle {
+		return "-c " + strconv.Itoa(p.class)
+	}
+	return "-c " + strconv.Itoa(p.class) + " -n " + strconv.Itoa(p.level)
+}
+
+// processPriority is the CPU and IO priority of the processes of a build or a step: their niceness
+// and IO priority
+type processPriority struct {
+	nice int
+	io   ioPriority
+}
+
+// Returns the priority of the processes of the build, SD_NICE and SD_IONICE in the launcher
+// environment, which the launcher keeps by default
+func buildPriority() (processPriority, error) {
+	var p processPriority
+	if value := strings.TrimSpace(os.Getenv("SD_NICE")); value != "" {
+		nice, err := strconv.Atoi(value)
+		if err != nil || nice < -20 || nice > maxNice {
+			return p, fmt.Errorf("Invalid SD_NICE %q, want a niceness from -20 to 19", value)
+		}
+		p.nice = nice
+	}
+	io, err := parseIOPriority(os.Getenv("SD_IONICE"))
+	if err != nil {
+		return p, fmt.Errorf("Invalid SD_IONICE: %v", err)
+	}
+	p.io = io
+	return p, nil
+}
+
+// Returns the priority of the processes of the step of cmd, whose nice adds to the niceness of the
+// build and whose ioNice replaces its IO priority
+func (p processPriority) forStep(cmd screwdriver.CommandDef) processPriority {
+	p.nice += cmd.Nice
+	if p.nice > maxNice {
+		p.nice = maxNice
+	}
+	if io, err := parseIOPriority(cmd.IONice); err == nil && io.class != 0 {
+		p.io = io
+	}
+	return p
+}
+
+// Sets the priority of the process pid, which its children inherit
+func (p processPriority) apply(pid int) error {
+	if p.nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, p.nice); err != nil {
+			return fmt.Errorf("Setting the niceness to %d: %v", p.nice, err)
+		}
+	}
+	if p.io.class != 0 {
+		if err := setIOPriority(pid, p.io); err != nil {
+			return fmt.Errorf("Setting the IO priority: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns an error if the nice or ioNice of the step of cmd is invalid, or if it runs in a container
+func checkPriority(cmd screwdriver.CommandDef) error {
+	if cmd.Nice == 0 && cmd.IONice == "" {
+		return nil
+	}
+	if cmd.Nice < 0 || cmd.Nice > maxNice {
+		return fmt.Errorf("Invalid nice %d of step %q, want 0 to 19", cmd.Nice, cmd.Name)
+	}
+	if _, err := parseIOPriority(cmd.IONice); err != nil {
+		return fmt.Errorf("Invalid ioNice of step %q: %v", cmd.Name, err)
+	}
+	if cmd.Image != "" || cmd.Container != "" {
+		return fmt.Errorf("Step %q in a container cannot have a nice or ioNice", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the prefix running the command of the step of cmd in the build shell with its nice and
+// ioNice, which adjust the priority of the shell, or ""
+func priorityCommand(cmd screwdriver.CommandDef) string {
+	prefix := ""
+	if cmd.Nice != 0 {
+		prefix += "nice -n " + strconv.Itoa(cmd.Nice) + " "
+	}
+	if io, err := parseIOPriority(cmd.IONice); err == nil && io.class != 0 {
+		prefix += "ionice " + io.ioniceArgs() + " "
+	}
+	return prefix
+}
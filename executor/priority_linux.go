@@ -0,0 +1,17 @@
+package executor
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ioprioWhoProcess makes ioprio_set apply to a single process
+const ioprioWhoProcess = 1
+
+// Sets the IO priority of the process pid with ioprio_set
+func setIOPriority(pid int, p ioPriority) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(p.class<<13|p.level))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Fails, the IO priority of processes can only be set on Linux
+func setIOPriority(pid int, p ioPriority) error {
+	return fmt.Errorf("Setting the IO priority is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,104 @@
+package executor
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestParseIOPriority(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ioPriority
+		err   bool
+	}{
+		{"", ioPriority{}, false},
+		{"idle", ioPriority{ioClassIdle, 0}, false},
+		{"best-effort", ioPriority{ioClassBestEffort, defaultIOLevel}, false},
+		{" best-effort:7 ", ioPriority{ioClassBestEffort, 7}, false},
+		{"realtime:0", ioPriority{ioClassRealtime, 0}, false},
+		{"idle:3", ioPriority{}, true},
+		{"best-effort:8", ioPriority{}, true},
+		{"low", ioPriority{}, true},
+	}
+	for _, test := range tests {
+		if got, err := parseIOPriority(test.value); got != test.want || (err != nil) != test.err {
+			t.Errorf("parseIOPriority(%q) = %v, %v, want %v and error %v", test.value, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestBuildPriority(t *testing.T) {
+	defer os.Setenv("SD_NICE", os.Getenv("SD_NICE"))
+	defer os.Setenv("SD_IONICE", os.Getenv("SD_IONICE"))
+	os.Setenv("SD_NICE", "10")
+	os.Setenv("SD_IONICE", "idle")
+	p, err := buildPriority()
+	if want := (processPriority{10, ioPriority{ioClassIdle, 0}}); p != want || err != nil {
+		t.Errorf("buildPriority() = %v, %v, want %v", p, err, want)
+	}
+	if got, want := p.forStep(screwdriver.CommandDef{Nice: 15, IONice: "best-effort:2"}), (processPriority{maxNice, ioPriority{ioClassBestEffort, 2}}); got != want {
+		t.Errorf("forStep() = %v, want %v", got, want)
+	}
+	for _, value := range []string{"20", "-21", "low"} {
+		os.Setenv("SD_NICE", value)
+		if _, err := buildPriority(); err == nil {
+			t.Errorf("buildPriority() with SD_NICE %q should fail", value)
+		}
+	}
+}
+
+func TestCheckPriority(t *testing.T) {
+	tests := []struct {
+		cmd screwdriver.CommandDef
+		err bool
+	}{
+		{screwdriver.CommandDef{Name: "test"}, false},
+		{screwdriver.CommandDef{Name: "test", Nice: 19, IONice: "idle"}, false},
+		{screwdriver.CommandDef{Name: "test", Nice: -5}, true},
+		{screwdriver.CommandDef{Name: "test", IONice: "fast"}, true},
+		{screwdriver.CommandDef{Name: "test", Nice: 5, Image: "node:12"}, true},
+	}
+	for _, test := range tests {
+		if err := checkPriority(test.cmd); (err != nil) != test.err {
+			t.Errorf("checkPriority(%+v) = %v, want error %v", test.cmd, err, test.err)
+		}
+	}
+	if got, want := priorityCommand(screwdriver.CommandDef{Nice: 5, IONice: "best-effort:7"}), "nice -n 5 ionice -c 2 -n 7 "; got != want {
+		t.Errorf("priorityCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestRunSetsProcessPriority(t *testing.T) {
+	if _, err := exec.LookPath("ionice"); err != nil {
+		t.Skip("ionice is not installed")
+	}
+	envFilepath := "/tmp/testProcessPriority"
+	setupTestCase(t, envFilepath)
+	defer os.Setenv("SD_NICE", os.Getenv("SD_NICE"))
+	defer os.Setenv("SD_IONICE", os.Getenv("SD_IONICE"))
+	os.Setenv("SD_NICE", "2")
+	os.Setenv("SD_IONICE", "idle")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "build", Cmd: `test "$(nice)" = 2 && test "$(ionice)" = idle`},
+			{Name: "lint", Cmd: `test "$(nice)" = 5 && test "$(ionice)" = "best-effort: prio 7"`, Nice: 3, IONice: "best-effort:7"},
+			{Name: "teardown-report", Cmd: `test "$(nice)" = 3 && test "$(ionice)" = idle`, Nice: 1},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			codes[stepName] = exitCode
+			return nil
+		},
+	})
+	if err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v, exit codes %v", err, codes)
+	}
+}
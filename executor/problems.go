@@ -0,0 +1,311 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// maxStepAnnotations bounds the annotations of a step sent to the API, the others are dropped
+const maxStepAnnotations = 500
+
+// ansiEscape matches the escape sequences coloring the output of the compilers and linters
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// problemMatcher turns the lines of output of a step matching Pattern into annotations, from its
+// named groups: file, line, column, severity and message. A matcher whose tool prints the file
+// apart from its problems sets the file of the problems that follow with the file group of the
+// lines matching FilePattern. Severity is the severity of the problems without a severity group,
+// error by default.
+type problemMatcher struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	FilePattern string `json:"filePattern,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+
+	pattern, filePattern *regexp.Regexp
+}
+
+// problemMatchers are the matchers cluster admins add to the built-in ones
+type problemMatchers struct {
+	Matchers []problemMatcher `json:"matchers"`
+}
+
+// builtinProblemMatchers match the errors and warnings of the usual compilers and linters
+var builtinProblemMatchers = []problemMatcher{
+	{Name: "gcc", pattern: regexp.MustCompile(`^(?P<file>[^\s:]+):(?P<line>\d+):(?:(?P<column>\d+):)? (?:fatal )?(?P<severity>error|warning|note): (?P<message>.+)$`)},
+	{Name: "go", pattern: regexp.MustCompile(`^\s*(?P<file>[^\s:]+\.go):(?P<line>\d+):(?:(?P<column>\d+):)? (?P<message>.+)$`)},
+	{Name: "tsc", pattern: regexp.MustCompile(`^(?P<file>[^\s(]+)\((?P<line>\d+),(?P<column>\d+)\): (?P<severity>error|warning) (?P<message>TS\d+: .+)$`)},
+	{Name: "eslint-stylish", filePattern: regexp.MustCompile(`^(?P<file>(?:/|[A-Za-z]:\\)\S.*)$`), pattern: regexp.MustCompile(`^\s+(?P<line>\d+):(?P<column>\d+)\s+(?P<severity>error|warning)\s+(?P<message>.+)$`)},
+	{Name: "eslint-compact", pattern: regexp.MustCompile(`^(?P<file>[^\s:]+): line (?P<line>\d+), col (?P<column>\d+), (?P<severity>Error|Warning) - (?P<message>.+)$`)},
+}
+
+// Loads the problem matchers from the JSON file at SD_PROBLEM_MATCHERS in the launcher
+// environment and the built-in ones, by name. A matcher of the file replaces the built-in one with
+// its name.
+func loadProblemMatchers() (map[string]*problemMatcher, error) {
+	matchers := map[string]*problemMatcher{}
+	for i := range builtinProblemMatchers {
+		matchers[builtinProblemMatchers[i].Name] = &builtinProblemMatchers[i]
+	}
+	path := strings.TrimSpace(os.Getenv("SD_PROBLEM_MATCHERS"))
+	if path == "" {
+		return matchers, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	custom, err := parseProblemMatchers(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := range custom {
+		matchers[custom[i].Name] = &custom[i]
+	}
+	return matchers, nil
+}
+
+// Parses and validates problem matchers
+func parseProblemMatchers(data []byte) ([]problemMatcher, error) {
+	var m problemMatchers
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Parsing the problem matchers: %v", err)
+	}
+
+	for i := range m.Matchers {
+		matcher := &m.Matchers[i]
+		if matcher.Name == "" {
+			return nil, fmt.Errorf("Problem matcher %d has no name", i)
+		}
+		switch matcher.Severity {
+		case "", screwdriver.AnnotationError, screwdriver.AnnotationWarning, screwdriver.AnnotationNotice:
+		default:
+			return nil, fmt.Errorf("Problem matcher %q has severity %q, want %q, %q or %q", matcher.Name, matcher.Severity, screwdriver.AnnotationError, screwdriver.AnnotationWarning, screwdriver.AnnotationNotice)
+		}
+
+		var err error
+		if matcher.pattern, err = regexp.Compile(matcher.Pattern); err != nil {
+			return nil, fmt.Errorf("Problem matcher %q: %v", matcher.Name, err)
+		}
+		if matcher.pattern.SubexpIndex("message") < 0 {
+			return nil, fmt.Errorf("Problem matcher %q has no message group in its pattern", matcher.Name)
+		}
+		if matcher.FilePattern != "" {
+			if matcher.filePattern, err = regexp.Compile(matcher.FilePattern); err != nil {
+				return nil, fmt.Errorf("Problem matcher %q: %v", matcher.Name, err)
+			}
+			if matcher.filePattern.SubexpIndex("file") < 0 {
+				return nil, fmt.Errorf("Problem matcher %q has no file group in its file pattern", matcher.Name)
+			}
+		} else if matcher.pattern.SubexpIndex("file") < 0 {
+			return nil, fmt.Errorf("Problem matcher %q has no file group in its pattern and no file pattern", matcher.Name)
+		}
+	}
+	return m.Matchers, nil
+}
+
+// Returns an error if a step of commands has a problem matcher that is not one of matchers
+func checkProblemMatchers(matchers map[string]*problemMatcher, commands ...[]screwdriver.CommandDef) error {
+	for _, cmds := range commands {
+		for _, cmd := range cmds {
+			for _, name := range cmd.ProblemMatchers {
+				if matchers[name] == nil {
+					return fmt.Errorf("Unknown problem matcher %q of step %q", name, cmd.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the annotation of the problem of line if it matches m, with file the file of the
+// problems of m without a file group
+func (m *problemMatcher) match(line, file string) (screwdriver.Annotation, bool) {
+	groups := m.pattern.FindStringSubmatch(line)
+	if groups == nil {
+		return screwdriver.Annotation{}, false
+	}
+	group := func(name string) string {
+		if i := m.pattern.SubexpIndex(name); i >= 0 {
+			return strings.TrimSpace(groups[i])
+		}
+		return ""
+	}
+
+	annotation := screwdriver.Annotation{
+		File:     file,
+		Severity: m.Severity,
+		Message:  group("message"),
+		Matcher:  m.Name,
+	}
+	if f := group("file"); f != "" {
+		annotation.File = f
+	}
+	annotation.Line, _ = strconv.Atoi(group("line"))
+	annotation.Column, _ = strconv.Atoi(group("column"))
+	switch strings.ToLower(group("severity")) {
+	case "":
+	case "error", "fatal", "failure":
+		annotation.Severity = screwdriver.AnnotationError
+	case "warning", "warn":
+		annotation.Severity = screwdriver.AnnotationWarning
+	default:
+		annotation.Severity = screwdriver.AnnotationNotice
+	}
+	if annotation.Severity == "" {
+		annotation.Severity = screwdriver.AnnotationError
+	}
+	return annotation, annotation.File != "" && annotation.Message != ""
+}
+
+// problemScanner is the emitter of the build, turning the output of each step into annotations
+// of the source with the problem matchers of the step
+type problemScanner struct {
+	screwdriver.Emitter
+	matchers  map[string]*problemMatcher
+	sourceDir string
+
+	mu   sync.Mutex
+	step string
+	line []byte
+	// active are the matchers of the current step, and files the file each of them is at
+	active []*problemMatcher
+	files  map[string]string
+	// annotations are the problems found in the output of each step, seen the ones found already,
+	// and dropped how many are left out past the limit, by name
+	annotations map[string][]screwdriver.Annotation
+	seen        map[string]map[screwdriver.Annotation]bool
+	dropped     map[string]int
+}
+
+func newProblemScanner(emitter screwdriver.Emitter, matchers map[string]*problemMatcher, sourceDir string) *problemScanner {
+	return &problemScanner{
+		Emitter:     emitter,
+		matchers:    matchers,
+		sourceDir:   sourceDir,
+		annotations: map[string][]screwdriver.Annotation{},
+		seen:        map[string]map[screwdriver.Annotation]bool{},
+		dropped:     map[string]int{},
+	}
+}
+
+// StartCmd attributes the output from now on to cmd, scanned with its problem matchers
+func (s *problemScanner) StartCmd(cmd screwdriver.CommandDef) {
+	s.mu.Lock()
+	s.flush()
+	s.step, s.active, s.files = cmd.Name, nil, map[string]string{}
+	for _, name := range cmd.ProblemMatchers {
+		if m := s.matchers[name]; m != nil {
+			s.active = append(s.active, m)
+		}
+	}
+	s.mu.Unlock()
+	s.Emitter.StartCmd(cmd)
+}
+
+func (s *problemScanner) Write(p []byte) (int, error) {
+	s.scanOutput(p)
+	return s.Emitter.Write(p)
+}
+
+// Scans p, output of the current step, for the problems its matchers match
+func (s *problemScanner) scanOutput(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.active) == 0 {
+		return
+	}
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		s.scan(s.line[:i])
+		s.line = s.line[i+1:]
+	}
+	if len(s.line) > maxScannedLine {
+		s.flush()
+	}
+}
+
+// Unwrap returns the emitter the scanner writes to
+func (s *problemScanner) Unwrap() screwdriver.Emitter {
+	return s.Emitter
+}
+
+// Scans the partial line of the current step
+func (s *problemScanner) flush() {
+	if len(s.line) > 0 {
+		s.scan(s.line)
+		s.line = nil
+	}
+}
+
+// Records the problem of line the first matcher matching it has, or the file it sets
+func (s *problemScanner) scan(line []byte) {
+	text := ansiEscape.ReplaceAllString(strings.TrimRight(string(line), "\r"), "")
+	for _, m := range s.active {
+		if annotation, ok := m.match(text, s.files[m.Name]); ok {
+			s.add(annotation)
+			return
+		}
+		if m.filePattern != nil {
+			if groups := m.filePattern.FindStringSubmatch(text); groups != nil {
+				s.files[m.Name] = strings.TrimSpace(groups[m.filePattern.SubexpIndex("file")])
+				return
+			}
+		}
+	}
+}
+
+// Adds annotation to the ones of the current step, with its file relative to the source directory
+func (s *problemScanner) add(annotation screwdriver.Annotation) {
+	file := filepath.Clean(annotation.File)
+	if rel, err := filepath.Rel(s.sourceDir, file); s.sourceDir != "" && filepath.IsAbs(file) && err == nil && !strings.HasPrefix(rel, "..") {
+		file = rel
+	}
+	annotation.File = filepath.ToSlash(file)
+
+	if s.seen[s.step][annotation] {
+		return
+	}
+	if len(s.annotations[s.step]) >= maxStepAnnotations {
+		s.dropped[s.step]++
+		return
+	}
+	if s.seen[s.step] == nil {
+		s.seen[s.step] = map[screwdriver.Annotation]bool{}
+	}
+	s.seen[s.step][annotation] = true
+	s.annotations[s.step] = append(s.annotations[s.step], annotation)
+}
+
+// Returns the annotations of the step with name and how many were dropped past the limit,
+// forgetting them. It returns nothing on a nil scanner.
+func (s *problemScanner) take(name string) ([]screwdriver.Annotation, int) {
+	if s == nil {
+		return nil, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == s.step {
+		s.flush()
+	}
+	annotations, dropped := s.annotations[name], s.dropped[name]
+	delete(s.annotations, name)
+	delete(s.seen, name)
+	delete(s.dropped, name)
+	return annotations, dropped
+}
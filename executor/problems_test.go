@@ -0,0 +1,159 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProblemMatchers(t *testing.T) {
+	tests := []struct {
+		json string
+		err  bool
+	}{
+		{json: `{"matchers": [{"name": "pylint", "pattern": "^(?P<file>[^:]+):(?P<line>\\d+): (?P<message>.+)$", "severity": "warning"}]}`},
+		{json: `{"matchers": [{"name": "stylish", "filePattern": "^(?P<file>/.+)$", "pattern": "^\\s+(?P<line>\\d+) (?P<message>.+)$"}]}`},
+		{json: `{"matchers": [{"pattern": "(?P<file>.+): (?P<message>.+)"}]}`, err: true},
+		{json: `{"matchers": [{"name": "a", "pattern": "(?P<file>.+): (?P<message>.+)", "severity": "fatal"}]}`, err: true},
+		{json: `{"matchers": [{"name": "a", "pattern": "(?P<file>.+): .+"}]}`, err: true},
+		{json: `{"matchers": [{"name": "a", "pattern": "(?P<line>\\d+): (?P<message>.+)"}]}`, err: true},
+		{json: `{"matchers": [{"name": "a", "pattern": "(?P<message>.+)", "filePattern": "^/.+$"}]}`, err: true},
+		{json: `{"matchers": [{"name": "a", "pattern": "(?P<file>.+): (?P<message>.+"}]}`, err: true},
+		{json: `{"matchers": `, err: true},
+	}
+	for _, test := range tests {
+		if _, err := parseProblemMatchers([]byte(test.json)); (err != nil) != test.err {
+			t.Errorf("parseProblemMatchers(%s) error = %v, want error %v", test.json, err, test.err)
+		}
+	}
+}
+
+func TestLoadProblemMatchers(t *testing.T) {
+	defer os.Setenv("SD_PROBLEM_MATCHERS", os.Getenv("SD_PROBLEM_MATCHERS"))
+	dir, err := ioutil.TempDir("", "matchers")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("SD_PROBLEM_MATCHERS", "")
+	matchers, err := loadProblemMatchers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assert.Len(t, matchers, len(builtinProblemMatchers))
+
+	file := filepath.Join(dir, "matchers.json")
+	custom := `{"matchers": [{"name": "go", "pattern": "^(?P<file>\\S+\\.go):(?P<line>\\d+): (?P<message>.+)$", "severity": "warning"}, {"name": "shellcheck", "pattern": "^(?P<file>[^:]+):(?P<line>\\d+):(?P<column>\\d+): (?P<severity>\\w+): (?P<message>.+)$"}]}`
+	if err := ioutil.WriteFile(file, []byte(custom), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.Setenv("SD_PROBLEM_MATCHERS", file)
+	matchers, err = loadProblemMatchers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assert.Len(t, matchers, len(builtinProblemMatchers)+1)
+	assert.Equal(t, screwdriver.AnnotationWarning, matchers["go"].Severity)
+	assert.NotNil(t, matchers["gcc"])
+
+	assert.NoError(t, checkProblemMatchers(matchers, []screwdriver.CommandDef{{Name: "lint", ProblemMatchers: []string{"shellcheck", "eslint-stylish"}}}))
+	assert.EqualError(t, checkProblemMatchers(matchers, nil, []screwdriver.CommandDef{{Name: "teardown-lint", ProblemMatchers: []string{"pylint"}}}), `Unknown problem matcher "pylint" of step "teardown-lint"`)
+
+	os.Setenv("SD_PROBLEM_MATCHERS", filepath.Join(dir, "missing.json"))
+	if _, err := loadProblemMatchers(); err == nil {
+		t.Errorf("A missing SD_PROBLEM_MATCHERS should be an error")
+	}
+}
+
+func TestProblemScanner(t *testing.T) {
+	matchers, err := loadProblemMatchers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	emitter := &MockEmitter{}
+	s := newProblemScanner(emitter, matchers, "/sd/workspace/src")
+
+	s.StartCmd(screwdriver.CommandDef{Name: "build", ProblemMatchers: []string{"gcc", "go"}})
+	fmt.Fprint(s, "cc -c main.c\n/sd/workspace/src/main.c:3:7: \x1b[1;31merror:\x1b[0m expected ';' before 'return'\r\n")
+	fmt.Fprint(s, "main.c:3:7: error: expected ';' before 'return'\n")
+	fmt.Fprint(s, "lib/util.h:10:1: warning: unused function\n./cmd/main.go:12:2: undefined: foo\n")
+	fmt.Fprint(s, "include/a.h:1: note: declared here")
+
+	s.StartCmd(screwdriver.CommandDef{Name: "lint", ProblemMatchers: []string{"eslint-stylish"}})
+	fmt.Fprint(s, "\n/sd/workspace/src/app/index.js\n  1:10  error    'x' is defined but never used  no-unused-vars\n")
+	fmt.Fprint(s, "  3:1   warning  Unexpected console statement   no-console\n\n✖ 2 problems\n")
+
+	s.StartCmd(screwdriver.CommandDef{Name: "test"})
+	fmt.Fprint(s, "main.c:1:1: error: ignored without a matcher\n")
+
+	build, dropped := s.take("build")
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, []screwdriver.Annotation{
+		{File: "main.c", Line: 3, Column: 7, Severity: screwdriver.AnnotationError, Message: "expected ';' before 'return'", Matcher: "gcc"},
+		{File: "lib/util.h", Line: 10, Column: 1, Severity: screwdriver.AnnotationWarning, Message: "unused function", Matcher: "gcc"},
+		{File: "cmd/main.go", Line: 12, Column: 2, Severity: screwdriver.AnnotationError, Message: "undefined: foo", Matcher: "go"},
+		{File: "include/a.h", Line: 1, Severity: screwdriver.AnnotationNotice, Message: "declared here", Matcher: "gcc"},
+	}, build)
+	lint, _ := s.take("lint")
+	assert.Equal(t, []screwdriver.Annotation{
+		{File: "app/index.js", Line: 1, Column: 10, Severity: screwdriver.AnnotationError, Message: "'x' is defined but never used  no-unused-vars", Matcher: "eslint-stylish"},
+		{File: "app/index.js", Line: 3, Column: 1, Severity: screwdriver.AnnotationWarning, Message: "Unexpected console statement   no-console", Matcher: "eslint-stylish"},
+	}, lint)
+	test, _ := s.take("test")
+	assert.Empty(t, test)
+	build, _ = s.take("build")
+	assert.Empty(t, build, "The annotations are only taken once")
+	assert.Contains(t, string(emitter.found), "2 problems\n", "The output is written as is")
+
+	// The annotations past the limit are dropped
+	s.StartCmd(screwdriver.CommandDef{Name: "compile", ProblemMatchers: []string{"eslint-compact"}})
+	for i := 0; i < maxStepAnnotations+3; i++ {
+		fmt.Fprintf(s, "src/a.js: line %d, col 1, Warning - Missing semicolon. (semi)\n", i+1)
+	}
+	compile, dropped := s.take("compile")
+	assert.Len(t, compile, maxStepAnnotations)
+	assert.Equal(t, 3, dropped)
+}
+
+func TestRunSendsProblemAnnotations(t *testing.T) {
+	envFilepath := "/tmp/testProblemMatchers"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "compile", Cmd: "echo 'src/main.c:4:2: error: unknown type name foo'", ProblemMatchers: []string{"gcc"}},
+			{Name: "test", Cmd: "echo 'src/main.c:5:2: error: not matched'"},
+		},
+		Environment: []map[string]string{},
+	}
+	var mu sync.Mutex
+	sent := map[string][]screwdriver.Annotation{}
+	api := MockAPI{
+		annotations: func(buildID int, stepName string, annotations []screwdriver.Annotation) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent[stepName] = annotations
+		},
+	}
+	if err := Run("", nil, &MockEmitter{}, testBuild, screwdriver.API(api), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]screwdriver.Annotation{
+		"compile": {{File: "src/main.c", Line: 4, Column: 2, Severity: screwdriver.AnnotationError, Message: "unknown type name foo", Matcher: "gcc"}},
+	}, sent)
+
+	testBuild.Commands[1].ProblemMatchers = []string{"javac"}
+	err := Run("", nil, &MockEmitter{}, testBuild, screwdriver.API(api), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if _, ok := err.(InfraError); !ok {
+		t.Errorf("An unknown problem matcher should fail the build as an infrastructure error, got %v", err)
+	}
+}
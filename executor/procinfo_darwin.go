@@ -0,0 +1,125 @@
+package executor
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// There is no /proc on macOS, the process information comes from proc_info(2), the system call
+// behind libproc, which needs no cgo
+const (
+	// The calls of proc_info and their flavors, from <sys/proc_info.h>
+	procInfoCallListPids  = 1
+	procInfoCallPidInfo   = 2
+	procInfoCallPidRusage = 9
+	procPgrpOnly          = 2
+	procPidVnodePathInfo  = 9
+	rusageInfoV2          = 2
+
+	// maxProcs bounds the processes listed in a process group
+	maxProcs = 4096
+	// maxRSSUnit is the unit of the max rss of rusage, bytes on macOS
+	maxRSSUnit = 1
+)
+
+// rusageInfo is struct rusage_info_v2 of <sys/resource.h>. The times are in mach absolute time
+// units.
+type rusageInfo struct {
+	UUID                [16]byte
+	UserTime            uint64
+	SystemTime          uint64
+	PkgIdleWkups        uint64
+	InterruptWkups      uint64
+	Pageins             uint64
+	WiredSize           uint64
+	ResidentSize        uint64
+	PhysFootprint       uint64
+	ProcStartAbstime    uint64
+	ProcExitAbstime     uint64
+	ChildUserTime       uint64
+	ChildSystemTime     uint64
+	ChildPkgIdleWkups   uint64
+	ChildInterruptWkups uint64
+	ChildPageins        uint64
+	ChildElapsedAbstime uint64
+	DiskioBytesRead     uint64
+	DiskioBytesWritten  uint64
+}
+
+// vnodePathInfo is struct proc_vnodepathinfo of <sys/proc_info.h>: the vnode_info and path of the
+// current and root directories of a process
+type vnodePathInfo struct {
+	CdirInfo [152]byte
+	CdirPath [1024]byte
+	RdirInfo [152]byte
+	RdirPath [1024]byte
+}
+
+// Calls proc_info, returning what it returns
+func procInfo(call, pid, flavor int, arg uint64, buf unsafe.Pointer, size int) (int, error) {
+	r, _, errno := syscall.Syscall6(syscall.SYS_PROC_INFO, uintptr(call), uintptr(pid), uintptr(flavor), uintptr(arg), uintptr(buf), uintptr(size))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// Returns the pids of the processes in the process group pgid, like proc_listpids
+func processGroupPids(pgid int) ([]int32, error) {
+	pids := make([]int32, maxProcs)
+	n, err := procInfo(procInfoCallListPids, procPgrpOnly, pgid, 0, unsafe.Pointer(&pids[0]), len(pids)*4)
+	if err != nil {
+		return nil, err
+	}
+	return pids[:n/4], nil
+}
+
+// Returns the duration of n mach absolute time units. They are nanoseconds on Intel, but ticks
+// of the timebase, e.g. 24MHz, on Apple silicon.
+func machDuration(n uint64) time.Duration {
+	freq, err := syscall.SysctlUint32("hw.tbfrequency")
+	if err != nil || freq == 0 {
+		return time.Duration(n)
+	}
+	return time.Duration(float64(n) * float64(time.Second) / float64(freq))
+}
+
+// Reads the resources used by the processes in the process group pgid like on Linux, from the
+// rusage of each process as proc_pid_rusage returns it
+func readProcUsage(pgid int) (procUsage, error) {
+	pids, err := processGroupPids(pgid)
+	if err != nil {
+		return procUsage{}, err
+	}
+
+	var u procUsage
+	var ticks uint64
+	for _, pid := range pids {
+		var info rusageInfo
+		// Processes may exit at any point, skip the ones that are gone
+		if _, err := procInfo(procInfoCallPidRusage, int(pid), rusageInfoV2, 0, unsafe.Pointer(&info), 0); err != nil {
+			continue
+		}
+		ticks += info.UserTime + info.SystemTime + info.ChildUserTime + info.ChildSystemTime
+		u.rss += int64(info.ResidentSize)
+		u.readBytes += int64(info.DiskioBytesRead)
+		u.writeBytes += int64(info.DiskioBytesWritten)
+	}
+	u.cpu = machDuration(ticks)
+
+	return u, nil
+}
+
+// Returns the working directory of the process pid, or fallback if it cannot be read
+func processDir(pid int, fallback string) string {
+	var info vnodePathInfo
+	if _, err := procInfo(procInfoCallPidInfo, pid, procPidVnodePathInfo, 0, unsafe.Pointer(&info), int(unsafe.Sizeof(info))); err != nil {
+		return fallback
+	}
+	if n := bytes.IndexByte(info.CdirPath[:], 0); n > 0 {
+		return string(info.CdirPath[:n])
+	}
+	return fallback
+}
@@ -0,0 +1,35 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestReadProcUsageDarwin(t *testing.T) {
+	u, err := readProcUsage(syscall.Getpgrp())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if u.cpu <= 0 || u.rss <= 0 {
+		t.Errorf("readProcUsage() = %+v, want the cpu and memory of the test", u)
+	}
+	if u, err := readProcUsage(1 << 30); err != nil || u != (procUsage{}) {
+		t.Errorf("readProcUsage() of a missing group = %+v, %v, want nothing", u, err)
+	}
+}
+
+func TestProcessDirDarwin(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want, _ := filepath.EvalSymlinks(wd)
+	if got := processDir(os.Getpid(), ""); got != want {
+		t.Errorf("processDir() = %q, want %q", got, want)
+	}
+	if got := processDir(1<<30, "/fallback"); got != "/fallback" {
+		t.Errorf("processDir() of a missing process = %q, want the fallback", got)
+	}
+}
@@ -0,0 +1,93 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// clockTicks is USER_HZ, the unit of the cpu times in /proc/<pid>/stat (fixed at 100 on Linux)
+	clockTicks = 100
+	// maxRSSUnit is the unit of the max rss of rusage, kilobytes on Linux
+	maxRSSUnit = 1024
+)
+
+var pageSize = int64(os.Getpagesize())
+
+// Reads the resources used by the processes in the process group pgid. The cpu time and I/O
+// include the children those processes already reaped, so the difference between two readings
+// is what the group consumed in between. The rss is the current total resident memory.
+func readProcUsage(pgid int) (procUsage, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return procUsage{}, err
+	}
+
+	var u procUsage
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join(procDir, entry.Name())
+
+		// Processes may exit at any point, skip the ones that are gone
+		stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces, the fields start after its closing paren
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		// fields[0] is field 3 (state) of proc(5)
+		if len(fields) < 22 {
+			continue
+		}
+		if group, _ := strconv.Atoi(fields[2]); group != pgid {
+			continue
+		}
+
+		var ticks int64
+		for _, i := range []int{11, 12, 13, 14} { // utime, stime, cutime, cstime
+			n, _ := strconv.ParseInt(fields[i], 10, 64)
+			ticks += n
+		}
+		u.cpu += time.Duration(ticks) * time.Second / clockTicks
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		u.rss += rss * pageSize
+
+		// I/O accounting may be disabled or unreadable, the cpu and memory are still useful
+		if io, err := ioutil.ReadFile(filepath.Join(dir, "io")); err == nil {
+			for _, line := range strings.Split(string(io), "\n") {
+				kv := strings.SplitN(line, ":", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				n, _ := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+				switch kv[0] {
+				case "read_bytes":
+					u.readBytes += n
+				case "write_bytes":
+					u.writeBytes += n
+				}
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// Returns the working directory of the process pid, or fallback if it cannot be read
+func processDir(pid int, fallback string) string {
+	if dir, err := os.Readlink(fmt.Sprintf("%s/%d/cwd", procDir, pid)); err == nil {
+		return dir
+	}
+	return fallback
+}
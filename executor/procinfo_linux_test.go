@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeProcEntry(t *testing.T, dir, pid, stat, io string) {
+	if err := os.MkdirAll(filepath.Join(dir, pid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, pid, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if io != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, pid, "io"), []byte(io), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadProcUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldProcDir := procDir
+	defer func() { procDir = oldProcDir }()
+	procDir = dir
+
+	// pid (comm) state ppid pgrp session tty tpgid flags minflt cminflt majflt cmajflt utime stime cutime cstime priority nice threads itrealvalue starttime vsize rss
+	writeProcEntry(t, dir, "10", "10 (sh) S 1 10 10 0 -1 0 0 0 0 0 100 50 30 20 20 0 1 0 0 0 10\n",
+		"rchar: 1\nread_bytes: 4096\nwrite_bytes: 8192\n")
+	writeProcEntry(t, dir, "11", "11 (my (odd) cmd) R 10 10 10 0 -1 0 0 0 0 0 200 0 0 0 20 0 1 0 0 0 5\n", "")
+	writeProcEntry(t, dir, "12", "12 (other) R 1 12 12 0 -1 0 0 0 0 0 900 900 0 0 20 0 1 0 0 0 900\n",
+		"read_bytes: 1\nwrite_bytes: 1\n")
+	if err := os.MkdirAll(filepath.Join(dir, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := readProcUsage(10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := procUsage{
+		cpu:        4 * time.Second,
+		rss:        15 * pageSize,
+		readBytes:  4096,
+		writeBytes: 8192,
+	}
+	if u != want {
+		t.Errorf("readProcUsage() = %+v, want %+v", u, want)
+	}
+}
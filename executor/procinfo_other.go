@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package executor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// maxRSSUnit is the unit of the max rss of rusage, kilobytes on the BSDs
+const maxRSSUnit = 1024
+
+// Fails, the usage of a running process group is only read on Linux and macOS
+func readProcUsage(pgid int) (procUsage, error) {
+	return procUsage{}, fmt.Errorf("Reading the usage of processes is not supported on %s", runtime.GOOS)
+}
+
+// Returns fallback, the working directory of a process is only read on Linux and macOS
+func processDir(pid int, fallback string) string {
+	return fallback
+}
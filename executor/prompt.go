@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+const (
+	// defaultPromptTimeout is how long a step waits for input after a prompt before it is stopped,
+	// unless SD_PROMPT_TIMEOUT is set
+	defaultPromptTimeout = time.Minute
+	// promptPollInterval is how often a quiet step is checked for waiting on input
+	promptPollInterval = time.Second
+	// maxPromptLength bounds the end of the output kept as the prompt
+	maxPromptLength = 256
+)
+
+// promptPattern matches the end of the output of a program asking for input: a question, a
+// choice, a password or a key to press
+var promptPattern = regexp.MustCompile(`(?i)([:?>\])]|y/n|yes/no|password|passphrase|press (any key|enter|return)[^\n]*)\s*$`)
+
+// Returns how long a step waits for input after a prompt before it is stopped,
+// SD_PROMPT_TIMEOUT seconds in the launcher environment or a minute, 0 if it is never stopped
+func promptTimeout() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("SD_PROMPT_TIMEOUT"))
+	if value == "" {
+		return defaultPromptTimeout, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("Invalid SD_PROMPT_TIMEOUT %q, want a number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// promptWatcher reads the output of a step from the pty, keeping when it last read some and the
+// line it ends with, which is the prompt of a step waiting for input
+type promptWatcher struct {
+	r io.Reader
+
+	mu   sync.Mutex
+	last time.Time
+	line []byte
+}
+
+func newPromptWatcher(r io.Reader) *promptWatcher {
+	return &promptWatcher{r: r, last: time.Now()}
+}
+
+func (p *promptWatcher) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.mu.Lock()
+		p.last = time.Now()
+		out := b[:n]
+		if i := bytes.LastIndexByte(out, '\n'); i >= 0 {
+			p.line, out = p.line[:0], out[i+1:]
+		}
+		p.line = append(p.line, out...)
+		if len(p.line) > maxPromptLength {
+			p.line = append(p.line[:0], p.line[len(p.line)-maxPromptLength:]...)
+		}
+		p.mu.Unlock()
+	}
+	return n, err
+}
+
+// Returns the prompt the output ends with, "" if its last line is not one, and for how long there
+// has been no output
+func (p *promptWatcher) prompt() (string, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	quiet := time.Since(p.last)
+	line := strings.TrimSpace(strings.ReplaceAll(string(p.line), "\r", ""))
+	if line == "" || !promptPattern.MatchString(line) {
+		return "", quiet
+	}
+	return line, quiet
+}
+
+// Checks every second until ctx is done whether the step run by the build shell shellPid waits for
+// input: it ends its output with a prompt, has had no output for timeout and one of its processes
+// is reading the pty. It is stopped then with a WaitingForInput error on ch, rather than hanging
+// until the build timeout.
+func (p *promptWatcher) watch(ctx context.Context, shellPid int, timeout time.Duration, ch chan<- error) {
+	if timeout <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(promptPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			prompt, quiet := p.prompt()
+			if prompt == "" || quiet < timeout {
+				continue
+			}
+			readers, err := ttyReaders(shellPid)
+			if err != nil {
+				logger.Debugf("Failed to find the processes reading the pty: %v", err)
+				return
+			}
+			if len(readers) == 0 {
+				continue
+			}
+			logger.Infof("Processes %v of the step are waiting for input after %q, stopping it", readers, prompt)
+			select {
+			case ch <- WaitingForInput{Prompt: prompt, Quiet: quiet.Round(time.Second)}:
+			default:
+			}
+			return
+		}
+	}()
+}
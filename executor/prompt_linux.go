@@ -0,0 +1,51 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the processes on the terminal of the build shell shellPid that are blocked reading it,
+// from their current syscall. The shell itself reads it for its read builtin.
+func ttyReaders(shellPid int) ([]int, error) {
+	tty, err := os.Readlink(filepath.Join(procDir, strconv.Itoa(shellPid), "fd", "0"))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var readers []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(procDir, entry.Name())
+		// Processes may exit at any point and the syscalls of others may not be readable, skip them
+		syscall, err := ioutil.ReadFile(filepath.Join(dir, "syscall"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(syscall))
+		if len(fields) < 2 || fields[0] != strconv.Itoa(unix.SYS_READ) {
+			continue
+		}
+		fd, err := strconv.ParseInt(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+		if file, err := os.Readlink(filepath.Join(dir, "fd", fmt.Sprint(fd))); err == nil && file == tty {
+			readers = append(readers, pid)
+		}
+	}
+	return readers, nil
+}
@@ -0,0 +1,57 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTTYReaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldProcDir := procDir
+	defer func() { procDir = oldProcDir }()
+	procDir = dir
+
+	// pid, current syscall and the file of fd 0
+	writeProc := func(pid, syscall, fd0 string) {
+		if err := os.MkdirAll(filepath.Join(dir, pid, "fd"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(fd0, filepath.Join(dir, pid, "fd", "0")); err != nil {
+			t.Fatal(err)
+		}
+		if syscall != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, pid, "syscall"), []byte(syscall), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := fmt.Sprintf("%d 0x0 0x7ffd1c2e 0x1 0x0 0x0 0x0 0x7ffd1c10 0x7f3a", unix.SYS_READ)
+	writeProc("10", "61 0xffffffff 0x7ffd 0x0 0x0 0x0 0x0", "/dev/pts/3") // the shell waiting for a child
+	writeProc("11", read, "/dev/pts/3")                                   // reading the pty
+	writeProc("12", read, "/dev/pts/3")                                   // reading the pty too
+	writeProc("13", read, "pipe:[1234]")                                  // reading a pipe
+	writeProc("14", "", "/dev/pts/3")                                     // unreadable syscall
+	writeProc("15", read, "/dev/pts/4")                                   // another terminal
+
+	readers, err := ttyReaders(10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []int{11, 12}; !reflect.DeepEqual(readers, want) {
+		t.Errorf("ttyReaders() = %v, want %v", readers, want)
+	}
+	if _, err := ttyReaders(99); err == nil {
+		t.Errorf("Expected an error for a shell that is gone")
+	}
+}
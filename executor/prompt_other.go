@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Fails, the processes reading a terminal are only found on Linux
+func ttyReaders(shellPid int) ([]int, error) {
+	return nil, fmt.Errorf("Finding the processes reading a terminal is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,114 @@
+package executor
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestPromptTimeout(t *testing.T) {
+	defer os.Setenv("SD_PROMPT_TIMEOUT", os.Getenv("SD_PROMPT_TIMEOUT"))
+	tests := []struct {
+		value   string
+		timeout time.Duration
+		err     bool
+	}{
+		{"", defaultPromptTimeout, false},
+		{"0", 0, false},
+		{" 30 ", 30 * time.Second, false},
+		{"-1", 0, true},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		os.Setenv("SD_PROMPT_TIMEOUT", test.value)
+		if timeout, err := promptTimeout(); timeout != test.timeout || (err != nil) != test.err {
+			t.Errorf("promptTimeout() with %q = %v, %v, want %v and error %v", test.value, timeout, err, test.timeout, test.err)
+		}
+	}
+}
+
+func TestPromptWatcher(t *testing.T) {
+	tests := []struct {
+		output []string
+		want   string
+	}{
+		{[]string{"Continue? [y/N] "}, "Continue? [y/N]"},
+		{[]string{"Checking out\r\nPass", "word: "}, "Password:"},
+		{[]string{"Press any key to continue..."}, "Press any key to continue..."},
+		{[]string{"Overwrite (yes/no)"}, "Overwrite (yes/no)"},
+		{[]string{"Enter your name: \r"}, "Enter your name:"},
+		{[]string{"Password: \r\n"}, ""},
+		{[]string{"Compiling 12 files"}, ""},
+		{[]string{""}, ""},
+		{[]string{strings.Repeat("x", 2*maxPromptLength) + "? "}, strings.Repeat("x", maxPromptLength-2) + "?"},
+	}
+	for _, test := range tests {
+		p := newPromptWatcher(strings.NewReader(strings.Join(test.output, "")))
+		buf := make([]byte, 3)
+		for {
+			if _, err := p.Read(buf); err != nil {
+				break
+			}
+		}
+		if got, quiet := p.prompt(); got != test.want || quiet > time.Second {
+			t.Errorf("prompt() after %q = %q, %v, want %q", test.output, got, quiet, test.want)
+		}
+	}
+}
+
+func TestRunStopsStepWaitingForInput(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("The processes reading a terminal are only found on Linux")
+	}
+	envFilepath := "/tmp/testWaitingForInput"
+	setupTestCase(t, envFilepath)
+	defer os.Setenv("SD_PROMPT_TIMEOUT", os.Getenv("SD_PROMPT_TIMEOUT"))
+	os.Setenv("SD_PROMPT_TIMEOUT", "1")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "configure", Cmd: "printf 'Continue? [y/N] '; read answer"},
+			{Name: "deploy", Cmd: "echo deployed"},
+			{Name: "teardown-cleanup", Cmd: "echo cleaned up"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			codes[stepName] = exitCode
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	start := time.Now()
+	err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	var waiting WaitingForInput
+	if !errors.As(err, &waiting) || waiting.Step != "configure" || waiting.Prompt != "Continue? [y/N]" {
+		t.Fatalf("Run() = %v, want the step stopped waiting for input", err)
+	}
+	if !errors.Is(err, ErrStepFailed) {
+		t.Errorf("A step waiting for input should fail, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("The step should stop once it waits for input, took %v", elapsed)
+	}
+	if codes["configure"] != ExitTimeout {
+		t.Errorf("Exit code of the stopped step = %d, want %d", codes["configure"], ExitTimeout)
+	}
+	if _, ok := codes["deploy"]; ok {
+		t.Errorf("The steps after the stopped step should not run")
+	}
+	if _, ok := codes["teardown-cleanup"]; !ok {
+		t.Errorf("The teardowns should run after the step is stopped")
+	}
+	if !strings.Contains(string(emitter.found), "Step is waiting for interactive input") {
+		t.Errorf("The log should tell the step waits for input: %q", emitter.found)
+	}
+}
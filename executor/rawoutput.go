@@ -0,0 +1,70 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// rawOutputDir is the directory of the artifacts with the raw output of the steps
+const rawOutputDir = "raw-output"
+
+// Returns an error if the step of cmd cannot have raw output: a teardown, whose output is the
+// log, or a step in a container
+func checkRawOutput(cmd screwdriver.CommandDef, stepType string) error {
+	if !cmd.RawOutput {
+		return nil
+	}
+	if stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown {
+		return fmt.Errorf("Teardown %q cannot have raw output", cmd.Name)
+	}
+	if cmd.Image != "" || cmd.Container != "" {
+		return fmt.Errorf("Step %q in a container cannot have raw output", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the path of the file with the raw output of the step with name, the index-th step of the
+// build, in the artifacts dir dir, or in the directory of the step scripts scriptDir without one
+func rawOutputPath(dir, scriptDir string, index int, name string) string {
+	if dir == "" {
+		dir = scriptDir
+	}
+	return filepath.Join(dir, rawOutputDir, fmt.Sprintf("%d-%s.out", index, unsafeNameChars.ReplaceAllString(name, "_")))
+}
+
+// Creates the empty file at path for the raw output of a step, replacing the one of a previous
+// build
+func createRawOutput(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Returns the redirection of the standard output of a step to the file at path, or "" without one.
+// The output never reaches the pty, so it is neither split in lines nor scanned for the end of
+// the step, which the build shell echoes after it to the pty.
+func rawOutputRedirect(path string) string {
+	if path == "" {
+		return ""
+	}
+	return " >" + shellQuote(path)
+}
+
+// Writes to out how much raw output the step wrote to the file at path
+func reportRawOutput(out io.Writer, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		launcherf(out, "The raw output of the step is missing: %v\n", err)
+		return
+	}
+	launcherf(out, "The step wrote %d bytes of raw output to %s\n", info.Size(), path)
+}
@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCheckRawOutput(t *testing.T) {
+	tests := []struct {
+		cmd      screwdriver.CommandDef
+		stepType string
+		wantErr  bool
+	}{
+		{screwdriver.CommandDef{Name: "archive", Cmd: "tar c .", RawOutput: true}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "archive", Cmd: "tar c .", RawOutput: true, User: "nobody"}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "teardown-archive", Cmd: "tar c .", RawOutput: true}, screwdriver.StepTypeTeardown, true},
+		{screwdriver.CommandDef{Name: "archive", Cmd: "tar c .", RawOutput: true, Image: "alpine"}, screwdriver.StepTypeUser, true},
+		{screwdriver.CommandDef{Name: "teardown-archive", Cmd: "tar c ."}, screwdriver.StepTypeTeardown, false},
+	}
+	for _, test := range tests {
+		if err := checkRawOutput(test.cmd, test.stepType); (err != nil) != test.wantErr {
+			t.Errorf("checkRawOutput(%+v, %s) = %v, want error %v", test.cmd, test.stepType, err, test.wantErr)
+		}
+	}
+}
+
+func TestRawOutputPath(t *testing.T) {
+	if got, want := rawOutputPath("/sd/artifacts", "/tmp/env_steps", 3, "pack ../x"), "/sd/artifacts/raw-output/3-pack_.._x.out"; got != want {
+		t.Errorf("rawOutputPath() = %s, want %s", got, want)
+	}
+	if got, want := rawOutputPath("", "/tmp/env_steps", 3, "pack"), "/tmp/env_steps/raw-output/3-pack.out"; got != want {
+		t.Errorf("rawOutputPath() = %s, want %s", got, want)
+	}
+}
+
+func TestRunRawOutput(t *testing.T) {
+	envFilepath := "/tmp/testRawOutput"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "rawoutput")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			// Neither the binary data nor a line looking like the end of the step end it
+			{Name: "pack", Cmd: `printf '\000\377\r\n\n%s 0\nbin\141ry' "$SD_STEP_ID"; echo to the log >&2`, RawOutput: true},
+			{Name: "flaky-pack", Cmd: `printf '\001\002'; exit 3`, RawOutput: true, AllowFailure: true},
+			{Name: "test", Cmd: "echo done"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	env := []string{"SD_ARTIFACTS_DIR=" + dir}
+	if err := Run("", env, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := map[string]int{"pack": 0, "flaky-pack": 3, "test": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, rawOutputDir, "0-pack.out"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("\x00\xff\r\n\n")) || !bytes.HasSuffix(data, []byte(" 0\nbinary")) {
+		t.Errorf("The raw output should be kept as is: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, rawOutputDir, "1-flaky-pack.out")); string(data) != "\x01\x02" {
+		t.Errorf("The raw output of a failed step should be kept: %q", data)
+	}
+
+	log := string(emitter.found)
+	if strings.Contains(log, "binary") || !strings.Contains(log, "to the log") {
+		t.Errorf("Only the standard error of the step should be in the log: %q", log)
+	}
+	if !strings.Contains(log, fmt.Sprintf("The step wrote %d bytes of raw output to %s", len(data), filepath.Join(dir, rawOutputDir, "0-pack.out"))) {
+		t.Errorf("The log should tell where the raw output is: %q", log)
+	}
+}
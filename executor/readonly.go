@@ -0,0 +1,87 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// readOnlySource makes the source directory read-only while the steps listed in
+// SD_READONLY_STEPS run, so they can check the workspace but not change it. The source directory
+// is bind mounted on itself for the whole build and the bind mount is switched between read-only
+// and read-write, which only changes what the steps see: the files underneath stay writable for
+// the launcher and the steps that come after.
+type readOnlySource struct {
+	dir     string
+	steps   map[string]bool
+	mounted bool
+}
+
+// Returns the read-only source settings for the steps named in SD_READONLY_STEPS from the build
+// environment (comma separated, e.g. "verify,scan"), or nil if there are none
+func newReadOnlySource(env []string, sourceDir string, isolation stepIsolation) (*readOnlySource, error) {
+	steps := map[string]bool{}
+	for _, name := range strings.Split(lookupEnv(env, "SD_READONLY_STEPS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			steps[name] = true
+		}
+	}
+	if len(steps) == 0 {
+		return nil, nil
+	}
+
+	if sourceDir == "" {
+		return nil, fmt.Errorf("No source directory to make read-only")
+	}
+	// Remounts made by the launcher don't propagate to a private mount namespace
+	if isolation.namespaces&stepNamespaceFlags["mount"] != 0 {
+		return nil, fmt.Errorf("Read-only steps can't run in their own mount namespace")
+	}
+	return &readOnlySource{dir: sourceDir, steps: steps}, nil
+}
+
+// Bind mounts the source directory on itself. This is done before the shell starts, so its
+// working directory is on the bind mount and the steps can't write through it.
+func (r *readOnlySource) mount() error {
+	if r == nil {
+		return nil
+	}
+	if err := bindMount(r.dir); err != nil {
+		return fmt.Errorf("Bind mounting the source directory %s: %v", r.dir, err)
+	}
+	r.mounted = true
+	return nil
+}
+
+// Returns whether step runs against a read-only source directory
+func (r *readOnlySource) applies(step string) bool {
+	return r != nil && r.steps[step]
+}
+
+// Makes the source directory read-only if step is one of the read-only steps, returning whether
+// it did. This fails if a process of an earlier step still has a file open for writing in it.
+func (r *readOnlySource) protect(step string) (bool, error) {
+	if !r.applies(step) {
+		return false, nil
+	}
+	if err := remountBind(r.dir, true); err != nil {
+		return false, fmt.Errorf("Making the source directory %s read-only for step %q: %v", r.dir, step, err)
+	}
+	return true, nil
+}
+
+// Makes the source directory writable again after a read-only step
+func (r *readOnlySource) release() error {
+	if err := remountBind(r.dir, false); err != nil {
+		return fmt.Errorf("Making the source directory %s writable again: %v", r.dir, err)
+	}
+	return nil
+}
+
+// Close removes the bind mount. It is detached lazily, as the shell may still be in it.
+func (r *readOnlySource) Close() error {
+	if r == nil || !r.mounted {
+		return nil
+	}
+	r.mounted = false
+	return unmountDetached(r.dir)
+}
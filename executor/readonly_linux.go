@@ -0,0 +1,22 @@
+package executor
+
+import "golang.org/x/sys/unix"
+
+// Bind mounts dir on itself
+func bindMount(dir string) error {
+	return unix.Mount(dir, dir, "", unix.MS_BIND, "")
+}
+
+// Switches the bind mount at dir to read-only or back to read-write
+func remountBind(dir string, readOnly bool) error {
+	var flags uintptr
+	if readOnly {
+		flags = unix.MS_RDONLY
+	}
+	return unix.Mount("", dir, "", unix.MS_REMOUNT|unix.MS_BIND|flags, "")
+}
+
+// Detaches the mount at dir, which goes away once nothing uses it anymore
+func unmountDetached(dir string) error {
+	return unix.Unmount(dir, unix.MNT_DETACH)
+}
@@ -0,0 +1,80 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestNewReadOnlySource(t *testing.T) {
+	r, err := newReadOnlySource([]string{"FOO=bar"}, "/src", stepIsolation{})
+	if r != nil || err != nil {
+		t.Errorf("newReadOnlySource() without read-only steps = %v, %v, want nil", r, err)
+	}
+
+	r, err = newReadOnlySource([]string{"SD_READONLY_STEPS=verify, scan"}, "/src", stepIsolation{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !r.applies("verify") || !r.applies("scan") || r.applies("install") {
+		t.Errorf("Unexpected read-only steps %v", r.steps)
+	}
+
+	if _, err := newReadOnlySource([]string{"SD_READONLY_STEPS=verify"}, "/src", stepIsolation{namespaces: syscall.CLONE_NEWNS}); err == nil {
+		t.Errorf("Expected an error for read-only steps in their own mount namespace")
+	}
+	if _, err := newReadOnlySource([]string{"SD_READONLY_STEPS=verify"}, "", stepIsolation{}); err == nil {
+		t.Errorf("Expected an error without a source directory")
+	}
+}
+
+func TestRunReadOnlySteps(t *testing.T) {
+	sourceDir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sourceDir)
+
+	// Bind mounts need CAP_SYS_ADMIN
+	probe := &readOnlySource{dir: sourceDir}
+	if err := probe.mount(); err != nil {
+		t.Skipf("Can't bind mount the source directory: %v", err)
+	}
+	probe.Close()
+
+	envFilepath := "/tmp/testReadOnly"
+	setupTestCase(t, envFilepath)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "touch before", Name: "install"},
+			{Cmd: "touch verify || echo refused", Name: "verify"},
+			{Cmd: "touch after", Name: "publish"},
+			{Cmd: "touch teardown || echo refused", Name: "teardown-verify"},
+		},
+		Environment: []map[string]string{},
+	}
+	env := []string{"SD_READONLY_STEPS=verify,teardown-verify"}
+
+	var emitter MockEmitter
+	err = Run(sourceDir, env, &emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, sourceDir)
+	if err != nil {
+		t.Fatalf("Unexpected error from Run(): %v", err)
+	}
+
+	for file, want := range map[string]bool{"before": true, "verify": false, "after": true, "teardown": false} {
+		_, err := os.Stat(filepath.Join(sourceDir, file))
+		if got := err == nil; got != want {
+			t.Errorf("File %q written: %v, want %v", file, got, want)
+		}
+	}
+	if n := strings.Count(string(emitter.found), "Read-only file system"); n != 2 {
+		t.Errorf("Expected 2 read-only errors in the step logs, got %d:\n%s", n, emitter.found)
+	}
+}
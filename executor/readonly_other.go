@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Fails, read-only steps need the bind mounts of Linux
+func bindMount(dir string) error {
+	return fmt.Errorf("Read-only steps are not supported on %s", runtime.GOOS)
+}
+
+// Fails, read-only steps need the bind mounts of Linux
+func remountBind(dir string, readOnly bool) error {
+	return fmt.Errorf("Read-only steps are not supported on %s", runtime.GOOS)
+}
+
+// Fails, read-only steps need the bind mounts of Linux
+func unmountDetached(dir string) error {
+	return fmt.Errorf("Read-only steps are not supported on %s", runtime.GOOS)
+}
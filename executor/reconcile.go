@@ -0,0 +1,66 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// defaultStatusPollInterval is how often the status of the build is fetched from the API, unless
+// SD_STATUS_POLL_INTERVAL is set
+const defaultStatusPollInterval = time.Minute
+
+// Returns how often the status of the build is fetched, SD_STATUS_POLL_INTERVAL seconds in the
+// launcher environment or a minute, 0 if it is not
+func statusPollInterval() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("SD_STATUS_POLL_INTERVAL"))
+	if value == "" {
+		return defaultStatusPollInterval, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("Invalid SD_STATUS_POLL_INTERVAL %q, want a number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Fetches the status of the build buildID every interval until ctx is done, and stops the build
+// with a BuildStopped error on ch once the API has it aborted or failed, so the launcher does not
+// run to completion against a dead build
+func reconcileStatus(ctx context.Context, api screwdriver.API, buildID int, interval time.Duration, ch chan<- error) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			build, err := api.BuildFromID(buildID)
+			if err != nil {
+				logger.Warnf("Failed to fetch the status of the build: %v", err)
+				continue
+			}
+			switch build.Status {
+			case screwdriver.Aborted, screwdriver.Failure:
+				logger.Infof("The build was set to %s outside of the launcher, stopping it", build.Status)
+				select {
+				case ch <- BuildStopped{Status: string(build.Status)}:
+				default:
+					// The build is stopping already
+				}
+				return
+			}
+		}
+	}()
+}
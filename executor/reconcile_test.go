@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestStatusPollInterval(t *testing.T) {
+	defer os.Setenv("SD_STATUS_POLL_INTERVAL", os.Getenv("SD_STATUS_POLL_INTERVAL"))
+	tests := []struct {
+		value    string
+		interval time.Duration
+		err      bool
+	}{
+		{"", defaultStatusPollInterval, false},
+		{"0", 0, false},
+		{" 30 ", 30 * time.Second, false},
+		{"-1", 0, true},
+		{"often", 0, true},
+	}
+	for _, test := range tests {
+		os.Setenv("SD_STATUS_POLL_INTERVAL", test.value)
+		if interval, err := statusPollInterval(); interval != test.interval || (err != nil) != test.err {
+			t.Errorf("statusPollInterval() with %q = %v, %v, want %v and error %v", test.value, interval, err, test.interval, test.err)
+		}
+	}
+}
+
+func TestRunStopsBuildAbortedOutside(t *testing.T) {
+	envFilepath := "/tmp/testReconcileStatus"
+	setupTestCase(t, envFilepath)
+	defer os.Setenv("SD_STATUS_POLL_INTERVAL", os.Getenv("SD_STATUS_POLL_INTERVAL"))
+	os.Setenv("SD_STATUS_POLL_INTERVAL", "1")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "wait", Cmd: "sleep 30"},
+			{Name: "deploy", Cmd: "echo deployed"},
+			{Name: "teardown-cleanup", Cmd: "echo cleaned up"},
+		},
+		Environment: []map[string]string{},
+	}
+	polls := 0
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		buildFromID: func(buildID int) (screwdriver.Build, error) {
+			polls++
+			if polls < 2 {
+				return screwdriver.Build{ID: buildID, Status: screwdriver.Running}, nil
+			}
+			return screwdriver.Build{ID: buildID, Status: screwdriver.Aborted}, nil
+		},
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			codes[stepName] = exitCode
+			return nil
+		},
+	})
+	start := time.Now()
+	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	var stopped BuildStopped
+	if !errors.As(err, &stopped) || stopped != (BuildStopped{Step: "wait", Status: screwdriver.Aborted}) {
+		t.Errorf("Run() = %v, want the build stopped", err)
+	}
+	if !errors.Is(err, ErrAborted) {
+		t.Errorf("A build stopped outside of the launcher should be aborted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("The step should stop once the build is aborted, took %v", elapsed)
+	}
+	if codes["wait"] != ExitAborted {
+		t.Errorf("Exit code of the stopped step = %d, want %d", codes["wait"], ExitAborted)
+	}
+	if _, ok := codes["deploy"]; ok {
+		t.Errorf("The steps after the stopped step should not run")
+	}
+	if _, ok := codes["teardown-cleanup"]; !ok {
+		t.Errorf("The teardowns should run after the build is stopped")
+	}
+}
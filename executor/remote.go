@@ -0,0 +1,254 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// sshCLI runs the commands on the remote host
+var sshCLI = "ssh"
+
+// remoteCopyTimeout bounds the copy of a file to the remote host
+const remoteCopyTimeout = 2 * time.Minute
+
+// remoteHost is the host the build runs on over SSH instead of the launcher's. The build shell
+// runs the steps there with the same protocol as a local one, and the files the launcher writes
+// for them are copied to the same paths.
+type remoteHost struct {
+	// destination is where ssh connects, e.g. builder@mac-mini-1
+	destination string
+	// options are the options of ssh, e.g. -i /etc/sd/ssh/id_ed25519 -p 2222
+	options []string
+	// scriptDir is the directory of the step scripts
+	scriptDir string
+}
+
+// Returns the remote host of SD_SSH_HOST in the launcher environment with the options of
+// SD_SSH_OPTIONS, or nil if it is not set. ssh never prompts, as no one could answer.
+func newRemoteHost(scriptDir string) (*remoteHost, error) {
+	destination := strings.TrimSpace(os.Getenv("SD_SSH_HOST"))
+	if destination == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(destination, "-") || strings.ContainsAny(destination, " \t\n") {
+		return nil, fmt.Errorf("Invalid SD_SSH_HOST %q", destination)
+	}
+	options := append([]string{"-o", "BatchMode=yes"}, strings.Fields(os.Getenv("SD_SSH_OPTIONS"))...)
+	return &remoteHost{destination: destination, options: options, scriptDir: scriptDir}, nil
+}
+
+// Returns the arguments of ssh running the shell command line on the remote host, in a pty if
+// tty so the processes it starts get SIGHUP when ssh goes away
+func (r *remoteHost) args(tty bool, line string) []string {
+	args := append([]string{}, r.options...)
+	if tty {
+		args = append(args, "-tt")
+	} else {
+		args = append(args, "-T")
+	}
+	return append(args, "--", r.destination, line)
+}
+
+// Returns the command running the shell command line on the remote host
+func (r *remoteHost) command(ctx context.Context, tty bool, line string) *exec.Cmd {
+	return exec.CommandContext(ctx, sshCLI, r.args(tty, line)...)
+}
+
+// Returns the shell command line running the words, each quoted
+func quoteWords(words ...string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = shellQuote(word)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Runs the shell command line on the remote host with stdin, returning its output in the error
+func (r *remoteHost) run(line string, stdin io.Reader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCopyTimeout)
+	defer cancel()
+
+	c := r.command(ctx, false, line)
+	c.Stdin = stdin
+	if output, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("Running %s on %s: %v: %s", line, r.destination, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Checks shellBin is an executable file on the remote host
+func (r *remoteHost) checkShellBin(shellBin string) error {
+	if err := r.run(quoteWords("test", "-f", shellBin, "-a", "-x", shellBin), nil); err != nil {
+		return fmt.Errorf("Shell %s is not an executable file on %s: %v", shellBin, r.destination, err)
+	}
+	return nil
+}
+
+// Creates the directory of the step scripts on the remote host like makeStepScriptDir
+func (r *remoteHost) makeScriptDir() error {
+	return r.run(quoteWords("rm", "-rf", r.scriptDir)+" && "+quoteWords("mkdir", "-m", "0711", r.scriptDir), nil)
+}
+
+// Writes what r reads to path on the remote host with permissions perm, owned by owner if not
+// empty. The file is replaced at once, so it is never seen half written.
+func (r *remoteHost) writeFile(path string, content io.Reader, perm os.FileMode, owner string) error {
+	tmpPath := path + ".tmp"
+	line := "(umask 077 && cat > " + shellQuote(tmpPath) + ") && " + quoteWords("chmod", fmt.Sprintf("%o", perm.Perm()), tmpPath)
+	if owner != "" {
+		line += " && " + quoteWords("chown", owner, tmpPath)
+	}
+	line += " && " + quoteWords("mv", "-f", tmpPath, path)
+	return r.run(line, content)
+}
+
+// Copies the file at path to the same path on the remote host with the same permissions, owned
+// by owner if not empty
+func (r *remoteHost) copyFile(path, owner string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return r.writeFile(path, f, info.Mode(), owner)
+}
+
+// Writes the shell script exporting the variables of env, but the ones of the launcher's host, to
+// a file on the remote host for the build shell to source, returning its path. Only its owner can
+// read it, it holds the build token, and it never touches the disk of the launcher's host.
+func (r *remoteHost) writeEnvFile(env []string) (string, error) {
+	var script strings.Builder
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !envName.MatchString(parts[0]) || isHostEnv(parts[0]) {
+			continue
+		}
+		script.WriteString("export " + parts[0] + "=" + shellQuote(parts[1]) + "\n")
+	}
+	path := filepath.Join(r.scriptDir, "build.env")
+	return path, r.writeFile(path, strings.NewReader(script.String()), 0600, "")
+}
+
+// Returns whether the variable name belongs to the host the shell runs on rather than the build
+func isHostEnv(name string) bool {
+	for _, skipped := range containerEnvSkipped {
+		if name == skipped {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the files at paths on the remote host
+func (r *remoteHost) removeFiles(paths ...string) error {
+	return r.run(quoteWords(append([]string{"rm", "-f"}, paths...)...), nil)
+}
+
+// Checks the build can run on the remote host: the isolation of the steps, the read-only source
+// directory and the step containers are set up on the launcher's host, where they would not apply
+func (r *remoteHost) check(isolation stepIsolation, readOnly *readOnlySource, commands ...[]screwdriver.CommandDef) error {
+	if isolation != (stepIsolation{}) {
+		return fmt.Errorf("The steps cannot be isolated on the remote host %s", r.destination)
+	}
+	if readOnly != nil {
+		return fmt.Errorf("The source directory cannot be read-only on the remote host %s", r.destination)
+	}
+	for _, cmds := range commands {
+		for _, cmd := range cmds {
+			if cmd.Image != "" || cmd.Container != "" {
+				return fmt.Errorf("Step %q cannot run in a container on the remote host %s", cmd.Name, r.destination)
+			}
+			if cmd.RawOutput {
+				return fmt.Errorf("Step %q cannot have raw output on the remote host %s", cmd.Name, r.destination)
+			}
+			if cmd.Stderr != "" {
+				return fmt.Errorf("Step %q cannot capture its standard error on the remote host %s", cmd.Name, r.destination)
+			}
+			if cmd.Stdin != "" || cmd.StdinFile != "" {
+				return fmt.Errorf("Step %q cannot have a standard input on the remote host %s", cmd.Name, r.destination)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the command starting the build shell shellBin with args on the remote host in dir, with
+// the variables of the file envFile it removes. ssh forwards its pty to the one of the shell.
+func (r *remoteHost) shellCommand(ctx context.Context, envFile, dir, shellBin string, args ...string) *exec.Cmd {
+	line := ". " + shellQuote(envFile) + " && rm -f " + shellQuote(envFile)
+	if dir != "" {
+		line += " && cd " + shellQuote(dir)
+	}
+	return r.command(ctx, true, line+" && exec "+quoteWords(append([]string{shellBin}, args...)...))
+}
+
+// Copies the step script at path of cmd to the remote host, with the script of its interpreter
+func (r *remoteHost) copyStepScript(path string, cmd screwdriver.CommandDef) error {
+	if cmd.Interpreter != "" {
+		if err := r.copyFile(interpreterScriptPath(path), cmd.User); err != nil {
+			return err
+		}
+	}
+	return r.copyFile(path, cmd.User)
+}
+
+// Returns the path of the script of the teardown of cmd on the remote host
+func (r *remoteHost) teardownScriptPath(cmd screwdriver.CommandDef) string {
+	return filepath.Join(r.scriptDir, "teardown-"+unsafeNameChars.ReplaceAllString(cmd.Name, "_")+".sh")
+}
+
+// Returns the command running the teardown of cmd with shell on the remote host, in a pty so it is
+// killed with ssh. The command sets the token and runs in sourceDir as the user of cmd, from a
+// script written to the host, so the token stays off the command lines.
+func (r *remoteHost) teardownCommand(ctx context.Context, cmd screwdriver.CommandDef, shell, script, sourceDir, token string) (*exec.Cmd, error) {
+	path := r.teardownScriptPath(cmd)
+	if token != "" {
+		script = exportToken(token) + script
+	}
+	if err := r.writeFile(path, strings.NewReader(script+"\n"), 0700, cmd.User); err != nil {
+		return nil, err
+	}
+
+	line := quoteWords(shell, "-e", path)
+	if cmd.User != "" {
+		line = quoteWords("su", "-m", "-s", shell, cmd.User, "-c", line)
+	}
+	if sourceDir != "" {
+		line = "cd " + shellQuote(sourceDir) + " && exec " + line
+	}
+	return r.command(ctx, true, line), nil
+}
+
+// crlfWriter writes to w what is written to it with the line endings of a pty, \r\n, turned to \n
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if c.cr && b != '\n' {
+			out = append(out, '\r')
+		}
+		c.cr = b == '\r'
+		if !c.cr {
+			out = append(out, b)
+		}
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestNewRemoteHost(t *testing.T) {
+	defer os.Unsetenv("SD_SSH_HOST")
+	defer os.Unsetenv("SD_SSH_OPTIONS")
+
+	if remote, err := newRemoteHost("/tmp/steps"); remote != nil || err != nil {
+		t.Errorf("newRemoteHost() = %+v, %v, want none", remote, err)
+	}
+
+	os.Setenv("SD_SSH_HOST", "builder@mac-mini-1")
+	os.Setenv("SD_SSH_OPTIONS", "-i /etc/sd/ssh/id_ed25519 -p 2222")
+	remote, err := newRemoteHost("/tmp/steps")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []string{"-o", "BatchMode=yes", "-i", "/etc/sd/ssh/id_ed25519", "-p", "2222", "-tt", "--", "builder@mac-mini-1", "make"}
+	if got := remote.args(true, "make"); !reflect.DeepEqual(got, want) {
+		t.Errorf("args() = %q, want %q", got, want)
+	}
+
+	for _, host := range []string{"-oProxyCommand=sh", "builder@mac mini"} {
+		os.Setenv("SD_SSH_HOST", host)
+		if _, err := newRemoteHost("/tmp/steps"); err == nil {
+			t.Errorf("Expected an error for host %q", host)
+		}
+	}
+}
+
+func TestCrlfWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &crlfWriter{w: &out}
+	for _, chunk := range []string{"one\r\ntwo\r", "\nthree\rfour\r\n"} {
+		w.Write([]byte(chunk))
+	}
+	if got, want := out.String(), "one\ntwo\nthree\rfour\n"; got != want {
+		t.Errorf("crlfWriter wrote %q, want %q", got, want)
+	}
+}
+
+func TestRemoteCheck(t *testing.T) {
+	remote := &remoteHost{destination: "builder@mac-mini-1"}
+	steps := []screwdriver.CommandDef{{Name: "test", Cmd: "make test"}}
+	if err := remote.check(stepIsolation{}, nil, steps); err != nil {
+		t.Errorf("check() = %v", err)
+	}
+	if err := remote.check(stepIsolation{capabilities: "none"}, nil, steps); err == nil {
+		t.Errorf("Expected an error for isolated steps")
+	}
+	if err := remote.check(stepIsolation{}, &readOnlySource{dir: "/sd/workspace"}, steps); err == nil {
+		t.Errorf("Expected an error for read-only steps")
+	}
+	if err := remote.check(stepIsolation{}, nil, append(steps, screwdriver.CommandDef{Name: "lint", Image: "node:18"})); err == nil {
+		t.Errorf("Expected an error for a step with an image")
+	}
+	if err := remote.check(stepIsolation{}, nil, append(steps, screwdriver.CommandDef{Name: "archive", RawOutput: true})); err == nil {
+		t.Errorf("Expected an error for a step with raw output")
+	}
+	if err := remote.check(stepIsolation{}, nil, append(steps, screwdriver.CommandDef{Name: "lint", Stderr: "fail"})); err == nil {
+		t.Errorf("Expected an error for a step capturing its standard error")
+	}
+	if err := remote.check(stepIsolation{}, nil, append(steps, screwdriver.CommandDef{Name: "load", Stdin: "data"})); err == nil {
+		t.Errorf("Expected an error for a step with a standard input")
+	}
+}
+
+func TestRunRemote(t *testing.T) {
+	envFilepath := "/tmp/testRemote"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("SD_SSH_HOST", "builder@mac-mini-1")
+	defer os.Unsetenv("SD_SSH_HOST")
+
+	// Records its arguments and runs the command line on this host, without the environment of
+	// the launcher
+	argsFile := filepath.Join(dir, "args")
+	cli := filepath.Join(dir, "ssh")
+	ioutil.WriteFile(cli, []byte("#!/bin/sh\necho \"$@\" >> "+argsFile+"\n"+
+		"for line; do :; done; exec env -i PATH=\"$PATH\" /bin/sh -c \"$line\"\n"), 0755)
+	oldCLI := sshCLI
+	defer func() { sshCLI = oldCLI }()
+	sshCLI = cli
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "export", Cmd: "export FOO=bar"},
+			{Name: "test", Cmd: `echo "test with $FOO and $GREETING"`},
+			{Name: "fail", Cmd: "exit 3"},
+			{Name: "teardown-echo", Cmd: `echo "teardown after $SD_STEP_EXIT_CODE with $FOO"`},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	env := []string{"GREETING=it's me"}
+	if err := Run("", env, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err == nil {
+		t.Errorf("Expected the failed step to fail the build")
+	}
+	if want := map[string]int{"export": 0, "test": 0, "fail": 3, "teardown-echo": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	for _, want := range []string{"\ntest with bar and it's me\n", "\nteardown after 3 with bar\n"} {
+		if !strings.Contains(string(emitter.found), want) {
+			t.Errorf("The output should contain %q, got %q", want, emitter.found)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(argsFile)
+	if !strings.Contains(string(data), "-o BatchMode=yes -tt -- builder@mac-mini-1 . '/tmp/testRemote_steps/build.env' && rm -f '/tmp/testRemote_steps/build.env' && exec '/bin/sh'\n") {
+		t.Errorf("The build shell should run on the remote host: %s", data)
+	}
+	if _, err := os.Stat("/tmp/testRemote_steps/build.env"); !os.IsNotExist(err) {
+		t.Errorf("The environment file should be gone: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// replayShellCommand is the first argument of the launcher when it is re-executed as the build
+// shell of a replayed build, see ReplayShell
+const replayShellCommand = "sd-replay-shell"
+
+var (
+	// replayStepID matches the start of a step or condition in the line the build shell runs
+	replayStepID = regexp.MustCompile(`export SD_STEP_ID=([0-9a-fA-F-]{36})`)
+	// replayExportFile matches the export file in the setup commands of the build shell
+	replayExportFile = regexp.MustCompile(`exportfile=([^;\s]+);`)
+)
+
+// Returns the terminal recording the build replays instead of running its steps,
+// SD_REPLAY_TERMINAL in the launcher environment, or ""
+func replayTerminal() (string, error) {
+	path := strings.TrimSpace(os.Getenv("SD_REPLAY_TERMINAL"))
+	if path == "" {
+		return "", nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("Invalid SD_REPLAY_TERMINAL: %v", err)
+	}
+	return path, nil
+}
+
+// Returns the commands of a replayed build, which run nothing: the teardowns, which do not run in
+// the build shell, do nothing and no step starts a container
+func replayCommands(commands []screwdriver.CommandDef) []screwdriver.CommandDef {
+	replayed := make([]screwdriver.CommandDef, len(commands))
+	for i, cmd := range commands {
+		cmd.Image, cmd.Container, cmd.User, cmd.Shell, cmd.Interpreter = "", "", "", "", ""
+		cmd.Nice, cmd.IONice = 0, ""
+		cmd.Stdin, cmd.StdinFile = "", ""
+		if cmd.Script != "" || cmd.Cmd != "" {
+			cmd.Cmd, cmd.Script, cmd.Args = ":", "", nil
+		}
+		replayed[i] = cmd
+	}
+	return replayed
+}
+
+// Returns the command starting the replay shell of the terminal recording at cast, in place of
+// the build shell
+func replayShellCmd(ctx context.Context, cast string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Finding the launcher executable: %v", err)
+	}
+	c := exec.CommandContext(ctx, self, replayShellCommand, cast)
+	c.SysProcAttr = &syscall.SysProcAttr{}
+	return c, nil
+}
+
+// ReplayShell runs the replay shell when the launcher was re-executed as the build shell of a
+// replayed build, exiting once the build shell of the recording did. Otherwise it returns right
+// away. The launcher calls it first thing in main.
+func ReplayShell() {
+	if len(os.Args) < 3 || os.Args[1] != replayShellCommand {
+		return
+	}
+	// The build shell ignores the SIGTERM of the processes of the steps
+	signal.Ignore(syscall.SIGTERM)
+	code, err := replayShell(os.Args[2], os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error replaying the terminal: %v\n", err)
+		os.Exit(ExitLaunch)
+	}
+	os.Exit(code)
+}
+
+// Returns the output of the asciicast recording at path
+func readCastOutput(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var out strings.Builder
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	// The first line is the header
+	for line := 0; scanner.Scan(); line++ {
+		var event []interface{}
+		if line == 0 || json.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 {
+			continue
+		}
+		if kind, _ := event[1].(string); kind == "o" {
+			data, _ := event[2].(string)
+			out.WriteString(data)
+		}
+	}
+	return out.String(), scanner.Err()
+}
+
+// Plays the recording at cast back as the build shell reading the lines of the launcher from in:
+// for each step or condition it writes to out what the recorded shell wrote for the same step,
+// with the id of the step replaced, up to the exit code. Nothing runs. It returns the exit code
+// of the shell, once the recorded shell exited or the launcher ended it.
+func replayShell(cast string, in io.Reader, out io.Writer) (int, error) {
+	recorded, err := readCastOutput(cast)
+	if err != nil {
+		return ExitLaunch, err
+	}
+	// The pty turns the newlines back into the CRLF it recorded
+	recorded = strings.ReplaceAll(recorded, "\r\n", "\n")
+
+	// The export file lets the teardowns go on, as the trap of the build shell writes it on ABRT
+	// and on exit
+	var mu sync.Mutex
+	var exportFile string
+	export := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if exportFile != "" {
+			ioutil.WriteFile(exportFile, nil, 0600)
+		}
+	}
+	exit := func(code int) (int, error) {
+		export()
+		return code, nil
+	}
+	// Ends the step with guid the recording has no end for, and the shell with it
+	unrecorded := func(guid, reason string) (int, error) {
+		fmt.Fprintf(out, "\n%s\n%s %d\n", reason, guid, ExitUnknown)
+		return exit(ExitUnknown)
+	}
+	abrt := make(chan os.Signal, 1)
+	signal.Notify(abrt, syscall.SIGABRT)
+	defer signal.Stop(abrt)
+	go func() {
+		for range abrt {
+			export()
+		}
+	}()
+
+	reader := bufio.NewReaderSize(in, maxLineChunk)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// The launcher ends the shell with an end of file
+			return exit(ExitOk)
+		}
+		if m := replayExportFile.FindStringSubmatch(line); m != nil {
+			mu.Lock()
+			exportFile = m[1]
+			mu.Unlock()
+		}
+		if strings.TrimSpace(line) == "exit" {
+			return exit(ExitOk)
+		}
+		m := replayStepID.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		guid := m[1]
+
+		start := replayStepID.FindStringSubmatchIndex(recorded)
+		if start == nil {
+			return unrecorded(guid, "The recording has no more steps")
+		}
+		oldGUID := recorded[start[2]:start[3]]
+		// The pty echoes the line itself, the recorded echo is left out
+		echoEnd := strings.IndexByte(recorded[start[1]:], '\n')
+		if echoEnd < 0 {
+			return unrecorded(guid, "The recording ends as the step starts")
+		}
+		condition := strings.Contains(recorded[start[1]:start[1]+echoEnd], " ;if eval ")
+		recorded = recorded[start[1]+echoEnd+1:]
+
+		exitLine := regexp.MustCompile(regexp.QuoteMeta(oldGUID) + ` ([0-9]+)( [0-9]+)?\n`)
+		end := exitLine.FindStringSubmatchIndex(recorded)
+		if end == nil {
+			io.WriteString(out, strings.ReplaceAll(recorded, oldGUID, guid))
+			return unrecorded(guid, "The recording ends during the step")
+		}
+		io.WriteString(out, strings.ReplaceAll(recorded[:end[1]], oldGUID, guid))
+		code, _ := strconv.Atoi(recorded[end[2]:end[3]])
+		recorded = recorded[end[1]:]
+
+		// The build shell exited on the failure of a step running in it, with its trap
+		if !condition && end[4] < 0 && code != ExitOk {
+			return exit(code)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestReplayTerminal(t *testing.T) {
+	defer os.Setenv("SD_REPLAY_TERMINAL", os.Getenv("SD_REPLAY_TERMINAL"))
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		value string
+		path  string
+		err   bool
+	}{
+		{"", "", false},
+		{" " + dir + " ", dir, false},
+		{filepath.Join(dir, "missing.cast"), "", true},
+	}
+	for _, test := range tests {
+		os.Setenv("SD_REPLAY_TERMINAL", test.value)
+		if path, err := replayTerminal(); path != test.path || (err != nil) != test.err {
+			t.Errorf("replayTerminal() with %q = %q, %v, want %q and error %v", test.value, path, err, test.path, test.err)
+		}
+	}
+}
+
+func TestReplayCommands(t *testing.T) {
+	commands := []screwdriver.CommandDef{
+		{Name: "install", Cmd: "npm install", Image: "node:14", User: "builder", Nice: 5},
+		{Name: "test", Script: "test.sh", Args: []string{"-v"}, Interpreter: "/bin/bash"},
+		{Name: "docs", Container: "docs", Cmd: "make docs"},
+	}
+	replayed := replayCommands(commands)
+	for i, cmd := range replayed {
+		want := screwdriver.CommandDef{Name: commands[i].Name, Cmd: ":"}
+		if !reflect.DeepEqual(cmd, want) {
+			t.Errorf("replayCommands()[%d] = %+v, want %+v", i, cmd, want)
+		}
+	}
+	if commands[0].Cmd != "npm install" {
+		t.Errorf("The commands of the build should be left alone: %+v", commands[0])
+	}
+}
+
+// Writes an asciicast recording with the output out to a file in dir
+func writeCast(t *testing.T, dir, out string) string {
+	path := filepath.Join(dir, terminalRecordingFile)
+	header, _ := json.Marshal(asciicastHeader{Version: 2, Width: 80, Height: 24})
+	event, _ := json.Marshal([]interface{}{0.5, "o", out})
+	if err := ioutil.WriteFile(path, append(append(header, '\n'), append(event, '\n')...), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestReplayShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldInstall := "11111111-1111-1111-1111-111111111111"
+	oldTest := "22222222-2222-2222-2222-222222222222"
+	cast := writeCast(t, dir, strings.Join([]string{
+		"$ export SD_STEP_ID=" + oldInstall + " ; npm install\r",
+		"added 12 packages\r",
+		oldInstall + " 0\r",
+		"$ export SD_STEP_ID=" + oldTest + " ; make test\r",
+		"FAIL " + oldTest + "\r",
+		oldTest + " 2\r",
+		"",
+	}, "\n"))
+
+	newInstall := "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+	newTest := "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb"
+	exportFile := filepath.Join(dir, "export")
+	in := strings.Join([]string{
+		"exportfile=" + exportFile + "; trap 'env > $exportfile' EXIT",
+		"export SD_STEP_ID=" + newInstall + " ; :",
+		"export SD_STEP_ID=" + newTest + " ; :",
+		"",
+	}, "\n")
+	var out bytes.Buffer
+	code, err := replayShell(cast, strings.NewReader(in), &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code != 2 {
+		t.Errorf("The shell should exit with the code of the failed step, got %d", code)
+	}
+	want := "added 12 packages\n" + newInstall + " 0\n" + "FAIL " + newTest + "\n" + newTest + " 2\n"
+	if out.String() != want {
+		t.Errorf("Output %q, want %q", out.String(), want)
+	}
+	if _, err := os.Stat(exportFile); err != nil {
+		t.Errorf("The shell should write the export file on exit: %v", err)
+	}
+
+	// A step the recording does not have ends the shell
+	out.Reset()
+	in = "export SD_STEP_ID=" + newInstall + " ; :\nexport SD_STEP_ID=" + newTest + " ; :\n"
+	cast = writeCast(t, dir, "$ export SD_STEP_ID="+oldInstall+" ; npm install\r\n"+oldInstall+" 0\r\n")
+	if code, err = replayShell(cast, strings.NewReader(in), &out); err != nil || code != ExitUnknown {
+		t.Errorf("replayShell() = %d, %v, want %d", code, err, ExitUnknown)
+	}
+	if !strings.HasSuffix(out.String(), "The recording has no more steps\n"+newTest+" 254\n") {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
+
+func TestRunReplaysTerminal(t *testing.T) {
+	envFilepath := "/tmp/testReplayTerminal"
+	setupTestCase(t, envFilepath)
+	defer os.Setenv("SD_TERMINAL_RECORDING", os.Getenv("SD_TERMINAL_RECORDING"))
+	defer os.Setenv("SD_REPLAY_TERMINAL", os.Getenv("SD_REPLAY_TERMINAL"))
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "ran")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "install", Cmd: "echo installing; touch " + marker},
+			{Name: "test", Cmd: "echo testing; exit 3"},
+			{Name: "skipped", Cmd: "echo skipped"},
+			{Name: "teardown-cleanup", Cmd: "echo cleaning"},
+		},
+		Environment: []map[string]string{},
+	}
+	// Runs the build and returns the exit codes of its steps and its log
+	run := func() (map[string]int, string) {
+		codes := map[string]int{}
+		testAPI := screwdriver.API(MockAPI{
+			updateStepStop: func(buildID int, stepName string, code int) error {
+				codes[stepName] = code
+				return nil
+			},
+		})
+		emitter := &MockEmitter{}
+		Run("", []string{"SD_ARTIFACTS_DIR=" + dir}, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+		return codes, string(emitter.found)
+	}
+
+	os.Setenv("SD_TERMINAL_RECORDING", "true")
+	recordedCodes, recordedLog := run()
+	os.Setenv("SD_TERMINAL_RECORDING", "")
+	if err := os.Remove(marker); err != nil {
+		t.Fatalf("The recorded build should run its steps: %v", err)
+	}
+	cast := filepath.Join(dir, "recorded.cast")
+	if err := os.Rename(filepath.Join(dir, terminalRecordingFile), cast); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	os.Setenv("SD_REPLAY_TERMINAL", cast)
+	replayedCodes, replayedLog := run()
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("The replayed build should not run its steps")
+	}
+	if recordedCodes["test"] != 3 || !reflect.DeepEqual(replayedCodes, recordedCodes) {
+		t.Errorf("Replayed step codes %v, want the recorded %v", replayedCodes, recordedCodes)
+	}
+	for _, line := range []string{"installing", "testing"} {
+		if !strings.Contains(replayedLog, line) {
+			t.Errorf("The replayed log should have %q: %q", line, replayedLog)
+		}
+	}
+	if strings.Contains(replayedLog, "cleaning") || !strings.Contains(recordedLog, "cleaning") {
+		t.Errorf("The teardowns should not run in the replayed build: %q", replayedLog)
+	}
+}
@@ -0,0 +1,89 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// Returns the file in the directory of the step scripts scriptDir where the build shell writes the
+// line number of the step script that failed. Only bash reports it.
+func failedLinePath(scriptDir string) string {
+	return filepath.Join(scriptDir, "step.line")
+}
+
+// Returns the setup command making bash write the line number of the failed command to path
+func trapFailedLine(path string) string {
+	return "[ -z \"$BASH_VERSION\" ] || trap " + shellQuote("{ echo $LINENO > "+shellQuote(path)+"; } 2>/dev/null") + " ERR"
+}
+
+// stepResult is the record of one user step in the results file
+type stepResult struct {
+	Name       string `json:"name"`
+	Code       int    `json:"code"`
+	DurationMs int64  `json:"durationMs"`
+	// FailedLine is the line of the step command that failed and FailedLineNumber its number,
+	// starting at 1, if the shell reported it
+	FailedLine       string `json:"failedLine,omitempty"`
+	FailedLineNumber int    `json:"failedLineNumber,omitempty"`
+}
+
+// stepResults collects how the user steps went, so the teardowns can report on them without
+// parsing the logs
+type stepResults struct {
+	Steps []stepResult `json:"steps"`
+}
+
+// Records a user step that started at start and just stopped, with the line of command that
+// failed if known
+func (r *stepResults) add(name string, start time.Time, code int, lineNumber int, command string) {
+	result := stepResult{
+		Name:       name,
+		Code:       code,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if lines := strings.Split(command, "\n"); lineNumber >= 1 && lineNumber <= len(lines) {
+		result.FailedLineNumber = lineNumber
+		result.FailedLine = lines[lineNumber-1]
+	}
+	r.Steps = append(r.Steps, result)
+}
+
+// Writes the results to path as JSON
+func (r *stepResults) write(path string) error {
+	if r.Steps == nil {
+		r.Steps = []stepResult{}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// Returns the line number in the command of a step of the failed line the shell reported in path,
+// or 0 if unknown. The step script starts with the header lines before the command.
+func failedLineNumber(path string, header int) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || n <= header {
+		return 0
+	}
+	return n - header
+}
+
+// Removes the line number at path left by a previous step
+func removeFailedLine(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("Failed to remove %s: %v", path, err)
+	}
+}
@@ -0,0 +1,78 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestStepResultsAdd(t *testing.T) {
+	var results stepResults
+	results.add("install", time.Now(), 0, 0, "npm install")
+	results.add("test", time.Now(), 1, 2, "npm run lint\nnpm test\necho done")
+	results.add("other", time.Now(), 1, 5, "make")
+
+	want := []stepResult{
+		{Name: "install", Code: 0},
+		{Name: "test", Code: 1, FailedLine: "npm test", FailedLineNumber: 2},
+		{Name: "other", Code: 1},
+	}
+	for i, got := range results.Steps {
+		got.DurationMs = 0
+		if got != want[i] {
+			t.Errorf("Step %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestRunWritesStepResults(t *testing.T) {
+	envFilepath := "/tmp/testStepResults"
+	setupTestCase(t, envFilepath)
+	copied := "/tmp/testStepResults.json"
+	os.Remove(copied)
+	defer os.Remove(copied)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "echo install", Name: "install"},
+			{Cmd: "echo lint\nfalse\necho never", Name: "test"},
+			{Cmd: "cp $SD_STEP_RESULTS " + copied, Name: "teardown-report"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	err := Run("", nil, &MockEmitter{}, testBuild, MockAPI{}, testBuild.ID, "/bin/bash", TestBuildTimeout, envFilepath, "")
+	if err == nil {
+		t.Fatalf("Expected the test step to fail")
+	}
+
+	data, err := ioutil.ReadFile(copied)
+	if err != nil {
+		t.Fatalf("The teardown should read the step results: %v", err)
+	}
+	var results stepResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []stepResult{
+		{Name: "install", Code: 0},
+		{Name: "test", Code: 1, FailedLine: "false", FailedLineNumber: 2},
+	}
+	if _, err := os.Stat(failedLinePath(envFilepath + "_steps")); !os.IsNotExist(err) {
+		t.Errorf("The line number of the failed command should be removed with the build: %v", err)
+	}
+	if len(results.Steps) != len(want) {
+		t.Fatalf("Unexpected step results %+v, want %+v", results.Steps, want)
+	}
+	for i, got := range results.Steps {
+		got.DurationMs = 0
+		if got != want[i] {
+			t.Errorf("Step %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
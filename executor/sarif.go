@@ -0,0 +1,315 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// sarifVersion is the version of SARIF the launcher reads
+	sarifVersion = "2.1.0"
+	// maxSarifBytes bounds the size of a SARIF file the launcher reads
+	maxSarifBytes = 64 << 20
+	// maxFindings bounds the findings listed in the summary, the most severe first
+	maxFindings = 100
+)
+
+// The decisions of the findings check
+const (
+	findingsPassed = "passed"
+	findingsWarned = "warned"
+	findingsFailed = "failed"
+)
+
+// sarifLevels are the levels of the findings counted, by severity
+var sarifLevels = map[string]int{"error": 0, "warning": 1, "note": 2}
+
+// sarifLog is the root of a SARIF file, with what the launcher reads of it
+type sarifLog struct {
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+// sarifRun is a run of a tool, with its results
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name  string      `json:"name"`
+			Rules []sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+// sarifRule is a rule of a tool, with the level of its results without one
+type sarifRule struct {
+	ID                   string       `json:"id"`
+	ShortDescription     sarifMessage `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+// sarifResult is a result of a run
+type sarifResult struct {
+	RuleID       string            `json:"ruleId"`
+	RuleIndex    *int              `json:"ruleIndex"`
+	Kind         string            `json:"kind"`
+	Level        string            `json:"level"`
+	Message      sarifMessage      `json:"message"`
+	Locations    []sarifLocation   `json:"locations"`
+	Suppressions []json.RawMessage `json:"suppressions"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine int `json:"startLine"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+// Checks the thresholds of the findings of a build, which may have none
+func checkSarifChecks(checks *screwdriver.SarifChecks) error {
+	if checks == nil {
+		return nil
+	}
+	for _, max := range []*int{checks.MaxErrors, checks.MaxWarnings, checks.MaxNotes} {
+		if max != nil && *max < 0 {
+			return fmt.Errorf("Invalid findings threshold %d, want a positive number", *max)
+		}
+	}
+	return nil
+}
+
+// Returns the summary of the findings of the SARIF files, *.sarif or *.sarif.json, of
+// artifactsDir, the locations in sourceDir made relative to it. The files that are not valid
+// SARIF are listed as invalid with a warning, symlinks are never followed.
+func readSarifFiles(artifactsDir, sourceDir string) (screwdriver.Findings, error) {
+	findings := screwdriver.Findings{Files: []string{}, Tools: []string{}, Findings: []screwdriver.Finding{}, Violations: []string{}}
+	tools := map[string]bool{}
+	err := filepath.WalkDir(artifactsDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".sarif") && !strings.HasSuffix(d.Name(), ".sarif.json") {
+			return nil
+		}
+		rel, err := filepath.Rel(artifactsDir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		log, err := parseSarifFile(file)
+		if err != nil {
+			logger.Warnf("Skipping SARIF file %s: %v", rel, err)
+			findings.Invalid = append(findings.Invalid, rel)
+			return nil
+		}
+		findings.Files = append(findings.Files, rel)
+		for _, run := range log.Runs {
+			if !tools[run.Tool.Driver.Name] {
+				tools[run.Tool.Driver.Name] = true
+				findings.Tools = append(findings.Tools, run.Tool.Driver.Name)
+			}
+			for _, result := range run.Results {
+				if finding, ok := run.finding(result, sourceDir); ok {
+					addFinding(&findings, finding)
+				}
+			}
+		}
+		return nil
+	})
+
+	// The most severe findings first, in the order of the files otherwise
+	sort.SliceStable(findings.Findings, func(i, j int) bool {
+		return sarifLevels[findings.Findings[i].Level] < sarifLevels[findings.Findings[j].Level]
+	})
+	if len(findings.Findings) > maxFindings {
+		findings.Findings = findings.Findings[:maxFindings]
+	}
+	return findings, err
+}
+
+// Parses and validates the SARIF file at path
+func parseSarifFile(path string) (sarifLog, error) {
+	var log sarifLog
+	f, err := os.Open(path)
+	if err != nil {
+		return log, err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil {
+		return log, err
+	} else if info.Size() > maxSarifBytes {
+		return log, fmt.Errorf("Larger than the limit of %d bytes", maxSarifBytes)
+	}
+	if err := json.NewDecoder(io.LimitReader(f, maxSarifBytes)).Decode(&log); err != nil {
+		return log, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	if log.Version != sarifVersion {
+		return log, fmt.Errorf("SARIF version %q, want %q", log.Version, sarifVersion)
+	}
+	if log.Runs == nil {
+		return log, fmt.Errorf("No runs")
+	}
+	for i, run := range log.Runs {
+		if run.Tool.Driver.Name == "" {
+			return log, fmt.Errorf("Run %d has no tool name", i)
+		}
+	}
+	return log, nil
+}
+
+// Returns the finding of result, a result of the run, or false if it is not a problem: a result
+// suppressed, of another kind than fail or of level none
+func (r sarifRun) finding(result sarifResult, sourceDir string) (screwdriver.Finding, bool) {
+	if len(result.Suppressions) > 0 || (result.Kind != "" && result.Kind != "fail") {
+		return screwdriver.Finding{}, false
+	}
+	var rule *sarifRule
+	if result.RuleIndex != nil && *result.RuleIndex >= 0 && *result.RuleIndex < len(r.Tool.Driver.Rules) {
+		rule = &r.Tool.Driver.Rules[*result.RuleIndex]
+	} else {
+		for i := range r.Tool.Driver.Rules {
+			if r.Tool.Driver.Rules[i].ID == result.RuleID {
+				rule = &r.Tool.Driver.Rules[i]
+				break
+			}
+		}
+	}
+
+	finding := screwdriver.Finding{
+		Tool:    r.Tool.Driver.Name,
+		Rule:    result.RuleID,
+		Level:   result.Level,
+		Message: result.Message.Text,
+	}
+	if rule != nil {
+		if finding.Rule == "" {
+			finding.Rule = rule.ID
+		}
+		if finding.Level == "" {
+			finding.Level = rule.DefaultConfiguration.Level
+		}
+		if finding.Message == "" {
+			finding.Message = rule.ShortDescription.Text
+		}
+	}
+	if finding.Level == "" {
+		finding.Level = "warning"
+	}
+	if _, ok := sarifLevels[finding.Level]; !ok {
+		return screwdriver.Finding{}, false
+	}
+	if len(finding.Message) > maxTestFailureMessage {
+		finding.Message = finding.Message[:maxTestFailureMessage] + "..."
+	}
+	if len(result.Locations) > 0 {
+		location := result.Locations[0].PhysicalLocation
+		finding.File = sourceFile(location.ArtifactLocation.URI, sourceDir)
+		finding.Line = location.Region.StartLine
+	}
+	return finding, true
+}
+
+// Returns the file of the URI uri of a SARIF location, relative to sourceDir if it is in it
+func sourceFile(uri, sourceDir string) string {
+	file := strings.TrimPrefix(uri, "file://")
+	if sourceDir != "" && filepath.IsAbs(file) {
+		if rel, err := filepath.Rel(sourceDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return file
+}
+
+// Counts finding in findings
+func addFinding(findings *screwdriver.Findings, finding screwdriver.Finding) {
+	switch finding.Level {
+	case "error":
+		findings.Errors++
+	case "warning":
+		findings.Warnings++
+	case "note":
+		findings.Notes++
+	}
+	findings.Findings = append(findings.Findings, finding)
+}
+
+// Checks findings against the thresholds of checks, which may have none, setting their violations
+// and decision
+func checkFindings(checks *screwdriver.SarifChecks, findings *screwdriver.Findings) {
+	if checks == nil {
+		checks = &screwdriver.SarifChecks{}
+	}
+	for _, threshold := range []struct {
+		level string
+		count int
+		max   *int
+	}{
+		{"errors", findings.Errors, checks.MaxErrors},
+		{"warnings", findings.Warnings, checks.MaxWarnings},
+		{"notes", findings.Notes, checks.MaxNotes},
+	} {
+		if threshold.max != nil && threshold.count > *threshold.max {
+			findings.Violations = append(findings.Violations, fmt.Sprintf("%d %s, more than %d", threshold.count, threshold.level, *threshold.max))
+		}
+	}
+
+	switch {
+	case len(findings.Violations) == 0:
+		findings.Decision = findingsPassed
+	case checks.FailBuild:
+		findings.Decision = findingsFailed
+	default:
+		findings.Decision = findingsWarned
+	}
+}
+
+// Checks the findings of the SARIF files of artifactsDir against the thresholds of checks, which
+// may have none, and sends their summary to the API if there are any. It returns a FindingsFailure
+// if the build fails because of them.
+func checkSarifFiles(api screwdriver.API, buildID int, checks *screwdriver.SarifChecks, artifactsDir, sourceDir string) error {
+	if artifactsDir == "" {
+		return nil
+	}
+	findings, err := readSarifFiles(artifactsDir, sourceDir)
+	if err != nil {
+		logger.Warnf("Failed to read the SARIF files: %v", err)
+		return nil
+	}
+	if len(findings.Files) == 0 && len(findings.Invalid) == 0 {
+		return nil
+	}
+
+	checkFindings(checks, &findings)
+	logger.Infof("Read %d SARIF files of %s: %d errors, %d warnings and %d notes, %s the checks", len(findings.Files), strings.Join(findings.Tools, ", "), findings.Errors, findings.Warnings, findings.Notes, findings.Decision)
+	for _, violation := range findings.Violations {
+		logger.Warnf("%s", violation)
+	}
+	if err := api.UpdateBuildFindings(buildID, findings); err != nil {
+		logger.Warnf("Failed to send the findings: %v", err)
+	}
+	if findings.Decision == findingsFailed {
+		return FindingsFailure{Violations: findings.Violations}
+	}
+	return nil
+}
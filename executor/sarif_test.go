@@ -0,0 +1,121 @@
+package executor
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSarifFile = `{
+  "version": "2.1.0",
+  "runs": [{
+    "tool": {"driver": {"name": "gosec", "rules": [
+      {"id": "G101", "shortDescription": {"text": "Hardcoded credentials"}, "defaultConfiguration": {"level": "error"}},
+      {"id": "G104", "defaultConfiguration": {"level": "note"}}
+    ]}},
+    "results": [
+      {"ruleId": "G104", "ruleIndex": 1, "message": {"text": "Errors unhandled"}, "locations": [{"physicalLocation": {"artifactLocation": {"uri": "file:///sd/workspace/src/cmd/main.go"}, "region": {"startLine": 40}}}]},
+      {"ruleId": "G101", "locations": [{"physicalLocation": {"artifactLocation": {"uri": "config.go"}, "region": {"startLine": 12}}}]},
+      {"ruleId": "G101", "message": {"text": "Suppressed"}, "suppressions": [{"kind": "inSource"}]},
+      {"ruleId": "G102", "kind": "pass", "message": {"text": "Passed"}},
+      {"ruleId": "G103", "level": "none", "message": {"text": "Not a problem"}},
+      {"ruleId": "G105", "message": {"text": "Without a rule"}}
+    ]
+  }]
+}`
+
+func TestReadSarifFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sarif")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "scans"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "scans", "gosec.sarif"), []byte(testSarifFile), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "old.sarif.json"), []byte(`{"version": "2.0.0", "runs": []}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "broken.sarif"), []byte(`{"version": `), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "report.json"), []byte(`{}`), 0644)
+
+	findings, err := readSarifFiles(dir, "/sd/workspace/src")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assert.Equal(t, screwdriver.Findings{
+		Files:    []string{"scans/gosec.sarif"},
+		Invalid:  []string{"broken.sarif", "old.sarif.json"},
+		Tools:    []string{"gosec"},
+		Errors:   1,
+		Warnings: 1,
+		Notes:    1,
+		Findings: []screwdriver.Finding{
+			{Tool: "gosec", Rule: "G101", Level: "error", Message: "Hardcoded credentials", File: "config.go", Line: 12},
+			{Tool: "gosec", Rule: "G105", Level: "warning", Message: "Without a rule"},
+			{Tool: "gosec", Rule: "G104", Level: "note", Message: "Errors unhandled", File: "cmd/main.go", Line: 40},
+		},
+		Violations: []string{},
+	}, findings)
+
+	maxErrors, maxNotes := 0, 5
+	checkFindings(&screwdriver.SarifChecks{MaxErrors: &maxErrors, MaxNotes: &maxNotes}, &findings)
+	assert.Equal(t, []string{"1 errors, more than 0"}, findings.Violations)
+	assert.Equal(t, findingsWarned, findings.Decision)
+
+	findings.Violations = []string{}
+	checkFindings(nil, &findings)
+	assert.Equal(t, findingsPassed, findings.Decision)
+
+	negative := -1
+	assert.Error(t, checkSarifChecks(&screwdriver.SarifChecks{MaxWarnings: &negative}))
+	assert.NoError(t, checkSarifChecks(&screwdriver.SarifChecks{MaxWarnings: &maxErrors}))
+}
+
+func TestRunFailsOnSarifFindings(t *testing.T) {
+	envFilepath := "/tmp/testSarif"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "sarif")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "gosec.sarif"), []byte(testSarifFile), 0644)
+	artifactsDir := filepath.Join(dir, "artifacts")
+	os.MkdirAll(artifactsDir, 0755)
+
+	maxErrors := 0
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "scan", Cmd: "cp " + filepath.Join(dir, "gosec.sarif") + " " + artifactsDir},
+			{Name: "teardown-echo", Cmd: "echo teardown"},
+		},
+		Environment: []map[string]string{},
+		Sarif:       &screwdriver.SarifChecks{MaxErrors: &maxErrors, FailBuild: true},
+	}
+	var sent []screwdriver.Findings
+	codes := map[string]int{}
+	api := MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+		findings: func(buildID int, findings screwdriver.Findings) {
+			sent = append(sent, findings)
+		},
+	}
+	env := []string{"SD_ARTIFACTS_DIR=" + artifactsDir}
+	err = Run("", env, &MockEmitter{}, testBuild, screwdriver.API(api), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	var failure FindingsFailure
+	if !errors.As(err, &failure) || !IsUserFailure(err) {
+		t.Errorf("The findings should fail the build: %v", err)
+	}
+	assert.Equal(t, map[string]int{"scan": 0, "teardown-echo": 0}, codes)
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, findingsFailed, sent[0].Decision)
+		assert.Equal(t, []string{"gosec.sarif"}, sent[0].Files)
+	}
+}
@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Exit codes of a step whose script is missing or cannot be run, like the shell's
+const (
+	exitScriptNotFound      = 127
+	exitScriptNotExecutable = 126
+)
+
+// Checks the script of a step is a relative path staying in the source directory
+func checkScriptPath(cmd screwdriver.CommandDef) error {
+	if cmd.Script == "" {
+		if len(cmd.Args) > 0 {
+			return fmt.Errorf("Step %q has arguments but no script", cmd.Name)
+		}
+		return nil
+	}
+	if cmd.Cmd != "" {
+		return fmt.Errorf("Step %q has both a command and a script", cmd.Name)
+	}
+	clean := filepath.Clean(cmd.Script)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("Invalid script %q of step %q, want a path in the source directory", cmd.Script, cmd.Name)
+	}
+	return nil
+}
+
+// Returns cmd running its script of the source directory, if any, with its arguments. The script
+// is checked right before the step, as the steps before it check out the source. If it is
+// missing or not executable, this returns the exit code and error the step fails with.
+func resolveScript(cmd screwdriver.CommandDef, sourceDir string) (screwdriver.CommandDef, int, error) {
+	if cmd.Script == "" {
+		return cmd, ExitOk, nil
+	}
+
+	path := filepath.Join(sourceDir, filepath.Clean(cmd.Script))
+	info, err := os.Stat(path)
+	if err != nil {
+		return cmd, exitScriptNotFound, fmt.Errorf("Script %s not found: %v", cmd.Script, err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return cmd, exitScriptNotExecutable, fmt.Errorf("Script %s is not an executable file", cmd.Script)
+	}
+
+	if !filepath.IsAbs(path) {
+		path = "./" + path
+	}
+	words := []string{shellQuote(path)}
+	for _, arg := range cmd.Args {
+		words = append(words, shellQuote(arg))
+	}
+	cmd.Cmd = strings.Join(words, " ")
+	return cmd, ExitOk, nil
+}
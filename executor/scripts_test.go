@@ -0,0 +1,108 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCheckScriptPath(t *testing.T) {
+	valid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "make test"},
+		{Name: "test", Script: "scripts/test.sh", Args: []string{"--all"}},
+		{Name: "test", Script: "./ci/../scripts/test.sh"},
+	}
+	for _, cmd := range valid {
+		if err := checkScriptPath(cmd); err != nil {
+			t.Errorf("checkScriptPath(%+v) = %v", cmd, err)
+		}
+	}
+
+	invalid := []screwdriver.CommandDef{
+		{Name: "test", Cmd: "make test", Script: "test.sh"},
+		{Name: "test", Cmd: "make test", Args: []string{"--all"}},
+		{Name: "test", Script: "/usr/bin/make"},
+		{Name: "test", Script: "../other/test.sh"},
+		{Name: "test", Script: "scripts/../../test.sh"},
+	}
+	for _, cmd := range invalid {
+		if err := checkScriptPath(cmd); err == nil {
+			t.Errorf("Expected an error for %+v", cmd)
+		}
+	}
+}
+
+func TestResolveScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scripts")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "scripts"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "scripts", "test.sh"), []byte("#!/bin/sh\necho ok\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "scripts", "data.txt"), []byte("data\n"), 0644)
+
+	cmd, code, err := resolveScript(screwdriver.CommandDef{Name: "test", Script: "scripts/test.sh", Args: []string{"it's", "$HOME"}}, dir)
+	if err != nil || code != ExitOk {
+		t.Fatalf("Unexpected error: %v, %d", err, code)
+	}
+	if want := "'" + dir + "/scripts/test.sh' 'it'\\''s' '$HOME'"; cmd.Cmd != want {
+		t.Errorf("Cmd = %s, want %s", cmd.Cmd, want)
+	}
+
+	for script, want := range map[string]int{"scripts/missing.sh": exitScriptNotFound, "scripts/data.txt": exitScriptNotExecutable, "scripts": exitScriptNotExecutable} {
+		if _, code, err := resolveScript(screwdriver.CommandDef{Name: "test", Script: script}, dir); err == nil || code != want {
+			t.Errorf("resolveScript(%s) = %d, %v, want %d", script, code, err, want)
+		}
+	}
+
+	inline := screwdriver.CommandDef{Name: "test", Cmd: "make test"}
+	if cmd, code, err := resolveScript(inline, dir); !reflect.DeepEqual(cmd, inline) || code != ExitOk || err != nil {
+		t.Errorf("resolveScript() of a command = %+v, %d, %v", cmd, code, err)
+	}
+}
+
+func TestRunScriptSteps(t *testing.T) {
+	envFilepath := "/tmp/testScriptSteps"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "greet.sh"), []byte("#!/bin/sh\necho \"hello $1\"\n"), 0755)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "greet", Script: "greet.sh", Args: []string{"big world"}},
+			{Name: "missing", Script: "missing.sh"},
+			{Name: "never", Cmd: "echo never"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+
+	err = Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir)
+	if want := (StepFailure{Step: "missing", Code: exitScriptNotFound}); err != want {
+		t.Errorf("Unexpected error: %v, want %v", err, want)
+	}
+	if want := map[string]int{"greet": 0, "missing": exitScriptNotFound}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	if !strings.Contains(string(emitter.found), "hello big world") {
+		t.Errorf("The script should run with its arguments: %q", emitter.found)
+	}
+}
@@ -0,0 +1,155 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Return values of a seccomp filter
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// Offsets of the fields of struct seccomp_data, which the filter inspects
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// seccompFilter is a compiled seccomp profile, the BPF program the kernel runs on every syscall
+type seccompFilter []unix.SockFilter
+
+// seccompProfile is a seccomp profile in the format of Docker and the OCI runtime spec, without
+// the argument filters
+type seccompProfile struct {
+	DefaultAction string           `json:"defaultAction"`
+	Syscalls      []seccompSyscall `json:"syscalls"`
+}
+
+// seccompSyscall is the action taken for some syscalls
+type seccompSyscall struct {
+	Names  []string          `json:"names"`
+	Action string            `json:"action"`
+	Args   []json.RawMessage `json:"args,omitempty"`
+}
+
+// Returns the filter return value for a profile action
+func seccompAction(action string) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | uint32(unix.EPERM), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	}
+	return 0, fmt.Errorf("Unsupported seccomp action %q", action)
+}
+
+// Reads the seccomp profile at path and compiles it to a BPF filter for this architecture
+func loadSeccompProfile(path string) (seccompFilter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile seccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("Parsing the seccomp profile %q: %v", path, err)
+	}
+	return profile.compile()
+}
+
+// Returns the BPF filter applying the profile. Syscalls unknown on this architecture are
+// ignored, like Docker does, so the same profile works everywhere.
+func (p seccompProfile) compile() (seccompFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, fmt.Errorf("Seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	defaultAction, err := seccompAction(p.DefaultAction)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := map[uint32]uint32{}
+	for _, rule := range p.Syscalls {
+		if len(rule.Args) > 0 {
+			return nil, fmt.Errorf("Seccomp argument filters are not supported (syscalls %v)", rule.Names)
+		}
+		action, err := seccompAction(rule.Action)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.Names {
+			if nr, ok := syscallNumbers[name]; ok {
+				actions[nr] = action
+			}
+		}
+	}
+
+	var nrs []uint32
+	for nr, action := range actions {
+		if action != defaultAction {
+			nrs = append(nrs, nr)
+		}
+	}
+	sort.Slice(nrs, func(i, j int) bool { return nrs[i] < nrs[j] })
+
+	filter := seccompFilter{
+		// Kill syscalls of another architecture, their numbers mean something else
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompAuditArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+	}
+	if seccompX32Bit != 0 {
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, seccompX32Bit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.ENOSYS)))
+	}
+	for _, nr := range nrs {
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, actions[nr]))
+	}
+	filter = append(filter, bpfStmt(unix.BPF_RET|unix.BPF_K, defaultAction))
+
+	if len(filter) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("Seccomp profile too large: %d instructions", len(filter))
+	}
+	return filter, nil
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// Installs filter on the calling thread, which must be locked to its goroutine and exec the step
+// right after. no_new_privs is set first, as the kernel requires without CAP_SYS_ADMIN, and so
+// setuid binaries can't escape the filter.
+func installSeccompFilter(filter seccompFilter) error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("Setting no_new_privs: %v", err)
+	}
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("Installing the seccomp filter: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"golang.org/x/sys/unix"
+)
+
+func writeSeccompProfile(t *testing.T, profile string) string {
+	f, err := ioutil.TempFile("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(profile); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestCompileSeccompProfile(t *testing.T) {
+	if seccompAuditArch == 0 {
+		t.Skipf("Seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+
+	profile := seccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []seccompSyscall{
+			{Names: []string{"mkdir", "mkdirat", "not_a_syscall"}, Action: "SCMP_ACT_ERRNO"},
+			{Names: []string{"read"}, Action: "SCMP_ACT_ALLOW"},
+		},
+	}
+	filter, err := profile.compile()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Every syscall with an action other than the default gets a check and a return
+	var denied []uint32
+	for i, insn := range filter {
+		if insn.Code == unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K && insn.K != seccompAuditArch {
+			denied = append(denied, insn.K)
+			if ret := filter[i+1]; ret.K != seccompRetErrno|uint32(unix.EPERM) {
+				t.Errorf("syscall %d returns %x, want EPERM", insn.K, ret.K)
+			}
+		}
+	}
+	if len(denied) != 1 && len(denied) != 2 {
+		t.Errorf("Unexpected denied syscalls %v", denied)
+	}
+	if last := filter[len(filter)-1]; last.Code != unix.BPF_RET|unix.BPF_K || last.K != seccompRetAllow {
+		t.Errorf("The filter should end with the default action, got %+v", last)
+	}
+
+	invalid := []seccompProfile{
+		{DefaultAction: "SCMP_ACT_TRACE"},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []seccompSyscall{{Names: []string{"mkdir"}, Action: "SCMP_ACT_NOTIFY"}}},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []seccompSyscall{{Names: []string{"clone"}, Action: "SCMP_ACT_ERRNO", Args: []json.RawMessage{[]byte(`{"index": 0}`)}}}},
+	}
+	for _, p := range invalid {
+		if _, err := p.compile(); err == nil {
+			t.Errorf("Expected an error compiling %+v", p)
+		}
+	}
+}
+
+func TestRunAppliesSeccompProfile(t *testing.T) {
+	if seccompAuditArch == 0 {
+		t.Skipf("Seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+
+	envFilepath := "/tmp/testSeccomp"
+	setupTestCase(t, envFilepath)
+	profile := writeSeccompProfile(t, `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [
+		{"names": ["mkdir", "mkdirat"], "action": "SCMP_ACT_ERRNO"}
+	]}`)
+	defer os.Remove(profile)
+	os.Setenv("SD_STEP_SECCOMP_PROFILE", profile)
+	defer os.Unsetenv("SD_STEP_SECCOMP_PROFILE")
+
+	dir, err := ioutil.TempDir("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "mkdir " + dir + "/step", Name: "step"},
+			{Cmd: "mkdir " + dir + "/sd", Name: "sd-teardown-launcher"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	var emitter MockEmitter
+	err = Run("", nil, &emitter, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if !IsUserFailure(err) {
+		t.Errorf("Run() = %v, want the step to fail", err)
+	}
+	if _, err := os.Stat(dir + "/step"); err == nil {
+		t.Errorf("The step should not be allowed to create a directory")
+	}
+	if !strings.Contains(string(emitter.found), "Operation not permitted") {
+		t.Errorf("The step log should show the denied syscall: %s", emitter.found)
+	}
+	if _, err := os.Stat(dir + "/sd"); err != nil {
+		t.Errorf("The Screwdriver teardowns should not be confined: %v", err)
+	}
+
+	os.Setenv("SD_STEP_SECCOMP_PROFILE", "/does/not/exist")
+	if err := Run("", nil, &emitter, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); !errors.Is(err, ErrInfra) {
+		t.Errorf("Run() with a missing profile = %v, want an infrastructure error", err)
+	}
+}
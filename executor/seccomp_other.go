@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// seccompFilter is never compiled where there is no seccomp
+type seccompFilter []struct{}
+
+// Fails, seccomp profiles are only supported on Linux
+func loadSeccompProfile(path string) (seccompFilter, error) {
+	return nil, fmt.Errorf("Seccomp profiles are not supported on %s", runtime.GOOS)
+}
+
+// Fails, seccomp profiles are only supported on Linux
+func installSeccompFilter(filter seccompFilter) error {
+	return fmt.Errorf("Seccomp profiles are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,184 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// shellProbeTimeout bounds each probe of the shell, so a shell waiting for input fails fast
+const shellProbeTimeout = 5 * time.Second
+
+// shellCapabilities are the optional features of the build shell the setup commands use. The
+// launcher cannot run without the ones checked by probeShell and works around the others.
+type shellCapabilities struct {
+	// abrtTrap is whether the shell can trap ABRT, or only EXIT
+	abrtTrap bool
+	// exportP is whether export -p prints the exported variables so the shell can source them
+	exportP bool
+	// busybox is whether the shell is BusyBox ash, whose tools take fewer options
+	busybox bool
+	// zsh is whether the shell is zsh, which needs its line editor off and sh emulation for the
+	// launcher's own commands
+	zsh bool
+}
+
+// shellProbe is a script run with shellBin -c and the output it must print
+type shellProbe struct {
+	feature string
+	script  string
+	want    string
+}
+
+var (
+	// The launcher needs these to run the steps and tell when they are done
+	requiredShellProbes = []shellProbe{
+		{"set -e", "set -e; false; echo sd_probe_continued", ""},
+		{"trap EXIT", "trap 'echo sd_probe_trapped' EXIT; true", "sd_probe_trapped"},
+	}
+	abrtTrapProbe = shellProbe{"trap ABRT", "trap 'echo sd_probe_trapped' ABRT EXIT; true", "sd_probe_trapped"}
+	zshProbe      = shellProbe{"zsh", "[ -n \"$ZSH_VERSION\" ] && echo sd_probe_zsh", "sd_probe_zsh"}
+	busyboxProbe  = shellProbe{"BusyBox", "[ -n \"$BB_ASH_VERSION\" ] && echo sd_probe_busybox", "sd_probe_busybox"}
+	exportPProbe  = shellProbe{"export -p", "export SD_PROBE='a b'; sd_exports=$(export -p); unset SD_PROBE; eval \"$sd_exports\" 2>/dev/null; echo \"sd_probe_$SD_PROBE\"", "sd_probe_a b"}
+)
+
+// Returns whether shellBin has the feature of probe, on the remote host if not nil
+func (p shellProbe) run(shellBin string, remote *remoteHost) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shellProbeTimeout)
+	defer cancel()
+
+	c := exec.CommandContext(ctx, shellBin, "-c", p.script)
+	if remote != nil {
+		c = remote.command(ctx, false, quoteWords(shellBin, "-c", p.script))
+	}
+	output, err := c.Output()
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("Checking %s of shell %s: no answer in %v", p.feature, shellBin, shellProbeTimeout)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return false, fmt.Errorf("Cannot run shell %s: %v", shellBin, err)
+	}
+	if p.want == "" {
+		// A failed command must end the script with an error
+		return err != nil && !strings.Contains(string(output), "sd_probe_"), nil
+	}
+	return err == nil && strings.Contains(string(output), p.want), nil
+}
+
+// Checks shellBin supports what the launcher relies on and returns its optional capabilities.
+// A shell lacking a required feature fails the build right away rather than hanging it. The shell
+// is the one of the remote host if not nil.
+func probeShell(shellBin string, remote *remoteHost) (shellCapabilities, error) {
+	if err := checkShellBin(shellBin, remote); err != nil {
+		return shellCapabilities{}, err
+	}
+	for _, probe := range requiredShellProbes {
+		ok, err := probe.run(shellBin, remote)
+		if err != nil {
+			return shellCapabilities{}, err
+		}
+		if !ok {
+			return shellCapabilities{}, fmt.Errorf("Shell %s does not support %s, which the launcher needs to run the steps", shellBin, probe.feature)
+		}
+	}
+
+	var caps shellCapabilities
+	var err error
+	if caps.busybox, err = isBusyBox(shellBin, remote); err != nil {
+		return caps, err
+	}
+	if caps.zsh, err = zshProbe.run(shellBin, remote); err != nil {
+		return caps, err
+	}
+	if caps.abrtTrap, err = abrtTrapProbe.run(shellBin, remote); err != nil {
+		return caps, err
+	}
+	if !caps.abrtTrap {
+		logger.Warnf("Shell %s cannot trap ABRT, the environment is only exported when it exits", shellBin)
+	}
+	if caps.exportP, err = exportPProbe.run(shellBin, remote); err != nil {
+		return caps, err
+	}
+	if !caps.exportP {
+		logger.Warnf("Shell %s has no usable export -p, the teardowns will not get the variables the steps export", shellBin)
+	}
+	return caps, nil
+}
+
+// Checks shellBin is the absolute path of an executable file in the image, or on the remote host
+// if not nil
+func checkShellBin(shellBin string, remote *remoteHost) error {
+	if !filepath.IsAbs(shellBin) {
+		return fmt.Errorf("Invalid shell %q, want an absolute path", shellBin)
+	}
+	if remote != nil {
+		return remote.checkShellBin(shellBin)
+	}
+	info, err := os.Stat(shellBin)
+	if err != nil {
+		return fmt.Errorf("Shell %s not found in the image: %v", shellBin, err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("Shell %s is not an executable file", shellBin)
+	}
+	return nil
+}
+
+// Returns whether shellBin is BusyBox ash, a link to the busybox binary or a shell setting
+// BB_ASH_VERSION. Only the latter tells for the shell of a remote host.
+func isBusyBox(shellBin string, remote *remoteHost) (bool, error) {
+	if remote != nil {
+		return busyboxProbe.run(shellBin, remote)
+	}
+	if path, err := filepath.EvalSymlinks(shellBin); err == nil && filepath.Base(path) == "busybox" {
+		return true, nil
+	}
+	return busyboxProbe.run(shellBin, nil)
+}
+
+// Returns the signals the build shell traps to export its environment
+func (c shellCapabilities) finishSignals() string {
+	if c.abrtTrap {
+		return "ABRT EXIT"
+	}
+	return "EXIT"
+}
+
+// Returns the shell commands writing the environment of the build to exportFile like
+// exportEnvCommand, syncing everything with BusyBox, or an empty exportFile if the shell cannot
+// export it, so the teardowns don't wait for it
+func (c shellCapabilities) exportEnvCommand(tmpFile, exportFile string, scrubbed []string) string {
+	if c.exportP {
+		command := exportEnvCommand(tmpFile, exportFile, scrubbed)
+		if c.busybox {
+			// BusyBox sync takes no file before 1.30
+			command = strings.Replace(command, "sync $tmpfile", "sync", 1)
+		}
+		return command
+	}
+	return "(umask 077; : > " + exportFile + "); "
+}
+
+// Returns the arguments starting the build shell. zsh skips the rc files, or it may prompt for
+// its new user setup and hang the build.
+func (c shellCapabilities) startArgs() []string {
+	if c.zsh {
+		return []string{"-f"}
+	}
+	return nil
+}
+
+// Returns the setup command making the build shell work with the pty, if it needs one. The line
+// editor and prompt marks of zsh would mix escape sequences with the output of the steps.
+func (c shellCapabilities) setupCommand() string {
+	if c.zsh {
+		return "unsetopt zle prompt_cr prompt_sp"
+	}
+	return ""
+}
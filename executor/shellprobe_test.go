@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Writes a shell to dir that runs /bin/sh, but runs action instead for the scripts containing
+// unsupported
+func fakeShell(t *testing.T, dir, name, unsupported, action string) string {
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\ncase \"$2\" in *'" + unsupported + "'*) " + action + ";; esac\nexec /bin/sh \"$@\"\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestProbeShell(t *testing.T) {
+	for _, shellBin := range []string{"/bin/sh", "/bin/bash"} {
+		caps, err := probeShell(shellBin, nil)
+		if err != nil {
+			t.Errorf("probeShell(%s) = %v", shellBin, err)
+		}
+		if want := (shellCapabilities{abrtTrap: true, exportP: true}); caps != want {
+			t.Errorf("probeShell(%s) = %+v, want %+v", shellBin, caps, want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "shells")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caps, err := probeShell(fakeShell(t, dir, "noabrt", "ABRT", "exit 2"), nil)
+	if err != nil || caps.abrtTrap || !caps.exportP {
+		t.Errorf("probeShell() of a shell without trap ABRT = %+v, %v", caps, err)
+	}
+	if got := caps.finishSignals(); got != "EXIT" {
+		t.Errorf("finishSignals() = %s, want EXIT", got)
+	}
+
+	caps, err = probeShell(fakeShell(t, dir, "noexport", "export -p", "exit 2"), nil)
+	if err != nil || !caps.abrtTrap || caps.exportP {
+		t.Errorf("probeShell() of a shell without export -p = %+v, %v", caps, err)
+	}
+	if got := caps.exportEnvCommand("/tmp/env_tmp", "/tmp/env_export", []string{"SD_TOKEN"}); strings.Contains(got, "export -p") {
+		t.Errorf("exportEnvCommand() = %s, want no export -p", got)
+	}
+
+	dataFile := filepath.Join(dir, "data")
+	ioutil.WriteFile(dataFile, []byte("echo\n"), 0644)
+	for name, shellBin := range map[string]string{
+		"no trap":   fakeShell(t, dir, "notrap", "trap", "exit 2"),
+		"no set -e": fakeShell(t, dir, "noset", "set -e", `exec /bin/sh -c "${2#set -e;}"`),
+		"missing":   filepath.Join(dir, "missing"),
+		"relative":  "sh",
+		"directory": dir,
+		"data file": dataFile,
+	} {
+		if _, err := probeShell(shellBin, nil); err == nil {
+			t.Errorf("Expected an error for a shell with %s", name)
+		}
+	}
+}
+
+func TestRunWithoutExportP(t *testing.T) {
+	envFilepath := "/tmp/testWithoutExportP"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "shells")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "test", Cmd: "export FOO=bar"},
+			{Name: "teardown-check", Cmd: `test -z "$FOO"`},
+		},
+		Environment: []map[string]string{},
+	}
+	start := time.Now()
+	shellBin := fakeShell(t, dir, "noexport", "export -p", "exit 2")
+	if err := Run("", nil, &MockEmitter{}, testBuild, MockAPI{}, testBuild.ID, shellBin, TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > WaitTimeout*time.Second {
+		t.Errorf("The teardowns should not wait for the environment, the build took %v", elapsed)
+	}
+}
+
+func TestBusyBoxCompatibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shells")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, shellBin := range []string{
+		fakeShell(t, dir, "busybox", "sd_no_script", "exit 2"),
+		fakeShell(t, dir, "ash", "BB_ASH_VERSION", `BB_ASH_VERSION=1.36.1 exec /bin/sh "$@"`),
+	} {
+		caps, err := probeShell(shellBin, nil)
+		if err != nil || !caps.busybox {
+			t.Errorf("probeShell(%s) = %+v, %v, want BusyBox", shellBin, caps, err)
+		}
+	}
+
+	busybox := shellCapabilities{abrtTrap: true, exportP: true, busybox: true}
+	if got := busybox.exportEnvCommand("/tmp/env_tmp", "/tmp/env_export", []string{"SD_TOKEN"}); !strings.Contains(got, "(sync 2>/dev/null || true)") {
+		t.Errorf("exportEnvCommand() = %s, want a sync of everything", got)
+	}
+
+	var banner strings.Builder
+	defaultBanner, err := loadTimeoutBanner()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	handleBuildTimeout(&banner, defaultBanner.render(defaultBanner.data("test", Timeout{Timeout: time.Minute}, nil)), busybox)
+	lines := strings.Split(strings.TrimSuffix(banner.String(), "\n"), "\n")
+	if last := lines[len(lines)-1]; last != "exit" {
+		t.Errorf("The banner should end with exit, got %q", last)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if !strings.HasPrefix(line, "#") {
+			t.Errorf("The banner line %q should be a comment", line)
+		}
+	}
+}
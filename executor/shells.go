@@ -0,0 +1,42 @@
+package executor
+
+import (
+	"path/filepath"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// posixShell runs the build when the shell picked for it is not a POSIX shell
+const posixShell = "/bin/sh"
+
+// Returns whether shellBin is fish, which is no POSIX shell: the build shell cannot source its
+// scripts nor can it run the setup commands
+func isFish(shellBin string) bool {
+	return filepath.Base(shellBin) == "fish"
+}
+
+// Returns commands with the steps without a shell of their own run by shell
+func withStepShell(commands []screwdriver.CommandDef, shell string) []screwdriver.CommandDef {
+	withShell := make([]screwdriver.CommandDef, len(commands))
+	for i, cmd := range commands {
+		if cmd.Shell == "" {
+			cmd.Shell = shell
+		}
+		withShell[i] = cmd
+	}
+	return withShell
+}
+
+// Returns the shell running the teardown command of cmd with shellBin as the build shell, and
+// the command it runs after setting up the environment. fish cannot source the export file, so
+// the POSIX shell does and then runs fish with the command.
+func teardownShell(cmd screwdriver.CommandDef, shellBin string) (string, string) {
+	shell := stepShell(cmd, shellBin)
+	if !isFish(shell) {
+		return shell, cmd.Cmd
+	}
+	if isFish(shellBin) {
+		shellBin = posixShell
+	}
+	return shellBin, "exec " + shell + " -c " + shellQuote(cmd.Cmd)
+}
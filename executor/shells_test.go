@@ -0,0 +1,136 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestTeardownShell(t *testing.T) {
+	tests := []struct {
+		cmd             screwdriver.CommandDef
+		shellBin        string
+		wantShell, want string
+	}{
+		{screwdriver.CommandDef{Cmd: "make clean"}, "/bin/bash", "/bin/bash", "make clean"},
+		{screwdriver.CommandDef{Cmd: "make clean", Shell: "/bin/zsh"}, "/bin/sh", "/bin/zsh", "make clean"},
+		{screwdriver.CommandDef{Cmd: "echo 'done'", Shell: "/usr/bin/fish"}, "/bin/bash", "/bin/bash", `exec /usr/bin/fish -c 'echo '\''done'\'''`},
+		{screwdriver.CommandDef{Cmd: "make clean"}, "/usr/bin/fish", posixShell, "exec /usr/bin/fish -c 'make clean'"},
+	}
+	for _, test := range tests {
+		if shell, run := teardownShell(test.cmd, test.shellBin); shell != test.wantShell || run != test.want {
+			t.Errorf("teardownShell(%+v, %s) = %s, %s, want %s, %s", test.cmd, test.shellBin, shell, run, test.wantShell, test.want)
+		}
+	}
+}
+
+func TestStepScriptHeaderFish(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Env: map[string]string{"GO": "1.12"}}
+	if got, want := stepScriptHeader(cmd, "/usr/bin/fish", ""), "#!/usr/bin/fish\nexport GO='1.12'\n"; got != want {
+		t.Errorf("stepScriptHeader() = %q, want %q", got, want)
+	}
+}
+
+func TestProbeZsh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shells")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caps, err := probeShell(fakeShell(t, dir, "zsh", "ZSH_VERSION", `ZSH_VERSION=5.9 exec /bin/sh "$@"`), nil)
+	if err != nil || !caps.zsh {
+		t.Fatalf("probeShell() = %+v, %v, want zsh", caps, err)
+	}
+	if !reflect.DeepEqual(caps.startArgs(), []string{"-f"}) || caps.setupCommand() == "" {
+		t.Errorf("zsh should start without its rc files and its line editor: %v, %q", caps.startArgs(), caps.setupCommand())
+	}
+}
+
+// Runs a build with shellBin whose first step exports a variable the next steps print, and
+// returns the exit codes of the steps and the output of the build
+func runShellBuild(t *testing.T, shellBin, envFilepath string) (map[string]int, string) {
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "export", Cmd: "export FOO=bar"},
+			{Name: "echo", Cmd: `echo "foo is $FOO"`},
+			{Name: "teardown-echo", Cmd: `echo "teardown after $SD_STEP_EXIT_CODE"`},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, shellBin, TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error with %s: %v", shellBin, err)
+	}
+	return codes, string(emitter.found)
+}
+
+func TestRunFishMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shells")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fish := filepath.Join(dir, "fish")
+	ioutil.WriteFile(fish, []byte("#!/bin/sh\nexec /bin/sh \"$@\"\n"), 0755)
+
+	codes, output := runShellBuild(t, fish, "/tmp/testFishMode")
+	if want := map[string]int{"export": 0, "echo": 0, "teardown-echo": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	if script := strings.Join(ReadCommand(stepScriptPath("/tmp/testFishMode_steps", 0, "export")), "\n"); !strings.HasPrefix(script, "#!"+fish+"\n") {
+		t.Errorf("The steps should be fish scripts: %q", script)
+	}
+	// Every step runs in its own fish, so the variables it exports are gone in the next one
+	for _, want := range []string{"\nfoo is \n", "\nteardown after 0\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("The output should contain %q, got %q", want, output)
+		}
+	}
+}
+
+// TestRunZshAndFish runs builds with the zsh and fish installed, which CI has. Set
+// SD_REQUIRE_SHELLS to fail rather than skip the shells that are missing.
+func TestRunZshAndFish(t *testing.T) {
+	for name, echoed := range map[string]string{
+		// zsh sources the steps like the other POSIX shells
+		"zsh": "\nfoo is bar\n",
+		// fish runs every step in its own fish
+		"fish": "\nfoo is \n",
+	} {
+		name, echoed := name, echoed
+		t.Run(name, func(t *testing.T) {
+			shellBin, err := exec.LookPath(name)
+			if err != nil {
+				if os.Getenv("SD_REQUIRE_SHELLS") != "" {
+					t.Fatalf("%s is not installed", name)
+				}
+				t.Skipf("%s is not installed", name)
+			}
+			codes, output := runShellBuild(t, shellBin, "/tmp/testShell_"+name)
+			if want := map[string]int{"export": 0, "echo": 0, "teardown-echo": 0}; !reflect.DeepEqual(codes, want) {
+				t.Errorf("Unexpected exit codes with %s %v, want %v", name, codes, want)
+			}
+			for _, want := range []string{echoed, "\nteardown after 0\n"} {
+				if !strings.Contains(output, want) {
+					t.Errorf("The output with %s should contain %q, got %q", name, want, output)
+				}
+			}
+		})
+	}
+}
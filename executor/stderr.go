@@ -0,0 +1,168 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// stderrCapture steps have their standard error logged apart from their output
+	stderrCapture = "capture"
+	// stderrFail steps also fail if they wrote anything to their standard error
+	stderrFail = "fail"
+)
+
+// Returns an error if the standard error of the step of cmd cannot be captured: an unknown value,
+// a teardown, which does not run in the build shell, or a step in a container, whose standard
+// error the container runtime merges with its output
+func checkStderr(cmd screwdriver.CommandDef, stepType string) error {
+	switch cmd.Stderr {
+	case "":
+		return nil
+	case stderrCapture, stderrFail:
+	default:
+		return fmt.Errorf("Unknown standard error option %q of step %q, want %s or %s", cmd.Stderr, cmd.Name, stderrCapture, stderrFail)
+	}
+	if stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown {
+		return fmt.Errorf("Teardown %q cannot capture its standard error", cmd.Name)
+	}
+	if cmd.Image != "" || cmd.Container != "" {
+		return fmt.Errorf("Step %q in a container cannot capture its standard error", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the path of the pipe the standard error of the step with name, the index-th step of the
+// build, goes to in the directory of the step scripts scriptDir
+func stderrPipePath(scriptDir string, index int, name string) string {
+	return filepath.Join(scriptDir, fmt.Sprintf("%d-%s.stderr", index, unsafeNameChars.ReplaceAllString(name, "_")))
+}
+
+// Returns the redirection of the standard error of a step to the pipe at path, or "" without one.
+// It is not a terminal for the step then, unlike its standard output.
+func stderrRedirect(path string) string {
+	if path == "" {
+		return ""
+	}
+	return " 2>" + shellQuote(path)
+}
+
+// outputScanner is an emitter wrapping another one to scan the output of the steps, e.g. for the
+// failure summary
+type outputScanner interface {
+	scanOutput(p []byte)
+	Unwrap() screwdriver.Emitter
+}
+
+// Returns the writer of the standard error stream of the emitter under the output scanners
+// wrapping it in emitter, and those scanners, or nil if it does not log the standard error apart
+func stderrStream(emitter screwdriver.Emitter) (io.WriteCloser, []outputScanner) {
+	return scannedStream(emitter, func(e screwdriver.Emitter) io.WriteCloser {
+		if e, ok := e.(screwdriver.StderrEmitter); ok {
+			return e.Stderr()
+		}
+		return nil
+	})
+}
+
+// Returns the writer open returns of the emitter under the output scanners wrapping it in emitter,
+// and those scanners, or nil if open returns nil for it
+func scannedStream(emitter screwdriver.Emitter, open func(screwdriver.Emitter) io.WriteCloser) (io.WriteCloser, []outputScanner) {
+	var scanners []outputScanner
+	for {
+		if w := open(emitter); w != nil {
+			return w, scanners
+		}
+		scanner, ok := emitter.(outputScanner)
+		if !ok {
+			return nil, nil
+		}
+		scanners = append(scanners, scanner)
+		emitter = scanner.Unwrap()
+	}
+}
+
+// scannedWriter has the output scanners scan what is written to it before writing it to w
+type scannedWriter struct {
+	scanners []outputScanner
+	w        io.Writer
+}
+
+func (s scannedWriter) Write(p []byte) (int, error) {
+	for _, scanner := range s.scanners {
+		scanner.scanOutput(p)
+	}
+	return s.w.Write(p)
+}
+
+// stepStderr logs what a step writes to its standard error, through a named pipe, as lines of the
+// standard error stream of the emitter
+type stepStderr struct {
+	path   string
+	r, w   *os.File
+	out    io.Writer
+	closer io.Closer
+	done   chan struct{}
+	bytes  int64
+}
+
+// Creates the named pipe at path for the standard error of a step and logs what is written to it
+// to emitter, tagged as standard error if it can
+func captureStderr(path string, emitter screwdriver.Emitter) (*stepStderr, error) {
+	os.Remove(path)
+	if err := unix.Mkfifo(path, 0600); err != nil {
+		return nil, err
+	}
+	// The launcher holds the pipe open for writing until stop, so it does not end when the step
+	// has yet to open it, nor in between its commands
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	s := &stepStderr{path: path, r: r, w: w, out: emitter, done: make(chan struct{})}
+	if stderr, scanners := stderrStream(emitter); stderr != nil {
+		s.out, s.closer = scannedWriter{scanners, stderr}, stderr
+	}
+	go func() {
+		defer close(s.done)
+		s.bytes, _ = io.Copy(s.out, s.r)
+	}()
+	return s, nil
+}
+
+// Ends the capture once the step is done and returns how many bytes it wrote to its standard error.
+// The processes the step left running get WaitTimeout seconds to close it.
+func (s *stepStderr) stop() int64 {
+	if s == nil {
+		return 0
+	}
+	s.w.Close()
+	select {
+	case <-s.done:
+	case <-time.After(WaitTimeout * time.Second):
+		logger.Warnf("The standard error of the step is still open %d seconds after it ended, closing it", WaitTimeout)
+		s.r.Close()
+		<-s.done
+	}
+	s.r.Close()
+	if s.closer != nil {
+		s.closer.Close()
+	}
+	os.Remove(s.path)
+	return s.bytes
+}
@@ -0,0 +1,156 @@
+package executor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCheckStderr(t *testing.T) {
+	tests := []struct {
+		cmd      screwdriver.CommandDef
+		stepType string
+		err      bool
+	}{
+		{screwdriver.CommandDef{Name: "test"}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "test", Stderr: "capture"}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "test", Stderr: "fail"}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "test", Stderr: "ignore"}, screwdriver.StepTypeUser, true},
+		{screwdriver.CommandDef{Name: "teardown-test", Stderr: "capture"}, screwdriver.StepTypeTeardown, true},
+		{screwdriver.CommandDef{Name: "test", Stderr: "capture", Image: "node:14"}, screwdriver.StepTypeUser, true},
+	}
+	for _, test := range tests {
+		if err := checkStderr(test.cmd, test.stepType); (err != nil) != test.err {
+			t.Errorf("checkStderr(%+v, %s) = %v, want error %v", test.cmd, test.stepType, err, test.err)
+		}
+	}
+}
+
+func TestStepCommandStderr(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Stderr: "capture"}
+	line := stepCommand("guid", "/tmp/step.sh", stepStreams{err: "/tmp/0-test.stderr"}, cmd, "/bin/sh", "", nil)
+	if !strings.Contains(line, ". /tmp/step.sh 2>'/tmp/0-test.stderr' ;") {
+		t.Errorf("The standard error should go to the pipe: %q", line)
+	}
+	cmd.Retries = 1
+	line = stepCommand("guid", "/tmp/step.sh", stepStreams{out: "/tmp/out", err: "/tmp/0-test.stderr"}, cmd, "/bin/sh", "", nil)
+	if !strings.Contains(line, "( set -e; . /tmp/step.sh ) >'/tmp/out' 2>'/tmp/0-test.stderr';") {
+		t.Errorf("The output and standard error of the attempts should be redirected: %q", line)
+	}
+}
+
+func TestRunCapturesStderr(t *testing.T) {
+	envFilepath := "/tmp/testCaptureStderr"
+	setupTestCase(t, envFilepath)
+
+	tests := []struct {
+		name  string
+		steps []screwdriver.CommandDef
+		codes map[string]int
+		log   []string
+		err   error
+	}{
+		{
+			name: "capture",
+			steps: []screwdriver.CommandDef{
+				{Name: "warn", Cmd: "echo output; [ -t 2 ] || echo 'not a terminal' >&2", Stderr: "capture"},
+				{Name: "strict", Cmd: "echo fine", Stderr: "fail"},
+			},
+			codes: map[string]int{"warn": 0, "strict": 0},
+			log:   []string{"output\n", "not a terminal\n", "fine\n"},
+		},
+		{
+			name: "fail",
+			steps: []screwdriver.CommandDef{
+				{Name: "strict", Cmd: "echo deprecated >&2", Stderr: "fail"},
+				{Name: "next", Cmd: "echo next"},
+			},
+			codes: map[string]int{"strict": ExitStderr},
+			log:   []string{"deprecated\n", launcherText("Step wrote 11 bytes to its standard error\n", colorLauncherText())},
+			err:   WroteStderr{"strict", 11},
+		},
+		{
+			name: "allowed failure",
+			steps: []screwdriver.CommandDef{
+				{Name: "strict", Cmd: "echo deprecated >&2", Stderr: "fail", AllowFailure: true},
+				{Name: "next", Cmd: "echo next"},
+			},
+			codes: map[string]int{"strict": ExitStderr, "next": 0},
+			log:   []string{launcherText("Step wrote 11 bytes to its standard error, which does not fail the build\n", colorLauncherText()), "next\n"},
+		},
+	}
+	for _, test := range tests {
+		testBuild := screwdriver.Build{ID: 12345, Commands: test.steps, Environment: []map[string]string{}}
+		codes := map[string]int{}
+		testAPI := screwdriver.API(MockAPI{
+			updateStepStop: func(buildID int, stepName string, code int) error {
+				codes[stepName] = code
+				return nil
+			},
+		})
+		emitter := &MockEmitter{}
+		err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+		if test.err == nil && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.err != nil && !errors.Is(err, ErrStepFailed) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+		if test.err != nil && err != nil && err.Error() != test.err.Error() {
+			t.Errorf("%s: error %q, want %q", test.name, err, test.err)
+		}
+		if !reflect.DeepEqual(codes, test.codes) {
+			t.Errorf("%s: step codes %v, want %v", test.name, codes, test.codes)
+		}
+		for _, line := range test.log {
+			if !strings.Contains(string(emitter.found), line) {
+				t.Errorf("%s: the log should have %q: %q", test.name, line, emitter.found)
+			}
+		}
+	}
+}
+
+// stderrEmitter is a MockEmitter logging the standard error apart
+type stderrEmitter struct {
+	MockEmitter
+	stderr bytes.Buffer
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (e *stderrEmitter) Stderr() io.WriteCloser {
+	return nopWriteCloser{&e.stderr}
+}
+
+func TestStderrStream(t *testing.T) {
+	base := &stderrEmitter{}
+	summarizer := newFailureSummarizer(newFailureClassifier(base, nil), 5)
+	stderr, scanners := stderrStream(summarizer)
+	if stderr == nil || len(scanners) != 2 {
+		t.Fatalf("stderrStream() = %v, %d scanners, want the standard error of the emitter under 2 scanners", stderr, len(scanners))
+	}
+
+	summarizer.StartCmd(screwdriver.CommandDef{Name: "test"})
+	scannedWriter{scanners, stderr}.Write([]byte("deprecated\n"))
+	if base.stderr.String() != "deprecated\n" || len(base.found) != 0 {
+		t.Errorf("The standard error should be logged apart: %q, output %q", base.stderr.String(), base.found)
+	}
+	if lines := summarizer.steps["test"].lines; !reflect.DeepEqual(lines, []string{"deprecated"}) {
+		t.Errorf("The failure summary should have the standard error: %q", lines)
+	}
+
+	if stderr, _ := stderrStream(newFailureSummarizer(&MockEmitter{}, 5)); stderr != nil {
+		t.Errorf("An emitter without a standard error stream should have none")
+	}
+}
@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// exitStdinNotFound is the exit code of a step whose standard input file is missing, like the
+// shell's for a failed redirection
+const exitStdinNotFound = 1
+
+// Returns an error if the standard input of the step of cmd is invalid: both a file and a text, a
+// file out of the source directory, or a step in a container, which gets none
+func checkStdin(cmd screwdriver.CommandDef) error {
+	if cmd.StdinFile == "" && cmd.Stdin == "" {
+		return nil
+	}
+	if cmd.StdinFile != "" && cmd.Stdin != "" {
+		return fmt.Errorf("Step %q has both a standard input file and a standard input", cmd.Name)
+	}
+	if cmd.StdinFile != "" {
+		clean := filepath.Clean(cmd.StdinFile)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("Invalid standard input file %q of step %q, want a path in the source directory", cmd.StdinFile, cmd.Name)
+		}
+	}
+	if cmd.Image != "" || cmd.Container != "" {
+		return fmt.Errorf("Step %q in a container cannot have a standard input", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the path of the standard input file of the step of cmd in the source directory, or ""
+// without one. The file is checked right before the step, as the steps before it check out the
+// source or write it. If it is missing, this returns the exit code and error the step fails with.
+func resolveStdinFile(cmd screwdriver.CommandDef, sourceDir string) (string, int, error) {
+	if cmd.StdinFile == "" {
+		return "", ExitOk, nil
+	}
+	path := filepath.Join(sourceDir, filepath.Clean(cmd.StdinFile))
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", exitStdinNotFound, fmt.Errorf("Standard input file %s not found: %v", cmd.StdinFile, err)
+	}
+	if info.IsDir() {
+		return "", exitStdinNotFound, fmt.Errorf("Standard input file %s is a directory", cmd.StdinFile)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path, ExitOk, nil
+}
+
+// Returns the path of the file with the standard input text of the step with name, the index-th
+// step of the build, in the directory of the step scripts scriptDir
+func stdinTextPath(scriptDir string, index int, name string) string {
+	return filepath.Join(scriptDir, fmt.Sprintf("%d-%s.stdin", index, unsafeNameChars.ReplaceAllString(name, "_")))
+}
+
+// Returns the path of the file the step of cmd reads as its standard input, or "" without one:
+// its file in the source directory at path if not empty, or the file at textPath its text is
+// written to
+func writeStdin(cmd screwdriver.CommandDef, path, textPath string) (string, error) {
+	if path != "" || cmd.Stdin == "" {
+		return path, nil
+	}
+	if err := ioutil.WriteFile(textPath, []byte(cmd.Stdin), 0600); err != nil {
+		return "", err
+	}
+	return textPath, nil
+}
+
+// Returns the redirection of the standard input of a step from the file at path, or "" without one.
+// The step does not read the pty then.
+func stdinRedirect(path string) string {
+	if path == "" {
+		return ""
+	}
+	return " <" + shellQuote(path)
+}
+
+// Returns the standard input of the teardown of cmd run in sourceDir, nil without one, and the
+// file to close once it is done if any
+func teardownStdin(cmd screwdriver.CommandDef, sourceDir string) (io.Reader, io.Closer, error) {
+	if cmd.Stdin != "" {
+		return strings.NewReader(cmd.Stdin), nil, nil
+	}
+	path, _, err := resolveStdinFile(cmd, sourceDir)
+	if err != nil || path == "" {
+		return nil, nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCheckStdin(t *testing.T) {
+	tests := []struct {
+		cmd screwdriver.CommandDef
+		err bool
+	}{
+		{screwdriver.CommandDef{Name: "test"}, false},
+		{screwdriver.CommandDef{Name: "test", Stdin: "yes\n"}, false},
+		{screwdriver.CommandDef{Name: "test", StdinFile: "fixtures/answers.txt"}, false},
+		{screwdriver.CommandDef{Name: "test", Stdin: "yes\n", StdinFile: "answers.txt"}, true},
+		{screwdriver.CommandDef{Name: "test", StdinFile: "/etc/passwd"}, true},
+		{screwdriver.CommandDef{Name: "test", StdinFile: "../answers.txt"}, true},
+		{screwdriver.CommandDef{Name: "test", Stdin: "yes\n", Image: "node:14"}, true},
+	}
+	for _, test := range tests {
+		if err := checkStdin(test.cmd); (err != nil) != test.err {
+			t.Errorf("checkStdin(%+v) = %v, want error %v", test.cmd, err, test.err)
+		}
+	}
+}
+
+func TestStepCommandStdin(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Stdin: "yes\n"}
+	line := stepCommand("guid", "/tmp/step.sh", stepStreams{in: "/tmp/0-test.stdin"}, cmd, "/bin/sh", "", nil)
+	if !strings.Contains(line, ". /tmp/step.sh <'/tmp/0-test.stdin' ;") {
+		t.Errorf("The standard input should come from the file: %q", line)
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	envFilepath := "/tmp/testStdin"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "answers.txt"), []byte("a\nb\nc\n"), 0644)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "text", Cmd: `read name; echo "hello $name"`, Stdin: "world\n"},
+			{Name: "file", Cmd: `echo "$(wc -l) answers"`, StdinFile: "answers.txt"},
+			{Name: "apart", Cmd: `read name; echo "hi $name"`, Stdin: "there\n", Retries: 1},
+			{Name: "missing", Cmd: "cat", StdinFile: "missing.txt"},
+			{Name: "never", Cmd: "echo never"},
+			{Name: "teardown-read", Cmd: `read name; echo "bye $name"`, Stdin: "everyone\n"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+
+	err = Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, dir)
+	if want := (StepFailure{Step: "missing", Code: exitStdinNotFound}); err != want {
+		t.Errorf("Unexpected error: %v, want %v", err, want)
+	}
+	if want := map[string]int{"text": 0, "file": 0, "apart": 0, "missing": exitStdinNotFound, "teardown-read": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Step codes %v, want %v", codes, want)
+	}
+	for _, line := range []string{"hello world\n", "3 answers\n", "hi there\n", "Standard input file missing.txt not found", "bye everyone\n"} {
+		if !strings.Contains(string(emitter.found), line) {
+			t.Errorf("The log should have %q: %q", line, emitter.found)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultStepPathAppend are the directories of the Screwdriver tools, which the PATH of the steps
+// ends with
+const defaultStepPathAppend = "/opt/sd:/usr/sd/bin"
+
+// stepPathDirs are absolute directories separated by colons, with no character the shell would
+// expand
+var stepPathDirs = regexp.MustCompile(`^/[A-Za-z0-9_./@+-]*(:/[A-Za-z0-9_./@+-]*)*$`)
+
+// stepPath are the directories the launcher adds to the PATH of the steps and the teardowns,
+// separated by colons: prepend before the PATH of the build, and append after it
+type stepPath struct {
+	prepend, append string
+}
+
+// Reads the directories added to the PATH of the steps from the launcher environment:
+// SD_STEP_PATH_PREPEND, none by default, and SD_STEP_PATH_APPEND, the directories of the
+// Screwdriver tools by default
+func loadStepPath() (stepPath, error) {
+	p := stepPath{append: defaultStepPathAppend}
+	for _, setting := range []struct {
+		name  string
+		value *string
+	}{
+		{"SD_STEP_PATH_PREPEND", &p.prepend},
+		{"SD_STEP_PATH_APPEND", &p.append},
+	} {
+		value := strings.TrimSpace(os.Getenv(setting.name))
+		if value == "" {
+			continue
+		}
+		if !stepPathDirs.MatchString(value) {
+			return stepPath{}, fmt.Errorf("Invalid %s %q, want absolute directories separated by colons", setting.name, value)
+		}
+		*setting.value = value
+	}
+	return p, nil
+}
+
+// Returns the value of PATH for the steps in the shell, from the PATH of the build
+func (p stepPath) value() string {
+	path := "${PATH}"
+	if p.prepend != "" {
+		path = p.prepend + ":" + path
+	}
+	if p.append != "" {
+		path += ":" + p.append
+	}
+	return path
+}
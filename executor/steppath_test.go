@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadStepPath(t *testing.T) {
+	defer os.Setenv("SD_STEP_PATH_PREPEND", os.Getenv("SD_STEP_PATH_PREPEND"))
+	defer os.Setenv("SD_STEP_PATH_APPEND", os.Getenv("SD_STEP_PATH_APPEND"))
+
+	tests := []struct {
+		prepend, append *string
+		want            string
+		err             bool
+	}{
+		{want: "${PATH}:/opt/sd:/usr/sd/bin"},
+		{prepend: strPtr("/opt/tools/bin"), want: "/opt/tools/bin:${PATH}:/opt/sd:/usr/sd/bin"},
+		{prepend: strPtr(" /a:/b "), append: strPtr("/opt/sd"), want: "/a:/b:${PATH}:/opt/sd"},
+		{append: strPtr(""), want: "${PATH}:/opt/sd:/usr/sd/bin"},
+		{append: strPtr("bin"), err: true},
+		{append: strPtr("/opt/sd:"), err: true},
+		{prepend: strPtr("/opt/$(whoami)"), err: true},
+		{prepend: strPtr("/opt/my tools"), err: true},
+	}
+	for _, test := range tests {
+		os.Unsetenv("SD_STEP_PATH_PREPEND")
+		os.Unsetenv("SD_STEP_PATH_APPEND")
+		if test.prepend != nil {
+			os.Setenv("SD_STEP_PATH_PREPEND", *test.prepend)
+		}
+		if test.append != nil {
+			os.Setenv("SD_STEP_PATH_APPEND", *test.append)
+		}
+		p, err := loadStepPath()
+		if (err != nil) != test.err {
+			t.Errorf("loadStepPath() with %+v: unexpected error %v", test, err)
+			continue
+		}
+		if err == nil && p.value() != test.want {
+			t.Errorf("loadStepPath() with %+v = %q, want %q", test, p.value(), test.want)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestRunAddsStepPath(t *testing.T) {
+	defer os.Setenv("SD_STEP_PATH_PREPEND", os.Getenv("SD_STEP_PATH_PREPEND"))
+	tools, err := ioutil.TempDir("", "tools")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tools)
+	if err := ioutil.WriteFile(filepath.Join(tools, "sd-greet"), []byte("#!/bin/sh\necho \"hello from $1\"\n"), 0755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.Setenv("SD_STEP_PATH_PREPEND", tools)
+
+	envFilepath := "/tmp/testStepPath"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "greet", Cmd: "sd-greet step"},
+			{Name: "teardown-greet", Cmd: "sd-greet teardown"},
+		},
+		Environment: []map[string]string{},
+	}
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, want := range []string{"hello from step\n", "hello from teardown\n"} {
+		if !strings.Contains(string(emitter.found), want) {
+			t.Errorf("The tools of SD_STEP_PATH_PREPEND should be on the PATH, want %q in %q", want, emitter.found)
+		}
+	}
+	assert.Contains(t, string(emitter.found), "export PATH="+tools+":${PATH}:/opt/sd:/usr/sd/bin")
+}
@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Returns whether the step of cmd runs apart from the build shell: in a subshell, in its own
+// shell, interpreter or container, as another user or with another priority. Its failure does not
+// end the build shell, so it can be retried or allowed to fail, but the variables it exports do not
+// reach the next steps, nor do its own.
+func runsApart(cmd screwdriver.CommandDef) bool {
+	return cmd.Retries > 0 || cmd.AllowFailure || cmd.Shell != "" || cmd.Interpreter != "" ||
+		cmd.Image != "" || cmd.Container != "" || cmd.User != "" || len(cmd.Env) > 0 ||
+		cmd.Nice != 0 || cmd.IONice != ""
+}
+
+// Returns the shell of the script of the step of cmd. The build shell may not be in a step
+// container, which runs the POSIX shell.
+func stepShell(cmd screwdriver.CommandDef, shellBin string) string {
+	if cmd.Shell != "" {
+		return cmd.Shell
+	}
+	if cmd.Image != "" || cmd.Container != "" {
+		return posixShell
+	}
+	return shellBin
+}
+
+// stepStreams are the files the standard input, output and error of a step are redirected to
+// instead of the pty, if not empty
+type stepStreams struct {
+	in, out, err string
+}
+
+// Returns the redirections of the streams of the step
+func (s stepStreams) redirect() string {
+	return stdinRedirect(s.in) + rawOutputRedirect(s.out) + stderrRedirect(s.err)
+}
+
+// Returns the line the build shell runs for the step script at path of cmd, in a container of
+// containers if it has an image, echoing guid and the exit code once it is done, followed for a
+// step running apart by the number of times it was retried. The streams of the step are
+// redirected to their files, and its TMPDIR is tmpDir if not empty. The guid is never followed by
+// a number in the line itself, the pty echoes it back.
+func stepCommand(guid, path string, streams stepStreams, cmd screwdriver.CommandDef, shellBin, tmpDir string, containers *stepContainers) string {
+	redirect := streams.redirect()
+	if !runsApart(cmd) {
+		return "export SD_STEP_ID=" + guid + " ;" + setTmpDir(tmpDir) + ". " + path + redirect + " ;" + restoreTmpDir(tmpDir) + "echo ;echo " + guid + " $?\n"
+	}
+
+	run := "( set -e; . " + path + " )"
+	if cmd.Image != "" || cmd.Container != "" {
+		run = containers.command(guid, path, cmd)
+	} else if cmd.User != "" {
+		run = "su -m -s " + shellBin + " " + shellQuote(cmd.User) + " -c " + path
+	} else if cmd.Shell != "" || priorityCommand(cmd) != "" {
+		run = path
+	}
+	run = priorityCommand(cmd) + run + redirect
+	retries := strconv.Itoa(cmd.Retries)
+	return "export SD_STEP_ID=" + guid + " ;set +e; " + setTmpDir(tmpDir) + "sd_attempt=0; while :; do " + run + "; sd_code=$?; " +
+		"if [ $sd_code -eq 0 ] || [ $sd_attempt -ge " + retries + " ]; then break; fi; sd_attempt=$((sd_attempt+1)); " +
+		"echo \"Exit code $sd_code, retrying ($sd_attempt of " + retries + ")\"; done; " + restoreTmpDir(tmpDir) + "set -e ;echo ;echo " + guid + " $sd_code $sd_attempt\n"
+}
+
+// Returns the line the build shell runs to check condition, echoing guid and 0 if it succeeds
+func conditionCommand(guid, condition string) string {
+	return "export SD_STEP_ID=" + guid + " ;if eval " + shellQuote(condition) + "; then sd_met=0; else sd_met=1; fi ;echo " + guid + " $sd_met\n"
+}
+
+// Returns s single quoted for the shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Gives the step script at path to the user the step of cmd runs as, if any, so it can run it
+func chownStepFile(path string, cmd screwdriver.CommandDef) error {
+	if cmd.User == "" {
+		return nil
+	}
+	uid, gid, err := lookupUser(cmd.User)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// Creates the directory of the step scripts of a build at dir, removing the scripts of a previous
+// build. The users the steps run as can run their own script but not list the others.
+func makeStepScriptDir(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0711); err != nil {
+		return err
+	}
+	// Mkdir applies the umask
+	return os.Chmod(dir, 0711)
+}
+
+// Returns the path of the script of the step with name, the index-th step of the build, in dir
+func stepScriptPath(dir string, index int, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d-%s.sh", index, unsafeNameChars.ReplaceAllString(name, "_")))
+}
+
+// Returns the uid and gid of the user name
+func lookupUser(name string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid uid %q of user %q", u.Uid, name)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid gid %q of user %q", u.Gid, name)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,145 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestRunsApart(t *testing.T) {
+	tests := []struct {
+		cmd  screwdriver.CommandDef
+		want bool
+	}{
+		{screwdriver.CommandDef{Name: "test"}, false},
+		{screwdriver.CommandDef{Name: "test", Timeout: 10, Condition: "true"}, false},
+		{screwdriver.CommandDef{Name: "test", Retries: 2}, true},
+		{screwdriver.CommandDef{Name: "test", AllowFailure: true}, true},
+		{screwdriver.CommandDef{Name: "test", Shell: "/bin/bash"}, true},
+		{screwdriver.CommandDef{Name: "test", Interpreter: "python3"}, true},
+		{screwdriver.CommandDef{Name: "test", User: "nobody"}, true},
+		{screwdriver.CommandDef{Name: "test", Nice: 5}, true},
+		{screwdriver.CommandDef{Name: "test", IONice: "idle"}, true},
+	}
+	for _, test := range tests {
+		if got := runsApart(test.cmd); got != test.want {
+			t.Errorf("runsApart(%+v) = %v, want %v", test.cmd, got, test.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote(`[ "$A" = 'b' ]`), `'[ "$A" = '\''b'\'' ]'`; got != want {
+		t.Errorf("shellQuote() = %s, want %s", got, want)
+	}
+}
+
+func TestStepScriptDir(t *testing.T) {
+	dir := "/tmp/testStepScriptDir_steps"
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir, 0777)
+	ioutil.WriteFile(stepScriptPath(dir, 0, "old"), []byte("echo old\n"), 0644)
+
+	if err := makeStepScriptDir(dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0711 {
+		t.Errorf("The step script directory should not be listable by other users: %v, %v", info, err)
+	}
+	if _, err := os.Stat(stepScriptPath(dir, 0, "old")); !os.IsNotExist(err) {
+		t.Errorf("The scripts of a previous build should be removed: %v", err)
+	}
+	if got, want := stepScriptPath(dir, 3, "test ../x"), dir+"/3-test_.._x.sh"; got != want {
+		t.Errorf("stepScriptPath() = %s, want %s", got, want)
+	}
+}
+
+func TestRunHonorsStepAnnotations(t *testing.T) {
+	envFilepath := "/tmp/testStepAnnotations"
+	setupTestCase(t, envFilepath)
+	counter := "/tmp/testStepAnnotations.count"
+	os.Remove(counter)
+	defer os.Remove(counter)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "export STAGE=test", Name: "init"},
+			{Cmd: "echo deploying", Name: "deploy", Condition: `[ "$STAGE" = prod ]`},
+			{Cmd: "echo x >> " + counter + "; test $(wc -l < " + counter + ") -ge 3", Name: "flaky", Retries: 2},
+			{Cmd: "exit 4", Name: "optional", AllowFailure: true},
+			{Cmd: `[[ "$STAGE" == te* ]]`, Name: "bash", Shell: "/bin/bash"},
+			{Cmd: "test $(id -un) = nobody", Name: "unprivileged", User: "nobody"},
+			{Cmd: `test "$SD_STEP_EXIT_CODE" = 0`, Name: "teardown-check"},
+			{Cmd: "exit 5", Name: "teardown-optional", AllowFailure: true},
+		},
+		Environment: []map[string]string{},
+	}
+	if os.Geteuid() != 0 {
+		testBuild.Commands = append(testBuild.Commands[:5], testBuild.Commands[6:]...)
+	}
+
+	codes := map[string]int{}
+	details := map[string]screwdriver.StepStopDetails{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+		stepStopDetails: func(stepName string, d screwdriver.StepStopDetails) {
+			details[stepName] = d
+		},
+	})
+
+	if err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v, exit codes %v", err, codes)
+	}
+
+	wantCodes := map[string]int{"init": 0, "deploy": 0, "flaky": 0, "optional": 4, "bash": 0, "unprivileged": 0, "teardown-check": 0, "teardown-optional": 5}
+	if os.Geteuid() != 0 {
+		delete(wantCodes, "unprivileged")
+	}
+	if !reflect.DeepEqual(codes, wantCodes) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, wantCodes)
+	}
+	if !details["deploy"].Skipped || !details["optional"].AllowedFailure || !details["teardown-optional"].AllowedFailure {
+		t.Errorf("Unexpected step details %+v", details)
+	}
+}
+
+func TestRunStepTimeout(t *testing.T) {
+	envFilepath := "/tmp/testStepTimeout"
+	setupTestCase(t, envFilepath)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "sleep 30", Name: "slow", Timeout: 1},
+			{Cmd: "echo never", Name: "next"},
+		},
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+
+	start := time.Now()
+	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("The step should be killed at its timeout, the build took %v", elapsed)
+	}
+	if want := (StepTimeout{"slow", time.Second}); err != want {
+		t.Errorf("Unexpected error: %v, want %v", err, want)
+	}
+	if want := map[string]int{"slow": ExitTimeout}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+}
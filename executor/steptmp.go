@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// stepTmpDirs are the temporary directories of the steps of a build: each step gets a fresh one as
+// its TMPDIR, which is wiped once it is over, so the steps do not leave their temporary files to
+// the next ones and the disk space each takes is known. A nil stepTmpDirs gives the steps none.
+type stepTmpDirs struct {
+	root string
+}
+
+// Returns the directory of the temporary directories of the steps of the build with the
+// environment file envFilepath, in SD_STEP_TMP_DIR from the launcher environment or next to it
+func stepTmpRoot(envFilepath string) string {
+	name := filepath.Base(envFilepath) + "_tmp_steps"
+	if dir := strings.TrimSpace(os.Getenv("SD_STEP_TMP_DIR")); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(filepath.Dir(envFilepath), name)
+}
+
+// Creates the directory root of the temporary directories of the steps, removing the ones of a
+// previous build. The users the steps run as can get into their own directory but not list the
+// others.
+func newStepTmpDirs(root string) (*stepTmpDirs, error) {
+	if err := os.RemoveAll(root); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0711); err != nil {
+		return nil, err
+	}
+	// MkdirAll applies the umask
+	if err := os.Chmod(root, 0711); err != nil {
+		return nil, err
+	}
+	return &stepTmpDirs{root: root}, nil
+}
+
+// Creates the temporary directory of the step of cmd, owned by the user it runs as, or returns ""
+// if it gets none: it runs in a container, which has its own
+func (d *stepTmpDirs) create(cmd screwdriver.CommandDef) (string, error) {
+	if d == nil || cmd.Image != "" || cmd.Container != "" {
+		return "", nil
+	}
+	dir, err := ioutil.TempDir(d.root, unsafeNameChars.ReplaceAllString(cmd.Name, "_")+"-")
+	if err != nil {
+		return "", err
+	}
+	if err := chownStepFile(dir, cmd); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Wipes the temporary directory dir of a step, if any, returning how many bytes its files took
+func (d *stepTmpDirs) remove(dir string) int64 {
+	if dir == "" {
+		return 0
+	}
+	var size int64
+	filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Warnf("Failed to wipe the temporary directory of the step %s: %v", dir, err)
+	}
+	return size
+}
+
+// Removes the temporary directories of the steps, and the files a step left in them as it went on
+// running in the background
+func (d *stepTmpDirs) removeAll() {
+	if d == nil {
+		return
+	}
+	if err := os.RemoveAll(d.root); err != nil {
+		logger.Warnf("Failed to remove the temporary directories of the steps: %v", err)
+	}
+}
+
+// Returns the part of the line the build shell runs for a step setting TMPDIR to its temporary
+// directory dir, keeping the TMPDIR of the shell for restoreTmpDir, or "" without one
+func setTmpDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return "sd_tmpdir=${TMPDIR-}; sd_tmpdir_set=${TMPDIR+x}; export TMPDIR=" + shellQuote(dir) + " ;"
+}
+
+// Returns the part of the line the build shell runs for a step setting TMPDIR back to the one of
+// the shell once the step is over, or "" if the step has no temporary directory dir
+func restoreTmpDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return "if [ -n \"$sd_tmpdir_set\" ]; then TMPDIR=$sd_tmpdir; else unset TMPDIR; fi; unset sd_tmpdir sd_tmpdir_set ;"
+}
+
+// Returns the shell line setting TMPDIR to the temporary directory dir of a teardown, or "" without
+// one
+func exportTmpDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return "export TMPDIR=" + shellQuote(dir) + "\n"
+}
@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepTmpRoot(t *testing.T) {
+	defer os.Setenv("SD_STEP_TMP_DIR", os.Getenv("SD_STEP_TMP_DIR"))
+
+	os.Unsetenv("SD_STEP_TMP_DIR")
+	assert.Equal(t, "/tmp/env_tmp_steps", stepTmpRoot("/tmp/env"))
+
+	os.Setenv("SD_STEP_TMP_DIR", "/scratch")
+	assert.Equal(t, "/scratch/env_tmp_steps", stepTmpRoot("/tmp/env"))
+}
+
+func TestStepCommandRestoresTmpDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "steptmp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "step.sh")
+	if err := ioutil.WriteFile(script, []byte("echo \"step $TMPDIR\"\n"), 0755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, cmd := range []screwdriver.CommandDef{
+		{Name: "sourced"},
+		{Name: "apart", AllowFailure: true},
+	} {
+		line := stepCommand("guid", script, stepStreams{}, cmd, "/bin/sh", "/tmp/step dir", nil)
+		for before, after := range map[string]string{"TMPDIR=/var/tmp; export TMPDIR": "/var/tmp", "unset TMPDIR": "unset"} {
+			out, err := exec.Command("/bin/sh", "-e", "-c", before+"; "+line+"echo \"after ${TMPDIR-unset}\"").CombinedOutput()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v: %s", err, out)
+			}
+			if !strings.HasPrefix(string(out), "step /tmp/step dir\n") || !strings.HasSuffix(string(out), "\nafter "+after+"\n") {
+				t.Errorf("Step %q should have its TMPDIR and the shell %s after it, got %q", cmd.Name, after, out)
+			}
+		}
+	}
+}
+
+func TestRunGivesStepsTmpDir(t *testing.T) {
+	envFilepath := "/tmp/testStepTmp"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "first", Cmd: "echo \"tmp=$TMPDIR\"; head -c 100 /dev/zero > \"$TMPDIR/left\""},
+			{Name: "second", Cmd: "echo \"tmp=$TMPDIR\"; ls \"$TMPDIR\"", AllowFailure: true},
+			{Name: "teardown-clean", Cmd: "echo \"tmp=$TMPDIR\""},
+		},
+		Environment: []map[string]string{},
+	}
+	tmpDirBytes := map[string]int64{}
+	api := MockAPI{
+		stepStopDetails: func(stepName string, details screwdriver.StepStopDetails) {
+			tmpDirBytes[stepName] = details.TmpDirBytes
+		},
+	}
+	emitter := &MockEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(api), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	root := stepTmpRoot(envFilepath)
+	dirs := regexp.MustCompile(`(?m)^tmp=(\S+)$`).FindAllStringSubmatch(string(emitter.found), -1)
+	if len(dirs) != 3 {
+		t.Fatalf("Every step should tell its TMPDIR, got %q", emitter.found)
+	}
+	for i, dir := range dirs {
+		if !strings.HasPrefix(dir[1], root+"/") {
+			t.Errorf("The TMPDIR of step %d should be in %s, got %q", i, root, dir[1])
+		}
+		for _, other := range dirs[:i] {
+			if other[1] == dir[1] {
+				t.Errorf("Step %d should have a TMPDIR of its own, got %q", i, dir[1])
+			}
+		}
+	}
+	if strings.Contains(string(emitter.found), "\nleft\n") {
+		t.Errorf("The temporary files of a step should not reach the next one, got %q", emitter.found)
+	}
+	assert.Equal(t, map[string]int64{"first": 100, "second": 0, "teardown-clean": 0}, tmpDirBytes)
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("The temporary directories of the steps should be removed after the build, got %v", err)
+	}
+}
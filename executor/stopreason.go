@@ -0,0 +1,32 @@
+package executor
+
+import (
+	"errors"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Returns why a step stopped with code and stepErr, as classified by the failure rules, for the
+// step stop: the reason and the message of the error, if any
+func stopReason(code int, stepErr error, details screwdriver.StepStopDetails) (string, string) {
+	message := ""
+	if stepErr != nil {
+		message = stepErr.Error()
+	}
+	var stepTimeout StepTimeout
+	switch {
+	case details.Skipped:
+		return screwdriver.StepSkipped, message
+	case details.Restored:
+		return screwdriver.StepCached, message
+	case errors.Is(stepErr, ErrAborted):
+		return screwdriver.StepAborted, message
+	case errors.Is(stepErr, ErrPreempted):
+		return screwdriver.StepPreempted, message
+	case errors.Is(stepErr, ErrTimeout) || errors.As(stepErr, &stepTimeout):
+		return screwdriver.StepTimedOut, message
+	case stepErr == nil && code == ExitOk:
+		return screwdriver.StepCompleted, message
+	}
+	return screwdriver.StepFailed, message
+}
@@ -0,0 +1,78 @@
+package executor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestStopReason(t *testing.T) {
+	tests := []struct {
+		code    int
+		err     error
+		details screwdriver.StepStopDetails
+		reason  string
+		message string
+	}{
+		{ExitOk, nil, screwdriver.StepStopDetails{}, screwdriver.StepCompleted, ""},
+		{ExitOk, nil, screwdriver.StepStopDetails{Skipped: true}, screwdriver.StepSkipped, ""},
+		{ExitOk, nil, screwdriver.StepStopDetails{Restored: true}, screwdriver.StepCached, ""},
+		{2, StepFailure{Step: "test", Code: 2}, screwdriver.StepStopDetails{}, screwdriver.StepFailed, "Launching command exit with code: 2"},
+		{2, nil, screwdriver.StepStopDetails{}, screwdriver.StepFailed, ""},
+		{ExitTimeout, StepTimeout{"test", time.Minute}, screwdriver.StepStopDetails{}, screwdriver.StepTimedOut, "Step timeout of 1m0s exceeded"},
+		{ExitTimeout, Timeout{"test", time.Hour}, screwdriver.StepStopDetails{}, screwdriver.StepTimedOut, "Timeout of 1h0m0s seconds exceeded"},
+		{ExitAborted, Aborted{"test"}, screwdriver.StepStopDetails{}, screwdriver.StepAborted, "SIGTERM received, step aborted"},
+		{ExitAborted, BuildStopped{"test", screwdriver.Aborted}, screwdriver.StepStopDetails{}, screwdriver.StepAborted, "Build set to ABORTED outside of the launcher, step stopped"},
+		{ExitBlocked, Blocked{Step: "test", Rule: "no-curl-sh"}, screwdriver.StepStopDetails{}, screwdriver.StepFailed, `Step blocked by policy rule "no-curl-sh"`},
+		{ExitLaunch, LaunchError{"test", errors.New("no shell")}, screwdriver.StepStopDetails{}, screwdriver.StepFailed, `Launching step "test": no shell`},
+		// The failure rules classify the step
+		{137, ClassifiedFailure{Step: "test", Class: ClassTimeout, Rule: "slow", Err: StepFailure{Step: "test", Code: 137}}, screwdriver.StepStopDetails{}, screwdriver.StepTimedOut,
+			`Step "test" failed as timeout by rule "slow": Launching command exit with code: 137`},
+	}
+	for _, test := range tests {
+		reason, message := stopReason(test.code, test.err, test.details)
+		if reason != test.reason || message != test.message {
+			t.Errorf("stopReason(%d, %v) = %q, %q, want %q, %q", test.code, test.err, reason, message, test.reason, test.message)
+		}
+	}
+}
+
+func TestRunReportsStopReasons(t *testing.T) {
+	envFilepath := "/tmp/testStopReasons"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "install", Cmd: "echo installed"},
+			{Name: "publish", Cmd: "echo published", Condition: "false"},
+			{Name: "test", Cmd: "echo 'Could not resolve host: registry'; exit 6"},
+			{Name: "teardown-report", Cmd: "echo reported"},
+		},
+		Environment: []map[string]string{},
+	}
+	details := map[string]screwdriver.StepStopDetails{}
+	testAPI := screwdriver.API(MockAPI{
+		stepStopDetails: func(stepName string, d screwdriver.StepStopDetails) {
+			details[stepName] = d
+		},
+	})
+	if err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err == nil {
+		t.Fatalf("Run() should fail")
+	}
+	want := map[string]string{
+		"install":         screwdriver.StepCompleted,
+		"publish":         screwdriver.StepSkipped,
+		"test":            screwdriver.StepFailed,
+		"teardown-report": screwdriver.StepCompleted,
+	}
+	for step, reason := range want {
+		if got := details[step].Reason; got != reason {
+			t.Errorf("Reason of %q = %q, want %q", step, got, reason)
+		}
+	}
+	if got, want := details["test"].Message, `Step "test" failed as infra-error by rule "dns": Launching command exit with code: 6`; got != want {
+		t.Errorf("Message of the failed step = %q, want %q", got, want)
+	}
+}
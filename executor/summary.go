@@ -0,0 +1,206 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// summaryFile is the name of the build summary artifact
+	summaryFile = "build-summary.json"
+	// summaryTableFile is the name of the human readable build summary artifact
+	summaryTableFile = "build-summary.txt"
+)
+
+// stepSummary is the record of one step in the build summary
+type stepSummary struct {
+	Name       string                     `json:"name"`
+	Teardown   bool                       `json:"teardown,omitempty"`
+	StartTime  time.Time                  `json:"startTime"`
+	DurationMs int64                      `json:"durationMs"`
+	Percent    float64                    `json:"percent"`
+	Code       int                        `json:"code"`
+	Signal     string                     `json:"signal,omitempty"`
+	Usage      *screwdriver.ResourceUsage `json:"usage,omitempty"`
+	// Network is the traffic of the whole container while the step ran
+	Network *netUsage `json:"network,omitempty"`
+	// Attempts is how many times the step ran, if it was run again after failing
+	Attempts      int  `json:"attempts,omitempty"`
+	PassedOnRetry bool `json:"passedOnRetry,omitempty"`
+}
+
+// buildSummary collects how every step of the build went, for the summary artifact
+type buildSummary struct {
+	// QueueTimeMs is the time from the build entering the queue until the launcher started it
+	QueueTimeMs    int64         `json:"queueTimeMs"`
+	TotalTimeMs    int64         `json:"totalTimeMs"`
+	StepsTimeMs    int64         `json:"stepsTimeMs"`
+	TeardownTimeMs int64         `json:"teardownTimeMs"`
+	Network        *netUsage     `json:"network,omitempty"`
+	Steps          []stepSummary `json:"steps"`
+
+	start time.Time
+	// network counters at the start of the build and at the end of the last step, if readable
+	netStart, netLast *netUsage
+}
+
+// Starts the summary of a build started at start, that entered the queue at queueEnterTime
+// (RFC 3339, as sent by the API)
+func newBuildSummary(start time.Time, queueEnterTime string) *buildSummary {
+	s := &buildSummary{start: start}
+	if queued, err := time.Parse(time.RFC3339, queueEnterTime); err == nil && queued.Before(start) {
+		s.QueueTimeMs = int64(start.Sub(queued) / time.Millisecond)
+	}
+	if n, err := readNetUsage(); err == nil {
+		s.netStart, s.netLast = &n, &n
+	} else {
+		logger.Debugf("Not tracking the network usage: %v", err)
+	}
+	return s
+}
+
+// Returns the network traffic since the last reading, and takes a new reading
+func (s *buildSummary) netSince() *netUsage {
+	if s.netLast == nil {
+		return nil
+	}
+	n, err := readNetUsage()
+	if err != nil {
+		return nil
+	}
+	delta := n.sub(*s.netLast)
+	s.netLast = &n
+	return &delta
+}
+
+// Records a step that started at start and just stopped
+func (s *buildSummary) add(name string, teardown bool, start time.Time, code int, details screwdriver.StepStopDetails) {
+	s.Steps = append(s.Steps, stepSummary{
+		Name:       name,
+		Teardown:   teardown,
+		StartTime:  start,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+		Code:       code,
+		Signal:     details.Signal,
+		Usage:      details.Usage,
+		Network:    s.netSince(),
+
+		Attempts:      details.Attempts,
+		PassedOnRetry: details.PassedOnRetry,
+	})
+}
+
+// Computes the totals and the share of the build time each step took, at the end of the build
+func (s *buildSummary) finish(end time.Time) {
+	s.TotalTimeMs = int64(end.Sub(s.start) / time.Millisecond)
+	if s.netStart != nil {
+		if n, err := readNetUsage(); err == nil {
+			total := n.sub(*s.netStart)
+			s.Network = &total
+		}
+	}
+	s.StepsTimeMs, s.TeardownTimeMs = 0, 0
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.Teardown {
+			s.TeardownTimeMs += step.DurationMs
+		} else {
+			s.StepsTimeMs += step.DurationMs
+		}
+		if s.TotalTimeMs > 0 {
+			step.Percent = percent(step.DurationMs, s.TotalTimeMs)
+		}
+	}
+}
+
+// Returns part as a percentage of total, rounded to one decimal
+func percent(part, total int64) float64 {
+	return float64(part*1000/total) / 10
+}
+
+// Returns the timing breakdown sent to the API
+func (s *buildSummary) timings() screwdriver.BuildTimings {
+	t := screwdriver.BuildTimings{
+		QueueTimeMs:    s.QueueTimeMs,
+		TotalTimeMs:    s.TotalTimeMs,
+		StepsTimeMs:    s.StepsTimeMs,
+		TeardownTimeMs: s.TeardownTimeMs,
+		Steps:          []screwdriver.StepTiming{},
+	}
+	for _, step := range s.Steps {
+		t.Steps = append(t.Steps, screwdriver.StepTiming{
+			Name:       step.Name,
+			DurationMs: step.DurationMs,
+			Percent:    step.Percent,
+		})
+	}
+	return t
+}
+
+// Returns the summary as a human readable table
+func (s *buildSummary) table() []byte {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+	ms := func(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	fmt.Fprintln(w, "STEP\tDURATION\tSHARE\tCODE\tCPU\tMAX RSS\tNET RX\tNET TX\t")
+	var passedOnRetry []string
+	for _, step := range s.Steps {
+		if step.PassedOnRetry {
+			passedOnRetry = append(passedOnRetry, fmt.Sprintf("%s (attempt %d)", step.Name, step.Attempts))
+		}
+		cpu, rss, rx, tx := "-", "-", "-", "-"
+		if step.Usage != nil {
+			cpu = ms(step.Usage.CPUTimeMs).String()
+			rss = fmt.Sprintf("%dMiB", step.Usage.MaxRSSBytes>>20)
+		}
+		if step.Network != nil {
+			rx = fmt.Sprintf("%dKiB", step.Network.RxBytes>>10)
+			tx = fmt.Sprintf("%dKiB", step.Network.TxBytes>>10)
+		}
+		fmt.Fprintf(w, "%s\t%v\t%.1f%%\t%d\t%s\t%s\t%s\t%s\t\n", step.Name, ms(step.DurationMs), step.Percent, step.Code, cpu, rss, rx, tx)
+	}
+	w.Flush()
+
+	fmt.Fprintf(&buf, "\nqueued:    %v\nsteps:     %v\nteardowns: %v\ntotal:     %v\n",
+		ms(s.QueueTimeMs), ms(s.StepsTimeMs), ms(s.TeardownTimeMs), ms(s.TotalTimeMs))
+	if s.Network != nil {
+		fmt.Fprintf(&buf, "network:   %dKiB received, %dKiB sent\n", s.Network.RxBytes>>10, s.Network.TxBytes>>10)
+	}
+	if len(passedOnRetry) > 0 {
+		fmt.Fprintf(&buf, "flaky:     %s passed on retry\n", strings.Join(passedOnRetry, ", "))
+	}
+	return buf.Bytes()
+}
+
+// Writes the summary into the artifacts dir, as JSON and as a table
+func (s *buildSummary) write(artifactsDir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(artifactsDir, summaryFile), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(artifactsDir, summaryTableFile), s.table(), 0644)
+}
+
+// Returns the value of key in env (KEY=value entries), the last one wins like in exec
+func lookupEnv(env []string, key string) string {
+	value := ""
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			value = kv[len(key)+1:]
+		}
+	}
+	return value
+}
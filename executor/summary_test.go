@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestBuildSummaryTimings(t *testing.T) {
+	start := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	summary := newBuildSummary(start, "2021-03-01T09:59:30.000Z")
+	summary.Steps = []stepSummary{
+		{Name: "install", StartTime: start, DurationMs: 6000},
+		{Name: "test", StartTime: start.Add(6 * time.Second), DurationMs: 3000},
+		{Name: "sd-teardown-artifacts", Teardown: true, StartTime: start.Add(9 * time.Second), DurationMs: 1000},
+	}
+	summary.finish(start.Add(12 * time.Second))
+
+	want := screwdriver.BuildTimings{
+		QueueTimeMs:    30000,
+		TotalTimeMs:    12000,
+		StepsTimeMs:    9000,
+		TeardownTimeMs: 1000,
+		Steps: []screwdriver.StepTiming{
+			{Name: "install", DurationMs: 6000, Percent: 50},
+			{Name: "test", DurationMs: 3000, Percent: 25},
+			{Name: "sd-teardown-artifacts", DurationMs: 1000, Percent: 8.3},
+		},
+	}
+	if got := summary.timings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("timings() = %+v, want %+v", got, want)
+	}
+
+	if got := newBuildSummary(start, "").QueueTimeMs; got != 0 {
+		t.Errorf("QueueTimeMs without a queue time = %v, want 0", got)
+	}
+}
+
+func TestBuildSummaryWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usage := &screwdriver.ResourceUsage{CPUTimeMs: 10, MaxRSSBytes: 1 << 20}
+	summary := newBuildSummary(time.Now(), "")
+	summary.add("install", false, time.Now(), 0, screwdriver.StepStopDetails{Usage: usage, Attempts: 2, PassedOnRetry: true})
+	summary.add("sd-teardown-test", true, time.Now(), ExitAborted, screwdriver.StepStopDetails{Signal: "SIGTERM"})
+	summary.finish(time.Now())
+	if err := summary.write(dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, summaryFile))
+	if err != nil {
+		t.Fatalf("Couldn't read the summary: %v", err)
+	}
+	var got buildSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Couldn't parse the summary: %v", err)
+	}
+	if len(got.Steps) != 2 {
+		t.Fatalf("summary has %d steps, want 2: %s", len(got.Steps), data)
+	}
+	if got.Steps[0].Name != "install" || !reflect.DeepEqual(got.Steps[0].Usage, usage) || got.Steps[0].Attempts != 2 || !got.Steps[0].PassedOnRetry {
+		t.Errorf("Unexpected step summary: %+v", got.Steps[0])
+	}
+	if got.Steps[1].Name != "sd-teardown-test" || !got.Steps[1].Teardown || got.Steps[1].Code != ExitAborted || got.Steps[1].Signal != "SIGTERM" {
+		t.Errorf("Unexpected step summary: %+v", got.Steps[1])
+	}
+
+	table, err := ioutil.ReadFile(filepath.Join(dir, summaryTableFile))
+	if err != nil {
+		t.Fatalf("Couldn't read the summary table: %v", err)
+	}
+	for _, want := range []string{"STEP", "install", "sd-teardown-test", "1MiB", "total:", "flaky:     install (attempt 2) passed on retry"} {
+		if !strings.Contains(string(table), want) {
+			t.Errorf("summary table should contain %q:\n%s", want, table)
+		}
+	}
+}
+
+func TestLookupEnv(t *testing.T) {
+	env := []string{"SD_ARTIFACTS_DIR_OLD=/old", "SD_ARTIFACTS_DIR=/a", "FOO=bar", "SD_ARTIFACTS_DIR=/b"}
+	if got := lookupEnv(env, "SD_ARTIFACTS_DIR"); got != "/b" {
+		t.Errorf("lookupEnv() = %q, want %q", got, "/b")
+	}
+	if got := lookupEnv(env, "MISSING"); got != "" {
+		t.Errorf("lookupEnv() = %q, want empty", got)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package executor
+
+const (
+	// seccompAuditArch is 0 on the architectures seccomp profiles are not supported on
+	seccompAuditArch = 0
+	seccompX32Bit    = 0
+)
+
+// syscallNumbers is empty on the architectures seccomp profiles are not supported on
+var syscallNumbers = map[string]uint32{}
@@ -0,0 +1,245 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// maxStepTestFailures bounds the failed tests of a TAP step reported with its step stop
+const maxStepTestFailures = 100
+
+var (
+	// tapTest matches a test line: ok or not ok, its number, description and directive
+	tapTest = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(?i:(skip|todo))\S*\s*(.*))?$`)
+	// tapPlan matches the plan of the tests, 1..0 when they are all skipped
+	tapPlan    = regexp.MustCompile(`^1\.\.(\d+)`)
+	tapBailOut = regexp.MustCompile(`^Bail out!\s*(.*)$`)
+	// tapMessage matches the message of the YAML diagnostics of a failed test
+	tapMessage = regexp.MustCompile(`^\s+message:\s*['"]?(.*?)['"]?\s*$`)
+)
+
+// tapParser counts the tests of the TAP output of a step, line by line. The subtests, indented,
+// are left to the test line summing them up.
+type tapParser struct {
+	tests screwdriver.StepTests
+	ran   int
+	// failure is the index of the last failed test in the failures while its diagnostics follow,
+	// -1 otherwise, and yaml whether they are in a YAML block
+	failure int
+	yaml    bool
+}
+
+func newTAPParser() *tapParser {
+	return &tapParser{tests: screwdriver.StepTests{Failures: []screwdriver.StepTestFailure{}}, failure: -1}
+}
+
+// Parses line of the TAP output
+func (p *tapParser) parse(line string) {
+	trimmed := strings.TrimSpace(line)
+	if p.yaml {
+		if trimmed == "..." {
+			p.yaml = false
+		} else if m := tapMessage.FindStringSubmatch(line); m != nil {
+			p.diagnose(m[1], true)
+		}
+		return
+	}
+	if trimmed == "---" && line != trimmed {
+		p.yaml = true
+		return
+	}
+	if strings.HasPrefix(trimmed, "#") {
+		if comment := strings.TrimSpace(strings.TrimLeft(trimmed, "#")); !strings.HasPrefix(comment, "Subtest:") {
+			p.diagnose(comment, false)
+		}
+		return
+	}
+	if line != strings.TrimLeft(line, " \t") {
+		return
+	}
+
+	if m := tapPlan.FindStringSubmatch(line); m != nil {
+		p.tests.Planned, _ = strconv.Atoi(m[1])
+		return
+	}
+	if m := tapBailOut.FindStringSubmatch(line); m != nil {
+		p.tests.BailOut = m[1]
+		if p.tests.BailOut == "" {
+			p.tests.BailOut = "Bail out!"
+		}
+		p.failure = -1
+		return
+	}
+	m := tapTest.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	p.ran++
+	p.failure = -1
+	number, _ := strconv.Atoi(m[2])
+	failed, directive := m[1] != "", strings.ToLower(m[4])
+	switch {
+	case directive == "skip":
+		p.tests.Skipped++
+	case directive == "todo":
+		p.tests.Todo++
+	case failed:
+		p.tests.Failed++
+		if len(p.tests.Failures) < maxStepTestFailures {
+			name := m[3]
+			if name == "" {
+				name = fmt.Sprintf("test %d", p.ran)
+			}
+			p.tests.Failures = append(p.tests.Failures, screwdriver.StepTestFailure{Number: number, Test: name})
+			p.failure = len(p.tests.Failures) - 1
+		}
+	default:
+		p.tests.Passed++
+	}
+}
+
+// Adds the line of diagnostics message to the message of the last failed test if its diagnostics
+// follow, or replaces its message with it, e.g. the message of its YAML diagnostics
+func (p *tapParser) diagnose(message string, replace bool) {
+	if p.failure < 0 || message == "" {
+		return
+	}
+	failure := &p.tests.Failures[p.failure]
+	if !replace && failure.Message != "" {
+		if len(failure.Message) >= maxTestFailureMessage {
+			return
+		}
+		message = failure.Message + "\n" + message
+	}
+	if len(message) > maxTestFailureMessage {
+		message = message[:maxTestFailureMessage] + "..."
+	}
+	failure.Message = message
+}
+
+// Returns the tests of the output, the planned tests that did not run failed
+func (p *tapParser) result() *screwdriver.StepTests {
+	tests := p.tests
+	tests.Failures = append([]screwdriver.StepTestFailure{}, p.tests.Failures...)
+	if missing := tests.Planned - p.ran; missing > 0 {
+		tests.Failed += missing
+		message := fmt.Sprintf("%d of the %d planned tests did not run", missing, tests.Planned)
+		if tests.BailOut != "" {
+			message += ", bailed out: " + tests.BailOut
+		}
+		tests.Failures = append(tests.Failures, screwdriver.StepTestFailure{Test: "plan", Message: message})
+	}
+	return &tests
+}
+
+// tapStepTests are the tests of a TAP step
+type tapStepTests struct {
+	step  string
+	tests *screwdriver.StepTests
+}
+
+// tapScanner is the emitter of the build, counting the tests of the TAP output of the steps
+type tapScanner struct {
+	screwdriver.Emitter
+
+	mu   sync.Mutex
+	step string
+	line []byte
+	// parser parses the output of the current step if it writes TAP, and done are the tests of the
+	// TAP steps over, in order
+	parser *tapParser
+	done   []tapStepTests
+}
+
+func newTAPScanner(emitter screwdriver.Emitter) *tapScanner {
+	return &tapScanner{Emitter: emitter}
+}
+
+// StartCmd attributes the output from now on to cmd, parsed if it writes TAP
+func (s *tapScanner) StartCmd(cmd screwdriver.CommandDef) {
+	s.mu.Lock()
+	s.flush()
+	s.step, s.parser = cmd.Name, nil
+	if cmd.TAP {
+		s.parser = newTAPParser()
+	}
+	s.mu.Unlock()
+	s.Emitter.StartCmd(cmd)
+}
+
+func (s *tapScanner) Write(p []byte) (int, error) {
+	s.scanOutput(p)
+	return s.Emitter.Write(p)
+}
+
+// Parses p, output of the current step, if it writes TAP
+func (s *tapScanner) scanOutput(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.parser == nil {
+		return
+	}
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		s.parse(s.line[:i])
+		s.line = s.line[i+1:]
+	}
+	if len(s.line) > maxScannedLine {
+		s.flush()
+	}
+}
+
+// Unwrap returns the emitter the scanner writes to
+func (s *tapScanner) Unwrap() screwdriver.Emitter {
+	return s.Emitter
+}
+
+// Parses the partial line of the current step
+func (s *tapScanner) flush() {
+	if len(s.line) > 0 {
+		s.parse(s.line)
+		s.line = nil
+	}
+}
+
+// Parses line of the TAP output of the current step, without its colors
+func (s *tapScanner) parse(line []byte) {
+	if s.parser != nil {
+		s.parser.parse(ansiEscape.ReplaceAllString(strings.TrimRight(string(line), "\r"), ""))
+	}
+}
+
+// Returns the tests of the step with name, or nil if it is not the current step or does not write
+// TAP, keeping them for the results of the build. It returns nil on a nil scanner.
+func (s *tapScanner) stop(name string) *screwdriver.StepTests {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name != s.step || s.parser == nil {
+		return nil
+	}
+	s.flush()
+	tests := s.parser.result()
+	s.done = append(s.done, tapStepTests{step: name, tests: tests})
+	s.parser = nil
+	return tests
+}
+
+// Returns the tests of the TAP steps over, in order
+func (s *tapScanner) steps() []tapStepTests {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]tapStepTests{}, s.done...)
+}
@@ -0,0 +1,134 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTAPOutput = `TAP version 13
+1..7
+ok 1 - loads the config
+not ok 2 - parses the dates
+  ---
+  message: 'got 2021-13-01, want an error'
+  severity: fail
+  ...
+ok 3 # SKIP no network
+not ok 4 - handles leap seconds # TODO not implemented
+# Subtest: nested
+    ok 1 - inner
+    not ok 2 - inner failure
+    1..2
+not ok 5 - nested
+#   Failed test 'nested'
+#   at t/nested.t line 12.
+ok 6
+`
+
+func TestTAPParser(t *testing.T) {
+	p := newTAPParser()
+	for _, line := range strings.Split(testTAPOutput, "\n") {
+		p.parse(line)
+	}
+	assert.Equal(t, &screwdriver.StepTests{
+		Planned: 7,
+		Passed:  2,
+		Failed:  3,
+		Skipped: 1,
+		Todo:    1,
+		Failures: []screwdriver.StepTestFailure{
+			{Number: 2, Test: "parses the dates", Message: "got 2021-13-01, want an error"},
+			{Number: 5, Test: "nested", Message: "Failed test 'nested'\nat t/nested.t line 12."},
+			{Test: "plan", Message: "1 of the 7 planned tests did not run"},
+		},
+	}, p.result())
+
+	p = newTAPParser()
+	for _, line := range []string{"1..3", "ok", "Bail out! Cannot connect to the database"} {
+		p.parse(line)
+	}
+	tests := p.result()
+	assert.Equal(t, "Cannot connect to the database", tests.BailOut)
+	assert.Equal(t, 2, tests.Failed)
+	assert.Equal(t, []screwdriver.StepTestFailure{{Test: "plan", Message: "2 of the 3 planned tests did not run, bailed out: Cannot connect to the database"}}, tests.Failures)
+}
+
+func TestTAPScanner(t *testing.T) {
+	emitter := &MockEmitter{}
+	s := newTAPScanner(emitter)
+	s.StartCmd(screwdriver.CommandDef{Name: "prove", TAP: true})
+	s.Write([]byte("1..2\r\nok 1 - \x1b[32mfirst\x1b[0m\r\nnot o"))
+	s.Write([]byte("k 2 - second"))
+	tests := s.stop("prove")
+	if assert.NotNil(t, tests) {
+		assert.Equal(t, 1, tests.Passed)
+		assert.Equal(t, []screwdriver.StepTestFailure{{Number: 2, Test: "second"}}, tests.Failures)
+	}
+	assert.Nil(t, s.stop("prove"), "The tests of a step are only counted once")
+
+	s.StartCmd(screwdriver.CommandDef{Name: "build"})
+	s.Write([]byte("ok 1 - not TAP\n"))
+	assert.Nil(t, s.stop("build"))
+	assert.Len(t, s.steps(), 1)
+	assert.Equal(t, "1..2\r\nok 1 - \x1b[32mfirst\x1b[0m\r\nnot ok 2 - secondok 1 - not TAP\n", string(emitter.found))
+}
+
+func TestRunCountsTAPTests(t *testing.T) {
+	envFilepath := "/tmp/testTAP"
+	setupTestCase(t, envFilepath)
+	dir, err := ioutil.TempDir("", "tap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metaPath := filepath.Join(dir, "meta.json")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "prove", Cmd: `printf '1..3\nok 1 - adds\nnot ok 2 - subtracts\n# got 1, want 2\nok 3 - divides # skip no floats\n'`, TAP: true},
+			{Name: "build", Cmd: "echo 'ok 1 - not TAP'"},
+		},
+		Environment: []map[string]string{},
+	}
+	var mu sync.Mutex
+	details := map[string]*screwdriver.StepTests{}
+	api := MockAPI{
+		stepStopDetails: func(stepName string, d screwdriver.StepStopDetails) {
+			mu.Lock()
+			defer mu.Unlock()
+			details[stepName] = d.Tests
+		},
+	}
+	if err := Run("", []string{"SD_META_PATH=" + metaPath}, &MockEmitter{}, testBuild, screwdriver.API(api), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]*screwdriver.StepTests{
+		"prove": {Planned: 3, Passed: 1, Failed: 1, Skipped: 1, Failures: []screwdriver.StepTestFailure{{Number: 2, Test: "subtracts", Message: "got 1, want 2"}}},
+		"build": nil,
+	}, details)
+
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var meta struct {
+		Tests map[string]interface{} `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assert.Equal(t, "1/3", meta.Tests["results"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"step": "prove", "test": "subtracts", "message": "got 1, want 2"}}, meta.Tests["failures"])
+}
@@ -0,0 +1,93 @@
+package executor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Returns commands with every step using a step template replaced by the steps of the template,
+// named after the step and theirs. The parameters of the template are set as variables of its
+// steps, to the value the step gives them or else their default. The steps of a template have the
+// type and the artifact retention class of the step using it unless they have their own, so a
+// teardown can use it too, and are flaky if it is.
+func expandTemplates(commands []screwdriver.CommandDef, templates map[string]screwdriver.StepTemplate) ([]screwdriver.CommandDef, error) {
+	expanded := []screwdriver.CommandDef{}
+	for _, cmd := range commands {
+		if cmd.Template == "" {
+			if len(cmd.With) > 0 {
+				return nil, fmt.Errorf("Step %q has parameters but no template", cmd.Name)
+			}
+			expanded = append(expanded, cmd)
+			continue
+		}
+		if cmd.Cmd != "" || cmd.Script != "" {
+			return nil, fmt.Errorf("Step %q has both a template and a command", cmd.Name)
+		}
+		template, ok := templates[cmd.Template]
+		if !ok {
+			return nil, fmt.Errorf("Unknown template %q of step %q", cmd.Template, cmd.Name)
+		}
+
+		params, err := templateParams(cmd, template)
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range template.Steps {
+			if step.Template != "" {
+				return nil, fmt.Errorf("Step %q of template %q cannot use a template", step.Name, cmd.Template)
+			}
+			step.Name = cmd.Name + "-" + step.Name
+			if step.Type == "" {
+				step.Type = cmd.Type
+			}
+			if step.ArtifactRetention == "" {
+				step.ArtifactRetention = cmd.ArtifactRetention
+			}
+			step.Flaky = step.Flaky || cmd.Flaky
+			env := map[string]string{}
+			for key, value := range step.Env {
+				env[key] = value
+			}
+			for key, value := range params {
+				env[key] = value
+			}
+			step.Env = env
+			expanded = append(expanded, step)
+		}
+	}
+	return expanded, nil
+}
+
+// Returns the values of the parameters of template for the step cmd using it
+func templateParams(cmd screwdriver.CommandDef, template screwdriver.StepTemplate) (map[string]string, error) {
+	params := map[string]string{}
+	for key, value := range template.Params {
+		params[key] = value
+	}
+	for _, key := range template.Required {
+		if _, ok := cmd.With[key]; !ok {
+			return nil, fmt.Errorf("Step %q is missing the parameter %q of template %q", cmd.Name, key, cmd.Template)
+		}
+		params[key] = ""
+	}
+
+	keys := make([]string, 0, len(cmd.With))
+	for key := range cmd.With {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := params[key]; !ok {
+			return nil, fmt.Errorf("Unknown parameter %q of template %q in step %q", key, cmd.Template, cmd.Name)
+		}
+		params[key] = cmd.With[key]
+	}
+	for key := range params {
+		if !envName.MatchString(key) {
+			return nil, fmt.Errorf("Invalid parameter %q of template %q", key, cmd.Template)
+		}
+	}
+	return params, nil
+}
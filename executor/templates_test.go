@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var testTemplates = map[string]screwdriver.StepTemplate{
+	"publish": {
+		Params:   map[string]string{"TAG": "latest"},
+		Required: []string{"IMAGE"},
+		Steps: []screwdriver.CommandDef{
+			{Name: "build", Cmd: `docker build -t "$IMAGE:$TAG" .`},
+			{Name: "push", Cmd: `docker push "$IMAGE:$TAG"`, Env: map[string]string{"TAG": "ignored", "RETRIES": "3"}},
+		},
+	},
+}
+
+func TestExpandTemplates(t *testing.T) {
+	commands := []screwdriver.CommandDef{
+		{Name: "install", Cmd: "npm install"},
+		{Name: "publish", Template: "publish", With: map[string]string{"IMAGE": "screwdriver/launcher"}, ArtifactRetention: "release"},
+		{Name: "teardown-publish", Template: "publish", Type: screwdriver.StepTypeTeardown, With: map[string]string{"IMAGE": "sd/debug", "TAG": "v1"}},
+	}
+	expanded, err := expandTemplates(commands, testTemplates)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []screwdriver.CommandDef{
+		commands[0],
+		{Name: "publish-build", Cmd: `docker build -t "$IMAGE:$TAG" .`, Env: map[string]string{"IMAGE": "screwdriver/launcher", "TAG": "latest"}, ArtifactRetention: "release"},
+		{Name: "publish-push", Cmd: `docker push "$IMAGE:$TAG"`, Env: map[string]string{"IMAGE": "screwdriver/launcher", "TAG": "latest", "RETRIES": "3"}, ArtifactRetention: "release"},
+		{Name: "teardown-publish-build", Type: screwdriver.StepTypeTeardown, Cmd: `docker build -t "$IMAGE:$TAG" .`, Env: map[string]string{"IMAGE": "sd/debug", "TAG": "v1"}},
+		{Name: "teardown-publish-push", Type: screwdriver.StepTypeTeardown, Cmd: `docker push "$IMAGE:$TAG"`, Env: map[string]string{"IMAGE": "sd/debug", "TAG": "v1", "RETRIES": "3"}},
+	}
+	if !reflect.DeepEqual(expanded, want) {
+		t.Errorf("expandTemplates() = %+v, want %+v", expanded, want)
+	}
+	if testTemplates["publish"].Steps[1].Env["TAG"] != "ignored" {
+		t.Errorf("The steps of the template should not change: %v", testTemplates["publish"].Steps[1].Env)
+	}
+
+	invalid := []screwdriver.CommandDef{
+		{Name: "publish", Template: "missing"},
+		{Name: "publish", Template: "publish"},
+		{Name: "publish", Template: "publish", With: map[string]string{"IMAGE": "a", "OTHER": "b"}},
+		{Name: "publish", Template: "publish", Cmd: "make", With: map[string]string{"IMAGE": "a"}},
+		{Name: "publish", Cmd: "make", With: map[string]string{"IMAGE": "a"}},
+	}
+	for _, cmd := range invalid {
+		if _, err := expandTemplates([]screwdriver.CommandDef{cmd}, testTemplates); err == nil {
+			t.Errorf("Expected an error for %+v", cmd)
+		}
+	}
+}
+
+func TestRunStepTemplates(t *testing.T) {
+	envFilepath := "/tmp/testStepTemplates"
+	setupTestCase(t, envFilepath)
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "greet", Template: "greet", With: map[string]string{"WHO": "world"}},
+			{Name: "greet-again", Template: "greet"},
+		},
+		Environment: []map[string]string{},
+		StepTemplates: map[string]screwdriver.StepTemplate{
+			"greet": {
+				Params: map[string]string{"WHO": "you"},
+				Steps:  []screwdriver.CommandDef{{Name: "say", Cmd: `echo "hello $WHO"`}},
+			},
+		},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	emitter := &MockEmitter{}
+
+	if err := Run("", nil, emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := map[string]int{"greet-say": 0, "greet-again-say": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Unexpected exit codes %v, want %v", codes, want)
+	}
+	for _, line := range []string{"\nhello world", "\nhello you"} {
+		if !strings.Contains(string(emitter.found), line) {
+			t.Errorf("Missing %q in the output %q", line, emitter.found)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// Returns the terminal the launcher runs in, as in local mode, or nil
+func launcherTerminal() *os.File {
+	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+		if _, err := pty.GetsizeFull(f); err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// Gives the pty f of the build shell the size of the terminal tty, if any, and again every time the
+// launcher gets SIGWINCH for a resize of the terminal, until ctx is done. The shell gets SIGWINCH
+// in turn, so the output of the steps fits the terminal. The returned channel is closed once f is
+// not resized anymore, which the caller waits for after ctx is done before closing the files.
+func propagateTerminalSize(ctx context.Context, tty, f *os.File) <-chan struct{} {
+	done := make(chan struct{})
+	if tty == nil {
+		close(done)
+		return done
+	}
+	if err := pty.InheritSize(tty, f); err != nil {
+		logger.Warnf("Failed to set the size of the pty to the size of the terminal: %v", err)
+		close(done)
+		return done
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+
+	go func() {
+		defer close(done)
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+				if err := pty.InheritSize(tty, f); err != nil {
+					logger.Debugf("Failed to resize the pty: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,61 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+func TestPropagateTerminalSize(t *testing.T) {
+	// The terminal of the launcher, and the pty of the build shell
+	termPty, term, err := pty.Open()
+	if err != nil {
+		t.Skipf("Cannot open a pty: %v", err)
+	}
+	defer termPty.Close()
+	defer term.Close()
+	shellPty, shellTty, err := pty.Open()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer shellPty.Close()
+	defer shellTty.Close()
+
+	if err := pty.Setsize(term, &pty.Winsize{Rows: 40, Cols: 120}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resized := propagateTerminalSize(ctx, term, shellPty)
+	// The pty is not resized anymore by the time the deferred calls close it
+	defer func() {
+		cancel()
+		<-resized
+	}()
+	if rows, cols, err := pty.Getsize(shellTty); err != nil || rows != 40 || cols != 120 {
+		t.Errorf("Size of the pty = %dx%d, %v, want 40x120", rows, cols, err)
+	}
+
+	// Resizing the terminal sends SIGWINCH
+	if err := pty.Setsize(term, &pty.Winsize{Rows: 50, Cols: 200}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows, cols, err := pty.Getsize(shellTty)
+		if err == nil && rows == 50 && cols == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Size of the pty after SIGWINCH = %dx%d, %v, want 50x200", rows, cols, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Without a terminal the size of the pty stays as it is
+	<-propagateTerminalSize(ctx, nil, shellPty)
+}
@@ -0,0 +1,82 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// defaultStepTokenTTL is how long the step tokens last by default, in seconds
+const defaultStepTokenTTL = 3600
+
+// stepTokens gives every user step its own short-lived token with a limited scope, minted by the
+// API, instead of the build token. The Screwdriver setup steps and teardowns keep the build token.
+type stepTokens struct {
+	api     screwdriver.API
+	buildID int
+	scope   []string
+	ttl     int
+}
+
+// Returns the step tokens with the comma separated scope of SD_STEP_TOKEN_SCOPE (e.g.
+// "store,meta") and the lifetime in seconds of SD_STEP_TOKEN_TTL from the launcher environment,
+// or nil if the scope is not set
+func newStepTokens(api screwdriver.API, buildID int) (*stepTokens, error) {
+	var scope []string
+	for _, s := range strings.Split(os.Getenv("SD_STEP_TOKEN_SCOPE"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scope = append(scope, s)
+		}
+	}
+	if len(scope) == 0 {
+		return nil, nil
+	}
+
+	ttl := defaultStepTokenTTL
+	if value := strings.TrimSpace(os.Getenv("SD_STEP_TOKEN_TTL")); value != "" {
+		var err error
+		if ttl, err = strconv.Atoi(value); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("Invalid SD_STEP_TOKEN_TTL %q, want a number of seconds", value)
+		}
+	}
+	return &stepTokens{api: api, buildID: buildID, scope: scope, ttl: ttl}, nil
+}
+
+// Returns a new token for step
+func (t *stepTokens) mint(step string) (string, error) {
+	token, err := t.api.GetStepToken(t.buildID, step, t.scope, t.ttl)
+	if err != nil {
+		return "", fmt.Errorf("Getting the token of step %q: %v", step, err)
+	}
+	return token, nil
+}
+
+// Returns env without the build token when the steps get their own tokens
+func (t *stepTokens) shellEnv(env []string) []string {
+	if t == nil {
+		return env
+	}
+	return setEnv(env, "SD_TOKEN", "")
+}
+
+// Returns env with key set to value, or without key if value is empty
+func setEnv(env []string, key, value string) []string {
+	var out []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			out = append(out, kv)
+		}
+	}
+	if value != "" {
+		out = append(out, key+"="+value)
+	}
+	return out
+}
+
+// Returns the shell line exporting the token of a step
+func exportToken(token string) string {
+	return "export SD_TOKEN=" + shellQuote(token) + "\n"
+}
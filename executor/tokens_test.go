@@ -0,0 +1,91 @@
+package executor
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestNewStepTokens(t *testing.T) {
+	defer os.Unsetenv("SD_STEP_TOKEN_SCOPE")
+	defer os.Unsetenv("SD_STEP_TOKEN_TTL")
+
+	if tokens, err := newStepTokens(MockAPI{}, 1); tokens != nil || err != nil {
+		t.Errorf("newStepTokens() without a scope = %v, %v, want nil", tokens, err)
+	}
+
+	os.Setenv("SD_STEP_TOKEN_SCOPE", "store, meta,")
+	tokens, err := newStepTokens(MockAPI{}, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(tokens.scope, []string{"store", "meta"}) || tokens.ttl != defaultStepTokenTTL {
+		t.Errorf("Unexpected step tokens %+v", tokens)
+	}
+
+	for _, ttl := range []string{"soon", "-5"} {
+		os.Setenv("SD_STEP_TOKEN_TTL", ttl)
+		if _, err := newStepTokens(MockAPI{}, 1); err == nil {
+			t.Errorf("Expected an error for the TTL %q", ttl)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	env := []string{"SD_TOKEN=build", "FOO=bar", "SD_TOKEN_X=y"}
+	if got, want := setEnv(env, "SD_TOKEN", "step"), []string{"FOO=bar", "SD_TOKEN_X=y", "SD_TOKEN=step"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("setEnv() = %v, want %v", got, want)
+	}
+	if got, want := setEnv(env, "SD_TOKEN", ""), []string{"FOO=bar", "SD_TOKEN_X=y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("setEnv() = %v, want %v", got, want)
+	}
+}
+
+func TestRunUsesStepTokens(t *testing.T) {
+	envFilepath := "/tmp/testStepTokens"
+	setupTestCase(t, envFilepath)
+	os.Setenv("SD_STEP_TOKEN_SCOPE", "store")
+	defer os.Unsetenv("SD_STEP_TOKEN_SCOPE")
+	os.Setenv("SD_STEP_TOKEN_TTL", "600")
+	defer os.Unsetenv("SD_STEP_TOKEN_TTL")
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: `test "$SD_TOKEN" = buildtoken`, Name: "sd-setup-scm"},
+			{Cmd: `test "$SD_TOKEN" = token-install`, Name: "install"},
+			{Cmd: `test "$SD_TOKEN" = "token-publish"`, Name: "publish"},
+			{Cmd: `test "$SD_TOKEN" = token-teardown-report`, Name: "teardown-report"},
+			{Cmd: `test "$SD_TOKEN" = buildtoken && ! grep -q token- ` + envFilepath + "_export", Name: "sd-teardown-artifacts"},
+		},
+		Environment: []map[string]string{},
+	}
+
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+		getStepToken: func(buildID int, stepName string, scope []string, ttlSeconds int) (string, error) {
+			if !reflect.DeepEqual(scope, []string{"store"}) || ttlSeconds != 600 {
+				t.Errorf("Unexpected token request for %q: %v, %d", stepName, scope, ttlSeconds)
+			}
+			if strings.HasPrefix(stepName, "sd-") {
+				t.Errorf("The Screwdriver step %q should keep the build token", stepName)
+			}
+			return "token-" + stepName, nil
+		},
+	})
+
+	env := []string{"SD_TOKEN=buildtoken"}
+	if err := Run("", env, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Errorf("Unexpected error: %v, exit codes %v", err, codes)
+	}
+	if info, err := os.Stat(stepScriptPath(envFilepath+"_steps", 2, "publish")); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("The step script with a token should only be readable by its owner: %v, %v", info, err)
+	}
+}
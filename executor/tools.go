@@ -0,0 +1,131 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// toolsDir is where the image installs the tools the launcher and the steps run (sd-cmd,
+// sd-step, store-cli, habitat packages...). Relative paths in the checksum manifest are in it.
+const toolsDir = "/opt/sd"
+
+// toolChecksum is the expected SHA256 checksum of a tool
+type toolChecksum struct {
+	path string
+	sum  string
+}
+
+// Verifies the tools against the SHA256 checksums in the manifest at SD_TOOL_CHECKSUMS in the
+// launcher environment, if it is set. Returns an error for any missing or modified tool.
+func verifyTools() error {
+	path := strings.TrimSpace(os.Getenv("SD_TOOL_CHECKSUMS"))
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	checksums, err := parseToolChecksums(data, toolsDir)
+	if err != nil {
+		return fmt.Errorf("Parsing the tool checksums %s: %v", path, err)
+	}
+
+	for _, c := range checksums {
+		sum, err := fileSHA256(c.path)
+		if err != nil {
+			return err
+		}
+		if sum != c.sum {
+			return fmt.Errorf("Checksum mismatch for %s: got sha256 %s, want %s", c.path, sum, c.sum)
+		}
+	}
+	logger.Infof("Verified the checksums of %d tools", len(checksums))
+	return nil
+}
+
+// Parses a manifest in the output format of sha256sum, "<hex digest>  <path>" per line, with the
+// relative paths resolved in dir
+func parseToolChecksums(data []byte, dir string) ([]toolChecksum, error) {
+	var checksums []toolChecksum
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"<sha256> <path>\"", n)
+		}
+		sum := strings.ToLower(fields[0])
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid sha256 %q", n, fields[0])
+		}
+		// sha256sum marks the files read in binary mode with a *
+		path := strings.TrimPrefix(fields[1], "*")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		checksums = append(checksums, toolChecksum{path: path, sum: sum})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(checksums) == 0 {
+		return nil, fmt.Errorf("No checksums")
+	}
+	return checksums, nil
+}
+
+// Returns the hex SHA256 digest of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WarmTools reads the tools of the tools directory once, for the builds to find them in the page
+// cache, and verifies their checksums. Returns how many files it read.
+func WarmTools() (int, error) {
+	n := 0
+	err := filepath.Walk(toolsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(ioutil.Discard, f); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return n, err
+	}
+	return n, verifyTools()
+}
@@ -0,0 +1,82 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// SHA256 of "hello\n"
+const helloSHA256 = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+func TestParseToolChecksums(t *testing.T) {
+	manifest := "# tools\n" +
+		helloSHA256 + "  sd-cmd\n" +
+		strings.ToUpper(helloSHA256) + " */usr/sd/bin/jq\n"
+	checksums, err := parseToolChecksums([]byte(manifest), "/opt/sd")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []toolChecksum{{"/opt/sd/sd-cmd", helloSHA256}, {"/usr/sd/bin/jq", helloSHA256}}
+	if fmt.Sprint(checksums) != fmt.Sprint(want) {
+		t.Errorf("parseToolChecksums() = %v, want %v", checksums, want)
+	}
+
+	for _, invalid := range []string{"", "# nothing\n", "sd-cmd\n", "abc sd-cmd\n", helloSHA256 + "  a b\n"} {
+		if _, err := parseToolChecksums([]byte(invalid), "/opt/sd"); err == nil {
+			t.Errorf("Expected an error for the manifest %q", invalid)
+		}
+	}
+}
+
+func TestVerifyTools(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	tool := filepath.Join(tmp, "sd-cmd")
+	ioutil.WriteFile(tool, []byte("hello\n"), 0755)
+	manifest := filepath.Join(tmp, "checksums")
+	ioutil.WriteFile(manifest, []byte(helloSHA256+"  "+tool+"\n"), 0644)
+	os.Setenv("SD_TOOL_CHECKSUMS", manifest)
+	defer os.Unsetenv("SD_TOOL_CHECKSUMS")
+
+	if err := verifyTools(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	ioutil.WriteFile(tool, []byte("tampered\n"), 0755)
+	if err := verifyTools(); err == nil || !strings.Contains(err.Error(), "Checksum mismatch for "+tool) {
+		t.Errorf("verifyTools() = %v, want a checksum mismatch", err)
+	}
+
+	// The build fails as an infrastructure error before any step runs
+	testBuild := screwdriver.Build{
+		ID:       12345,
+		Commands: []screwdriver.CommandDef{{Cmd: "echo hi", Name: "test"}},
+	}
+	started := false
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStart: func(buildID int, stepName string) error {
+			started = true
+			return nil
+		},
+	})
+	err = Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, "/tmp/testTools", "")
+	if !errors.Is(err, ErrInfra) || started {
+		t.Errorf("Run() = %v (steps started: %v), want an infrastructure error", err, started)
+	}
+
+	os.Remove(tool)
+	if err := verifyTools(); err == nil {
+		t.Errorf("Expected an error for a missing tool")
+	}
+}
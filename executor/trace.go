@@ -0,0 +1,153 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// traceMarker follows the + of PS4 on the lines of the shell trace of a step, which bash repeats
+// for each level of nesting, to tell them from its output
+const traceMarker = "sd-trace "
+
+// Returns an error if the step of cmd cannot be traced: a teardown, which does not run a step
+// script, or a step with an interpreter, which runs no shell
+func checkTrace(cmd screwdriver.CommandDef, stepType string) error {
+	if !cmd.Trace {
+		return nil
+	}
+	if stepType == screwdriver.StepTypeTeardown || stepType == screwdriver.StepTypeSDTeardown {
+		return fmt.Errorf("Teardown %q cannot be traced", cmd.Name)
+	}
+	if cmd.Interpreter != "" {
+		return fmt.Errorf("Step %q with an interpreter cannot be traced", cmd.Name)
+	}
+	return nil
+}
+
+// Returns the lines of the step script of cmd, run by shellBin, turning the shell trace on with the
+// marker, or "" if the step is not traced. fish has no shell trace of this kind.
+func traceStart(cmd screwdriver.CommandDef, shellBin string) string {
+	if !cmd.Trace || isFish(shellBin) {
+		return ""
+	}
+	return "sd_ps4=$PS4; PS4='+" + traceMarker + "'\nset -x\n"
+}
+
+// Returns the end of the step script of cmd turning the shell trace off again, for a step sourced
+// by the build shell, which would keep it on for the next steps, or "" if there is no need. The
+// script still ends with the exit status of the command, which fails the build shell if it failed.
+func traceStop(cmd screwdriver.CommandDef, shellBin string) string {
+	if !cmd.Trace || isFish(shellBin) || runsApart(cmd) {
+		return ""
+	}
+	return "\n{ sd_status=$?; set +x; PS4=$sd_ps4; unset sd_ps4; } 2>/dev/null\nreturn $sd_status\n"
+}
+
+// Returns the emitter of the output of the step of cmd to out, logging the lines of its shell trace
+// to the trace stream of emitter with + and no marker. The output of a step that is not traced goes
+// through as it is, and the lines of the trace stay in the output if emitter does not log it apart.
+func traceOutput(cmd screwdriver.CommandDef, out, emitter screwdriver.Emitter) *traceEmitter {
+	t := &traceEmitter{Emitter: out}
+	if !cmd.Trace {
+		return t
+	}
+	t.trace = out
+	if stream, scanners := scannedStream(emitter, func(e screwdriver.Emitter) io.WriteCloser {
+		if e, ok := e.(screwdriver.TraceEmitter); ok {
+			return e.Trace()
+		}
+		return nil
+	}); stream != nil {
+		t.trace, t.closer = scannedWriter{scanners, stream}, stream
+	}
+	return t
+}
+
+// traceEmitter sorts the lines of the shell trace of a step out of its output. A line is held
+// until it cannot be one of them anymore.
+type traceEmitter struct {
+	screwdriver.Emitter
+	// trace is where the lines of the trace go, nil if the step is not traced
+	trace  io.Writer
+	closer io.Closer
+	// line is the start of a line held, and midLine whether the line written last is not over
+	line    []byte
+	midLine bool
+}
+
+func (t *traceEmitter) Write(p []byte) (int, error) {
+	if t.trace == nil {
+		return t.Emitter.Write(p)
+	}
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if t.midLine {
+			end := len(p)
+			if i >= 0 {
+				end = i + 1
+			}
+			if _, err := t.Emitter.Write(p[:end]); err != nil {
+				return n - len(p), err
+			}
+			t.midLine, p = i < 0, p[end:]
+			continue
+		}
+		if i < 0 {
+			t.line = append(t.line, p...)
+			if !mayBeTrace(t.line) {
+				if _, err := t.Emitter.Write(t.line); err != nil {
+					return n - len(p), err
+				}
+				t.line, t.midLine = nil, true
+			}
+			break
+		}
+		line := append(t.line, p[:i+1]...)
+		t.line, p = nil, p[i+1:]
+		if err := t.writeLine(line); err != nil {
+			return n - len(p), err
+		}
+	}
+	return n, nil
+}
+
+// Writes a whole line of the output to the trace if it is one of its lines, or else to the output
+func (t *traceEmitter) writeLine(line []byte) error {
+	plus := len(line) - len(bytes.TrimLeft(line, "+"))
+	if plus > 0 && bytes.HasPrefix(line[plus:], []byte(traceMarker)) {
+		_, err := t.trace.Write(append(line[:plus:plus], append([]byte(" "), line[plus+len(traceMarker):]...)...))
+		return err
+	}
+	_, err := t.Emitter.Write(line)
+	return err
+}
+
+// Returns whether the start of a line may still be a line of the trace
+func mayBeTrace(start []byte) bool {
+	rest := bytes.TrimLeft(start, "+")
+	if len(rest) == len(start) {
+		return false
+	}
+	if len(rest) < len(traceMarker) {
+		return bytes.HasPrefix([]byte(traceMarker), rest)
+	}
+	return bytes.HasPrefix(rest, []byte(traceMarker))
+}
+
+// Writes the line held, if any, and stops logging the trace of the step
+func (t *traceEmitter) close() {
+	if t.trace == nil {
+		return
+	}
+	if len(t.line) > 0 {
+		t.writeLine(t.line)
+		t.line = nil
+	}
+	if t.closer != nil {
+		t.closer.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/stretchr/testify/assert"
+)
+
+// traceStreamEmitter is a MockEmitter logging the shell trace apart
+type traceStreamEmitter struct {
+	MockEmitter
+	trace bytes.Buffer
+}
+
+func (e *traceStreamEmitter) Trace() io.WriteCloser {
+	return nopWriteCloser{&e.trace}
+}
+
+func TestCheckTrace(t *testing.T) {
+	tests := []struct {
+		cmd      screwdriver.CommandDef
+		stepType string
+		err      bool
+	}{
+		{screwdriver.CommandDef{Name: "test", Trace: true}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "test", Trace: true, Image: "node:16"}, screwdriver.StepTypeUser, false},
+		{screwdriver.CommandDef{Name: "teardown-test", Trace: true}, screwdriver.StepTypeTeardown, true},
+		{screwdriver.CommandDef{Name: "test", Trace: true, Interpreter: "python3"}, screwdriver.StepTypeUser, true},
+		{screwdriver.CommandDef{Name: "teardown-test"}, screwdriver.StepTypeTeardown, false},
+	}
+	for _, test := range tests {
+		if err := checkTrace(test.cmd, test.stepType); (err != nil) != test.err {
+			t.Errorf("checkTrace(%+v, %q) = %v, want error %v", test.cmd, test.stepType, err, test.err)
+		}
+	}
+}
+
+func TestTraceEmitter(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Trace: true}
+	base := &traceStreamEmitter{}
+	out := traceOutput(cmd, base, newFailureSummarizer(base, 5))
+	for _, chunk := range []string{"+sd-trace make\r\n", "building", "...\r\n+", "+sd-", "trace echo ok\r\n", "ok\r\n", "++ not traced\r\n", "+sd-trace tail"} {
+		fmt.Fprint(out, chunk)
+	}
+	out.close()
+	assert.Equal(t, "building...\r\nok\r\n++ not traced\r\n", string(base.found))
+	assert.Equal(t, "+ make\r\n++ echo ok\r\n+ tail", base.trace.String())
+
+	// The trace stays in the output without a trace stream
+	base = &traceStreamEmitter{}
+	out = traceOutput(cmd, &base.MockEmitter, &base.MockEmitter)
+	fmt.Fprint(out, "+sd-trace make\nbuilt\n")
+	out.close()
+	assert.Equal(t, "+ make\nbuilt\n", string(base.found))
+
+	// The output of a step that is not traced goes through
+	base = &traceStreamEmitter{}
+	out = traceOutput(screwdriver.CommandDef{Name: "test"}, base, base)
+	fmt.Fprint(out, "+sd-trace make\n")
+	out.close()
+	assert.Equal(t, "+sd-trace make\n", string(base.found))
+}
+
+func TestRunTracesStep(t *testing.T) {
+	envFilepath := "/tmp/testTrace"
+	setupTestCase(t, envFilepath)
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Name: "traced", Cmd: "GREETING=hi\necho \"$GREETING\"", Trace: true},
+			{Name: "quiet", Cmd: "echo done"},
+		},
+		Environment: []map[string]string{},
+	}
+	emitter := &traceStreamEmitter{}
+	if err := Run("", nil, emitter, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	trace := emitter.trace.String()
+	if !strings.Contains(trace, "+ GREETING=hi") || !strings.Contains(trace, "+ echo hi") {
+		t.Errorf("The trace of the step should be logged apart, got %q", trace)
+	}
+	if strings.Contains(trace, "done") || strings.Contains(trace, "set +x") {
+		t.Errorf("The trace should stop with the step, got %q", trace)
+	}
+	if output := string(emitter.found); strings.Contains(output, traceMarker) || !strings.Contains(output, "hi\n") {
+		t.Errorf("The output should have no trace, got %q", output)
+	}
+
+	// The end of the trace does not hide that the step failed
+	envFilepath = "/tmp/testTraceFailure"
+	setupTestCase(t, envFilepath)
+	testBuild.Commands = []screwdriver.CommandDef{{Name: "traced", Cmd: "true && sh -c 'exit 5' && true", Trace: true}}
+	err := Run("", nil, &traceStreamEmitter{}, testBuild, screwdriver.API(MockAPI{}), testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	assert.Equal(t, StepFailure{Step: "traced", Code: 5}, err)
+}
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// How often the memory of a running step is sampled
+const usageSampleInterval = time.Second
+
+// procDir is where the process information is read from on Linux, replaced in tests
+var procDir = "/proc"
+
+// procUsage is a reading of the resources used so far by a process group
+type procUsage struct {
+	cpu        time.Duration
+	rss        int64
+	readBytes  int64
+	writeBytes int64
+}
+
+// usageTracker measures the resources a process group consumes while a step runs in it
+type usageTracker struct {
+	pgid  int
+	start procUsage
+	ok    bool
+
+	mu   sync.Mutex
+	peak int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Starts measuring the resources used by the process group pgid
+func startUsageTracker(pgid int) *usageTracker {
+	u := &usageTracker{
+		pgid: pgid,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	start, err := readProcUsage(pgid)
+	if err != nil {
+		close(u.done)
+		return u
+	}
+	u.start = start
+	u.peak = start.rss
+	u.ok = true
+
+	go func() {
+		defer close(u.done)
+		ticker := time.NewTicker(usageSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case <-ticker.C:
+				if cur, err := readProcUsage(pgid); err == nil {
+					u.sample(cur)
+				}
+			}
+		}
+	}()
+
+	return u
+}
+
+func (u *usageTracker) sample(cur procUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if cur.rss > u.peak {
+		u.peak = cur.rss
+	}
+}
+
+// Stop ends the measurement and returns what the process group consumed since it started,
+// or nil if it could not be measured. The peak memory is sampled, short spikes may be missed.
+func (u *usageTracker) Stop() *screwdriver.ResourceUsage {
+	if !u.ok {
+		return nil
+	}
+	close(u.stop)
+	<-u.done
+
+	end, err := readProcUsage(u.pgid)
+	if err != nil {
+		return nil
+	}
+	u.sample(end)
+
+	return &screwdriver.ResourceUsage{
+		CPUTimeMs:   int64((end.cpu - u.start.cpu) / time.Millisecond),
+		MaxRSSBytes: u.peak,
+		ReadBytes:   end.readBytes - u.start.readBytes,
+		WriteBytes:  end.writeBytes - u.start.writeBytes,
+	}
+}
+
+// Returns the resources used by a command that has exited, from its rusage
+func rusageOf(state *os.ProcessState) *screwdriver.ResourceUsage {
+	if state == nil {
+		return nil
+	}
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+
+	return &screwdriver.ResourceUsage{
+		CPUTimeMs:   int64((state.UserTime() + state.SystemTime()) / time.Millisecond),
+		MaxRSSBytes: int64(ru.Maxrss) * maxRSSUnit,
+		ReadBytes:   int64(ru.Inblock) * 512,
+		WriteBytes:  int64(ru.Oublock) * 512,
+	}
+}
@@ -0,0 +1,58 @@
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUsageTracker(t *testing.T) {
+	if _, err := readProcUsage(syscall.Getpgrp()); err != nil {
+		t.Skipf("Cannot read the usage of processes on this system: %v", err)
+	}
+
+	c := exec.Command("/bin/sh", "-c", "i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done; read x")
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Wait()
+
+	tracker := startUsageTracker(c.Process.Pid)
+	time.Sleep(usageSampleInterval + 200*time.Millisecond)
+	usage := tracker.Stop()
+	stdin.Close()
+
+	if usage == nil {
+		t.Fatalf("expected the usage of the process group")
+	}
+	if usage.MaxRSSBytes <= 0 {
+		t.Errorf("expected a peak memory, got %+v", usage)
+	}
+	if usage.CPUTimeMs < 0 || usage.ReadBytes < 0 || usage.WriteBytes < 0 {
+		t.Errorf("usage should not be negative: %+v", usage)
+	}
+}
+
+func TestRusageOf(t *testing.T) {
+	c := exec.Command("/bin/sh", "-c", "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done")
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	usage := rusageOf(c.ProcessState)
+	if usage == nil {
+		t.Fatalf("expected the usage of the command")
+	}
+	if usage.MaxRSSBytes <= 0 {
+		t.Errorf("expected a peak memory, got %+v", usage)
+	}
+	if rusageOf(nil) != nil {
+		t.Errorf("expected no usage for a command that did not run")
+	}
+}
@@ -0,0 +1,212 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const (
+	// Webhook events
+	webhookStepStart     = "step_start"
+	webhookStepStop      = "step_stop"
+	webhookBuildComplete = "build_complete"
+
+	// webhookSignatureHeader carries the HMAC-SHA256 of the body when a secret is configured
+	webhookSignatureHeader = "X-Screwdriver-Signature"
+	// How many events may wait to be sent before new ones are dropped
+	webhookQueueSize = 64
+	// How long a single webhook call may take
+	webhookTimeout = 10 * time.Second
+	// How long the end of the build waits for the pending events to be sent
+	webhookFlushTimeout = 15 * time.Second
+)
+
+// webhookEvent is the data of a step or build state change, sent as JSON or rendered by the
+// webhook template
+type webhookEvent struct {
+	Event   string    `json:"event"`
+	BuildID int       `json:"buildId"`
+	Step    string    `json:"step,omitempty"`
+	Time    time.Time `json:"time"`
+	// Code is the exit code of a stopped step
+	Code int `json:"code"`
+	// Status is the result of a stopped step or of the build (SUCCESS, FAILURE or ABORTED)
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// webhookNotifier calls the configured webhook on step and build state changes in the background,
+// so a slow endpoint never delays the build. A nil webhookNotifier sends nothing.
+type webhookNotifier struct {
+	url     string
+	tmpl    *template.Template
+	secret  []byte
+	buildID int
+	client  *http.Client
+	queue   chan webhookEvent
+	done    chan struct{}
+}
+
+// Returns a notifier for the webhook at SD_WEBHOOK_URL from the launcher environment, with the
+// body rendered by the Go template SD_WEBHOOK_TEMPLATE (the event as JSON by default) and signed
+// with SD_WEBHOOK_SECRET if set. An invalid template is logged and disables the webhook.
+func newWebhookNotifier(buildID int) *webhookNotifier {
+	url := strings.TrimSpace(os.Getenv("SD_WEBHOOK_URL"))
+	if url == "" {
+		return nil
+	}
+
+	var tmpl *template.Template
+	if text := os.Getenv("SD_WEBHOOK_TEMPLATE"); text != "" {
+		var err error
+		if tmpl, err = template.New("webhook").Parse(text); err != nil {
+			logger.Warnf("Not sending webhooks, invalid SD_WEBHOOK_TEMPLATE: %v", err)
+			return nil
+		}
+	}
+
+	n := &webhookNotifier{
+		url:     url,
+		tmpl:    tmpl,
+		secret:  []byte(os.Getenv("SD_WEBHOOK_SECRET")),
+		buildID: buildID,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan webhookEvent, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(n.done)
+		for event := range n.queue {
+			if err := n.send(event); err != nil {
+				logger.Warnf("Failed to send the %s webhook: %v", event.Event, err)
+			}
+		}
+	}()
+
+	return n
+}
+
+// Returns the body of the webhook call for event
+func (n *webhookNotifier) body(event webhookEvent) ([]byte, error) {
+	if n.tmpl == nil {
+		return json.Marshal(event)
+	}
+
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the hex HMAC-SHA256 of body with the webhook secret
+func (n *webhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Calls the webhook with event
+func (n *webhookNotifier) send(event webhookEvent) error {
+	body, err := n.body(event)
+	if err != nil {
+		return fmt.Errorf("Rendering the webhook template: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, n.sign(body))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Queues event to be sent, dropping it if too many are pending
+func (n *webhookNotifier) notify(event webhookEvent) {
+	if n == nil {
+		return
+	}
+
+	event.BuildID = n.buildID
+	event.Time = time.Now()
+	select {
+	case n.queue <- event:
+	default:
+		logger.Warnf("Dropping the %s webhook, too many are waiting to be sent", event.Event)
+	}
+}
+
+// Notifies that step started
+func (n *webhookNotifier) stepStart(step string) {
+	n.notify(webhookEvent{Event: webhookStepStart, Step: step})
+}
+
+// Notifies that step stopped with code
+func (n *webhookNotifier) stepStop(step string, code int, err error) {
+	n.notify(webhookEvent{Event: webhookStepStop, Step: step, Code: code, Status: resultStatus(code, err), Error: errorString(err)})
+}
+
+// Notifies that the build completed with err
+func (n *webhookNotifier) buildComplete(err error) {
+	n.notify(webhookEvent{Event: webhookBuildComplete, Status: resultStatus(ExitOk, err), Error: errorString(err)})
+}
+
+// Close waits up to timeout for the pending events to be sent
+func (n *webhookNotifier) Close(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+
+	close(n.queue)
+	select {
+	case <-n.done:
+	case <-time.After(timeout):
+		logger.Warnf("Gave up sending the pending webhooks after %v", timeout)
+	}
+}
+
+// Returns the status reported for a step or build that ended with code and err
+func resultStatus(code int, err error) string {
+	switch {
+	case errors.Is(err, ErrAborted):
+		return screwdriver.Aborted
+	case err != nil || code != ExitOk:
+		return screwdriver.Failure
+	}
+	return screwdriver.Success
+}
+
+// Returns the message of err, or "" if err is nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
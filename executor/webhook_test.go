@@ -0,0 +1,187 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// webhookRequest is a call received by the test webhook
+type webhookRequest struct {
+	body      []byte
+	signature string
+}
+
+// Starts a webhook endpoint recording the calls, and points SD_WEBHOOK_URL to it
+func startTestWebhook(t *testing.T, env map[string]string) func() []webhookRequest {
+	var mu sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Couldn't read the webhook body: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, webhookRequest{body, r.Header.Get(webhookSignatureHeader)})
+		mu.Unlock()
+	}))
+
+	env["SD_WEBHOOK_URL"] = server.URL
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	})
+
+	return func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	requests := startTestWebhook(t, map[string]string{"SD_WEBHOOK_SECRET": "s3cr3t"})
+
+	n := newWebhookNotifier(42)
+	n.stepStart("install")
+	n.stepStop("install", 3, StepFailure{Step: "install", Code: 3})
+	n.buildComplete(Aborted{Step: "test"})
+	n.Close(time.Second)
+
+	got := requests()
+	if len(got) != 3 {
+		t.Fatalf("webhook got %d calls, want 3", len(got))
+	}
+	wants := []webhookEvent{
+		{Event: webhookStepStart, BuildID: 42, Step: "install"},
+		{Event: webhookStepStop, BuildID: 42, Step: "install", Code: 3, Status: screwdriver.Failure, Error: StepFailure{Step: "install", Code: 3}.Error()},
+		{Event: webhookBuildComplete, BuildID: 42, Status: screwdriver.Aborted, Error: Aborted{Step: "test"}.Error()},
+	}
+	for i, want := range wants {
+		var event webhookEvent
+		if err := json.Unmarshal(got[i].body, &event); err != nil {
+			t.Fatalf("Couldn't parse the webhook body %q: %v", got[i].body, err)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("webhook %d has no time", i)
+		}
+		event.Time = time.Time{}
+		if !reflect.DeepEqual(event, want) {
+			t.Errorf("webhook %d = %+v, want %+v", i, event, want)
+		}
+		if got[i].signature != n.sign(got[i].body) {
+			t.Errorf("webhook %d has signature %q, want %q", i, got[i].signature, n.sign(got[i].body))
+		}
+	}
+
+	n = &webhookNotifier{secret: []byte("key")}
+	want := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if sig := n.sign([]byte("The quick brown fox jumps over the lazy dog")); sig != want {
+		t.Errorf("sign() = %q, want %q", sig, want)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	requests := startTestWebhook(t, map[string]string{
+		"SD_WEBHOOK_TEMPLATE": `{"text": "build {{.BuildID}} step {{.Step}} {{.Event}}"}`,
+	})
+
+	n := newWebhookNotifier(7)
+	n.stepStart("test")
+	n.Close(time.Second)
+
+	got := requests()
+	if len(got) != 1 || string(got[0].body) != `{"text": "build 7 step test step_start"}` {
+		t.Errorf("Unexpected webhook calls: %+v", got)
+	}
+	if got[0].signature != "" {
+		t.Errorf("Expected no signature without a secret, got %q", got[0].signature)
+	}
+}
+
+func TestWebhookDisabled(t *testing.T) {
+	if n := newWebhookNotifier(1); n != nil {
+		t.Errorf("Expected no webhook without SD_WEBHOOK_URL")
+	}
+	// a nil notifier sends nothing
+	var n *webhookNotifier
+	n.stepStart("test")
+	n.Close(time.Second)
+
+	startTestWebhook(t, map[string]string{"SD_WEBHOOK_TEMPLATE": "{{.Event"})
+	if n := newWebhookNotifier(1); n != nil {
+		t.Errorf("Expected no webhook with an invalid template")
+	}
+}
+
+func TestResultStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		err  error
+		want string
+	}{
+		{ExitOk, nil, screwdriver.Success},
+		{1, nil, screwdriver.Failure},
+		{1, StepFailure{Step: "test", Code: 1}, screwdriver.Failure},
+		{ExitTimeout, Timeout{Step: "test"}, screwdriver.Failure},
+		{ExitAborted, Aborted{Step: "test"}, screwdriver.Aborted},
+		{ExitOk, InfraError{"Updating step start", fmt.Errorf("boom")}, screwdriver.Failure},
+	}
+
+	for _, test := range tests {
+		if got := resultStatus(test.code, test.err); got != test.want {
+			t.Errorf("resultStatus(%v, %v) = %v, want %v", test.code, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRunSendsWebhooks(t *testing.T) {
+	envFilepath := "/tmp/testWebhooks"
+	setupTestCase(t, envFilepath)
+	requests := startTestWebhook(t, map[string]string{})
+
+	testBuild := screwdriver.Build{
+		ID: 12345,
+		Commands: []screwdriver.CommandDef{
+			{Cmd: "exit 2", Name: "fail"},
+			{Cmd: "echo done", Name: "sd-teardown-done"},
+		},
+		Environment: []map[string]string{},
+	}
+	if err := Run("", nil, &MockEmitter{}, testBuild, MockAPI{}, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, ""); err == nil {
+		t.Fatalf("Expected the build to fail")
+	}
+
+	var got []string
+	for _, r := range requests() {
+		var event webhookEvent
+		if err := json.Unmarshal(r.body, &event); err != nil {
+			t.Fatalf("Couldn't parse the webhook body %q: %v", r.body, err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d %s", event.Event, event.Step, event.Code, event.Status))
+	}
+	want := []string{
+		"step_start fail 0 ",
+		"step_stop fail 2 FAILURE",
+		"step_start sd-teardown-done 0 ",
+		"step_stop sd-teardown-done 0 SUCCESS",
+		"build_complete  0 FAILURE",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("webhooks = %q, want %q", got, want)
+	}
+}
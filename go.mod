@@ -9,9 +9,11 @@ require (
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/myesui/uuid v1.0.0 // indirect
 	github.com/peterbourgon/mergemap v0.0.0-20130613134717-e21c03b7a721
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli v1.22.2
-	golang.org/x/sys v0.0.0-20201009025420-dfb3f7c4e634 // indirect
+	golang.org/x/sys v0.0.0-20201009025420-dfb3f7c4e634
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/fatih/color.v1 v1.7.0
 	gopkg.in/stretchr/testify.v1 v1.2.2 // indirect
 )
@@ -0,0 +1,93 @@
+package identity
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAWSDuration is how long the AWS credentials last by default
+const defaultAWSDuration = time.Hour
+
+// assumeRoleResponse is the response of AssumeRoleWithWebIdentity
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// awsError is an error response of STS
+type awsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// AWS assumes the role roleARN with the identity token, as session, for duration (an hour if 0),
+// returning AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, and AWS_REGION and
+// AWS_DEFAULT_REGION if region is set, whose regional endpoint of STS is used then
+func (c *Client) AWS(token, roleARN, session, region string, duration time.Duration) (Credentials, error) {
+	if !strings.HasPrefix(roleARN, "arn:") {
+		return Credentials{}, fmt.Errorf("Invalid AWS role %q, want the ARN of a role", roleARN)
+	}
+	if duration == 0 {
+		duration = defaultAWSDuration
+	}
+	endpoint := c.awsSTS
+	if endpoint == "" {
+		endpoint = "https://sts.amazonaws.com/"
+		if region != "" {
+			endpoint = "https://sts." + region + ".amazonaws.com/"
+		}
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {token},
+		"DurationSeconds":  {strconv.Itoa(int(duration / time.Second))},
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := c.do(req)
+	if err != nil {
+		var e awsError
+		if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+			return Credentials{}, fmt.Errorf("Assuming AWS role %s: %s: %s", roleARN, e.Code, e.Message)
+		}
+		return Credentials{}, fmt.Errorf("Assuming AWS role %s: %v", roleARN, err)
+	}
+
+	var res assumeRoleResponse
+	if err := xml.Unmarshal(body, &res); err != nil {
+		return Credentials{}, fmt.Errorf("Parsing the STS response: %v", err)
+	}
+	if res.Credentials.AccessKeyID == "" || res.Credentials.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("Assuming AWS role %s: no credentials", roleARN)
+	}
+	credentials := Credentials{
+		Env: map[string]string{},
+		Secrets: map[string]string{
+			"AWS_ACCESS_KEY_ID":     res.Credentials.AccessKeyID,
+			"AWS_SECRET_ACCESS_KEY": res.Credentials.SecretAccessKey,
+			"AWS_SESSION_TOKEN":     res.Credentials.SessionToken,
+		},
+		Expiration: res.Credentials.Expiration,
+	}
+	if region != "" {
+		credentials.Env["AWS_REGION"] = region
+		credentials.Env["AWS_DEFAULT_REGION"] = region
+	}
+	return credentials, nil
+}
@@ -0,0 +1,67 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// azureScope is the scope of the Azure access tokens, Azure Resource Manager
+const azureScope = "https://management.azure.com/.default"
+
+// azureID matches the tenant and client IDs, GUIDs, or the tenant domains
+var azureID = regexp.MustCompile(`^[\w.-]+$`)
+
+// Azure gets an access token of Azure Resource Manager for the application clientID of the
+// tenant, with the identity token as its federated credential, returning it in AZURE_ACCESS_TOKEN
+// with AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_SUBSCRIPTION_ID if set
+func (c *Client) Azure(token, tenantID, clientID, subscriptionID string) (Credentials, error) {
+	if !azureID.MatchString(tenantID) || !azureID.MatchString(clientID) {
+		return Credentials{}, fmt.Errorf("Invalid Azure tenant %q or client %q", tenantID, clientID)
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {token},
+		"scope":                 {azureScope},
+	}
+	req, err := http.NewRequest("POST", c.azureLogin+tenantID+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := c.do(req)
+	if err != nil {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return Credentials{}, fmt.Errorf("Getting an Azure token of %s: %s: %s", clientID, e.Error, e.Description)
+		}
+		return Credentials{}, fmt.Errorf("Getting an Azure token of %s: %v", clientID, err)
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.AccessToken == "" {
+		return Credentials{}, fmt.Errorf("Getting an Azure token of %s: no access token", clientID)
+	}
+
+	credentials := Credentials{
+		Env:        map[string]string{"AZURE_TENANT_ID": tenantID, "AZURE_CLIENT_ID": clientID},
+		Secrets:    map[string]string{"AZURE_ACCESS_TOKEN": res.AccessToken},
+		Expiration: time.Now().Add(time.Duration(res.ExpiresIn) * time.Second),
+	}
+	if subscriptionID != "" {
+		credentials.Env["AZURE_SUBSCRIPTION_ID"] = subscriptionID
+	}
+	return credentials, nil
+}
@@ -0,0 +1,97 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gcpScope is the OAuth scope of the Google Cloud access tokens
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// GCPAudience returns the audience of the identity tokens the workload identity provider of
+// Google Cloud, //iam.googleapis.com/projects/.../providers/..., accepts by default
+func GCPAudience(provider string) string {
+	return "https:" + provider
+}
+
+// GCP exchanges the identity token with the workload identity provider of Google Cloud for a
+// federated access token, and for an access token of the service account if set, returning it in
+// GOOGLE_OAUTH_ACCESS_TOKEN, and the project in GOOGLE_CLOUD_PROJECT and CLOUDSDK_CORE_PROJECT if
+// set
+func (c *Client) GCP(token, provider, serviceAccount, project string) (Credentials, error) {
+	if !strings.HasPrefix(provider, "//iam.googleapis.com/") {
+		return Credentials{}, fmt.Errorf("Invalid Google Cloud provider %q, want //iam.googleapis.com/projects/.../providers/...", provider)
+	}
+
+	exchange, err := json.Marshal(map[string]string{
+		"grantType":          "urn:ietf:params:oauth:grant-type:token-exchange",
+		"audience":           provider,
+		"scope":              gcpScope,
+		"requestedTokenType": "urn:ietf:params:oauth:token-type:access_token",
+		"subjectToken":       token,
+		"subjectTokenType":   "urn:ietf:params:oauth:token-type:jwt",
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	req, err := http.NewRequest("POST", c.gcpSTS, bytes.NewReader(exchange))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	body, err := c.do(req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Exchanging the token with %s: %v", provider, err)
+	}
+	var federated struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &federated); err != nil || federated.AccessToken == "" {
+		return Credentials{}, fmt.Errorf("Exchanging the token with %s: no access token", provider)
+	}
+	accessToken := federated.AccessToken
+	expiration := time.Now().Add(time.Duration(federated.ExpiresIn) * time.Second)
+
+	if serviceAccount != "" {
+		generate, err := json.Marshal(map[string]interface{}{"scope": []string{gcpScope}})
+		if err != nil {
+			return Credentials{}, err
+		}
+		u := c.gcpIAM + "projects/-/serviceAccounts/" + url.PathEscape(serviceAccount) + ":generateAccessToken"
+		req, err := http.NewRequest("POST", u, bytes.NewReader(generate))
+		if err != nil {
+			return Credentials{}, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+federated.AccessToken)
+		body, err := c.do(req)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("Impersonating %s: %v", serviceAccount, err)
+		}
+		var impersonated struct {
+			AccessToken string    `json:"accessToken"`
+			ExpireTime  time.Time `json:"expireTime"`
+		}
+		if err := json.Unmarshal(body, &impersonated); err != nil || impersonated.AccessToken == "" {
+			return Credentials{}, fmt.Errorf("Impersonating %s: no access token", serviceAccount)
+		}
+		accessToken, expiration = impersonated.AccessToken, impersonated.ExpireTime
+	}
+
+	credentials := Credentials{
+		Env:        map[string]string{},
+		Secrets:    map[string]string{"GOOGLE_OAUTH_ACCESS_TOKEN": accessToken},
+		Expiration: expiration,
+	}
+	if project != "" {
+		credentials.Env["GOOGLE_CLOUD_PROJECT"] = project
+		credentials.Env["CLOUDSDK_CORE_PROJECT"] = project
+	}
+	return credentials, nil
+}
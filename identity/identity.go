@@ -0,0 +1,81 @@
+// Package identity exchanges the OIDC identity token of a build for short-lived credentials of
+// AWS, Google Cloud and Azure, with their workload identity federations
+package identity
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// requestTimeout bounds a request to a cloud
+	requestTimeout = 30 * time.Second
+	// maxResponseBytes bounds the responses read
+	maxResponseBytes = 1 << 20
+)
+
+// Default audiences of the identity tokens the clouds accept
+const (
+	AWSAudience   = "sts.amazonaws.com"
+	AzureAudience = "api://AzureADTokenExchange"
+)
+
+// Credentials are the variables of the credentials of a cloud, Secrets those to mask and Env the
+// others
+type Credentials struct {
+	Env     map[string]string
+	Secrets map[string]string
+	// Expiration is when the credentials expire
+	Expiration time.Time
+}
+
+// Client exchanges identity tokens with the endpoints of the clouds
+type Client struct {
+	// awsSTS is the endpoint of AWS STS, the one of the region of the role if empty
+	awsSTS string
+	// gcpSTS and gcpIAM are the endpoints of the Security Token Service and IAM Credentials APIs
+	// of Google Cloud
+	gcpSTS, gcpIAM string
+	// azureLogin is the endpoint of Microsoft Entra ID
+	azureLogin string
+	http       *http.Client
+}
+
+// New returns a Client of the public endpoints of the clouds, or of the endpoints of
+// AWS_ENDPOINT_URL_STS and AZURE_AUTHORITY_HOST if set, as the SDKs of AWS and Azure do
+func New() *Client {
+	c := &Client{
+		awsSTS:     os.Getenv("AWS_ENDPOINT_URL_STS"),
+		gcpSTS:     "https://sts.googleapis.com/v1/token",
+		gcpIAM:     "https://iamcredentials.googleapis.com/v1/",
+		azureLogin: "https://login.microsoftonline.com/",
+		http:       &http.Client{Timeout: requestTimeout},
+	}
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		c.azureLogin = strings.TrimSuffix(host, "/") + "/"
+	}
+	return c
+}
+
+// Sends req, returning the body of the response, or an error with the body if the status is not
+// a success
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return body, fmt.Errorf("Status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
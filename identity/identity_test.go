@@ -0,0 +1,162 @@
+package identity
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a client of the fake endpoints of server
+func testClient(server *httptest.Server) *Client {
+	return &Client{
+		awsSTS:     server.URL + "/aws/",
+		gcpSTS:     server.URL + "/gcp/sts",
+		gcpIAM:     server.URL + "/gcp/iam/",
+		azureLogin: server.URL + "/azure/",
+		http:       server.Client(),
+	}
+}
+
+func TestAWS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		want := url.Values{
+			"Action":           {"AssumeRoleWithWebIdentity"},
+			"Version":          {"2011-06-15"},
+			"RoleArn":          {r.Form.Get("RoleArn")},
+			"RoleSessionName":  {"sd-build-42"},
+			"WebIdentityToken": {"idtoken"},
+			"DurationSeconds":  {"3600"},
+		}
+		if !reflect.DeepEqual(r.Form, want) {
+			t.Errorf("Form = %v, want %v", r.Form, want)
+		}
+		if r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/deploy" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<ErrorResponse><Error><Code>AccessDenied</Code><Message>Not authorized to perform sts:AssumeRoleWithWebIdentity</Message></Error></ErrorResponse>`))
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+			<AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+			<Expiration>2021-06-01T13:00:00Z</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer server.Close()
+	c := testClient(server)
+
+	credentials, err := c.AWS("idtoken", "arn:aws:iam::123456789012:role/deploy", "sd-build-42", "eu-west-1", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := Credentials{
+		Env:        map[string]string{"AWS_REGION": "eu-west-1", "AWS_DEFAULT_REGION": "eu-west-1"},
+		Secrets:    map[string]string{"AWS_ACCESS_KEY_ID": "ASIAEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_SESSION_TOKEN": "session"},
+		Expiration: time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(credentials, want) {
+		t.Errorf("AWS() = %+v, want %+v", credentials, want)
+	}
+
+	_, err = c.AWS("idtoken", "arn:aws:iam::123456789012:role/admin", "sd-build-42", "", time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied: Not authorized") {
+		t.Errorf("AWS() error = %v, want the error of STS", err)
+	}
+	if _, err := c.AWS("idtoken", "deploy", "sd-build-42", "", 0); err == nil {
+		t.Errorf("A role that is not an ARN should fail")
+	}
+}
+
+func TestGCP(t *testing.T) {
+	provider := "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/sd/providers/sd"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/gcp/sts":
+			if body["audience"] != provider || body["subjectToken"] != "idtoken" || body["grantType"] != "urn:ietf:params:oauth:grant-type:token-exchange" {
+				t.Errorf("Token exchange %v", body)
+			}
+			w.Write([]byte(`{"access_token": "federated", "token_type": "Bearer", "expires_in": 3600}`))
+		case "/gcp/iam/projects/-/serviceAccounts/deploy@project.iam.gserviceaccount.com:generateAccessToken":
+			if r.Header.Get("Authorization") != "Bearer federated" {
+				t.Errorf("Impersonation without the federated token: %v", r.Header)
+			}
+			w.Write([]byte(`{"accessToken": "impersonated", "expireTime": "2021-06-01T13:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "Not found"}}`))
+		}
+	}))
+	defer server.Close()
+	c := testClient(server)
+
+	credentials, err := c.GCP("idtoken", provider, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if credentials.Secrets["GOOGLE_OAUTH_ACCESS_TOKEN"] != "federated" || len(credentials.Env) != 0 {
+		t.Errorf("GCP() = %+v, want the federated token", credentials)
+	}
+
+	credentials, err = c.GCP("idtoken", provider, "deploy@project.iam.gserviceaccount.com", "project")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := Credentials{
+		Env:        map[string]string{"GOOGLE_CLOUD_PROJECT": "project", "CLOUDSDK_CORE_PROJECT": "project"},
+		Secrets:    map[string]string{"GOOGLE_OAUTH_ACCESS_TOKEN": "impersonated"},
+		Expiration: time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(credentials, want) {
+		t.Errorf("GCP() = %+v, want %+v", credentials, want)
+	}
+
+	if _, err := c.GCP("idtoken", provider, "other@project.iam.gserviceaccount.com", ""); err == nil || !strings.Contains(err.Error(), "Status 404") {
+		t.Errorf("GCP() error = %v, want the status of the impersonation", err)
+	}
+	if _, err := c.GCP("idtoken", "projects/123/providers/sd", "", ""); err == nil {
+		t.Errorf("An invalid provider should fail")
+	}
+	if got := GCPAudience(provider); got != "https:"+provider {
+		t.Errorf("GCPAudience() = %q", got)
+	}
+}
+
+func TestAzure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		if r.URL.Path != "/azure/tenant/oauth2/v2.0/token" || form.Get("client_assertion") != "idtoken" || form.Get("grant_type") != "client_credentials" {
+			t.Errorf("Token request %s %v", r.URL.Path, form)
+		}
+		if form.Get("client_id") != "client" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_client", "error_description": "AADSTS70021: No matching federated identity record found"}`))
+			return
+		}
+		w.Write([]byte(`{"token_type": "Bearer", "access_token": "azuretoken", "expires_in": 3599}`))
+	}))
+	defer server.Close()
+	c := testClient(server)
+
+	credentials, err := c.Azure("idtoken", "tenant", "client", "subscription")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	wantEnv := map[string]string{"AZURE_TENANT_ID": "tenant", "AZURE_CLIENT_ID": "client", "AZURE_SUBSCRIPTION_ID": "subscription"}
+	if !reflect.DeepEqual(credentials.Env, wantEnv) || credentials.Secrets["AZURE_ACCESS_TOKEN"] != "azuretoken" {
+		t.Errorf("Azure() = %+v", credentials)
+	}
+
+	if _, err := c.Azure("idtoken", "tenant", "other", ""); err == nil || !strings.Contains(err.Error(), "invalid_client: AADSTS70021") {
+		t.Errorf("Azure() error = %v, want the error of Entra ID", err)
+	}
+	if _, err := c.Azure("idtoken", "../tenant", "client", ""); err == nil {
+		t.Errorf("An invalid tenant should fail")
+	}
+}
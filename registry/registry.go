@@ -0,0 +1,199 @@
+// Package registry logs the builds in to container registries: Amazon ECR with AWS credentials,
+// Google Artifact Registry and Container Registry with a Google Cloud access token, and the others
+// with a username and password. It writes their credentials in a Docker config, which podman
+// reads too.
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/sigv4"
+)
+
+// Kinds of registries, by how the builds log in to them
+const (
+	ECR   = "ecr"
+	GCR   = "gcr"
+	Basic = "basic"
+)
+
+const (
+	// requestTimeout bounds a request to ECR
+	requestTimeout = 30 * time.Second
+	// dockerHub is the key of Docker Hub in the Docker configs
+	dockerHub = "https://index.docker.io/v1/"
+	// gcrUsername is the username of the logins with a Google Cloud access token
+	gcrUsername = "oauth2accesstoken"
+)
+
+var (
+	// ecrHost matches the hosts of the ECR registries, <account>.dkr.ecr.<region>.amazonaws.com
+	ecrHost = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+	// gcrHost matches the hosts of Container Registry, gcr.io and its regions, and of Artifact
+	// Registry, <location>-docker.pkg.dev
+	gcrHost = regexp.MustCompile(`^(?:[a-z]+\.)?gcr\.io$|^[a-z0-9-]+-docker\.pkg\.dev$`)
+	// dockerHubHosts are the names of Docker Hub
+	dockerHubHosts = map[string]bool{"docker.io": true, "index.docker.io": true, "registry-1.docker.io": true}
+)
+
+// Auth is the credentials of a registry
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Host returns the host of the registry, without the scheme or path it may have
+func Host(registry string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
+
+// Kind returns how the builds log in to the registry host: ECR, GCR or Basic
+func Kind(host string) string {
+	switch {
+	case ecrHost.MatchString(host):
+		return ECR
+	case gcrHost.MatchString(host):
+		return GCR
+	}
+	return Basic
+}
+
+// GCRAuth returns the credentials of the Google registries with the access token
+func GCRAuth(accessToken string) Auth {
+	return Auth{Username: gcrUsername, Password: accessToken}
+}
+
+// Client gets the credentials of the ECR registries
+type Client struct {
+	// ecrEndpoint is the endpoint of the ECR API, the one of the region of the registry if empty
+	ecrEndpoint string
+	http        *http.Client
+	now         func() time.Time
+}
+
+// New returns a Client of the endpoints of ECR, or of AWS_ENDPOINT_URL_ECR if set
+func New() *Client {
+	return &Client{ecrEndpoint: os.Getenv("AWS_ENDPOINT_URL_ECR"), http: &http.Client{Timeout: requestTimeout}, now: time.Now}
+}
+
+// ECR returns the credentials of the ECR registry host, which last 12 hours, from an authorization
+// token of the account of the registry got with the AWS credentials
+func (c *Client) ECR(host string, credentials sigv4.Credentials) (Auth, error) {
+	match := ecrHost.FindStringSubmatch(host)
+	if match == nil {
+		return Auth{}, fmt.Errorf("Invalid ECR registry %q", host)
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return Auth{}, fmt.Errorf("No AWS credentials for %s", host)
+	}
+	account, region := match[1], match[2]
+	endpoint := c.ecrEndpoint
+	if endpoint == "" {
+		endpoint = "https://api.ecr." + region + ".amazonaws.com/"
+	}
+
+	body, err := json.Marshal(map[string][]string{"registryIds": {account}})
+	if err != nil {
+		return Auth{}, err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Auth{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+	sigv4.Sign(req, body, c.now().UTC(), region, "ecr", credentials)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return Auth{}, fmt.Errorf("Getting an ECR authorization token: %v", err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return Auth{}, fmt.Errorf("Reading the ECR authorization token: %v", err)
+	}
+	if res.StatusCode/100 != 2 {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &e)
+		return Auth{}, fmt.Errorf("Getting an ECR authorization token: status %d: %s %s", res.StatusCode, e.Type, e.Message)
+	}
+
+	var token struct {
+		AuthorizationData []struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		} `json:"authorizationData"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil || len(token.AuthorizationData) == 0 {
+		return Auth{}, fmt.Errorf("No ECR authorization token in the response")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(token.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return Auth{}, fmt.Errorf("Invalid ECR authorization token: %v", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return Auth{}, fmt.Errorf("Invalid ECR authorization token")
+	}
+	return Auth{Username: parts[0], Password: parts[1]}, nil
+}
+
+// WriteConfig writes the Docker config with the credentials of the registries by host in dir, as
+// config.json, keeping the rest of the config at base if set and it exists (its credential
+// helpers...). Docker Hub is written under the names docker and podman know it by.
+func WriteConfig(dir, base string, auths map[string]Auth) error {
+	config := map[string]interface{}{}
+	if base != "" {
+		if data, err := ioutil.ReadFile(base); err == nil {
+			if err := json.Unmarshal(data, &config); err != nil {
+				return fmt.Errorf("Parsing the Docker config %s: %v", base, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("Reading the Docker config %s: %v", base, err)
+		}
+	}
+
+	entries, _ := config["auths"].(map[string]interface{})
+	if entries == nil {
+		entries = map[string]interface{}{}
+	}
+	for host, auth := range auths {
+		entry := map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))}
+		if dockerHubHosts[host] {
+			entries[dockerHub] = entry
+			host = "docker.io"
+		}
+		entries[host] = entry
+	}
+	config["auths"] = entries
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Creating the Docker config directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		return fmt.Errorf("Writing the Docker config: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/sigv4"
+)
+
+func TestKind(t *testing.T) {
+	tests := []struct {
+		registry, host, kind string
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", "123456789012.dkr.ecr.us-east-1.amazonaws.com", ECR},
+		{"https://123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/v2/", "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", ECR},
+		{"gcr.io", "gcr.io", GCR},
+		{"eu.gcr.io/my-project", "eu.gcr.io", GCR},
+		{"europe-west1-docker.pkg.dev", "europe-west1-docker.pkg.dev", GCR},
+		{"docker.io", "docker.io", Basic},
+		{"ghcr.io", "ghcr.io", Basic},
+		{"registry.example.com:5000", "registry.example.com:5000", Basic},
+		{"dkr.ecr.us-east-1.amazonaws.com.example.com", "dkr.ecr.us-east-1.amazonaws.com.example.com", Basic},
+	}
+	for _, test := range tests {
+		host := Host(test.registry)
+		if host != test.host || Kind(host) != test.kind {
+			t.Errorf("Host(%q) = %q of kind %q, want %q of kind %q", test.registry, host, Kind(host), test.host, test.kind)
+		}
+	}
+}
+
+func TestECR(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" {
+			t.Errorf("X-Amz-Target = %q", r.Header.Get("X-Amz-Target"))
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=ASIAEXAMPLE/20210601/eu-west-1/ecr/aws4_request") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("Unsigned request: %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"registryIds":["123456789012"]}` {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "InvalidParameterException", "message": "Invalid registry"}`))
+			return
+		}
+		token := base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password"))
+		w.Write([]byte(`{"authorizationData": [{"authorizationToken": "` + token + `", "proxyEndpoint": "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com"}]}`))
+	}))
+	defer server.Close()
+	c := &Client{ecrEndpoint: server.URL, http: server.Client(), now: func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }}
+	credentials := sigv4.Credentials{AccessKeyID: "ASIAEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"}
+
+	auth, err := c.ECR("123456789012.dkr.ecr.eu-west-1.amazonaws.com", credentials)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if auth != (Auth{Username: "AWS", Password: "ecr-password"}) {
+		t.Errorf("ECR() = %+v", auth)
+	}
+
+	if _, err := c.ECR("123456789012.dkr.ecr.eu-west-1.amazonaws.com", sigv4.Credentials{}); err == nil {
+		t.Errorf("A registry without AWS credentials should fail")
+	}
+	if _, err := c.ECR("ghcr.io", credentials); err == nil {
+		t.Errorf("A registry that is not ECR should fail")
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "home", "config.json")
+	os.MkdirAll(filepath.Dir(base), 0700)
+	ioutil.WriteFile(base, []byte(`{"auths": {"quay.io": {"auth": "cXVheQ=="}}, "credHelpers": {"example.azurecr.io": "acr"}}`), 0600)
+
+	auths := map[string]Auth{"docker.io": {Username: "user", Password: "hub-token"}, "gcr.io": GCRAuth("ya29.token")}
+	if err := WriteConfig(filepath.Join(dir, "docker"), base, auths); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "docker", "config.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hub := map[string]interface{}{"auth": base64.StdEncoding.EncodeToString([]byte("user:hub-token"))}
+	want := map[string]interface{}{
+		"auths": map[string]interface{}{
+			"quay.io":                     map[string]interface{}{"auth": "cXVheQ=="},
+			"https://index.docker.io/v1/": hub,
+			"docker.io":                   hub,
+			"gcr.io":                      map[string]interface{}{"auth": base64.StdEncoding.EncodeToString([]byte("oauth2accesstoken:ya29.token"))},
+		},
+		"credHelpers": map[string]interface{}{"example.azurecr.io": "acr"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Config = %v, want %v", config, want)
+	}
+
+	if err := WriteConfig(filepath.Join(dir, "other"), filepath.Join(dir, "missing.json"), auths); err != nil {
+		t.Errorf("A missing base config should be ignored: %v", err)
+	}
+}
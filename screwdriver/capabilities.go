@@ -0,0 +1,175 @@
+package screwdriver
+
+import (
+	"io"
+	"reflect"
+	"strings"
+)
+
+// LogProtocolVersion is the version of the log lines the launcher writes: 1 has the time, message
+// and step of every line, 2 also the stream of the lines of the standard error of the steps, 3 also
+// the stream of their shell trace and the fold markers of the phases of the build, and 4 also the
+// stream of the messages and the timeout events of the launcher
+const LogProtocolVersion = 4
+
+// legacyLogProtocol is the log protocol of the APIs that do not negotiate capabilities
+const legacyLogProtocol = 1
+
+// TeardownAlways is the teardown semantics of the launcher: the teardowns run after failed and
+// aborted builds too, and a failed teardown fails the build
+const TeardownAlways = "always"
+
+// These are the features of the launcher the API may rely on
+const (
+	FeatureStepApproval  = "stepApproval"
+	FeatureStepTokens    = "stepTokens"
+	FeatureStepTimings   = "stepTimings"
+	FeatureRequeue       = "requeue"
+	FeatureFreezeWindows = "freezeWindows"
+	FeatureAnnotations   = "annotations"
+	FeatureFindings      = "findings"
+	FeatureIDTokens      = "idTokens"
+)
+
+// Capabilities is the manifest of what the launcher or the API supports, exchanged at the start of
+// a build so each only uses what the other has
+type Capabilities struct {
+	Version     string `json:"version,omitempty"`
+	LogProtocol int    `json:"logProtocol"`
+	// StepAnnotations are the options of the steps, as in the JSON of CommandDef
+	StepAnnotations []string `json:"stepAnnotations,omitempty"`
+	Teardown        string   `json:"teardown,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// CapabilitiesPayload is a Screwdriver Capabilities payload.
+type CapabilitiesPayload struct {
+	Launcher Capabilities `json:"launcher"`
+}
+
+// LauncherCapabilities returns the manifest of the launcher of version
+func LauncherCapabilities(version string) Capabilities {
+	return Capabilities{
+		Version:         version,
+		LogProtocol:     LogProtocolVersion,
+		StepAnnotations: stepAnnotations(),
+		Teardown:        TeardownAlways,
+		Features: []string{
+			FeatureStepApproval,
+			FeatureStepTokens,
+			FeatureStepTimings,
+			FeatureRequeue,
+			FeatureFreezeWindows,
+			FeatureAnnotations,
+			FeatureFindings,
+			FeatureIDTokens,
+		},
+	}
+}
+
+// LegacyCapabilities returns the manifest of an API that does not negotiate capabilities, which
+// knows the first log protocol only
+func LegacyCapabilities() Capabilities {
+	return Capabilities{LogProtocol: legacyLogProtocol}
+}
+
+// Returns the JSON names of the options of the steps, which are all the fields of CommandDef but
+// its name and command
+func stepAnnotations() []string {
+	var names []string
+	t := reflect.TypeOf(CommandDef{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" && name != "name" && name != "command" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Negotiate returns what both c and the capabilities of the API support: the lower log protocol,
+// the step annotations and features both have, and the teardown semantics if they agree. The
+// version is that of the API.
+func (c Capabilities) Negotiate(api Capabilities) Capabilities {
+	n := Capabilities{
+		Version:         api.Version,
+		LogProtocol:     c.LogProtocol,
+		StepAnnotations: intersect(c.StepAnnotations, api.StepAnnotations),
+		Features:        intersect(c.Features, api.Features),
+	}
+	if api.LogProtocol < n.LogProtocol {
+		n.LogProtocol = api.LogProtocol
+	}
+	if n.LogProtocol < legacyLogProtocol {
+		n.LogProtocol = legacyLogProtocol
+	}
+	if c.Teardown == api.Teardown {
+		n.Teardown = c.Teardown
+	}
+	return n
+}
+
+// Has reports whether feature is one of the capabilities
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the values of a that b also has, in their order in a
+func intersect(a, b []string) []string {
+	var out []string
+	for _, value := range a {
+		for _, other := range b {
+			if value == other {
+				out = append(out, value)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// legacyEmitter hides that an emitter logs the standard error of the steps apart, which is then
+// logged as their output
+type legacyEmitter struct {
+	Emitter
+}
+
+// stderrOnlyEmitter hides that an emitter logs the shell trace of the steps apart, which is then
+// logged as their output, and folds the log, leaving its standard error stream
+type stderrOnlyEmitter struct {
+	StderrEmitter
+}
+
+// foldingEmitter hides that an emitter logs the messages of the launcher apart, which are then
+// logged as output, leaving its standard error and shell trace streams and its fold markers
+type foldingEmitter struct {
+	protocol3Emitter
+}
+
+// protocol3Emitter is an emitter with all the log lines of version 3 of the log protocol
+type protocol3Emitter interface {
+	StderrEmitter
+	Trace() io.WriteCloser
+	Fold(marker FoldMarker)
+}
+
+// EmitterForProtocol returns e for the log protocol the API knows: without the standard error
+// stream before version 2, without the shell trace stream and the fold markers before version 3,
+// and without the launcher stream before version 4
+func EmitterForProtocol(e Emitter, logProtocol int) Emitter {
+	if logProtocol >= LogProtocolVersion {
+		return e
+	}
+	if f, ok := e.(protocol3Emitter); ok && logProtocol >= 3 {
+		return foldingEmitter{f}
+	}
+	if s, ok := e.(StderrEmitter); ok && logProtocol >= 2 {
+		return stderrOnlyEmitter{s}
+	}
+	return legacyEmitter{e}
+}
@@ -0,0 +1,120 @@
+package screwdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLauncherCapabilities(t *testing.T) {
+	c := LauncherCapabilities("6.0.0")
+	if c.Version != "6.0.0" || c.LogProtocol != LogProtocolVersion || c.Teardown != TeardownAlways {
+		t.Errorf("Unexpected capabilities %+v", c)
+	}
+	annotations := Capabilities{Features: c.StepAnnotations}
+	for _, name := range []string{"timeout", "retries", "gate", "stdin", "stderr", "artifactRetention"} {
+		if !annotations.Has(name) {
+			t.Errorf("The step annotations should have %q: %v", name, c.StepAnnotations)
+		}
+	}
+	for _, name := range []string{"name", "command"} {
+		if annotations.Has(name) {
+			t.Errorf("The step annotations should not have %q: %v", name, c.StepAnnotations)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	launcher := Capabilities{
+		Version:         "6.0.0",
+		LogProtocol:     2,
+		StepAnnotations: []string{"timeout", "stderr"},
+		Teardown:        TeardownAlways,
+		Features:        []string{FeatureStepApproval, FeatureRequeue},
+	}
+	tests := []struct {
+		name string
+		api  Capabilities
+		want Capabilities
+	}{
+		{
+			name: "legacy",
+			api:  LegacyCapabilities(),
+			want: Capabilities{LogProtocol: 1},
+		},
+		{
+			name: "older",
+			api:  Capabilities{Version: "5.0.0", LogProtocol: 1, StepAnnotations: []string{"timeout"}, Teardown: TeardownAlways, Features: []string{FeatureRequeue}},
+			want: Capabilities{Version: "5.0.0", LogProtocol: 1, StepAnnotations: []string{"timeout"}, Teardown: TeardownAlways, Features: []string{FeatureRequeue}},
+		},
+		{
+			name: "newer",
+			api:  Capabilities{Version: "7.0.0", LogProtocol: 3, StepAnnotations: []string{"stderr", "timeout", "cache"}, Teardown: "onSuccess", Features: []string{"webhooks", FeatureRequeue, FeatureStepApproval}},
+			want: Capabilities{Version: "7.0.0", LogProtocol: 2, StepAnnotations: []string{"timeout", "stderr"}, Features: []string{FeatureStepApproval, FeatureRequeue}},
+		},
+		{
+			name: "no log protocol",
+			api:  Capabilities{Version: "7.0.0"},
+			want: Capabilities{Version: "7.0.0", LogProtocol: 1},
+		},
+	}
+	for _, test := range tests {
+		if got := launcher.Negotiate(test.api); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Negotiate() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEmitterForProtocol(t *testing.T) {
+	file, err := ioutil.TempFile("", "emitter")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	e, err := NewEmitter(file.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer e.Close()
+
+	if _, ok := EmitterForProtocol(e, LogProtocolVersion).(StderrEmitter); !ok {
+		t.Errorf("The emitter should log the standard error apart with log protocol %d", LogProtocolVersion)
+	}
+	if _, ok := EmitterForProtocol(e, LogProtocolVersion).(FoldEmitter); !ok {
+		t.Errorf("The emitter should fold the log with log protocol %d", LogProtocolVersion)
+	}
+	if _, ok := EmitterForProtocol(e, LogProtocolVersion).(LauncherEmitter); !ok {
+		t.Errorf("The emitter should log the messages of the launcher apart with log protocol %d", LogProtocolVersion)
+	}
+	folding := EmitterForProtocol(e, 3)
+	if _, ok := folding.(FoldEmitter); !ok {
+		t.Errorf("The emitter should fold the log with log protocol 3")
+	}
+	if _, ok := folding.(TraceEmitter); !ok {
+		t.Errorf("The emitter should log the shell trace apart with log protocol 3")
+	}
+	if _, ok := folding.(LauncherEmitter); ok {
+		t.Errorf("The emitter should not log the messages of the launcher apart with log protocol 3")
+	}
+	stderrOnly := EmitterForProtocol(e, 2)
+	if _, ok := stderrOnly.(StderrEmitter); !ok {
+		t.Errorf("The emitter should log the standard error apart with log protocol 2")
+	}
+	if _, ok := stderrOnly.(TraceEmitter); ok {
+		t.Errorf("The emitter should not log the shell trace apart with log protocol 2")
+	}
+	if _, ok := stderrOnly.(FoldEmitter); ok {
+		t.Errorf("The emitter should not fold the log with log protocol 2")
+	}
+	legacy := EmitterForProtocol(e, legacyLogProtocol)
+	if _, ok := legacy.(StderrEmitter); ok {
+		t.Errorf("The emitter should not log the standard error apart with the legacy log protocol")
+	}
+	legacy.StartCmd(CommandDef{Name: "test"})
+	if _, err := legacy.Write([]byte("hello\n")); err != nil {
+		t.Errorf("Unexpected error writing to the emitter: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package screwdriver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// defaultMaxClockSkew is how far the clock of the host may be off the one of the API before the
+// launcher warns and compensates
+const defaultMaxClockSkew = 30 * time.Second
+
+// clockSkew follows how far the clock of the host is off the one of the API, from the Date header
+// of the responses of the API. The header only has seconds, and a response takes its round trip, so
+// a skew within max is not told apart from them.
+type clockSkew struct {
+	mu  sync.Mutex
+	max time.Duration
+	// skew is the time of the API minus the one of the host, if significant is true
+	skew        time.Duration
+	significant bool
+}
+
+// apiClock is the skew of the clock of the host off the one of the API the launcher talks to
+var apiClock = &clockSkew{max: defaultMaxClockSkew}
+
+// Records the Date header date of a response to a request sent at sent and answered at received,
+// by the clock of the host. A response whose round trip is over max tells nothing.
+func (c *clockSkew) observe(date string, sent, received time.Time) {
+	apiTime, err := http.ParseTime(date)
+	if err != nil || received.Sub(sent) > c.max {
+		return
+	}
+	// The API answered within the second of its header, during the round trip
+	skew := apiTime.Add(500 * time.Millisecond).Sub(sent.Add(received.Sub(sent) / 2))
+	significant := skew > c.max || skew < -c.max
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case significant && !c.significant:
+		logger.Warnf("The clock of the host is %s the API, the tokens may look expired or not valid yet to it; compensating the times sent to the API", skewString(skew))
+	case !significant && c.significant:
+		logger.Infof("The clock of the host is back in sync with the API")
+	}
+	c.skew, c.significant = skew, significant
+	if !significant {
+		c.skew = 0
+	}
+}
+
+// Returns the time now by the clock of the API
+func (c *clockSkew) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.skew)
+}
+
+// Returns why the API may have answered 401 to token: its validity by the clock of the API, and
+// the skew of the clock of the host, if any
+func (c *clockSkew) explainUnauthorized(token string) string {
+	c.mu.Lock()
+	skew, significant := c.skew, c.significant
+	c.mu.Unlock()
+
+	var reasons []string
+	if expires, notBefore, ok := tokenValidity(token); ok {
+		now := time.Now().Add(skew)
+		switch {
+		case !expires.IsZero() && !now.Before(expires):
+			reasons = append(reasons, fmt.Sprintf("the token expired at %s by the clock of the API", expires.UTC().Format(time.RFC3339)))
+		case !notBefore.IsZero() && now.Before(notBefore):
+			reasons = append(reasons, fmt.Sprintf("the token is not valid before %s by the clock of the API", notBefore.UTC().Format(time.RFC3339)))
+		}
+	}
+	if significant {
+		reasons = append(reasons, fmt.Sprintf("the clock of the host is %s the API", skewString(skew)))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Returns how far the clock of the host is off the one of the API, for skew
+func skewString(skew time.Duration) string {
+	if skew < 0 {
+		return fmt.Sprintf("%v ahead of", (-skew).Round(time.Second))
+	}
+	return fmt.Sprintf("%v behind", skew.Round(time.Second))
+}
+
+// Returns the expiry and the start of validity of the JWT token, zero if it has none, or false if
+// the token is not a JWT. The signature is left to the API.
+func tokenValidity(token string) (time.Time, time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+		Nbf int64 `json:"nbf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	var expires, notBefore time.Time
+	if claims.Exp > 0 {
+		expires = time.Unix(claims.Exp, 0)
+	}
+	if claims.Nbf > 0 {
+		notBefore = time.Unix(claims.Nbf, 0)
+	}
+	return expires, notBefore, true
+}
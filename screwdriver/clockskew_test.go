@@ -0,0 +1,95 @@
+package screwdriver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns an unsigned JWT with the claims
+func testJWT(claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestClockSkewObserve(t *testing.T) {
+	c := &clockSkew{max: 30 * time.Second}
+	sent := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	received := sent.Add(200 * time.Millisecond)
+
+	// A skew within the round trip and the second of the header is not told apart
+	c.observe(sent.Add(2*time.Second).Format(http.TimeFormat), sent, received)
+	assert.False(t, c.significant)
+	assert.Equal(t, time.Duration(0), c.skew)
+
+	c.observe(sent.Add(5*time.Minute).Format(http.TimeFormat), sent, received)
+	assert.True(t, c.significant)
+	assert.Equal(t, 5*time.Minute+400*time.Millisecond, c.skew)
+	if d := c.now().Sub(time.Now()); d < 5*time.Minute || d > 6*time.Minute {
+		t.Errorf("now() should be 5 minutes ahead, got %v", d)
+	}
+
+	// A slow response or an invalid header tells nothing
+	c.observe(sent.Format(http.TimeFormat), sent, sent.Add(time.Minute))
+	c.observe("yesterday", sent, received)
+	assert.True(t, c.significant)
+
+	c.observe(sent.Format(http.TimeFormat), sent, received)
+	assert.False(t, c.significant)
+	assert.Equal(t, time.Duration(0), c.skew)
+}
+
+func TestTokenValidity(t *testing.T) {
+	expires, notBefore, ok := tokenValidity(testJWT(`{"exp":1614592800,"nbf":1614589200}`))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1614592800), expires.Unix())
+	assert.Equal(t, int64(1614589200), notBefore.Unix())
+
+	expires, notBefore, ok = tokenValidity(testJWT(`{"sub":"build"}`))
+	assert.True(t, ok)
+	assert.True(t, expires.IsZero() && notBefore.IsZero())
+
+	for _, token := range []string{"faketoken", "a.b.c", testJWT("[]")} {
+		if _, _, ok := tokenValidity(token); ok {
+			t.Errorf("tokenValidity(%q) should not be ok", token)
+		}
+	}
+}
+
+func TestUnauthorizedExplainsClockSkew(t *testing.T) {
+	defer func(clock *clockSkew) { apiClock = clock }(apiClock)
+	apiClock = &clockSkew{max: defaultMaxClockSkew}
+
+	// The token is still valid by the clock of the host, not by the one of the API
+	now := time.Now()
+	token := testJWT(fmt.Sprintf(`{"exp":%d}`, now.Add(5*time.Minute).Unix()))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(10*time.Minute).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, `{"statusCode": 401, "error": "Unauthorized", "message": "Invalid token"}`)
+	}))
+	defer server.Close()
+
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = &http.Client{Transport: &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return url.Parse(server.URL)
+		},
+	}}
+	testAPI := api{"http://fakeurl", token, client}
+
+	_, err := testAPI.BuildFromID(1)
+	if err == nil || !strings.Contains(err.Error(), "the token expired at") || !strings.Contains(err.Error(), "the clock of the host is 10m0s behind the API") {
+		t.Errorf("The 401 should tell about the clock skew, got %v", err)
+	}
+	if d := apiClock.now().Sub(time.Now()); d < 9*time.Minute {
+		t.Errorf("The times sent to the API should be compensated, got %v ahead", d)
+	}
+}
@@ -3,67 +3,299 @@ package screwdriver
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-// Emitter is an io.WriteCloser that knows about CommandDef
+// Emitter is an io.WriteCloser that knows about CommandDef. Write may be called concurrently, e.g.
+// with the output and the standard error of a step, so the emitters and the ones wrapping them
+// must be safe for it.
 type Emitter interface {
 	StartCmd(cmd CommandDef)
 	io.WriteCloser
 	Error() error
 }
 
+// StderrEmitter is an Emitter that also logs the standard error of a step apart from its output
+type StderrEmitter interface {
+	Emitter
+	// Stderr returns a writer whose lines are logged as the standard error of the current step,
+	// until it is closed
+	Stderr() io.WriteCloser
+}
+
+// TraceEmitter is an Emitter that also logs the shell trace of a step apart from its output
+type TraceEmitter interface {
+	Emitter
+	// Trace returns a writer whose lines are logged as the shell trace of the current step, until
+	// it is closed
+	Trace() io.WriteCloser
+}
+
+// FoldEmitter is an Emitter that also marks where the phases of the build and its steps begin and
+// end in the log, for the log store and the UI to fold them
+type FoldEmitter interface {
+	Emitter
+	// Fold logs marker after the output written so far
+	Fold(marker FoldMarker)
+}
+
+// LauncherEmitter is an Emitter that also logs the messages of the launcher itself apart from the
+// output of the steps
+type LauncherEmitter interface {
+	Emitter
+	// Launcher logs the lines of message as lines of the launcher, after the output written so far
+	Launcher(message string)
+}
+
+// TimeoutEmitter is an Emitter that also logs the timeouts of the build and its steps as events,
+// for the UI to show a banner of its own
+type TimeoutEmitter interface {
+	Emitter
+	// Timeout logs event after the output written so far
+	Timeout(event TimeoutEvent)
+}
+
+// These are the timeouts of a TimeoutEvent
+const (
+	TimeoutBuild = "build"
+	TimeoutStep  = "step"
+)
+
+// TimeoutEvent is the event of the build or one of its steps timing out
+type TimeoutEvent struct {
+	// Kind tells whether the build or the step timed out
+	Kind      string `json:"kind"`
+	Step      string `json:"step"`
+	Message   string `json:"message"`
+	TimeoutMs int64  `json:"timeoutMs"`
+	// Teardowns is how many teardowns run next, for at most TeardownBudgetMs, 0 without a limit
+	Teardowns        int    `json:"teardowns"`
+	TeardownBudgetMs int64  `json:"teardownBudgetMs,omitempty"`
+	DocsURL          string `json:"docsUrl,omitempty"`
+}
+
+// These are the folds of the log, the ends of which have the duration of the fold
+const (
+	FoldBegin = "begin"
+	FoldEnd   = "end"
+)
+
+// These are the phases of the build the log folds: the setup of the build shell and the setup
+// steps, each step, and the teardowns
+const (
+	FoldPhaseSetup    = "setup"
+	FoldPhaseStep     = "step"
+	FoldPhaseTeardown = "teardown"
+)
+
+// FoldMarker marks the begin or the end of a phase of the build in the log
+type FoldMarker struct {
+	Fold  string `json:"fold"`
+	Phase string `json:"phase"`
+	// Step is the step of a step fold, and the step of its log line
+	Step       string `json:"step,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+// StreamStderr is the stream of the log lines of the standard error of a step
+const StreamStderr = "stderr"
+
+// StreamTrace is the stream of the log lines of the shell trace of a step
+const StreamTrace = "trace"
+
+// StreamLauncher is the stream of the log lines of the messages of the launcher about a step, e.g.
+// its timeout
+const StreamLauncher = "launcher"
+
 type emitter struct {
 	file   *os.File
 	cmd    CommandDef
 	buffer *bytes.Buffer
 	reader io.Reader
 	*io.PipeWriter
-	err error
+	leaks *LeakScanner
+	// recordPrefix starts the records of the launcher in the output, and cannot be written by the
+	// steps
+	recordPrefix []byte
+
+	// mu guards the log file between the streams, and the current step cmd they tag their lines
+	// with
+	mu     sync.Mutex
+	out    *bufio.Writer
+	closed bool
+	err    error
 }
 
 type logLine struct {
 	Time    int64  `json:"t"`
 	Message string `json:"m"`
 	Step    string `json:"s"`
+	Stream  string `json:"stream,omitempty"`
+	// Fold, Phase and DurationMs are those of a fold marker
+	Fold       string `json:"fold,omitempty"`
+	Phase      string `json:"phase,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	// Timeout is the event of a launcher line with an empty message
+	Timeout *TimeoutEvent `json:"timeout,omitempty"`
 }
 
 // Error gets the latest error from the emitter
 func (e *emitter) Error() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.err
 }
 
 // StartCmd switches the currently running step for the Emitter
 func (e *emitter) StartCmd(cmd CommandDef) {
+	e.mu.Lock()
 	e.cmd = cmd
+	e.mu.Unlock()
 }
 
-// Returns a single line (without the ending \n) from the input buffered reader
-// Pulled from https://stackoverflow.com/a/12206365
-func readln(r *bufio.Reader) (string, error) {
-	var (
-		isPrefix = true
-		err      error
-		line, ln []byte
-	)
+// Returns the name of the current step
+func (e *emitter) step() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cmd.Name
+}
 
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.ReadLine()
-		ln = append(ln, line...)
+// maxLogLineSize is the longest message a single log line carries; longer output is split
+const maxLogLineSize = 64 * 1024
+
+// RuneBoundary returns the length of the longest prefix of b that does not end in the middle
+// of a UTF-8 character, so output split there keeps every character whole
+func RuneBoundary(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// scanLogLines is a bufio.SplitFunc like bufio.ScanLines that splits overly long lines
+// into chunks of at most maxLogLineSize, between UTF-8 characters, and drops a trailing line
+// that has no newline
+func scanLogLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, bytes.TrimSuffix(data[:i], []byte{'\r'}), nil
+	}
+	if len(data) >= maxLogLineSize {
+		n := RuneBoundary(data[:maxLogLineSize])
+		if n == 0 {
+			n = maxLogLineSize
+		}
+		return n, data[:n], nil
+	}
+	if atEOF {
+		return len(data), nil, nil
 	}
+	return 0, nil, nil
+}
 
-	return string(ln), err
+const hexDigits = "0123456789abcdef"
+
+// appendLogLine appends the JSON encoding of a logLine to buf, like json.Encoder does,
+// without the reflection overhead on the hot log path
+func appendLogLine(buf []byte, t int64, message []byte, step, stream string) []byte {
+	buf = append(buf, `{"t":`...)
+	buf = strconv.AppendInt(buf, t, 10)
+	buf = append(buf, `,"m":`...)
+	buf = appendJSONString(buf, message)
+	buf = append(buf, `,"s":`...)
+	buf = appendJSONString(buf, []byte(step))
+	if stream != "" {
+		buf = append(buf, `,"stream":`...)
+		buf = appendJSONString(buf, []byte(stream))
+	}
+	return append(buf, "}\n"...)
 }
 
-func (e *emitter) processPipe() {
-	var line string
-	var readErr error
+// appendJSONString appends s as a JSON string, escaping it the same way encoding/json does
+func appendJSONString(buf []byte, s []byte) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRune(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but break JavaScript parsers
+		if c == '\u2028' || c == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+// flushReader flushes the encoded log lines before blocking on a read for more output,
+// so lines are written in batches without delaying them
+type flushReader struct {
+	r io.Reader
+	e *emitter
+}
+
+func (f flushReader) Read(p []byte) (int, error) {
+	f.e.mu.Lock()
+	var err error
+	if !f.e.closed {
+		err = f.e.out.Flush()
+	}
+	f.e.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
 
+func (e *emitter) processPipe() {
 	// TODO: fix temporary hack - without this delay the datetime is printing incorrectly for kata containers
 	// runtime class env is populated for kata containers
 	if strings.TrimSpace(os.Getenv("SD_RUNTIME_CLASS")) != "" {
@@ -71,35 +303,199 @@ func (e *emitter) processPipe() {
 	}
 	//
 
-	reader := bufio.NewReader(e.reader)
-	encoder := json.NewEncoder(e.file)
+	e.processStream(e.reader, "")
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.out.Flush(); err != nil {
+		e.err = err
+	}
+
+	if err := e.file.Close(); err != nil {
+		e.err = err
+	}
+	e.closed = true
+}
 
-	line, readErr = readln(reader)
+// Logs the lines read from r as lines of stream, "" for the output of the steps
+func (e *emitter) processStream(r io.Reader, stream string) {
+	scanner := bufio.NewScanner(flushReader{r, e})
+	scanner.Buffer(make([]byte, 4096), maxLogLineSize)
+	scanner.Split(scanLogLines)
 
-	for readErr == nil {
-		newLine := logLine{
-			Time:    time.Now().UnixNano() / int64(time.Millisecond),
-			Message: line,
-			Step:    e.cmd.Name,
+	var buf []byte
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var record []byte
+		if stream == "" && e.recordPrefix != nil {
+			if i := bytes.Index(line, e.recordPrefix); i >= 0 {
+				line, record = line[:i], line[i+len(e.recordPrefix):]
+			}
 		}
-		if err := encoder.Encode(newLine); err != nil {
+		buf = buf[:0]
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		// The line is tagged with the step current when it is read, which the next one may replace
+		step := e.step()
+		// The output before a record on the same line is a line of its own
+		if record == nil || len(line) > 0 {
+			if e.leaks != nil {
+				line = e.leaks.Scan(line, step)
+			}
+			buf = appendLogLine(buf, now, line, step, stream)
+		}
+		if record != nil {
+			buf = e.appendRecordLine(buf, now, record, step)
+		}
+		e.mu.Lock()
+		if e.closed {
+			// The output of the steps ended with the emitter
+		} else if _, err := e.out.Write(buf); err != nil {
 			e.err = fmt.Errorf("Encoding json: %v", err)
 		}
+		e.mu.Unlock()
+	}
 
-		line, readErr = readln(reader)
+	if err := scanner.Err(); err != nil {
+		e.mu.Lock()
+		e.err = fmt.Errorf("Piping log line to emitter: %v", err)
+		e.mu.Unlock()
 	}
+}
+
+// logRecord is what the launcher logs through the pipe of the output, after the record prefix,
+// besides the output: a fold marker or a line of its own
+type logRecord struct {
+	Fold     *FoldMarker   `json:"fold,omitempty"`
+	Launcher *string       `json:"launcher,omitempty"`
+	Timeout  *TimeoutEvent `json:"timeout,omitempty"`
+}
 
-	if readErr != nil && readErr.Error() != "EOF" {
-		e.err = fmt.Errorf("Piping log line to emitter: %v", readErr)
+// Appends the log line of the record encoded in data to buf, or nothing if it is not one. Its step
+// is current unless the record has its own.
+func (e *emitter) appendRecordLine(buf []byte, t int64, data []byte, current string) []byte {
+	var record logRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return buf
+	}
+	switch {
+	case record.Fold != nil:
+		marker := record.Fold
+		step := marker.Step
+		if step == "" {
+			step = current
+		}
+		line, err := json.Marshal(logLine{Time: t, Step: step, Fold: marker.Fold, Phase: marker.Phase, DurationMs: marker.DurationMs})
+		if err != nil {
+			return buf
+		}
+		return append(append(buf, line...), '\n')
+	case record.Launcher != nil:
+		line := []byte(*record.Launcher)
+		if e.leaks != nil {
+			line = e.leaks.Scan(line, current)
+		}
+		return appendLogLine(buf, t, line, current, StreamLauncher)
+	case record.Timeout != nil:
+		line, err := json.Marshal(logLine{Time: t, Step: current, Stream: StreamLauncher, Timeout: record.Timeout})
+		if err != nil {
+			return buf
+		}
+		return append(append(buf, line...), '\n')
 	}
+	return buf
+}
 
-	if err := e.file.Close(); err != nil {
-		e.err = err
+// Logs records after the output written so far. They go through the pipe of the output, in one
+// write, so they keep their place among the lines of the output.
+func (e *emitter) writeRecords(records ...logRecord) {
+	var data []byte
+	for _, record := range records {
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+		data = append(append(append(data, e.recordPrefix...), encoded...), '\n')
 	}
+	if _, err := e.PipeWriter.Write(data); err != nil {
+		e.mu.Lock()
+		e.err = fmt.Errorf("Logging the records of the launcher: %v", err)
+		e.mu.Unlock()
+	}
+}
+
+// Fold logs marker after the output written so far
+func (e *emitter) Fold(marker FoldMarker) {
+	e.writeRecords(logRecord{Fold: &marker})
+}
+
+// Timeout logs event after the output written so far
+func (e *emitter) Timeout(event TimeoutEvent) {
+	e.writeRecords(logRecord{Timeout: &event})
+}
+
+// Launcher logs the lines of message as lines of the launcher, after the output written so far
+func (e *emitter) Launcher(message string) {
+	var records []logRecord
+	for _, line := range strings.Split(strings.TrimSuffix(message, "\n"), "\n") {
+		line := strings.TrimSuffix(line, "\r")
+		records = append(records, logRecord{Launcher: &line})
+	}
+	e.writeRecords(records...)
+}
+
+// stderrWriter is the writer of the standard error of a step, whose Close returns once its lines
+// are logged
+type stderrWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+func (w stderrWriter) Close() error {
+	err := w.PipeWriter.Close()
+	<-w.done
+	return err
+}
+
+// Stderr returns a writer whose lines are logged as the standard error of the current step,
+// until it is closed
+func (e *emitter) Stderr() io.WriteCloser {
+	return e.stream(StreamStderr)
+}
+
+// Trace returns a writer whose lines are logged as the shell trace of the current step, until it
+// is closed
+func (e *emitter) Trace() io.WriteCloser {
+	return e.stream(StreamTrace)
+}
+
+// Returns a writer whose lines are logged as lines of stream, until it is closed
+func (e *emitter) stream(stream string) io.WriteCloser {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.processStream(r, stream)
+		// The rest of what is written is dropped if the log line was too long
+		io.Copy(ioutil.Discard, r)
+	}()
+	return stderrWriter{w, done}
 }
 
 // NewEmitter returns an emitter object from an emitter destination path
 func NewEmitter(path string) (Emitter, error) {
+	return NewScanningEmitter(path, nil)
+}
+
+// NewScanningEmitter returns an emitter object from an emitter destination path, passing every
+// line of output through leaks unless it is nil
+func NewScanningEmitter(path string, leaks *LeakScanner) (Emitter, error) {
+	// The records of the launcher start with a NUL and a random token no step can know
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("Generating the record prefix: %v", err)
+	}
+	recordPrefix := []byte("\x00sd-record-" + hex.EncodeToString(token) + " ")
+
 	r, w := io.Pipe()
 	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
@@ -111,11 +507,14 @@ func NewEmitter(path string) (Emitter, error) {
 	}
 
 	e := &emitter{
-		file:       file,
-		buffer:     bytes.NewBuffer([]byte{}),
-		reader:     r,
-		PipeWriter: w,
-		cmd:        cmd,
+		file:         file,
+		out:          bufio.NewWriterSize(file, maxLogLineSize),
+		buffer:       bytes.NewBuffer([]byte{}),
+		reader:       r,
+		PipeWriter:   w,
+		cmd:          cmd,
+		leaks:        leaks,
+		recordPrefix: recordPrefix,
 	}
 
 	go e.processPipe()
@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func fakeCmd(name string) CommandDef {
@@ -99,3 +102,286 @@ func TestEmitter(t *testing.T) {
 		t.Errorf("file does not contain correct number lines. Wanted %v. Got %v", len(tests), line)
 	}
 }
+
+func TestEmitterStderr(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "emitter")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	emitterpath := path.Join(tmp, "socket")
+	emitter, err := NewEmitter(emitterpath)
+	if err != nil {
+		t.Fatalf("Error creating emitter: %v", err)
+	}
+	defer emitter.Close()
+
+	emitter.StartCmd(fakeCmd("test"))
+	stderr := emitter.(StderrEmitter).Stderr()
+	fmt.Fprintln(emitter, "output")
+	time.Sleep(10 * time.Millisecond)
+	fmt.Fprint(stderr, "warning: deprecated\nerror")
+	fmt.Fprintln(stderr, ": failed")
+	if err := stderr.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	trace := emitter.(TraceEmitter).Trace()
+	fmt.Fprintln(trace, "+ make build")
+	if err := trace.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fmt.Fprintln(emitter, "done")
+	time.Sleep(10 * time.Millisecond)
+
+	data, err := ioutil.ReadFile(emitterpath)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	want := []logLine{
+		{Message: "output", Step: "test"},
+		{Message: "warning: deprecated", Step: "test", Stream: StreamStderr},
+		{Message: "error: failed", Step: "test", Stream: StreamStderr},
+		{Message: "+ make build", Step: "test", Stream: StreamTrace},
+		{Message: "done", Step: "test"},
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("Want %d lines, got %q", len(want), lines)
+	}
+	for i, text := range lines {
+		var log logLine
+		if err := json.Unmarshal([]byte(text), &log); err != nil {
+			t.Fatalf("error unmarshalling %v", err)
+		}
+		log.Time = 0
+		if log != want[i] {
+			t.Errorf("line %d is %+v, want %+v", i, log, want[i])
+		}
+	}
+	if strings.Contains(lines[0], "stream") {
+		t.Errorf("The output should have no stream: %s", lines[0])
+	}
+}
+
+func TestEmitterFold(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "emitter")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	emitterpath := path.Join(tmp, "socket")
+	emitter, err := NewEmitter(emitterpath)
+	if err != nil {
+		t.Fatalf("Error creating emitter: %v", err)
+	}
+	defer emitter.Close()
+
+	folds := emitter.(FoldEmitter)
+	emitter.StartCmd(fakeCmd("sd-setup-init"))
+	folds.Fold(FoldMarker{Fold: FoldBegin, Phase: FoldPhaseSetup})
+	folds.Fold(FoldMarker{Fold: FoldBegin, Phase: FoldPhaseStep, Step: "test"})
+	emitter.StartCmd(fakeCmd("test"))
+	fmt.Fprint(emitter, "building")
+	folds.Fold(FoldMarker{Fold: FoldEnd, Phase: FoldPhaseStep, Step: "test", DurationMs: 1500})
+	// A step cannot write a fold marker
+	fmt.Fprintln(emitter, "\x00sd-record-0123 {\"fold\":{\"fold\":\"end\",\"phase\":\"setup\"}}")
+	time.Sleep(10 * time.Millisecond)
+
+	data, err := ioutil.ReadFile(emitterpath)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	want := []logLine{
+		{Step: "sd-setup-init", Fold: FoldBegin, Phase: FoldPhaseSetup},
+		{Step: "test", Fold: FoldBegin, Phase: FoldPhaseStep},
+		{Message: "building", Step: "test"},
+		{Step: "test", Fold: FoldEnd, Phase: FoldPhaseStep, DurationMs: 1500},
+		{Message: "\x00sd-record-0123 {\"fold\":{\"fold\":\"end\",\"phase\":\"setup\"}}", Step: "test"},
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("Want %d lines, got %q", len(want), lines)
+	}
+	for i, text := range lines {
+		var log logLine
+		if err := json.Unmarshal([]byte(text), &log); err != nil {
+			t.Fatalf("error unmarshalling %v", err)
+		}
+		log.Time = 0
+		if log != want[i] {
+			t.Errorf("line %d is %+v, want %+v", i, log, want[i])
+		}
+	}
+}
+
+func TestEmitterLauncher(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "emitter")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	emitterpath := path.Join(tmp, "socket")
+	emitter, err := NewEmitter(emitterpath)
+	if err != nil {
+		t.Fatalf("Error creating emitter: %v", err)
+	}
+	defer emitter.Close()
+
+	emitter.StartCmd(fakeCmd("test"))
+	fmt.Fprint(emitter, "building")
+	emitter.(LauncherEmitter).Launcher("Step timeout of 1m0s exceeded\nStopping the step\n")
+	event := TimeoutEvent{Kind: TimeoutStep, Step: "test", Message: "Step timeout of 1m0s exceeded", TimeoutMs: 60000}
+	emitter.(TimeoutEmitter).Timeout(event)
+	fmt.Fprintln(emitter, "done")
+	time.Sleep(10 * time.Millisecond)
+
+	data, err := ioutil.ReadFile(emitterpath)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	want := []logLine{
+		{Message: "building", Step: "test"},
+		{Message: "Step timeout of 1m0s exceeded", Step: "test", Stream: StreamLauncher},
+		{Message: "Stopping the step", Step: "test", Stream: StreamLauncher},
+		{Step: "test", Stream: StreamLauncher, Timeout: &event},
+		{Message: "done", Step: "test"},
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("Want %d lines, got %q", len(want), lines)
+	}
+	for i, text := range lines {
+		var log logLine
+		if err := json.Unmarshal([]byte(text), &log); err != nil {
+			t.Fatalf("error unmarshalling %v", err)
+		}
+		log.Time = 0
+		if !reflect.DeepEqual(log, want[i]) {
+			t.Errorf("line %d is %+v, want %+v", i, log, want[i])
+		}
+	}
+}
+
+func TestScanLogLines(t *testing.T) {
+	long := strings.Repeat("y", maxLogLineSize+10)
+	input := "short\r\n" + long + "\nno newline"
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Buffer(make([]byte, 4096), maxLogLineSize)
+	scanner.Split(scanLogLines)
+
+	var found []string
+	for scanner.Scan() {
+		found = append(found, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []string{"short", long[:maxLogLineSize], long[maxLogLineSize:]}
+	if len(found) != len(want) {
+		t.Fatalf("found %d lines, want %d", len(found), len(want))
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("line %d has length %d, want %d", i, len(found[i]), len(want[i]))
+		}
+	}
+}
+
+func TestScanLogLinesUTF8(t *testing.T) {
+	// The 3-byte characters straddle maxLogLineSize
+	long := strings.Repeat("y", maxLogLineSize-1) + strings.Repeat("€", 4)
+	scanner := bufio.NewScanner(strings.NewReader(long + "\n"))
+	scanner.Buffer(make([]byte, 4096), maxLogLineSize)
+	scanner.Split(scanLogLines)
+
+	var found []string
+	for scanner.Scan() {
+		if !utf8.Valid(scanner.Bytes()) {
+			t.Errorf("line %q... is not valid UTF-8", scanner.Text()[:10])
+		}
+		found = append(found, scanner.Text())
+	}
+	if got := strings.Join(found, ""); got != long {
+		t.Errorf("found %d bytes, want %d", len(got), len(long))
+	}
+}
+
+func TestRuneBoundary(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"ab€", 5},
+		{"ab\xe2\x82", 2},
+		{"ab\xe2", 2},
+		{"ab\xf0\x9f\x98", 2},
+		{"ab\xff", 3},
+		{"ab\x82\x82\x82\x82", 6},
+	}
+	for _, test := range tests {
+		if got := RuneBoundary([]byte(test.in)); got != test.want {
+			t.Errorf("RuneBoundary(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+}
+
+func BenchmarkEmitter(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "emitter")
+	if err != nil {
+		b.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	emitter, err := NewEmitter(path.Join(tmp, "socket"))
+	if err != nil {
+		b.Fatalf("Error creating emitter: %v", err)
+	}
+	defer emitter.Close()
+
+	// the executor forwards output in batches of lines
+	chunk := []byte(strings.Repeat(strings.Repeat("a", 99)+"\n", 320))
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := emitter.Write(chunk); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func TestAppendLogLine(t *testing.T) {
+	messages := []string{
+		"plain",
+		`quotes " and \ backslash`,
+		"tab\tcontrol\x01\x1f",
+		"<html> & friends",
+		"unicode: héllo 世界   ",
+		"invalid utf8: \xff\xfe",
+		"",
+	}
+
+	for _, msg := range messages {
+		encoded := appendLogLine(nil, 1234, []byte(msg), `step "name"`, "")
+
+		var got, want logLine
+		if err := json.Unmarshal(encoded, &got); err != nil {
+			t.Fatalf("invalid json %q: %v", encoded, err)
+		}
+		wantJSON, _ := json.Marshal(logLine{Time: 1234, Message: msg, Step: `step "name"`})
+		json.Unmarshal(wantJSON, &want)
+
+		if got != want {
+			t.Errorf("appendLogLine(%q) = %+v, want %+v", msg, got, want)
+		}
+		if encoded[len(encoded)-1] != '\n' {
+			t.Errorf("appendLogLine(%q) should end with a newline", msg)
+		}
+	}
+}
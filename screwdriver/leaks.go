@@ -0,0 +1,146 @@
+package screwdriver
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// leakMask replaces the possible secrets found in the output when masking
+	leakMask = "********"
+	// Shortest string checked for a high entropy (as in entropyCandidate), shorter random strings
+	// are too common
+	minEntropyLength = 32
+	// Entropy in bits per character above which a string looks random. Hex strings like commit
+	// hashes have at most 4 bits per character and are never flagged.
+	minEntropy = 4.5
+)
+
+// leakPattern is a known credential format
+type leakPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+var (
+	leakPatterns = []leakPattern{
+		{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`)},
+		{"private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )?PRIVATE KEY-----`)},
+	}
+	// Candidates for the entropy check: long runs of base64 or URL safe base64 characters
+	entropyCandidate = regexp.MustCompile(`[A-Za-z0-9+/_\-]{32,}={0,2}`)
+	// Subresource integrity digests, like the ones npm and yarn print, look random but are public
+	sriDigest = regexp.MustCompile(`^sha(256-[A-Za-z0-9+/]{43}=|384-[A-Za-z0-9+/]{64}|512-[A-Za-z0-9+/]{86}==)$`)
+)
+
+// LeakFinding is a kind of possible secret found in the output of a step
+type LeakFinding struct {
+	Step  string
+	Kind  string
+	Count int
+}
+
+// LeakScanner looks for credentials in the build output: known formats like AWS access keys and
+// GitHub tokens, and random looking strings. This is separate from the known secrets of the
+// build; it catches credentials the build got elsewhere.
+type LeakScanner struct {
+	mask     bool
+	mu       sync.Mutex
+	findings map[LeakFinding]int
+}
+
+// NewLeakScanner returns a LeakScanner that only records the possible secrets, or also masks
+// them in the output if mask is set
+func NewLeakScanner(mask bool) *LeakScanner {
+	return &LeakScanner{mask: mask, findings: map[LeakFinding]int{}}
+}
+
+// Scan records the possible secrets in a line of output of step, and returns the line with them
+// masked if masking
+func (s *LeakScanner) Scan(line []byte, step string) []byte {
+	// Every match is masked so the following checks don't count it again
+	text := string(line)
+	found := false
+	record := func(kind string) func(string) string {
+		return func(string) string {
+			found = true
+			s.record(step, kind)
+			return leakMask
+		}
+	}
+
+	for _, p := range leakPatterns {
+		text = p.re.ReplaceAllStringFunc(text, record(p.kind))
+	}
+	text = entropyCandidate.ReplaceAllStringFunc(text, func(match string) string {
+		if sriDigest.MatchString(match) || !looksRandom(match) {
+			return match
+		}
+		return record("high-entropy string")(match)
+	})
+
+	if !found || !s.mask {
+		return line
+	}
+	return []byte(text)
+}
+
+func (s *LeakScanner) record(step, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.findings[LeakFinding{Step: step, Kind: kind}]++
+}
+
+// Findings returns the possible secrets found so far, by step and kind
+func (s *LeakScanner) Findings() []LeakFinding {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var findings []LeakFinding
+	for f, count := range s.findings {
+		f.Count = count
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Step != findings[j].Step {
+			return findings[i].Step < findings[j].Step
+		}
+		return findings[i].Kind < findings[j].Kind
+	})
+	return findings
+}
+
+// Returns whether s mixes upper and lower case letters and digits with a high entropy
+func looksRandom(s string) bool {
+	s = strings.TrimRight(s, "=")
+	if len(s) < minEntropyLength ||
+		!strings.ContainsAny(s, "abcdefghijklmnopqrstuvwxyz") ||
+		!strings.ContainsAny(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") ||
+		!strings.ContainsAny(s, "0123456789") {
+		return false
+	}
+	return entropy(s) >= minEntropy
+}
+
+// Returns the Shannon entropy of s in bits per character
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	var e float64
+	n := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
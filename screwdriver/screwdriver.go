@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,6 +14,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/screwdriver-cd/launcher/logger"
 )
 
 var sleep = time.Sleep
@@ -31,6 +31,10 @@ const (
 	Success             = "SUCCESS"
 	Failure             = "FAILURE"
 	Aborted             = "ABORTED"
+	// Queued puts the build back in the queue, to run again from the start
+	Queued = "QUEUED"
+	// Frozen stops a build whose deployment steps fall in a freeze window of its job
+	Frozen = "FROZEN"
 )
 
 const defaultBuildTimeoutBuffer = 30 // 30 minutes
@@ -49,14 +53,25 @@ type API interface {
 	BuildFromID(buildID int) (Build, error)
 	EventFromID(eventID int) (Event, error)
 	JobFromID(jobID int) (Job, error)
+	LastSuccessfulMeta(jobID int) (map[string]interface{}, error)
 	PipelineFromID(pipelineID int) (Pipeline, error)
 	UpdateBuildStatus(status BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error
 	UpdateStepStart(buildID int, stepName string) error
-	UpdateStepStop(buildID int, stepName string, exitCode int) error
+	UpdateStepStop(buildID int, stepName string, exitCode int, details StepStopDetails) error
+	UpdateBuildTimings(buildID int, timings BuildTimings) error
+	UpdateStepTimings(buildID int, stepName string, timings StepTimings) error
+	UpdateStepAnnotations(buildID int, stepName string, annotations []Annotation) error
+	UpdateBuildFindings(buildID int, findings Findings) error
+	RequestStepApproval(buildID int, stepName, message string) error
+	GetStepApproval(buildID int, stepName string) (StepApproval, error)
 	SecretsForBuild(build Build) (Secrets, error)
 	GetAPIURL() (string, error)
 	GetCoverageInfo(jobID, pipelineID int, jobName, pipelineName, scope, prNum, prParentJobId string) (Coverage, error)
 	GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error)
+	GetStepToken(buildID int, stepName string, scope []string, ttlSeconds int) (string, error)
+	GetIDToken(buildID int, audience string) (string, error)
+	NegotiateCapabilities(buildID int, launcher Capabilities) (Capabilities, error)
+	ClaimBuild(queue string) (int, error)
 }
 
 // SDError is an error response from the Screwdriver API
@@ -88,6 +103,11 @@ func New(url, token string) (API, error) {
 		maxRetries, _ = strconv.Atoi(os.Getenv("SDAPI_MAXRETRIES"))
 	}
 
+	if strings.TrimSpace(os.Getenv("SDAPI_MAX_CLOCK_SKEW_SECS")) != "" {
+		maxSkew, _ := strconv.Atoi(os.Getenv("SDAPI_MAX_CLOCK_SKEW_SECS"))
+		apiClock.max = time.Duration(maxSkew) * time.Second
+	}
+
 	retryClient := retryablehttp.NewClient()
 	retryClient.RetryMax = maxRetries
 	retryClient.RetryWaitMin = time.Duration(retryWaitMin) * time.Millisecond
@@ -122,8 +142,206 @@ type StepStartPayload struct {
 
 // StepStopPayload is a Screwdriver Step Stop payload.
 type StepStopPayload struct {
-	EndTime  time.Time `json:"endTime"`
-	ExitCode int       `json:"code"`
+	EndTime        time.Time         `json:"endTime"`
+	ExitCode       int               `json:"code"`
+	Signal         string            `json:"signal,omitempty"`
+	Usage          *ResourceUsage    `json:"usage,omitempty"`
+	TmpDirBytes    int64             `json:"tmpDirBytes,omitempty"`
+	Policy         []PolicyViolation `json:"policyViolations,omitempty"`
+	Skipped        bool              `json:"skipped,omitempty"`
+	AllowedFailure bool              `json:"allowedFailure,omitempty"`
+	Attempts       int               `json:"attempts,omitempty"`
+	PassedOnRetry  bool              `json:"passedOnRetry,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	Message        string            `json:"message,omitempty"`
+	Tests          *StepTests        `json:"tests,omitempty"`
+}
+
+// Reasons a step stopped for, in the step stop
+const (
+	StepCompleted = "completed"
+	StepFailed    = "failed"
+	StepTimedOut  = "timed_out"
+	StepAborted   = "aborted"
+	StepSkipped   = "skipped"
+	// StepPreempted is the reason of a step stopped because the node of the build was going away
+	StepPreempted = "preempted"
+	// StepCached is the reason of a step whose result was reused instead of running it
+	StepCached = "cached"
+)
+
+// StepStopDetails holds what is known about how a step stopped besides its exit code.
+type StepStopDetails struct {
+	// Signal is the name of the signal that killed the step (e.g. "SIGTERM"), if any
+	Signal string
+	// Usage is the resources the step consumed, if they could be measured
+	Usage *ResourceUsage
+	// TmpDirBytes is how many bytes the files the step left in its temporary directory took
+	TmpDirBytes int64
+	// Policy is the command policy rules the step violated
+	Policy []PolicyViolation
+	// Skipped is whether the step did not run as its condition failed
+	Skipped bool
+	// Restored is whether the step did not run again as it passed before the build was re-queued
+	Restored bool
+	// AllowedFailure is whether the step failed without failing the build
+	AllowedFailure bool
+	// Attempts is how many times the step ran, if it was run again after failing
+	Attempts int
+	// PassedOnRetry is whether the step succeeded after failing, so it is flaky
+	PassedOnRetry bool
+	// Reason is why the step stopped, one of the Step reasons, and Message says more about it
+	Reason  string
+	Message string
+	// Tests are the tests the step ran, if it writes TAP
+	Tests *StepTests
+}
+
+// StepTests are the tests a step ran from its Test Anything Protocol output: how many it planned,
+// passed, failed, skipped and marked as to do, why it bailed out if it did, and its first failed
+// tests.
+type StepTests struct {
+	Planned  int               `json:"planned,omitempty"`
+	Passed   int               `json:"passed"`
+	Failed   int               `json:"failed"`
+	Skipped  int               `json:"skipped"`
+	Todo     int               `json:"todo"`
+	BailOut  string            `json:"bailOut,omitempty"`
+	Failures []StepTestFailure `json:"failures"`
+}
+
+// StepTestFailure is a failed test of a step, with its number and description in the TAP output
+// and the message of its diagnostics.
+type StepTestFailure struct {
+	Number  int    `json:"number,omitempty"`
+	Test    string `json:"test"`
+	Message string `json:"message,omitempty"`
+}
+
+// Statuses of the approval of a gate step
+const (
+	ApprovalWaiting  = "waiting"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// StepApproval is the approval of a gate step: whether it is waiting, approved or rejected, and by
+// whom with what message.
+type StepApproval struct {
+	Status  string `json:"status"`
+	By      string `json:"by,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// StepApprovalPayload is a Screwdriver Step Approval payload.
+type StepApprovalPayload struct {
+	Approval StepApproval `json:"approval"`
+}
+
+// PolicyViolation is a command policy rule matched by a step.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Action  string `json:"action"`
+	Message string `json:"message,omitempty"`
+}
+
+// ResourceUsage is the resources consumed by a step.
+type ResourceUsage struct {
+	CPUTimeMs   int64 `json:"cpuTimeMs"`
+	MaxRSSBytes int64 `json:"maxRssBytes"`
+	ReadBytes   int64 `json:"readBytes"`
+	WriteBytes  int64 `json:"writeBytes"`
+}
+
+// StepTiming is how long a step took and its share of the build time.
+type StepTiming struct {
+	Name       string  `json:"name"`
+	DurationMs int64   `json:"durationMs"`
+	Percent    float64 `json:"percent"`
+}
+
+// BuildTimings is the timing breakdown of a build.
+type BuildTimings struct {
+	QueueTimeMs    int64        `json:"queueTimeMs"`
+	TotalTimeMs    int64        `json:"totalTimeMs"`
+	StepsTimeMs    int64        `json:"stepsTimeMs"`
+	TeardownTimeMs int64        `json:"teardownTimeMs"`
+	Steps          []StepTiming `json:"steps"`
+}
+
+// BuildTimingsPayload is a Screwdriver Build payload updating the build timing stats.
+type BuildTimingsPayload struct {
+	Stats struct {
+		Timings BuildTimings `json:"timings"`
+	} `json:"stats"`
+}
+
+// StepTimings is where the launcher spent the time of a step, in milliseconds.
+type StepTimings struct {
+	ScriptWriteMs     float64 `json:"scriptWriteMs,omitempty"`
+	PtyRoundTripMs    float64 `json:"ptyRoundTripMs,omitempty"`
+	StepStartUpdateMs float64 `json:"stepStartUpdateMs"`
+	StepStopUpdateMs  float64 `json:"stepStopUpdateMs"`
+}
+
+// StepTimingsPayload is a Screwdriver Step payload annotating the step with its timings.
+type StepTimingsPayload struct {
+	Timings StepTimings `json:"timings"`
+}
+
+// Severities of the annotations
+const (
+	AnnotationError   = "error"
+	AnnotationWarning = "warning"
+	AnnotationNotice  = "notice"
+)
+
+// Annotation is a problem the output of a step reported at a line of a file of the source, e.g. a
+// compiler error, shown inline on the pull requests. Matcher is the problem matcher that found it.
+type Annotation struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Matcher  string `json:"matcher"`
+}
+
+// StepAnnotationsPayload is a Screwdriver Step payload with the annotations of the source the step
+// reported.
+type StepAnnotationsPayload struct {
+	Annotations []Annotation `json:"annotations"`
+}
+
+// Findings is the summary of the findings of the SARIF files the scanners of a build wrote: the
+// files and the tools, the findings of each level and the most severe of them, and the thresholds
+// they exceed. Decision is passed, warned or failed.
+type Findings struct {
+	Files      []string  `json:"files"`
+	Invalid    []string  `json:"invalid,omitempty"`
+	Tools      []string  `json:"tools"`
+	Errors     int       `json:"errors"`
+	Warnings   int       `json:"warnings"`
+	Notes      int       `json:"notes"`
+	Findings   []Finding `json:"findings"`
+	Violations []string  `json:"violations"`
+	Decision   string    `json:"decision"`
+}
+
+// Finding is a result of a SARIF file: the tool and rule reporting it, its level, error, warning
+// or note, its message and where it is in the source.
+type Finding struct {
+	Tool    string `json:"tool"`
+	Rule    string `json:"rule,omitempty"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// FindingsPayload is a Screwdriver Build payload with the summary of its findings.
+type FindingsPayload struct {
+	Findings Findings `json:"findings"`
 }
 
 // BuildTokenPayload is a Screwdriver Build Token payload.
@@ -131,6 +349,17 @@ type BuildTokenPayload struct {
 	BuildTimeout int `json:"buildTimeout"`
 }
 
+// StepTokenPayload is a Screwdriver Step Token payload.
+type StepTokenPayload struct {
+	Scope []string `json:"scope"`
+	TTL   int      `json:"ttl"`
+}
+
+// IDTokenPayload is a Screwdriver ID Token payload.
+type IDTokenPayload struct {
+	Audience string `json:"audience"`
+}
+
 // Pipeline is a Screwdriver Pipeline definition.
 type Pipeline struct {
 	ID      int     `json:"id"`
@@ -146,10 +375,71 @@ type ScmRepo struct {
 
 type JobAnnotations struct {
 	CoverageScope string `json:"screwdriver.cd/coverageScope,omitempty" default:""`
+	// Shell is the absolute path of the shell the build runs in, e.g. /bin/bash
+	Shell string `json:"screwdriver.cd/shell,omitempty"`
+	// Locale is the locale of the build, e.g. en_US.UTF-8, Timezone its time zone, e.g.
+	// Europe/Paris, and Term its terminal type, e.g. xterm-256color
+	Locale   string `json:"screwdriver.cd/locale,omitempty"`
+	Timezone string `json:"screwdriver.cd/timezone,omitempty"`
+	Term     string `json:"screwdriver.cd/term,omitempty"`
+	// VaultSecrets maps variables of the build environment to values of secrets of the Vault of
+	// the cluster, path#key, e.g. NPM_TOKEN: secret/data/ci/npm#token
+	VaultSecrets map[string]string `json:"screwdriver.cd/vaultSecrets,omitempty"`
+	// CloudIdentity is the cloud credentials the build exchanges its identity token for
+	CloudIdentity *CloudIdentity `json:"screwdriver.cd/cloudIdentity,omitempty"`
+	// Registries are the container registries the build logs in to before the steps run
+	Registries []Registry `json:"screwdriver.cd/registries,omitempty"`
+	// SSHKeys are the names of the secrets of the deploy keys the ssh-agent of the build holds
+	SSHKeys []string `json:"screwdriver.cd/sshKeys,omitempty"`
+}
+
+// Registry is a container registry the build logs in to: an Amazon ECR registry with the AWS
+// credentials of the build, a Google registry with its Google Cloud access token, and any other
+// with Username and the password in the secret PasswordSecret
+type Registry struct {
+	Registry       string `json:"registry"`
+	Username       string `json:"username,omitempty"`
+	PasswordSecret string `json:"passwordSecret,omitempty"`
+}
+
+// CloudIdentity is the roles of the clouds the build gets short-lived credentials of before the
+// steps run, with the identity token of the build the federations of the clouds trust
+type CloudIdentity struct {
+	AWS   *AWSIdentity   `json:"aws,omitempty"`
+	GCP   *GCPIdentity   `json:"gcp,omitempty"`
+	Azure *AzureIdentity `json:"azure,omitempty"`
+}
+
+// AWSIdentity is the IAM role the build assumes with web identity, in Region if set, for Duration
+// seconds, an hour if 0
+type AWSIdentity struct {
+	RoleARN  string `json:"roleArn"`
+	Region   string `json:"region,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+}
+
+// GCPIdentity is the workload identity provider of Google Cloud the build exchanges its token
+// with, //iam.googleapis.com/projects/.../providers/..., and the service account it impersonates
+// if set
+type GCPIdentity struct {
+	Provider       string `json:"provider"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	Project        string `json:"project,omitempty"`
+}
+
+// AzureIdentity is the application of Microsoft Entra ID with a federated credential the build
+// gets a token of
+type AzureIdentity struct {
+	TenantID       string `json:"tenantId"`
+	ClientID       string `json:"clientId"`
+	SubscriptionID string `json:"subscriptionId,omitempty"`
 }
 
 type JobPermutation struct {
 	Annotations JobAnnotations `json:"annotations"`
+	// FreezeWindows are cron expressions of the minutes in UTC during which the deployment steps
+	// of the job do not run
+	FreezeWindows []string `json:"freezeWindows,omitempty"`
 }
 
 // Job is a Screwdriver Job.
@@ -161,15 +451,213 @@ type Job struct {
 	Permutations  []JobPermutation `json:"permutations,omitempty"`
 }
 
+// Shell returns the shell picked by the shell annotation of the job, if any
+func (j Job) Shell() string {
+	if len(j.Permutations) == 0 {
+		return ""
+	}
+	return j.Permutations[0].Annotations.Shell
+}
+
+// Annotations returns the annotations of the job, if any
+func (j Job) Annotations() JobAnnotations {
+	if len(j.Permutations) == 0 {
+		return JobAnnotations{}
+	}
+	return j.Permutations[0].Annotations
+}
+
+// FreezeWindows returns the freeze windows of the job, if any
+func (j Job) FreezeWindows() []string {
+	if len(j.Permutations) == 0 {
+		return nil
+	}
+	return j.Permutations[0].FreezeWindows
+}
+
+// Types of steps. A step without a type is classified by its name, see TeardownPatterns.
+const (
+	StepTypeUser       = "user"
+	StepTypeSetup      = "setup"
+	StepTypeTeardown   = "teardown"
+	StepTypeSDTeardown = "sd-teardown"
+)
+
+// What the launcher does with the remaining teardowns when a teardown fails. A teardown without a
+// policy continues.
+const (
+	OnFailureContinue = "continue"
+	OnFailureStop     = "stop"
+)
+
+// StepGate is the approval a gate step waits for, with the message shown to the approvers.
+type StepGate struct {
+	Message string `json:"message,omitempty"`
+}
+
 // CommandDef is the definition of a single executable command.
 type CommandDef struct {
 	Name string `json:"name"`
 	Cmd  string `json:"command"`
+	Type string `json:"type,omitempty"`
+	// Timeout of the step in seconds, none if 0
+	Timeout   int    `json:"timeout,omitempty"`
+	OnFailure string `json:"onFailure,omitempty"`
+	// Parallel teardowns following each other run at the same time
+	Parallel bool `json:"parallel,omitempty"`
+	// Retries is how many times the step is run again after failing
+	Retries int `json:"retries,omitempty"`
+	// AllowFailure steps do not fail the build
+	AllowFailure bool `json:"allowFailure,omitempty"`
+	// Flaky steps may fail now and then, and are run again after failing
+	Flaky bool `json:"flaky,omitempty"`
+	// Gate steps wait for an approval instead of running a command
+	Gate *StepGate `json:"gate,omitempty"`
+	// Deployment steps do not run during the freeze windows of the job
+	Deployment bool `json:"deployment,omitempty"`
+	// Nice adds to the niceness of the processes of the step, and IONice sets their IO scheduling
+	// class and level, e.g. idle or best-effort:7
+	Nice   int    `json:"nice,omitempty"`
+	IONice string `json:"ioNice,omitempty"`
+	// RawOutput steps write their standard output as is to a file of the artifacts instead of the
+	// log, for binary data
+	RawOutput bool `json:"rawOutput,omitempty"`
+	// StdinFile is the path in the source directory of a file the step reads as its standard input,
+	// and Stdin the text it reads instead
+	StdinFile string `json:"stdinFile,omitempty"`
+	Stdin     string `json:"stdin,omitempty"`
+	// Stderr is capture for the standard error of the step to be logged apart from its output, or
+	// fail for the step to also fail if it wrote anything to it
+	Stderr string `json:"stderr,omitempty"`
+	// Trace steps run with the shell trace on (set -x), logged apart from their output
+	Trace bool `json:"trace,omitempty"`
+	// Echo is the text the log shows instead of the command of the step, which it hides if empty
+	Echo *string `json:"echo,omitempty"`
+	// Shell runs the step instead of the build shell, and User runs it as another user
+	Shell string `json:"shell,omitempty"`
+	User  string `json:"user,omitempty"`
+	// Interpreter runs the command instead of a shell, e.g. python3 or /usr/bin/node
+	Interpreter string `json:"interpreter,omitempty"`
+	// Image is the container image the step runs in instead of the build container
+	Image string `json:"image,omitempty"`
+	// Container is the container of the build pod the step runs in instead of the build container
+	Container string `json:"container,omitempty"`
+	// Condition is a shell command the step only runs if it succeeds
+	Condition string `json:"condition,omitempty"`
+	// Script is the path in the source directory of an executable the step runs with Args,
+	// instead of a command
+	Script string   `json:"script,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	// Env are variables set for the step only
+	Env map[string]string `json:"env,omitempty"`
+	// Matrix makes the step run once for every combination of the values of its variables
+	Matrix map[string][]string `json:"matrix,omitempty"`
+	// Template is the name of the step template the step runs the steps of, With its parameters
+	Template string            `json:"template,omitempty"`
+	With     map[string]string `json:"with,omitempty"`
+	// ArtifactRetention is the retention class of the artifacts the step writes
+	ArtifactRetention string `json:"artifactRetention,omitempty"`
+	// ProblemMatchers are the names of the problem matchers turning the output of the step into
+	// annotations of the source
+	ProblemMatchers []string `json:"problemMatchers,omitempty"`
+	// TAP steps write Test Anything Protocol output, whose tests are counted
+	TAP bool `json:"tap,omitempty"`
+}
+
+// StepTemplate is a sequence of steps the steps of a build can run with their own parameters.
+// Params are the parameters of the template and their default value, Required the ones without
+// a default.
+type StepTemplate struct {
+	Params   map[string]string `json:"params,omitempty"`
+	Required []string          `json:"required,omitempty"`
+	Steps    []CommandDef      `json:"steps"`
+}
+
+// TeardownPatterns are the regular expressions matching the names of the Screwdriver and user
+// teardowns, and of their counterpart the setup steps. An empty pattern keeps the launcher's
+// default.
+type TeardownPatterns struct {
+	SD    string `json:"sd,omitempty"`
+	User  string `json:"user,omitempty"`
+	Setup string `json:"setup,omitempty"`
 }
 
 // Need a generic interface to take in an int or array of ints
 type IntOrArray interface{}
 
+// TestReports are the JUnit XML reports of a build
+type TestReports struct {
+	// Patterns are the glob patterns of the reports in the source directory
+	Patterns []string `json:"patterns"`
+	// FailBuild fails the build if a report has failed tests, even when the steps succeeded
+	FailBuild bool `json:"failBuild,omitempty"`
+}
+
+// CoverageChecks are the coverage reports of a build and the coverage they must show
+type CoverageChecks struct {
+	// Patterns are the glob patterns of the Cobertura, JaCoCo, LCOV or Go coverage reports in the
+	// source directory
+	Patterns []string `json:"patterns"`
+	// MinLine and MinBranch are the lowest line and branch coverage in percent, 0 for none
+	MinLine   float64 `json:"minLine,omitempty"`
+	MinBranch float64 `json:"minBranch,omitempty"`
+	// MaxDrop is how many percentage points the line coverage may be below the one of the last
+	// successful build of the target branch, nil for no limit
+	MaxDrop *float64 `json:"maxDrop,omitempty"`
+	// FailBuild fails the build when the coverage is below a threshold, rather than warning
+	FailBuild bool `json:"failBuild,omitempty"`
+}
+
+// SarifChecks are the thresholds of the findings of the SARIF files the scanners of a build write
+// to its artifacts directory
+type SarifChecks struct {
+	// MaxErrors, MaxWarnings and MaxNotes are how many findings of each level the build may have,
+	// nil for no limit
+	MaxErrors   *int `json:"maxErrors,omitempty"`
+	MaxWarnings *int `json:"maxWarnings,omitempty"`
+	MaxNotes    *int `json:"maxNotes,omitempty"`
+	// FailBuild fails the build when the findings exceed a threshold, rather than warning
+	FailBuild bool `json:"failBuild,omitempty"`
+}
+
+// SBOMOptions are the options of the software bill of materials the launcher writes after the user
+// steps: the packages of the image, the toolchains and the Git repositories of the source directory
+type SBOMOptions struct {
+	// Toolchains are the commands on the PATH of the build whose version is listed, the
+	// launcher's defaults if empty
+	Toolchains []string `json:"toolchains,omitempty"`
+}
+
+// CacheKey is the key of a cache of a build, made from a template with the hash of its lockfiles,
+// e.g. npm-{{ hashFiles "package-lock.json" }}
+type CacheKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// RestoreKeys are the templates of the key prefixes to restore the cache from when no cache
+	// has the key, the first matching one winning
+	RestoreKeys []string `json:"restoreKeys,omitempty"`
+	// Paths are the files and directories the launcher saves to the cache store under the key and
+	// restores from it, relative to the source directory or absolute
+	Paths []string `json:"paths,omitempty"`
+}
+
+// ArtifactRetention tags the artifacts of a build with the retention classes the store enforces
+// its storage policies by, e.g. ephemeral, 30d or release
+type ArtifactRetention struct {
+	// Default is the class of the artifacts no rule or step tags, none if empty
+	Default string `json:"default,omitempty"`
+	// Rules tag the artifacts matching their pattern, the first matching one winning over the
+	// class of the step that wrote the artifact
+	Rules []ArtifactRetentionRule `json:"rules,omitempty"`
+}
+
+// ArtifactRetentionRule tags the artifacts whose path in the artifacts dir matches Pattern with
+// Class
+type ArtifactRetentionRule struct {
+	Pattern string `json:"pattern"`
+	Class   string `json:"class"`
+}
+
 // Build is a Screwdriver Build
 type Build struct {
 	ID            int                    `json:"id"`
@@ -180,10 +668,36 @@ type Build struct {
 	ParentBuildID IntOrArray             `json:"parentBuildId"`
 	Meta          map[string]interface{} `json:"meta"`
 	EventID       int                    `json:"eventId"`
+	Status        BuildStatus            `json:"status,omitempty"`
 	Createtime    string                 `json:"createTime"`
 	Stats         struct {
 		QueueEntertime string `json:"queueEnterTime"`
 	} `json:"stats"`
+	// TeardownPatterns classify the steps without a type as teardowns by their name
+	TeardownPatterns *TeardownPatterns `json:"teardownPatterns,omitempty"`
+	// SpecSignature is the base64 Ed25519 signature of the build spec, see VerifyBuildSpec
+	SpecSignature string `json:"specSignature,omitempty"`
+	// StepTemplates are the step templates of the steps, by name
+	StepTemplates map[string]StepTemplate `json:"stepTemplates,omitempty"`
+	// ArtifactPatterns are the glob patterns of the files of the source directory the launcher
+	// collects as artifacts after the user steps
+	ArtifactPatterns []string `json:"artifactPatterns,omitempty"`
+	// TestReports are the JUnit reports the launcher reads after the user steps
+	TestReports *TestReports `json:"testReports,omitempty"`
+	// Coverage are the coverage reports the launcher checks after the user steps
+	Coverage *CoverageChecks `json:"coverage,omitempty"`
+	// Sarif are the thresholds of the findings of the SARIF files the launcher reads after the user
+	// steps
+	Sarif *SarifChecks `json:"sarif,omitempty"`
+	// SBOM is the software bill of materials the launcher writes after the user steps, none if nil
+	SBOM *SBOMOptions `json:"sbom,omitempty"`
+	// CacheKeys are the keys of the caches of the build, derived from its files
+	CacheKeys []CacheKey `json:"cacheKeys,omitempty"`
+	// ArtifactRetention are the retention classes of the artifacts of the build
+	ArtifactRetention *ArtifactRetention `json:"artifactRetention,omitempty"`
+
+	// rawSpec is the JSON of the signed fields of the build response, see SpecBytes
+	rawSpec map[string]json.RawMessage
 }
 
 // Coverage is a Coverage object returned when getInfo is called
@@ -234,20 +748,21 @@ func (a api) get(url *url.URL) ([]byte, error) {
 
 	req.Header.Set("Authorization", tokenHeader(a.token))
 
+	sent := time.Now()
 	res, err := a.client.StandardClient().Do(req)
-
 	if res != nil {
+		apiClock.observe(res.Header.Get("Date"), sent, time.Now())
 		defer res.Body.Close()
 	}
 
 	if err != nil {
-		log.Printf("WARNING: received error from %s(%s): %v ", requestType, url.String(), err)
+		logger.Warnf("received error from %s(%s): %v ", requestType, url.String(), err)
 		return nil, fmt.Errorf("WARNING: received error from %s(%s): %v ", requestType, url.String(), err)
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("reading response Body from Screwdriver: %v", err)
+		logger.Warnf("reading response Body from Screwdriver: %v", err)
 		return nil, fmt.Errorf("reading response Body from Screwdriver: %v", err)
 	}
 
@@ -255,12 +770,11 @@ func (a api) get(url *url.URL) ([]byte, error) {
 		var errParse SDError
 		parseError := json.Unmarshal(body, &errParse)
 		if parseError != nil {
-			log.Printf("unparseable error response from Screwdriver: %v", parseError)
+			logger.Warnf("unparseable error response from Screwdriver: %v", parseError)
 			return nil, fmt.Errorf("unparseable error response from Screwdriver: %v", parseError)
 		}
 
-		log.Printf("WARNING: received response %d from %s ", res.StatusCode, url.String())
-		return nil, fmt.Errorf("WARNING: received response %d from %s ", res.StatusCode, url.String())
+		return nil, a.responseError(res.StatusCode, url)
 	}
 
 	return body, nil
@@ -272,14 +786,14 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 
 	size, err := buf.ReadFrom(payload)
 	if err != nil {
-		log.Printf("WARNING: error:[%v], not able to read payload: %v", err, payload)
+		logger.Warnf("error:[%v], not able to read payload: %v", err, payload)
 		return nil, fmt.Errorf("WARNING: error:[%v], not able to read payload: %v", err, payload)
 	}
 	p := buf.String()
 
 	req, err = http.NewRequest(requestType, url.String(), strings.NewReader(p))
 	if err != nil {
-		log.Printf("WARNING: received error generating new request for %s(%s): %v ", requestType, url.String(), err)
+		logger.Warnf("received error generating new request for %s(%s): %v ", requestType, url.String(), err)
 		return nil, fmt.Errorf("WARNING: received error generating new request for %s(%s): %v ", requestType, url.String(), err)
 	}
 
@@ -289,19 +803,21 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 	req.Header.Set("Content-Type", bodyType)
 	req.ContentLength = size
 
+	sent := time.Now()
 	res, err := a.client.StandardClient().Do(req)
 	if res != nil {
+		apiClock.observe(res.Header.Get("Date"), sent, time.Now())
 		defer res.Body.Close()
 	}
 
 	if err != nil {
-		log.Printf("WARNING: received error from %s(%s): %v ", requestType, url.String(), err)
+		logger.Warnf("received error from %s(%s): %v ", requestType, url.String(), err)
 		return nil, fmt.Errorf("WARNING: received error from %s(%s): %v ", requestType, url.String(), err)
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("reading response Body from Screwdriver: %v", err)
+		logger.Warnf("reading response Body from Screwdriver: %v", err)
 		return nil, fmt.Errorf("reading response Body from Screwdriver: %v", err)
 	}
 
@@ -309,17 +825,28 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 		var errParse SDError
 		parseError := json.Unmarshal(body, &errParse)
 		if parseError != nil {
-			log.Printf("unparseable error response from Screwdriver: %v", parseError)
+			logger.Warnf("unparseable error response from Screwdriver: %v", parseError)
 			return nil, fmt.Errorf("unparseable error response from Screwdriver: %v", parseError)
 		}
 
-		log.Printf("WARNING: received response %d from %s ", res.StatusCode, url.String())
-		return nil, fmt.Errorf("WARNING: received response %d from %s ", res.StatusCode, url.String())
+		return nil, a.responseError(res.StatusCode, url)
 	}
 
 	return body, nil
 }
 
+// Returns the error of the response code to a request to url, telling why a 401 may be
+func (a api) responseError(code int, url *url.URL) error {
+	if code == http.StatusUnauthorized {
+		if reason := apiClock.explainUnauthorized(a.token); reason != "" {
+			logger.Warnf("received response %d from %s: %s", code, url.String(), reason)
+			return fmt.Errorf("WARNING: received response %d from %s: %s", code, url.String(), reason)
+		}
+	}
+	logger.Warnf("received response %d from %s ", code, url.String())
+	return fmt.Errorf("WARNING: received response %d from %s ", code, url.String())
+}
+
 func (a api) post(url *url.URL, bodyType string, payload io.Reader) ([]byte, error) {
 	return a.write(url, "POST", bodyType, payload)
 }
@@ -404,6 +931,26 @@ func (a api) JobFromID(jobID int) (job Job, err error) {
 	return job, nil
 }
 
+// LastSuccessfulMeta fetches and returns the meta of the last successful build of a Job, empty if
+// it has none
+func (a api) LastSuccessfulMeta(jobID int) (map[string]interface{}, error) {
+	u, err := a.makeURL(fmt.Sprintf("jobs/%d/lastSuccessfulMeta", jobID))
+	if err != nil {
+		return nil, fmt.Errorf("Generating Screwdriver url for Job %d: %v", jobID, err)
+	}
+
+	body, err := a.get(u)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]interface{}{}
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+	return meta, nil
+}
+
 // PipelineFromID fetches and returns a Pipeline object from its ID
 func (a api) PipelineFromID(pipelineID int) (pipeline Pipeline, err error) {
 	u, err := a.makeURL(fmt.Sprintf("pipelines/%d", pipelineID))
@@ -429,6 +976,8 @@ func (a api) UpdateBuildStatus(status BuildStatus, meta map[string]interface{},
 	case Success:
 	case Failure:
 	case Aborted:
+	case Queued:
+	case Frozen:
 	default:
 		return fmt.Errorf("Invalid build status: %s", status)
 	}
@@ -472,7 +1021,7 @@ func (a api) UpdateStepStart(buildID int, stepName string) error {
 	}
 
 	bs := StepStartPayload{
-		StartTime: time.Now().In(UTCLoc),
+		StartTime: apiClock.now().In(UTCLoc),
 	}
 	payload, err := json.Marshal(bs)
 	if err != nil {
@@ -487,15 +1036,26 @@ func (a api) UpdateStepStart(buildID int, stepName string) error {
 	return nil
 }
 
-func (a api) UpdateStepStop(buildID int, stepName string, exitCode int) error {
+func (a api) UpdateStepStop(buildID int, stepName string, exitCode int, details StepStopDetails) error {
 	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
 	if err != nil {
 		return fmt.Errorf("Creating url: %v", err)
 	}
 
 	bs := StepStopPayload{
-		EndTime:  time.Now().In(UTCLoc),
-		ExitCode: exitCode,
+		EndTime:        apiClock.now().In(UTCLoc),
+		ExitCode:       exitCode,
+		Signal:         details.Signal,
+		Usage:          details.Usage,
+		TmpDirBytes:    details.TmpDirBytes,
+		Policy:         details.Policy,
+		Skipped:        details.Skipped,
+		AllowedFailure: details.AllowedFailure,
+		Attempts:       details.Attempts,
+		PassedOnRetry:  details.PassedOnRetry,
+		Reason:         details.Reason,
+		Message:        details.Message,
+		Tests:          details.Tests,
 	}
 	payload, err := json.Marshal(bs)
 	if err != nil {
@@ -510,6 +1070,122 @@ func (a api) UpdateStepStop(buildID int, stepName string, exitCode int) error {
 	return nil
 }
 
+func (a api) UpdateBuildTimings(buildID int, timings BuildTimings) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d", buildID))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	var bs BuildTimingsPayload
+	bs.Stats.Timings = timings
+	payload, err := json.Marshal(bs)
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Build Timings: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Build Timings: %v", err)
+	}
+
+	return nil
+}
+
+func (a api) UpdateStepTimings(buildID int, stepName string, timings StepTimings) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(StepTimingsPayload{Timings: timings})
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Step Timings: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Step Timings: %v", err)
+	}
+
+	return nil
+}
+
+func (a api) UpdateBuildFindings(buildID int, findings Findings) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d", buildID))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(FindingsPayload{Findings: findings})
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Build Findings: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Build Findings: %v", err)
+	}
+
+	return nil
+}
+
+func (a api) UpdateStepAnnotations(buildID int, stepName string, annotations []Annotation) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(StepAnnotationsPayload{Annotations: annotations})
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Step Annotations: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Step Annotations: %v", err)
+	}
+
+	return nil
+}
+
+func (a api) RequestStepApproval(buildID int, stepName, message string) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(StepApprovalPayload{Approval: StepApproval{Status: ApprovalWaiting, Message: message}})
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Step Approval: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Step Approval: %v", err)
+	}
+
+	return nil
+}
+
+func (a api) GetStepApproval(buildID int, stepName string) (StepApproval, error) {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
+	if err != nil {
+		return StepApproval{}, fmt.Errorf("Creating url: %v", err)
+	}
+
+	body, err := a.get(u)
+	if err != nil {
+		return StepApproval{}, fmt.Errorf("Fetching Step Approval: %v", err)
+	}
+
+	var step StepApprovalPayload
+	if err := json.Unmarshal(body, &step); err != nil {
+		return StepApproval{}, fmt.Errorf("Parsing JSON of Step Approval: %v", err)
+	}
+
+	return step.Approval, nil
+}
+
 func (a api) SecretsForBuild(build Build) (Secrets, error) {
 	u, err := a.makeURL(fmt.Sprintf("builds/%d/secrets", build.ID))
 	if err != nil {
@@ -559,3 +1235,127 @@ func (a api) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error)
 
 	return buildToken.Token, nil
 }
+
+// GetStepToken returns a token for the step that expires after ttlSeconds and only grants the
+// scope (e.g. "store", "meta"), to give the step instead of the build token
+func (a api) GetStepToken(buildID int, stepName string, scope []string, ttlSeconds int) (string, error) {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s/token", buildID, stepName))
+	if err != nil {
+		return "", fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(StepTokenPayload{Scope: scope, TTL: ttlSeconds})
+	if err != nil {
+		return "", fmt.Errorf("Marshaling JSON for Step Token: %v", err)
+	}
+
+	body, err := a.post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("Posting to Step Token: %v", err)
+	}
+
+	stepToken := Token{}
+	if err := json.Unmarshal(body, &stepToken); err != nil {
+		return "", fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+	if stepToken.Token == "" {
+		return "", fmt.Errorf("No token in the response %q", body)
+	}
+
+	return stepToken.Token, nil
+}
+
+// GetIDToken returns an OIDC identity token of the build for audience, signed by the API, which
+// the clouds exchange for their credentials
+func (a api) GetIDToken(buildID int, audience string) (string, error) {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/idtoken", buildID))
+	if err != nil {
+		return "", fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(IDTokenPayload{Audience: audience})
+	if err != nil {
+		return "", fmt.Errorf("Marshaling JSON for ID Token: %v", err)
+	}
+
+	body, err := a.post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("Posting to ID Token: %v", err)
+	}
+
+	idToken := Token{}
+	if err := json.Unmarshal(body, &idToken); err != nil {
+		return "", fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+	if idToken.Token == "" {
+		return "", fmt.Errorf("No token in the response %q", body)
+	}
+
+	return idToken.Token, nil
+}
+
+// NegotiateCapabilities sends the capabilities of the launcher to the API and returns those of the
+// API, for the build to only use what both support
+func (a api) NegotiateCapabilities(buildID int, launcher Capabilities) (Capabilities, error) {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/capabilities", buildID))
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(CapabilitiesPayload{Launcher: launcher})
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("Marshaling JSON for Capabilities: %v", err)
+	}
+
+	body, err := a.post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("Posting to Capabilities: %v", err)
+	}
+
+	capabilities := Capabilities{}
+	if err := json.Unmarshal(body, &capabilities); err != nil {
+		return Capabilities{}, fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+
+	return capabilities, nil
+}
+
+// ClaimBuildPayload is a Screwdriver Claim Build payload.
+type ClaimBuildPayload struct {
+	Queue string `json:"queue"`
+}
+
+// ClaimedBuild is the build claimed from a queue
+type ClaimedBuild struct {
+	BuildID int `json:"buildId"`
+}
+
+// ClaimBuild takes the next build of the queue for the launcher to run, and returns its ID, or 0
+// if the queue is empty
+func (a api) ClaimBuild(queue string) (int, error) {
+	u, err := a.makeURL("queues/builds/claim")
+	if err != nil {
+		return 0, fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(ClaimBuildPayload{Queue: queue})
+	if err != nil {
+		return 0, fmt.Errorf("Marshaling JSON for Claim Build: %v", err)
+	}
+
+	body, err := a.post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("Posting to Claim Build: %v", err)
+	}
+	// No content without a build
+	if len(bytes.TrimSpace(body)) == 0 {
+		return 0, nil
+	}
+
+	claimed := ClaimedBuild{}
+	if err := json.Unmarshal(body, &claimed); err != nil {
+		return 0, fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+
+	return claimed.BuildID, nil
+}
@@ -71,10 +71,35 @@ func (a localApi) UpdateStepStart(buildID int, stepName string) error {
 	return nil
 }
 
-func (a localApi) UpdateStepStop(buildID int, stepName string, exitCode int) error {
+func (a localApi) UpdateStepStop(buildID int, stepName string, exitCode int, details StepStopDetails) error {
 	return nil
 }
 
+func (a localApi) UpdateBuildTimings(buildID int, timings BuildTimings) error {
+	return nil
+}
+
+func (a localApi) UpdateStepTimings(buildID int, stepName string, timings StepTimings) error {
+	return nil
+}
+
+func (a localApi) UpdateBuildFindings(buildID int, findings Findings) error {
+	return nil
+}
+
+func (a localApi) UpdateStepAnnotations(buildID int, stepName string, annotations []Annotation) error {
+	return nil
+}
+
+func (a localApi) RequestStepApproval(buildID int, stepName, message string) error {
+	return nil
+}
+
+// GetStepApproval approves the gate steps of the local builds, nobody can approve them
+func (a localApi) GetStepApproval(buildID int, stepName string) (StepApproval, error) {
+	return StepApproval{Status: ApprovalApproved, By: "local"}, nil
+}
+
 func (a localApi) SecretsForBuild(build Build) (Secrets, error) {
 	secrets := make(Secrets, 0)
 
@@ -87,6 +112,10 @@ func (a localApi) GetAPIURL() (string, error) {
 	return url.String(), err
 }
 
+func (a localApi) LastSuccessfulMeta(jobID int) (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
 func (a localApi) GetCoverageInfo(jobID, pipelineID int, jobName, pipelineName, scope, prNum, prParentJobId string) (Coverage, error) {
 	coverage := Coverage{}
 
@@ -96,3 +125,21 @@ func (a localApi) GetCoverageInfo(jobID, pipelineID int, jobName, pipelineName,
 func (a localApi) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error) {
 	return "", nil
 }
+
+func (a localApi) GetStepToken(buildID int, stepName string, scope []string, ttlSeconds int) (string, error) {
+	return "", nil
+}
+
+// GetIDToken fails, as there is no API to sign the identity tokens in local mode
+func (a localApi) GetIDToken(buildID int, audience string) (string, error) {
+	return "", fmt.Errorf("No identity tokens in local mode")
+}
+
+// NegotiateCapabilities returns the capabilities of the launcher, as local mode supports them all
+func (a localApi) NegotiateCapabilities(buildID int, launcher Capabilities) (Capabilities, error) {
+	return launcher, nil
+}
+
+func (a localApi) ClaimBuild(queue string) (int, error) {
+	return 0, fmt.Errorf("Local mode has no build queue")
+}
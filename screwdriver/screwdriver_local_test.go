@@ -95,10 +95,46 @@ func TestUpdateStepStartLocal(t *testing.T) {
 	}
 }
 
+func TestUpdateBuildTimingsLocal(t *testing.T) {
+	testAPI := localApi{"http://fakeurl", "testJob", Build{}}
+
+	actual := testAPI.UpdateBuildTimings(0, BuildTimings{})
+	if actual != nil {
+		t.Errorf("actual: %v, expected: %v", actual, nil)
+	}
+}
+
+func TestUpdateStepTimingsLocal(t *testing.T) {
+	testAPI := localApi{"http://fakeurl", "testJob", Build{}}
+
+	actual := testAPI.UpdateStepTimings(0, "", StepTimings{})
+	if actual != nil {
+		t.Errorf("actual: %v, expected: %v", actual, nil)
+	}
+}
+
+func TestUpdateBuildFindingsLocal(t *testing.T) {
+	testAPI := localApi{"http://fakeurl", "testJob", Build{}}
+
+	actual := testAPI.UpdateBuildFindings(0, Findings{})
+	if actual != nil {
+		t.Errorf("actual: %v, expected: %v", actual, nil)
+	}
+}
+
+func TestUpdateStepAnnotationsLocal(t *testing.T) {
+	testAPI := localApi{"http://fakeurl", "testJob", Build{}}
+
+	actual := testAPI.UpdateStepAnnotations(0, "", []Annotation{})
+	if actual != nil {
+		t.Errorf("actual: %v, expected: %v", actual, nil)
+	}
+}
+
 func TestUpdateStepStopLocal(t *testing.T) {
 	testAPI := localApi{"http://fakeurl", "testJob", Build{}}
 
-	actual := testAPI.UpdateStepStop(0, "", 0)
+	actual := testAPI.UpdateStepStop(0, "", 0, StepStopDetails{})
 	if actual != nil {
 		t.Errorf("actual: %v, expected: %v", actual, nil)
 	}
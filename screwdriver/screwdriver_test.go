@@ -183,6 +183,8 @@ func TestBuildFromID(t *testing.T) {
 		if len(test.build.Commands) != 0 {
 			test.build.Commands = test.build.Commands[1:]
 		}
+		// The JSON of the build spec is checked by TestSpecBytesOfResponse
+		build.rawSpec = nil
 
 		if !reflect.DeepEqual(build, test.build) {
 			t.Errorf("build == %#v, want %#v", build, test.build)
@@ -499,13 +501,243 @@ func TestUpdateStepStop(t *testing.T) {
 	})
 	testAPI := api{"http://fakeurl", "faketoken", client}
 
-	err := testAPI.UpdateStepStop(999, "step1", 10)
+	err := testAPI.UpdateStepStop(999, "step1", 10, StepStopDetails{})
 
 	if err != nil {
 		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
 	}
 }
 
+func TestUpdateStepStopSignal(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := regexp.MustCompile(`{"endTime":"[\d-]+T[\d:.(Z-|Z+)]+","code":143,"signal":"SIGTERM","usage":{"cpuTimeMs":1500,"maxRssBytes":1048576,"readBytes":0,"writeBytes":4096}}`)
+		if !want.MatchString(buf.String()) {
+			t.Errorf("buf.String() = %q", buf.String())
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateStepStop(999, "step1", 143, StepStopDetails{
+		Signal: "SIGTERM",
+		Usage:  &ResourceUsage{CPUTimeMs: 1500, MaxRSSBytes: 1 << 20, WriteBytes: 4096},
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
+	}
+}
+
+func TestUpdateStepStopPolicy(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := regexp.MustCompile(`{"endTime":"[\d-]+T[\d:.(Z-|Z+)]+","code":126,"policyViolations":\[{"rule":"no-curl-sh","action":"block","message":"Don't pipe downloads to a shell"}\]}`)
+		if !want.MatchString(buf.String()) {
+			t.Errorf("buf.String() = %q", buf.String())
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateStepStop(999, "step1", 126, StepStopDetails{
+		Policy: []PolicyViolation{{Rule: "no-curl-sh", Action: "block", Message: "Don't pipe downloads to a shell"}},
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
+	}
+}
+
+func TestUpdateStepStopOutcome(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := regexp.MustCompile(`{"endTime":"[\d-]+T[\d:.(Z-|Z+)]+","code":4,"allowedFailure":true}`)
+		if !want.MatchString(buf.String()) {
+			t.Errorf("buf.String() = %q", buf.String())
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	if err := testAPI.UpdateStepStop(999, "step1", 4, StepStopDetails{AllowedFailure: true}); err != nil {
+		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
+	}
+}
+
+func TestUpdateStepStopPassedOnRetry(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := regexp.MustCompile(`{"endTime":"[\d-]+T[\d:.(Z-|Z+)]+","code":0,"attempts":2,"passedOnRetry":true}`)
+		if !want.MatchString(buf.String()) {
+			t.Errorf("buf.String() = %q", buf.String())
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	if err := testAPI.UpdateStepStop(999, "step1", 0, StepStopDetails{Attempts: 2, PassedOnRetry: true}); err != nil {
+		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
+	}
+}
+
+func TestUpdateStepStopReason(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := regexp.MustCompile(`{"endTime":"[\d-]+T[\d:.(Z-|Z+)]+","code":143,"reason":"timed_out","message":"Step timeout of 1m0s exceeded"}`)
+		if !want.MatchString(buf.String()) {
+			t.Errorf("buf.String() = %q", buf.String())
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	if err := testAPI.UpdateStepStop(999, "step1", 143, StepStopDetails{Reason: StepTimedOut, Message: "Step timeout of 1m0s exceeded"}); err != nil {
+		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
+	}
+}
+
+func TestUpdateStepStopTests(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := regexp.MustCompile(`{"endTime":"[\d-]+T[\d:.(Z-|Z+)]+","code":1,"tests":{"planned":3,"passed":2,"failed":1,"skipped":0,"todo":0,"failures":\[{"number":2,"test":"parses the config","message":"got 1, want 2"}\]}}`)
+		if !want.MatchString(buf.String()) {
+			t.Errorf("buf.String() = %q", buf.String())
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	tests := &StepTests{Planned: 3, Passed: 2, Failed: 1, Failures: []StepTestFailure{{Number: 2, Test: "parses the config", Message: "got 1, want 2"}}}
+	if err := testAPI.UpdateStepStop(999, "step1", 1, StepStopDetails{Tests: tests}); err != nil {
+		t.Errorf("Unexpected error from UpdateStepStop: %v", err)
+	}
+}
+
+func TestUpdateBuildTimings(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v4/builds/999" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"stats":{"timings":{"queueTimeMs":500,"totalTimeMs":2000,"stepsTimeMs":1500,"teardownTimeMs":500,"steps":[{"name":"install","durationMs":1500,"percent":75}]}}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateBuildTimings(999, BuildTimings{
+		QueueTimeMs:    500,
+		TotalTimeMs:    2000,
+		StepsTimeMs:    1500,
+		TeardownTimeMs: 500,
+		Steps:          []StepTiming{{Name: "install", DurationMs: 1500, Percent: 75}},
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateBuildTimings: %v", err)
+	}
+}
+
+func TestUpdateStepTimings(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v4/builds/999/steps/step1" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"timings":{"scriptWriteMs":0.25,"ptyRoundTripMs":1.5,"stepStartUpdateMs":20,"stepStopUpdateMs":30.125}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateStepTimings(999, "step1", StepTimings{
+		ScriptWriteMs:     0.25,
+		PtyRoundTripMs:    1.5,
+		StepStartUpdateMs: 20,
+		StepStopUpdateMs:  30.125,
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateStepTimings: %v", err)
+	}
+}
+
+func TestUpdateBuildFindings(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v4/builds/999" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"findings":{"files":["gosec.sarif"],"tools":["gosec"],"errors":1,"warnings":0,"notes":0,"findings":[{"tool":"gosec","rule":"G101","level":"error","message":"Potential hardcoded credentials","file":"main.go","line":12}],"violations":["1 errors, more than 0"],"decision":"failed"}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateBuildFindings(999, Findings{
+		Files:      []string{"gosec.sarif"},
+		Tools:      []string{"gosec"},
+		Errors:     1,
+		Findings:   []Finding{{Tool: "gosec", Rule: "G101", Level: "error", Message: "Potential hardcoded credentials", File: "main.go", Line: 12}},
+		Violations: []string{"1 errors, more than 0"},
+		Decision:   "failed",
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateBuildFindings: %v", err)
+	}
+}
+
+func TestUpdateStepAnnotations(t *testing.T) {
+	var client *retryablehttp.Client
+	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v4/builds/999/steps/step1" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"annotations":[{"file":"main.c","line":3,"column":7,"severity":"error","message":"expected ';'","matcher":"gcc"}]}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+	testAPI := api{"http://fakeurl", "faketoken", client}
+
+	err := testAPI.UpdateStepAnnotations(999, "step1", []Annotation{
+		{File: "main.c", Line: 3, Column: 7, Severity: AnnotationError, Message: "expected ';'", Matcher: "gcc"},
+	})
+
+	if err != nil {
+		t.Errorf("Unexpected error from UpdateStepAnnotations: %v", err)
+	}
+}
+
 func TestGetAPIURL(t *testing.T) {
 	var client *retryablehttp.Client
 	client = makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
@@ -589,6 +821,192 @@ func TestGetBuildToken(t *testing.T) {
 	}
 }
 
+func TestLastSuccessfulMeta(t *testing.T) {
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, `{"tests":{"coverage":"80"}}`, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/jobs/1555/lastSuccessfulMeta")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Last successful meta URL=%q, want %q", r.URL, wantURL)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	meta, err := testAPI.LastSuccessfulMeta(1555)
+	if err != nil {
+		t.Fatalf("Unexpected error from LastSuccessfulMeta: %v", err)
+	}
+	if want := map[string]interface{}{"tests": map[string]interface{}{"coverage": "80"}}; !reflect.DeepEqual(meta, want) {
+		t.Errorf("meta=%v, want %v", meta, want)
+	}
+}
+
+func TestRequestStepApproval(t *testing.T) {
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v4/builds/1111/steps/deploy" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"approval":{"status":"waiting","message":"Deploy to production?"}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	if err := testAPI.RequestStepApproval(1111, "deploy", "Deploy to production?"); err != nil {
+		t.Errorf("Unexpected error from RequestStepApproval: %v", err)
+	}
+}
+
+func TestGetStepApproval(t *testing.T) {
+	testResponse := `{"name": "deploy", "approval": {"status": "rejected", "by": "jdoe", "message": "Not on a Friday"}}`
+
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, testResponse, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/builds/1111/steps/deploy")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Step Approval URL=%q, want %q", r.URL, wantURL)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	approval, err := testAPI.GetStepApproval(1111, "deploy")
+	if err != nil {
+		t.Fatalf("Unexpected error from GetStepApproval: %v", err)
+	}
+	if want := (StepApproval{Status: ApprovalRejected, By: "jdoe", Message: "Not on a Friday"}); approval != want {
+		t.Errorf("approval=%+v, want %+v", approval, want)
+	}
+}
+
+func TestGetStepToken(t *testing.T) {
+	testResponse := `{"token": "steptoken"}`
+
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, testResponse, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/builds/1111/steps/publish/token")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Step Token URL=%q, want %q", r.URL, wantURL)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"scope":["store","meta"],"ttl":900}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	token, err := testAPI.GetStepToken(1111, "publish", []string{"store", "meta"}, 900)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetStepToken: %v", err)
+	}
+	if token != "steptoken" {
+		t.Errorf("token=%q, want %q", token, "steptoken")
+	}
+
+	client.HTTPClient = makeFakeHTTPClient(t, 200, `{}`)
+	if _, err := testAPI.GetStepToken(1111, "publish", nil, 900); err == nil {
+		t.Errorf("Expected an error for a response without a token")
+	}
+}
+
+func TestGetIDToken(t *testing.T) {
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, `{"token": "idtoken"}`, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/builds/1111/idtoken")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("ID Token URL=%q, want %q", r.URL, wantURL)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"audience":"sts.amazonaws.com"}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	token, err := testAPI.GetIDToken(1111, "sts.amazonaws.com")
+	if err != nil {
+		t.Fatalf("Unexpected error from GetIDToken: %v", err)
+	}
+	if token != "idtoken" {
+		t.Errorf("token=%q, want %q", token, "idtoken")
+	}
+
+	client.HTTPClient = makeFakeHTTPClient(t, 200, `{}`)
+	if _, err := testAPI.GetIDToken(1111, "sts.amazonaws.com"); err == nil {
+		t.Errorf("Expected an error for a response without a token")
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	testResponse := `{"version":"7.1.0","logProtocol":1,"features":["requeue"]}`
+
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, testResponse, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/builds/1111/capabilities")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Capabilities URL=%q, want %q", r.URL, wantURL)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"launcher":{"version":"6.0.0","logProtocol":2,"teardown":"always","features":["requeue"]}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	launcher := Capabilities{Version: "6.0.0", LogProtocol: 2, Teardown: TeardownAlways, Features: []string{FeatureRequeue}}
+	capabilities, err := testAPI.NegotiateCapabilities(1111, launcher)
+	if err != nil {
+		t.Fatalf("Unexpected error from NegotiateCapabilities: %v", err)
+	}
+	want := Capabilities{Version: "7.1.0", LogProtocol: 1, Features: []string{FeatureRequeue}}
+	if !reflect.DeepEqual(capabilities, want) {
+		t.Errorf("capabilities=%+v, want %+v", capabilities, want)
+	}
+
+	client.HTTPClient = makeFakeHTTPClient(t, 404, `{"statusCode":404,"error":"Not Found","message":"Not Found"}`)
+	if _, err := testAPI.NegotiateCapabilities(1111, launcher); err == nil {
+		t.Errorf("Expected an error from an API that does not negotiate capabilities")
+	}
+}
+
+func TestClaimBuild(t *testing.T) {
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeValidatedFakeHTTPClient(t, 200, `{"buildId": 1234}`, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/queues/builds/claim")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Claim Build URL=%q, want %q", r.URL, wantURL)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"queue":"dedicated"}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", "faketoken", client}
+	buildID, err := testAPI.ClaimBuild("dedicated")
+	if err != nil {
+		t.Fatalf("Unexpected error from ClaimBuild: %v", err)
+	}
+	if buildID != 1234 {
+		t.Errorf("buildID=%d, want 1234", buildID)
+	}
+
+	client.HTTPClient = makeFakeHTTPClient(t, 204, "")
+	if buildID, err := testAPI.ClaimBuild("dedicated"); buildID != 0 || err != nil {
+		t.Errorf("ClaimBuild() = %d, %v, want no build", buildID, err)
+	}
+}
+
 func TestNewDefaults(t *testing.T) {
 	maxRetries = 5
 	httpTimeout = time.Duration(20) * time.Second
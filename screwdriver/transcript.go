@@ -0,0 +1,217 @@
+package screwdriver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/logger"
+)
+
+// TranscriptEntry is an HTTP request to the Screwdriver API and its response in the transcript of
+// a build: one per attempt, with the error of the attempts that got no response
+type TranscriptEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Request  string    `json:"request,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// transcriptTokens matches the tokens in the bodies of the requests and responses, which the
+// transcript never has
+var transcriptTokens = regexp.MustCompile(`(?i)("\w*token"\s*:\s*)"[^"]*"`)
+
+// Returns body with its tokens masked
+func redactTokens(body []byte) string {
+	return transcriptTokens.ReplaceAllString(string(body), `$1"********"`)
+}
+
+// transcriptTransport writes every request going through it and its response to a transcript, as
+// lines of JSON
+type transcriptTransport struct {
+	next http.RoundTripper
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *transcriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := TranscriptEntry{Time: time.Now().UTC(), Method: req.Method, Path: req.URL.RequestURI()}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		entry.Request = redactTokens(body)
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		body, rerr := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		entry.Status, entry.Response = res.StatusCode, redactTokens(body)
+		if rerr != nil {
+			entry.Error = rerr.Error()
+		}
+	}
+
+	line, _ := json.Marshal(entry)
+	t.mu.Lock()
+	if _, werr := t.w.Write(append(line, '\n')); werr != nil {
+		logger.Warnf("Failed to write the API transcript: %v", werr)
+	}
+	t.mu.Unlock()
+	return res, err
+}
+
+// RecordTranscript returns a, writing the transcript of its requests to the Screwdriver API to w
+// so the build can be replayed. The API of local mode, which makes no request, has none.
+func RecordTranscript(a API, w io.Writer) API {
+	httpAPI, ok := a.(api)
+	if !ok {
+		return a
+	}
+	next := httpAPI.client.HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	httpAPI.client.HTTPClient.Transport = &transcriptTransport{next: next, w: w}
+	return httpAPI
+}
+
+// replayTransport answers the requests with the responses of a transcript, in the order they
+// were recorded for each method and path
+type replayTransport struct {
+	mu        sync.Mutex
+	responses map[string][]TranscriptEntry
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	key := req.Method + " " + req.URL.RequestURI()
+
+	t.mu.Lock()
+	entries := t.responses[key]
+	var entry TranscriptEntry
+	if len(entries) > 0 {
+		entry = entries[0]
+		// The last response answers the requests made more often than recorded, e.g. polls
+		if len(entries) > 1 {
+			t.responses[key] = entries[1:]
+		}
+	}
+	t.mu.Unlock()
+
+	if len(entries) == 0 {
+		logger.Warnf("Replay: no recorded response to %s", key)
+		entry = TranscriptEntry{Status: http.StatusNotFound, Response: `{"statusCode":404,"error":"Not Found","message":"No recorded response"}`}
+	} else if !sameRequest(body, []byte(entry.Request)) {
+		logger.Warnf("Replay: %s sent %s, recorded %s", key, body, entry.Request)
+	} else {
+		logger.Debugf("Replay: %s", key)
+	}
+	if entry.Error != "" && entry.Status == 0 {
+		return nil, fmt.Errorf("%s", entry.Error)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(entry.Response)),
+		ContentLength: int64(len(entry.Response)),
+		Request:       req,
+	}, nil
+}
+
+// Reports whether the request body sent is the one recorded, but for its times and durations and
+// its masked tokens
+func sameRequest(sent, recorded []byte) bool {
+	if redactTokens(sent) == string(recorded) {
+		return true
+	}
+	var a, b interface{}
+	if json.Unmarshal([]byte(redactTokens(sent)), &a) != nil || json.Unmarshal(recorded, &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(withoutTimes(a), withoutTimes(b))
+}
+
+// Returns the JSON value v without the fields of its objects that are times or durations, which
+// differ from one run to the next
+func withoutTimes(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for key, value := range v {
+			if !strings.HasSuffix(key, "Time") && !strings.HasSuffix(key, "Ms") {
+				out[key] = withoutTimes(value)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = withoutTimes(value)
+		}
+		return out
+	}
+	return v
+}
+
+// NewReplay returns an API answering with the responses of the transcript r instead of the
+// Screwdriver API at url, to replay a recorded build. The requests differing from the recorded
+// ones are logged.
+func NewReplay(url string, r io.Reader) (API, error) {
+	t := &replayTransport{responses: map[string][]TranscriptEntry{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("Parsing line %d of the API transcript: %v", line, err)
+		}
+		key := entry.Method + " " + entry.Path
+		t.responses[key] = append(t.responses[key], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Reading the API transcript: %v", err)
+	}
+
+	a, err := New(url, "")
+	if err != nil {
+		return nil, err
+	}
+	replay := a.(api)
+	replay.client.HTTPClient.Transport = t
+	return replay, nil
+}
@@ -0,0 +1,101 @@
+package screwdriver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRecordTranscript(t *testing.T) {
+	client := makeRetryableHttpClient(testMaxRetries, testRetryWaitMin, testRetryWaitMax, testHttpTimeout)
+	client.HTTPClient = makeFakeHTTPClient(t, 200, `{"token":"secrettoken"}`)
+	var transcript bytes.Buffer
+	testAPI := RecordTranscript(api{"http://fakeurl", "faketoken", client}, &transcript)
+
+	token, err := testAPI.GetBuildToken(999, 60)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if token != "secrettoken" {
+		t.Errorf("The response should be left alone, got token %q", token)
+	}
+	if strings.Contains(transcript.String(), "secrettoken") || strings.Contains(transcript.String(), "faketoken") {
+		t.Errorf("The transcript should have no token: %s", transcript.String())
+	}
+
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(&transcript)
+	for scanner.Scan() {
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid transcript line %s: %v", scanner.Bytes(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Want 1 entry, got %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Method != "POST" || entry.Path != "/v4/builds/999/token" || entry.Status != 200 || entry.Request != `{"buildTimeout":90}` {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if !strings.Contains(entry.Response, `"token":"********"`) {
+		t.Errorf("The token of the response should be masked: %s", entry.Response)
+	}
+
+	local, _ := NewLocal("http://fakeurl", "main", Build{})
+	if _, ok := RecordTranscript(local, &transcript).(localApi); !ok {
+		t.Errorf("The local API should have no transcript")
+	}
+}
+
+func TestNewReplay(t *testing.T) {
+	transcript := strings.Join([]string{
+		`{"method":"GET","path":"/v4/builds/999","status":200,"response":"{\"id\":999,\"jobId\":1,\"steps\":[{\"name\":\"test\",\"command\":\"make test\"}]}"}`,
+		`{"method":"GET","path":"/v4/jobs/1","status":200,"response":"{\"id\":1,\"name\":\"main\"}"}`,
+		``,
+	}, "\n")
+	testAPI, err := NewReplay("http://fakeurl", strings.NewReader(transcript))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		build, err := testAPI.BuildFromID(999)
+		if err != nil || build.ID != 999 || build.JobID != 1 {
+			t.Errorf("BuildFromID() = %+v, %v, want the recorded build", build, err)
+		}
+	}
+	job, err := testAPI.JobFromID(1)
+	if err != nil || job.Name != "main" {
+		t.Errorf("JobFromID() = %+v, %v, want the recorded job", job, err)
+	}
+	if _, err := testAPI.PipelineFromID(7); err == nil {
+		t.Errorf("A request with no recorded response should fail")
+	}
+
+	if _, err := NewReplay("http://fakeurl", strings.NewReader("{\n")); err == nil {
+		t.Errorf("An invalid transcript should fail")
+	}
+}
+
+func TestSameRequest(t *testing.T) {
+	tests := []struct {
+		sent, recorded string
+		same           bool
+	}{
+		{`{"a":1}`, `{"a":1}`, true},
+		{`{"a":1,"startTime":"2026-10-16T10:00:00Z"}`, `{"startTime":"2026-01-01T00:00:00Z","a":1}`, true},
+		{`{"a":1,"durationMs":12}`, `{"a":1}`, true},
+		{`{"token":"abc"}`, `{"token":"********"}`, true},
+		{`{"a":1}`, `{"a":2}`, false},
+		{`plain`, `other`, false},
+	}
+	for _, test := range tests {
+		if same := sameRequest([]byte(test.sent), []byte(test.recorded)); same != test.same {
+			t.Errorf("sameRequest(%s, %s) = %v, want %v", test.sent, test.recorded, same, test.same)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package sqs is a minimal client of the query API of Amazon SQS and the queues compatible with it
+// (ElasticMQ, LocalStack...), receiving and deleting messages with Signature Version 4
+package sqs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/sigv4"
+)
+
+// apiVersion is the version of the SQS query API
+const apiVersion = "2012-11-05"
+
+// Client receives and deletes the messages of a queue
+type Client struct {
+	queueURL    string
+	region      string
+	credentials sigv4.Credentials
+	http        *http.Client
+	now         func() time.Time
+}
+
+// Message is a message of the queue
+type Message struct {
+	MessageID     string `xml:"MessageId"`
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	Body          string `xml:"Body"`
+}
+
+// Error is an error response of the queue
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Error>Code"`
+	Message    string `xml:"Error>Message"`
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// New returns a Client of the queue at queueURL. The region is that of AWS_REGION or
+// AWS_DEFAULT_REGION if region is empty, else of the host of an SQS URL
+// (sqs.<region>.amazonaws.com), else us-east-1.
+func New(queueURL, region string, credentials sigv4.Credentials) (*Client, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid queue URL %q", queueURL)
+	}
+	for _, r := range []string{region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if region = r; region != "" {
+			break
+		}
+	}
+	if parts := strings.Split(u.Hostname(), "."); region == "" && len(parts) == 4 && parts[0] == "sqs" && parts[2] == "amazonaws" {
+		region = parts[1]
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &Client{
+		queueURL:    queueURL,
+		region:      region,
+		credentials: credentials,
+		// Long polls last up to 20 seconds
+		http: &http.Client{Timeout: 30 * time.Second},
+		now:  time.Now,
+	}, nil
+}
+
+// Receive waits up to waitSeconds for a message of the queue and returns it, or nil without one.
+// It is hidden from the other receivers for visibilitySeconds, or the default of the queue if 0.
+func (c *Client) Receive(waitSeconds, visibilitySeconds int) (*Message, error) {
+	params := url.Values{
+		"Action":              {"ReceiveMessage"},
+		"MaxNumberOfMessages": {"1"},
+		"WaitTimeSeconds":     {strconv.Itoa(waitSeconds)},
+	}
+	if visibilitySeconds > 0 {
+		params.Set("VisibilityTimeout", strconv.Itoa(visibilitySeconds))
+	}
+	var res struct {
+		Messages []Message `xml:"ReceiveMessageResult>Message"`
+	}
+	if err := c.do(params, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Messages) == 0 {
+		return nil, nil
+	}
+	return &res.Messages[0], nil
+}
+
+// Delete deletes the message received with receiptHandle from the queue
+func (c *Client) Delete(receiptHandle string) error {
+	return c.do(url.Values{"Action": {"DeleteMessage"}, "ReceiptHandle": {receiptHandle}}, nil)
+}
+
+// Posts the action of params to the queue and decodes its XML response into v if not nil
+func (c *Client) do(params url.Values, v interface{}) error {
+	params.Set("Version", apiVersion)
+	body := params.Encode()
+	req, err := http.NewRequest("POST", c.queueURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.sign(req, []byte(body), c.now().UTC())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %v", params.Get("Action"), err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Reading the response to %s: %v", params.Get("Action"), err)
+	}
+	if res.StatusCode/100 != 2 {
+		e := Error{StatusCode: res.StatusCode}
+		xml.Unmarshal(data, &e)
+		return fmt.Errorf("%s: %v", params.Get("Action"), e)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Parsing the response to %s: %v", params.Get("Action"), err)
+	}
+	return nil
+}
+
+// Signs req, with body, for the SQS service at t with Signature Version 4
+func (c *Client) sign(req *http.Request, body []byte, t time.Time) {
+	sigv4.Sign(req, body, t, c.region, "sqs", c.credentials)
+}
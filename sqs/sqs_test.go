@@ -0,0 +1,88 @@
+package sqs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/sigv4"
+)
+
+func TestNew(t *testing.T) {
+	defer os.Setenv("AWS_REGION", os.Getenv("AWS_REGION"))
+	defer os.Setenv("AWS_DEFAULT_REGION", os.Getenv("AWS_DEFAULT_REGION"))
+	os.Setenv("AWS_REGION", "")
+	os.Setenv("AWS_DEFAULT_REGION", "")
+	tests := []struct {
+		url, region, want string
+		err               bool
+	}{
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/builds", "", "eu-west-1", false},
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/builds", "us-west-2", "us-west-2", false},
+		{"http://localhost:9324/queue/builds", "", "us-east-1", false},
+		{"builds", "", "", true},
+		{"ftp://localhost/builds", "", "", true},
+	}
+	for _, test := range tests {
+		c, err := New(test.url, test.region, sigv4.Credentials{})
+		if (err != nil) != test.err {
+			t.Errorf("New(%q) error %v, want error %v", test.url, err, test.err)
+		}
+		if err == nil && c.region != test.want {
+			t.Errorf("New(%q, %q) region %q, want %q", test.url, test.region, c.region, test.want)
+		}
+	}
+}
+
+func TestReceiveAndDelete(t *testing.T) {
+	var actions []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		params, _ := url.ParseQuery(string(body))
+		actions = append(actions, params)
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("Unsigned request: %v", r.Header)
+		}
+		switch params.Get("Action") {
+		case "ReceiveMessage":
+			if len(actions) > 1 {
+				w.Write([]byte(`<ReceiveMessageResponse><ReceiveMessageResult/></ReceiveMessageResponse>`))
+				return
+			}
+			w.Write([]byte(`<ReceiveMessageResponse><ReceiveMessageResult><Message><MessageId>m1</MessageId><ReceiptHandle>r1</ReceiptHandle><Body>{"buildId":123}</Body></Message></ReceiveMessageResult></ReceiveMessageResponse>`))
+		case "DeleteMessage":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>ReceiptHandleIsInvalid</Code><Message>The receipt handle is invalid</Message></Error></ErrorResponse>`))
+		}
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL+"/queue/builds", "", sigv4.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := c.Receive(20, 60)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m == nil || m.MessageID != "m1" || m.ReceiptHandle != "r1" || m.Body != `{"buildId":123}` {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if got := actions[0]; got.Get("WaitTimeSeconds") != "20" || got.Get("VisibilityTimeout") != "60" || got.Get("Version") != apiVersion {
+		t.Errorf("Unexpected parameters %v", got)
+	}
+	if m, err := c.Receive(20, 0); m != nil || err != nil {
+		t.Errorf("Receive() = %+v, %v, want no message", m, err)
+	}
+	err = c.Delete("r1")
+	if err == nil || !strings.Contains(err.Error(), "400 ReceiptHandleIsInvalid: The receipt handle is invalid") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if got := actions[2].Get("ReceiptHandle"); got != "r1" {
+		t.Errorf("Deleted %q, want r1", got)
+	}
+}
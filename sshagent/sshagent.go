@@ -0,0 +1,127 @@
+// Package sshagent runs the ssh-agent of a build, holding its deploy keys for the steps and the
+// checkout to reach private Git repositories without writing the keys to disk
+package sshagent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// startTimeout is how long the agent has to listen on its socket
+	startTimeout = 5 * time.Second
+	// pollInterval is how often the socket is checked while the agent starts
+	pollInterval = 10 * time.Millisecond
+)
+
+// Agent is a running ssh-agent
+type Agent struct {
+	// Socket is the socket of the agent, for SSH_AUTH_SOCK
+	Socket string
+	dir    string
+	cmd    *exec.Cmd
+}
+
+// Start starts an ssh-agent listening on a socket in a new private directory of dir, the
+// temporary directory if empty
+func Start(dir string) (*Agent, error) {
+	return StartAs(dir, os.Getuid(), os.Getgid())
+}
+
+// StartAs starts an ssh-agent like Start, run as uid and gid with its directory owned by them, for
+// the steps of another user to connect to it: the agent only serves its own user and root
+func StartAs(dir string, uid, gid int) (*Agent, error) {
+	path, err := exec.LookPath("ssh-agent")
+	if err != nil {
+		return nil, fmt.Errorf("No ssh-agent: %v", err)
+	}
+	private, err := ioutil.TempDir(dir, "ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("Creating the directory of the agent: %v", err)
+	}
+
+	a := &Agent{Socket: filepath.Join(private, "agent.sock"), dir: private}
+	// -D keeps the agent in the foreground, as a child of the launcher to stop with the build
+	a.cmd = exec.Command(path, "-D", "-a", a.Socket)
+	if uid != os.Getuid() || gid != os.Getgid() {
+		if err := os.Chown(private, uid, gid); err != nil {
+			os.RemoveAll(private)
+			return nil, fmt.Errorf("Giving the directory of the agent to %d:%d: %v", uid, gid, err)
+		}
+		a.cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	}
+	var stderr bytes.Buffer
+	a.cmd.Stderr = &stderr
+	if err := a.cmd.Start(); err != nil {
+		os.RemoveAll(private)
+		return nil, fmt.Errorf("Starting ssh-agent: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		a.cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(startTimeout)
+	for {
+		if _, err := os.Stat(a.Socket); err == nil {
+			return a, nil
+		}
+		select {
+		case <-exited:
+			os.RemoveAll(private)
+			return nil, fmt.Errorf("ssh-agent exited: %s", strings.TrimSpace(stderr.String()))
+		case <-time.After(pollInterval):
+		}
+		if time.Now().After(deadline) {
+			a.Stop()
+			return nil, fmt.Errorf("ssh-agent did not listen on %s after %v", a.Socket, startTimeout)
+		}
+	}
+}
+
+// Add adds the private key, in the OpenSSH or PEM format, or base64 of either, to the agent
+func (a *Agent) Add(name, key string) error {
+	cmd := exec.Command("ssh-add", "-q", "-")
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+a.Socket)
+	cmd.Stdin = strings.NewReader(NormalizeKey(key))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Adding the key %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Stop stops the agent and removes its socket
+func (a *Agent) Stop() {
+	if a == nil {
+		return
+	}
+	if a.cmd.Process != nil {
+		a.cmd.Process.Kill()
+	}
+	os.RemoveAll(a.dir)
+}
+
+// NormalizeKey returns the private key as ssh-add reads it: decoded if it is base64, with the
+// newlines of the secrets stored with \n escapes, and a final newline
+func NormalizeKey(key string) string {
+	key = strings.TrimSpace(key)
+	if !strings.HasPrefix(key, "-----BEGIN") {
+		if decoded, err := base64.StdEncoding.DecodeString(key); err == nil {
+			key = strings.TrimSpace(string(decoded))
+		}
+	}
+	if !strings.Contains(key, "\n") {
+		key = strings.ReplaceAll(key, `\n`, "\n")
+	}
+	return strings.ReplaceAll(key, "\r\n", "\n") + "\n"
+}
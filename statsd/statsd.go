@@ -0,0 +1,90 @@
+// Package statsd is a minimal StatsD client sending counters and timers over UDP, with
+// DogStatsD tags when enabled
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client sends metrics to a StatsD server. A nil Client sends nothing, so callers don't need to
+// check whether metrics are enabled.
+type Client struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	tags      []string
+}
+
+// New returns a Client sending the metrics named prefix + name to the StatsD server at addr
+// (host:port). With dogstatsd set, tags (key:value) are added to every metric; plain StatsD has
+// no tags, so they are dropped otherwise.
+func New(addr, prefix string, dogstatsd bool, tags ...string) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to statsd at %q: %v", addr, err)
+	}
+
+	return &Client{
+		conn:      conn,
+		prefix:    prefix,
+		dogstatsd: dogstatsd,
+		tags:      tags,
+	}, nil
+}
+
+// Count adds n to the counter name
+func (c *Client) Count(name string, n int64, tags ...string) error {
+	return c.send(name, fmt.Sprintf("%d", n), "c", tags)
+}
+
+// Timing records d, in milliseconds, for the timer name
+func (c *Client) Timing(name string, d time.Duration, tags ...string) error {
+	return c.send(name, fmt.Sprintf("%d", int64(d/time.Millisecond)), "ms", tags)
+}
+
+// Returns the packet for one metric: name:value|type, followed by |#tags for DogStatsD
+func (c *Client) format(name, value, kind string, tags []string) string {
+	packet := c.prefix + nameReplacer.Replace(name) + ":" + value + "|" + kind
+	if !c.dogstatsd {
+		return packet
+	}
+
+	all := append(append([]string{}, c.tags...), tags...)
+	if len(all) == 0 {
+		return packet
+	}
+	for i, tag := range all {
+		all[i] = tagReplacer.Replace(tag)
+	}
+	return packet + "|#" + strings.Join(all, ",")
+}
+
+func (c *Client) send(name, value, kind string, tags []string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write([]byte(c.format(name, value, kind, tags)))
+	return err
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Replace the characters that delimit the fields of a packet in metric names and tags
+var (
+	nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+	tagReplacer  = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+)
@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts a UDP server returning the packets it receives
+func listen(t *testing.T) (string, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String(), func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Didn't receive a packet: %v", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestStatsd(t *testing.T) {
+	addr, receive := listen(t)
+	c, err := New(addr, "sd.launcher.", false, "pipeline_id:1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	c.Count("step.failure", 1, "step:test")
+	if got, want := receive(), "sd.launcher.step.failure:1|c"; got != want {
+		t.Errorf("Count sent %q, want %q", got, want)
+	}
+	c.Timing("step|duration", 1500*time.Millisecond)
+	if got, want := receive(), "sd.launcher.step_duration:1500|ms"; got != want {
+		t.Errorf("Timing sent %q, want %q", got, want)
+	}
+}
+
+func TestDogStatsd(t *testing.T) {
+	addr, receive := listen(t)
+	c, err := New(addr, "", true, "pipeline_id:1", "job:main")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	c.Timing("step.duration", 20*time.Millisecond, "step:install,deps")
+	if got, want := receive(), "step.duration:20|ms|#pipeline_id:1,job:main,step:install_deps"; got != want {
+		t.Errorf("Timing sent %q, want %q", got, want)
+	}
+	c.Count("build.failure", 2)
+	if got, want := receive(), "build.failure:2|c|#pipeline_id:1,job:main"; got != want {
+		t.Errorf("Count sent %q, want %q", got, want)
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	var c *Client
+	if err := c.Count("step.failure", 1); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestNewInvalidAddress(t *testing.T) {
+	if _, err := New("no port", "", false); err == nil {
+		t.Errorf("Expected an error for an invalid address")
+	}
+}
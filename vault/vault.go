@@ -0,0 +1,270 @@
+// Package vault is a minimal client of the HTTP API of HashiCorp Vault, logging in with a token or
+// the AppRole or Kubernetes auth methods and reading the secrets of the KV engines
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Auth methods of the launcher
+const (
+	AuthToken      = "token"
+	AuthAppRole    = "approle"
+	AuthKubernetes = "kubernetes"
+)
+
+const (
+	// requestTimeout bounds a request to Vault
+	requestTimeout = 30 * time.Second
+	// kubernetesTokenPath is where Kubernetes mounts the service account token of the pods
+	kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// Client reads the secrets of a Vault
+type Client struct {
+	addr      *url.URL
+	namespace string
+	token     string
+	http      *http.Client
+}
+
+// Error is an error response of Vault
+type Error struct {
+	StatusCode int
+	Errors     []string `json:"errors"`
+}
+
+func (e Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("Vault returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("Vault returned status %d: %s", e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+// Reference is a value of a secret of Vault: the value of Key in the secret at Path, the path of
+// the API, e.g. secret/data/app for the secret app of a KV version 2 engine mounted at secret
+type Reference struct {
+	Path string
+	Key  string
+}
+
+// ParseReference parses a reference to a value of a secret, path#key
+func ParseReference(s string) (Reference, error) {
+	i := strings.LastIndexByte(s, '#')
+	if i < 0 {
+		return Reference{}, fmt.Errorf("Invalid Vault reference %q, want path#key", s)
+	}
+	r := Reference{Path: strings.Trim(s[:i], "/"), Key: s[i+1:]}
+	if r.Path == "" || r.Key == "" || strings.Contains(r.Path, "..") {
+		return Reference{}, fmt.Errorf("Invalid Vault reference %q, want path#key", s)
+	}
+	return r, nil
+}
+
+func (r Reference) String() string {
+	return r.Path + "#" + r.Key
+}
+
+// New returns a Client of the Vault at addr, in namespace if not empty, without a token
+func New(addr, namespace string) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(addr, "/"))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid Vault address %q", addr)
+	}
+	return &Client{addr: u, namespace: namespace, http: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+// NewFromEnv returns a Client of the Vault at VAULT_ADDR, in VAULT_NAMESPACE, logged in with the
+// auth method SD_VAULT_AUTH mounted at SD_VAULT_AUTH_MOUNT, the name of the method by default:
+//   - token, the default, with VAULT_TOKEN
+//   - approle with VAULT_ROLE_ID and VAULT_SECRET_ID
+//   - kubernetes with the role SD_VAULT_ROLE and the service account token of the pod, or the one
+//     at SD_VAULT_JWT_PATH
+func NewFromEnv() (*Client, error) {
+	addr := strings.TrimSpace(os.Getenv("VAULT_ADDR"))
+	if addr == "" {
+		return nil, fmt.Errorf("No VAULT_ADDR")
+	}
+	c, err := New(addr, strings.TrimSpace(os.Getenv("VAULT_NAMESPACE")))
+	if err != nil {
+		return nil, err
+	}
+
+	method := strings.TrimSpace(os.Getenv("SD_VAULT_AUTH"))
+	if method == "" {
+		method = AuthToken
+	}
+	mount := strings.Trim(os.Getenv("SD_VAULT_AUTH_MOUNT"), "/ ")
+	if mount == "" {
+		mount = method
+	}
+	switch method {
+	case AuthToken:
+		if c.token = os.Getenv("VAULT_TOKEN"); c.token == "" {
+			return nil, fmt.Errorf("No VAULT_TOKEN")
+		}
+		return c, nil
+	case AuthAppRole:
+		roleID, secretID := os.Getenv("VAULT_ROLE_ID"), os.Getenv("VAULT_SECRET_ID")
+		if roleID == "" {
+			return nil, fmt.Errorf("No VAULT_ROLE_ID")
+		}
+		return c, c.LoginAppRole(mount, roleID, secretID)
+	case AuthKubernetes:
+		role := os.Getenv("SD_VAULT_ROLE")
+		if role == "" {
+			return nil, fmt.Errorf("No SD_VAULT_ROLE")
+		}
+		path := os.Getenv("SD_VAULT_JWT_PATH")
+		if path == "" {
+			path = kubernetesTokenPath
+		}
+		jwt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Reading the service account token: %v", err)
+		}
+		return c, c.LoginKubernetes(mount, role, strings.TrimSpace(string(jwt)))
+	}
+	return nil, fmt.Errorf("Invalid SD_VAULT_AUTH %q, want %q, %q or %q", method, AuthToken, AuthAppRole, AuthKubernetes)
+}
+
+// LoginAppRole logs in with the AppRole auth method mounted at mount
+func (c *Client) LoginAppRole(mount, roleID, secretID string) error {
+	body := map[string]string{"role_id": roleID}
+	if secretID != "" {
+		body["secret_id"] = secretID
+	}
+	return c.login(mount, body)
+}
+
+// LoginKubernetes logs in as role with the Kubernetes auth method mounted at mount and the service
+// account token jwt
+func (c *Client) LoginKubernetes(mount, role, jwt string) error {
+	return c.login(mount, map[string]string{"role": role, "jwt": jwt})
+}
+
+// Logs in with the auth method mounted at mount, keeping the token it returns
+func (c *Client) login(mount string, body interface{}) error {
+	var res struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.do("POST", "auth/"+mount+"/login", body, &res); err != nil {
+		return fmt.Errorf("Logging in to Vault with %s: %v", mount, err)
+	}
+	if res.Auth.ClientToken == "" {
+		return fmt.Errorf("Logging in to Vault with %s: no token", mount)
+	}
+	c.token = res.Auth.ClientToken
+	return nil
+}
+
+// Read returns the data of the secret at path. The data of the secrets of the KV version 2
+// engines is unwrapped from their metadata.
+func (c *Client) Read(path string) (map[string]interface{}, error) {
+	var res struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := c.do("GET", path, nil, &res); err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", path, err)
+	}
+	if data, ok := res.Data["data"].(map[string]interface{}); ok {
+		if _, ok := res.Data["metadata"]; ok {
+			return data, nil
+		}
+	}
+	if res.Data == nil {
+		return nil, fmt.Errorf("Reading %s: no data", path)
+	}
+	return res.Data, nil
+}
+
+// Values returns the values of the references by name, reading each secret once. Values that are
+// not strings are JSON.
+func (c *Client) Values(references map[string]Reference) (map[string]string, error) {
+	names := make([]string, 0, len(references))
+	for name := range references {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	secrets := map[string]map[string]interface{}{}
+	values := map[string]string{}
+	for _, name := range names {
+		r := references[name]
+		data, ok := secrets[r.Path]
+		if !ok {
+			var err error
+			if data, err = c.Read(r.Path); err != nil {
+				return nil, err
+			}
+			secrets[r.Path] = data
+		}
+		value, ok := data[r.Key]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s has no key %s", r.Path, r.Key)
+		}
+		if s, ok := value.(string); ok {
+			values[name] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("Encoding %s: %v", r, err)
+		}
+		values[name] = string(encoded)
+	}
+	return values, nil
+}
+
+// Sends a request to the API at path with body, decoding the response into out
+func (c *Client) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.addr.String()+"/v1/"+strings.TrimPrefix(path, "/"), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		e := Error{StatusCode: res.StatusCode}
+		json.Unmarshal(data, &e)
+		return e
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,158 @@
+package vault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Reference
+		err  bool
+	}{
+		{s: "secret/data/ci/npm#token", want: Reference{Path: "secret/data/ci/npm", Key: "token"}},
+		{s: "/kv/app/#pass#word", want: Reference{Path: "kv/app/#pass", Key: "word"}},
+		{s: "secret/data/ci/npm", err: true},
+		{s: "#token", err: true},
+		{s: "secret/data/ci#", err: true},
+		{s: "secret/../sys/mounts#type", err: true},
+	}
+	for _, test := range tests {
+		got, err := ParseReference(test.s)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("ParseReference(%q) = %v, %v, want %v, error %v", test.s, got, err, test.want, test.err)
+		}
+	}
+}
+
+// Returns a fake Vault with the secrets by path, where role logs in with the approle or
+// kubernetes auth methods
+func fakeVault(t *testing.T, secrets map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Namespace") != "ci" {
+			t.Errorf("Request without the namespace: %v", r.Header)
+		}
+		switch r.URL.Path {
+		case "/v1/auth/approle/login", "/v1/auth/k8s/login":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["role_id"] != "role" && body["role"] != "role" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors": ["invalid role"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth": {"client_token": "s.token"}}`))
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		data, ok := secrets[r.URL.Path[len("/v1/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+func TestValues(t *testing.T) {
+	server := fakeVault(t, map[string]interface{}{
+		"secret/data/ci/npm": map[string]interface{}{"data": map[string]interface{}{"token": "npm-token", "port": 4873}, "metadata": map[string]interface{}{"version": 3}},
+		"kv/deploy":          map[string]interface{}{"key": "deploy-key"},
+	})
+	defer server.Close()
+	for _, name := range []string{"VAULT_ADDR", "VAULT_NAMESPACE", "SD_VAULT_AUTH", "SD_VAULT_AUTH_MOUNT", "VAULT_ROLE_ID", "VAULT_SECRET_ID"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("VAULT_ADDR", server.URL)
+	os.Setenv("VAULT_NAMESPACE", "ci")
+	os.Setenv("SD_VAULT_AUTH", AuthAppRole)
+	os.Setenv("SD_VAULT_AUTH_MOUNT", "")
+	os.Setenv("VAULT_ROLE_ID", "role")
+	os.Setenv("VAULT_SECRET_ID", "secret")
+
+	c, err := NewFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	values, err := c.Values(map[string]Reference{
+		"NPM_TOKEN":  {Path: "secret/data/ci/npm", Key: "token"},
+		"NPM_PORT":   {Path: "secret/data/ci/npm", Key: "port"},
+		"DEPLOY_KEY": {Path: "kv/deploy", Key: "key"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string]string{"NPM_TOKEN": "npm-token", "NPM_PORT": "4873", "DEPLOY_KEY": "deploy-key"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Values() = %v, want %v", values, want)
+	}
+
+	if _, err := c.Values(map[string]Reference{"NPM_USER": {Path: "secret/data/ci/npm", Key: "user"}}); err == nil {
+		t.Errorf("A missing key should fail")
+	}
+	if _, err := c.Values(map[string]Reference{"OTHER": {Path: "kv/other", Key: "key"}}); err == nil {
+		t.Errorf("A missing secret should fail")
+	}
+
+	os.Setenv("VAULT_ROLE_ID", "other")
+	if _, err := NewFromEnv(); err == nil || err.Error() != "Logging in to Vault with approle: Vault returned status 400: invalid role" {
+		t.Errorf("NewFromEnv() error = %v, want the error of Vault", err)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	server := fakeVault(t, map[string]interface{}{"kv/deploy": map[string]interface{}{"key": "deploy-key"}})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jwtPath := filepath.Join(dir, "token")
+	ioutil.WriteFile(jwtPath, []byte("eyJhbGciOiJSUzI1NiJ9.e30.c2ln\n"), 0600)
+	for _, name := range []string{"VAULT_ADDR", "VAULT_NAMESPACE", "VAULT_TOKEN", "SD_VAULT_AUTH", "SD_VAULT_AUTH_MOUNT", "SD_VAULT_ROLE", "SD_VAULT_JWT_PATH"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+
+	tests := []struct {
+		env map[string]string
+		err bool
+	}{
+		{env: map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "s.token"}},
+		{env: map[string]string{"VAULT_ADDR": server.URL, "SD_VAULT_AUTH": AuthKubernetes, "SD_VAULT_AUTH_MOUNT": "/k8s/", "SD_VAULT_ROLE": "role", "SD_VAULT_JWT_PATH": jwtPath}},
+		{env: map[string]string{"VAULT_ADDR": server.URL}, err: true},
+		{env: map[string]string{"VAULT_ADDR": server.URL, "SD_VAULT_AUTH": AuthKubernetes, "SD_VAULT_ROLE": "role", "SD_VAULT_JWT_PATH": filepath.Join(dir, "missing")}, err: true},
+		{env: map[string]string{"VAULT_ADDR": server.URL, "SD_VAULT_AUTH": "ldap"}, err: true},
+		{env: map[string]string{"VAULT_ADDR": "vault:8200", "VAULT_TOKEN": "s.token"}, err: true},
+		{env: map[string]string{"VAULT_TOKEN": "s.token"}, err: true},
+	}
+	for _, test := range tests {
+		for _, name := range []string{"VAULT_ADDR", "VAULT_TOKEN", "SD_VAULT_AUTH", "SD_VAULT_AUTH_MOUNT", "SD_VAULT_ROLE", "SD_VAULT_JWT_PATH"} {
+			os.Setenv(name, test.env[name])
+		}
+		os.Setenv("VAULT_NAMESPACE", "ci")
+		c, err := NewFromEnv()
+		if (err != nil) != test.err {
+			t.Errorf("NewFromEnv() with %v error = %v, want error %v", test.env, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if data, err := c.Read("kv/deploy"); err != nil || data["key"] != "deploy-key" {
+			t.Errorf("Read() with %v = %v, %v", test.env, data, err)
+		}
+	}
+}